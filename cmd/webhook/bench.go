@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/server"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// Layers of the webhook bench -local can drive.
+const (
+	benchLayerHandler = "handler" // the admission handler, HTTP round trip included
+	benchLayerMutator = "mutator" // decoding the secret, Evaluate and MarshalPatch
+	benchLayerPatch   = "patch"   // a PatchBuilder setting the sync annotation
+)
+
+// runBench implements the bench subcommand: it fires synthetic admissions
+// at a webhook, or at an in-process layer with -local, and reports
+// throughput, latency percentiles, errors and, with -local, allocations.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	var (
+		url           = fs.String("url", "", "webhook URL, e.g. https://localhost:8443/mutate/secrets")
+		local         = fs.Bool("local", false, "drive an in-process layer instead of a URL, to measure its cost alone")
+		layer         = fs.String("layer", benchLayerHandler, "layer driven with -local: handler, mutator or patch")
+		requests      = fs.Int("n", 1000, "number of requests")
+		concurrency   = fs.Int("c", 10, "concurrent requests")
+		secretSize    = fs.Int("secret-size", 2048, "bytes in each of tls.crt and tls.key")
+		syncedPercent = fs.Float64("synced-percent", 0, "percentage of secrets that already carry the sync annotation")
+		bare          = fs.Bool("bare", false, "secrets without annotations, instead of cert-manager's")
+		verify        = fs.Bool("verify-patches", true, "with -layer handler, apply each patch to its secret before answering, as the server does by default")
+		logLevel      = fs.String("log-level", "", "with -local -layer handler, log at this level, info or debug, to a discarded JSON log; no logging when empty")
+		updatePercent = fs.Float64("update-percent", 50, "percentage of UPDATE operations, the rest are CREATE")
+		timeout       = fs.Duration("timeout", 10*time.Second, "timeout of each request")
+		tlsFlags      clientTLSFlags
+	)
+	tlsFlags.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if (*url == "") == !*local || *requests <= 0 || *concurrency <= 0 {
+		fmt.Fprintln(os.Stderr, "bench: set exactly one of -url and -local, and positive -n and -c")
+		return 2
+	}
+
+	if *layer != benchLayerHandler && (!*local || *layer != benchLayerMutator && *layer != benchLayerPatch) {
+		fmt.Fprintln(os.Stderr, "bench: -layer is one of handler, mutator and patch, the last two with -local")
+		return 2
+	}
+
+	var send func(body []byte) (int, error)
+	if *local {
+		settings, err := offlineMutatorConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+			return 2
+		}
+		log := logr.Discard()
+		if *logLevel != "" {
+			if log, err = newDiscardLogger(*logLevel); err != nil {
+				fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+				return 2
+			}
+		}
+		send, err = localBenchLayer(*layer, settings, *verify, log)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+			return 2
+		}
+	} else {
+		tlsConfig, err := tlsFlags.config()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+			return 1
+		}
+		client := &http.Client{
+			Timeout:   *timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, MaxIdleConnsPerHost: *concurrency},
+		}
+		send = func(body []byte) (int, error) {
+			resp, err := client.Post(*url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				return 0, err
+			}
+			defer resp.Body.Close()
+			answer, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return resp.StatusCode, err
+			}
+			return resp.StatusCode, checkBenchResponse(answer)
+		}
+	}
+
+	// build the requests up front so generation isn't measured
+	bodies := make([][]byte, *requests)
+	for i := range bodies {
+		operation := v1beta1.Create
+		if rand.Float64()*100 < *updatePercent {
+			operation = v1beta1.Update
+		}
+		secret := server.FixtureSecret{
+			Name:      fmt.Sprintf("bench-%d", i),
+			Namespace: "bench",
+			DataSize:  *secretSize,
+			Synced:    rand.Float64()*100 < *syncedPercent,
+			Bare:      *bare,
+		}.Build()
+		review, err := server.FixtureReview(secret, operation, true)
+		if err == nil && *layer == benchLayerHandler {
+			bodies[i], err = json.Marshal(review)
+		} else if err == nil {
+			// the lower layers start from the object
+			bodies[i] = review.Request.Object.Raw
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+			return 1
+		}
+	}
+
+	var (
+		next      atomic.Int64
+		errors    atomic.Int64
+		latencies = make([]time.Duration, *requests)
+		wg        sync.WaitGroup
+	)
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1)) - 1
+				if i >= len(bodies) {
+					return
+				}
+				t := time.Now()
+				code, err := send(bodies[i])
+				latencies[i] = time.Since(t)
+				if err != nil || code != http.StatusOK {
+					errors.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	fmt.Printf("requests:    %d (%d concurrent)\n", *requests, *concurrency)
+	fmt.Printf("errors:      %d\n", errors.Load())
+	fmt.Printf("duration:    %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("throughput:  %.1f req/s\n", float64(*requests)/elapsed.Seconds())
+	fmt.Printf("latency:     p50 %s  p90 %s  p99 %s  max %s\n",
+		percentile(.5), percentile(.9), percentile(.99), latencies[len(latencies)-1])
+	if *local {
+		// the process does little else, so its allocations are the layer's
+		fmt.Printf("allocations: %d B/req  %d allocs/req\n",
+			(after.TotalAlloc-before.TotalAlloc)/uint64(*requests), (after.Mallocs-before.Mallocs)/uint64(*requests))
+	}
+	if errors.Load() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// localBenchLayer returns the function sending a body to an in-process
+// layer: a review to the handler, a secret to the others. The handler logs
+// to log, the access log included.
+func localBenchLayer(layer string, settings mutator.Config, verify bool, log logr.Logger) (func(body []byte) (int, error), error) {
+	switch layer {
+	case benchLayerMutator:
+		m, err := mutator.New(settings)
+		if err != nil {
+			return nil, err
+		}
+		return func(body []byte) (int, error) {
+			secret, err := m.DecodeSecret(body)
+			if err != nil {
+				return 0, err
+			}
+			_, patch, err := m.Evaluate(context.Background(), mutator.AdmissionContext{Operation: "CREATE", Secret: secret})
+			if err == nil {
+				_, err = m.MarshalPatch(patch)
+			}
+			return http.StatusOK, err
+		}, nil
+	case benchLayerPatch:
+		return func(body []byte) (int, error) {
+			var secret mutator.SecretMetadata
+			if err := json.Unmarshal(body, &secret); err != nil {
+				return 0, err
+			}
+			patch := mutator.NewPatchBuilder(secret.Secret())
+			patch.AddAnnotation(mutator.SyncAnnotationKey, settings.NamespaceSelector)
+			_, err := patch.Build()
+			return http.StatusOK, err
+		}, nil
+	}
+	handler, err := server.NewHandler(server.Config{Mutator: settings, FailOpen: true, SkipPatchVerification: !verify},
+		server.WithLogger(log), server.WithAccessLog(log, 1))
+	if err != nil {
+		return nil, err
+	}
+	return func(body []byte) (int, error) {
+		rec := server.ServeLocal(context.Background(), handler, body)
+		return rec.Code, checkBenchResponse(rec.Body.Bytes())
+	}, nil
+}
+
+// checkBenchResponse fails on an answer that isn't an allowed AdmissionReview.
+func checkBenchResponse(body []byte) error {
+	var review v1beta1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil {
+		return err
+	}
+	if review.Response == nil || !review.Response.Allowed {
+		return fmt.Errorf("admission not allowed")
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"testing"
+)
+
+// captureStdout runs run and returns its exit code and what it printed.
+func captureStdout(t *testing.T, run func() int) (int, string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	code := run()
+	w.Close()
+	return code, <-out
+}
+
+// benchErrorCount returns the errors bench reported in out.
+func benchErrorCount(out string) string {
+	if match := regexp.MustCompile(`(?m)^errors: +(\d+)$`).FindStringSubmatch(out); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+func TestBenchLocal(t *testing.T) {
+	code, out := captureStdout(t, func() int {
+		return runBench([]string{"-local", "-n", "50", "-c", "4", "-secret-size", "64", "-synced-percent", "50"})
+	})
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, out)
+	}
+	for _, line := range []string{`(?m)^requests: +50 \(4 concurrent\)$`, `(?m)^errors: +0$`, `(?m)^throughput: `, `(?m)^latency: +p50 .* p90 .* p99 .* max `} {
+		if !regexp.MustCompile(line).MatchString(out) {
+			t.Errorf("no line matching %s in:\n%s", line, out)
+		}
+	}
+}
+
+// Against a URL, the requests go over TLS to the webhook, and answers that
+// aren't allowed reviews are counted as errors.
+func TestBenchURL(t *testing.T) {
+	handler := newTestHandler(t)
+	var failing atomic.Bool
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-url", ts.URL + "/mutate", "-ca-file", caFile, "-n", "20", "-c", "2"}
+
+	code, out := captureStdout(t, func() int { return runBench(args) })
+	if code != 0 || benchErrorCount(out) != "0" {
+		t.Fatalf("exit %d against a working webhook:\n%s", code, out)
+	}
+	failing.Store(true)
+	code, out = captureStdout(t, func() int { return runBench(args) })
+	if code != 1 || benchErrorCount(out) != "20" {
+		t.Errorf("exit %d against a failing webhook, want 1 with 20 errors:\n%s", code, out)
+	}
+}
+
+func TestBenchUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-local", "-url", "https://localhost:8443"},
+		{"-local", "-n", "0"},
+	} {
+		if code := runBench(args); code != 2 {
+			t.Errorf("runBench(%q) exit %d, want 2", args, code)
+		}
+	}
+}
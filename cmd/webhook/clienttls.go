@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// clientTLSFlags are the TLS options of the subcommands that call a
+// running webhook.
+type clientTLSFlags struct {
+	caFile             string
+	certFile           string
+	keyFile            string
+	insecureSkipVerify bool
+}
+
+func (f *clientTLSFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.caFile, "ca-file", "", "CA bundle to verify the webhook's serving certificate")
+	fs.StringVar(&f.certFile, "cert-file", "", "client certificate for webhooks requiring mTLS")
+	fs.StringVar(&f.keyFile, "key-file", "", "key of the client certificate")
+	fs.BoolVar(&f.insecureSkipVerify, "insecure-skip-verify", false, "don't verify the webhook's serving certificate")
+}
+
+func (f *clientTLSFlags) config() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: f.insecureSkipVerify}
+	if f.caFile != "" {
+		pem, err := os.ReadFile(f.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", f.caFile)
+		}
+		config.RootCAs = pool
+	}
+	if f.certFile != "" || f.keyFile != "" {
+		pair, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/bygui86/cert-manager-webhook/internal/server"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// Decisions reported by eval.
+const (
+	evalAllowed = "allowed"
+	evalDenied  = "denied"
+	evalError   = "error"
+)
+
+// evalResult is what eval prints for one AdmissionReview.
+type evalResult struct {
+	Decision string                     `json:"decision"`
+	Error    string                     `json:"error,omitempty"`
+	Response *v1beta1.AdmissionResponse `json:"response,omitempty"`
+	Patch    []mutator.PatchOperation   `json:"patch,omitempty"`
+	Metadata *metav1.ObjectMeta         `json:"metadata,omitempty"` // of the secret with the patch applied
+}
+
+// runEval implements the eval subcommand: it reads an AdmissionReview, v1
+// or v1beta1, from stdin or -f, sends it through the same admission handler
+// the server uses and prints the decision, the patch and the secret's
+// metadata after patching. It exits 1 when the review is denied or fails.
+func runEval(args []string) int {
+	fs := flag.NewFlagSet("eval", flag.ContinueOnError)
+	var (
+		file   = fs.String("f", "-", "file holding the AdmissionReview, - for stdin")
+		output = fs.String("output", "pretty", "output format: json, yaml or pretty")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *output != "json" && *output != "yaml" && *output != "pretty" {
+		fmt.Fprintf(os.Stderr, "eval: unknown output format %q\n", *output)
+		return 2
+	}
+
+	var in io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+			return 2
+		}
+		defer f.Close()
+		in = f
+	}
+	body, err := io.ReadAll(in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+		return 2
+	}
+
+	result := evaluate(body)
+	switch *output {
+	case "json":
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+	case "yaml":
+		out, _ := yaml.Marshal(result)
+		fmt.Print(string(out))
+	default:
+		printEvalResult(os.Stdout, result)
+	}
+	if result.Decision != evalAllowed {
+		return 1
+	}
+	return 0
+}
+
+// evaluate runs body through the admission handler. Nothing is audited,
+// recorded or sent to the cluster.
+func evaluate(body []byte) evalResult {
+	settings, err := offlineMutatorConfig()
+	if err != nil {
+		return evalResult{Decision: evalError, Error: err.Error()}
+	}
+	handler, err := server.NewHandler(server.Config{Mutator: settings})
+	if err != nil {
+		return evalResult{Decision: evalError, Error: err.Error()}
+	}
+	rec := server.ServeLocal(context.Background(), handler, body)
+	if rec.Code != http.StatusOK {
+		return evalResult{Decision: evalError, Error: fmt.Sprintf("admission handler answered %d: %s", rec.Code, rec.Body.String())}
+	}
+
+	var answer v1beta1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil {
+		return evalResult{Decision: evalError, Error: fmt.Sprintf("decoding response: %v", err)}
+	}
+	result := evalResult{Decision: evalAllowed, Response: answer.Response}
+	if answer.Response == nil {
+		result.Decision, result.Error = evalError, "response has no AdmissionResponse"
+		return result
+	}
+	if !answer.Response.Allowed {
+		result.Decision = evalDenied
+		if answer.Response.Result != nil {
+			result.Error = answer.Response.Result.Message
+		}
+		return result
+	}
+	if len(answer.Response.Patch) == 0 {
+		return result
+	}
+
+	if err := json.Unmarshal(answer.Response.Patch, &result.Patch); err != nil {
+		result.Decision, result.Error = evalError, fmt.Sprintf("decoding patch: %v", err)
+		return result
+	}
+	var review v1beta1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		return result
+	}
+	mutated, err := server.ApplyPatch(review.Request.Object.Raw, answer.Response.Patch)
+	if err != nil {
+		result.Decision, result.Error = evalError, err.Error()
+		return result
+	}
+	result.Metadata = &mutated.ObjectMeta
+	return result
+}
+
+func printEvalResult(w io.Writer, result evalResult) {
+	fmt.Fprintf(w, "decision: %s\n", result.Decision)
+	if result.Response != nil {
+		fmt.Fprintf(w, "uid:      %s\n", result.Response.UID)
+	}
+	if result.Error != "" {
+		fmt.Fprintf(w, "error:    %s\n", result.Error)
+	}
+	if len(result.Patch) > 0 {
+		fmt.Fprintln(w, "patch:")
+		for _, op := range result.Patch {
+			value, _ := json.Marshal(op.Value)
+			fmt.Fprintf(w, "  %-7s %s %s\n", op.Op, op.Path, value)
+		}
+	}
+	if result.Metadata != nil {
+		fmt.Fprintf(w, "secret:   %s/%s\n", result.Metadata.Namespace, result.Metadata.Name)
+		printSortedMap(w, "annotations", result.Metadata.Annotations)
+		printSortedMap(w, "labels", result.Metadata.Labels)
+	}
+}
+
+func printSortedMap(w io.Writer, title string, m map[string]string) {
+	if len(m) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "  %s:\n", title)
+	for _, key := range keys {
+		fmt.Fprintf(w, "    %s: %s\n", key, m[key])
+	}
+}
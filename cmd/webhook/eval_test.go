@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/bygui86/cert-manager-webhook/internal/server"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// A request recorded by the server is evaluated by eval as the server
+// decided it.
+func TestEvaluateRecordedRequest(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := server.NewRequestRecorder(logr.Discard(), dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := server.NewHandler(server.DefaultConfig(), server.WithRequestRecorder(recorder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(secretReview(t, "tls", "apps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ServeLocal(context.Background(), handler, body)
+	recorder.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("recordings %v: %v", files, err)
+	}
+	recorded, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := evaluate(recorded)
+	if result.Decision != evalAllowed || len(result.Patch) == 0 || result.Metadata == nil {
+		t.Fatalf("eval of the recording: %+v", result)
+	}
+	if result.Metadata.Annotations[mutator.SyncAnnotationKey] == "" {
+		t.Errorf("eval of the recording set no sync annotation: %v", result.Metadata.Annotations)
+	}
+}
+
+// writeReview writes review to a file, in apiVersion, and returns its path.
+func writeReview(t *testing.T, review *v1beta1.AdmissionReview, apiVersion string) string {
+	t.Helper()
+	review.APIVersion = apiVersion
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "review.json")
+	if err := os.WriteFile(path, body, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEvalOutputs(t *testing.T) {
+	for _, apiVersion := range []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1"} {
+		path := writeReview(t, secretReview(t, "tls", "apps"), apiVersion)
+		t.Run(apiVersion, func(t *testing.T) {
+			code, out := captureStdout(t, func() int { return runEval([]string{"-f", path, "-output", "json"}) })
+			var result evalResult
+			if err := json.Unmarshal([]byte(out), &result); err != nil || code != 0 {
+				t.Fatalf("exit %d, %v: %s", code, err, out)
+			}
+			if result.Decision != evalAllowed || result.Metadata.Annotations[mutator.SyncAnnotationKey] == "" {
+				t.Errorf("json result %+v, want the secret allowed and annotated", result)
+			}
+
+			code, out = captureStdout(t, func() int { return runEval([]string{"-f", path, "-output", "yaml"}) })
+			result = evalResult{}
+			if err := yaml.Unmarshal([]byte(out), &result); err != nil || code != 0 || result.Decision != evalAllowed {
+				t.Errorf("yaml exit %d, %v: %s", code, err, out)
+			}
+
+			code, out = captureStdout(t, func() int { return runEval([]string{"-f", path}) })
+			for _, line := range []string{"decision: allowed\n", "patch:\n", "secret:   apps/tls\n", "    " + mutator.SyncAnnotationKey + ": "} {
+				if code != 0 || !strings.Contains(out, line) {
+					t.Errorf("pretty exit %d, no %q in:\n%s", code, line, out)
+				}
+			}
+		})
+	}
+}
+
+// A review from stdin that the webhook denies, here one of an object that
+// isn't a secret, or can't answer, exits 1; bad usage exits 2.
+func TestEvalExitCodes(t *testing.T) {
+	denied := secretReview(t, "tls", "apps")
+	denied.Request.Object.Raw = []byte(`{"apiVersion":"v1","kind":"Secret","metadata":"broken"}`)
+	deniedPath := writeReview(t, denied, "admission.k8s.io/v1")
+	emptyPath := filepath.Join(t.TempDir(), "empty.json")
+	if err := os.WriteFile(emptyPath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		stdin    string
+		args     []string
+		code     int
+		decision string
+	}{
+		{name: "denied", stdin: deniedPath, code: 1, decision: evalDenied},
+		{name: "error", stdin: emptyPath, code: 1, decision: evalError},
+		{name: "unknown output", args: []string{"-f", deniedPath, "-output", "xml"}, code: 2},
+		{name: "missing file", args: []string{"-f", filepath.Join(t.TempDir(), "missing.json")}, code: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.stdin != "" {
+				in, err := os.Open(tt.stdin)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer in.Close()
+				stdin := os.Stdin
+				os.Stdin = in
+				defer func() { os.Stdin = stdin }()
+			}
+			code, out := captureStdout(t, func() int { return runEval(append([]string{"-output", "json"}, tt.args...)) })
+			if code != tt.code {
+				t.Errorf("exit %d, want %d: %s", code, tt.code, out)
+			}
+			if tt.decision == "" {
+				return
+			}
+			var result evalResult
+			if err := json.Unmarshal([]byte(out), &result); err != nil || result.Decision != tt.decision || result.Error == "" {
+				t.Errorf("result %+v, %v, want %s with the reason", result, err, tt.decision)
+			}
+		})
+	}
+}
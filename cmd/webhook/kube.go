@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/bygui86/cert-manager-webhook/internal/server"
+)
+
+// kubeClientFunc returns the clientset the cluster features share, built on
+// first use so that a webhook without them never needs cluster access.
+type kubeClientFunc func() (kubernetes.Interface, error)
+
+// newKubeClient builds a clientset from the kubeconfig given with
+// --kubeconfig, e.g. for a local or test API server, or else from the pod's
+// service account.
+func newKubeClient() (kubernetes.Interface, error) {
+	config, err := kubeRestConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// newDynamicClient builds a dynamic client for the custom resources, like
+// newKubeClient.
+func newDynamicClient() (dynamic.Interface, error) {
+	config, err := kubeRestConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+func kubeRestConfig() (*rest.Config, error) {
+	if *kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	}
+	return rest.InClusterConfig()
+}
+
+// kubeClientFor builds a clientset from the kubeconfig at path, or from the
+// pod's service account when path is empty.
+func kubeClientFor(path string) (kubernetes.Interface, error) {
+	config, err := restConfigFor(path)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// dynamicClientFor builds a dynamic client like kubeClientFor.
+func dynamicClientFor(path string) (dynamic.Interface, error) {
+	config, err := restConfigFor(path)
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+func restConfigFor(path string) (*rest.Config, error) {
+	if path != "" {
+		return clientcmd.BuildConfigFromFlags("", path)
+	}
+	return rest.InClusterConfig()
+}
+
+// apiNamespaces looks namespaces up on the API server for the subcommands,
+// which run too briefly for an informer cache, fetching each one once.
+type apiNamespaces struct {
+	ctx    context.Context
+	client kubernetes.Interface
+	mu     sync.Mutex
+	cache  map[string]*corev1.Namespace
+}
+
+func newAPINamespaces(ctx context.Context, client kubernetes.Interface) *apiNamespaces {
+	return &apiNamespaces{ctx: ctx, client: client, cache: map[string]*corev1.Namespace{}}
+}
+
+func (n *apiNamespaces) Get(name string) (*corev1.Namespace, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if namespace, ok := n.cache[name]; ok {
+		return namespace, nil
+	}
+	namespace, err := n.client.CoreV1().Namespaces().Get(n.ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	n.cache[name] = namespace
+	return namespace, nil
+}
+
+// apiCertificates looks Certificates up on the API server for the
+// subcommands, like apiNamespaces.
+type apiCertificates struct {
+	ctx    context.Context
+	client dynamic.Interface
+}
+
+func newAPICertificates(ctx context.Context, client dynamic.Interface) *apiCertificates {
+	return &apiCertificates{ctx: ctx, client: client}
+}
+
+func (c *apiCertificates) DNSNames(namespace, name string) ([]string, error) {
+	certificate, err := c.client.Resource(server.CertificatesResource).Namespace(namespace).Get(c.ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return server.CertificateDNSNames(certificate)
+}
+
+// apiIngresses lists the Ingresses on the API server for the subcommands,
+// once, on first use.
+type apiIngresses struct {
+	list func() ([]*networkingv1.Ingress, error)
+}
+
+func newAPIIngresses(ctx context.Context, client kubernetes.Interface) *apiIngresses {
+	return &apiIngresses{list: sync.OnceValues(func() ([]*networkingv1.Ingress, error) {
+		var ingresses []*networkingv1.Ingress
+		opts := metav1.ListOptions{Limit: 500}
+		for {
+			list, err := client.NetworkingV1().Ingresses("").List(ctx, opts)
+			if err != nil {
+				return nil, err
+			}
+			for i := range list.Items {
+				ingresses = append(ingresses, &list.Items[i])
+			}
+			if list.Continue == "" {
+				return ingresses, nil
+			}
+			opts.Continue = list.Continue
+		}
+	})}
+}
+
+func (i *apiIngresses) List(selector labels.Selector) ([]*networkingv1.Ingress, error) {
+	ingresses, err := i.list()
+	if err != nil {
+		return nil, err
+	}
+	var selected []*networkingv1.Ingress
+	for _, ingress := range ingresses {
+		if selector.Matches(labels.Set(ingress.Labels)) {
+			selected = append(selected, ingress)
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// newLogger builds the process logger. format is "json" or "text" and level
+// one of "debug", "info" or "error"; debug enables logr's V(1) lines. The
+// returned level can be changed at runtime.
+func newLogger(format, level string) (logr.Logger, zap.AtomicLevel, error) {
+	var config zap.Config
+	switch format {
+	case "json":
+		config = zap.NewProductionConfig()
+	case "text":
+		config = zap.NewDevelopmentConfig()
+		config.Development = false
+	default:
+		return logr.Discard(), zap.AtomicLevel{}, fmt.Errorf("unknown log format %q, expected json or text", format)
+	}
+
+	zapLevel, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return logr.Discard(), zap.AtomicLevel{}, err
+	}
+	config.Level = zap.NewAtomicLevelAt(zapLevel)
+	config.Sampling = nil
+	config.DisableStacktrace = true
+	config.EncoderConfig.TimeKey = "ts"
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	zapLogger, err := config.Build()
+	if err != nil {
+		return logr.Discard(), zap.AtomicLevel{}, err
+	}
+	return zapr.NewLogger(zapLogger), config.Level, nil
+}
+
+// newDiscardLogger returns a logger at level that encodes its lines as the
+// JSON process logger does and drops them, for bench to measure logging.
+func newDiscardLogger(level string) (logr.Logger, error) {
+	zapLevel, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return logr.Discard(), err
+	}
+	encoder := zap.NewProductionEncoderConfig()
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoder), zapcore.AddSync(io.Discard), zapLevel)
+	return zapr.NewLogger(zap.New(core)), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestNewLogger(t *testing.T) {
+	for _, format := range []string{"json", "text"} {
+		log, level, err := newLogger(format, "debug")
+		if err != nil {
+			t.Fatalf("format %s: %v", format, err)
+		}
+		if level.Level() != zapcore.DebugLevel {
+			t.Errorf("format %s: level %v, want debug", format, level.Level())
+		}
+		if !log.V(1).Enabled() {
+			t.Errorf("format %s: V(1) disabled at debug level", format)
+		}
+	}
+
+	log, level, err := newLogger("json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.V(1).Enabled() {
+		t.Error("V(1) enabled at info level")
+	}
+	// the level is shared with the logger, as /debug/loglevel needs
+	level.SetLevel(zapcore.DebugLevel)
+	if !log.V(1).Enabled() {
+		t.Error("V(1) still disabled after raising the level")
+	}
+
+	for format, level := range map[string]string{"logfmt": "info", "json": "verbose"} {
+		if _, _, err := newLogger(format, level); err == nil {
+			t.Errorf("newLogger(%q, %q) accepted", format, level)
+		}
+	}
+}
@@ -0,0 +1,1061 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/errgroup"
+	"sigs.k8s.io/yaml"
+
+	"github.com/bygui86/cert-manager-webhook/internal/certs"
+	"github.com/bygui86/cert-manager-webhook/internal/env"
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/internal/server"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+var (
+	logFormat             = flag.String("log-format", env.String("LOG_FORMAT", "json"), "log output format, json or text")
+	logLevel              = flag.String("log-level", env.String("LOG_LEVEL", "info"), "log level: debug, info or error; debug also logs decoded objects and patches (secret data is always redacted)")
+	certReloadInterval    = flag.Duration("cert-reload-interval", env.Duration("CERT_RELOAD_INTERVAL", time.Minute), "how often to check the key pair files for changes")
+	maxRequestBodyBytes   = flag.Int64("max-request-body-bytes", env.Int64("MAX_REQUEST_BODY_BYTES", 3<<20), "maximum size of a (decompressed) admission request body")
+	rateLimit             = flag.Float64("rate-limit", env.Float64("RATE_LIMIT", 0), "global admission requests per second, 0 disables")
+	rateLimitBurst        = flag.Int("rate-limit-burst", int(env.Int64("RATE_LIMIT_BURST", 100)), "global admission burst size")
+	clientRateLimit       = flag.Float64("client-rate-limit", env.Float64("CLIENT_RATE_LIMIT", 0), "admission requests per second per source IP, 0 disables")
+	clientRateLimitBurst  = flag.Int("client-rate-limit-burst", int(env.Int64("CLIENT_RATE_LIMIT_BURST", 20)), "admission burst size per source IP")
+	rateLimitStrict       = flag.Bool("rate-limit-strict", env.Bool("RATE_LIMIT_STRICT", false), "reject over-limit requests with 429 instead of allowing them without a patch")
+	shutdownDelay         = flag.Duration("shutdown-delay", env.Duration("SHUTDOWN_DELAY", 5*time.Second), "time to keep serving after reporting not ready on shutdown, so the endpoint is removed from the Service first")
+	shutdownTimeout       = flag.Duration("shutdown-timeout", env.Duration("SHUTDOWN_TIMEOUT", 15*time.Second), "time allowed for in-flight requests to drain on shutdown")
+	readHeaderTimeout     = flag.Duration("read-header-timeout", env.Duration("READ_HEADER_TIMEOUT", 5*time.Second), "time allowed to read request headers")
+	readTimeout           = flag.Duration("read-timeout", env.Duration("READ_TIMEOUT", 10*time.Second), "time allowed to read a whole request")
+	writeTimeout          = flag.Duration("write-timeout", env.Duration("WRITE_TIMEOUT", 10*time.Second), "time allowed from the end of the request headers until the response is written")
+	idleTimeout           = flag.Duration("idle-timeout", env.Duration("IDLE_TIMEOUT", 90*time.Second), "time an idle keep-alive connection is kept open")
+	bindAddress           = flag.String("bind-address", env.String("BIND_ADDRESS", ""), "address to bind the webhook port to, all interfaces when empty")
+	listenSpec            = flag.String("listen", env.String("LISTEN", ""), "listen on unix:///path/to/socket instead of the TLS port; TLS is left to the fronting proxy")
+	opsPort               = flag.Int("ops-port", int(env.Int64("OPS_PORT", 8081)), "plain HTTP port for health, metrics and debug endpoints")
+	opsBindAddress        = flag.String("ops-bind-address", env.String("OPS_BIND_ADDRESS", ""), "address to bind the ops port to, all interfaces when empty")
+	disableHTTP2          = flag.Bool("disable-http2", env.Bool("DISABLE_HTTP2", false), "serve HTTP/1.1 only")
+	maxHeaderBytes        = flag.Int("max-header-bytes", int(env.Int64("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)), "maximum size of request headers")
+	disableKeepAlives     = flag.Bool("disable-keepalives", env.Bool("DISABLE_KEEPALIVES", false), "close connections after each request")
+	clientCAFile          = flag.String("client-ca-file", env.String("CLIENT_CA_FILE", ""), "require client certificates signed by a CA in this bundle")
+	clientCAFromCluster   = flag.Bool("client-ca-from-cluster", env.Bool("CLIENT_CA_FROM_CLUSTER", false), "require client certificates signed by the API server's client CA from the extension-apiserver-authentication ConfigMap")
+	auditLogPath          = flag.String("audit-log-path", env.String("AUDIT_LOG_PATH", ""), "write a JSON line per admission decision to this file, \"-\" for stdout")
+	auditLogMaxSize       = flag.Int64("audit-log-max-size", env.Int64("AUDIT_LOG_MAX_SIZE", 100<<20), "rotate the audit log at this many bytes, 0 disables rotation")
+	auditLogMaxBackups    = flag.Int("audit-log-max-backups", int(env.Int64("AUDIT_LOG_MAX_BACKUPS", 5)), "number of rotated audit logs to keep")
+	enablePprof           = flag.Bool("enable-pprof", env.Bool("ENABLE_PPROF", false), "serve net/http/pprof under /debug/pprof/ on the ops listener")
+	blockProfileRate      = flag.Int("block-profile-rate", int(env.Int64("BLOCK_PROFILE_RATE", 0)), "runtime.SetBlockProfileRate value when pprof is enabled")
+	mutexProfileFraction  = flag.Int("mutex-profile-fraction", int(env.Int64("MUTEX_PROFILE_FRACTION", 0)), "runtime.SetMutexProfileFraction value when pprof is enabled")
+	accessLogEnabled      = flag.Bool("access-log", env.Bool("ACCESS_LOG", true), "log one line per HTTP request")
+	accessLogSample       = flag.Uint64("access-log-sample", uint64(env.Int64("ACCESS_LOG_SAMPLE", 1)), "log only one in every N successful requests")
+	opsTokenFile          = flag.String("ops-token-file", env.String("OPS_TOKEN_FILE", ""), "file holding a bearer token required for the metrics and debug endpoints")
+	opsTokenReview        = flag.Bool("ops-token-review", env.Bool("OPS_TOKEN_REVIEW", false), "verify bearer tokens for the metrics and debug endpoints with a TokenReview")
+	certExpiryWarningDays = flag.String("cert-expiry-warning-days", env.String("CERT_EXPIRY_WARNING_DAYS", "30,7,1"), "comma separated days before certificate expiry at which to log a warning")
+	servingDNSNames       = flag.String("serving-dns-names", env.String("SERVING_DNS_NAMES", ""), "comma separated DNS names the serving certificate must cover, e.g. those of the webhook Service")
+	tracingEndpoint       = flag.String("tracing-endpoint", env.String("TRACING_ENDPOINT", ""), "OTLP/HTTP endpoint URL to export admission traces to, tracing is disabled when empty")
+	tracingSampleRate     = flag.Float64("tracing-sample-rate", env.Float64("TRACING_SAMPLE_RATE", 0.1), "fraction of admissions to trace when the API server sent no sampling decision")
+	emitEvents            = flag.Bool("emit-events", env.Bool("EMIT_EVENTS", false), "record Kubernetes Events on annotated, skipped and failed secrets; needs RBAC to create events")
+	reconcileConfig       = flag.Bool("reconcile-webhook-config", env.Bool("RECONCILE_WEBHOOK_CONFIG", false), "keep the caBundle and rules of the MutatingWebhookConfiguration in step, with leader election")
+	watchWebhookConfig    = flag.Bool("watch-webhook-config", env.Bool("WATCH_WEBHOOK_CONFIG", false), "report drift of the MutatingWebhookConfiguration from the webhook's settings, with leader election; never writes")
+	webhookConfigName     = flag.String("webhook-config-name", env.String("WEBHOOK_CONFIG_NAME", ""), "name of the MutatingWebhookConfiguration to reconcile")
+	caBundleFile          = flag.String("ca-bundle-file", env.String("CA_BUNDLE_FILE", ""), "PEM file with the CA that signed the serving certificate, for the caBundle")
+	enableBackfill        = flag.Bool("enable-backfill-controller", env.Bool("ENABLE_BACKFILL_CONTROLLER", false), "annotate the secrets that existed before the webhook, with leader election")
+	backfillDryRun        = flag.Bool("backfill-dry-run", env.Bool("BACKFILL_DRY_RUN", false), "log the patches of the backfill controller instead of sending them")
+	backfillRate          = flag.Float64("backfill-rate", env.Float64("BACKFILL_RATE", 5), "secrets the backfill controller patches per second")
+	backfillBurst         = flag.Int("backfill-burst", int(env.Int64("BACKFILL_BURST", 10)), "secrets the backfill controller patches at once")
+	eligibilityInterval   = flag.Duration("eligibility-interval", env.Duration("ELIGIBILITY_INTERVAL", time.Minute), "how often the backfill controller computes the eligible secrets gauges, never when 0")
+	eligibilityTopN       = flag.Int("eligibility-top-namespaces", int(env.Int64("ELIGIBILITY_TOP_NAMESPACES", 20)), "namespaces the eligible secrets gauges are labelled with, the rest summed as other")
+	statusConfigMap       = flag.String("status-configmap", env.String("STATUS_CONFIGMAP", ""), "name of the ConfigMap in POD_NAMESPACE the leader writes recent decisions to, none when empty")
+	statusInterval        = flag.Duration("status-interval", env.Duration("STATUS_INTERVAL", 30*time.Second), "how often the status ConfigMap is written, when it changed")
+	enableNamespaceResync = flag.Bool("enable-namespace-resync", env.Bool("ENABLE_NAMESPACE_RESYNC", false), "touch the managed secrets selecting a namespace when it is created, with leader election")
+	resyncBatchWindow     = flag.Duration("resync-batch-window", env.Duration("RESYNC_BATCH_WINDOW", 10*time.Second), "how long namespace creations are collected before the secrets are touched")
+	resyncRate            = flag.Float64("resync-rate", env.Float64("RESYNC_RATE", 5), "secrets touched per second")
+	resyncBurst           = flag.Int("resync-burst", int(env.Int64("RESYNC_BURST", 10)), "secrets touched at once")
+	enableReplicaGC       = flag.Bool("enable-replica-gc", env.Bool("ENABLE_REPLICA_GC", false), "delete the kubed copies whose source is gone or no longer synced, with leader election")
+	replicaGCGracePeriod  = flag.Duration("replica-gc-grace-period", env.Duration("REPLICA_GC_GRACE_PERIOD", time.Hour), "how long a copy stays orphaned before it is deleted")
+	replicaGCDryRun       = flag.Bool("replica-gc-dry-run", env.Bool("REPLICA_GC_DRY_RUN", false), "log the deletions of orphaned copies instead of making them")
+	enableDriftScan       = flag.Bool("enable-drift-scan", env.Bool("ENABLE_DRIFT_SCAN", false), "periodically compare the managed secrets with the policy, with leader election")
+	driftScanInterval     = flag.Duration("drift-scan-interval", env.Duration("DRIFT_SCAN_INTERVAL", time.Hour), "time between drift scans")
+	driftScanBatchSize    = flag.Int64("drift-scan-batch-size", env.Int64("DRIFT_SCAN_BATCH_SIZE", 500), "secrets listed per request by the drift scan")
+	driftScanNamespace    = flag.String("drift-scan-namespace", env.String("DRIFT_SCAN_NAMESPACE", ""), "namespace the drift scan is limited to, all when empty")
+	remediateDrift        = flag.Bool("remediate-drift", env.Bool("REMEDIATE_DRIFT", false), "patch drifted managed secrets back to the policy")
+	podNamespace          = flag.String("leader-election-namespace", env.String("POD_NAMESPACE", "default"), "namespace of the leader election Lease")
+	leaseName             = flag.String("leader-election-lease-name", env.String("LEADER_ELECTION_LEASE_NAME", server.DefaultLeaseName), "name of the Lease the replicas elect the one running the controllers on")
+	leaseDuration         = flag.Duration("leader-election-lease-duration", env.Duration("LEADER_ELECTION_LEASE_DURATION", server.DefaultLeaderElection().LeaseDuration), "how long the replicas wait before taking over a lease that wasn't renewed")
+	leaseRenewDeadline    = flag.Duration("leader-election-renew-deadline", env.Duration("LEADER_ELECTION_RENEW_DEADLINE", server.DefaultLeaderElection().RenewDeadline), "how long the leader tries to renew the lease before stopping the controllers")
+	leaseRetryPeriod      = flag.Duration("leader-election-retry-period", env.Duration("LEADER_ELECTION_RETRY_PERIOD", server.DefaultLeaderElection().RetryPeriod), "time between attempts to acquire or renew the lease")
+	maxConcurrent         = flag.Int("max-concurrent-admissions", int(env.Int64("MAX_CONCURRENT_ADMISSIONS", int64(4*runtime.GOMAXPROCS(0)))), "admissions evaluated at once, 0 disables the cap; defaults to 4 per GOMAXPROCS")
+	admissionQueueTimeout = flag.Duration("admission-queue-timeout", env.Duration("ADMISSION_QUEUE_TIMEOUT", 250*time.Millisecond), "time an admission waits for a free slot before it is shed")
+	skipOperatorCheck     = flag.Bool("skip-operator-check", env.Bool("SKIP_OPERATOR_CHECK", false), "don't check whether kubed/config-syncer is installed")
+	operatorCheckInterval = flag.Duration("operator-check-interval", env.Duration("OPERATOR_CHECK_INTERVAL", 10*time.Minute), "how often to check whether kubed/config-syncer is installed")
+	activeProbe           = flag.Bool("active-probe", env.Bool("ENABLE_ACTIVE_PROBE", false), "periodically dry-run a marker secret through the API server and check the webhook mutated it")
+	activeProbeInterval   = flag.Duration("active-probe-interval", env.Duration("ACTIVE_PROBE_INTERVAL", server.DefaultActiveProbe().Interval), "time between active probes")
+	activeProbeNamespace  = flag.String("active-probe-namespace", env.String("ACTIVE_PROBE_NAMESPACE", server.DefaultActiveProbe().Namespace), "namespace the active probe's marker secret is dry-run created in")
+	activeProbeFailures   = flag.Int("active-probe-failure-threshold", int(env.Int64("ACTIVE_PROBE_FAILURE_THRESHOLD", int64(server.DefaultActiveProbe().FailureThreshold))), "consecutive failed active probes after which /readyz fails")
+	activeProbeSuccesses  = flag.Int("active-probe-success-threshold", int(env.Int64("ACTIVE_PROBE_SUCCESS_THRESHOLD", int64(server.DefaultActiveProbe().SuccessThreshold))), "consecutive successful active probes after which /readyz passes again")
+	activeProbeReadiness  = flag.Bool("active-probe-readiness", env.Bool("ACTIVE_PROBE_READINESS", true), "fail /readyz while the active probe fails; otherwise only export its result")
+	metricsMaxLabelValues = flag.Int("metrics-max-label-values", int(env.Int64("METRICS_MAX_LABEL_VALUES", metrics.DefaultMaxLabelValues)), "distinct values each label of a metric takes before new ones are counted as other, 0 for no cap")
+	metricsLabelAllowlist = flag.String("metrics-label-allowlist", env.String("METRICS_LABEL_ALLOWLIST", ""), "the only values of a label given their own series, e.g. \"namespace=payments,checkout;rule=prod\"; others are counted as other")
+	metricsSink           = flag.String("metrics-sink", env.String("METRICS_SINK", "prometheus"), "comma separated metrics sinks: prometheus serves /metrics, statsd and otlp push counters and histograms")
+	metricsPushInterval   = flag.Duration("metrics-push-interval", env.Duration("METRICS_PUSH_INTERVAL", 10*time.Second), "how often the statsd and otlp sinks push the metrics")
+	statsdAddress         = flag.String("statsd-address", env.String("STATSD_ADDRESS", metrics.DefaultStatsD().Address), "host:port of the StatsD server the statsd sink sends to over UDP")
+	statsdPrefix          = flag.String("statsd-prefix", env.String("STATSD_PREFIX", ""), "prefix of the metric names sent to StatsD, joined with a dot")
+	otlpMetricsEndpoint   = flag.String("otlp-metrics-endpoint", env.String("OTLP_METRICS_ENDPOINT", ""), "OTLP/HTTP endpoint URL the otlp sink exports the metrics to, /v1/metrics when it has no path")
+	errorReportURL        = flag.String("error-report-url", env.String("ERROR_REPORT_URL", ""), "URL to post JSON reports of panics and repeated admission errors to, disabled when empty")
+	errorReportDSN        = flag.String("error-report-dsn", env.String("ERROR_REPORT_DSN", ""), "Sentry DSN to send panics and repeated admission errors to as Sentry events, instead of --error-report-url")
+	errorReportThreshold  = flag.Int("error-report-threshold", int(env.Int64("ERROR_REPORT_THRESHOLD", int64(server.DefaultErrorReporter().Threshold))), "times the same admission error must occur within --error-report-window to be reported")
+	errorReportWindow     = flag.Duration("error-report-window", env.Duration("ERROR_REPORT_WINDOW", server.DefaultErrorReporter().Window), "window errors are counted in, and a panic or an error reported at most once in")
+	recentDecisions       = flag.Int("recent-decisions", int(env.Int64("RECENT_DECISIONS", server.DefaultRecentDecisions)), "admission decisions kept in memory for /decisions, 0 disables")
+	logSample             = flag.Uint64("log-sample", uint64(env.Int64("LOG_SAMPLE", 1)), "log only every Nth repeated identical decision per namespace; first and changed decisions per secret are always logged")
+	decisionCacheSize     = flag.Int("decision-cache-size", int(env.Int64("DECISION_CACHE_SIZE", 1024)), "admission decisions remembered by request UID to answer API server retries, 0 disables")
+	decisionCacheTTL      = flag.Duration("decision-cache-ttl", env.Duration("DECISION_CACHE_TTL", 30*time.Second), "how long a decision is replayed to retries of its request")
+	logSummaryInterval    = flag.Duration("log-summary-interval", env.Duration("LOG_SUMMARY_INTERVAL", 5*time.Minute), "how often to log decision counts when log sampling is enabled, 0 disables")
+	slowRequestThreshold  = flag.Duration("slow-request-threshold", env.Duration("SLOW_REQUEST_THRESHOLD", 2*time.Second), "log a warning for admissions taking longer, 0 disables")
+	recordRequests        = flag.String("record-requests", env.String("RECORD_REQUESTS", ""), "debug: write sanitised AdmissionReview fixtures of incoming requests to this directory")
+	recordMaxFiles        = flag.Int("record-requests-max-files", int(env.Int64("RECORD_REQUESTS_MAX_FILES", 1000)), "number of recorded requests to keep")
+	recordMaxBytes        = flag.Int64("record-requests-max-bytes", env.Int64("RECORD_REQUESTS_MAX_BYTES", 100<<20), "total size of recorded requests to keep")
+	enableFaultInjection  = flag.Bool("enable-fault-injection", env.Bool("ENABLE_FAULT_INJECTION", false), "testing only: allow the --inject-* flags")
+	injectLatency         = flag.Duration("inject-latency", env.Duration("INJECT_LATENCY", 0), "testing only: delay added to sampled admissions")
+	injectLatencyPercent  = flag.Float64("inject-latency-percent", env.Float64("INJECT_LATENCY_PERCENT", 0), "testing only: percentage of admissions delayed by --inject-latency")
+	injectErrorPercent    = flag.Float64("inject-error-percent", env.Float64("INJECT_ERROR_PERCENT", 0), "testing only: percentage of admissions failed with an HTTP 500")
+	mutationStages        = flag.String("mutation-stages", env.String("MUTATION_STAGES", strings.Join(mutator.DefaultStages, ",")), "comma separated mutation stages to run, in order")
+	mutationStageConfig   = flag.String("mutation-stage-config", env.String("MUTATION_STAGE_CONFIG", ""), "YAML or JSON file with the settings of the mutation stages, by stage name")
+	freezeWindowsFile     = flag.String("freeze-windows-file", env.String("FREEZE_WINDOWS_FILE", ""), "YAML or JSON file with the change freeze windows, during which admissions aren't patched; re-read when it changes")
+	clusterProfile        = flag.String("profile", env.String("CLUSTER_PROFILE", ""), "cluster profile of the stage settings file to run with")
+	clusterProfileSource  = flag.String("profile-source", env.String("CLUSTER_PROFILE_SOURCE", ""), "object naming the cluster profile when --profile is empty: namespace/<name> or configmap/<namespace>/<name>")
+	clusterProfileKey     = flag.String("profile-key", env.String("CLUSTER_PROFILE_KEY", defaultProfileKey), "label or annotation of the --profile-source object holding the profile name")
+	clusterName           = flag.String("cluster-name", env.String("CLUSTER_NAME", ""), "name of the cluster written in the cert-sync.bygui86.io/cluster annotation")
+	clusterNameConfigMap  = flag.String("cluster-name-configmap", env.String("CLUSTER_NAME_CONFIGMAP", ""), "ConfigMap, <namespace>/<name>, holding the cluster name when --cluster-name is empty")
+	clusterNameKey        = flag.String("cluster-name-key", env.String("CLUSTER_NAME_KEY", defaultClusterNameKey), "key of the --cluster-name-configmap ConfigMap holding the cluster name")
+	rewriteDecision       = flag.Bool("rewrite-decision-on-config-change", env.Bool("REWRITE_DECISION_ON_CONFIG_CHANGE", false), "update the recorded decision of secrets whose rule didn't change when the settings did")
+	downstreamURL         = flag.String("downstream-webhook-url", env.String("DOWNSTREAM_WEBHOOK_URL", ""), "URL of a mutating webhook to forward every admission to, merging its patch after ours")
+	downstreamCAFile      = flag.String("downstream-webhook-ca-file", env.String("DOWNSTREAM_WEBHOOK_CA_FILE", ""), "CA bundle to verify the downstream webhook's serving certificate, the system roots when empty")
+	downstreamCertFile    = flag.String("downstream-webhook-cert-file", env.String("DOWNSTREAM_WEBHOOK_CERT_FILE", ""), "client certificate for a downstream webhook requiring mTLS")
+	downstreamKeyFile     = flag.String("downstream-webhook-key-file", env.String("DOWNSTREAM_WEBHOOK_KEY_FILE", ""), "key of the downstream webhook client certificate")
+	downstreamTimeout     = flag.Duration("downstream-webhook-timeout", env.Duration("DOWNSTREAM_WEBHOOK_TIMEOUT", 5*time.Second), "time allowed for the downstream webhook to answer; must leave room within the write timeout")
+	kubeconfig            = flag.String("kubeconfig", env.String("KUBECONFIG", ""), "kubeconfig to reach the cluster with instead of the pod's service account, e.g. for a local API server")
+	admissionPaths        = flag.String("admission-paths", env.String("ADMISSION_PATHS", strings.Join(server.DefaultPaths, ",")), "comma separated admission paths to serve: /mutate/secrets, /mutate/configmaps, /mutate/certificates, /validate/secrets, /validate/secrets/delete; /mutate stays an alias of /mutate/secrets")
+	deleteAllowedUsers    = flag.String("delete-allowed-users", env.String("DELETE_ALLOWED_USERS", strings.Join(server.DefaultDeleteProtection().AllowedUsers, ",")), "comma separated users /validate/secrets/delete lets delete protected secrets")
+	deleteAllowedGroups   = flag.String("delete-allowed-groups", env.String("DELETE_ALLOWED_GROUPS", strings.Join(server.DefaultDeleteProtection().AllowedGroups, ",")), "comma separated groups /validate/secrets/delete lets delete protected secrets")
+	configMapSelector     = flag.String("configmap-selector", env.String("CONFIGMAP_SELECTOR", server.DefaultConfigMapSelector), "label selector of the ConfigMaps /mutate/configmaps annotates")
+	verifyPatches         = flag.Bool("verify-patches", env.Bool("VERIFY_PATCHES", true), "apply each generated patch to its object before returning it, answering per the failure policy when it doesn't apply")
+	failurePolicy         = flag.String("failure-policy", env.String("FAILURE_POLICY", server.FailurePolicyIgnore), "answer to give when the webhook fails internally: Ignore allows the object, Fail rejects it")
+)
+
+// newClientCASource returns the reloader for the client CA bundle, or nil
+// when client certificates are not required.
+func newClientCASource(log logr.Logger, kubeClient kubeClientFunc) (*certs.ClientCAReloader, error) {
+	switch {
+	case *clientCAFile != "":
+		return certs.NewClientCAReloader(log, certs.FileSource(*clientCAFile))
+	case *clientCAFromCluster:
+		client, err := kubeClient()
+		if err != nil {
+			return nil, err
+		}
+		return certs.NewClientCAReloader(log, certs.ConfigMapSource(client))
+	}
+	return nil, nil
+}
+
+// newOpsAuthenticator returns the authenticator guarding the operational
+// endpoints, or nil when none is configured.
+func newOpsAuthenticator(kubeClient kubeClientFunc) (server.Authenticator, error) {
+	switch {
+	case *opsTokenFile != "":
+		auth, err := server.NewStaticTokenAuthenticator(*opsTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return auth, nil
+	case *opsTokenReview:
+		client, err := kubeClient()
+		if err != nil {
+			return nil, err
+		}
+		return server.NewTokenReviewAuthenticator(client), nil
+	}
+	return nil, nil
+}
+
+// mutatorConfig returns the mutation settings, taken from the environment
+// and the stage settings file, with the settings of the cluster profile and
+// the cluster name of identity.
+func mutatorConfig(identity clusterIdentity) (mutator.Config, error) {
+	config := mutator.DefaultConfig()
+	config.NamespaceSelector = env.String("NAMESPACE_SELECTOR", config.NamespaceSelector)
+	config.MaxTargets = int(env.Int64("MAX_TARGET_NAMESPACES", 0))
+	config.StrictTargetLimit = env.Bool("STRICT_TARGET_LIMIT", false)
+	config.RewriteDecisionOnConfigChange = *rewriteDecision
+	config.ClusterName = identity.name
+	config.StrictPatchValidation = env.Bool("STRICT_PATCH_VALIDATION", false)
+	if config.MaxTargets < 0 {
+		return config, fmt.Errorf("MAX_TARGET_NAMESPACES %d is negative", config.MaxTargets)
+	}
+	config.Stages = splitList(*mutationStages)
+	var settings map[string]json.RawMessage
+	if *mutationStageConfig != "" {
+		data, err := os.ReadFile(*mutationStageConfig)
+		if err != nil {
+			return config, err
+		}
+		if err := yaml.Unmarshal(data, &settings); err != nil {
+			return config, fmt.Errorf("parsing %s: %w", *mutationStageConfig, err)
+		}
+	}
+	if err := applyClusterProfile(settings, identity.profile); err != nil {
+		return config, err
+	}
+	config.StageConfig = settings
+	return config, nil
+}
+
+// freezeConfig reads the change freeze windows file, none when it is unset.
+func freezeConfig() (server.FreezeConfig, error) {
+	var config server.FreezeConfig
+	if *freezeWindowsFile == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(*freezeWindowsFile)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return config, fmt.Errorf("parsing %s: %w", *freezeWindowsFile, err)
+	}
+	return config, nil
+}
+
+// splitList returns the non-empty items of a comma separated list.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// fatal logs err and exits.
+func fatal(log logr.Logger, err error, msg string, keysAndValues ...interface{}) {
+	log.Error(err, msg, keysAndValues...)
+	os.Exit(1)
+}
+
+// configureHTTP2 offers HTTP/2 in the TLS handshake of srv, or only
+// HTTP/1.1 when disabled. srv must have a TLS config.
+func configureHTTP2(srv *http.Server, disable bool) {
+	if disable {
+		// a non-nil empty TLSNextProto stops net/http from enabling HTTP/2
+		srv.TLSConfig.NextProtos = []string{"http/1.1"}
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	} else {
+		srv.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+}
+
+// configState is the configuration precondition of readiness: the
+// environment values are valid and the last reload of the settings files,
+// if any, succeeded.
+type configState struct {
+	envErrors func() []error
+
+	mu        sync.Mutex
+	reloadErr error
+}
+
+// reloaded records the outcome of a reload; a later successful one clears a
+// failure.
+func (c *configState) reloaded(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reloadErr = err
+}
+
+func (c *configState) Ready(time.Time) error {
+	if n := len(c.envErrors()); n > 0 {
+		return fmt.Errorf("%d invalid environment values, see log", n)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reloadErr != nil {
+		return fmt.Errorf("last reload failed, running the previous settings: %v", c.reloadErr)
+	}
+	return nil
+}
+
+// awaitShutdown returns once a signal arrives on signals or ctx is done,
+// reporting not ready at once. After a signal the server keeps serving for
+// delay, while the endpoint is taken out of the Service.
+func awaitShutdown(ctx context.Context, log logr.Logger, signals <-chan os.Signal, ready *server.Readiness, delay time.Duration) {
+	select {
+	case <-signals:
+		log.Info("Got OS shutdown signal, shutting down webhook server gracefully")
+		ready.ShuttingDown.Store(true)
+		time.Sleep(delay)
+	case <-ctx.Done():
+		ready.ShuttingDown.Store(true)
+	}
+}
+
+// drain shuts whsvr down, closing idle connections at once and waiting for
+// the in-flight admissions until ctx is done. It returns how many were left
+// undrained with the error.
+func drain(ctx context.Context, log logr.Logger, whsvr *server.WebhookServer) error {
+	inFlight := whsvr.InFlight()
+	if err := whsvr.Shutdown(ctx); err != nil {
+		return fmt.Errorf("%d of %d in-flight requests drained: %w", inFlight-whsvr.InFlight(), inFlight, err)
+	}
+	log.Info("Webhook server shut down", "drained", inFlight)
+	return nil
+}
+
+// shutdownServers drains whsvr, then shuts the ops server down: it goes
+// last so probes and metrics see the drain. A failed drain is returned, so
+// the process exits non-zero.
+func shutdownServers(ctx context.Context, log logr.Logger, whsvr *server.WebhookServer, opsServer *http.Server) error {
+	drainErr := drain(ctx, log, whsvr)
+	if err := opsServer.Shutdown(ctx); err != nil {
+		log.Error(err, "Failed to shut down ops server gracefully")
+	}
+	if drainErr != nil {
+		return fmt.Errorf("shutting down webhook server: %w", drainErr)
+	}
+	return nil
+}
+
+// subcommands run instead of the webhook server when named as the first
+// argument; they return the process exit code.
+var subcommands = map[string]func(args []string) int{
+	"bench":     runBench,
+	"eval":      runEval,
+	"probe":     runProbe,
+	"selfcheck": runSelfcheck,
+	"manifests": runManifests,
+	"migrate":   runMigrate,
+	"report":    runReport,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+	flag.Parse()
+
+	logger, level, err := newLogger(*logFormat, *logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up logging: %v\n", err)
+		os.Exit(1)
+	}
+	for _, err := range env.Errors() {
+		logger.Error(err, "Invalid environment variable")
+	}
+
+	// get command line parameters
+	webhookPort := env.String("WEBHOOK_PORT", "443")
+	certFile := env.String("WEBHOOK_CERT", "/etc/webhook/certs/tls.crt")
+	keyFile := env.String("WEBHOOK_KEY", "/etc/webhook/certs/tls.key")
+
+	metrics.SetAnnotationKeys(mutator.SyncAnnotationKey)
+	allowlist, err := metrics.ParseLabelAllowlist(*metricsLabelAllowlist)
+	if err != nil {
+		fatal(logger, err, "Invalid metrics label allowlist")
+	}
+	for _, warning := range metrics.SetCardinality(metrics.CardinalityConfig{MaxValues: *metricsMaxLabelValues, Allow: allowlist}) {
+		logger.Info("WARNING: " + warning)
+	}
+
+	warnDays, err := certs.ParseWarnDays(*certExpiryWarningDays)
+	if err != nil {
+		fatal(logger, err, "Invalid certificate expiry warning days")
+	}
+
+	keyPair, err := certs.NewReloader(logger.WithName("certs"), certFile, keyFile, warnDays)
+	if err != nil {
+		logger.Error(err, "Failed to load key pair", "cert", certFile, "key", keyFile)
+	}
+	// the chain is checked against the caBundle when it is known
+	chainCheck := certs.ChainConfig{DNSNames: splitList(*servingDNSNames)}
+	if *caBundleFile != "" {
+		chainCheck.Roots = certs.FileSource(*caBundleFile)
+	}
+	keyPair.CheckChain(chainCheck)
+
+	// ctx is cancelled when shutdown begins; background components stop with it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shutdownTracing, err := server.InitTracing(ctx, *tracingEndpoint, *tracingSampleRate)
+	if err != nil {
+		fatal(logger, err, "Failed to set up tracing")
+	}
+	if *tracingEndpoint != "" {
+		logger.Info("Tracing enabled", "endpoint", *tracingEndpoint, "sampleRate", *tracingSampleRate)
+	}
+
+	// counters and histograms go to the sinks listed besides, or instead of,
+	// the Prometheus registry
+	servePrometheus := false
+	var sinks []metrics.Sink
+	listed := map[string]bool{}
+	for _, name := range strings.Split(*metricsSink, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if listed[name] {
+			fatal(logger, fmt.Errorf("metrics sink %q listed twice", name), "Invalid metrics sink settings")
+		}
+		listed[name] = true
+		switch name {
+		case "prometheus":
+			servePrometheus = true
+		case "statsd":
+			config := metrics.DefaultStatsD()
+			config.Address = *statsdAddress
+			config.Prefix = *statsdPrefix
+			sink, err := metrics.NewStatsD(config)
+			if err != nil {
+				fatal(logger, err, "Invalid metrics sink settings")
+			}
+			sinks = append(sinks, sink)
+		case "otlp":
+			if *otlpMetricsEndpoint == "" {
+				fatal(logger, fmt.Errorf("the otlp metrics sink needs --otlp-metrics-endpoint"), "Invalid metrics sink settings")
+			}
+			sink, err := metrics.NewOTLP(*otlpMetricsEndpoint)
+			if err != nil {
+				fatal(logger, err, "Invalid metrics sink settings")
+			}
+			sinks = append(sinks, sink)
+		default:
+			fatal(logger, fmt.Errorf("unknown metrics sink %q, expect prometheus, statsd or otlp", name), "Invalid metrics sink settings")
+		}
+	}
+	if !servePrometheus && len(sinks) == 0 {
+		fatal(logger, fmt.Errorf("no metrics sink listed"), "Invalid metrics sink settings")
+	}
+	var pusher *metrics.Pusher
+	if len(sinks) > 0 {
+		if *metricsPushInterval <= 0 {
+			fatal(logger, fmt.Errorf("metrics push interval %v is not positive", *metricsPushInterval), "Invalid metrics sink settings")
+		}
+		metrics.SetSinks(sinks...)
+		pusher = metrics.NewPusher(logger.WithName("metrics"), *metricsPushInterval, *metricsPushInterval, sinks...)
+		go pusher.Run(ctx.Done())
+		logger.Info("Pushing metrics", "sinks", *metricsSink, "interval", metricsPushInterval.String())
+	}
+
+	go keyPair.Watch(*certReloadInterval, ctx.Done())
+
+	// one clientset, built when a feature first needs the cluster
+	kubeClient := kubeClientFunc(sync.OnceValues(newKubeClient))
+
+	// The read and write timeouts match the webhook timeoutSeconds we
+	// recommend (10s): the API server gives up on us by then anyway.
+	httpServer := &http.Server{
+		Addr:              net.JoinHostPort(*bindAddress, webhookPort),
+		TLSConfig:         &tls.Config{GetCertificate: keyPair.GetCertificate},
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeaderBytes,
+	}
+	configureHTTP2(httpServer, *disableHTTP2)
+	httpServer.SetKeepAlivesEnabled(!*disableKeepAlives)
+
+	clientCAs, err := newClientCASource(logger.WithName("client-ca"), kubeClient)
+	if err != nil {
+		fatal(logger, err, "Failed to set up client certificate verification")
+	}
+	if clientCAs != nil {
+		go clientCAs.Watch(*certReloadInterval, ctx.Done())
+		httpServer.TLSConfig.GetConfigForClient = clientCAs.ConfigForClient(httpServer.TLSConfig)
+		logger.Info("Client certificate verification enabled")
+	}
+	logger.Info("Server settings",
+		"http2", !*disableHTTP2,
+		"keepalives", !*disableKeepAlives,
+		"maxHeaderBytes", *maxHeaderBytes,
+		"readHeaderTimeout", readHeaderTimeout.String(),
+		"readTimeout", readTimeout.String(),
+		"writeTimeout", writeTimeout.String(),
+		"idleTimeout", idleTimeout.String())
+
+	failOpen, err := server.ParseFailurePolicy(*failurePolicy)
+	if err != nil {
+		fatal(logger, err, "Invalid failure policy")
+	}
+	identity, err := resolveClusterIdentity(ctx, kubeClient)
+	if err != nil {
+		fatal(logger, err, "Failed to identify the cluster")
+	}
+	mutatorSettings, err := mutatorConfig(identity)
+	if err != nil {
+		fatal(logger, err, "Failed to read the mutation stage settings")
+	}
+	if identity.profile != "" {
+		logger.Info("Cluster profile selected", "profile", identity.profile)
+	}
+	if identity.name != "" {
+		logger.Info("Stamping the cluster name", "cluster", identity.name)
+	}
+	metrics.SetClusterProfile(identity.profile)
+	freeze, err := freezeConfig()
+	if err != nil {
+		fatal(logger, err, "Failed to read the change freeze windows")
+	}
+	config := server.Config{
+		Mutator:        mutatorSettings,
+		ClusterProfile: identity.profile,
+		ConfigMaps: server.ConfigMapConfig{
+			Selector:          *configMapSelector,
+			IgnoredNamespaces: mutatorSettings.IgnoredNamespaces,
+			NamespaceSelector: mutatorSettings.NamespaceSelector,
+		},
+		Certificates: server.CertificateConfig{
+			IgnoredNamespaces: mutatorSettings.IgnoredNamespaces,
+			NamespaceSelector: mutatorSettings.NamespaceSelector,
+		},
+		Paths:                 splitList(*admissionPaths),
+		FailOpen:              failOpen,
+		MaxBodyBytes:          *maxRequestBodyBytes,
+		SlowThreshold:         *slowRequestThreshold,
+		SkipPatchVerification: !*verifyPatches,
+		DeleteProtection: server.DeleteProtectionConfig{
+			AllowedUsers:  splitList(*deleteAllowedUsers),
+			AllowedGroups: splitList(*deleteAllowedGroups),
+		},
+		Freeze: freeze,
+	}
+	webhookLog := logger.WithName("webhook")
+	opts := []server.Option{server.WithLogger(webhookLog)}
+
+	if *auditLogPath != "" {
+		audit, err := server.NewAuditLogger(logger.WithName("audit"), *auditLogPath, *auditLogMaxSize, *auditLogMaxBackups)
+		if err != nil {
+			fatal(logger, err, "Failed to open audit log", "path", *auditLogPath)
+		}
+		opts = append(opts, server.WithAuditLogger(audit))
+
+		// reopen the audit log on SIGUSR1 so logrotate can move it away
+		reopenChan := make(chan os.Signal, 1)
+		signal.Notify(reopenChan, syscall.SIGUSR1)
+		go func() {
+			for range reopenChan {
+				audit.Reopen()
+			}
+		}()
+	}
+
+	if *emitEvents {
+		client, err := kubeClient()
+		if err != nil {
+			fatal(logger, err, "Failed to set up event recording")
+		}
+		opts = append(opts, server.WithEventRecorder(server.NewEventRecorder(logger.WithName("events"), client)))
+		logger.Info("Event recording enabled")
+	}
+
+	var status *server.StatusReporter
+	if *statusConfigMap != "" {
+		if *statusInterval <= 0 {
+			fatal(logger, fmt.Errorf("--status-interval must be positive"), "Invalid status settings")
+		}
+		client, err := kubeClient()
+		if err != nil {
+			fatal(logger, err, "Failed to set up the status ConfigMap")
+		}
+		replica, err := os.Hostname()
+		if err != nil {
+			fatal(logger, err, "Failed to determine the replica name")
+		}
+		status = server.NewStatusReporter(logger.WithName("status"), client, *podNamespace, *statusConfigMap, replica, *statusInterval)
+		opts = append(opts, server.WithStatusReporter(status))
+	}
+
+	if *recentDecisions < 0 {
+		fatal(logger, fmt.Errorf("--recent-decisions %d is negative", *recentDecisions), "Invalid recent decisions settings")
+	}
+	recent := server.NewRecentDecisions(*recentDecisions)
+	opts = append(opts, server.WithRecentDecisions(recent))
+
+	if *errorReportURL != "" || *errorReportDSN != "" {
+		var hook *server.HTTPErrorHook
+		switch {
+		case *errorReportURL != "" && *errorReportDSN != "":
+			err = fmt.Errorf("--error-report-url and --error-report-dsn are mutually exclusive")
+		case *errorReportDSN != "":
+			hook, err = server.NewSentryErrorHook(*errorReportDSN)
+		default:
+			hook, err = server.NewHTTPErrorHook(*errorReportURL)
+		}
+		if err == nil && *errorReportThreshold < 1 {
+			err = fmt.Errorf("--error-report-threshold %d is not positive", *errorReportThreshold)
+		}
+		if err == nil && *errorReportWindow <= 0 {
+			err = fmt.Errorf("--error-report-window %v is not positive", *errorReportWindow)
+		}
+		if err != nil {
+			fatal(logger, err, "Invalid error report settings")
+		}
+		config := server.DefaultErrorReporter()
+		config.Threshold = *errorReportThreshold
+		config.Window = *errorReportWindow
+		reports := server.NewErrorReporter(logger.WithName("error-reports"), hook, config)
+		go reports.Run(ctx.Done())
+		opts = append(opts, server.WithErrorReporter(reports))
+		logger.Info("Error reporting enabled", "sentry", *errorReportDSN != "", "threshold", config.Threshold, "window", config.Window.String())
+	}
+
+	if *recordRequests != "" {
+		recorder, err := server.NewRequestRecorder(logger.WithName("recorder"), *recordRequests, *recordMaxFiles, *recordMaxBytes)
+		if err != nil {
+			fatal(logger, err, "Failed to set up request recording", "dir", *recordRequests)
+		}
+		opts = append(opts, server.WithRequestRecorder(recorder))
+		logger.Info("WARNING: recording admission requests, secret data is blanked but metadata is kept", "dir", *recordRequests)
+	}
+
+	if *logSample > 1 {
+		sampler := server.NewDecisionSampler(*logSample)
+		if *logSummaryInterval > 0 {
+			go sampler.Summarize(webhookLog, *logSummaryInterval, ctx.Done())
+		}
+		opts = append(opts, server.WithDecisionSampler(sampler))
+		logger.Info("Decision log sampling enabled", "every", *logSample, "summaryInterval", logSummaryInterval.String())
+	}
+
+	if *rateLimit > 0 || *clientRateLimit > 0 {
+		opts = append(opts, server.WithRateLimiter(server.NewRateLimiter(*rateLimit, *rateLimitBurst, *clientRateLimit, *clientRateLimitBurst), *rateLimitStrict))
+	}
+
+	if *decisionCacheSize > 0 && *decisionCacheTTL > 0 {
+		opts = append(opts, server.WithDecisionCache(server.NewDecisionCache(*decisionCacheSize, *decisionCacheTTL)))
+	}
+
+	if *maxConcurrent > 0 {
+		opts = append(opts, server.WithConcurrencyLimiter(server.NewConcurrencyLimiter(*maxConcurrent, *admissionQueueTimeout)))
+		logger.Info("Admission concurrency capped", "limit", *maxConcurrent, "queueTimeout", admissionQueueTimeout.String())
+	}
+
+	if *injectLatency > 0 || *injectLatencyPercent > 0 || *injectErrorPercent > 0 {
+		if !*enableFaultInjection {
+			fatal(logger, fmt.Errorf("fault injection flags need --enable-fault-injection"), "Refusing to inject faults")
+		}
+		faults, err := server.NewFaultInjector(logger.WithName("faults"), *injectLatency, *injectLatencyPercent, *injectErrorPercent)
+		if err != nil {
+			fatal(logger, err, "Invalid fault injection settings")
+		}
+		opts = append(opts, server.WithFaultInjector(faults))
+		logger.Info("WARNING: fault injection enabled, admissions will be delayed or failed on purpose",
+			"latency", injectLatency.String(), "latencyPercent", *injectLatencyPercent, "errorPercent", *injectErrorPercent)
+	}
+
+	if *downstreamURL != "" {
+		if *downstreamTimeout >= *writeTimeout {
+			fatal(logger, fmt.Errorf("downstream webhook timeout %s must be shorter than the write timeout %s", downstreamTimeout, writeTimeout),
+				"Invalid downstream webhook settings")
+		}
+		tlsFlags := clientTLSFlags{caFile: *downstreamCAFile, certFile: *downstreamCertFile, keyFile: *downstreamKeyFile}
+		tlsConfig, err := tlsFlags.config()
+		if err != nil {
+			fatal(logger, err, "Failed to set up the downstream webhook client TLS")
+		}
+		downstream, err := server.NewDownstreamWebhook(*downstreamURL, tlsConfig, *downstreamTimeout)
+		if err != nil {
+			fatal(logger, err, "Invalid downstream webhook settings")
+		}
+		opts = append(opts, server.WithDownstreamWebhook(downstream))
+		logger.Info("Forwarding admissions to the downstream webhook", "url", *downstreamURL, "timeout", downstreamTimeout.String())
+	}
+
+	var accessLogger logr.Logger
+	if *accessLogEnabled {
+		accessLogger = logger.WithName("access")
+		opts = append(opts, server.WithAccessLog(accessLogger, *accessLogSample))
+	}
+
+	// the webhook listener serves admission paths only, all of them
+	// covered by panic recovery
+	whsvr, err := server.NewWebhookServer(append(opts, server.WithConfig(config), server.WithHTTPServer(httpServer))...)
+	if err != nil {
+		fatal(logger, err, "Invalid webhook settings")
+	}
+	// the informer cache runs only for the features reading the cluster
+	if whsvr.NeedsInformers() {
+		client, err := kubeClient()
+		if err != nil {
+			fatal(logger, err, "Failed to set up the informer cache")
+		}
+		dynamicClient, err := newDynamicClient()
+		if err != nil {
+			fatal(logger, err, "Failed to set up the informer cache")
+		}
+		whsvr.StartInformers(ctx, client, dynamicClient)
+		logger.Info("Informer cache enabled")
+	}
+
+	// SIGHUP re-reads the stage settings and freeze windows files;
+	// admissions in flight finish on the settings they started with. The
+	// freeze windows file is also re-read every CERT_RELOAD_INTERVAL, so an
+	// update of its ConfigMap applies without a signal
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	var freezeTicks <-chan time.Time
+	if *freezeWindowsFile != "" {
+		ticker := time.NewTicker(*certReloadInterval)
+		defer ticker.Stop()
+		freezeTicks = ticker.C
+	}
+	configReady := &configState{envErrors: env.Errors}
+	go func() {
+		current, freezeErr := config, ""
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-freezeTicks:
+				freeze, err := freezeConfig()
+				if err != nil {
+					// logged once until it changes, the file is read again and again
+					if err.Error() != freezeErr {
+						logger.Error(err, "Failed to read the change freeze windows, keeping the current ones")
+						freezeErr = err.Error()
+					}
+					configReady.reloaded(err)
+					continue
+				}
+				freezeErr = ""
+				if reflect.DeepEqual(freeze, current.Freeze) {
+					continue
+				}
+				reloaded := current
+				reloaded.Freeze = freeze
+				if err := whsvr.Reload(reloaded); err != nil {
+					logger.Error(err, "Failed to reload the change freeze windows, keeping the current ones")
+					configReady.reloaded(err)
+					continue
+				}
+				configReady.reloaded(nil)
+				current = reloaded
+			case <-reloadChan:
+				// the profile is selected again, the cluster identity may
+				// have changed with the settings
+				identity, err := resolveClusterIdentity(ctx, kubeClient)
+				if err != nil {
+					logger.Error(err, "Failed to identify the cluster, keeping the current settings")
+					configReady.reloaded(err)
+					continue
+				}
+				settings, err := mutatorConfig(identity)
+				if err != nil {
+					logger.Error(err, "Failed to read the mutation stage settings, keeping the current ones")
+					configReady.reloaded(err)
+					continue
+				}
+				freeze, err := freezeConfig()
+				if err != nil {
+					logger.Error(err, "Failed to read the change freeze windows, keeping the current settings")
+					configReady.reloaded(err)
+					continue
+				}
+				reloaded := config
+				reloaded.Mutator = settings
+				reloaded.ClusterProfile = identity.profile
+				reloaded.Freeze = freeze
+				if err := whsvr.Reload(reloaded); err != nil {
+					logger.Error(err, "Failed to reload the mutation stage settings, keeping the current ones")
+					configReady.reloaded(err)
+					continue
+				}
+				configReady.reloaded(nil)
+				current = reloaded
+				metrics.SetClusterProfile(identity.profile)
+			}
+		}
+	}()
+	go whsvr.WatchFreeze(ctx.Done())
+
+	opsAuth, err := newOpsAuthenticator(kubeClient)
+	if err != nil {
+		fatal(logger, err, "Failed to set up operational endpoint authentication")
+	}
+
+	// health, metrics and debug endpoints live on a separate plain HTTP
+	// listener so scrapers and probes never touch the admission port
+	opsMux := http.NewServeMux()
+	opsServer := &http.Server{
+		Addr:              net.JoinHostPort(*opsBindAddress, strconv.Itoa(*opsPort)),
+		Handler:           opsMux,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	if opsAuth == nil && !server.IsLocalListen(opsServer.Addr) {
+		logger.Info("WARNING: /metrics and debug endpoints are served without authentication; set OPS_TOKEN_FILE or OPS_TOKEN_REVIEW to protect them", "address", opsServer.Addr)
+	}
+	opsLog := logger.WithName("ops")
+	opsMux.HandleFunc("/healthz", server.Healthz)
+	ready := &server.Readiness{}
+	ready.Add("certificate", keyPair.Ready)
+	ready.AddNote(keyPair.ChainNote)
+	ready.AddNote(whsvr.FreezeNote)
+	ready.Add("config", configReady.Ready)
+	if clientCAs != nil {
+		ready.Add("client-ca", clientCAs.Ready)
+	}
+	ready.Add("informer-cache", whsvr.InformersSynced)
+	if !*skipOperatorCheck {
+		if client, err := kubeClient(); err != nil {
+			logger.Info("Skipping kubed/config-syncer check, no cluster access", "error", err.Error())
+		} else {
+			ready.Operator = server.NewOperatorCheck(logger.WithName("operator-check"), client)
+			go ready.Operator.Watch(*operatorCheckInterval, ctx.Done())
+		}
+	}
+	if *activeProbe {
+		if *activeProbeInterval <= 0 || *activeProbeFailures <= 0 || *activeProbeSuccesses <= 0 {
+			fatal(logger, fmt.Errorf("--active-probe-interval and the --active-probe-*-threshold flags must be positive"), "Invalid active probe settings")
+		}
+		client, err := kubeClient()
+		if err != nil {
+			fatal(logger, err, "Active probe needs cluster access")
+		}
+		config := server.DefaultActiveProbe()
+		config.Namespace = *activeProbeNamespace
+		config.Interval = *activeProbeInterval
+		config.FailureThreshold = *activeProbeFailures
+		config.SuccessThreshold = *activeProbeSuccesses
+		probe := server.NewActiveProbe(logger.WithName("active-probe"), client, config)
+		if *activeProbeReadiness {
+			ready.Add("active-probe", probe.Ready)
+		}
+		go probe.Watch(ctx.Done())
+	}
+	// the controllers write to the cluster, so only the replica holding the
+	// lease runs them
+	var elector *server.LeaderElector
+	leaderElector := func(component string) *server.LeaderElector {
+		if elector != nil {
+			return elector
+		}
+		client, err := kubeClient()
+		if err != nil {
+			fatal(logger, err, "Failed to set up the "+component)
+		}
+		leaderIdentity, err := os.Hostname()
+		if err != nil {
+			fatal(logger, err, "Failed to determine leader election identity")
+		}
+		elector = server.NewLeaderElector(logger.WithName("leader-election"), client, server.LeaderElectionConfig{
+			Namespace:     *podNamespace,
+			Name:          *leaseName,
+			Identity:      leaderIdentity,
+			LeaseDuration: *leaseDuration,
+			RenewDeadline: *leaseRenewDeadline,
+			RetryPeriod:   *leaseRetryPeriod,
+		})
+		return elector
+	}
+	if *reconcileConfig {
+		if *webhookConfigName == "" || *caBundleFile == "" {
+			fatal(logger, fmt.Errorf("--webhook-config-name and --ca-bundle-file are required"), "Invalid webhook configuration reconciliation settings")
+		}
+		client, err := kubeClient()
+		if err != nil {
+			fatal(logger, err, "Failed to set up webhook configuration reconciliation")
+		}
+		routes, err := server.EnabledRoutes(config.Paths)
+		if err != nil {
+			fatal(logger, err, "Invalid admission paths")
+		}
+		reconciler := server.NewWebhookConfigReconciler(logger.WithName("webhook-config"), client,
+			*webhookConfigName, certs.FileSource(*caBundleFile), routes, *certReloadInterval)
+		leaderElector("webhook configuration reconciliation").Add("webhook-config", reconciler)
+		ready.Add("informers", reconciler.Synced)
+		ready.Add("webhook-config", reconciler.Drifted)
+		logger.Info("Webhook configuration reconciliation enabled", "name", *webhookConfigName)
+	}
+	if *watchWebhookConfig {
+		if *webhookConfigName == "" {
+			fatal(logger, fmt.Errorf("--webhook-config-name is required"), "Invalid webhook configuration drift settings")
+		}
+		client, err := kubeClient()
+		if err != nil {
+			fatal(logger, err, "Failed to set up the webhook configuration drift watcher")
+		}
+		watcher := server.NewWebhookConfigWatcher(logger.WithName("webhook-config-drift"), client, *webhookConfigName,
+			server.ExpectedWebhookSettings(*failurePolicy, *emitEvents), *certReloadInterval)
+		leaderElector("webhook configuration drift watch").Add("webhook-config-drift", watcher)
+		ready.Add("webhook-config-present", watcher.Present)
+		logger.Info("Webhook configuration drift watch enabled", "name", *webhookConfigName)
+	}
+	if *enableBackfill {
+		client, err := kubeClient()
+		if err != nil {
+			fatal(logger, err, "Failed to set up the backfill controller")
+		}
+		backfill := whsvr.NewBackfillController(logger.WithName("backfill"), client, server.BackfillConfig{
+			QPS:                      *backfillRate,
+			Burst:                    *backfillBurst,
+			DryRun:                   *backfillDryRun,
+			EligibilityInterval:      *eligibilityInterval,
+			EligibilityTopNamespaces: *eligibilityTopN,
+		})
+		leaderElector("backfill controller").Add("backfill", backfill)
+		logger.Info("Backfill controller enabled", "rate", *backfillRate, "burst", *backfillBurst, "dryRun", *backfillDryRun)
+	}
+	if status != nil {
+		leaderElector("status ConfigMap").Add("status", status)
+		logger.Info("Status ConfigMap enabled", "name", *statusConfigMap, "interval", statusInterval.String())
+	}
+	if *enableNamespaceResync {
+		if *resyncBatchWindow <= 0 {
+			fatal(logger, fmt.Errorf("--resync-batch-window must be positive"), "Invalid namespace resync settings")
+		}
+		client, err := kubeClient()
+		if err != nil {
+			fatal(logger, err, "Failed to set up the namespace resync")
+		}
+		resync := whsvr.NewResyncController(logger.WithName("resync"), client, server.ResyncConfig{
+			BatchWindow: *resyncBatchWindow,
+			QPS:         *resyncRate,
+			Burst:       *resyncBurst,
+		})
+		leaderElector("namespace resync").Add("resync", resync)
+		logger.Info("Namespace resync enabled", "batchWindow", resyncBatchWindow.String(), "rate", *resyncRate)
+	}
+	if *enableReplicaGC {
+		client, err := kubeClient()
+		if err != nil {
+			fatal(logger, err, "Failed to set up the replica collector")
+		}
+		gc := server.NewReplicaGC(logger.WithName("replica-gc"), client, server.ReplicaGCConfig{
+			GracePeriod: *replicaGCGracePeriod,
+			DryRun:      *replicaGCDryRun,
+		})
+		leaderElector("replica collector").Add("replica-gc", gc)
+		logger.Info("Replica collection enabled", "gracePeriod", replicaGCGracePeriod.String(), "dryRun", *replicaGCDryRun)
+	}
+	if *enableDriftScan {
+		if *driftScanInterval <= 0 || *driftScanBatchSize <= 0 {
+			fatal(logger, fmt.Errorf("--drift-scan-interval and --drift-scan-batch-size must be positive"), "Invalid drift scan settings")
+		}
+		client, err := kubeClient()
+		if err != nil {
+			fatal(logger, err, "Failed to set up the drift scan")
+		}
+		scanner := whsvr.NewDriftScanner(logger.WithName("drift"), client, server.DriftScanConfig{
+			Interval:  *driftScanInterval,
+			BatchSize: *driftScanBatchSize,
+			Namespace: *driftScanNamespace,
+			Remediate: *remediateDrift,
+		})
+		leaderElector("drift scan").Add("drift", scanner)
+		logger.Info("Drift scan enabled", "interval", driftScanInterval.String(), "namespace", *driftScanNamespace, "remediate", *remediateDrift)
+	}
+	if elector != nil {
+		go elector.Run(ctx)
+	}
+	opsMux.Handle("/readyz", ready)
+	if servePrometheus {
+		opsMux.Handle("/metrics", server.RequireBearerToken(opsLog, opsAuth, promhttp.Handler()))
+	}
+	opsMux.Handle("/debug/loglevel", server.RequireBearerToken(opsLog, opsAuth, server.NewLogLevelHandler(opsLog, level)))
+	opsMux.Handle("/debug/config", server.RequireBearerToken(opsLog, opsAuth, whsvr.ConfigHandler()))
+	if recent != nil {
+		opsMux.Handle("/decisions", server.RequireBearerToken(opsLog, opsAuth, recent))
+	}
+	opsMux.Handle("/stats", server.RequireBearerToken(opsLog, opsAuth, http.HandlerFunc(server.StatsHandler)))
+	opsMux.Handle("/selftest", server.RequireBearerToken(opsLog, opsAuth, &server.SelfTestHandler{Log: opsLog, Admission: httpServer.Handler}))
+	if *enablePprof {
+		server.RegisterPprof(opsMux, opsLog, opsAuth, *blockProfileRate, *mutexProfileFraction)
+		logger.Info("pprof enabled", "path", "/debug/pprof/")
+	}
+
+	if *accessLogEnabled {
+		opsServer.Handler = server.AccessLog(accessLogger, *accessLogSample, opsServer.Handler)
+	}
+	opsServer.Handler = server.RequestID(opsServer.Handler)
+
+	addr := whsvr.Addr()
+	if *listenSpec != "" {
+		addr = *listenSpec
+	}
+	if err := server.CheckPortConflict(addr, opsServer.Addr); err != nil {
+		fatal(logger, err, "Invalid listen addresses")
+	}
+
+	// open both listeners up front so a port conflict fails startup
+	ln, err := server.Listen(addr)
+	if err != nil {
+		fatal(logger, err, "Failed to listen", "address", addr)
+	}
+	opsLn, err := server.Listen(opsServer.Addr)
+	if err != nil {
+		fatal(logger, err, "Failed to listen", "address", opsServer.Addr)
+	}
+	logger.Info("Webhook listening", "address", addr)
+	logger.Info("Ops endpoints listening", "address", opsServer.Addr)
+
+	// run both servers; if either fails the other is shut down as well
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		if err := whsvr.Serve(ln); err != nil && err != http.ErrServerClosed {
+			return fmt.Errorf("webhook server: %w", err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		if err := opsServer.Serve(opsLn); err != nil && err != http.ErrServerClosed {
+			return fmt.Errorf("ops server: %w", err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		// listening OS shutdown singal
+		signalChan := make(chan os.Signal, 1)
+		signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+		awaitShutdown(gctx, logger, signalChan, ready, *shutdownDelay)
+		cancel()
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer shutdownCancel()
+		err := shutdownServers(shutdownCtx, logger, whsvr, opsServer)
+		// flush the spans of the drained requests
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			logger.Error(err, "Failed to flush traces")
+		}
+		// and push their metrics
+		if pusher != nil {
+			pusher.Flush(shutdownCtx)
+		}
+		return err
+	})
+
+	logger.Info("Server started")
+	err = g.Wait()
+	whsvr.Close()
+	if err != nil {
+		fatal(logger, err, "Server failed")
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/api/admission/v1beta1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/server"
+)
+
+// selfSignedCertificate returns a serving certificate for 127.0.0.1 and the
+// pool trusting it.
+func selfSignedCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "webhook"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// A client offering both protocols gets HTTP/2 unless it is disabled.
+func TestConfigureHTTP2(t *testing.T) {
+	for disable, want := range map[bool]string{false: "HTTP/2.0", true: "HTTP/1.1"} {
+		cert, pool := selfSignedCertificate(t)
+		srv := &http.Server{
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.Proto)
+			}),
+		}
+		configureHTTP2(srv, disable)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- srv.ServeTLS(ln, "", "") }()
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: true,
+		}}
+		res, err := client.Get("https://" + ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		served, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.Proto != want || string(served) != want {
+			t.Errorf("disable=%v: negotiated %s, served %s, want %s", disable, res.Proto, served, want)
+		}
+		if negotiated := res.TLS.NegotiatedProtocol; disable && negotiated == "h2" {
+			t.Errorf("ALPN negotiated h2 with HTTP/2 disabled")
+		}
+
+		client.CloseIdleConnections()
+		srv.Close()
+		if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("ServeTLS: %v", err)
+		}
+	}
+}
+
+// newTestServer returns a webhook server answering admissions on /mutate
+// over plain HTTP.
+func newTestServer(t *testing.T) *server.WebhookServer {
+	t.Helper()
+	whsvr, err := server.NewWebhookServer(server.WithHTTPServer(&http.Server{Addr: ":8443"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return whsvr
+}
+
+// newTestHandler returns the admission handler of the default settings.
+func newTestHandler(t *testing.T) http.Handler {
+	t.Helper()
+	handler, err := server.NewHandler(server.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+// secretReview returns the review of the creation of a cert-manager TLS
+// secret name in namespace.
+func secretReview(t *testing.T, name, namespace string) *v1beta1.AdmissionReview {
+	t.Helper()
+	review, err := server.FixtureReview(server.FixtureSecret{Name: name, Namespace: namespace, DataSize: 16}.Build(), v1beta1.Create, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return review
+}
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of loggers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// bufferLogger returns a logger writing every line, whatever its
+// verbosity, to a buffer.
+func bufferLogger() (logr.Logger, *syncBuffer) {
+	out := &syncBuffer{}
+	log := funcr.New(func(prefix, args string) {
+		fmt.Fprintln(out, prefix, args)
+	}, funcr.Options{Verbosity: 10})
+	return log, out
+}
+
+// waitFor polls cond for up to five seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+	}
+}
+
+// A slow admission under way when SIGTERM arrives is served to the end,
+// readiness having dropped at once, before the server stops.
+func TestShutdownDrainsSlowRequest(t *testing.T) {
+	log, logged := bufferLogger()
+	whsvr := newTestServer(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- whsvr.Serve(ln) }()
+
+	finish := slowAdmission(t, ln.Addr().String())
+	waitFor(t, func() bool { return whsvr.InFlight() == 1 })
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	ready := &server.Readiness{}
+	drained := make(chan error, 1)
+	go func() {
+		awaitShutdown(context.Background(), log, signals, ready, 50*time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		drained <- drain(ctx, log, whsvr)
+	}()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, ready.ShuttingDown.Load)
+
+	time.Sleep(100 * time.Millisecond) // the shutdown has begun
+	if response := finish(); !response.Allowed || len(response.Patch) == 0 {
+		t.Errorf("slow request answered %+v, want patched", response)
+	}
+
+	if err := <-drained; err != nil {
+		t.Errorf("drain: %v", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Serve: %v", err)
+	}
+	if !strings.Contains(logged.String(), `"drained"=1`) {
+		t.Errorf("drained request not logged:\n%s", logged.String())
+	}
+}
+
+// slowAdmission starts an admission on the webhook at addr, sending half
+// of the body. finish sends the rest and returns the answer.
+func slowAdmission(t *testing.T, addr string) func() *v1beta1.AdmissionResponse {
+	t.Helper()
+	body, err := json.Marshal(secretReview(t, "tls", "apps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "POST /mutate HTTP/1.1\r\nHost: webhook\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n", len(body))
+	conn.Write(body[:len(body)/2])
+
+	return func() *v1beta1.AdmissionResponse {
+		t.Helper()
+		conn.Write(body[len(body)/2:])
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("slow request cut off: %v", err)
+		}
+		defer res.Body.Close()
+		var answer v1beta1.AdmissionReview
+		if err := json.NewDecoder(res.Body).Decode(&answer); err != nil {
+			t.Fatalf("decoding answer %s: %v", res.Status, err)
+		}
+		if answer.Response == nil {
+			t.Fatalf("answer %s has no response", res.Status)
+		}
+		return answer.Response
+	}
+}
+
+// The ops server keeps answering while the webhook drains, readiness
+// failing, and stops once the drain is over.
+func TestShutdownServersOrder(t *testing.T) {
+	whsvr := newTestServer(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go whsvr.Serve(ln)
+
+	ready := &server.Readiness{}
+	opsMux := http.NewServeMux()
+	opsMux.Handle("/readyz", ready)
+	opsMux.Handle("/metrics", promhttp.Handler())
+	opsServer := &http.Server{Handler: opsMux}
+	opsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opsDone := make(chan error, 1)
+	go func() { opsDone <- opsServer.Serve(opsLn) }()
+	opsURL := "http://" + opsLn.Addr().String()
+	opsStatus := func(path string) (int, error) {
+		res, err := (&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}).Get(opsURL + path)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	finish := slowAdmission(t, ln.Addr().String())
+	waitFor(t, func() bool { return whsvr.InFlight() == 1 })
+	ready.ShuttingDown.Store(true)
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- shutdownServers(ctx, logr.Discard(), whsvr, opsServer)
+	}()
+	// the webhook takes no new connections while it drains
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	})
+
+	for path, want := range map[string]int{"/readyz": http.StatusServiceUnavailable, "/metrics": http.StatusOK} {
+		if got, err := opsStatus(path); err != nil || got != want {
+			t.Errorf("ops %s during the drain: %d %v, want %d", path, got, err, want)
+		}
+	}
+	select {
+	case <-stopped:
+		t.Fatal("servers shut down before the admission was drained")
+	default:
+	}
+
+	if response := finish(); !response.Allowed {
+		t.Errorf("drained admission answered %+v", response)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("shutdownServers: %v", err)
+	}
+	if err := <-opsDone; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("ops server: %v", err)
+	}
+	if _, err := opsStatus("/readyz"); err == nil {
+		t.Error("ops server still answering after the shutdown")
+	}
+}
+
+// An admission still in flight when the shutdown timeout runs out fails the
+// shutdown, so the process exits non-zero; the ops server stops all the
+// same.
+func TestShutdownServersDrainTimeout(t *testing.T) {
+	whsvr := newTestServer(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go whsvr.Serve(ln)
+	opsServer := &http.Server{Handler: http.NewServeMux()}
+	opsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opsDone := make(chan error, 1)
+	go func() { opsDone <- opsServer.Serve(opsLn) }()
+
+	// the admission ends once its connection is closed, before the test
+	t.Cleanup(func() { waitFor(t, func() bool { return whsvr.InFlight() == 0 }) })
+	slowAdmission(t, ln.Addr().String())
+	waitFor(t, func() bool { return whsvr.InFlight() == 1 })
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = shutdownServers(ctx, logr.Discard(), whsvr, opsServer)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "0 of 1 in-flight requests drained") {
+		t.Errorf("shutdownServers returned %v, want the undrained request reported", err)
+	}
+	if err := <-opsDone; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("ops server: %v", err)
+	}
+}
+
+// The stages come from MUTATION_STAGES and their settings from the YAML
+// file of MUTATION_STAGE_CONFIG, by stage name.
+func TestMutatorConfigStageSettings(t *testing.T) {
+	restoreFlags(t)
+	file := filepath.Join(t.TempDir(), "stages.yaml")
+	if err := os.WriteFile(file, []byte("policy:\n  note: x\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := flag.Set("mutation-stages", " policy, sync-annotation ,"); err != nil {
+		t.Fatal(err)
+	}
+	if err := flag.Set("mutation-stage-config", file); err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutatorConfig(clusterIdentity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(config.Stages, ",") != "policy,sync-annotation" {
+		t.Errorf("stages %q", config.Stages)
+	}
+	if got := string(config.StageConfig["policy"]); got != `{"note":"x"}` {
+		t.Errorf("policy settings %s", got)
+	}
+
+	if err := os.WriteFile(file, []byte("policy: [unclosed"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutatorConfig(clusterIdentity{}); err == nil || !strings.Contains(err.Error(), file) {
+		t.Errorf("error %v, want the unparsable file", err)
+	}
+}
+
+func TestTimeoutDefaults(t *testing.T) {
+	if *readHeaderTimeout != 5*time.Second || *readTimeout != 10*time.Second ||
+		*writeTimeout != 10*time.Second || *idleTimeout != 90*time.Second {
+		t.Errorf("timeouts %v/%v/%v/%v, want 5s/10s/10s/90s",
+			*readHeaderTimeout, *readTimeout, *writeTimeout, *idleTimeout)
+	}
+}
+
+// The config readiness check fails on invalid environment values, and
+// while the last reload failed.
+func TestConfigState(t *testing.T) {
+	var envErrors []error
+	state := &configState{envErrors: func() []error { return envErrors }}
+	if err := state.Ready(time.Now()); err != nil {
+		t.Fatalf("not ready with a valid config: %v", err)
+	}
+
+	state.reloaded(errors.New("invalid stage settings"))
+	if err := state.Ready(time.Now()); err == nil || !strings.Contains(err.Error(), "invalid stage settings") {
+		t.Errorf("Ready = %v after a failed reload", err)
+	}
+	state.reloaded(nil)
+	if err := state.Ready(time.Now()); err != nil {
+		t.Errorf("not ready after a successful reload: %v", err)
+	}
+
+	envErrors = []error{errors.New("invalid boolean")}
+	if err := state.Ready(time.Now()); err == nil {
+		t.Error("ready with an invalid environment value")
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+
+	"github.com/bygui86/cert-manager-webhook/internal/certs"
+	"github.com/bygui86/cert-manager-webhook/internal/env"
+	"github.com/bygui86/cert-manager-webhook/internal/server"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+const (
+	// port the rendered Deployment serves admissions on; unprivileged so
+	// the container can run as non-root
+	manifestWebhookPort = 8443
+	// name of the webhook entry, as in the chart
+	manifestWebhookName = "cert-webhook.alterus.io"
+
+	nameLabel      = "app.kubernetes.io/name"
+	componentLabel = "app.kubernetes.io/component"
+)
+
+// manifestScheme knows every kind manifests renders, to check the output
+// decodes back.
+var manifestScheme = runtime.NewScheme()
+
+func init() {
+	_ = corev1.AddToScheme(manifestScheme)
+	_ = appsv1.AddToScheme(manifestScheme)
+	_ = rbacv1.AddToScheme(manifestScheme)
+	_ = admissionregistrationv1.AddToScheme(manifestScheme)
+}
+
+// manifestOptions are the settings of the manifests subcommand on top of
+// the webhook's own flags.
+type manifestOptions struct {
+	name           string
+	namespace      string
+	image          string
+	replicas       int
+	certificate    string   // namespace/name of a cert-manager Certificate to inject the caBundle from
+	args           []string // webhook flags set on the command line, passed on to the container
+	failurePolicy  admissionregistrationv1.FailurePolicyType
+	namespaceLabel string
+	routes         []server.Route // enabled admission paths, a webhook entry each
+}
+
+// runManifests implements the manifests subcommand: it renders the objects
+// needed to deploy the webhook with the given flags, which are the server's
+// flags plus a few of its own, to stdout or to a file per object in -dir.
+func runManifests(args []string) int {
+	fs := flag.NewFlagSet("manifests", flag.ContinueOnError)
+	var (
+		opts manifestOptions
+		dir  string
+	)
+	fs.StringVar(&opts.name, "name", "cert-manager-webhook", "name of the rendered objects")
+	fs.StringVar(&opts.namespace, "namespace", "cert-manager", "namespace to deploy to")
+	fs.StringVar(&opts.image, "image", "bygui86/cert-manager-webhook:latest", "container image")
+	fs.IntVar(&opts.replicas, "replicas", 2, "Deployment replicas")
+	fs.StringVar(&opts.certificate, "cert-manager-certificate", "", "namespace/name of the cert-manager Certificate of the serving certificate; its CA is injected as caBundle by cainjector")
+	fs.StringVar(&dir, "dir", "", "write a file per object to this directory instead of stdout")
+	own := map[string]bool{}
+	fs.VisitAll(func(f *flag.Flag) { own[f.Name] = true })
+	// the server's flags configure the rendered webhook
+	flag.CommandLine.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if !own[f.Name] {
+			opts.args = append(opts.args, fmt.Sprintf("--%s=%s", f.Name, f.Value))
+		}
+	})
+
+	if _, err := server.ParseFailurePolicy(*failurePolicy); err != nil {
+		fmt.Fprintf(os.Stderr, "manifests: %v\n", err)
+		return 2
+	}
+	opts.failurePolicy = admissionregistrationv1.FailurePolicyType(*failurePolicy)
+	routes, err := server.EnabledRoutes(splitList(*admissionPaths))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "manifests: %v\n", err)
+		return 2
+	}
+	opts.routes = routes
+	if opts.certificate != "" && !strings.Contains(opts.certificate, "/") {
+		fmt.Fprintln(os.Stderr, "manifests: -cert-manager-certificate must be namespace/name")
+		return 2
+	}
+
+	objects := renderManifests(opts)
+	docs := make([][]byte, 0, len(objects))
+	for _, object := range objects {
+		doc, err := yaml.Marshal(object)
+		if err == nil {
+			err = checkManifest(doc)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "manifests: %T: %v\n", object, err)
+			return 1
+		}
+		docs = append(docs, doc)
+	}
+
+	if dir == "" {
+		_, _ = os.Stdout.Write(bytes.Join(docs, []byte("---\n")))
+		return 0
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "manifests: %v\n", err)
+		return 1
+	}
+	for i, object := range objects {
+		meta := object.(metav1.Object)
+		kind := object.GetObjectKind().GroupVersionKind().Kind
+		file := filepath.Join(dir, fmt.Sprintf("%02d-%s-%s.yaml", i, strings.ToLower(kind), meta.GetName()))
+		if err := os.WriteFile(file, docs[i], 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "manifests: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkManifest decodes a rendered object back through the scheme.
+func checkManifest(doc []byte) error {
+	json, err := yaml.YAMLToJSON(doc)
+	if err != nil {
+		return err
+	}
+	_, _, err = serializer.NewCodecFactory(manifestScheme, serializer.EnableStrict).UniversalDeserializer().Decode(json, nil, nil)
+	return err
+}
+
+// renderManifests returns the objects to deploy, in apply order.
+func renderManifests(opts manifestOptions) []runtime.Object {
+	labels := map[string]string{nameLabel: opts.name, componentLabel: "webhook"}
+	meta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: opts.namespace, Labels: labels}
+	}
+	subjects := []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: opts.name, Namespace: opts.namespace}}
+
+	objects := []runtime.Object{&corev1.ServiceAccount{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+		ObjectMeta: meta(opts.name),
+	}}
+
+	// RBAC for the client features that are enabled
+	var clusterRules []rbacv1.PolicyRule
+	if !*skipOperatorCheck {
+		clusterRules = append(clusterRules, rbacv1.PolicyRule{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, Verbs: []string{"list"}})
+	}
+	if *emitEvents {
+		clusterRules = append(clusterRules, rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"create", "patch"}})
+	}
+	if *opsTokenReview {
+		clusterRules = append(clusterRules, rbacv1.PolicyRule{APIGroups: []string{"authentication.k8s.io"}, Resources: []string{"tokenreviews"}, Verbs: []string{"create"}})
+	}
+	if *reconcileConfig || *watchWebhookConfig {
+		// the drift watcher only reads
+		verbs := []string{"get", "list", "watch"}
+		if *reconcileConfig {
+			verbs = append(verbs, "update")
+		}
+		clusterRules = append(clusterRules, rbacv1.PolicyRule{
+			APIGroups:     []string{"admissionregistration.k8s.io"},
+			Resources:     []string{"mutatingwebhookconfigurations"},
+			Verbs:         verbs,
+			ResourceNames: []string{opts.name},
+		})
+	}
+	if len(clusterRules) > 0 {
+		objects = append(objects,
+			&rbacv1.ClusterRole{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+				ObjectMeta: metav1.ObjectMeta{Name: opts.name, Labels: labels},
+				Rules:      clusterRules,
+			},
+			&rbacv1.ClusterRoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Name: opts.name, Labels: labels},
+				Subjects:   subjects,
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: opts.name},
+			})
+	}
+	if *reconcileConfig || *watchWebhookConfig {
+		objects = append(objects,
+			&rbacv1.Role{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role"},
+				ObjectMeta: meta(opts.name + "-leader-election"),
+				Rules: []rbacv1.PolicyRule{{
+					APIGroups: []string{"coordination.k8s.io"},
+					Resources: []string{"leases"},
+					Verbs:     []string{"get", "create", "update"},
+				}},
+			},
+			&rbacv1.RoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"},
+				ObjectMeta: meta(opts.name + "-leader-election"),
+				Subjects:   subjects,
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: opts.name + "-leader-election"},
+			})
+	}
+	if *clientCAFromCluster {
+		objects = append(objects, &rbacv1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{Name: opts.name + "-auth-reader", Namespace: certs.AuthenticationConfigMapNamespace, Labels: labels},
+			Subjects:   subjects,
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "extension-apiserver-authentication-reader"},
+		})
+	}
+	if *activeProbe {
+		// the dry-run creates of the marker secret need the create verb
+		objects = append(objects,
+			&rbacv1.Role{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role"},
+				ObjectMeta: metav1.ObjectMeta{Name: opts.name + "-active-probe", Namespace: *activeProbeNamespace, Labels: labels},
+				Rules: []rbacv1.PolicyRule{{
+					APIGroups: []string{""},
+					Resources: []string{"secrets"},
+					Verbs:     []string{"create"},
+				}},
+			},
+			&rbacv1.RoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Name: opts.name + "-active-probe", Namespace: *activeProbeNamespace, Labels: labels},
+				Subjects:   subjects,
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: opts.name + "-active-probe"},
+			})
+	}
+
+	objects = append(objects,
+		&corev1.Service{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+			ObjectMeta: meta(opts.name),
+			Spec: corev1.ServiceSpec{
+				Selector: labels,
+				Ports: []corev1.ServicePort{{
+					Name:       "webhook",
+					Port:       443,
+					TargetPort: intstr.FromString("webhook"),
+					Protocol:   corev1.ProtocolTCP,
+				}},
+			},
+		},
+		renderDeployment(opts, meta(opts.name), labels))
+	return append(objects, renderWebhookConfigurations(opts, labels)...)
+}
+
+func renderDeployment(opts manifestOptions, meta metav1.ObjectMeta, labels map[string]string) *appsv1.Deployment {
+	replicas := int32(opts.replicas)
+	envVars := []corev1.EnvVar{
+		{Name: "WEBHOOK_PORT", Value: fmt.Sprint(manifestWebhookPort)},
+		{Name: "WEBHOOK_CERT", Value: "/etc/webhook/certs/" + corev1.TLSCertKey},
+		{Name: "WEBHOOK_KEY", Value: "/etc/webhook/certs/" + corev1.TLSPrivateKeyKey},
+		{Name: "NAMESPACE_SELECTOR", Value: env.String("NAMESPACE_SELECTOR", mutator.DefaultConfig().NamespaceSelector)},
+		{Name: "SERVING_DNS_NAMES", Value: opts.name + "." + opts.namespace + ".svc"},
+		{Name: "POD_NAMESPACE", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}},
+	}
+	if *reconcileConfig || *watchWebhookConfig {
+		envVars = append(envVars, corev1.EnvVar{Name: "WEBHOOK_CONFIG_NAME", Value: opts.name})
+	}
+	if *reconcileConfig {
+		envVars = append(envVars, corev1.EnvVar{Name: "CA_BUNDLE_FILE", Value: "/etc/webhook/certs/ca.crt"})
+	}
+	probe := func(path string) *corev1.Probe {
+		return &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{Path: path, Port: intstr.FromString("ops")},
+		}}
+	}
+	nonRoot := true
+
+	return &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: meta,
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: opts.name,
+					SecurityContext:    &corev1.PodSecurityContext{RunAsNonRoot: &nonRoot},
+					Containers: []corev1.Container{{
+						Name:  "webhook",
+						Image: opts.image,
+						Args:  opts.args,
+						Env:   envVars,
+						Ports: []corev1.ContainerPort{
+							{Name: "webhook", ContainerPort: manifestWebhookPort},
+							{Name: "ops", ContainerPort: int32(*opsPort)},
+						},
+						LivenessProbe:  probe("/healthz"),
+						ReadinessProbe: probe("/readyz"),
+						VolumeMounts:   []corev1.VolumeMount{{Name: "certs", MountPath: "/etc/webhook/certs", ReadOnly: true}},
+					}},
+					Volumes: []corev1.Volume{{
+						Name:         "certs",
+						VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: opts.name + "-tls"}},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// renderWebhookConfigurations returns the webhook configurations with an
+// entry per enabled admission path: a MutatingWebhookConfiguration, and a
+// ValidatingWebhookConfiguration when a validating path is enabled.
+func renderWebhookConfigurations(opts manifestOptions, labels map[string]string) []runtime.Object {
+	var port int32 = 443
+	// the settings the webhook configuration drift watcher expects
+	settings := server.ExpectedWebhookSettings(string(opts.failurePolicy), *emitEvents)
+	timeout := settings.TimeoutSeconds
+	sideEffects := settings.SideEffects
+	failurePolicy := settings.FailurePolicy
+	namespaceSelector := settings.NamespaceSelector
+	meta := metav1.ObjectMeta{Name: opts.name, Labels: labels}
+	// the caBundle is left empty for cainjector or the webhook's own
+	// reconciler to fill in, or for the user to set
+	if opts.certificate != "" {
+		meta.Annotations = map[string]string{"cert-manager.io/inject-ca-from": opts.certificate}
+	}
+	clientConfig := func(path string) admissionregistrationv1.WebhookClientConfig {
+		return admissionregistrationv1.WebhookClientConfig{
+			Service: &admissionregistrationv1.ServiceReference{Namespace: opts.namespace, Name: opts.name, Path: &path, Port: &port},
+		}
+	}
+	mutating := &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "MutatingWebhookConfiguration"},
+		ObjectMeta: meta,
+	}
+	validating := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "ValidatingWebhookConfiguration"},
+		ObjectMeta: meta,
+	}
+	// each path only gets the resource it handles
+	for _, route := range opts.routes {
+		if route.Validating {
+			validating.Webhooks = append(validating.Webhooks, admissionregistrationv1.ValidatingWebhook{
+				Name:                    route.WebhookName(manifestWebhookName),
+				ClientConfig:            clientConfig(route.Path),
+				Rules:                   route.Rules(),
+				NamespaceSelector:       namespaceSelector,
+				FailurePolicy:           &failurePolicy,
+				SideEffects:             &sideEffects,
+				TimeoutSeconds:          &timeout,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			})
+			continue
+		}
+		mutating.Webhooks = append(mutating.Webhooks, admissionregistrationv1.MutatingWebhook{
+			Name:                    route.WebhookName(manifestWebhookName),
+			ClientConfig:            clientConfig(route.Path),
+			Rules:                   route.Rules(),
+			NamespaceSelector:       namespaceSelector,
+			FailurePolicy:           &failurePolicy,
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeout,
+			AdmissionReviewVersions: []string{"v1", "v1beta1"},
+		})
+	}
+
+	var objects []runtime.Object
+	if len(mutating.Webhooks) > 0 {
+		objects = append(objects, mutating)
+	}
+	if len(validating.Webhooks) > 0 {
+		objects = append(objects, validating)
+	}
+	return objects
+}
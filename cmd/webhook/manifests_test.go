@@ -0,0 +1,188 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"sigs.k8s.io/yaml"
+
+	"github.com/bygui86/cert-manager-webhook/internal/server"
+)
+
+// restoreFlags puts the server's flags back as they are once the test is
+// over: manifests sets them from its arguments.
+func restoreFlags(t *testing.T) {
+	t.Helper()
+	values := map[string]string{}
+	flag.CommandLine.VisitAll(func(f *flag.Flag) { values[f.Name] = f.Value.String() })
+	t.Cleanup(func() {
+		for name, value := range values {
+			_ = flag.Set(name, value)
+		}
+	})
+}
+
+// renderedManifests runs manifests with args and decodes each document
+// back strictly through the scheme.
+func renderedManifests(t *testing.T, args ...string) (string, []runtime.Object) {
+	t.Helper()
+	restoreFlags(t)
+	code, out := captureStdout(t, func() int { return runManifests(args) })
+	if code != 0 {
+		t.Fatalf("manifests %q exit %d", args, code)
+	}
+	decoder := serializer.NewCodecFactory(manifestScheme, serializer.EnableStrict).UniversalDeserializer()
+	var objects []runtime.Object
+	for _, doc := range strings.Split(out, "---\n") {
+		json, err := yaml.YAMLToJSON([]byte(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		object, _, err := decoder.Decode(json, nil, nil)
+		if err != nil {
+			t.Fatalf("document doesn't decode: %v\n%s", err, doc)
+		}
+		objects = append(objects, object)
+	}
+	return out, objects
+}
+
+// kinds returns the kind of each object, in order.
+func kinds(objects []runtime.Object) []string {
+	var kinds []string
+	for _, object := range objects {
+		kinds = append(kinds, object.GetObjectKind().GroupVersionKind().Kind)
+	}
+	return kinds
+}
+
+func TestManifestsDecode(t *testing.T) {
+	out, objects := renderedManifests(t, "-name", "webhook", "-namespace", "infra", "-image", "example/webhook:v1", "-replicas", "3")
+	want := []string{"ServiceAccount", "ClusterRole", "ClusterRoleBinding", "Service", "Deployment", "MutatingWebhookConfiguration"}
+	if got := kinds(objects); !slices.Equal(got, want) {
+		t.Fatalf("rendered %v, want %v", got, want)
+	}
+
+	deployment := objects[4].(*appsv1.Deployment)
+	container := deployment.Spec.Template.Spec.Containers[0]
+	if deployment.Namespace != "infra" || *deployment.Spec.Replicas != 3 || container.Image != "example/webhook:v1" {
+		t.Errorf("deployment %s/%s of %d replicas of %s", deployment.Namespace, deployment.Name, *deployment.Spec.Replicas, container.Image)
+	}
+	if len(container.Args) != 0 {
+		t.Errorf("container args %v, want none with no server flag set", container.Args)
+	}
+
+	config := objects[5].(*admissionregistrationv1.MutatingWebhookConfiguration)
+	if len(config.Webhooks) != 1 {
+		t.Fatalf("%d webhooks, want 1", len(config.Webhooks))
+	}
+	webhook := config.Webhooks[0]
+	if service := webhook.ClientConfig.Service; service.Namespace != "infra" || service.Name != "webhook" || *service.Path != server.PathMutateSecrets {
+		t.Errorf("webhook calls %s/%s%s", service.Namespace, service.Name, *service.Path)
+	}
+	if *webhook.FailurePolicy != admissionregistrationv1.Ignore || len(webhook.Rules) == 0 || webhook.Rules[0].Resources[0] != "secrets" {
+		t.Errorf("webhook failing %s with rules %+v", *webhook.FailurePolicy, webhook.Rules)
+	}
+	if len(config.Annotations) != 0 {
+		t.Errorf("annotations %v without a certificate", config.Annotations)
+	}
+
+	// the same flags render the same bytes, for diffing in GitOps
+	again, _ := renderedManifests(t, "-name", "webhook", "-namespace", "infra", "-image", "example/webhook:v1", "-replicas", "3")
+	if again != out {
+		t.Error("two renders differ")
+	}
+}
+
+// The server's flags shape the webhook and the RBAC it needs, and are
+// passed on to the container.
+func TestManifestsServerFlags(t *testing.T) {
+	_, objects := renderedManifests(t,
+		"-emit-events", "-failure-policy", "Fail", "-cert-manager-certificate", "cert-manager/webhook-tls")
+	want := []string{"ServiceAccount", "ClusterRole", "ClusterRoleBinding", "Service", "Deployment", "MutatingWebhookConfiguration"}
+	if got := kinds(objects); !slices.Equal(got, want) {
+		t.Fatalf("rendered %v, want %v", got, want)
+	}
+
+	role := objects[1].(*rbacv1.ClusterRole)
+	if !slices.ContainsFunc(role.Rules, func(rule rbacv1.PolicyRule) bool { return slices.Contains(rule.Resources, "events") }) {
+		t.Errorf("cluster role rules %+v, want events with -emit-events", role.Rules)
+	}
+	args := objects[4].(*appsv1.Deployment).Spec.Template.Spec.Containers[0].Args
+	for _, arg := range []string{"--emit-events=true", "--failure-policy=Fail"} {
+		if !slices.Contains(args, arg) {
+			t.Errorf("container args %v, want %s", args, arg)
+		}
+	}
+	if slices.ContainsFunc(args, func(arg string) bool { return strings.HasPrefix(arg, "--cert-manager-certificate") }) {
+		t.Errorf("container args %v carry a manifests flag", args)
+	}
+
+	mutating := objects[5].(*admissionregistrationv1.MutatingWebhookConfiguration)
+	if mutating.Annotations["cert-manager.io/inject-ca-from"] != "cert-manager/webhook-tls" {
+		t.Errorf("annotations %v, want the cainjector one", mutating.Annotations)
+	}
+	for _, webhook := range mutating.Webhooks {
+		if *webhook.FailurePolicy != admissionregistrationv1.Fail {
+			t.Errorf("webhook %s fails %s, want Fail", webhook.Name, *webhook.FailurePolicy)
+		}
+		if *webhook.SideEffects != admissionregistrationv1.SideEffectClassNoneOnDryRun {
+			t.Errorf("webhook %s has side effects %s with -emit-events, want NoneOnDryRun", webhook.Name, *webhook.SideEffects)
+		}
+	}
+}
+
+// With -dir, each document goes to a file named after its order, kind and
+// name, with the bytes stdout would get.
+func TestManifestsDir(t *testing.T) {
+	out, objects := renderedManifests(t)
+	dir := filepath.Join(t.TempDir(), "manifests")
+	if code := runManifests([]string{"-dir", dir}); code != 0 {
+		t.Fatalf("exit %d", code)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(objects) {
+		t.Fatalf("%d files for %d objects", len(entries), len(objects))
+	}
+	var docs []string
+	for _, entry := range entries {
+		body, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, string(body))
+	}
+	if entries[0].Name() != "00-serviceaccount-cert-manager-webhook.yaml" {
+		t.Errorf("first file %s", entries[0].Name())
+	}
+	if strings.Join(docs, "---\n") != out {
+		t.Error("files differ from stdout")
+	}
+}
+
+func TestManifestsUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{"-cert-manager-certificate", "webhook-tls"},
+		{"-failure-policy", "Sometimes"},
+		{"-no-such-flag"},
+	} {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			restoreFlags(t)
+			if code := runManifests(args); code != 2 {
+				t.Errorf("runManifests(%q) exit %d, want 2", args, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+
+	"golang.org/x/sync/errgroup"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/bygui86/cert-manager-webhook/internal/server"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+const (
+	// migratePageSize is the number of secrets listed per request.
+	migratePageSize = 500
+	// migrateFieldManager owns the fields migrate patches.
+	migrateFieldManager = "cert-manager-webhook-migrate"
+)
+
+// migrateCounts are the results of one namespace.
+type migrateCounts struct {
+	examined, patched, conflicts, failed int
+}
+
+// migration patches existing secrets the way the webhook would have.
+type migration struct {
+	client   kubernetes.Interface
+	mutator  *mutator.Mutator
+	lookups  mutator.NamespaceLister
+	certs    mutator.CertificateLister
+	ingress  mutator.IngressLister
+	dryRun   bool
+	limit    int64 // secrets patched at most, 0 for all
+	pageSize int64 // secrets listed per request
+	out      io.Writer
+
+	patched atomic.Int64
+	mu      sync.Mutex
+	counts  map[string]*migrateCounts // by namespace
+}
+
+// runMigrate implements the migrate subcommand: it lists the secrets of the
+// cluster, evaluates them with the configured policy and patches the ones
+// the webhook would have patched, once, for clusters that don't run the
+// backfill controller. Secrets whose annotations hold another value than the
+// policy's, or that changed since they were listed, are reported as
+// conflicts and left alone. It prints a summary per namespace and exits 1
+// when a patch failed.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	var (
+		kubeconfigPath = fs.String("kubeconfig", "", "kubeconfig of the cluster, the pod's service account when empty")
+		namespace      = fs.String("namespace", "", "only migrate the secrets of this namespace")
+		selector       = fs.String("selector", "", "only migrate the secrets matching this label selector")
+		dryRun         = fs.Bool("dry-run", false, "print the patches instead of sending them")
+		concurrency    = fs.Int("concurrency", 4, "secrets evaluated and patched at once")
+		limit          = fs.Int64("limit", 0, "patch at most this many secrets, 0 for all")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *concurrency <= 0 || *limit < 0 {
+		fmt.Fprintln(os.Stderr, "migrate: -concurrency must be positive and -limit not negative")
+		return 2
+	}
+	client, err := kubeClientFor(*kubeconfigPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 2
+	}
+	settings, err := clusterMutatorConfig(client)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 2
+	}
+	m, err := mutator.New(settings)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 2
+	}
+	dynamicClient, err := dynamicClientFor(*kubeconfigPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 2
+	}
+
+	ctx := context.Background()
+	mg := &migration{
+		client:   client,
+		mutator:  m,
+		lookups:  newAPINamespaces(ctx, client),
+		certs:    newAPICertificates(ctx, dynamicClient),
+		ingress:  newAPIIngresses(ctx, client),
+		dryRun:   *dryRun,
+		limit:    *limit,
+		pageSize: migratePageSize,
+		out:      os.Stdout,
+		counts:   map[string]*migrateCounts{},
+	}
+	return mg.execute(ctx, *namespace, *selector, *concurrency)
+}
+
+// execute migrates the secrets of namespace matching selector, prints the
+// summary and returns the exit code.
+func (mg *migration) execute(ctx context.Context, namespace, selector string, concurrency int) int {
+	listErr := mg.run(ctx, namespace, selector, concurrency)
+	failed := mg.summarize(mg.out)
+	if listErr != nil {
+		fmt.Fprintf(os.Stderr, "migrate: listing secrets: %v\n", listErr)
+		return 1
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// run lists the secrets page by page, migrating each page before the next
+// is fetched, until they are all done or the limit is reached.
+func (mg *migration) run(ctx context.Context, namespace, selector string, concurrency int) error {
+	opts := metav1.ListOptions{LabelSelector: selector, Limit: mg.pageSize}
+	for {
+		list, err := mg.client.CoreV1().Secrets(namespace).List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		g := new(errgroup.Group)
+		g.SetLimit(concurrency)
+		for i := range list.Items {
+			if mg.limitReached() {
+				break
+			}
+			secret := &list.Items[i]
+			g.Go(func() error {
+				mg.migrate(ctx, secret)
+				return nil
+			})
+		}
+		_ = g.Wait()
+		if list.Continue == "" || mg.limitReached() {
+			return nil
+		}
+		opts.Continue = list.Continue
+	}
+}
+
+func (mg *migration) limitReached() bool {
+	return mg.limit > 0 && mg.patched.Load() >= mg.limit
+}
+
+// migrate evaluates one secret and patches it unless it conflicts.
+func (mg *migration) migrate(ctx context.Context, secret *corev1.Secret) {
+	ref := secret.Namespace + "/" + secret.Name
+	admission := mutator.AdmissionContext{Operation: string(v1beta1.Update), Secret: secret, Namespaces: mg.lookups, Certificates: mg.certs,
+		Ingresses: mg.ingress}
+	decision, patch, err := mg.mutator.Evaluate(ctx, admission)
+	if err != nil {
+		mg.count(secret.Namespace, func(c *migrateCounts) { c.failed++ })
+		fmt.Fprintf(mg.out, "FAILED    %s: evaluating: %v\n", ref, err)
+		return
+	}
+	if !decision.Mutate {
+		mg.count(secret.Namespace, nil)
+		return
+	}
+	if conflicts := mutator.ConflictingAnnotations(secret.Annotations, decision.Annotations); len(conflicts) > 0 {
+		mg.count(secret.Namespace, func(c *migrateCounts) { c.conflicts++ })
+		for _, key := range conflicts {
+			fmt.Fprintf(mg.out, "CONFLICT  %s: %s is %q, the policy wants %q\n", ref, key, secret.Annotations[key], decision.Annotations[key])
+		}
+		return
+	}
+	// claim a slot under the limit before patching
+	if n := mg.patched.Add(1); mg.limit > 0 && n > mg.limit {
+		mg.patched.Add(-1)
+		return
+	}
+	// the patch only applies to the secret as listed and checked for
+	// conflicts, not to one changed since
+	guard := mutator.PatchOperation{Op: "test", Path: "/metadata/resourceVersion", Value: secret.ResourceVersion}
+	guarded := append([]mutator.PatchOperation{guard}, patch...)
+	patchBytes, err := mutator.MarshalPatch(guarded)
+	if err == nil && !mg.dryRun {
+		_, err = mg.client.CoreV1().Secrets(secret.Namespace).Patch(ctx, secret.Name, types.JSONPatchType, patchBytes,
+			metav1.PatchOptions{FieldManager: migrateFieldManager})
+	}
+	if apierrors.IsInvalid(err) {
+		// the API server refuses a patch whose test failed as invalid
+		mg.patched.Add(-1)
+		mg.count(secret.Namespace, func(c *migrateCounts) { c.conflicts++ })
+		fmt.Fprintf(mg.out, "CONFLICT  %s: changed since listed\n", ref)
+		return
+	}
+	if err != nil {
+		mg.patched.Add(-1)
+		mg.count(secret.Namespace, func(c *migrateCounts) { c.failed++ })
+		fmt.Fprintf(mg.out, "FAILED    %s: patching: %v\n", ref, err)
+		return
+	}
+	mg.count(secret.Namespace, func(c *migrateCounts) { c.patched++ })
+	if mg.dryRun {
+		// the patch may carry key material, e.g. a bundle with tls.key
+		fmt.Fprintf(mg.out, "WOULD     %s: %s\n", ref, server.RedactPatch(guarded))
+	} else {
+		fmt.Fprintf(mg.out, "PATCHED   %s (rule %s)\n", ref, decision.Rule)
+	}
+}
+
+// count records an examined secret of namespace, with update adding its
+// result.
+func (mg *migration) count(namespace string, update func(*migrateCounts)) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	c, ok := mg.counts[namespace]
+	if !ok {
+		c = &migrateCounts{}
+		mg.counts[namespace] = c
+	}
+	c.examined++
+	if update != nil {
+		update(c)
+	}
+}
+
+// summarize prints the counts per namespace and returns the failures.
+func (mg *migration) summarize(w io.Writer) int {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	patchedHeader := "PATCHED"
+	if mg.dryRun {
+		patchedHeader = "WOULD PATCH"
+	}
+	fmt.Fprintf(tw, "\nNAMESPACE\tEXAMINED\t%s\tCONFLICTS\tFAILED\n", patchedHeader)
+	var total migrateCounts
+	for _, namespace := range slices.Sorted(maps.Keys(mg.counts)) {
+		c := mg.counts[namespace]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", namespace, c.examined, c.patched, c.conflicts, c.failed)
+		total.examined += c.examined
+		total.patched += c.patched
+		total.conflicts += c.conflicts
+		total.failed += c.failed
+	}
+	fmt.Fprintf(tw, "TOTAL\t%d\t%d\t%d\t%d\n", total.examined, total.patched, total.conflicts, total.failed)
+	_ = tw.Flush()
+	if mg.limitReached() {
+		fmt.Fprintf(w, "stopped at the limit of %d patched secrets\n", mg.limit)
+	}
+	return total.failed
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/bygui86/cert-manager-webhook/internal/server"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// listedSecret returns a cert-manager secret as listed from the API server,
+// with a resourceVersion, carrying annotations on top of cert-manager's.
+func listedSecret(namespace, name string, annotations map[string]string) *corev1.Secret {
+	secret := server.FixtureSecret{Name: name, Namespace: namespace, DataSize: 16}.Build()
+	secret.ResourceVersion = "1"
+	for key, value := range annotations {
+		secret.Annotations[key] = value
+	}
+	return secret
+}
+
+// newMigration returns a migration of the default policy over client,
+// writing to out.
+func newMigration(t *testing.T, client *fake.Clientset, out *syncBuffer) *migration {
+	t.Helper()
+	m, err := mutator.New(mutator.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &migration{
+		client:   client,
+		mutator:  m,
+		lookups:  newAPINamespaces(context.Background(), client),
+		pageSize: migratePageSize,
+		out:      out,
+		counts:   map[string]*migrateCounts{},
+	}
+}
+
+// paginate makes the secret lists of client honor the limit and continue
+// token like the API server's, the token being the offset of the next
+// page, and returns the count of lists.
+func paginate(client *fake.Clientset) *atomic.Int32 {
+	var lists atomic.Int32
+	client.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		lists.Add(1)
+		opts := action.(k8stesting.ListActionImpl).ListOptions
+		obj, err := client.Tracker().List(corev1.SchemeGroupVersion.WithResource("secrets"),
+			corev1.SchemeGroupVersion.WithKind("Secret"), action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		items := obj.(*corev1.SecretList).Items
+		slices.SortFunc(items, func(a, b corev1.Secret) int {
+			return strings.Compare(a.Namespace+"/"+a.Name, b.Namespace+"/"+b.Name)
+		})
+		offset, _ := strconv.Atoi(opts.Continue)
+		end := len(items)
+		if opts.Limit > 0 {
+			end = min(offset+int(opts.Limit), end)
+		}
+		page := &corev1.SecretList{Items: items[offset:end]}
+		if end < len(items) {
+			page.Continue = strconv.Itoa(end)
+		}
+		return true, page, nil
+	})
+	return &lists
+}
+
+// patches returns the secrets client was sent patches for.
+func patches(client *fake.Clientset) []string {
+	var patched []string
+	for _, action := range client.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok {
+			patched = append(patched, patch.GetNamespace()+"/"+patch.GetName())
+		}
+	}
+	return patched
+}
+
+// summaryRow returns the counts of the summary row of name, space separated.
+func summaryRow(out, name string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) == 5 && fields[0] == name {
+			return strings.Join(fields[1:], " ")
+		}
+	}
+	return ""
+}
+
+// Eligible secrets are patched with the annotations the webhook would set,
+// skipped ones are left alone and conflicting ones are reported and left
+// alone.
+func TestMigrate(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		listedSecret("apps", "api-tls", nil),
+		listedSecret(metav1.NamespaceSystem, "api-tls", nil),
+		listedSecret("apps", "conflict-tls", map[string]string{mutator.SyncAnnotationKey: "env=prod"}),
+	)
+	var out syncBuffer
+	if code := newMigration(t, client, &out).execute(context.Background(), "", "", 2); code != 0 {
+		t.Fatalf("exit %d: %s", code, out.String())
+	}
+
+	if got := patches(client); !slices.Equal(got, []string{"apps/api-tls"}) {
+		t.Errorf("patched %v, want only apps/api-tls", got)
+	}
+	secret, err := client.CoreV1().Secrets("apps").Get(context.Background(), "api-tls", metav1.GetOptions{})
+	if err != nil || secret.Annotations[mutator.SyncAnnotationKey] != "true" {
+		t.Errorf("migrated secret annotated %v: %v", secret.Annotations, err)
+	}
+	for _, want := range []string{
+		"PATCHED   apps/api-tls",
+		`CONFLICT  apps/conflict-tls: ` + mutator.SyncAnnotationKey + ` is "env=prod", the policy wants "true"`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+	if got := summaryRow(out.String(), "apps"); got != "2 1 1 0" {
+		t.Errorf("summary of apps %q, want 2 examined, 1 patched, 1 conflict:\n%s", got, out.String())
+	}
+}
+
+// A dry run prints the guarded patches and sends none.
+func TestMigrateDryRun(t *testing.T) {
+	client := fake.NewSimpleClientset(listedSecret("apps", "api-tls", nil))
+	var out syncBuffer
+	mg := newMigration(t, client, &out)
+	mg.dryRun = true
+	if code := mg.execute(context.Background(), "", "", 1); code != 0 {
+		t.Fatalf("exit %d: %s", code, out.String())
+	}
+	if got := patches(client); len(got) != 0 {
+		t.Errorf("dry run patched %v", got)
+	}
+	want := `WOULD     apps/api-tls: [{"op":"test","path":"/metadata/resourceVersion","value":"1"}`
+	if !strings.Contains(out.String(), want) || !strings.Contains(out.String(), "WOULD PATCH") {
+		t.Errorf("output lacks the guarded patch %s:\n%s", want, out.String())
+	}
+}
+
+// The limit holds across pages, and no page is listed past it.
+func TestMigrateLimitAcrossPages(t *testing.T) {
+	var secrets []runtime.Object
+	for i := range 7 {
+		secrets = append(secrets, listedSecret("apps", "tls-"+strconv.Itoa(i), nil))
+	}
+	client := fake.NewSimpleClientset(secrets...)
+	lists := paginate(client)
+	var out syncBuffer
+	mg := newMigration(t, client, &out)
+	mg.pageSize, mg.limit = 2, 3
+	if code := mg.execute(context.Background(), "", "", 1); code != 0 {
+		t.Fatalf("exit %d: %s", code, out.String())
+	}
+
+	if got := patches(client); !slices.Equal(got, []string{"apps/tls-0", "apps/tls-1", "apps/tls-2"}) {
+		t.Errorf("patched %v, want the first 3 secrets", got)
+	}
+	if got := lists.Load(); got != 2 {
+		t.Errorf("%d pages listed, want 2", got)
+	}
+	if !strings.Contains(out.String(), "stopped at the limit of 3 patched secrets") {
+		t.Errorf("output lacks the limit:\n%s", out.String())
+	}
+}
+
+// A secret changed since it was listed fails the patch's test and is
+// reported as a conflict, not a failure.
+func TestMigrateChangedSinceListed(t *testing.T) {
+	client := fake.NewSimpleClientset(listedSecret("apps", "api-tls", nil))
+	client.PrependReactor("patch", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewGenericServerResponse(http.StatusUnprocessableEntity, "", schema.GroupResource{}, "",
+			"testing value /metadata/resourceVersion failed: test failed", 0, false)
+	})
+	var out syncBuffer
+	if code := newMigration(t, client, &out).execute(context.Background(), "", "", 1); code != 0 {
+		t.Fatalf("exit %d: %s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "CONFLICT  apps/api-tls: changed since listed") {
+		t.Errorf("output lacks the conflict:\n%s", out.String())
+	}
+	if got := summaryRow(out.String(), "TOTAL"); got != "1 0 1 0" {
+		t.Errorf("summary %q, want the secret counted as a conflict:\n%s", got, out.String())
+	}
+}
+
+// A refused patch is reported as failed and makes migrate exit 1.
+func TestMigrateFailure(t *testing.T) {
+	client := fake.NewSimpleClientset(listedSecret("apps", "api-tls", nil))
+	client.PrependReactor("patch", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "api-tls", nil)
+	})
+	var out syncBuffer
+	if code := newMigration(t, client, &out).execute(context.Background(), "", "", 1); code != 1 {
+		t.Errorf("exit %d, want 1 for a failed patch", code)
+	}
+	if !strings.Contains(out.String(), "FAILED    apps/api-tls: patching:") {
+		t.Errorf("output lacks the failure:\n%s", out.String())
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/bygui86/cert-manager-webhook/internal/server"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// probeCheck is one verified property of a probe's answer.
+type probeCheck struct {
+	name   string
+	err    error
+	failed bool
+}
+
+// probeTimings are the phases of a probe request; zero when not measured.
+type probeTimings struct {
+	connect   time.Duration
+	tls       time.Duration
+	firstByte time.Duration
+	total     time.Duration
+}
+
+// runProbe implements the probe subcommand: it POSTs an AdmissionReview for
+// a dummy cert-manager secret to a running webhook, either at -url or
+// through the API server's service proxy with -kubeconfig, and checks the
+// answer end to end. It exits 1 when any check fails.
+func runProbe(args []string) int {
+	fs := flag.NewFlagSet("probe", flag.ContinueOnError)
+	var (
+		url        = fs.String("url", "", "webhook URL, e.g. https://localhost:8443/mutate/secrets")
+		kubeconfig = fs.String("kubeconfig", "", "reach the webhook through the API server's service proxy with this kubeconfig instead of -url")
+		service    = fs.String("service", "", "namespace/name of the webhook Service, with -kubeconfig")
+		path       = fs.String("path", server.PathMutateSecrets, "webhook path on the Service, with -kubeconfig")
+		namespace  = fs.String("namespace", "default", "namespace of the dummy secret")
+		timeout    = fs.Duration("timeout", 10*time.Second, "timeout of the request")
+		tlsFlags   clientTLSFlags
+	)
+	tlsFlags.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if (*url == "") == (*kubeconfig == "") || (*kubeconfig != "" && !strings.Contains(*service, "/")) {
+		fmt.Fprintln(os.Stderr, "probe: set either -url, or -kubeconfig with -service namespace/name")
+		return 2
+	}
+
+	secret := server.FixtureSecret{Name: "probe-tls", Namespace: *namespace, DataSize: 8}.Build()
+	review, err := server.FixtureReview(secret, v1beta1.Create, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "probe: %v\n", err)
+		return 1
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "probe: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	var (
+		answer  []byte
+		timings probeTimings
+	)
+	if *url != "" {
+		tlsConfig, err := tlsFlags.config()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "probe: %v\n", err)
+			return 2
+		}
+		answer, timings, err = probeURL(ctx, *url, tlsConfig, body)
+		if err != nil {
+			fmt.Printf("FAIL  request: %v\n", err)
+			return 1
+		}
+	} else {
+		config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "probe: %v\n", err)
+			return 2
+		}
+		client, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "probe: %v\n", err)
+			return 2
+		}
+		ns, name, _ := strings.Cut(*service, "/")
+		start := time.Now()
+		answer, err = client.CoreV1().RESTClient().Post().
+			Namespace(ns).Resource("services").Name("https:"+name+":443").
+			SubResource("proxy").Suffix(*path).
+			SetHeader("Content-Type", "application/json").
+			Body(body).DoRaw(ctx)
+		timings.total = time.Since(start)
+		if err != nil {
+			fmt.Printf("FAIL  request through the service proxy: %v\n", err)
+			return 1
+		}
+	}
+
+	failed := false
+	for _, check := range checkProbeAnswer(review, answer) {
+		if check.failed {
+			failed = true
+			fmt.Printf("FAIL  %s: %v\n", check.name, check.err)
+		} else {
+			fmt.Printf("PASS  %s\n", check.name)
+		}
+	}
+	if timings.connect > 0 {
+		fmt.Printf("timings: connect %s  tls %s  first byte %s  total %s\n",
+			timings.connect, timings.tls, timings.firstByte, timings.total)
+	} else {
+		fmt.Printf("timings: total %s\n", timings.total)
+	}
+	if failed {
+		fmt.Println("result: FAIL")
+		return 1
+	}
+	fmt.Println("result: PASS")
+	return 0
+}
+
+// probeURL POSTs body to url and times the phases of the request.
+func probeURL(ctx context.Context, url string, tlsConfig *tls.Config, body []byte) ([]byte, probeTimings, error) {
+	var (
+		timings                       probeTimings
+		start, connectStart, tlsStart time.Time
+	)
+	trace := &httptrace.ClientTrace{
+		ConnectStart:         func(string, string) { connectStart = time.Now() },
+		ConnectDone:          func(string, string, error) { timings.connect = time.Since(connectStart) },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { timings.tls = time.Since(tlsStart) },
+		GotFirstResponseByte: func() { timings.firstByte = time.Since(start) },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, timings, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+	start = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, timings, err
+	}
+	defer resp.Body.Close()
+	answer, err := io.ReadAll(resp.Body)
+	timings.total = time.Since(start)
+	if err != nil {
+		return nil, timings, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, timings, fmt.Errorf("webhook answered %d: %s", resp.StatusCode, bytes.TrimSpace(answer))
+	}
+	return answer, timings, nil
+}
+
+// checkProbeAnswer verifies the webhook's answer to review, stopping at the
+// first check later ones depend on.
+func checkProbeAnswer(review *v1beta1.AdmissionReview, answer []byte) []probeCheck {
+	var checks []probeCheck
+	check := func(name string, err error) bool {
+		checks = append(checks, probeCheck{name: name, err: err, failed: err != nil})
+		return err == nil
+	}
+
+	var decoded v1beta1.AdmissionReview
+	if err := json.Unmarshal(answer, &decoded); err != nil || decoded.Response == nil {
+		if err == nil {
+			err = fmt.Errorf("no response in %s", answer)
+		}
+		check("response is an AdmissionReview", err)
+		return checks
+	}
+	check("response is an AdmissionReview", nil)
+	response := decoded.Response
+
+	var err error
+	if response.UID != review.Request.UID {
+		err = fmt.Errorf("got %q, sent %q", response.UID, review.Request.UID)
+	}
+	check("UID echoed", err)
+
+	err = nil
+	if !response.Allowed {
+		err = fmt.Errorf("secret was not allowed")
+		if response.Result != nil {
+			err = fmt.Errorf("secret was not allowed: %s", response.Result.Message)
+		}
+	}
+	if !check("secret allowed", err) {
+		return checks
+	}
+
+	err = nil
+	if response.PatchType == nil || *response.PatchType != v1beta1.PatchTypeJSONPatch {
+		err = fmt.Errorf("want %s", v1beta1.PatchTypeJSONPatch)
+	}
+	if !check("patch type", err) {
+		return checks
+	}
+
+	mutated, err := server.ApplyPatch(review.Request.Object.Raw, response.Patch)
+	if err == nil {
+		if _, ok := mutated.Annotations[mutator.SyncAnnotationKey]; !ok {
+			err = fmt.Errorf("patched secret has no %s annotation", mutator.SyncAnnotationKey)
+		}
+	}
+	check("patch sets "+mutator.SyncAnnotationKey, err)
+	return checks
+}
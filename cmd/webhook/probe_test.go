@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// serverCAFile writes the certificate of ts to a file and returns its path.
+func serverCAFile(t *testing.T, ts *httptest.Server) string {
+	t.Helper()
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return caFile
+}
+
+func TestProbeURL(t *testing.T) {
+	webhook := newTestHandler(t)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		noCA    bool
+		code    int
+		lines   []string
+	}{
+		{
+			name:    "pass",
+			handler: webhook.ServeHTTP,
+			code:    0,
+			lines:   []string{"PASS  UID echoed\n", "PASS  patch sets " + mutator.SyncAnnotationKey + "\n", "timings: connect ", "result: PASS\n"},
+		},
+		{
+			name: "non-2xx",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "broken", http.StatusInternalServerError)
+			},
+			code:  1,
+			lines: []string{"FAIL  request: webhook answered 500: broken\n"},
+		},
+		{
+			name:    "untrusted certificate",
+			handler: webhook.ServeHTTP,
+			noCA:    true,
+			code:    1,
+			lines:   []string{"FAIL  request: ", "certificate"},
+		},
+		{
+			name: "denied",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				var review v1beta1.AdmissionReview
+				_ = json.NewDecoder(r.Body).Decode(&review)
+				_ = json.NewEncoder(w).Encode(v1beta1.AdmissionReview{Response: &v1beta1.AdmissionResponse{UID: review.Request.UID}})
+			},
+			code:  1,
+			lines: []string{"PASS  UID echoed\n", "FAIL  secret allowed: ", "result: FAIL\n"},
+		},
+		{
+			name: "wrong UID",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(v1beta1.AdmissionReview{Response: &v1beta1.AdmissionResponse{UID: "other", Allowed: true}})
+			},
+			code:  1,
+			lines: []string{"FAIL  UID echoed: ", "FAIL  patch type: ", "result: FAIL\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewTLSServer(tt.handler)
+			defer ts.Close()
+			args := []string{"-url", ts.URL + "/mutate"}
+			if !tt.noCA {
+				args = append(args, "-ca-file", serverCAFile(t, ts))
+			}
+			code, out := captureStdout(t, func() int { return runProbe(args) })
+			if code != tt.code {
+				t.Errorf("exit %d, want %d:\n%s", code, tt.code, out)
+			}
+			for _, line := range tt.lines {
+				if !strings.Contains(out, line) {
+					t.Errorf("no %q in:\n%s", line, out)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-url", "https://localhost:8443/mutate", "-kubeconfig", "kubeconfig"},
+		{"-kubeconfig", "kubeconfig", "-service", "webhook"},
+		{"-url", "https://localhost:8443/mutate", "-ca-file", filepath.Join(t.TempDir(), "missing.crt")},
+	} {
+		if code := runProbe(args); code != 2 {
+			t.Errorf("runProbe(%q) exit %d, want 2", args, code)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+const (
+	// clusterProfilesKey holds the cluster profiles in the stage settings
+	// file: stage settings by stage name, by profile name.
+	clusterProfilesKey = "clusterProfiles"
+	// defaultProfileKey is the label or annotation of the cluster identity
+	// object naming the cluster profile.
+	defaultProfileKey = "cert-sync.bygui86.io/cluster-profile"
+	// defaultClusterNameKey is the key of the --cluster-name-configmap
+	// ConfigMap holding the cluster name.
+	defaultClusterNameKey = "cluster-name"
+)
+
+// clusterIdentity is what the settings are picked by and stamped with in a
+// cluster.
+type clusterIdentity struct {
+	profile string // of the stage settings file, empty when none
+	name    string // written in the cluster annotation, empty when none
+}
+
+// resolveClusterIdentity returns the identity of the cluster client
+// reaches, nil for the subcommands without cluster access.
+func resolveClusterIdentity(ctx context.Context, client kubeClientFunc) (clusterIdentity, error) {
+	profile, err := selectClusterProfile(ctx, client)
+	if err != nil {
+		return clusterIdentity{}, err
+	}
+	name, err := resolveClusterName(ctx, client)
+	if err != nil {
+		return clusterIdentity{}, err
+	}
+	return clusterIdentity{profile: profile, name: name}, nil
+}
+
+// resolveClusterName returns the cluster name: --cluster-name, which
+// defaults to CLUSTER_NAME, else the --cluster-name-key of the
+// --cluster-name-configmap ConfigMap, and empty when none is set. A ConfigMap
+// that can't be read or lacks the key is an error.
+func resolveClusterName(ctx context.Context, client kubeClientFunc) (string, error) {
+	if *clusterName != "" || *clusterNameConfigMap == "" {
+		return *clusterName, nil
+	}
+	namespace, name, ok := strings.Cut(*clusterNameConfigMap, "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("cluster name ConfigMap %q is not <namespace>/<name>", *clusterNameConfigMap)
+	}
+	if client == nil {
+		return "", fmt.Errorf("cluster name ConfigMap %s: no cluster access, set --cluster-name", *clusterNameConfigMap)
+	}
+	c, err := client()
+	if err != nil {
+		return "", fmt.Errorf("cluster name ConfigMap %s: %w", *clusterNameConfigMap, err)
+	}
+	cm, err := c.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("cluster name ConfigMap %s: %w", *clusterNameConfigMap, err)
+	}
+	value := strings.TrimSpace(cm.Data[*clusterNameKey])
+	if value == "" {
+		return "", fmt.Errorf("cluster name ConfigMap %s has no %s", *clusterNameConfigMap, *clusterNameKey)
+	}
+	return value, nil
+}
+
+// selectClusterProfile returns the name of the cluster profile the settings
+// are picked by: --profile when set, else the label or annotation
+// --profile-key of the --profile-source object, read with client, and empty
+// when neither is set. An object that can't be read or doesn't name a
+// profile is an error.
+func selectClusterProfile(ctx context.Context, client kubeClientFunc) (string, error) {
+	if *clusterProfile != "" || *clusterProfileSource == "" {
+		return *clusterProfile, nil
+	}
+	kind, name, _ := strings.Cut(*clusterProfileSource, "/")
+	var get func(kubernetes.Interface) (metav1.Object, error)
+	switch {
+	case kind == "namespace" && name != "" && !strings.Contains(name, "/"):
+		get = func(c kubernetes.Interface) (metav1.Object, error) {
+			return c.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+		}
+	case kind == "configmap" && strings.Count(name, "/") == 1:
+		namespace, configMap, _ := strings.Cut(name, "/")
+		get = func(c kubernetes.Interface) (metav1.Object, error) {
+			return c.CoreV1().ConfigMaps(namespace).Get(ctx, configMap, metav1.GetOptions{})
+		}
+	default:
+		return "", fmt.Errorf("profile source %q is neither namespace/<name> nor configmap/<namespace>/<name>", *clusterProfileSource)
+	}
+	if client == nil {
+		return "", fmt.Errorf("profile source %s: no cluster access, set --profile", *clusterProfileSource)
+	}
+	c, err := client()
+	if err != nil {
+		return "", fmt.Errorf("profile source %s: %w", *clusterProfileSource, err)
+	}
+	obj, err := get(c)
+	if err != nil {
+		return "", fmt.Errorf("profile source %s: %w", *clusterProfileSource, err)
+	}
+	profile := obj.GetLabels()[*clusterProfileKey]
+	if profile == "" {
+		profile = obj.GetAnnotations()[*clusterProfileKey]
+	}
+	if profile == "" {
+		return "", fmt.Errorf("profile source %s has no %s label or annotation", *clusterProfileSource, *clusterProfileKey)
+	}
+	return profile, nil
+}
+
+// clusterMutatorConfig returns the mutation settings of the cluster client
+// reaches, for the subcommands working on one.
+func clusterMutatorConfig(client kubernetes.Interface) (mutator.Config, error) {
+	identity, err := resolveClusterIdentity(context.Background(), func() (kubernetes.Interface, error) { return client, nil })
+	if err != nil {
+		return mutator.Config{}, err
+	}
+	return mutatorConfig(identity)
+}
+
+// offlineMutatorConfig returns the mutation settings for the subcommands
+// without cluster access, which need the profile and cluster name given
+// with --profile and --cluster-name.
+func offlineMutatorConfig() (mutator.Config, error) {
+	identity, err := resolveClusterIdentity(context.Background(), nil)
+	if err != nil {
+		return mutator.Config{}, err
+	}
+	return mutatorConfig(identity)
+}
+
+// applyClusterProfile takes the cluster profiles out of settings, the
+// content of the stage settings file, and lays the settings of profile over
+// the others, a stage's settings in the profile replacing its shared ones.
+// A file with profiles needs one selected, and the one selected must exist.
+func applyClusterProfile(settings map[string]json.RawMessage, profile string) error {
+	raw, ok := settings[clusterProfilesKey]
+	delete(settings, clusterProfilesKey)
+	var profiles map[string]map[string]json.RawMessage
+	if ok {
+		if err := json.Unmarshal(raw, &profiles); err != nil {
+			return fmt.Errorf("%s: %w", clusterProfilesKey, err)
+		}
+	}
+	switch {
+	case profile == "" && len(profiles) == 0:
+		return nil
+	case profile == "":
+		return fmt.Errorf("the settings define cluster profiles (%s), select one with --profile or --profile-source", strings.Join(profileNames(profiles), ", "))
+	}
+	selected, ok := profiles[profile]
+	if !ok {
+		if len(profiles) == 0 {
+			return fmt.Errorf("unknown cluster profile %q, the settings define none", profile)
+		}
+		return fmt.Errorf("unknown cluster profile %q, profiles: %s", profile, strings.Join(profileNames(profiles), ", "))
+	}
+	for stage, stageSettings := range selected {
+		if stage == clusterProfilesKey {
+			return errors.New("cluster profiles can't be nested")
+		}
+		settings[stage] = stageSettings
+	}
+	return nil
+}
+
+func profileNames(profiles map[string]map[string]json.RawMessage) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
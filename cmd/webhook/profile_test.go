@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// profileSettings is a stage settings file with a prod and a dev profile
+// over shared settings.
+const profileSettings = `
+policy:
+  rules:
+  - name: default
+sync-annotation:
+  profiles:
+    edge:
+      targetNamespaces: [ingress-nginx]
+clusterProfiles:
+  prod:
+    sync-annotation:
+      profiles:
+        edge:
+          targetNamespaces: [ingress-nginx, istio-system]
+  dev: {}
+`
+
+// setFlags sets the flags for the test, restoring them after.
+func setFlags(t *testing.T, values map[string]string) {
+	t.Helper()
+	restoreFlags(t)
+	for name, value := range values {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fakeClient returns a kubeClientFunc of a fake clientset with objects, and
+// the clientset.
+func fakeClient(objects ...runtime.Object) (kubeClientFunc, *fake.Clientset) {
+	client := fake.NewSimpleClientset(objects...)
+	return func() (kubernetes.Interface, error) { return client, nil }, client
+}
+
+// The profile is --profile when set, else read from the label or the
+// annotation of the source object, and none when neither is set.
+func TestSelectClusterProfile(t *testing.T) {
+	client, _ := fakeClient(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system", Labels: map[string]string{defaultProfileKey: "prod"}}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "cluster-identity",
+			Annotations: map[string]string{defaultProfileKey: "stage", "example.com/env": "dev"}}},
+	)
+	for _, tt := range []struct {
+		name  string
+		flags map[string]string
+		want  string
+	}{
+		{name: "none"},
+		{name: "explicit", flags: map[string]string{"profile": "dev"}, want: "dev"},
+		{name: "explicit over the source", flags: map[string]string{"profile": "dev", "profile-source": "namespace/kube-system"}, want: "dev"},
+		{name: "namespace label", flags: map[string]string{"profile-source": "namespace/kube-system"}, want: "prod"},
+		{name: "configmap annotation", flags: map[string]string{"profile-source": "configmap/kube-system/cluster-identity"}, want: "stage"},
+		{name: "other key", flags: map[string]string{"profile-source": "configmap/kube-system/cluster-identity", "profile-key": "example.com/env"}, want: "dev"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, map[string]string{"profile": "", "profile-source": "", "profile-key": defaultProfileKey})
+			setFlags(t, tt.flags)
+			got, err := selectClusterProfile(context.Background(), client)
+			if err != nil || got != tt.want {
+				t.Errorf("profile %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// A source that can't be read or doesn't name a profile fails the
+// selection rather than fall back to none.
+func TestSelectClusterProfileFailures(t *testing.T) {
+	client, _ := fakeClient(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}})
+	for _, tt := range []struct {
+		source string
+		client kubeClientFunc
+		want   string
+	}{
+		{source: "namespace/kube-system", client: client, want: "has no " + defaultProfileKey + " label or annotation"},
+		{source: "namespace/missing", client: client, want: `namespaces "missing" not found`},
+		{source: "configmap/kube-system/missing", client: client, want: `configmaps "missing" not found`},
+		{source: "configmap/kube-system", client: client, want: "is neither namespace/<name> nor configmap/<namespace>/<name>"},
+		{source: "secret/kube-system/identity", client: client, want: "is neither"},
+		{source: "namespace/kube-system", want: "no cluster access, set --profile"},
+	} {
+		setFlags(t, map[string]string{"profile": "", "profile-source": tt.source, "profile-key": defaultProfileKey})
+		if got, err := selectClusterProfile(context.Background(), tt.client); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: profile %q, error %v, want %q", tt.source, got, err, tt.want)
+		}
+	}
+}
+
+// The settings of the selected profile replace the shared ones of the same
+// stage; a file with profiles needs a known one selected.
+func TestApplyClusterProfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stages.yaml")
+	if err := os.WriteFile(path, []byte(profileSettings), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setFlags(t, map[string]string{"mutation-stage-config": path})
+	for _, tt := range []struct {
+		profile string
+		want    []string // targets of the edge sync profile
+		err     string
+	}{
+		{profile: "prod", want: []string{"ingress-nginx", "istio-system"}},
+		{profile: "dev", want: []string{"ingress-nginx"}},
+		{profile: "", err: "the settings define cluster profiles (dev, prod), select one with --profile or --profile-source"},
+		{profile: "stage", err: `unknown cluster profile "stage", profiles: dev, prod`},
+	} {
+		config, err := mutatorConfig(clusterIdentity{profile: tt.profile})
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: error %v, want %q", tt.profile, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tt.profile, err)
+		}
+		if _, ok := config.StageConfig[clusterProfilesKey]; ok {
+			t.Errorf("%q: the cluster profiles left in the stage settings", tt.profile)
+		}
+		var sync mutator.SyncAnnotationConfig
+		if err := json.Unmarshal(config.StageConfig[mutator.SyncAnnotationStage], &sync); err != nil {
+			t.Fatal(err)
+		}
+		if got := sync.Profiles["edge"].TargetNamespaces; strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%q: edge targets %v, want %v", tt.profile, got, tt.want)
+		}
+		if _, ok := config.StageConfig[mutator.PolicyStage]; !ok {
+			t.Errorf("%q: shared policy settings dropped", tt.profile)
+		}
+		if _, err := mutator.New(config); err != nil {
+			t.Errorf("%q: settings don't build: %v", tt.profile, err)
+		}
+	}
+
+	// without profiles in the file, none may be selected
+	if err := os.WriteFile(path, []byte("policy: {}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutatorConfig(clusterIdentity{}); err != nil {
+		t.Errorf("no profile: %v", err)
+	}
+	if _, err := mutatorConfig(clusterIdentity{profile: "prod"}); err == nil || !strings.Contains(err.Error(), "the settings define none") {
+		t.Errorf("profile without profiles: error %v", err)
+	}
+}
+
+// The profile is read again from the cluster identity object, as on a
+// reload, and the settings follow it.
+func TestClusterProfileReselected(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stages.yaml")
+	if err := os.WriteFile(path, []byte(profileSettings), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setFlags(t, map[string]string{"mutation-stage-config": path, "profile": "", "profile-source": "namespace/kube-system",
+		"profile-key": defaultProfileKey, "cluster-name": "", "cluster-name-configmap": ""})
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system", Labels: map[string]string{defaultProfileKey: "prod"}}}
+	clientFunc, client := fakeClient(namespace)
+
+	identity, err := resolveClusterIdentity(context.Background(), clientFunc)
+	if err != nil || identity.profile != "prod" {
+		t.Fatalf("profile %q, %v", identity.profile, err)
+	}
+	namespace.Labels[defaultProfileKey] = "dev"
+	if _, err := client.CoreV1().Namespaces().Update(context.Background(), namespace, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := clusterMutatorConfig(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sync mutator.SyncAnnotationConfig
+	if err := json.Unmarshal(config.StageConfig[mutator.SyncAnnotationStage], &sync); err != nil {
+		t.Fatal(err)
+	}
+	if got := sync.Profiles["edge"].TargetNamespaces; len(got) != 1 {
+		t.Errorf("edge targets %v after the cluster moved to dev", got)
+	}
+
+	namespace.Labels[defaultProfileKey] = "qa"
+	if _, err := client.CoreV1().Namespaces().Update(context.Background(), namespace, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clusterMutatorConfig(client); err == nil || !strings.Contains(err.Error(), `unknown cluster profile "qa"`) {
+		t.Errorf("unknown profile: error %v", err)
+	}
+}
+
+// clusterInfo is the ConfigMap the cluster name tests read.
+var clusterInfo = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "cluster-info"},
+	Data: map[string]string{defaultClusterNameKey: "from-configmap\n", "region": "eu-west-1"}}
+
+// The cluster name is --cluster-name when set, else read from the key of
+// the ConfigMap, and none when neither is set.
+func TestResolveClusterName(t *testing.T) {
+	client, _ := fakeClient(clusterInfo)
+	for _, tt := range []struct {
+		name  string
+		flags map[string]string
+		want  string
+	}{
+		{name: "none"},
+		{name: "flag", flags: map[string]string{"cluster-name": "from-flag"}, want: "from-flag"},
+		{name: "flag over the configmap", flags: map[string]string{"cluster-name": "from-flag", "cluster-name-configmap": "kube-system/cluster-info"}, want: "from-flag"},
+		{name: "configmap", flags: map[string]string{"cluster-name-configmap": "kube-system/cluster-info"}, want: "from-configmap"},
+		{name: "configmap key", flags: map[string]string{"cluster-name-configmap": "kube-system/cluster-info", "cluster-name-key": "region"}, want: "eu-west-1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, map[string]string{"cluster-name": "", "cluster-name-configmap": "", "cluster-name-key": defaultClusterNameKey})
+			setFlags(t, tt.flags)
+			got, err := resolveClusterName(context.Background(), client)
+			if err != nil || got != tt.want {
+				t.Errorf("cluster name %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		flags  map[string]string
+		client kubeClientFunc
+		want   string
+	}{
+		{flags: map[string]string{"cluster-name-configmap": "kube-system/missing"}, client: client, want: `configmaps "missing" not found`},
+		{flags: map[string]string{"cluster-name-configmap": "kube-system/cluster-info", "cluster-name-key": "zone"}, client: client, want: "has no zone"},
+		{flags: map[string]string{"cluster-name-configmap": "cluster-info"}, client: client, want: "is not <namespace>/<name>"},
+		{flags: map[string]string{"cluster-name-configmap": "kube-system/cluster-info"}, want: "no cluster access, set --cluster-name"},
+	} {
+		setFlags(t, map[string]string{"cluster-name": "", "cluster-name-key": defaultClusterNameKey})
+		setFlags(t, tt.flags)
+		if got, err := resolveClusterName(context.Background(), tt.client); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: cluster name %q, error %v, want %q", tt.flags, got, err, tt.want)
+		}
+	}
+}
+
+// TestClusterNameHelper prints the cluster name the process resolves, for
+// TestClusterNameEnvironment to run with an environment of its own.
+func TestClusterNameHelper(t *testing.T) {
+	if os.Getenv("CLUSTER_NAME_HELPER") == "" {
+		t.Skip("run by TestClusterNameEnvironment")
+	}
+	client, _ := fakeClient(clusterInfo)
+	name, err := resolveClusterName(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout.WriteString("cluster-name=" + name + "\n")
+}
+
+// CLUSTER_NAME, read as the flags are defined, ranks under --cluster-name
+// and over the ConfigMap.
+func TestClusterNameEnvironment(t *testing.T) {
+	for _, tt := range []struct {
+		env  []string
+		args []string
+		want string
+	}{
+		{env: []string{"CLUSTER_NAME=from-env"}, want: "from-env"},
+		{env: []string{"CLUSTER_NAME=from-env"}, args: []string{"-cluster-name=from-flag"}, want: "from-flag"},
+		{env: []string{"CLUSTER_NAME=from-env", "CLUSTER_NAME_CONFIGMAP=kube-system/cluster-info"}, want: "from-env"},
+		{env: []string{"CLUSTER_NAME_CONFIGMAP=kube-system/cluster-info"}, want: "from-configmap"},
+	} {
+		cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestClusterNameHelper$", "-test.v"}, tt.args...)...)
+		cmd.Env = append(os.Environ(), append(tt.env, "CLUSTER_NAME_HELPER=1")...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v %v: %v\n%s", tt.env, tt.args, err, out)
+		}
+		if !strings.Contains(string(out), "cluster-name="+tt.want+"\n") {
+			t.Errorf("%v %v: %s, want %s", tt.env, tt.args, out, tt.want)
+		}
+	}
+}
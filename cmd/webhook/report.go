@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+const (
+	// reportPageSize is the number of secrets listed per request.
+	reportPageSize = 500
+	// issuerNameAnnotationKey and issuerKindAnnotationKey are set by
+	// cert-manager on the secrets it issues.
+	issuerNameAnnotationKey = "cert-manager.io/issuer-name"
+	issuerKindAnnotationKey = "cert-manager.io/issuer-kind"
+)
+
+// Decisions reported by report.
+const (
+	reportMutate = "mutate"
+	reportSkip   = "skip"
+	reportError  = "error"
+)
+
+// reportRow is one cert-manager secret of the report.
+type reportRow struct {
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	Certificate string `json:"certificate"`
+	IssuerKind  string `json:"issuerKind,omitempty"`
+	Issuer      string `json:"issuer,omitempty"`
+	// NotAfter is the expiry of the leaf certificate in RFC 3339, empty
+	// when tls.crt doesn't hold one.
+	NotAfter  string `json:"notAfter,omitempty"`
+	Sync      string `json:"sync,omitempty"`      // current sync annotation
+	ManagedBy string `json:"managedBy,omitempty"` // current managed-by marker
+	// Recorded is the current decision annotation, the rule and config hash
+	// that set the sync annotation.
+	Recorded     string `json:"recorded,omitempty"`
+	Cluster      string `json:"cluster,omitempty"` // current cluster annotation
+	Decision     string `json:"decision"`
+	Rule         string `json:"rule,omitempty"`
+	Reason       string `json:"reason,omitempty"`       // skip reason or evaluation error
+	WantSync     string `json:"wantSync,omitempty"`     // sync annotation the policy sets
+	WantDecision string `json:"wantDecision,omitempty"` // decision annotation the policy sets
+	Differs      bool   `json:"differs"`
+}
+
+var reportColumns = []string{"namespace", "name", "certificate", "issuerKind", "issuer", "notAfter",
+	"sync", "managedBy", "recorded", "cluster", "decision", "rule", "reason", "wantSync", "wantDecision", "differs"}
+
+func (r reportRow) record() []string {
+	return []string{r.Namespace, r.Name, r.Certificate, r.IssuerKind, r.Issuer, r.NotAfter,
+		r.Sync, r.ManagedBy, r.Recorded, r.Cluster, r.Decision, r.Rule, r.Reason, r.WantSync, r.WantDecision, strconv.FormatBool(r.Differs)}
+}
+
+// reportWriter writes the rows as they are produced, so that the report of a
+// large cluster is never held in memory.
+type reportWriter interface {
+	write(reportRow) error
+	flush() error
+}
+
+type jsonReportWriter struct{ enc *json.Encoder }
+
+func (w jsonReportWriter) write(row reportRow) error { return w.enc.Encode(row) }
+func (w jsonReportWriter) flush() error              { return nil }
+
+type csvReportWriter struct{ w *csv.Writer }
+
+func (w csvReportWriter) write(row reportRow) error { return w.w.Write(row.record()) }
+func (w csvReportWriter) flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+func newReportWriter(format string, out io.Writer) (reportWriter, error) {
+	switch format {
+	case "json":
+		return jsonReportWriter{enc: json.NewEncoder(out)}, nil
+	case "csv":
+		w := csv.NewWriter(out)
+		if err := w.Write(reportColumns); err != nil {
+			return nil, err
+		}
+		return csvReportWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// runReport implements the report subcommand: it lists the cert-manager
+// secrets of the cluster and writes, for each, its issuer, expiry and sync
+// annotations next to what the configured policy would decide, as JSON lines
+// or CSV. A secret differs when the policy would patch it, or when it carries
+// the managed-by marker but the policy would no longer annotate it. The
+// secrets are evaluated by the mutator the webhook uses, with nothing sent
+// to the cluster. It exits 1 when listing fails.
+func runReport(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	var (
+		kubeconfigPath  = fs.String("kubeconfig", "", "kubeconfig of the cluster, the pod's service account when empty")
+		namespace       = fs.String("namespace", "", "only report the secrets of this namespace")
+		issuer          = fs.String("issuer", "", "only report the secrets issued by this issuer or cluster issuer")
+		onlyDifferences = fs.Bool("only-differences", false, "only report the secrets the policy disagrees with")
+		output          = fs.String("output", "json", "output format: json, one object per line, or csv")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	w, err := newReportWriter(*output, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		return 2
+	}
+	client, err := kubeClientFor(*kubeconfigPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		return 2
+	}
+	settings, err := clusterMutatorConfig(client)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		return 2
+	}
+	m, err := mutator.New(settings)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		return 2
+	}
+	dynamicClient, err := dynamicClientFor(*kubeconfigPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		return 2
+	}
+
+	ctx := context.Background()
+	lookups := newAPINamespaces(ctx, client)
+	certs := newAPICertificates(ctx, dynamicClient)
+	ingresses := newAPIIngresses(ctx, client)
+	err = listSecretPages(ctx, client, *namespace, func(secret *corev1.Secret) error {
+		if _, ok := secret.Annotations[mutator.CertManagerAnnotationKey]; !ok {
+			return nil
+		}
+		if *issuer != "" && secret.Annotations[issuerNameAnnotationKey] != *issuer {
+			return nil
+		}
+		row := reportSecret(ctx, m, admissionLookups{lookups, certs, ingresses}, secret)
+		if *onlyDifferences && !row.Differs {
+			return nil
+		}
+		return w.write(row)
+	})
+	if flushErr := w.flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// listSecretPages calls fn for each secret of namespace, all when empty,
+// holding one page of them at a time. It stops at the first error.
+func listSecretPages(ctx context.Context, client kubernetes.Interface, namespace string, fn func(*corev1.Secret) error) error {
+	opts := metav1.ListOptions{Limit: reportPageSize}
+	for {
+		list, err := client.CoreV1().Secrets(namespace).List(ctx, opts)
+		if err != nil {
+			return fmt.Errorf("listing secrets: %w", err)
+		}
+		for i := range list.Items {
+			if err := fn(&list.Items[i]); err != nil {
+				return err
+			}
+		}
+		if list.Continue == "" {
+			return nil
+		}
+		opts.Continue = list.Continue
+	}
+}
+
+// admissionLookups are the API-backed listers the stages may read.
+type admissionLookups struct {
+	namespaces   mutator.NamespaceLister
+	certificates mutator.CertificateLister
+	ingresses    mutator.IngressLister
+}
+
+// reportSecret evaluates secret and returns its row.
+func reportSecret(ctx context.Context, m *mutator.Mutator, lookups admissionLookups, secret *corev1.Secret) reportRow {
+	row := reportRow{
+		Namespace:   secret.Namespace,
+		Name:        secret.Name,
+		Certificate: secret.Annotations[mutator.CertManagerAnnotationKey],
+		IssuerKind:  secret.Annotations[issuerKindAnnotationKey],
+		Issuer:      secret.Annotations[issuerNameAnnotationKey],
+		NotAfter:    certificateExpiry(secret),
+		Sync:        secret.Annotations[mutator.SyncAnnotationKey],
+		ManagedBy:   secret.Annotations[mutator.ManagedByAnnotationKey],
+		Recorded:    secret.Annotations[mutator.DecisionAnnotationKey],
+		Cluster:     secret.Annotations[mutator.ClusterAnnotationKey],
+	}
+	admission := mutator.AdmissionContext{Operation: string(v1beta1.Update), Secret: secret, Namespaces: lookups.namespaces,
+		Certificates: lookups.certificates, Ingresses: lookups.ingresses}
+	decision, _, err := m.Evaluate(ctx, admission)
+	switch {
+	case err != nil:
+		row.Decision, row.Reason = reportError, err.Error()
+	case decision.Mutate:
+		row.Decision, row.Rule, row.WantSync = reportMutate, decision.Rule, decision.Annotations[mutator.SyncAnnotationKey]
+		row.WantDecision = decision.Annotations[mutator.DecisionAnnotationKey]
+		row.Differs = true
+	case decision.SkipReason == mutator.SkipNoChanges:
+		row.Decision, row.Reason, row.WantSync, row.WantDecision = reportSkip, decision.SkipReason, row.Sync, row.Recorded
+	default:
+		row.Decision, row.Reason = reportSkip, decision.SkipReason
+		row.Differs = row.ManagedBy == mutator.ManagedByValue
+	}
+	return row
+}
+
+// certificateExpiry returns the expiry of the first certificate of tls.crt,
+// empty when there is none.
+func certificateExpiry(secret *corev1.Secret) string {
+	block, _ := pem.Decode(secret.Data[corev1.TLSCertKey])
+	if block == nil {
+		return ""
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return ""
+	}
+	return cert.NotAfter.UTC().Format(time.RFC3339)
+}
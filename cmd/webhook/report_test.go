@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// The cluster a secret was stamped by is reported, and a secret stamped by
+// another cluster differs.
+func TestReportCluster(t *testing.T) {
+	config := mutator.DefaultConfig()
+	config.ClusterName = "eu-west-1"
+	m, err := mutator.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "api-tls",
+		Annotations: map[string]string{mutator.CertManagerAnnotationKey: "api"}}, Type: corev1.SecretTypeTLS}
+	recorded := reportSecret(context.Background(), m, admissionLookups{}, bare).WantDecision
+	// secret returns the secret as the webhook of cluster mutated it
+	secret := func(cluster string) *corev1.Secret {
+		secret := bare.DeepCopy()
+		secret.Annotations[mutator.SyncAnnotationKey] = "true"
+		secret.Annotations[mutator.ManagedByAnnotationKey] = mutator.ManagedByValue
+		secret.Annotations[mutator.DecisionAnnotationKey] = recorded
+		secret.Annotations[mutator.ClusterAnnotationKey] = cluster
+		return secret
+	}
+
+	var out bytes.Buffer
+	w, err := newReportWriter("csv", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		cluster  string
+		decision string
+		differs  bool
+	}{
+		{cluster: "eu-west-1", decision: reportSkip},
+		{cluster: "us-east-1", decision: reportMutate, differs: true},
+	} {
+		row := reportSecret(context.Background(), m, admissionLookups{}, secret(tt.cluster))
+		if row.Cluster != tt.cluster || row.Decision != tt.decision || row.Differs != tt.differs {
+			t.Errorf("stamped by %s: cluster %q, %s, differs %v, want %s, differs %v", tt.cluster, row.Cluster, row.Decision, row.Differs, tt.decision, tt.differs)
+		}
+		if err := w.write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	column := -1
+	for i, name := range records[0] {
+		if name == "cluster" {
+			column = i
+		}
+	}
+	if column < 0 || len(records) != 3 || records[1][column] != "eu-west-1" || records[2][column] != "us-east-1" {
+		t.Errorf("CSV %q, want the cluster of each secret", records)
+	}
+}
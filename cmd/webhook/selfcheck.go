@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// selfcheckPollInterval is how often selfcheck reads the secrets back.
+const selfcheckPollInterval = 500 * time.Millisecond
+
+// selfcheckStep is one step of a selfcheck and how long it took.
+type selfcheckStep struct {
+	name     string
+	err      error
+	skipped  bool
+	duration time.Duration
+}
+
+// runSelfcheck implements the selfcheck subcommand: it creates a short-lived
+// cert-manager secret in -namespace of a live cluster, so that it goes
+// through the API server, the webhook configuration and the webhook like
+// cert-manager's, reads it back and checks the sync annotation and the
+// managed-by marker, and with -target-namespace waits for kubed's copy
+// there. The secrets are deleted at the end, the copy too if kubed left it.
+// It prints a pass/fail line per step with its duration and exits 1 when
+// one fails.
+func runSelfcheck(args []string) int {
+	fs := flag.NewFlagSet("selfcheck", flag.ContinueOnError)
+	var (
+		kubeconfigPath     = fs.String("kubeconfig", "", "kubeconfig of the cluster, the pod's service account when empty")
+		namespace          = fs.String("namespace", "default", "namespace the test secret is created in")
+		targetNamespace    = fs.String("target-namespace", "", "check that kubed copies the test secret to this namespace, skipped when empty")
+		admissionTimeout   = fs.Duration("admission-timeout", 10*time.Second, "timeout of creating the test secret and reading it back annotated")
+		replicationTimeout = fs.Duration("replication-timeout", time.Minute, "timeout of waiting for kubed's copy, with -target-namespace")
+		cleanupTimeout     = fs.Duration("cleanup-timeout", 10*time.Second, "timeout of deleting the test secrets")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *namespace == "" || *targetNamespace == *namespace || *admissionTimeout <= 0 || *replicationTimeout <= 0 || *cleanupTimeout <= 0 {
+		fmt.Fprintln(os.Stderr, "selfcheck: -namespace must be set and differ from -target-namespace, and the timeouts be positive")
+		return 2
+	}
+	client, err := kubeClientFor(*kubeconfigPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "selfcheck: %v\n", err)
+		return 2
+	}
+	secret, err := selfcheckSecret(*namespace)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "selfcheck: %v\n", err)
+		return 1
+	}
+
+	var steps []selfcheckStep
+	step := func(name string, timeout time.Duration, run func(context.Context) error) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		start := time.Now()
+		err := run(ctx)
+		steps = append(steps, selfcheckStep{name: name, err: err, duration: time.Since(start)})
+		return err == nil
+	}
+	skip := func(name string) { steps = append(steps, selfcheckStep{name: name, skipped: true}) }
+
+	const (
+		stepCreate      = "create test secret"
+		stepAnnotations = "sync annotations set"
+		stepCopy        = "kubed copy"
+		stepCleanup     = "delete test secrets"
+	)
+	created := step(stepCreate, *admissionTimeout, func(ctx context.Context) error {
+		secret, err = client.CoreV1().Secrets(*namespace).Create(ctx, secret, metav1.CreateOptions{})
+		return err
+	})
+	if !created {
+		skip(stepAnnotations)
+		skip(stepCopy)
+		skip(stepCleanup)
+		return printSelfcheck(steps)
+	}
+	fmt.Printf("test secret %s/%s\n", secret.Namespace, secret.Name)
+
+	annotated := step(stepAnnotations, *admissionTimeout, func(ctx context.Context) error {
+		return waitSelfcheck(ctx, func(ctx context.Context) error {
+			got, err := client.CoreV1().Secrets(secret.Namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			return checkSelfcheckAnnotations(got)
+		})
+	})
+	switch {
+	case *targetNamespace == "" || !annotated:
+		skip(stepCopy)
+	default:
+		step(stepCopy, *replicationTimeout, func(ctx context.Context) error {
+			return waitSelfcheck(ctx, func(ctx context.Context) error {
+				copied, err := client.CoreV1().Secrets(*targetNamespace).Get(ctx, secret.Name, metav1.GetOptions{})
+				if err != nil {
+					return err
+				}
+				if _, ok := copied.Annotations[mutator.OriginAnnotationKey]; !ok {
+					return fmt.Errorf("secret %s/%s has no %s annotation, it isn't kubed's copy", *targetNamespace, secret.Name, mutator.OriginAnnotationKey)
+				}
+				return nil
+			})
+		})
+	}
+
+	step(stepCleanup, *cleanupTimeout, func(ctx context.Context) error {
+		return deleteSelfcheckSecrets(ctx, client, secret, *targetNamespace)
+	})
+	return printSelfcheck(steps)
+}
+
+// selfcheckSecret returns the test secret, a TLS secret like cert-manager's
+// with a self-signed certificate, so that the stages reading it see a valid
+// one, annotated to be deletable despite the deletion protection.
+func selfcheckSecret(namespace string) (*corev1.Secret, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: "cert-sync-selfcheck"},
+		DNSNames:     []string{"cert-sync-selfcheck.invalid"},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "cert-sync-selfcheck-",
+			Namespace:    namespace,
+			Annotations: map[string]string{
+				mutator.CertManagerAnnotationKey: "cert-sync-selfcheck",
+				"cert-manager.io/issuer-name":    "cert-sync-selfcheck",
+				"cert-manager.io/issuer-kind":    "Issuer",
+				mutator.AllowDeleteAnnotationKey: "true",
+			},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		},
+	}, nil
+}
+
+// checkSelfcheckAnnotations checks that the webhook annotated secret.
+func checkSelfcheckAnnotations(secret *corev1.Secret) error {
+	if _, ok := secret.Annotations[mutator.SyncAnnotationKey]; !ok {
+		return fmt.Errorf("no %s annotation, the webhook didn't mutate the secret", mutator.SyncAnnotationKey)
+	}
+	if value := secret.Annotations[mutator.ManagedByAnnotationKey]; value != mutator.ManagedByValue {
+		return fmt.Errorf("%s is %q, want %q", mutator.ManagedByAnnotationKey, value, mutator.ManagedByValue)
+	}
+	return nil
+}
+
+// waitSelfcheck calls check until it succeeds or ctx is done, returning its
+// last error then.
+func waitSelfcheck(ctx context.Context, check func(context.Context) error) error {
+	var last error
+	err := wait.PollUntilContextCancel(ctx, selfcheckPollInterval, true, func(ctx context.Context) (bool, error) {
+		last = check(ctx)
+		return last == nil, nil
+	})
+	if err != nil && last != nil {
+		return last
+	}
+	return err
+}
+
+// deleteSelfcheckSecrets deletes the test secret and, when kubed hasn't
+// already, its copy in targetNamespace.
+func deleteSelfcheckSecrets(ctx context.Context, client kubernetes.Interface, secret *corev1.Secret, targetNamespace string) error {
+	var errs []error
+	if err := client.CoreV1().Secrets(secret.Namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		errs = append(errs, err)
+	}
+	if targetNamespace != "" {
+		if err := client.CoreV1().Secrets(targetNamespace).Delete(ctx, secret.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// printSelfcheck prints a line per step and the result, and returns the
+// exit code.
+func printSelfcheck(steps []selfcheckStep) int {
+	failed := false
+	for _, step := range steps {
+		switch {
+		case step.skipped:
+			fmt.Printf("SKIP  %s\n", step.name)
+		case step.err != nil:
+			failed = true
+			fmt.Printf("FAIL  %s (%s): %v\n", step.name, step.duration.Round(time.Millisecond), step.err)
+		default:
+			fmt.Printf("PASS  %s (%s)\n", step.name, step.duration.Round(time.Millisecond))
+		}
+	}
+	if failed {
+		fmt.Println("result: FAIL")
+		return 1
+	}
+	fmt.Println("result: PASS")
+	return 0
+}
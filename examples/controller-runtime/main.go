@@ -0,0 +1,44 @@
+// Command controller-runtime shows how to mount the secret mutator in a
+// controller-runtime manager's webhook server. Register the path with a
+// MutatingWebhookConfiguration for secrets pointing at the manager's Service.
+package main
+
+import (
+	"os"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/crwebhook"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+func main() {
+	ctrl.SetLogger(zap.New())
+	log := ctrl.Log.WithName("example")
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		WebhookServer: webhook.NewServer(webhook.Options{Port: 9443}),
+	})
+	if err != nil {
+		log.Error(err, "Failed to create manager")
+		os.Exit(1)
+	}
+
+	config := mutator.DefaultConfig()
+	config.NamespaceSelector = "env=production"
+	m, err := mutator.New(config)
+	if err != nil {
+		log.Error(err, "Invalid mutator configuration")
+		os.Exit(1)
+	}
+	mgr.GetWebhookServer().Register("/mutate-secrets", &webhook.Admission{
+		Handler: crwebhook.New(m),
+	})
+
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		log.Error(err, "Manager stopped")
+		os.Exit(1)
+	}
+}
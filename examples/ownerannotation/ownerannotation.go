@@ -0,0 +1,64 @@
+// Package ownerannotation is an example of a mutation stage compiled into
+// the webhook from outside the repository. It sets one fixed annotation on
+// every mutated secret, configured under its name in the stage settings:
+//
+//	owner-annotation:
+//	  key: example.com/owner
+//	  value: platform-team
+//
+// A build enables it by importing the package for its side effect, e.g.
+// in a file next to the webhook's main package:
+//
+//	import _ "github.com/bygui86/cert-manager-webhook/examples/ownerannotation"
+//
+// and adding owner-annotation to MUTATION_STAGES.
+package ownerannotation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// Name is the stage's name in MUTATION_STAGES and the stage settings.
+const Name = "owner-annotation"
+
+// Config holds the stage's settings.
+type Config struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func init() {
+	mutator.Register(Name, New)
+}
+
+// New builds the stage from its settings.
+func New(_ mutator.Config, raw json.RawMessage) (mutator.Stage, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("settings with key and value are required")
+	}
+	var config Config
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	if errs := validation.IsQualifiedName(config.Key); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid key %q: %s", config.Key, strings.Join(errs, "; "))
+	}
+
+	return mutator.StageFunc(func(_ context.Context, obj mutator.AdmissionContext, decision *mutator.Decision) ([]mutator.PatchOperation, error) {
+		decision.Annotations[config.Key] = config.Value
+		patch := mutator.NewPatchBuilder(obj.Secret)
+		patch.AddAnnotation(config.Key, config.Value)
+		return patch.Operations()
+	}), nil
+}
@@ -0,0 +1,108 @@
+package ownerannotation_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/bygui86/cert-manager-webhook/examples/ownerannotation"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// stageConfig is a stage settings file as the webhook reads it.
+const stageConfig = `
+owner-annotation:
+  key: example.com/owner
+  value: platform-team
+`
+
+// newMutator returns a mutator running the default stages and the example
+// one, with the settings of file.
+func newMutator(file string) (*mutator.Mutator, error) {
+	var settings map[string]json.RawMessage
+	if err := yaml.Unmarshal([]byte(file), &settings); err != nil {
+		return nil, err
+	}
+	config := mutator.DefaultConfig()
+	config.Stages = append(append([]string(nil), mutator.DefaultStages...), ownerannotation.Name)
+	config.StageConfig = settings
+	return mutator.New(config)
+}
+
+// Imported, the stage is registered, enabled by name and configured from
+// the settings file, and annotates the secrets the chain mutates.
+func TestOwnerAnnotation(t *testing.T) {
+	m, err := newMutator(stageConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "api-tls", Namespace: "apps", Annotations: map[string]string{mutator.CertManagerAnnotationKey: "api-tls"}},
+		Type:       corev1.SecretTypeTLS,
+	}
+	decision, patch, err := m.Evaluate(context.Background(), mutator.AdmissionContext{Operation: "CREATE", Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Annotations["example.com/owner"] != "platform-team" {
+		t.Errorf("decided annotations %v, want the owner", decision.Annotations)
+	}
+
+	doc, err := json.Marshal(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := mutator.MarshalPatch(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jsonpatch.DecodePatch(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err = decoded.Apply(doc); err != nil {
+		t.Fatal(err)
+	}
+	var patched corev1.Secret
+	if err := json.Unmarshal(doc, &patched); err != nil {
+		t.Fatal(err)
+	}
+	if patched.Annotations["example.com/owner"] != "platform-team" || patched.Annotations[mutator.SyncAnnotationKey] != "true" {
+		t.Errorf("secret patched to %v, want the owner and sync annotations", patched.Annotations)
+	}
+
+	// the secrets the policy skips aren't annotated either
+	secret.Namespace = metav1.NamespaceSystem
+	if _, patch, err := m.Evaluate(context.Background(), mutator.AdmissionContext{Operation: "CREATE", Secret: secret}); err != nil || patch != nil {
+		t.Errorf("skipped secret patched with %v: %v", patch, err)
+	}
+}
+
+func TestOwnerAnnotationSettings(t *testing.T) {
+	for name, file := range map[string]string{
+		"missing":       "{}",
+		"invalid key":   "owner-annotation: {key: 'not a key!', value: x}",
+		"unknown field": "owner-annotation: {key: example.com/owner, value: x, team: y}",
+	} {
+		if _, err := newMutator(file); err == nil || !strings.Contains(err.Error(), ownerannotation.Name) {
+			t.Errorf("%s settings: error %v, want one about %s", name, err, ownerannotation.Name)
+		}
+	}
+}
+
+// The example's name is among the registered stages listed when config
+// names one that isn't.
+func TestUnknownStageListsExample(t *testing.T) {
+	config := mutator.DefaultConfig()
+	config.Stages = []string{mutator.PolicyStage, "owner-annotations"}
+	_, err := mutator.New(config)
+	if err == nil || !strings.Contains(err.Error(), `"owner-annotations"`) || !strings.Contains(err.Error(), ownerannotation.Name) {
+		t.Errorf("error %v, want the unknown name and the registered %s", err, ownerannotation.Name)
+	}
+}
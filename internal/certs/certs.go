@@ -0,0 +1,202 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// Reloader serves the webhook key pair and reloads it from disk whenever
+// the certificate or key file changes, keeping the expiry metric in step.
+type Reloader struct {
+	log      logr.Logger
+	certFile string
+	keyFile  string
+	warnDays []int // expiry warning thresholds in days, ascending
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	notAfter time.Time
+	modTime  time.Time
+	warned   int  // smallest threshold already warned about for the current cert
+	expired  bool // expiry already logged for the current cert
+
+	chain     *ChainConfig // checks of the served chain, nil when off
+	chainNote string       // problems of the current chain
+}
+
+// NewReloader loads the key pair from certFile and keyFile, warning as the
+// certificate comes within each of warnDays of its expiry. warnDays is
+// copied, not modified. The Reloader is returned even when loading fails, so
+// Watch can pick up files written later.
+func NewReloader(log logr.Logger, certFile, keyFile string, warnDays []int) (*Reloader, error) {
+	warnDays = slices.Clone(warnDays)
+	sort.Ints(warnDays)
+	r := &Reloader{
+		log:      log,
+		certFile: certFile,
+		keyFile:  keyFile,
+		warnDays: warnDays,
+	}
+	return r, r.reload()
+}
+
+// ParseWarnDays parses a comma separated list of day thresholds, e.g. "30,7,1".
+func ParseWarnDays(value string) ([]int, error) {
+	var days []int
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		d, err := strconv.Atoi(field)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid expiry warning threshold %q", field)
+		}
+		days = append(days, d)
+	}
+	return days, nil
+}
+
+func (r *Reloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *Reloader) reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+
+	pair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	pair.Leaf = leaf
+
+	r.mu.Lock()
+	r.cert = &pair
+	r.notAfter = leaf.NotAfter
+	r.modTime = modTime
+	r.warned = 0
+	r.expired = false
+	r.mu.Unlock()
+
+	metrics.CertExpiryTimestamp.Set(float64(leaf.NotAfter.Unix()))
+	r.log.Info("Loaded serving certificate", "commonName", leaf.Subject.CommonName, "notAfter", leaf.NotAfter.Format(time.RFC3339))
+
+	r.checkExpiry(time.Now())
+	r.checkChain(&pair)
+	return nil
+}
+
+// checkExpiry logs a warning the first time the certificate crosses each
+// configured threshold, and once more when it has actually expired.
+func (r *Reloader) checkExpiry(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cert == nil {
+		return
+	}
+
+	remaining := r.notAfter.Sub(now)
+	if remaining <= 0 {
+		if !r.expired {
+			r.expired = true
+			r.log.Error(nil, "Serving certificate expired, reporting not ready", "notAfter", r.notAfter.Format(time.RFC3339))
+		}
+		return
+	}
+
+	for _, days := range r.warnDays {
+		if remaining > time.Duration(days)*24*time.Hour {
+			continue
+		}
+		if r.warned == 0 || days < r.warned {
+			r.warned = days
+			r.log.Info("WARNING: serving certificate expires soon", "withinDays", days, "notAfter", r.notAfter.Format(time.RFC3339))
+		}
+		break
+	}
+}
+
+// Ready returns why the serving certificate can't be used, or nil.
+func (r *Reloader) Ready(now time.Time) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return fmt.Errorf("serving certificate not loaded")
+	}
+	if !now.Before(r.notAfter) {
+		return fmt.Errorf("serving certificate expired at %s", r.notAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return nil, fmt.Errorf("no serving certificate loaded")
+	}
+	return r.cert, nil
+}
+
+// Watch polls the key pair files and reloads them when they change, until stop is closed.
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		modTime, err := r.lastModified()
+		if err != nil {
+			r.log.Error(err, "Failed to stat key pair")
+			continue
+		}
+
+		r.mu.RLock()
+		changed := !modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+
+		if changed {
+			if err := r.reload(); err != nil {
+				r.log.Error(err, "Failed to reload key pair, keeping previous certificate")
+			}
+			continue
+		}
+		r.checkExpiry(time.Now())
+	}
+}
@@ -0,0 +1,247 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// writeKeyPair writes a self-signed key pair for commonName, valid for
+// validity, to certFile and keyFile, stamping both with modTime.
+func writeKeyPair(t *testing.T, certFile, keyFile, commonName string, validity time.Duration, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(validity),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key goes first, so a reload between the writes sees a mismatched
+	// pair rather than a stale one
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})},
+		{certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})},
+	}
+	for _, file := range files {
+		if err := os.WriteFile(file.name, file.data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file.name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func keyPairFiles(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	return filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+}
+
+func TestParseWarnDays(t *testing.T) {
+	days, err := ParseWarnDays(" 30, 7,,1 ")
+	if err != nil || len(days) != 3 || days[0] != 30 || days[2] != 1 {
+		t.Errorf("parsed %v, %v", days, err)
+	}
+	for _, value := range []string{"30,seven", "0", "-1"} {
+		if _, err := ParseWarnDays(value); err == nil {
+			t.Errorf("%q parsed", value)
+		}
+	}
+}
+
+func TestCheckExpiry(t *testing.T) {
+	certFile, keyFile := keyPairFiles(t)
+	writeKeyPair(t, certFile, keyFile, "webhook", 10*24*time.Hour, time.Now())
+	r, err := NewReloader(logr.Discard(), certFile, keyFile, []int{30, 7, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.warned != 30 {
+		t.Errorf("warned about %d days when loading a certificate valid for 10, want 30", r.warned)
+	}
+	r.checkExpiry(r.notAfter.Add(-3 * 24 * time.Hour))
+	if r.warned != 7 {
+		t.Errorf("warned about %d days 3 days before the expiry, want 7", r.warned)
+	}
+	if r.expired {
+		t.Error("expired before notAfter")
+	}
+	r.checkExpiry(r.notAfter)
+	if !r.expired {
+		t.Error("not expired at notAfter")
+	}
+	if r.Ready(r.notAfter) == nil {
+		t.Error("ready at notAfter")
+	}
+}
+
+// The expiry metric and readiness follow the served certificate when a
+// short-lived one is swapped in and expires.
+func TestReloadExpiryMetric(t *testing.T) {
+	certFile, keyFile := keyPairFiles(t)
+	issued := time.Now().Add(-time.Hour)
+	writeKeyPair(t, certFile, keyFile, "long-lived", 90*24*time.Hour, issued)
+	r, err := NewReloader(logr.Discard(), certFile, keyFile, []int{30, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := testutil.ToFloat64(metrics.CertExpiryTimestamp), float64(r.notAfter.Unix()); got != want {
+		t.Errorf("expiry metric %v, want %v", got, want)
+	}
+	if r.warned != 0 {
+		t.Errorf("warned about %d days for a certificate valid 90", r.warned)
+	}
+
+	writeKeyPair(t, certFile, keyFile, "short-lived", 2*time.Second, issued.Add(time.Minute))
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Watch(10*time.Millisecond, stop)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Leaf.Subject.CommonName == "short-lived" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("short-lived certificate not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.mu.RLock()
+	notAfter, warned := r.notAfter, r.warned
+	r.mu.RUnlock()
+	if got, want := testutil.ToFloat64(metrics.CertExpiryTimestamp), float64(notAfter.Unix()); got != want {
+		t.Errorf("expiry metric %v after the rotation, want %v", got, want)
+	}
+	if warned != 7 {
+		t.Errorf("warned about %d days for a certificate expiring in seconds, want 7", warned)
+	}
+	if err := r.Ready(time.Now()); err != nil {
+		t.Errorf("not ready with a valid certificate: %v", err)
+	}
+	if r.Ready(notAfter.Add(time.Second)) == nil {
+		t.Error("ready once the certificate expired")
+	}
+}
+
+func TestNewReloaderCopiesWarnDays(t *testing.T) {
+	certFile, keyFile := keyPairFiles(t)
+	writeKeyPair(t, certFile, keyFile, "webhook", time.Hour, time.Now())
+
+	warnDays := []int{30, 7, 1}
+	r, err := NewReloader(logr.Discard(), certFile, keyFile, warnDays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(warnDays, []int{30, 7, 1}) {
+		t.Errorf("caller's warnDays changed to %v", warnDays)
+	}
+	if !slices.Equal(r.warnDays, []int{1, 7, 30}) {
+		t.Errorf("warnDays %v, want them ascending", r.warnDays)
+	}
+}
+
+// Certificates rotated while handshakes read the served one are swapped in
+// whole. Run with -race.
+func TestWatchConcurrentReloads(t *testing.T) {
+	certFile, keyFile := keyPairFiles(t)
+	issued := time.Now().Add(-time.Hour)
+	writeKeyPair(t, certFile, keyFile, "rotation-0", time.Hour, issued)
+	r, err := NewReloader(logr.Discard(), certFile, keyFile, []int{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		r.Watch(time.Millisecond, stop)
+	}()
+
+	var wg sync.WaitGroup
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				cert, err := r.GetCertificate(nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if cert.Leaf == nil {
+					t.Error("certificate served without its leaf")
+					return
+				}
+				if err := r.Ready(time.Now()); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	const rotations = 20
+	for i := 1; i <= rotations; i++ {
+		writeKeyPair(t, certFile, keyFile, fmt.Sprintf("rotation-%d", i), time.Hour, issued.Add(time.Duration(i)*time.Second))
+		time.Sleep(5 * time.Millisecond)
+	}
+	want := fmt.Sprintf("rotation-%d", rotations)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Leaf.Subject.CommonName == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("serving %q, want the last rotation %q", cert.Leaf.Subject.CommonName, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	<-watched
+}
@@ -0,0 +1,178 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// Checks of the served chain, as exported in webhook_tls_chain_valid.
+const (
+	ChainCheckChain = "chain"
+	ChainCheckSAN   = "san"
+)
+
+// ChainConfig says what the served certificate chain is checked against.
+type ChainConfig struct {
+	// Roots returns the CA bundle the clients verify the chain with, e.g.
+	// the caBundle of the webhook configuration. Without it, a chain is
+	// complete when it ends with a CA or a self-signed certificate, the
+	// clients being expected to trust the issuer of its last certificate.
+	Roots Source
+	// DNSNames the leaf must cover, e.g. the names of the webhook Service;
+	// none skips the check.
+	DNSNames []string
+}
+
+// chainProblems are what the checks of a served chain found, by check.
+type chainProblems map[string]error
+
+// checkChain checks that every certificate of the chain of pair parses and
+// is issued by the next one, that the chain is complete up to roots, or up
+// to a CA without them, and that the leaf covers dnsNames.
+func checkChain(pair *tls.Certificate, roots []byte, dnsNames []string, now time.Time) chainProblems {
+	problems := chainProblems{ChainCheckChain: nil}
+	if len(dnsNames) > 0 {
+		problems[ChainCheckSAN] = nil
+	}
+
+	chain := make([]*x509.Certificate, len(pair.Certificate))
+	for i, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			problems[ChainCheckChain] = fmt.Errorf("certificate %d of the chain doesn't parse: %w", i, err)
+			return problems
+		}
+		chain[i] = cert
+	}
+	leaf := chain[0]
+	if len(dnsNames) > 0 {
+		problems[ChainCheckSAN] = checkSANs(leaf, dnsNames)
+	}
+
+	for i := 0; i+1 < len(chain); i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			problems[ChainCheckChain] = fmt.Errorf("certificate %d (%s) isn't issued by certificate %d (%s) that follows it: %w",
+				i, chain[i].Subject, i+1, chain[i+1].Subject, err)
+			return problems
+		}
+	}
+
+	last := chain[len(chain)-1]
+	if len(roots) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(roots) {
+			problems[ChainCheckChain] = fmt.Errorf("the CA bundle holds no certificate to verify the chain with")
+			return problems
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: intermediates,
+			CurrentTime:   now,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		if err != nil {
+			problems[ChainCheckChain] = fmt.Errorf("the served chain doesn't lead to the CA bundle, is the issuer %s of %s missing: %w",
+				last.Issuer, last.Subject, err)
+		}
+		return problems
+	}
+	selfSigned := last.Subject.String() == last.Issuer.String() && last.CheckSignatureFrom(last) == nil
+	if len(chain) == 1 && !selfSigned {
+		problems[ChainCheckChain] = fmt.Errorf("only the leaf is served, clients must trust its issuer %s directly; serve the intermediates after it", last.Issuer)
+	}
+	return problems
+}
+
+// checkSANs returns which of dnsNames leaf doesn't cover.
+func checkSANs(leaf *x509.Certificate, dnsNames []string) error {
+	var missing []string
+	for _, name := range dnsNames {
+		if leaf.VerifyHostname(name) != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("the certificate doesn't cover %s, its DNS names are %s",
+		strings.Join(missing, ", "), strings.Join(leaf.DNSNames, ", "))
+}
+
+// CheckChain has the served chain checked per config, now and on every
+// reload. Problems are logged as warnings, exported in
+// webhook_tls_chain_valid and noted by ChainNote, but don't fail readiness:
+// the API server may still verify the chain with the caBundle.
+func (r *Reloader) CheckChain(config ChainConfig) {
+	r.mu.Lock()
+	r.chain = &config
+	cert := r.cert
+	r.mu.Unlock()
+	if cert != nil {
+		r.checkChain(cert)
+	}
+}
+
+// checkChain runs the chain checks on cert, when configured.
+func (r *Reloader) checkChain(cert *tls.Certificate) {
+	r.mu.RLock()
+	config := r.chain
+	r.mu.RUnlock()
+	if config == nil {
+		return
+	}
+	var roots []byte
+	if config.Roots != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		var err error
+		roots, err = config.Roots(ctx)
+		cancel()
+		if err != nil {
+			r.log.Error(err, "Failed to read the CA bundle to check the serving chain with, checking without it")
+		}
+	}
+
+	problems := checkChain(cert, roots, config.DNSNames, time.Now())
+	var notes []string
+	for _, check := range []string{ChainCheckChain, ChainCheckSAN} {
+		err, checked := problems[check]
+		if !checked {
+			continue
+		}
+		if err != nil {
+			notes = append(notes, err.Error())
+			r.log.Info("WARNING: serving certificate "+check+" check failed", "error", err.Error(), "served", len(cert.Certificate))
+		}
+		valid := 0.0
+		if err == nil {
+			valid = 1
+		}
+		metrics.CertChainValid.WithLabelValues(check).Set(valid)
+	}
+	r.mu.Lock()
+	r.chainNote = strings.Join(notes, "; ")
+	r.mu.Unlock()
+}
+
+// ChainNote returns the problems the last chain check found, empty when
+// none. It is nil-safe.
+func (r *Reloader) ChainNote() string {
+	if r == nil {
+		return ""
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.chainNote == "" {
+		return ""
+	}
+	return "serving certificate: " + r.chainNote
+}
@@ -0,0 +1,230 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/funcr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// serviceName is the DNS name of the webhook Service the serving
+// certificates are checked against.
+const serviceName = "cert-manager-webhook.cert-manager.svc"
+
+// intermediate returns a CA signed by ca.
+func (ca testCA) intermediate(t *testing.T, commonName string) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// serving returns a serving certificate for dnsNames signed by the CA,
+// followed by chain.
+func (ca testCA) serving(t *testing.T, dnsNames []string, chain ...testCA) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "webhook"},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	for _, issuer := range chain {
+		pair.Certificate = append(pair.Certificate, issuer.cert.Raw)
+	}
+	return pair
+}
+
+// writeChain writes pair to certFile and keyFile, stamped with modTime.
+func writeChain(t *testing.T, certFile, keyFile string, pair tls.Certificate, modTime time.Time) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(pair.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chain []byte
+	for _, der := range pair.Certificate {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	for name, data := range map[string][]byte{
+		keyFile:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		certFile: chain,
+	} {
+		if err := os.WriteFile(name, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckChain(t *testing.T) {
+	root := newTestCA(t, "root")
+	intermediate := root.intermediate(t, "intermediate")
+	dnsNames := []string{serviceName}
+	for _, tt := range []struct {
+		name     string
+		pair     tls.Certificate
+		roots    []byte
+		dnsNames []string
+		chain    string // in the chain problem, none when empty
+		san      string // in the SAN problem, none when empty
+	}{
+		{name: "full chain", pair: intermediate.serving(t, dnsNames, intermediate), roots: root.pem, dnsNames: dnsNames},
+		{name: "full chain with the root", pair: intermediate.serving(t, dnsNames, intermediate, root), roots: root.pem, dnsNames: dnsNames},
+		{name: "full chain, no CA bundle", pair: intermediate.serving(t, dnsNames, intermediate, root), dnsNames: dnsNames},
+		{name: "leaf only", pair: intermediate.serving(t, dnsNames), roots: root.pem, dnsNames: dnsNames,
+			chain: "the served chain doesn't lead to the CA bundle, is the issuer CN=intermediate of CN=webhook missing"},
+		{name: "leaf only, no CA bundle", pair: intermediate.serving(t, dnsNames), dnsNames: dnsNames,
+			chain: "only the leaf is served, clients must trust its issuer CN=intermediate directly"},
+		{name: "leaf issued by the bundle", pair: root.serving(t, dnsNames), roots: root.pem, dnsNames: dnsNames},
+		{name: "intermediate skipped", pair: intermediate.serving(t, dnsNames, root), roots: root.pem,
+			chain: "certificate 0 (CN=webhook) isn't issued by certificate 1 (CN=root) that follows it"},
+		{name: "other CA bundle", pair: intermediate.serving(t, dnsNames, intermediate), roots: newTestCA(t, "other").pem,
+			chain: "doesn't lead to the CA bundle"},
+		{name: "CA bundle without certificates", pair: intermediate.serving(t, dnsNames, intermediate), roots: []byte("not PEM"),
+			chain: "the CA bundle holds no certificate"},
+		{name: "wrong SAN", pair: intermediate.serving(t, []string{"other.example.com"}, intermediate), roots: root.pem, dnsNames: dnsNames,
+			san: "the certificate doesn't cover " + serviceName + ", its DNS names are other.example.com"},
+		{name: "SAN partly covered", pair: intermediate.serving(t, dnsNames, intermediate), roots: root.pem,
+			dnsNames: []string{serviceName, "cert-manager-webhook", serviceName + ".cluster.local"},
+			san:      "doesn't cover cert-manager-webhook, " + serviceName + ".cluster.local, its DNS names"},
+		{name: "wildcard SAN", pair: intermediate.serving(t, []string{"*.cert-manager.svc"}, intermediate), roots: root.pem, dnsNames: dnsNames},
+		{name: "no DNS names to cover", pair: intermediate.serving(t, nil, intermediate), roots: root.pem},
+		{name: "garbage in the chain", pair: tls.Certificate{Certificate: [][]byte{intermediate.serving(t, dnsNames).Certificate[0], []byte("garbage")}},
+			chain: "certificate 1 of the chain doesn't parse"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := checkChain(&tt.pair, tt.roots, tt.dnsNames, time.Now())
+			for check, want := range map[string]string{ChainCheckChain: tt.chain, ChainCheckSAN: tt.san} {
+				err, checked := problems[check]
+				if check == ChainCheckSAN && len(tt.dnsNames) == 0 {
+					if checked {
+						t.Errorf("SANs checked without DNS names: %v", err)
+					}
+					continue
+				}
+				if !checked || want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+					t.Errorf("%s check: %v, want %q", check, err, want)
+				}
+			}
+		})
+	}
+}
+
+// The chain is checked when configured and on every reload: the metric,
+// the warnings and the readiness note follow the served chain.
+func TestCheckChainReload(t *testing.T) {
+	root := newTestCA(t, "root")
+	intermediate := root.intermediate(t, "intermediate")
+	dir := t.TempDir()
+	certFile, keyFile, bundle := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(bundle, root.pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	issued := time.Now().Add(-time.Hour)
+	writeChain(t, certFile, keyFile, intermediate.serving(t, []string{serviceName}), issued)
+
+	var mu sync.Mutex
+	var warnings []string
+	log := funcr.New(func(_, args string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Contains(args, "WARNING") {
+			warnings = append(warnings, args)
+		}
+	}, funcr.Options{})
+	r, err := NewReloader(log, certFile, keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ChainNote() != "" {
+		t.Errorf("note %q before the check is configured", r.ChainNote())
+	}
+	r.CheckChain(ChainConfig{Roots: FileSource(bundle), DNSNames: []string{serviceName}})
+
+	for i, step := range []struct {
+		name       string
+		pair       tls.Certificate
+		chain, san float64
+		note       string // in the note, none when empty
+	}{
+		{name: "leaf only", chain: 0, san: 1, note: "serving certificate: the served chain doesn't lead to the CA bundle"},
+		{name: "wrong SAN", pair: intermediate.serving(t, []string{"other.example.com"}, intermediate), chain: 1, san: 0,
+			note: "serving certificate: the certificate doesn't cover " + serviceName},
+		{name: "full chain", pair: intermediate.serving(t, []string{serviceName}, intermediate), chain: 1, san: 1},
+	} {
+		if i > 0 {
+			writeChain(t, certFile, keyFile, step.pair, issued.Add(time.Duration(i)*time.Minute))
+			if err := r.reload(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := testutil.ToFloat64(metrics.CertChainValid.WithLabelValues(ChainCheckChain)); got != step.chain {
+			t.Errorf("%s: chain metric %v, want %v", step.name, got, step.chain)
+		}
+		if got := testutil.ToFloat64(metrics.CertChainValid.WithLabelValues(ChainCheckSAN)); got != step.san {
+			t.Errorf("%s: san metric %v, want %v", step.name, got, step.san)
+		}
+		note := r.ChainNote()
+		if step.note == "" && note != "" || step.note != "" && !strings.HasPrefix(note, step.note) {
+			t.Errorf("%s: note %q, want %q", step.name, note, step.note)
+		}
+		if err := r.Ready(time.Now()); err != nil {
+			t.Errorf("%s: not ready: %v", step.name, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(warnings) != 2 || !strings.Contains(warnings[0], `"WARNING: serving certificate chain check failed"`) ||
+		!strings.Contains(warnings[1], `"WARNING: serving certificate san check failed"`) {
+		t.Errorf("warnings %q, want one per problem", warnings)
+	}
+}
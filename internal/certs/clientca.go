@@ -0,0 +1,148 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	AuthenticationConfigMapNamespace = "kube-system"
+	authenticationConfigMapName      = "extension-apiserver-authentication"
+	authenticationConfigMapKey       = "client-ca-file"
+)
+
+// Source returns the current PEM bundle of client CAs.
+type Source func(ctx context.Context) ([]byte, error)
+
+func FileSource(path string) Source {
+	return func(context.Context) ([]byte, error) {
+		return ioutil.ReadFile(path)
+	}
+}
+
+// ConfigMapSource reads the client CA the API server publishes for
+// extension API servers.
+func ConfigMapSource(client kubernetes.Interface) Source {
+	return func(ctx context.Context) ([]byte, error) {
+		cm, err := client.CoreV1().ConfigMaps(AuthenticationConfigMapNamespace).Get(ctx, authenticationConfigMapName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		bundle, ok := cm.Data[authenticationConfigMapKey]
+		if !ok {
+			return nil, fmt.Errorf("configmap %s/%s has no %s key", cm.Namespace, cm.Name, authenticationConfigMapKey)
+		}
+		return []byte(bundle), nil
+	}
+}
+
+// ClientCAReloader keeps the pool used to verify client certificates in step
+// with its source. Every CA in the bundle is trusted, so during a rotation the
+// old and new CA are both accepted for as long as both are published.
+type ClientCAReloader struct {
+	log    logr.Logger
+	source Source
+
+	mu      sync.RWMutex
+	bundle  []byte
+	pool    *x509.CertPool
+	lastErr error // error of the last reload, nil when it succeeded
+}
+
+func NewClientCAReloader(log logr.Logger, source Source) (*ClientCAReloader, error) {
+	c := &ClientCAReloader{log: log, source: source}
+	return c, c.reload(context.Background())
+}
+
+func (c *ClientCAReloader) reload(ctx context.Context) error {
+	bundle, err := c.source(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	unchanged := bytes.Equal(bundle, c.bundle)
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return fmt.Errorf("no certificates found in client CA bundle")
+	}
+
+	c.mu.Lock()
+	c.bundle = bundle
+	c.pool = pool
+	c.mu.Unlock()
+
+	c.log.Info("Loaded client CA bundle")
+	return nil
+}
+
+// Watch reloads the bundle every interval until stop is closed. A failed
+// reload keeps the previous pool.
+func (c *ClientCAReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := c.reload(ctx)
+		if err != nil {
+			c.log.Error(err, "Failed to reload client CA bundle, keeping previous one")
+		}
+		cancel()
+
+		c.mu.Lock()
+		c.lastErr = err
+		c.mu.Unlock()
+	}
+}
+
+// Ready returns the error of the last reload: with client certificates
+// required, a CA that can't be read means rotations are no longer followed.
+func (c *ClientCAReloader) Ready(time.Time) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.lastErr != nil {
+		return fmt.Errorf("client CA bundle unreadable: %v", c.lastErr)
+	}
+	return nil
+}
+
+func (c *ClientCAReloader) Pool() *x509.CertPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pool
+}
+
+// ConfigForClient returns a tls.Config.GetConfigForClient callback that
+// requires client certificates signed by the current pool. Each handshake
+// picks up the latest pool; established connections are unaffected.
+func (c *ClientCAReloader) ConfigForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = c.Pool()
+		return config, nil
+	}
+}
@@ -0,0 +1,206 @@
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testCA is a CA issuing client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, commonName string) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a client certificate signed by the CA.
+func (ca testCA) issue(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshake runs a TLS handshake of client against a server configured by
+// the reloader, returning the server's verdict.
+func handshake(t *testing.T, c *ClientCAReloader, client tls.Certificate) error {
+	t.Helper()
+	serving := newTestCA(t, "webhook").issue(t, "webhook")
+	base := &tls.Config{Certificates: []tls.Certificate{serving}}
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	go func() {
+		conn := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{client}})
+		conn.Handshake()
+		// read until the server closes, which takes the alert of a
+		// rejected certificate off the pipe
+		conn.Read(make([]byte, 1))
+	}()
+	conn := tls.Server(serverConn, &tls.Config{GetConfigForClient: c.ConfigForClient(base)})
+	return conn.Handshake()
+}
+
+// The client CAs are rotated by publishing the new one next to the old one,
+// then dropping the old one: clients of both are accepted in between.
+func TestClientCARotation(t *testing.T) {
+	oldCA, newCA := newTestCA(t, "old-ca"), newTestCA(t, "new-ca")
+	oldClient, newClient := oldCA.issue(t, "apiserver"), newCA.issue(t, "apiserver")
+	bundleFile := filepath.Join(t.TempDir(), "client-ca.crt")
+	writeBundle := func(cas ...testCA) {
+		var bundle []byte
+		for _, ca := range cas {
+			bundle = append(bundle, ca.pem...)
+		}
+		if err := os.WriteFile(bundleFile, bundle, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeBundle(oldCA)
+	c, err := NewClientCAReloader(logr.Discard(), FileSource(bundleFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name     string
+		bundle   []testCA
+		accepted map[string]bool
+	}{
+		{"before", []testCA{oldCA}, map[string]bool{"old": true, "new": false}},
+		{"during", []testCA{oldCA, newCA}, map[string]bool{"old": true, "new": true}},
+		{"after", []testCA{newCA}, map[string]bool{"old": false, "new": true}},
+	}
+	clients := map[string]tls.Certificate{"old": oldClient, "new": newClient}
+	for _, step := range steps {
+		writeBundle(step.bundle...)
+		if err := c.reload(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for name, client := range clients {
+			err := handshake(t, c, client)
+			if accepted := err == nil; accepted != step.accepted[name] {
+				t.Errorf("%s rotation: client of the %s CA accepted = %v (%v), want %v", step.name, name, accepted, err, step.accepted[name])
+			}
+		}
+	}
+	// no client certificate at all
+	if err := handshake(t, c, tls.Certificate{}); err == nil {
+		t.Error("client without a certificate accepted")
+	}
+}
+
+// A bundle that can't be read keeps the last pool.
+func TestClientCAWatchKeepsPool(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	var failing atomic.Bool
+	var failures atomic.Int32
+	source := func(context.Context) ([]byte, error) {
+		if failing.Load() {
+			failures.Add(1)
+			return nil, errors.New("bundle unavailable")
+		}
+		return ca.pem, nil
+	}
+	c, err := NewClientCAReloader(logr.Discard(), source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing.Store(true)
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.Watch(time.Millisecond, stop)
+
+	waitFor(t, func() bool { return failures.Load() >= 3 })
+	if err := handshake(t, c, ca.issue(t, "apiserver")); err != nil {
+		t.Errorf("client rejected after a failed reload: %v", err)
+	}
+}
+
+func TestConfigMapCASource(t *testing.T) {
+	ca := newTestCA(t, "cluster-ca")
+	client := fake.NewClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: AuthenticationConfigMapNamespace, Name: authenticationConfigMapName},
+		Data:       map[string]string{authenticationConfigMapKey: string(ca.pem)},
+	})
+	c, err := NewClientCAReloader(logr.Discard(), ConfigMapSource(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, c, ca.issue(t, "apiserver")); err != nil {
+		t.Errorf("client of the published CA rejected: %v", err)
+	}
+
+	if _, err := ConfigMapSource(fake.NewClientset())(context.Background()); err == nil {
+		t.Error("missing ConfigMap not reported")
+	}
+}
+
+// waitFor polls cond for up to five seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+	}
+}
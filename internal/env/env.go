@@ -0,0 +1,72 @@
+package env
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envErrors collects invalid environment values found while the flag
+// defaults are computed, before there is a logger to report them to.
+var envErrors []error
+
+func String(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func Bool(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			envErrors = append(envErrors, fmt.Errorf("invalid boolean %q for %s, using %v", value, key, fallback))
+			return fallback
+		}
+		return b
+	}
+	return fallback
+}
+
+func Float64(key string, fallback float64) float64 {
+	if value, ok := os.LookupEnv(key); ok {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			envErrors = append(envErrors, fmt.Errorf("invalid number %q for %s, using %v", value, key, fallback))
+			return fallback
+		}
+		return f
+	}
+	return fallback
+}
+
+func Int64(key string, fallback int64) int64 {
+	if value, ok := os.LookupEnv(key); ok {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			envErrors = append(envErrors, fmt.Errorf("invalid integer %q for %s, using %v", value, key, fallback))
+			return fallback
+		}
+		return i
+	}
+	return fallback
+}
+
+func Duration(key string, fallback time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			envErrors = append(envErrors, fmt.Errorf("invalid duration %q for %s, using %v", value, key, fallback))
+			return fallback
+		}
+		return d
+	}
+	return fallback
+}
+
+// Errors returns the invalid environment values found so far.
+func Errors() []error {
+	return envErrors
+}
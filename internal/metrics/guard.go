@@ -0,0 +1,292 @@
+package metrics
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultMaxLabelValues is the default cap on the distinct values of a label
+// of one metric.
+const DefaultMaxLabelValues = 100
+
+// openLabels take their values from the cluster, the requests or the
+// configuration rather than from a fixed set in the code, so only the
+// cardinality guard bounds them.
+var openLabels = []string{"namespace", "path", "kind", "rule", "signature", "bucket", "profile", "key"}
+
+// CardinalityConfig bounds the series of the metric vectors.
+type CardinalityConfig struct {
+	// MaxValues caps the distinct values each label of a metric takes; once
+	// reached, new values are counted as "other". 0 disables the cap.
+	MaxValues int
+	// Allow lists, by label name, the only values that get their own series
+	// in every metric with that label, e.g. the namespaces worth a series;
+	// the others are counted as "other". Listed labels aren't capped.
+	Allow map[string][]string
+}
+
+// DefaultCardinality caps every label at DefaultMaxLabelValues values.
+func DefaultCardinality() CardinalityConfig {
+	return CardinalityConfig{MaxValues: DefaultMaxLabelValues}
+}
+
+var (
+	cardinalityMu sync.RWMutex
+	maxValues     = DefaultMaxLabelValues
+	allowed       map[string]map[string]bool
+)
+
+// SetCardinality bounds the label values of every metric vector as config
+// says, and returns warnings for the open labels it leaves unbounded. It is
+// meant to be called once at startup, before the metrics are used.
+func SetCardinality(config CardinalityConfig) []string {
+	allow := make(map[string]map[string]bool, len(config.Allow))
+	for label, values := range config.Allow {
+		allow[label] = make(map[string]bool, len(values))
+		for _, value := range values {
+			allow[label][value] = true
+		}
+	}
+	cardinalityMu.Lock()
+	maxValues = config.MaxValues
+	allowed = allow
+	cardinalityMu.Unlock()
+
+	if config.MaxValues > 0 {
+		return nil
+	}
+	var warnings []string
+	for _, label := range openLabels {
+		if _, ok := config.Allow[label]; !ok {
+			warnings = append(warnings, fmt.Sprintf("label %q of the metrics is unbounded: the label value cap is disabled and it has no allowlist", label))
+		}
+	}
+	return warnings
+}
+
+// ParseLabelAllowlist parses label value allowlists written
+// "label=value,value;label=value", e.g. "namespace=payments,checkout".
+func ParseLabelAllowlist(s string) (map[string][]string, error) {
+	allow := map[string][]string{}
+	for _, entry := range strings.Split(s, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		label, list, ok := strings.Cut(entry, "=")
+		label = strings.TrimSpace(label)
+		if !ok || label == "" {
+			return nil, fmt.Errorf("label allowlist %q is not label=value,value", entry)
+		}
+		if _, taken := allow[label]; taken {
+			return nil, fmt.Errorf("label %q listed twice", label)
+		}
+		values := []string{}
+		for _, value := range strings.Split(list, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		allow[label] = values
+	}
+	return allow, nil
+}
+
+// labelGuard bounds the values of the labels of one metric vector.
+type labelGuard struct {
+	metric string
+	labels []string
+
+	mu   sync.RWMutex
+	seen []map[string]bool // by label index
+}
+
+func newLabelGuard(metric string, labels []string) *labelGuard {
+	g := &labelGuard{metric: metric, labels: labels}
+	g.reset()
+	return g
+}
+
+func (g *labelGuard) reset() {
+	seen := make([]map[string]bool, len(g.labels))
+	for i := range seen {
+		seen[i] = map[string]bool{}
+	}
+	g.mu.Lock()
+	g.seen = seen
+	g.mu.Unlock()
+}
+
+// values returns the label values to record for values, those over the
+// bounds replaced by "other". values itself is left alone.
+func (g *labelGuard) values(values []string) []string {
+	out, copied := values, false
+	for i, value := range values {
+		if i >= len(g.labels) {
+			break
+		}
+		if bounded := g.bound(i, value); bounded != value {
+			if !copied {
+				out, copied = slices.Clone(values), true
+			}
+			out[i] = bounded
+		}
+	}
+	return out
+}
+
+// labelSet is values for labels given by name.
+func (g *labelGuard) labelSet(labels prometheus.Labels) prometheus.Labels {
+	out, copied := labels, false
+	for i, label := range g.labels {
+		value, ok := labels[label]
+		if !ok {
+			continue
+		}
+		if bounded := g.bound(i, value); bounded != value {
+			if !copied {
+				out, copied = maps.Clone(labels), true
+			}
+			out[label] = bounded
+		}
+	}
+	return out
+}
+
+// bound returns value when the label at i may take it, else otherLabel.
+func (g *labelGuard) bound(i int, value string) string {
+	label := g.labels[i]
+	cardinalityMu.RLock()
+	allow, listed := allowed[label]
+	max := maxValues
+	cardinalityMu.RUnlock()
+	if listed {
+		if allow[value] {
+			return value
+		}
+		LabelOverflows.WithLabelValues(g.metric, label).Inc()
+		return otherLabel
+	}
+	if max <= 0 || value == otherLabel {
+		return value
+	}
+
+	g.mu.RLock()
+	seen := g.seen[i][value]
+	g.mu.RUnlock()
+	if seen {
+		return value
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.seen[i][value] {
+		if len(g.seen[i]) >= max {
+			LabelOverflows.WithLabelValues(g.metric, label).Inc()
+			return otherLabel
+		}
+		g.seen[i][value] = true
+	}
+	return value
+}
+
+// ordered returns the values of labels in the order of the labels of the
+// metric.
+func (g *labelGuard) ordered(labels prometheus.Labels) []string {
+	values := make([]string, len(g.labels))
+	for i, label := range g.labels {
+		values[i] = labels[label]
+	}
+	return values
+}
+
+// CounterVec is a prometheus.CounterVec whose label values are bounded per
+// SetCardinality, and which is recorded to the sinks as well.
+type CounterVec struct {
+	*prometheus.CounterVec
+	guard  *labelGuard
+	metric *Metric
+}
+
+func newCounterVec(opts prometheus.CounterOpts, labels []string) *CounterVec {
+	return &CounterVec{prometheus.NewCounterVec(opts, labels), newLabelGuard(opts.Name, labels), counterMetric(opts, labels)}
+}
+
+// WithLabelValues returns the counter for values, once bounded.
+func (v *CounterVec) WithLabelValues(values ...string) prometheus.Counter {
+	values = v.guard.values(values)
+	return withSinks(v.CounterVec.WithLabelValues(values...), v.metric, values)
+}
+
+// With returns the counter for labels, once bounded.
+func (v *CounterVec) With(labels prometheus.Labels) prometheus.Counter {
+	labels = v.guard.labelSet(labels)
+	return withSinks(v.CounterVec.With(labels), v.metric, v.guard.ordered(labels))
+}
+
+// Reset deletes the series and forgets the values seen.
+func (v *CounterVec) Reset() {
+	v.CounterVec.Reset()
+	v.guard.reset()
+}
+
+// GaugeVec is a prometheus.GaugeVec whose label values are bounded per
+// SetCardinality.
+type GaugeVec struct {
+	*prometheus.GaugeVec
+	guard *labelGuard
+}
+
+func newGaugeVec(opts prometheus.GaugeOpts, labels []string) *GaugeVec {
+	return &GaugeVec{prometheus.NewGaugeVec(opts, labels), newLabelGuard(opts.Name, labels)}
+}
+
+// WithLabelValues returns the gauge for values, once bounded.
+func (v *GaugeVec) WithLabelValues(values ...string) prometheus.Gauge {
+	return v.GaugeVec.WithLabelValues(v.guard.values(values)...)
+}
+
+// With returns the gauge for labels, once bounded.
+func (v *GaugeVec) With(labels prometheus.Labels) prometheus.Gauge {
+	return v.GaugeVec.With(v.guard.labelSet(labels))
+}
+
+// Reset deletes the series and forgets the values seen, for gauges set anew
+// from a full count.
+func (v *GaugeVec) Reset() {
+	v.GaugeVec.Reset()
+	v.guard.reset()
+}
+
+// HistogramVec is a prometheus.HistogramVec whose label values are bounded
+// per SetCardinality, and which is recorded to the sinks as well.
+type HistogramVec struct {
+	*prometheus.HistogramVec
+	guard  *labelGuard
+	metric *Metric
+}
+
+func newHistogramVec(opts prometheus.HistogramOpts, labels []string) *HistogramVec {
+	return &HistogramVec{prometheus.NewHistogramVec(opts, labels), newLabelGuard(opts.Name, labels), histogramMetric(opts, labels)}
+}
+
+// WithLabelValues returns the histogram for values, once bounded.
+func (v *HistogramVec) WithLabelValues(values ...string) prometheus.Observer {
+	values = v.guard.values(values)
+	return observeWithSinks(v.HistogramVec.WithLabelValues(values...), v.metric, values)
+}
+
+// With returns the histogram for labels, once bounded.
+func (v *HistogramVec) With(labels prometheus.Labels) prometheus.Observer {
+	labels = v.guard.labelSet(labels)
+	return observeWithSinks(v.HistogramVec.With(labels), v.metric, v.guard.ordered(labels))
+}
+
+// Reset deletes the series and forgets the values seen.
+func (v *HistogramVec) Reset() {
+	v.HistogramVec.Reset()
+	v.guard.reset()
+}
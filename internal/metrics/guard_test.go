@@ -0,0 +1,217 @@
+package metrics
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// setCardinality bounds the label values as config says for the test.
+func setCardinality(t *testing.T, config CardinalityConfig) {
+	t.Helper()
+	SetCardinality(config)
+	t.Cleanup(func() { SetCardinality(DefaultCardinality()) })
+}
+
+// Thousands of distinct values get the first MaxValues their own series,
+// the rest one "other" series, counted as overflows; a value seen keeps its
+// series once the cap is reached.
+func TestCardinalityCap(t *testing.T) {
+	setCardinality(t, CardinalityConfig{MaxValues: 50})
+	vec := newCounterVec(prometheus.CounterOpts{Name: "test_cap_total", Help: "test"}, []string{"namespace", "operation"})
+	overflows := LabelOverflows.WithLabelValues("test_cap_total", "namespace")
+	before := testutil.ToFloat64(overflows)
+
+	for i := range 3000 {
+		vec.WithLabelValues(fmt.Sprintf("ns-%04d", i), "CREATE").Inc()
+	}
+	vec.WithLabelValues("ns-0000", "CREATE").Inc()
+	if got := testutil.CollectAndCount(vec); got != 51 {
+		t.Errorf("%d series, want 50 and other", got)
+	}
+	if got := testutil.ToFloat64(vec.WithLabelValues(otherLabel, "CREATE")); got != 2950 {
+		t.Errorf("other counted %v, want 2950", got)
+	}
+	if got := testutil.ToFloat64(vec.WithLabelValues("ns-0000", "CREATE")); got != 2 {
+		t.Errorf("value seen before the cap counted %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(overflows) - before; got != 2950 {
+		t.Errorf("%v overflows, want 2950", got)
+	}
+
+	// each label is capped on its own
+	for i := range 200 {
+		vec.WithLabelValues("ns-0001", fmt.Sprintf("op-%d", i)).Inc()
+	}
+	if got := testutil.CollectAndCount(vec); got != 51+50 {
+		t.Errorf("%d series once the operations overflow, want 101", got)
+	}
+}
+
+// Only the values allowlisted get a series, whatever the cap; the labels
+// not listed are still capped.
+func TestCardinalityAllowlist(t *testing.T) {
+	setCardinality(t, CardinalityConfig{MaxValues: 5, Allow: map[string][]string{"namespace": {"payments", "checkout"}}})
+	vec := newCounterVec(prometheus.CounterOpts{Name: "test_allow_total", Help: "test"}, []string{"namespace", "rule"})
+	for i := range 2000 {
+		vec.With(prometheus.Labels{"namespace": fmt.Sprintf("ns-%d", i), "rule": fmt.Sprintf("rule-%d", i%20)}).Inc()
+	}
+	vec.With(prometheus.Labels{"namespace": "payments", "rule": "rule-0"}).Inc()
+
+	var namespaces, rules []string
+	for _, series := range collectLabels(t, vec) {
+		if !slices.Contains(namespaces, series["namespace"]) {
+			namespaces = append(namespaces, series["namespace"])
+		}
+		if !slices.Contains(rules, series["rule"]) {
+			rules = append(rules, series["rule"])
+		}
+	}
+	slices.Sort(namespaces)
+	slices.Sort(rules)
+	if !slices.Equal(namespaces, []string{otherLabel, "payments"}) {
+		t.Errorf("namespaces %v, want payments and other", namespaces)
+	}
+	if !slices.Equal(rules, []string{otherLabel, "rule-0", "rule-1", "rule-2", "rule-3", "rule-4"}) {
+		t.Errorf("rules %v, want 5 and other", rules)
+	}
+}
+
+// collectLabels returns the labels of each series of c.
+func collectLabels(t *testing.T, c prometheus.Collector) []map[string]string {
+	t.Helper()
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []map[string]string
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, pair := range metric.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			series = append(series, labels)
+		}
+	}
+	return series
+}
+
+// Histograms and gauges are bounded the same, by values and by labels,
+// and the values given are left alone.
+func TestCardinalityVectors(t *testing.T) {
+	setCardinality(t, CardinalityConfig{MaxValues: 10})
+	histogram := newHistogramVec(prometheus.HistogramOpts{Name: "test_seconds", Help: "test"}, []string{"path"})
+	gauge := newGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "test"}, []string{"namespace"})
+	for i := range 1000 {
+		values := []string{fmt.Sprintf("/path-%d", i)}
+		histogram.WithLabelValues(values...).Observe(0.1)
+		if values[0] != fmt.Sprintf("/path-%d", i) {
+			t.Fatalf("values given changed to %v", values)
+		}
+		labels := prometheus.Labels{"namespace": fmt.Sprintf("ns-%d", i)}
+		gauge.With(labels).Add(1)
+		if labels["namespace"] != fmt.Sprintf("ns-%d", i) {
+			t.Fatalf("labels given changed to %v", labels)
+		}
+	}
+	if got := testutil.CollectAndCount(histogram); got != 11 {
+		t.Errorf("%d histogram series, want 11", got)
+	}
+	if got := testutil.CollectAndCount(gauge); got != 11 {
+		t.Errorf("%d gauge series, want 11", got)
+	}
+	if got := testutil.ToFloat64(gauge.WithLabelValues(otherLabel)); got != 990 {
+		t.Errorf("other gauge %v, want the sum of 990", got)
+	}
+
+	// a reset forgets the values seen
+	gauge.Reset()
+	for i := range 10 {
+		gauge.WithLabelValues(fmt.Sprintf("new-%d", i)).Set(1)
+	}
+	if got := testutil.ToFloat64(gauge.WithLabelValues("new-9")); got != 1 || testutil.CollectAndCount(gauge) != 10 {
+		t.Errorf("after a reset: %d series", testutil.CollectAndCount(gauge))
+	}
+}
+
+// Concurrent new values never take a label over the cap. Run with -race.
+func TestCardinalityConcurrent(t *testing.T) {
+	setCardinality(t, CardinalityConfig{MaxValues: 100})
+	vec := newCounterVec(prometheus.CounterOpts{Name: "test_concurrent_total", Help: "test"}, []string{"namespace"})
+	var wg sync.WaitGroup
+	for worker := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 1000 {
+				vec.WithLabelValues(fmt.Sprintf("ns-%d-%d", worker, i)).Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	if got := testutil.CollectAndCount(vec); got != 101 {
+		t.Errorf("%d series, want 100 and other", got)
+	}
+	var total float64
+	for _, series := range collectLabels(t, vec) {
+		total += testutil.ToFloat64(vec.WithLabelValues(series["namespace"]))
+	}
+	if total != 8000 {
+		t.Errorf("%v counted in all, want 8000", total)
+	}
+}
+
+// Without a cap, every open label without an allowlist is warned about.
+func TestCardinalityWarnings(t *testing.T) {
+	t.Cleanup(func() { SetCardinality(DefaultCardinality()) })
+	if warnings := SetCardinality(DefaultCardinality()); len(warnings) != 0 {
+		t.Errorf("capped: warnings %q", warnings)
+	}
+	warnings := SetCardinality(CardinalityConfig{})
+	if len(warnings) != len(openLabels) {
+		t.Errorf("%d warnings, want one per open label: %q", len(warnings), warnings)
+	}
+	warnings = SetCardinality(CardinalityConfig{Allow: map[string][]string{"namespace": {"payments"}}})
+	if len(warnings) != len(openLabels)-1 || strings.Contains(strings.Join(warnings, "\n"), `"namespace"`) {
+		t.Errorf("namespace allowlisted: warnings %q", warnings)
+	}
+
+	// uncapped, values go through
+	vec := newCounterVec(prometheus.CounterOpts{Name: "test_uncapped_total", Help: "test"}, []string{"rule"})
+	for i := range 500 {
+		vec.WithLabelValues(fmt.Sprintf("rule-%d", i)).Inc()
+	}
+	if got := testutil.CollectAndCount(vec); got != 500 {
+		t.Errorf("uncapped: %d series, want 500", got)
+	}
+}
+
+func TestParseLabelAllowlist(t *testing.T) {
+	allow, err := ParseLabelAllowlist(" namespace = payments, checkout ,; rule=prod;;path=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allow) != 3 || !slices.Equal(allow["namespace"], []string{"payments", "checkout"}) ||
+		!slices.Equal(allow["rule"], []string{"prod"}) || allow["path"] == nil || len(allow["path"]) != 0 {
+		t.Errorf("allowlist %v", allow)
+	}
+	for s, want := range map[string]string{
+		"namespace":                  "is not label=value,value",
+		"=payments":                  "is not label=value,value",
+		"namespace=a;namespace=b":    `label "namespace" listed twice`,
+		"rule=prod;namespace":        `"namespace" is not`,
+		"namespace=a ; rule=b ; =c ": `"=c" is not`,
+	} {
+		if _, err := ParseLabelAllowlist(s); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: error %v, want %q", s, err, want)
+		}
+	}
+}
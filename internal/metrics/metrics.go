@@ -0,0 +1,348 @@
+// Package metrics holds the Prometheus instrumentation of the webhook.
+// Collectors are registered with the default registry, which also carries
+// the standard Go and process collectors.
+package metrics
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Results of an admission request.
+const (
+	ResultMutated = "mutated"
+	ResultSkipped = "skipped"
+	ResultErrored = "errored"
+	ResultDenied  = "denied"
+	ResultAllowed = "allowed" // passed a validating webhook
+)
+
+var (
+	Requests = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_requests_total",
+		Help: "Number of admission requests by path, operation and result.",
+	}, []string{"path", "operation", "result"})
+	AdmissionDuration = newHistogramVec(prometheus.HistogramOpts{
+		Name:    "webhook_admission_duration_seconds",
+		Help:    "Time taken to answer an admission request.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"path"})
+	PatchBytes = newHistogram(prometheus.HistogramOpts{
+		Name:    "webhook_patch_bytes",
+		Help:    "Size of the JSON patches returned to the API server.",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+	})
+	RuleMatches = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_rule_matches_total",
+		Help: "Number of admissions each mutation rule matched.",
+	}, []string{"rule"})
+	SignatureMatches = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_signature_matches_total",
+		Help: "Number of mutated admissions by the ownership signature the secret matched.",
+	}, []string{"signature"})
+	SyncTargets = newHistogram(prometheus.HistogramOpts{
+		Name:    "webhook_sync_target_namespaces",
+		Help:    "Number of namespaces the sync annotation of mutated secrets selects, resolved when MAX_TARGET_NAMESPACES is set.",
+		Buckets: []float64{1, 2, 5, 10, 25, 50, 100, 250, 500},
+	})
+	ClusterProfile = newGaugeVec(prometheus.GaugeOpts{
+		Name: "webhook_cluster_profile_info",
+		Help: "Always 1, labelled with the cluster profile the active settings were picked by, empty when none.",
+	}, []string{"profile"})
+	AnnotationsAdded = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_annotations_added_total",
+		Help: "Number of annotations set by patches, by key. Keys outside the configured set are counted as \"other\".",
+	}, []string{"key"})
+	PatchErrors = newCounter(prometheus.CounterOpts{
+		Name: "webhook_patch_errors_total",
+		Help: "Number of failures while building a patch.",
+	})
+	CertExpiryTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_tls_cert_expiry_timestamp_seconds",
+		Help: "Expiry time of the active serving certificate in seconds since the epoch.",
+	})
+	CertChainValid = newGaugeVec(prometheus.GaugeOpts{
+		Name: "webhook_tls_chain_valid",
+		Help: "Whether the served certificate chain passed the check, by check: chain, complete and in order, or san, covering the expected DNS names.",
+	}, []string{"check"})
+	RequestBodyTooLarge = newCounter(prometheus.CounterOpts{
+		Name: "webhook_request_body_too_large_total",
+		Help: "Number of requests rejected because their body exceeded the size limit.",
+	})
+	RateLimited = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_rate_limited_total",
+		Help: "Number of admission requests over the rate limit, by bucket and mode.",
+	}, []string{"bucket", "mode"})
+	AuditDropped = newCounter(prometheus.CounterOpts{
+		Name: "webhook_audit_dropped_total",
+		Help: "Number of audit log entries dropped because the writer could not keep up or failed.",
+	})
+	Panics = newCounter(prometheus.CounterOpts{
+		Name: "webhook_panics_total",
+		Help: "Number of panics recovered while handling admission requests.",
+	})
+	AdmissionsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_admissions_in_flight",
+		Help: "Number of admission requests currently being served.",
+	})
+	LoadShed = newCounter(prometheus.CounterOpts{
+		Name: "webhook_load_shed_total",
+		Help: "Number of admissions answered per the failure policy because no concurrency slot freed up in time.",
+	})
+	SyncOperatorPresent = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_sync_operator_present",
+		Help: "Whether a kubed or config-syncer Deployment was found, 1 or 0.",
+	})
+	SlowRequests = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_slow_requests_total",
+		Help: "Number of admissions slower than the threshold, by their slowest phase.",
+	}, []string{"phase"})
+	FreezeActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_freeze_active",
+		Help: "Whether a change freeze window is active, during which admissions are not patched, 1 or 0.",
+	})
+	ActiveProbeSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_active_probe_success",
+		Help: "Whether the last dry-run of the marker secret through the API server came back mutated, 1 or 0.",
+	})
+	ActiveProbes = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_active_probes_total",
+		Help: "Number of dry-runs of the marker secret through the API server, by result: passed or failed.",
+	}, []string{"result"})
+	ReadinessCheck = newGaugeVec(prometheus.GaugeOpts{
+		Name: "webhook_readiness_check",
+		Help: "Whether each readiness precondition held at the last /readyz probe, 1 or 0.",
+	}, []string{"check"})
+	Skips = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_skips_total",
+		Help: "Number of admissions passed through unmodified, by reason.",
+	}, []string{"reason"})
+	InjectedFaults = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_injected_faults_total",
+		Help: "Number of faults deliberately injected into admissions, by type.",
+	}, []string{"type"})
+	WebhookConfigReconciles = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_config_reconciles_total",
+		Help: "Number of corrections of the MutatingWebhookConfiguration, by result.",
+	}, []string{"result"})
+	WebhookConfigDrift = newGaugeVec(prometheus.GaugeOpts{
+		Name: "webhook_config_drift",
+		Help: "1 when a field of the webhook configuration's entries differs from the settings of the webhook, by field; exported by the leader.",
+	}, []string{"field"})
+	RuleErrors = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_rule_errors_total",
+		Help: "Number of admissions whose rule match expression failed to evaluate, by rule.",
+	}, []string{"rule"})
+	DownstreamRequests = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_downstream_requests_total",
+		Help: "Number of admissions forwarded to the downstream webhook, by result: allowed, denied, error or timeout.",
+	}, []string{"result"})
+	DownstreamConflicts = newCounter(prometheus.CounterOpts{
+		Name: "webhook_downstream_patch_conflicts_total",
+		Help: "Number of downstream webhook patch values dropped because they conflicted with ours.",
+	})
+	UnexpectedKinds = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_unexpected_kinds_total",
+		Help: "Number of admission requests for a kind the path doesn't handle, by path, kind and whether another handler took them.",
+	}, []string{"path", "kind", "handled"})
+	PatchVerificationFailures = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_patch_verification_failures_total",
+		Help: "Number of generated patches that failed to apply to their object or left it without the expected annotations, by the operation at fault (\"result\" for the latter). Any increase is a bug.",
+	}, []string{"op"})
+	NamespaceCacheMisses = newCounter(prometheus.CounterOpts{
+		Name: "webhook_namespace_cache_misses_total",
+		Help: "Number of admissions answered per the failure policy because their namespace wasn't in the informer cache yet.",
+	})
+	DecisionCacheReplays = newCounter(prometheus.CounterOpts{
+		Name: "webhook_decision_cache_replays_total",
+		Help: "Number of retried admissions answered with the cached decision of their first attempt.",
+	})
+	DecisionCacheBypasses = newCounter(prometheus.CounterOpts{
+		Name: "webhook_decision_cache_bypasses_total",
+		Help: "Number of retried admissions evaluated again because their object's resourceVersion changed since the cached decision.",
+	})
+	ConfigGeneration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_config_generation",
+		Help: "Number of times the admission policy was loaded: 1 at start, one more for each successful reload.",
+	})
+	BackfillSecrets = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_backfill_secrets_total",
+		Help: "Number of secrets examined by the backfill controller, by result: patched, unchanged, conflict, dry-run, change-freeze or failed.",
+	}, []string{"result"})
+	SideEffectRetries = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_sideeffect_retries_total",
+		Help: "Number of retries of writes to the cluster after a conflict or transient failure, by operation.",
+	}, []string{"operation"})
+	IsLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_is_leader",
+		Help: "1 while this replica holds the leader election lease and runs the controllers, 0 otherwise.",
+	})
+	EligibleSecrets = newGaugeVec(prometheus.GaugeOpts{
+		Name: "webhook_eligible_secrets_total",
+		Help: "cert-manager secrets the policy annotates, annotated or not, by namespace; namespaces beyond the top ones are summed as other.",
+	}, []string{"namespace"})
+	AnnotatedSecrets = newGaugeVec(prometheus.GaugeOpts{
+		Name: "webhook_annotated_secrets_total",
+		Help: "Eligible cert-manager secrets already annotated as the policy wants, by namespace.",
+	}, []string{"namespace"})
+	UnannotatedEligibleSecrets = newGaugeVec(prometheus.GaugeOpts{
+		Name: "webhook_unannotated_eligible_secrets_total",
+		Help: "Eligible cert-manager secrets the policy would still patch, by namespace.",
+	}, []string{"namespace"})
+	ResyncTouches = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_resync_touches_total",
+		Help: "Number of managed secrets touched for kubed to copy them into newly created namespaces, by result: touched or failed.",
+	}, []string{"result"})
+	ReplicaGC = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_replica_gc_total",
+		Help: "Number of orphaned kubed copies collected, by result: deleted, dry-run or failed.",
+	}, []string{"result"})
+	DriftedSecrets = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_drifted_secrets",
+		Help: "Managed secrets whose annotations differed from the current policy at the last drift scan, remediated or not.",
+	})
+	LabelOverflows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_metric_label_overflows_total",
+		Help: "Number of observations recorded with the label value \"other\" because their own value was over the label value cap or not in its allowlist, by metric and label.",
+	}, []string{"metric", "label"})
+	DriftRemediations = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_drift_remediations_total",
+		Help: "Number of drifted secrets patched back to the policy, by result: patched, change-freeze or failed.",
+	}, []string{"result"})
+	ErrorReports = newCounterVec(prometheus.CounterOpts{
+		Name: "webhook_error_reports_total",
+		Help: "Number of reports of panics and repeated errors to the error tracker, by result: sent, failed or dropped.",
+	}, []string{"result"})
+	SinkErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_metrics_sink_errors_total",
+		Help: "Number of failed pushes of the metrics to a sink other than Prometheus, by sink.",
+	}, []string{"sink"})
+)
+
+// collectors are all the webhook's metrics.
+var collectors = []prometheus.Collector{
+	Requests,
+	AdmissionDuration,
+	PatchBytes,
+	RuleMatches,
+	SignatureMatches,
+	SyncTargets,
+	ClusterProfile,
+	AnnotationsAdded,
+	PatchErrors,
+	CertExpiryTimestamp,
+	CertChainValid,
+	RequestBodyTooLarge,
+	RateLimited,
+	AuditDropped,
+	Panics,
+	WebhookConfigReconciles,
+	WebhookConfigDrift,
+	AdmissionsInFlight,
+	LoadShed,
+	SyncOperatorPresent,
+	FreezeActive,
+	ActiveProbeSuccess,
+	ActiveProbes,
+	SlowRequests,
+	ReadinessCheck,
+	Skips,
+	InjectedFaults,
+	RuleErrors,
+	DownstreamRequests,
+	DownstreamConflicts,
+	UnexpectedKinds,
+	NamespaceCacheMisses,
+	PatchVerificationFailures,
+	DecisionCacheReplays,
+	DecisionCacheBypasses,
+	ConfigGeneration,
+	BackfillSecrets,
+	SideEffectRetries,
+	IsLeader,
+	EligibleSecrets,
+	AnnotatedSecrets,
+	UnannotatedEligibleSecrets,
+	ResyncTouches,
+	ReplicaGC,
+	DriftedSecrets,
+	DriftRemediations,
+	ErrorReports,
+	LabelOverflows,
+	SinkErrors,
+}
+
+func init() {
+	prometheus.MustRegister(collectors...)
+}
+
+// Register registers the webhook's metrics with reg as well, e.g. the
+// registry of a program embedding the webhook. The collectors are shared by
+// every webhook in the process; registering them twice with reg is not an
+// error.
+func Register(reg prometheus.Registerer) error {
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			var already prometheus.AlreadyRegisteredError
+			if !errors.As(err, &already) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ObserveAdmission records the outcome and latency of one admission request.
+func ObserveAdmission(path, operation, result string, duration time.Duration) {
+	Requests.WithLabelValues(path, operation, result).Inc()
+	AdmissionDuration.WithLabelValues(path).Observe(duration.Seconds())
+	stats.Lock()
+	stats.results[result]++
+	stats.Unlock()
+}
+
+// otherLabel replaces label values outside a bounded, configured set.
+const otherLabel = "other"
+
+var (
+	annotationKeysMu sync.RWMutex
+	annotationKeys   = map[string]bool{}
+)
+
+// SetAnnotationKeys sets the annotation keys that get their own label value
+// in AnnotationsAdded, keeping its cardinality bounded by configuration.
+func SetAnnotationKeys(keys ...string) {
+	set := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		set[key] = true
+	}
+	annotationKeysMu.Lock()
+	annotationKeys = set
+	annotationKeysMu.Unlock()
+}
+
+// SetClusterProfile labels ClusterProfile with the active cluster profile.
+func SetClusterProfile(profile string) {
+	ClusterProfile.Reset()
+	ClusterProfile.WithLabelValues(profile).Set(1)
+}
+
+// ObserveAnnotationAdded counts an annotation set by a patch.
+func ObserveAnnotationAdded(key string) {
+	annotationKeysMu.RLock()
+	known := annotationKeys[key]
+	annotationKeysMu.RUnlock()
+	if !known {
+		key = otherLabel
+	}
+	AnnotationsAdded.WithLabelValues(key).Inc()
+}
+
+// ObservePatch records the size of a patch and the rule that produced it.
+func ObservePatch(rule string, patch []byte) {
+	RuleMatches.WithLabelValues(rule).Inc()
+	PatchBytes.Observe(float64(len(patch)))
+}
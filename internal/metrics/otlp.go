@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+)
+
+const meterName = "github.com/bygui86/cert-manager-webhook"
+
+// OTLP is a Sink recording the metrics with the OpenTelemetry SDK and
+// exporting them to an OTLP/HTTP endpoint, e.g. an OpenTelemetry
+// collector. Its reader is a manual one, collected on Push, and keeps the
+// totals since start, exported as cumulative sums and explicit bucket
+// histograms, so a failed export loses nothing the next one doesn't carry.
+// The replicas are told apart by the service.instance.id resource
+// attribute, the host name.
+type OTLP struct {
+	endpoint string
+	reader   *sdkmetric.ManualReader
+	exporter sdkmetric.Exporter
+	meter    otelmetric.Meter
+
+	mu         sync.Mutex
+	counters   map[string]otelmetric.Float64Counter
+	histograms map[string]otelmetric.Float64Histogram
+}
+
+// NewOTLP returns an OTLP sink exporting to endpoint, an http or https URL;
+// the metrics path /v1/metrics is used when it has no path.
+func NewOTLP(endpoint string) (*OTLP, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("otlp metrics endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("otlp metrics endpoint %q is not an http or https URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/metrics"
+	}
+	exporter, err := otlpmetrichttp.New(context.Background(), otlpmetrichttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	attributes := []attribute.KeyValue{semconv.ServiceName("cert-manager-webhook")}
+	if host, err := os.Hostname(); err == nil {
+		attributes = append(attributes, semconv.ServiceInstanceID(host))
+	}
+	// schemaless, to merge with the default resource whatever the semantic
+	// conventions version of the SDK
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attributes...))
+	if err != nil {
+		return nil, err
+	}
+	reader := sdkmetric.NewManualReader(
+		sdkmetric.WithTemporalitySelector(exporter.Temporality),
+		sdkmetric.WithAggregationSelector(exporter.Aggregation),
+	)
+	sink := newOTLP(reader, exporter, res)
+	sink.endpoint = u.String()
+	return sink, nil
+}
+
+// newOTLP returns an OTLP sink recording to a meter provider read by
+// reader, which Push collects and hands to exporter.
+func newOTLP(reader *sdkmetric.ManualReader, exporter sdkmetric.Exporter, res *resource.Resource) *OTLP {
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithResource(res))
+	return &OTLP{
+		reader:     reader,
+		exporter:   exporter,
+		meter:      provider.Meter(meterName),
+		counters:   map[string]otelmetric.Float64Counter{},
+		histograms: map[string]otelmetric.Float64Histogram{},
+	}
+}
+
+// Name returns "otlp".
+func (o *OTLP) Name() string { return "otlp" }
+
+// Add adds delta to the counter.
+func (o *OTLP) Add(metric *Metric, values []string, delta float64) {
+	o.mu.Lock()
+	counter, ok := o.counters[metric.Name]
+	if !ok {
+		// the names are Prometheus', valid instrument names, and the SDK
+		// returns a working instrument whatever the error
+		counter, _ = o.meter.Float64Counter(metric.Name, otelmetric.WithDescription(metric.Help))
+		o.counters[metric.Name] = counter
+	}
+	o.mu.Unlock()
+	counter.Add(context.Background(), delta, otelmetric.WithAttributes(otlpAttributes(metric, values)...))
+}
+
+// Observe records value in the histogram, in the metric's buckets.
+func (o *OTLP) Observe(metric *Metric, values []string, value float64) {
+	o.mu.Lock()
+	histogram, ok := o.histograms[metric.Name]
+	if !ok {
+		histogram, _ = o.meter.Float64Histogram(metric.Name, otelmetric.WithDescription(metric.Help),
+			otelmetric.WithExplicitBucketBoundaries(metric.Buckets...))
+		o.histograms[metric.Name] = histogram
+	}
+	o.mu.Unlock()
+	histogram.Record(context.Background(), value, otelmetric.WithAttributes(otlpAttributes(metric, values)...))
+}
+
+// otlpAttributes returns the label values of metric as attributes.
+func otlpAttributes(metric *Metric, values []string) []attribute.KeyValue {
+	attributes := make([]attribute.KeyValue, 0, len(values))
+	for i, label := range metric.Labels {
+		if i < len(values) {
+			attributes = append(attributes, attribute.String(label, values[i]))
+		}
+	}
+	return attributes
+}
+
+// Push collects the totals of every series and exports them.
+func (o *OTLP) Push(ctx context.Context) error {
+	var metrics metricdata.ResourceMetrics
+	if err := o.reader.Collect(ctx, &metrics); err != nil {
+		return err
+	}
+	return o.exporter.Export(ctx, &metrics)
+}
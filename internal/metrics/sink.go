@@ -0,0 +1,203 @@
+package metrics
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// Sink receives the counter increments and histogram observations of the
+// webhook, besides the Prometheus registry, for monitoring systems that
+// don't scrape. It is called on the admission path, so it only buffers:
+// Push ships what was buffered, from the Pusher's goroutine. Gauges and
+// LabelOverflows stay with Prometheus.
+type Sink interface {
+	// Name names the sink in logs and metrics.
+	Name() string
+	// Add adds delta to the counter metric with the label values.
+	Add(metric *Metric, values []string, delta float64)
+	// Observe records value in the histogram metric with the label values.
+	Observe(metric *Metric, values []string, value float64)
+	// Push ships the buffered metrics.
+	Push(ctx context.Context) error
+}
+
+// Metric describes a counter or a histogram to the sinks.
+type Metric struct {
+	Name   string
+	Help   string
+	Labels []string
+	// Buckets are the upper bounds of the buckets of a histogram.
+	Buckets []float64
+}
+
+func counterMetric(opts prometheus.CounterOpts, labels []string) *Metric {
+	return &Metric{Name: prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), Help: opts.Help, Labels: labels}
+}
+
+func histogramMetric(opts prometheus.HistogramOpts, labels []string) *Metric {
+	buckets := opts.Buckets
+	if buckets == nil {
+		buckets = prometheus.DefBuckets
+	}
+	return &Metric{Name: prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), Help: opts.Help, Labels: labels, Buckets: buckets}
+}
+
+// sinks are the sinks set with SetSinks, nil for none.
+var sinks atomic.Pointer[[]Sink]
+
+// SetSinks sets the sinks the counters and histograms are recorded to
+// besides the Prometheus registry. It is meant to be called once at
+// startup, before the metrics are used.
+func SetSinks(s ...Sink) {
+	if len(s) == 0 {
+		sinks.Store(nil)
+		return
+	}
+	sinks.Store(&s)
+}
+
+func activeSinks() []Sink {
+	if s := sinks.Load(); s != nil {
+		return *s
+	}
+	return nil
+}
+
+// sinkCounter records the increments of a counter to the sinks as well.
+type sinkCounter struct {
+	prometheus.Counter
+	metric *Metric
+	values []string
+	sinks  []Sink
+}
+
+func withSinks(counter prometheus.Counter, metric *Metric, values []string) prometheus.Counter {
+	s := activeSinks()
+	if s == nil {
+		return counter
+	}
+	return sinkCounter{counter, metric, values, s}
+}
+
+func (c sinkCounter) Inc() { c.Add(1) }
+
+func (c sinkCounter) Add(delta float64) {
+	// the counter panics on a negative delta, before any sink sees it
+	c.Counter.Add(delta)
+	for _, sink := range c.sinks {
+		sink.Add(c.metric, c.values, delta)
+	}
+}
+
+// sinkObserver records the observations of a histogram to the sinks as
+// well.
+type sinkObserver struct {
+	prometheus.Observer
+	metric *Metric
+	values []string
+	sinks  []Sink
+}
+
+func observeWithSinks(observer prometheus.Observer, metric *Metric, values []string) prometheus.Observer {
+	s := activeSinks()
+	if s == nil {
+		return observer
+	}
+	return sinkObserver{observer, metric, values, s}
+}
+
+func (o sinkObserver) Observe(value float64) {
+	o.Observer.Observe(value)
+	for _, sink := range o.sinks {
+		sink.Observe(o.metric, o.values, value)
+	}
+}
+
+// Counter is a prometheus.Counter recorded to the sinks as well.
+type Counter struct {
+	prometheus.Counter
+	metric *Metric
+}
+
+func newCounter(opts prometheus.CounterOpts) *Counter {
+	return &Counter{prometheus.NewCounter(opts), counterMetric(opts, nil)}
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add adds delta, which must not be negative, to the counter.
+func (c *Counter) Add(delta float64) {
+	withSinks(c.Counter, c.metric, nil).Add(delta)
+}
+
+// Histogram is a prometheus.Histogram recorded to the sinks as well.
+type Histogram struct {
+	prometheus.Histogram
+	metric *Metric
+}
+
+func newHistogram(opts prometheus.HistogramOpts) *Histogram {
+	return &Histogram{prometheus.NewHistogram(opts), histogramMetric(opts, nil)}
+}
+
+// Observe adds value to the histogram.
+func (h *Histogram) Observe(value float64) {
+	observeWithSinks(h.Histogram, h.metric, nil).Observe(value)
+}
+
+// Pusher pushes the sinks on an interval. A failed push is counted in
+// SinkErrors and logged, at most once a minute per sink; it never reaches
+// the admissions, which only ever buffer.
+type Pusher struct {
+	log      logr.Logger
+	interval time.Duration
+	timeout  time.Duration
+	sinks    []Sink
+	logs     []*rate.Sometimes // by sink
+}
+
+// NewPusher returns a Pusher of sinks, pushing every interval, each push
+// bounded by timeout.
+func NewPusher(log logr.Logger, interval, timeout time.Duration, sinks ...Sink) *Pusher {
+	logs := make([]*rate.Sometimes, len(sinks))
+	for i := range logs {
+		logs[i] = &rate.Sometimes{First: 1, Interval: time.Minute}
+	}
+	return &Pusher{log: log, interval: interval, timeout: timeout, sinks: sinks, logs: logs}
+}
+
+// Run pushes every interval until stop is closed; Flush pushes what the
+// last admissions recorded after that.
+func (p *Pusher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+			p.Flush(ctx)
+			cancel()
+		}
+	}
+}
+
+// Flush pushes every sink once.
+func (p *Pusher) Flush(ctx context.Context) {
+	for i, sink := range p.sinks {
+		if err := sink.Push(ctx); err != nil {
+			SinkErrors.WithLabelValues(sink.Name()).Inc()
+			p.logs[i].Do(func() {
+				p.log.Error(err, "Failed to push metrics, further failures are logged at most once a minute", "sink", sink.Name())
+			})
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/funcr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+)
+
+// setSinks records the metrics to sinks for the test.
+func setSinks(t *testing.T, sinks ...Sink) {
+	t.Helper()
+	SetSinks(sinks...)
+	t.Cleanup(func() { SetSinks() })
+}
+
+// statsdServer is a local StatsD server, reading the datagrams as they
+// come so that none is lost to a full socket buffer.
+type statsdServer struct {
+	conn      net.PacketConn
+	datagramC chan string
+}
+
+func newStatsDServer(t *testing.T) *statsdServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &statsdServer{conn: conn, datagramC: make(chan string, 2*statsdMaxSamples)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			s.datagramC <- string(buf[:n])
+		}
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	return s
+}
+
+// datagrams returns the datagrams received until none came for a while.
+func (s *statsdServer) datagrams(t *testing.T) []string {
+	t.Helper()
+	var datagrams []string
+	for {
+		select {
+		case datagram := <-s.datagramC:
+			datagrams = append(datagrams, datagram)
+		case <-time.After(200 * time.Millisecond):
+			return datagrams
+		}
+	}
+}
+
+// lines returns the lines of the datagrams received, sorted.
+func (s *statsdServer) lines(t *testing.T) []string {
+	t.Helper()
+	var lines []string
+	for _, datagram := range s.datagrams(t) {
+		lines = append(lines, strings.Split(datagram, "\n")...)
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+// The counters and histograms recorded, bounded labels and all, are sent
+// to StatsD prefixed: the increments summed, the observations one by one.
+func TestStatsD(t *testing.T) {
+	setCardinality(t, CardinalityConfig{MaxValues: 2})
+	server := newStatsDServer(t)
+	config := DefaultStatsD()
+	config.Address, config.Prefix = server.conn.LocalAddr().String(), "edge"
+	sink, err := NewStatsD(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setSinks(t, sink)
+
+	counter := newCounterVec(prometheus.CounterOpts{Name: "test_statsd_total", Help: "test"}, []string{"namespace"})
+	counter.WithLabelValues("apps").Inc()
+	counter.With(prometheus.Labels{"namespace": "apps"}).Add(2)
+	counter.WithLabelValues("a|b,c").Inc()
+	counter.WithLabelValues("over-the-cap").Inc()
+	latency := newHistogramVec(prometheus.HistogramOpts{Name: "test_statsd_seconds", Help: "test"}, []string{"path"})
+	latency.WithLabelValues("/mutate").Observe(0.25)
+	latency.WithLabelValues("/mutate").Observe(0.004)
+	size := newHistogram(prometheus.HistogramOpts{Name: "test_statsd_bytes", Help: "test"})
+	size.Observe(512)
+	plain := newCounter(prometheus.CounterOpts{Name: "test_statsd_plain_total", Help: "test"})
+	plain.Inc()
+
+	if got := testutil.ToFloat64(counter.WithLabelValues("apps")); got != 3 {
+		t.Errorf("Prometheus counted %v, want 3", got)
+	}
+	if err := sink.Push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"edge.test_statsd_bytes:512|h",
+		"edge.test_statsd_plain_total:1|c",
+		"edge.test_statsd_seconds:250|ms|#path:/mutate",
+		"edge.test_statsd_seconds:4|ms|#path:/mutate",
+		"edge.test_statsd_total:1|c|#namespace:a_b_c",
+		"edge.test_statsd_total:1|c|#namespace:other",
+		"edge.test_statsd_total:3|c|#namespace:apps",
+	}
+	if got := server.lines(t); !slices.Equal(got, want) {
+		t.Errorf("lines\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// only what was recorded since is sent again
+	if err := sink.Push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.datagrams(t); len(got) != 0 {
+		t.Errorf("nothing recorded, sent %q", got)
+	}
+	plain.Add(2)
+	if err := sink.Push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.lines(t); !slices.Equal(got, []string{"edge.test_statsd_plain_total:2|c"}) {
+		t.Errorf("sent %q, want the increments since", got)
+	}
+}
+
+// The lines are packed in datagrams of at most MaxPacketSize; the
+// observations over the buffer are dropped and reported by the push.
+func TestStatsDPackets(t *testing.T) {
+	server := newStatsDServer(t)
+	config := DefaultStatsD()
+	config.Address, config.MaxPacketSize = server.conn.LocalAddr().String(), 64
+	sink, err := NewStatsD(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := &Metric{Name: "test_packets_total", Labels: []string{"n"}}
+	for i := range 20 {
+		sink.Add(metric, []string{fmt.Sprint(i)}, 1)
+	}
+	if err := sink.Push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	datagrams := server.datagrams(t)
+	lines := 0
+	for _, datagram := range datagrams {
+		if len(datagram) > 64 {
+			t.Errorf("datagram of %d bytes", len(datagram))
+		}
+		lines += strings.Count(datagram, "\n") + 1
+	}
+	if len(datagrams) < 2 || lines != 20 {
+		t.Errorf("%d lines in %d datagrams, want 20 in several", lines, len(datagrams))
+	}
+
+	histogram := &Metric{Name: "test_packets_seconds"}
+	for range statsdMaxSamples + 5 {
+		sink.Observe(histogram, nil, 0.001)
+	}
+	// counted on the buffer, the loopback may lose some of a burst this size
+	if len(sink.samples) != statsdMaxSamples || sink.dropped != 5 {
+		t.Errorf("%d observations buffered, %d dropped", len(sink.samples), sink.dropped)
+	}
+	if err := sink.Push(context.Background()); err == nil || !strings.Contains(err.Error(), "dropped 5 observations over the buffer of 10000") {
+		t.Errorf("push error %v, want the observations dropped", err)
+	}
+	if len(sink.samples) != 0 || sink.dropped != 0 {
+		t.Errorf("%d observations left buffered after the push, %d dropped", len(sink.samples), sink.dropped)
+	}
+}
+
+// otlpCollector is an OTLP/HTTP endpoint counting the export requests it
+// receives, or failing them with status.
+type otlpCollector struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	status      int
+	path        string
+	contentType string
+	exports     int
+}
+
+func newOTLPCollector(t *testing.T) *otlpCollector {
+	t.Helper()
+	c := &otlpCollector{status: http.StatusOK}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.path, c.contentType = r.URL.Path, r.Header.Get("Content-Type")
+		if c.status != http.StatusOK {
+			http.Error(w, "collector unavailable", c.status)
+			return
+		}
+		c.exports++
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *otlpCollector) setStatus(status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+}
+
+// collect returns the metrics reader holds, by name, and their resource.
+func collect(t *testing.T, reader *sdkmetric.ManualReader) (map[string]metricdata.Metrics, *resource.Resource) {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	if len(rm.ScopeMetrics) != 1 {
+		t.Fatalf("metrics %+v, want one scope", rm)
+	}
+	byName := map[string]metricdata.Metrics{}
+	for _, metric := range rm.ScopeMetrics[0].Metrics {
+		byName[metric.Name] = metric
+	}
+	return byName, rm.Resource
+}
+
+// attributeValue returns the value of key in set.
+func attributeValue(set attribute.Set, key string) string {
+	value, _ := set.Value(attribute.Key(key))
+	return value.AsString()
+}
+
+// The counters are recorded as cumulative sums and the histograms as
+// explicit bucket histograms, by label values, the totals since start, and
+// exported to the endpoint on Push.
+func TestOTLP(t *testing.T) {
+	collector := newOTLPCollector(t)
+	sink, err := NewOTLP(collector.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setSinks(t, sink)
+
+	counter := newCounterVec(prometheus.CounterOpts{Name: "test_otlp_total", Help: "Test counter."}, []string{"result"})
+	counter.WithLabelValues("patched").Add(2)
+	counter.WithLabelValues("skipped").Inc()
+	latency := newHistogramVec(prometheus.HistogramOpts{Name: "test_otlp_seconds", Help: "test", Buckets: []float64{0.1, 1}}, []string{"path"})
+	for _, value := range []float64{0.05, 0.1, 0.5, 3} {
+		latency.WithLabelValues("/mutate").Observe(value)
+	}
+	if err := sink.Push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if collector.exports != 1 || collector.path != "/v1/metrics" || collector.contentType != "application/x-protobuf" {
+		t.Errorf("%d exports to %q as %q, want one to /v1/metrics in protobuf", collector.exports, collector.path, collector.contentType)
+	}
+
+	metrics, res := collect(t, sink.reader)
+	if got := attributeValue(*res.Set(), string(semconv.ServiceNameKey)); got != "cert-manager-webhook" {
+		t.Errorf("service name %q", got)
+	}
+	sum, ok := metrics["test_otlp_total"].Data.(metricdata.Sum[float64])
+	if !ok || !sum.IsMonotonic || sum.Temporality != metricdata.CumulativeTemporality || len(sum.DataPoints) != 2 || metrics["test_otlp_total"].Description != "Test counter." {
+		t.Fatalf("counter %+v, want a cumulative sum of two points", metrics["test_otlp_total"])
+	}
+	for _, point := range sum.DataPoints {
+		if want := map[string]float64{"patched": 2, "skipped": 1}[attributeValue(point.Attributes, "result")]; point.Value != want {
+			t.Errorf("point %+v, want %v", point, want)
+		}
+	}
+	histogram, ok := metrics["test_otlp_seconds"].Data.(metricdata.Histogram[float64])
+	if !ok || len(histogram.DataPoints) != 1 {
+		t.Fatalf("histogram %+v, want one point", metrics["test_otlp_seconds"])
+	}
+	point := histogram.DataPoints[0]
+	if point.Count != 4 || point.Sum != 3.65 || !slices.Equal(point.BucketCounts, []uint64{2, 1, 1}) ||
+		!slices.Equal(point.Bounds, []float64{0.1, 1}) || attributeValue(point.Attributes, "path") != "/mutate" {
+		t.Errorf("histogram point %+v", point)
+	}
+
+	// a failed export loses nothing: the next carries the totals
+	collector.setStatus(http.StatusBadRequest)
+	counter.WithLabelValues("patched").Inc()
+	if err := sink.Push(context.Background()); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("push error %v, want the status", err)
+	}
+	collector.setStatus(http.StatusOK)
+	counter.WithLabelValues("patched").Inc()
+	if err := sink.Push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ = collect(t, sink.reader)
+	for _, point := range metrics["test_otlp_total"].Data.(metricdata.Sum[float64]).DataPoints {
+		if attributeValue(point.Attributes, "result") == "patched" && point.Value != 4 {
+			t.Errorf("patched total %v after the failed export, want 4", point.Value)
+		}
+	}
+}
+
+func TestNewOTLP(t *testing.T) {
+	for endpoint, want := range map[string]string{
+		"http://collector:4318":             "http://collector:4318/v1/metrics",
+		"https://collector:4318/":           "https://collector:4318/v1/metrics",
+		"https://collector/otlp/v1/metrics": "https://collector/otlp/v1/metrics",
+	} {
+		sink, err := NewOTLP(endpoint)
+		if err != nil || sink.endpoint != want {
+			t.Errorf("%q: endpoint %v, %v, want %q", endpoint, sink, err, want)
+		}
+	}
+	for _, endpoint := range []string{"collector:4318", "grpc://collector:4317", "http://[::1"} {
+		if _, err := NewOTLP(endpoint); err == nil {
+			t.Errorf("%q accepted", endpoint)
+		}
+	}
+}
+
+// failingSink is a Sink whose pushes fail, counting what it was given.
+type failingSink struct {
+	mu     sync.Mutex
+	added  float64
+	pushes int
+}
+
+func (s *failingSink) Name() string { return "failing" }
+
+func (s *failingSink) Add(_ *Metric, _ []string, delta float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.added += delta
+}
+
+func (s *failingSink) Observe(*Metric, []string, float64) {}
+
+func (s *failingSink) Push(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pushes++
+	return errors.New("collector unreachable")
+}
+
+// A failing sink leaves the recording alone; its failures are counted and
+// logged once a minute, the other sinks still pushed.
+func TestPusherFailures(t *testing.T) {
+	server := newStatsDServer(t)
+	config := DefaultStatsD()
+	config.Address = server.conn.LocalAddr().String()
+	statsd, err := NewStatsD(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := &failingSink{}
+	setSinks(t, failing, statsd)
+
+	var mu sync.Mutex
+	var logged []string
+	log := funcr.New(func(_, args string) {
+		mu.Lock()
+		defer mu.Unlock()
+		logged = append(logged, args)
+	}, funcr.Options{})
+	pusher := NewPusher(log, time.Millisecond, time.Second, failing, statsd)
+	errorsBefore := testutil.ToFloat64(SinkErrors.WithLabelValues("failing"))
+
+	counter := newCounterVec(prometheus.CounterOpts{Name: "test_pusher_total", Help: "test"}, []string{"result"})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pusher.Run(stop)
+	}()
+	for range 100 {
+		counter.WithLabelValues("patched").Inc()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(SinkErrors.WithLabelValues("failing"))-errorsBefore < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-done
+	pusher.Flush(context.Background())
+
+	if got := testutil.ToFloat64(counter.WithLabelValues("patched")); got != 100 {
+		t.Errorf("Prometheus counted %v, want 100", got)
+	}
+	failing.mu.Lock()
+	if failing.added != 100 || failing.pushes < 4 {
+		t.Errorf("failing sink given %v in %d pushes", failing.added, failing.pushes)
+	}
+	if got := testutil.ToFloat64(SinkErrors.WithLabelValues("failing")) - errorsBefore; got != float64(failing.pushes) {
+		t.Errorf("%v sink errors, want one per push, %d", got, failing.pushes)
+	}
+	failing.mu.Unlock()
+	mu.Lock()
+	if len(logged) != 1 || !strings.Contains(logged[0], `"sink"="failing"`) || !strings.Contains(logged[0], "collector unreachable") {
+		t.Errorf("logged %q, want the first failure only", logged)
+	}
+	mu.Unlock()
+
+	total := 0.0
+	for _, line := range server.lines(t) {
+		var n float64
+		if _, err := fmt.Sscanf(line, "test_pusher_total:%g|c|#result:patched", &n); err != nil {
+			t.Errorf("line %q", line)
+		}
+		total += n
+	}
+	if total != 100 {
+		t.Errorf("StatsD sent %v in all, want 100", total)
+	}
+}
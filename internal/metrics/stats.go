@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxStatsNamespaces bounds the namespaces tracked for mutation counts;
+// further ones are counted under "other".
+const maxStatsNamespaces = 1000
+
+// stats is the in-process accounting behind the /stats summary. It is fed
+// by the same Observe functions as the Prometheus collectors.
+var stats = struct {
+	sync.Mutex
+	started    time.Time
+	results    map[string]uint64
+	namespaces map[string]uint64
+	skips      map[string]uint64
+	lastError  *ErrorRecord
+	generation uint64
+}{
+	started:    time.Now(),
+	results:    map[string]uint64{},
+	namespaces: map[string]uint64{},
+	skips:      map[string]uint64{},
+}
+
+// ErrorRecord is the last admission error seen.
+type ErrorRecord struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// NamespaceCount is the number of mutations in one namespace.
+type NamespaceCount struct {
+	Namespace string `json:"namespace"`
+	Mutations uint64 `json:"mutations"`
+}
+
+// Summary is a point-in-time copy of the activity since start.
+type Summary struct {
+	Started     time.Time         `json:"started"`
+	Uptime      string            `json:"uptime"`
+	Requests    map[string]uint64 `json:"requests"`
+	TopMutated  []NamespaceCount  `json:"topMutatedNamespaces"`
+	SkipReasons map[string]uint64 `json:"skipReasons"`
+	LastError   *ErrorRecord      `json:"lastError,omitempty"`
+	Generation  uint64            `json:"configGeneration"`
+}
+
+// ObserveMutation counts a mutation in namespace.
+func ObserveMutation(namespace string) {
+	stats.Lock()
+	defer stats.Unlock()
+	if _, ok := stats.namespaces[namespace]; !ok && len(stats.namespaces) >= maxStatsNamespaces {
+		namespace = otherLabel
+	}
+	stats.namespaces[namespace]++
+}
+
+// ObserveSkip counts an admission passed through unmodified for reason.
+func ObserveSkip(reason string) {
+	Skips.WithLabelValues(reason).Inc()
+	stats.Lock()
+	stats.skips[reason]++
+	stats.Unlock()
+}
+
+// ObserveError keeps err as the last admission error.
+func ObserveError(err error) {
+	stats.Lock()
+	stats.lastError = &ErrorRecord{Time: time.Now().UTC(), Message: err.Error()}
+	stats.Unlock()
+}
+
+// ObserveConfigLoad counts a load of the admission policy, at start or on
+// a reload.
+func ObserveConfigLoad() {
+	stats.Lock()
+	stats.generation++
+	ConfigGeneration.Set(float64(stats.generation))
+	stats.Unlock()
+}
+
+// Summarize returns the activity since start with the topN namespaces by
+// mutations.
+func Summarize(topN int) Summary {
+	stats.Lock()
+	defer stats.Unlock()
+
+	s := Summary{
+		Started:     stats.started,
+		Uptime:      time.Since(stats.started).Round(time.Second).String(),
+		Requests:    make(map[string]uint64, len(stats.results)),
+		SkipReasons: make(map[string]uint64, len(stats.skips)),
+		Generation:  stats.generation,
+	}
+	for result, n := range stats.results {
+		s.Requests[result] = n
+	}
+	for reason, n := range stats.skips {
+		s.SkipReasons[reason] = n
+	}
+	if stats.lastError != nil {
+		lastError := *stats.lastError
+		s.LastError = &lastError
+	}
+
+	for namespace, n := range stats.namespaces {
+		s.TopMutated = append(s.TopMutated, NamespaceCount{Namespace: namespace, Mutations: n})
+	}
+	sort.Slice(s.TopMutated, func(i, j int) bool {
+		if s.TopMutated[i].Mutations != s.TopMutated[j].Mutations {
+			return s.TopMutated[i].Mutations > s.TopMutated[j].Mutations
+		}
+		return s.TopMutated[i].Namespace < s.TopMutated[j].Namespace
+	})
+	if len(s.TopMutated) > topN {
+		s.TopMutated = s.TopMutated[:topN]
+	}
+	return s
+}
@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// statsdMaxSamples bounds the histogram observations buffered between two
+// pushes; further ones are dropped, and the push reports it.
+const statsdMaxSamples = 10000
+
+// StatsDConfig holds the settings of the StatsD sink.
+type StatsDConfig struct {
+	// Address is the host:port of the StatsD server, sent UDP datagrams.
+	Address string
+	// Prefix is prepended to the metric names, joined with a dot.
+	Prefix string
+	// MaxPacketSize bounds the datagrams; the default fits the usual
+	// Ethernet MTU.
+	MaxPacketSize int
+}
+
+// DefaultStatsD sends to a StatsD server on the node's loopback, e.g. a
+// sidecar agent.
+func DefaultStatsD() StatsDConfig {
+	return StatsDConfig{Address: "127.0.0.1:8125", MaxPacketSize: 1432}
+}
+
+// statsdKey is a counter of the StatsD sink, its name and tags formatted.
+type statsdKey struct {
+	name, tags string
+}
+
+// StatsD is a Sink sending the metrics to a StatsD server over UDP, labels
+// as DogStatsD tags. Counter increments are summed between pushes;
+// histogram observations are sent one by one, as timings in milliseconds
+// for the metrics in seconds, as histogram samples otherwise.
+type StatsD struct {
+	config StatsDConfig
+	conn   net.Conn
+
+	mu       sync.Mutex
+	counters map[statsdKey]float64
+	samples  []string // formatted lines
+	dropped  int
+}
+
+// NewStatsD returns a StatsD sink sending to config.Address.
+func NewStatsD(config StatsDConfig) (*StatsD, error) {
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("statsd address %q: %w", config.Address, err)
+	}
+	return &StatsD{config: config, conn: conn, counters: map[statsdKey]float64{}}, nil
+}
+
+// Name returns "statsd".
+func (s *StatsD) Name() string { return "statsd" }
+
+// Add sums delta into the counter until the next push.
+func (s *StatsD) Add(metric *Metric, values []string, delta float64) {
+	key := statsdKey{s.name(metric), statsdTags(metric.Labels, values)}
+	s.mu.Lock()
+	s.counters[key] += delta
+	s.mu.Unlock()
+}
+
+// Observe buffers value until the next push.
+func (s *StatsD) Observe(metric *Metric, values []string, value float64) {
+	kind := "h"
+	if strings.HasSuffix(metric.Name, "_seconds") {
+		kind, value = "ms", value*1000
+	}
+	line := s.name(metric) + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind + statsdTags(metric.Labels, values)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.samples) >= statsdMaxSamples {
+		s.dropped++
+		return
+	}
+	s.samples = append(s.samples, line)
+}
+
+// Push sends what was buffered since the last push, as many lines in a
+// datagram as fit.
+func (s *StatsD) Push(ctx context.Context) error {
+	s.mu.Lock()
+	counters, samples, dropped := s.counters, s.samples, s.dropped
+	s.counters, s.samples, s.dropped = make(map[statsdKey]float64, len(counters)), nil, 0
+	s.mu.Unlock()
+
+	lines := make([]string, 0, len(counters)+len(samples))
+	for key, delta := range counters {
+		lines = append(lines, key.name+":"+strconv.FormatFloat(delta, 'f', -1, 64)+"|c"+key.tags)
+	}
+	lines = append(lines, samples...)
+
+	var errs []error
+	if dropped > 0 {
+		errs = append(errs, fmt.Errorf("dropped %d observations over the buffer of %d", dropped, statsdMaxSamples))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.conn.SetWriteDeadline(deadline)
+	}
+	var packet strings.Builder
+	send := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := s.conn.Write([]byte(packet.String())); err != nil {
+			errs = append(errs, err)
+		}
+		packet.Reset()
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > s.config.MaxPacketSize {
+			send()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	send()
+	return errors.Join(errs...)
+}
+
+// name returns the StatsD name of metric.
+func (s *StatsD) name(metric *Metric) string {
+	if s.config.Prefix == "" {
+		return metric.Name
+	}
+	return s.config.Prefix + "." + metric.Name
+}
+
+// statsdTagValue strips the characters that delimit DogStatsD tags.
+var statsdTagValue = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_")
+
+// statsdTags formats the labels as DogStatsD tags, "|#label:value,...".
+func statsdTags(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var tags strings.Builder
+	tags.WriteString("|#")
+	for i, label := range labels {
+		if i > 0 {
+			tags.WriteByte(',')
+		}
+		tags.WriteString(label)
+		tags.WriteByte(':')
+		if i < len(values) {
+			tags.WriteString(statsdTagValue.Replace(values[i]))
+		}
+	}
+	return tags.String()
+}
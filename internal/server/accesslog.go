@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// requestInfo carries details learnt while handling a request back out to
+// the middleware, e.g. the admission UID once the review is decoded.
+type requestInfo struct {
+	uid    types.UID
+	review metav1.TypeMeta // of the decoded AdmissionReview, answered in
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// requestInfoFrom returns the request's info, or a throwaway one when the
+// request did not pass through the middleware.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// statusRecorder captures the status code and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// AccessLog logs one line per request. Successful requests are sampled,
+// logging one in every sampleEvery; failures are always logged.
+func AccessLog(log logr.Logger, sampleEvery uint64, next http.Handler) http.Handler {
+	var successes atomic.Uint64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{}
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r.WithContext(withRequestInfo(r.Context(), info)))
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status < http.StatusBadRequest && sampleEvery > 1 && successes.Add(1)%sampleEvery != 1 {
+			return
+		}
+
+		keysAndValues := []interface{}{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remoteAddr", r.RemoteAddr,
+			"status", status,
+			"bytes", rec.bytes,
+			"latency", time.Since(start).String(),
+		}
+		if id := requestIDFrom(r.Context()); id != "" {
+			keysAndValues = append(keysAndValues, "requestID", id)
+		}
+		if info.uid != "" {
+			keysAndValues = append(keysAndValues, "uid", info.uid)
+		}
+		log.Info("HTTP request", keysAndValues...)
+	})
+}
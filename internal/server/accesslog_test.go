@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// The access log line of each request carries the status the client got
+// and the request ID.
+func TestAccessLogStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+		uid         bool
+	}{
+		{name: "success", contentType: "application/json", status: http.StatusOK, uid: true},
+		{name: "client error", contentType: "text/plain", status: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.InfoLevel)
+			handler := RequestID(AccessLog(zapr.NewLogger(zap.New(core)), 1, http.HandlerFunc(newDefaultServer().serve)))
+			body, err := json.Marshal(secretReview(t, "tls", "apps"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			lines := logs.FilterMessage("HTTP request").All()
+			if len(lines) != 1 {
+				t.Fatalf("%d access log lines, want 1", len(lines))
+			}
+			fields := lines[0].ContextMap()
+			if id := rec.Header().Get(requestIDHeader); fields["requestID"] != id {
+				t.Errorf("logged request ID %v, echoed %q", fields["requestID"], id)
+			}
+			if fmt.Sprint(fields["status"]) != fmt.Sprint(tt.status) || rec.Code != tt.status {
+				t.Errorf("logged status %v, client got %d, want %d", fields["status"], rec.Code, tt.status)
+			}
+			if fields["bytes"] != int64(rec.Body.Len()) {
+				t.Errorf("logged %v bytes, client got %d", fields["bytes"], rec.Body.Len())
+			}
+			if _, ok := fields["uid"]; ok != tt.uid {
+				t.Errorf("uid logged: %v, want %v", fields["uid"], tt.uid)
+			}
+			for _, key := range []string{"method", "path", "remoteAddr", "latency", "requestID"} {
+				if _, ok := fields[key]; !ok {
+					t.Errorf("no %s: %v", key, fields)
+				}
+			}
+		})
+	}
+}
+
+// Successful requests are sampled, failed ones always logged.
+func TestAccessLogSampling(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	status := http.StatusOK
+	handler := AccessLog(zapr.NewLogger(zap.New(core)), 4, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	serve := func(n int) {
+		for i := 0; i < n; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+	}
+	serve(8)
+	if got := logs.TakeAll(); len(got) != 2 {
+		t.Errorf("%d of 8 successes logged, want 2", len(got))
+	}
+	status = http.StatusBadRequest
+	serve(3)
+	if got := logs.TakeAll(); len(got) != 3 {
+		t.Errorf("%d of 3 failures logged, want all", len(got))
+	}
+}
+
+// The access log line of a request whose handler panicked carries the
+// status of the recovery's answer.
+func TestAccessLogRecoveredPanic(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	handler := AccessLog(zapr.NewLogger(zap.New(core)), 1, recoverAdmission(logr.Discard(), true, nil,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestInfoFrom(r.Context()).uid = "4a5f4c0e"
+			panic("boom")
+		})))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/mutate", nil))
+
+	lines := logs.FilterMessage("HTTP request").All()
+	if len(lines) != 1 {
+		t.Fatalf("%d access log lines, want 1", len(lines))
+	}
+	fields := lines[0].ContextMap()
+	if fmt.Sprint(fields["status"]) != fmt.Sprint(http.StatusOK) || rec.Code != http.StatusOK {
+		t.Errorf("logged status %v, client got %d, want %d", fields["status"], rec.Code, http.StatusOK)
+	}
+	if fmt.Sprint(fields["uid"]) != "4a5f4c0e" {
+		t.Errorf("logged uid %v, want the request's", fields["uid"])
+	}
+}
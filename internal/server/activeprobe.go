@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// activeProbeSecretPrefix is the generated name prefix of the marker secret.
+const activeProbeSecretPrefix = "cert-sync-active-probe-"
+
+// ActiveProbeConfig holds the settings of the active probe.
+type ActiveProbeConfig struct {
+	// Namespace the marker secret is created in, dry-run; it must be one the
+	// webhook configuration and the policy mutate secrets of.
+	Namespace string
+	// Interval between probes.
+	Interval time.Duration
+	// Timeout of one probe.
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failed probes after
+	// which the readiness check fails.
+	FailureThreshold int
+	// SuccessThreshold is the number of consecutive successful probes after
+	// which a failing readiness check passes again.
+	SuccessThreshold int
+}
+
+// DefaultActiveProbe probes every minute, failing after three failures in a
+// row and recovering on the first success.
+func DefaultActiveProbe() ActiveProbeConfig {
+	return ActiveProbeConfig{
+		Namespace:        "default",
+		Interval:         time.Minute,
+		Timeout:          10 * time.Second,
+		FailureThreshold: 3,
+		SuccessThreshold: 1,
+	}
+}
+
+// ActiveProbe checks the path passive checks can't see, from the API server
+// to the webhook: it creates a marker cert-manager secret with a
+// server-side dry run, so the API server sends it through the webhook
+// configuration and the Service to a replica, and checks that the secret
+// it gets back carries the sync annotation and the managed-by marker. A
+// broken Service or a stale caBundle fails it, while /readyz would pass.
+// Nothing is persisted. The result of each probe is exported, and the
+// readiness check only flips after FailureThreshold failures, or
+// SuccessThreshold successes, in a row, so one blip doesn't flap readiness.
+type ActiveProbe struct {
+	log    logr.Logger
+	client kubernetes.Interface
+	config ActiveProbeConfig
+
+	mu        sync.RWMutex
+	failing   bool
+	failures  int
+	successes int
+	lastErr   error
+}
+
+func NewActiveProbe(log logr.Logger, client kubernetes.Interface, config ActiveProbeConfig) *ActiveProbe {
+	return &ActiveProbe{log: log, client: client, config: config}
+}
+
+// probe creates the marker secret, dry-run, and checks the webhook's
+// mutation in the answer.
+func (p *ActiveProbe) probe(ctx context.Context) error {
+	marker := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: activeProbeSecretPrefix,
+			Namespace:    p.config.Namespace,
+			Annotations:  map[string]string{mutator.CertManagerAnnotationKey: "cert-sync-active-probe"},
+		},
+		// the policy only mutates TLS secrets, which the API server
+		// accepts with the keys present, empty
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{corev1.TLSCertKey: {}, corev1.TLSPrivateKeyKey: {}},
+	}
+	created, err := p.client.CoreV1().Secrets(p.config.Namespace).Create(ctx, marker, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+	if err != nil {
+		return fmt.Errorf("dry-run create of the marker secret: %w", err)
+	}
+	if _, ok := created.Annotations[mutator.SyncAnnotationKey]; !ok {
+		return fmt.Errorf("the marker secret came back without %s, the API server didn't reach the webhook", mutator.SyncAnnotationKey)
+	}
+	if created.Annotations[mutator.ManagedByAnnotationKey] != mutator.ManagedByValue {
+		return fmt.Errorf("the marker secret came back without %s", mutator.ManagedByAnnotationKey)
+	}
+	return nil
+}
+
+// record counts the result of a probe towards the thresholds.
+func (p *ActiveProbe) record(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastErr = err
+	if err != nil {
+		metrics.ActiveProbeSuccess.Set(0)
+		metrics.ActiveProbes.WithLabelValues("failed").Inc()
+		p.successes = 0
+		p.failures++
+		if !p.failing && p.failures >= p.config.FailureThreshold {
+			p.failing = true
+			p.log.Info("Active probe failing, marking the webhook unready", "failures", p.failures, "error", err.Error())
+		}
+		return
+	}
+	metrics.ActiveProbeSuccess.Set(1)
+	metrics.ActiveProbes.WithLabelValues("passed").Inc()
+	p.failures = 0
+	p.successes++
+	if p.failing && p.successes >= p.config.SuccessThreshold {
+		p.failing = false
+		p.log.Info("Active probe passing again", "successes", p.successes)
+	}
+}
+
+// Ready is the readiness check of the probe: it fails once the probe has
+// failed FailureThreshold times in a row, until it succeeds again
+// SuccessThreshold times in a row. It passes before the first probe.
+func (p *ActiveProbe) Ready(time.Time) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.failing {
+		return nil
+	}
+	if p.lastErr == nil {
+		return errors.New("recovering, waiting for more successful probes")
+	}
+	return fmt.Errorf("%d probes failed in a row: %w", p.failures, p.lastErr)
+}
+
+// Watch probes every interval until stop is closed.
+func (p *ActiveProbe) Watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+		err := p.probe(ctx)
+		cancel()
+		if err != nil {
+			p.log.V(1).Info("Active probe failed", "error", err.Error())
+		}
+		p.record(err)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
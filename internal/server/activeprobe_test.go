@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// probeAPIServer returns a fake clientset answering the dry-run creates of
+// secrets as the API server would with the webhook's handler registered,
+// sending them through it, or with answer when handler is nil. The creates
+// that aren't dry runs fail.
+func probeAPIServer(t *testing.T, handler http.Handler, answer func(*corev1.Secret) (*corev1.Secret, error)) *fake.Clientset {
+	t.Helper()
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		create := action.(k8stesting.CreateActionImpl)
+		if dryRun := create.CreateOptions.DryRun; len(dryRun) != 1 || dryRun[0] != metav1.DryRunAll {
+			return true, nil, errors.New("the marker secret isn't a dry run")
+		}
+		secret := create.GetObject().(*corev1.Secret).DeepCopy()
+		secret.Name = secret.GenerateName + "x7k2p"
+		if handler == nil {
+			return true, secret, nil
+		}
+		if answer != nil {
+			patched, err := answer(secret)
+			return true, patched, err
+		}
+		review, err := FixtureReview(secret, v1beta1.Create, true)
+		if err != nil {
+			return true, nil, err
+		}
+		response := admitWith(t, handler, review)
+		if len(response.Patch) == 0 {
+			return true, secret, nil
+		}
+		patched, err := ApplyPatch(review.Request.Object.Raw, response.Patch)
+		return true, patched, err
+	})
+	return client
+}
+
+// The probe round-trips the dry-run marker secret through the webhook, and
+// fails when it comes back unmutated or the API server fails it.
+func TestActiveProbe(t *testing.T) {
+	handler := newTestHandler(t, DefaultConfig())
+	for _, tt := range []struct {
+		name   string
+		client *fake.Clientset
+		want   string // in the error, passing when empty
+	}{
+		{name: "mutated", client: probeAPIServer(t, handler, nil)},
+		{name: "webhook not reached", client: probeAPIServer(t, nil, nil), want: "the API server didn't reach the webhook"},
+		{name: "no managed-by marker", client: probeAPIServer(t, handler, func(secret *corev1.Secret) (*corev1.Secret, error) {
+			secret.Annotations[mutator.SyncAnnotationKey] = "true"
+			return secret, nil
+		}), want: "without cert-sync.bygui86.io/managed-by"},
+		{name: "API server error", client: probeAPIServer(t, handler, func(*corev1.Secret) (*corev1.Secret, error) {
+			return nil, errors.New(`Internal error occurred: failed calling webhook "cert-sync.bygui86.io": x509: certificate signed by unknown authority`)
+		}), want: "dry-run create of the marker secret: Internal error occurred"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewActiveProbe(logr.Discard(), tt.client, DefaultActiveProbe())
+			err := p.probe(context.Background())
+			if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+			secrets, err := tt.client.CoreV1().Secrets("default").List(context.Background(), metav1.ListOptions{})
+			if err != nil || len(secrets.Items) != 0 {
+				t.Errorf("secrets persisted: %v, %v", secrets, err)
+			}
+		})
+	}
+}
+
+// Readiness flips after FailureThreshold failures in a row and back after
+// SuccessThreshold successes in a row; the gauge follows each probe.
+func TestActiveProbeHysteresis(t *testing.T) {
+	config := DefaultActiveProbe()
+	config.FailureThreshold, config.SuccessThreshold = 3, 2
+	p := NewActiveProbe(logr.Discard(), nil, config)
+	if err := p.Ready(time.Now()); err != nil {
+		t.Fatalf("not ready before the first probe: %v", err)
+	}
+	blip := errors.New("blip")
+	failedBefore := testutil.ToFloat64(metrics.ActiveProbes.WithLabelValues("failed"))
+	passedBefore := testutil.ToFloat64(metrics.ActiveProbes.WithLabelValues("passed"))
+	for i, step := range []struct {
+		err   error
+		ready bool
+		gauge float64
+	}{
+		{err: blip, ready: true}, {err: blip, ready: true},
+		{ready: true, gauge: 1}, // the failures in a row are reset
+		{err: blip, ready: true}, {err: blip, ready: true},
+		{err: blip, ready: false}, // the third in a row
+		{ready: false, gauge: 1},  // recovering
+		{err: blip, ready: false}, // the successes in a row are reset
+		{ready: false, gauge: 1},
+		{ready: true, gauge: 1}, // the second in a row
+	} {
+		p.record(step.err)
+		err := p.Ready(time.Now())
+		if (err == nil) != step.ready {
+			t.Errorf("probe %d: ready %v (%v), want %v", i, err == nil, err, step.ready)
+		}
+		if got := testutil.ToFloat64(metrics.ActiveProbeSuccess); got != step.gauge {
+			t.Errorf("probe %d: gauge %v, want %v", i, got, step.gauge)
+		}
+		if err != nil && step.err != nil && !errors.Is(err, blip) {
+			t.Errorf("probe %d: readiness error %v doesn't wrap the probe's", i, err)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.ActiveProbes.WithLabelValues("failed")) - failedBefore; got != 6 {
+		t.Errorf("%v failed probes counted, want 6", got)
+	}
+	if got := testutil.ToFloat64(metrics.ActiveProbes.WithLabelValues("passed")) - passedBefore; got != 4 {
+		t.Errorf("%v passed probes counted, want 4", got)
+	}
+}
+
+// Watch probes at once and every interval until stopped.
+func TestActiveProbeWatch(t *testing.T) {
+	client := probeAPIServer(t, nil, nil)
+	config := DefaultActiveProbe()
+	config.Interval, config.FailureThreshold = time.Millisecond, 2
+	p := NewActiveProbe(logr.Discard(), client, config)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Watch(stop)
+	}()
+	waitFor(t, func() bool { return p.Ready(time.Now()) != nil })
+	close(stop)
+	<-done
+	creates := 0
+	for _, action := range client.Actions() {
+		if action.Matches("create", "secrets") {
+			creates++
+		}
+	}
+	if creates < 2 {
+		t.Errorf("%d probes, want at least 2", creates)
+	}
+}
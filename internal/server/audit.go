@@ -0,0 +1,226 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+const (
+	decisionMutated = "mutated"
+	decisionSkipped = "skipped"
+	decisionError   = "error"
+	decisionDenied  = "denied"
+	decisionAllowed = "allowed"
+
+	// audit lines buffered before new ones are dropped
+	auditQueueSize = 1024
+)
+
+// auditEntry is one line of the audit log. It never carries secret data:
+// the patch is summarised as "op path" pairs without values.
+type auditEntry struct {
+	Timestamp   time.Time `json:"timestamp"`
+	RequestID   string    `json:"requestID,omitempty"`
+	UID         string    `json:"uid"`
+	Namespace   string    `json:"namespace"`
+	Name        string    `json:"name"`
+	Operation   string    `json:"operation"`
+	User        string    `json:"user"`
+	Decision    string    `json:"decision"`
+	SkipReason  string    `json:"skipReason,omitempty"`
+	MatchedRule string    `json:"matchedRule,omitempty"`
+	Cluster     string    `json:"cluster,omitempty"` // stamped on the secrets
+	Patch       []string  `json:"patch,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Replay      bool      `json:"replay,omitempty"` // the answer to an earlier attempt, sent again
+	DryRun      bool      `json:"dryRun,omitempty"`
+}
+
+func newAuditEntry(requestID string, req *v1beta1.AdmissionRequest, name string) auditEntry {
+	return auditEntry{
+		Timestamp: time.Now().UTC(),
+		RequestID: requestID,
+		UID:       string(req.UID),
+		Namespace: req.Namespace,
+		Name:      name,
+		Operation: string(req.Operation),
+		User:      req.UserInfo.Username,
+		DryRun:    req.DryRun != nil && *req.DryRun,
+	}
+}
+
+// patchSummary lists the operations of patch for an entry, nil when
+// neither the audit log nor the recent decisions record it.
+func (whsvr *WebhookServer) patchSummary(patch []mutator.PatchOperation) []string {
+	if whsvr.audit == nil && whsvr.recent == nil {
+		return nil
+	}
+	summary := make([]string, 0, len(patch))
+	for _, op := range patch {
+		summary = append(summary, op.Op+" "+op.Path)
+	}
+	return summary
+}
+
+// AuditLogger writes audit entries as JSON lines from a background goroutine.
+// Writes never block admissions: when the queue is full, entries are dropped
+// and counted. The file is rotated by size, and reopened on request so it
+// works with an external logrotate.
+type AuditLogger struct {
+	log        logr.Logger
+	path       string // "-" writes to stdout
+	maxSize    int64  // rotate once the file reaches this size, 0 disables
+	maxBackups int
+
+	entries chan auditEntry
+	reopen  chan struct{}
+	done    chan struct{}
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewAuditLogger(log logr.Logger, path string, maxSize int64, maxBackups int) (*AuditLogger, error) {
+	a := &AuditLogger{
+		log:        log,
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		entries:    make(chan auditEntry, auditQueueSize),
+		reopen:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	go a.run()
+	return a, nil
+}
+
+// record queues an entry. It is safe to call on a nil logger.
+func (a *AuditLogger) record(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	select {
+	case a.entries <- entry:
+	default:
+		metrics.AuditDropped.Inc()
+	}
+}
+
+// recordDecision accounts a decision in the audit log and the status.
+func (whsvr *WebhookServer) recordDecision(entry auditEntry) {
+	whsvr.audit.record(entry)
+	whsvr.status.observe(entry)
+	whsvr.recent.record(entry)
+}
+
+// Reopen asks the writer to reopen the file, e.g. after logrotate moved it.
+func (a *AuditLogger) Reopen() {
+	select {
+	case a.reopen <- struct{}{}:
+	default:
+	}
+}
+
+// Close flushes queued entries and closes the file.
+func (a *AuditLogger) Close() {
+	close(a.entries)
+	<-a.done
+}
+
+func (a *AuditLogger) open() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.path == "-" {
+		a.file = os.Stdout
+		return nil
+	}
+	if a.file != nil {
+		a.file.Close()
+	}
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, and starts a new file.
+func (a *AuditLogger) rotate() error {
+	for i := a.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if a.maxBackups > 0 {
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *AuditLogger) run() {
+	defer close(a.done)
+	for {
+		select {
+		case <-a.reopen:
+			if err := a.open(); err != nil {
+				a.log.Error(err, "Failed to reopen audit log", "path", a.path)
+			}
+		case entry, ok := <-a.entries:
+			if !ok {
+				a.mu.Lock()
+				if a.file != nil && a.file != os.Stdout {
+					a.file.Close()
+				}
+				a.mu.Unlock()
+				return
+			}
+			a.write(entry)
+		}
+	}
+}
+
+func (a *AuditLogger) write(entry auditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		a.log.Error(err, "Failed to encode audit entry")
+		return
+	}
+	line = append(line, '\n')
+
+	if a.path != "-" && a.maxSize > 0 && a.size+int64(len(line)) > a.maxSize && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			a.log.Error(err, "Failed to rotate audit log", "path", a.path)
+		}
+	}
+
+	a.mu.Lock()
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	a.mu.Unlock()
+	if err != nil {
+		metrics.AuditDropped.Inc()
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// auditLines returns the entries of the audit log at path, decoded as
+// generic objects so the test sees the field names written.
+func auditLines(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var lines []map[string]any
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("audit line %q isn't JSON: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// newTestAuditLogger returns an audit logger writing to a file of a
+// temporary directory, and the file.
+func newTestAuditLogger(t *testing.T, maxSize int64, maxBackups int) (*AuditLogger, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := NewAuditLogger(logr.Discard(), path, maxSize, maxBackups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return audit, path
+}
+
+// Each decision type is written as one line with the fields of its type.
+func TestAuditLineSchema(t *testing.T) {
+	common := []string{"timestamp", "requestID", "uid", "namespace", "name", "operation", "user", "decision"}
+	tests := []struct {
+		decision string
+		review   func(t *testing.T) *v1beta1.AdmissionReview
+		fields   []string // besides the common ones
+	}{
+		{
+			decision: decisionMutated,
+			review:   reviewOf("mutated", "apps"),
+			fields:   []string{"matchedRule", "patch"},
+		},
+		{
+			decision: decisionSkipped,
+			review:   reviewOf("skipped", metav1.NamespaceSystem),
+			fields:   []string{"skipReason"},
+		},
+		{
+			decision: decisionError,
+			review: func(t *testing.T) *v1beta1.AdmissionReview {
+				review := secretReview(t, "broken", "apps")
+				review.Request.Object.Raw = []byte(`{"apiVersion":"v1","kind":"Secret","metadata":"broken"}`)
+				return review
+			},
+			fields: []string{"error"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.decision, func(t *testing.T) {
+			audit, path := newTestAuditLogger(t, 0, 0)
+			review := tt.review(t)
+			admit(t, newDefaultServer(WithAuditLogger(audit)), review)
+			audit.Close()
+
+			lines := auditLines(t, path)
+			if len(lines) != 1 {
+				t.Fatalf("%d audit lines, want 1: %v", len(lines), lines)
+			}
+			line := lines[0]
+			if line["decision"] != tt.decision {
+				t.Errorf("decision %v, want %s", line["decision"], tt.decision)
+			}
+			if line["uid"] != string(review.Request.UID) {
+				t.Errorf("uid %v, want %s", line["uid"], review.Request.UID)
+			}
+			want := map[string]bool{}
+			for _, field := range append(common, tt.fields...) {
+				want[field] = true
+				if _, ok := line[field]; !ok {
+					t.Errorf("no %s field: %v", field, line)
+				}
+			}
+			for field := range line {
+				if !want[field] {
+					t.Errorf("unexpected field %s: %v", field, line)
+				}
+			}
+			if patch, ok := line["patch"].([]any); ok {
+				for _, op := range patch {
+					if fields := strings.Fields(fmt.Sprint(op)); len(fields) != 2 {
+						t.Errorf("patch summary %q, want \"op path\" without a value", op)
+					}
+				}
+			}
+		})
+	}
+}
+
+// reviewOf returns a function building the review of the creation of the
+// cert-manager secret name in namespace.
+func reviewOf(name, namespace string) func(t *testing.T) *v1beta1.AdmissionReview {
+	return func(t *testing.T) *v1beta1.AdmissionReview {
+		return secretReview(t, name, namespace)
+	}
+}
+
+// The cluster name stamped on the secrets is in the entries, when set.
+func TestAuditCluster(t *testing.T) {
+	for _, name := range []string{"eu-west-1", ""} {
+		audit, path := newTestAuditLogger(t, 0, 0)
+		config := DefaultConfig()
+		config.Mutator.ClusterName = name
+		handler := newTestHandler(t, config, WithAuditLogger(audit))
+		admitWith(t, handler, secretReview(t, "api-tls", "apps"))
+		audit.Close()
+
+		lines := auditLines(t, path)
+		if len(lines) != 1 {
+			t.Fatalf("%d audit lines, want 1", len(lines))
+		}
+		if cluster, ok := lines[0]["cluster"]; name != "" && cluster != name || name == "" && ok {
+			t.Errorf("cluster %q: entry has %v", name, cluster)
+		}
+	}
+}
+
+func TestAuditRotation(t *testing.T) {
+	line, err := json.Marshal(auditEntry{Decision: decisionMutated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two lines fit in a file
+	audit, path := newTestAuditLogger(t, int64(2*(len(line)+1)), 2)
+	for range 7 {
+		audit.record(auditEntry{Decision: decisionMutated})
+	}
+	audit.Close()
+
+	// 7 lines: 1 in the file, 2 in each of the backups kept, the 2 oldest
+	// rotated away
+	for file, want := range map[string]int{path: 1, path + ".1": 2, path + ".2": 2} {
+		if got := len(auditLines(t, file)); got != want {
+			t.Errorf("%s has %d lines, want %d", filepath.Base(file), got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more backups than kept: %v", err)
+	}
+}
+
+// Reopen starts a new file after logrotate moved the old one.
+func TestAuditReopen(t *testing.T) {
+	audit, path := newTestAuditLogger(t, 0, 0)
+	audit.record(auditEntry{Decision: decisionMutated})
+	waitFor(t, func() bool {
+		info, err := os.Stat(path)
+		return err == nil && info.Size() > 0
+	})
+	if err := os.Rename(path, path+".rotated"); err != nil {
+		t.Fatal(err)
+	}
+	audit.Reopen()
+	waitFor(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+	audit.record(auditEntry{Decision: decisionSkipped})
+	audit.Close()
+
+	if lines := auditLines(t, path+".rotated"); len(lines) != 1 || lines[0]["decision"] != decisionMutated {
+		t.Errorf("rotated file has %v, want the first entry", lines)
+	}
+	if lines := auditLines(t, path); len(lines) != 1 || lines[0]["decision"] != decisionSkipped {
+		t.Errorf("reopened file has %v, want the second entry", lines)
+	}
+}
+
+// A stalled writer never blocks admissions: entries past the queue are
+// dropped and counted.
+func TestAuditDropsWhenStalled(t *testing.T) {
+	audit, path := newTestAuditLogger(t, 0, 0)
+	before := testutil.ToFloat64(metrics.AuditDropped)
+	audit.mu.Lock() // the writer blocks on its first entry
+	for range auditQueueSize + 10 {
+		audit.record(auditEntry{Decision: decisionMutated})
+	}
+	dropped := testutil.ToFloat64(metrics.AuditDropped) - before
+	audit.mu.Unlock()
+	audit.Close()
+
+	// the writer may have taken one entry off the queue before stalling
+	if dropped < 9 || dropped > 10 {
+		t.Errorf("%v entries dropped, want 9 or 10", dropped)
+	}
+	if written := len(auditLines(t, path)); float64(written)+dropped != auditQueueSize+10 {
+		t.Errorf("%d entries written and %v dropped of %d", written, dropped, auditQueueSize+10)
+	}
+}
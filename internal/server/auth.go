@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// tokenReviewCacheTTL bounds how long a TokenReview verdict is reused.
+const tokenReviewCacheTTL = time.Minute
+
+// Authenticator verifies bearer tokens presented to the operational endpoints.
+type Authenticator interface {
+	authenticate(ctx context.Context, token string) (bool, error)
+}
+
+// staticTokenAuthenticator accepts a single token read from a file.
+type staticTokenAuthenticator struct {
+	token []byte
+}
+
+func NewStaticTokenAuthenticator(tokenFile string) (*staticTokenAuthenticator, error) {
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("token file %s is empty", tokenFile)
+	}
+	return &staticTokenAuthenticator{token: []byte(token)}, nil
+}
+
+func (a *staticTokenAuthenticator) authenticate(_ context.Context, token string) (bool, error) {
+	return subtle.ConstantTimeCompare(a.token, []byte(token)) == 1, nil
+}
+
+type tokenReviewResult struct {
+	authenticated bool
+	expires       time.Time
+}
+
+// tokenReviewAuthenticator verifies tokens against the cluster with a
+// TokenReview, caching verdicts briefly so scrapes don't hit the API server.
+type tokenReviewAuthenticator struct {
+	client kubernetes.Interface
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]tokenReviewResult
+}
+
+func NewTokenReviewAuthenticator(client kubernetes.Interface) *tokenReviewAuthenticator {
+	return &tokenReviewAuthenticator{
+		client: client,
+		cache:  map[[sha256.Size]byte]tokenReviewResult{},
+	}
+}
+
+func (a *tokenReviewAuthenticator) authenticate(ctx context.Context, token string) (bool, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	a.mu.Lock()
+	if result, ok := a.cache[key]; ok && now.Before(result.expires) {
+		a.mu.Unlock()
+		return result.authenticated, nil
+	}
+	a.mu.Unlock()
+
+	review, err := a.client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	a.mu.Lock()
+	for k, result := range a.cache {
+		if now.After(result.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = tokenReviewResult{authenticated: review.Status.Authenticated, expires: now.Add(tokenReviewCacheTTL)}
+	a.mu.Unlock()
+
+	return review.Status.Authenticated, nil
+}
+
+// RequireBearerToken wraps next so it is only served to requests carrying a
+// token accepted by auth. A nil auth leaves the handler open.
+func RequireBearerToken(log logr.Logger, auth Authenticator, next http.Handler) http.Handler {
+	if auth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="webhook"`)
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		ok, err := auth.authenticate(r.Context(), strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			log.Error(err, "Failed to verify bearer token", "path", r.URL.Path)
+			http.Error(w, "could not verify bearer token", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const validToken = "s3cr3t-scrape-token"
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+})
+
+// getWithToken serves GET /metrics through handler with the Authorization
+// header set to authorization, none when empty.
+func getWithToken(handler http.Handler, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// fakeTokenReviews returns a clientset authenticating validToken only, or
+// failing every review with err when not nil, and a count of the reviews.
+func fakeTokenReviews(err error) (*fake.Clientset, *int) {
+	client := fake.NewClientset()
+	reviews := new(int)
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		*reviews++
+		if err != nil {
+			return true, nil, err
+		}
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		review.Status.Authenticated = review.Spec.Token == validToken
+		return true, review, nil
+	})
+	return client, reviews
+}
+
+func TestRequireBearerToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte(validToken+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	static, err := NewStaticTokenAuthenticator(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := fakeTokenReviews(nil)
+	authenticators := map[string]Authenticator{
+		"static token": static,
+		"token review": NewTokenReviewAuthenticator(client),
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{name: "missing", want: http.StatusUnauthorized},
+		{name: "other scheme", authorization: "Basic dXNlcjpwYXNz", want: http.StatusUnauthorized},
+		{name: "invalid", authorization: "Bearer not-the-token", want: http.StatusUnauthorized},
+		{name: "valid", authorization: "Bearer " + validToken, want: http.StatusOK},
+	}
+	for name, auth := range authenticators {
+		handler := RequireBearerToken(logr.Discard(), auth, okHandler)
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				rec := getWithToken(handler, tt.authorization)
+				if rec.Code != tt.want {
+					t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+				}
+				if tt.authorization == "" && rec.Header().Get("WWW-Authenticate") == "" {
+					t.Error("no WWW-Authenticate challenge")
+				}
+			})
+		}
+	}
+}
+
+func TestRequireBearerTokenOpen(t *testing.T) {
+	if rec := getWithToken(RequireBearerToken(logr.Discard(), nil, okHandler), ""); rec.Code != http.StatusOK {
+		t.Errorf("status %d without an Authenticator, want the handler open", rec.Code)
+	}
+}
+
+func TestRequireBearerTokenReviewError(t *testing.T) {
+	client, _ := fakeTokenReviews(errors.New("API server unavailable"))
+	handler := RequireBearerToken(logr.Discard(), NewTokenReviewAuthenticator(client), okHandler)
+	if rec := getWithToken(handler, "Bearer "+validToken); rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d when the review fails, want 500", rec.Code)
+	}
+}
+
+// Verdicts are cached, so scrapes don't review the same token every time.
+func TestTokenReviewCache(t *testing.T) {
+	client, reviews := fakeTokenReviews(nil)
+	handler := RequireBearerToken(logr.Discard(), NewTokenReviewAuthenticator(client), okHandler)
+	for range 3 {
+		getWithToken(handler, "Bearer "+validToken)
+		getWithToken(handler, "Bearer not-the-token")
+	}
+	if *reviews != 2 {
+		t.Errorf("%d token reviews for 2 tokens, want the verdicts cached", *reviews)
+	}
+}
+
+func TestNewStaticTokenAuthenticatorEmptyFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte(" \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStaticTokenAuthenticator(tokenFile); err == nil {
+		t.Error("empty token file accepted")
+	}
+	if _, err := NewStaticTokenAuthenticator(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing token file accepted")
+	}
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/time/rate"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+const (
+	// backfillFieldManager owns the fields the backfill controller patches.
+	backfillFieldManager = "cert-manager-webhook-backfill"
+	// backfillMaxRetries is how often a secret whose patch failed is retried
+	// before waiting for its next change or resync.
+	backfillMaxRetries = 5
+)
+
+// Results of the secrets the backfill controller examines.
+const (
+	backfillPatched   = "patched"
+	backfillUnchanged = "unchanged"
+	backfillFailed    = "failed"
+	backfillDryRun    = "dry-run"
+	backfillConflict  = "conflict"
+	backfillFrozen    = skipFrozen
+)
+
+// BackfillConfig holds the settings of the backfill controller.
+type BackfillConfig struct {
+	// QPS and Burst limit the patches sent per second and at once.
+	QPS   float64
+	Burst int
+	// DryRun logs the patches instead of sending them.
+	DryRun bool
+	// EligibilityInterval is how often the eligibility gauges are computed
+	// from the secrets cache, never when zero.
+	EligibilityInterval time.Duration
+	// EligibilityTopNamespaces is the number of namespaces the gauges are
+	// labelled with, the others being summed as "other".
+	EligibilityTopNamespaces int
+}
+
+// BackfillController annotates the secrets that existed before the webhook
+// was installed, which it never saw at admission time. The elected leader
+// watches every secret and evaluates it with the mutator of the server's
+// current policy, the one admissions are decided by, so the two can't
+// disagree; secrets the webhook would have patched are patched, at a
+// limited rate. Its own patches go through the webhook like any update.
+// Secrets already holding one of the annotations with another value are
+// left to the drift scanner, which knows whose value it is. During a change
+// freeze nothing is patched, the secrets are requeued to the window's end.
+type BackfillController struct {
+	log     logr.Logger
+	client  kubernetes.Interface
+	whsvr   *WebhookServer
+	limiter *rate.Limiter // patches sent per second
+	config  BackfillConfig
+}
+
+// NewBackfillController returns a controller backfilling with the policy of
+// whsvr.
+func (whsvr *WebhookServer) NewBackfillController(log logr.Logger, client kubernetes.Interface, config BackfillConfig) *BackfillController {
+	return &BackfillController{
+		log:     log,
+		client:  client,
+		whsvr:   whsvr,
+		limiter: rate.NewLimiter(rate.Limit(config.QPS), config.Burst),
+		config:  config,
+	}
+}
+
+// Lead backfills until ctx is done.
+func (c *BackfillController) Lead(ctx context.Context) {
+	c.log.Info("Backfilling secrets", "dryRun", c.config.DryRun)
+	c.backfill(ctx)
+}
+
+// Stopped clears the eligibility gauges, which the new leader reports.
+func (c *BackfillController) Stopped() {
+	resetEligibility()
+}
+
+func (c *BackfillController) backfill(ctx context.Context) {
+	// the cache holds every secret of the cluster; their data is dropped
+	// unless a stage reads it
+	keepData := c.whsvr.policy.Load().mutator.NeedsData()
+	factory := informers.NewSharedInformerFactory(c.client, informerResync)
+	secrets := factory.Core().V1().Secrets()
+	informer := secrets.Informer()
+	_ = informer.SetTransform(func(obj interface{}) (interface{}, error) {
+		if secret, ok := obj.(*corev1.Secret); ok {
+			secret.ManagedFields = nil
+			if !keepData {
+				secret.Data, secret.StringData = nil, nil
+			}
+		}
+		return obj, nil
+	})
+
+	queue := workqueue.NewTypedRateLimitingQueueWithConfig(workqueue.DefaultTypedControllerRateLimiter[string](),
+		workqueue.TypedRateLimitingQueueConfig[string]{Name: "backfill"})
+	enqueue := func(obj interface{}) {
+		if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+			queue.Add(key)
+		}
+	}
+	_, _ = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+	})
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	go func() {
+		<-ctx.Done()
+		queue.ShutDown()
+	}()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return
+	}
+	c.log.Info("Secrets cache synced")
+	if c.config.EligibilityInterval > 0 {
+		go c.reportEligibility(ctx, secrets.Lister())
+	}
+
+	for c.processNext(ctx, queue, secrets.Lister()) {
+	}
+}
+
+func (c *BackfillController) processNext(ctx context.Context, queue workqueue.TypedRateLimitingInterface[string], lister corelisters.SecretLister) bool {
+	key, shutdown := queue.Get()
+	if shutdown {
+		return false
+	}
+	defer queue.Done(key)
+
+	result, err := c.sync(ctx, lister, key)
+	if result != "" {
+		metrics.BackfillSecrets.WithLabelValues(result).Inc()
+	}
+	if err == nil || ctx.Err() != nil {
+		queue.Forget(key)
+		return true
+	}
+	var frozen *frozenError
+	if errors.As(err, &frozen) {
+		// not a failure, the secret is retried when the window ends
+		queue.Forget(key)
+		queue.AddAfter(key, frozen.match.End.Sub(c.whsvr.clock.Now()))
+		return true
+	}
+	if queue.NumRequeues(key) < backfillMaxRetries {
+		c.log.Error(err, "Failed to backfill secret, retrying", "secret", key)
+		queue.AddRateLimited(key)
+		return true
+	}
+	c.log.Error(err, "Failed to backfill secret, giving up until it changes", "secret", key)
+	queue.Forget(key)
+	return true
+}
+
+// sync evaluates the secret of key and patches it when the webhook would
+// have. It returns the result to count, empty when the secret is gone.
+func (c *BackfillController) sync(ctx context.Context, lister corelisters.SecretLister, key string) (string, error) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return "", err
+	}
+	secret, err := lister.Secrets(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return backfillFailed, err
+	}
+
+	// the cached object is shared and the stages get their own copy
+	p := c.whsvr.policy.Load()
+	admission := mutator.AdmissionContext{Operation: string(v1beta1.Update), Secret: secret.DeepCopy(),
+		Namespaces: c.whsvr.informers.namespaceLister(), Certificates: c.whsvr.informers.certificateLister(),
+		Ingresses: c.whsvr.informers.ingressLister()}
+	decision, patch, err := p.mutator.Evaluate(ctx, admission)
+	if err != nil {
+		return backfillFailed, fmt.Errorf("evaluating: %w", err)
+	}
+	log := c.log.WithValues("namespace", namespace, "name", name)
+	if !decision.Mutate {
+		log.V(1).Info("Secret needs no backfill", "reason", decision.SkipReason)
+		return backfillUnchanged, nil
+	}
+	if conflicts := mutator.ConflictingAnnotations(secret.Annotations, decision.Annotations); len(conflicts) > 0 {
+		log.V(1).Info("Secret holds other annotation values, not backfilling", "keys", conflicts)
+		return backfillConflict, nil
+	}
+	patchBytes, err := p.mutator.MarshalPatch(patch)
+	if err != nil {
+		return backfillFailed, fmt.Errorf("creating patch: %w", err)
+	}
+	if c.config.DryRun {
+		log.Info("Would annotate pre-existing secret", "rule", decision.Rule, "patch", redactedPatch(patch))
+		return backfillDryRun, nil
+	}
+	if match, frozen := c.whsvr.frozen(p); frozen {
+		log.V(1).Info("Not backfilling during change freeze", "reason", skipFrozen, "window", match.Window,
+			"until", match.End.Format(time.RFC3339))
+		return backfillFrozen, &frozenError{match: match}
+	}
+
+	if err := c.limiter.Wait(ctx); err != nil {
+		return "", err
+	}
+	err = withRetry(ctx, opBackfillPatch, nil, func(ctx context.Context) error {
+		_, err := c.client.CoreV1().Secrets(namespace).Patch(ctx, name, types.JSONPatchType, patchBytes,
+			metav1.PatchOptions{FieldManager: backfillFieldManager})
+		return err
+	})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return backfillFailed, fmt.Errorf("patching: %w", err)
+	}
+	log.Info("Annotated pre-existing secret", "rule", decision.Rule, "patchOperations", len(patch))
+	return backfillPatched, nil
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// backfillCounts returns the secrets the backfill controller counted so
+// far, by result.
+func backfillCounts() map[string]float64 {
+	counts := map[string]float64{}
+	for _, result := range []string{backfillPatched, backfillUnchanged, backfillFailed, backfillDryRun, backfillConflict} {
+		counts[result] = testutil.ToFloat64(metrics.BackfillSecrets.WithLabelValues(result))
+	}
+	return counts
+}
+
+// runBackfill runs a backfill controller of the default policy over client
+// until the test ends.
+func runBackfill(t *testing.T, client *fake.Clientset, config BackfillConfig) {
+	t.Helper()
+	whsvr, err := NewWebhookServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		whsvr.NewBackfillController(logr.Discard(), client, config).Lead(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		whsvr.Close()
+	})
+}
+
+// preexisting returns the secrets created before the webhook was
+// installed: one to annotate, one skipped by the policy, one already
+// annotated with another value.
+func preexisting() []runtime.Object {
+	conflicting := FixtureSecret{Name: "conflict-tls", Namespace: "apps", DataSize: 16}.Build()
+	conflicting.Annotations[mutator.ManagedByAnnotationKey] = "someone-else"
+	return []runtime.Object{
+		FixtureSecret{Name: "api-tls", Namespace: "apps", DataSize: 16}.Build(),
+		FixtureSecret{Name: "api-tls", Namespace: metav1.NamespaceSystem, DataSize: 16}.Build(),
+		conflicting,
+	}
+}
+
+// Pre-existing secrets converge: the eligible one is patched with the
+// annotations the webhook would set, then found unchanged, and the others
+// are left alone.
+func TestBackfill(t *testing.T) {
+	client := fake.NewSimpleClientset(preexisting()...)
+	before := backfillCounts()
+	runBackfill(t, client, BackfillConfig{QPS: 100, Burst: 10})
+
+	waitFor(t, func() bool {
+		secret, err := client.CoreV1().Secrets("apps").Get(context.Background(), "api-tls", metav1.GetOptions{})
+		return err == nil && secret.Annotations[mutator.SyncAnnotationKey] == "true"
+	})
+	// the patch's update event brings the secret back, now up to date
+	waitFor(t, func() bool {
+		counts := backfillCounts()
+		return counts[backfillPatched]-before[backfillPatched] == 1 && counts[backfillUnchanged]-before[backfillUnchanged] >= 2 &&
+			counts[backfillConflict]-before[backfillConflict] == 1
+	})
+	secret, err := client.CoreV1().Secrets("apps").Get(context.Background(), "conflict-tls", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := secret.Annotations[mutator.SyncAnnotationKey]; ok {
+		t.Error("secret of another manager backfilled")
+	}
+	if secret, err := client.CoreV1().Secrets(metav1.NamespaceSystem).Get(context.Background(), "api-tls", metav1.GetOptions{}); err != nil || len(secret.Annotations) != 3 {
+		t.Errorf("skipped secret annotated %v: %v", secret.Annotations, err)
+	}
+	if failed := backfillCounts()[backfillFailed] - before[backfillFailed]; failed != 0 {
+		t.Errorf("%v secrets failed", failed)
+	}
+}
+
+// A dry run counts what it would patch and patches nothing.
+func TestBackfillDryRun(t *testing.T) {
+	client := fake.NewSimpleClientset(preexisting()...)
+	before := backfillCounts()
+	runBackfill(t, client, BackfillConfig{QPS: 100, Burst: 10, DryRun: true})
+
+	waitFor(t, func() bool { return backfillCounts()[backfillDryRun]-before[backfillDryRun] == 1 })
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "patch" {
+			t.Errorf("dry run sent %v", action)
+		}
+	}
+}
+
+// A patch the API server refuses is counted as failed and retried a few
+// times before the secret is left until it changes.
+func TestBackfillFailure(t *testing.T) {
+	client := fake.NewSimpleClientset(preexisting()...)
+	var patches atomic.Int32
+	client.PrependReactor("patch", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		patches.Add(1)
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "api-tls", nil)
+	})
+	before := backfillCounts()
+	runBackfill(t, client, BackfillConfig{QPS: 100, Burst: 10})
+
+	waitFor(t, func() bool { return backfillCounts()[backfillFailed]-before[backfillFailed] == backfillMaxRetries+1 })
+	time.Sleep(100 * time.Millisecond)
+	if failed := backfillCounts()[backfillFailed] - before[backfillFailed]; failed != backfillMaxRetries+1 {
+		t.Errorf("%v failures, want the secret given up after %d retries", failed, backfillMaxRetries)
+	}
+	// a refusal isn't worth retrying within a sync
+	if got := patches.Load(); got != backfillMaxRetries+1 {
+		t.Errorf("%d patches sent, want one per attempt", got)
+	}
+	if secret, _ := client.CoreV1().Secrets("apps").Get(context.Background(), "api-tls", metav1.GetOptions{}); secret.Annotations[mutator.SyncAnnotationKey] != "" {
+		t.Error("secret annotated despite the refused patch")
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// benchSecrets are the fixtures of BenchmarkAdmission: small and 1MiB
+// secrets, with cert-manager's annotations and without any.
+var benchSecrets = []FixtureSecret{
+	{Name: "small", Namespace: "apps", DataSize: 2048},
+	{Name: "small-bare", Namespace: "apps", DataSize: 2048, Bare: true},
+	{Name: "1MiB", Namespace: "apps", DataSize: 1 << 20},
+	{Name: "1MiB-bare", Namespace: "apps", DataSize: 1 << 20, Bare: true},
+}
+
+// BenchmarkAdmission measures each layer of an admission, as webhook bench
+// -local does: the handler with its HTTP round trip, with and without the
+// patch verification, the mutator decoding the secret, evaluating it and
+// encoding the patch, and a PatchBuilder setting the sync annotation. Compare runs before and after a change with
+// `make bench`.
+func BenchmarkAdmission(b *testing.B) {
+	config := DefaultConfig()
+	handler, err := NewHandler(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	unverified := config
+	unverified.SkipPatchVerification = true
+	unverifiedHandler, err := NewHandler(unverified)
+	if err != nil {
+		b.Fatal(err)
+	}
+	m, err := mutator.New(config.Mutator)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, fixture := range benchSecrets {
+		secret := fixture.Build()
+		review, err := FixtureReview(secret, v1beta1.Create, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		body, err := json.Marshal(review)
+		if err != nil {
+			b.Fatal(err)
+		}
+		raw := review.Request.Object.Raw
+
+		b.Run(fmt.Sprintf("handler/%s", fixture.Name), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for b.Loop() {
+				if rec := ServeLocal(context.Background(), handler, body); rec.Code != http.StatusOK {
+					b.Fatalf("answered %d: %s", rec.Code, rec.Body)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("handler-unverified/%s", fixture.Name), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for b.Loop() {
+				if rec := ServeLocal(context.Background(), unverifiedHandler, body); rec.Code != http.StatusOK {
+					b.Fatalf("answered %d: %s", rec.Code, rec.Body)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("mutator/%s", fixture.Name), func(b *testing.B) {
+			b.SetBytes(int64(len(raw)))
+			b.ReportAllocs()
+			for b.Loop() {
+				secret, err := m.DecodeSecret(raw)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, patch, err := m.Evaluate(context.Background(), mutator.AdmissionContext{Operation: "CREATE", Secret: secret})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := m.MarshalPatch(patch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("patch/%s", fixture.Name), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				patch := mutator.NewPatchBuilder(secret)
+				patch.AddAnnotation(mutator.SyncAnnotationKey, config.Mutator.NamespaceSelector)
+				ops, err := patch.Operations()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := mutator.MarshalPatch(ops); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBuffer is the capacity above which a buffer is dropped rather than
+// pooled, so that one large request doesn't keep its memory around.
+const maxPooledBuffer = 1 << 20
+
+// buffers holds the buffers request bodies are read into and responses
+// encoded in. A buffer is owned by one request and returned to the pool when
+// it is answered, so nothing read from or written to it may be kept past
+// that: whatever outlives the request must be copied out.
+var buffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+func getBuffer() *bytes.Buffer {
+	buf := buffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buffers.Put(buf)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Requests served at once through pooled buffers each get the answer to
+// their own review, and the recordings, written after the buffers are
+// reused, hold the review of their UID. Run with -race.
+func TestPooledBuffersConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRequestRecorder(logr.Discard(), dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestHandler(t, DefaultConfig(), WithRequestRecorder(recorder))
+
+	var (
+		mu    sync.Mutex
+		names = map[types.UID]string{} // secret name by review UID
+		wg    sync.WaitGroup
+	)
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				// sizes vary so buffers are reused for shorter and longer bodies
+				secret := FixtureSecret{Name: fmt.Sprintf("tls-%d-%d", worker, i), Namespace: "apps", DataSize: 16 << (i % 8)}.Build()
+				review, err := FixtureReview(secret, v1beta1.Create, false)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				names[review.Request.UID] = secret.Name
+				mu.Unlock()
+				body, err := json.Marshal(review)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var answer v1beta1.AdmissionReview
+				if err := json.Unmarshal(ServeLocal(context.Background(), handler, body).Body.Bytes(), &answer); err != nil {
+					t.Error(err)
+					return
+				}
+				if answer.Response == nil || answer.Response.UID != review.Request.UID {
+					t.Errorf("answer %+v to review %s", answer.Response, review.Request.UID)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	recorder.Close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("nothing recorded")
+	}
+	for _, entry := range entries {
+		raw, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var review v1beta1.AdmissionReview
+		if err := json.Unmarshal(raw, &review); err != nil {
+			t.Fatalf("recording %s: %v", entry.Name(), err)
+		}
+		uid := review.Request.UID
+		if !strings.Contains(entry.Name(), safeFileName(string(uid))) || review.Request.Name != names[uid] {
+			t.Errorf("recording %s holds secret %s of review %s, want %s", entry.Name(), review.Request.Name, uid, names[uid])
+		}
+	}
+}
+
+// BenchmarkServeReview serves a review through the handler, its body read
+// and its answer encoded in pooled buffers.
+func BenchmarkServeReview(b *testing.B) {
+	handler, err := NewHandler(DefaultConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	review, err := FixtureReview(FixtureSecret{Name: "tls", Namespace: "apps", DataSize: 2048}.Build(), v1beta1.Create, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			ServeLocal(context.Background(), handler, body)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ServeLocal(context.Background(), handler, body)
+			}
+		})
+	})
+}
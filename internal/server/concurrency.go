@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// ConcurrencyLimiter caps the number of admissions evaluated at once. A
+// request waits a short while for a slot and is shed when none frees up, so
+// that under a storm the admitted requests still finish within the API
+// server's timeout.
+type ConcurrencyLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+func NewConcurrencyLimiter(limit int, wait time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		slots: make(chan struct{}, limit),
+		wait:  wait,
+	}
+}
+
+// acquire reports whether a slot was obtained within the wait time. A nil
+// limiter always grants one.
+func (l *ConcurrencyLimiter) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	metrics.LoadShed.Inc()
+	return false
+}
+
+func (l *ConcurrencyLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+func (l *ConcurrencyLimiter) limit() int {
+	if l == nil {
+		return 0
+	}
+	return cap(l.slots)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	const wait = 20 * time.Millisecond
+	limiter := NewConcurrencyLimiter(2, wait)
+	if !limiter.acquire(context.Background()) || !limiter.acquire(context.Background()) {
+		t.Fatal("slot refused under the limit")
+	}
+
+	shed := testutil.ToFloat64(metrics.LoadShed)
+	start := time.Now()
+	if limiter.acquire(context.Background()) {
+		t.Fatal("slot granted over the limit")
+	}
+	if waited := time.Since(start); waited < wait {
+		t.Errorf("shed after %v, want a wait of %v", waited, wait)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if limiter.acquire(ctx) {
+		t.Fatal("slot granted to a cancelled request")
+	}
+	if got := testutil.ToFloat64(metrics.LoadShed) - shed; got != 2 {
+		t.Errorf("%v requests counted as shed, want 2", got)
+	}
+
+	// a slot released during the wait goes to the waiting request
+	go func() {
+		time.Sleep(wait / 4)
+		limiter.release()
+	}()
+	if !limiter.acquire(context.Background()) {
+		t.Error("slot released during the wait not granted")
+	}
+
+	var none *ConcurrencyLimiter
+	if !none.acquire(context.Background()) || none.limit() != 0 {
+		t.Error("nil limiter limits")
+	}
+	none.release()
+}
+
+// Under a storm with every slot taken, admissions are answered per the
+// failure policy within the queue timeout, and evaluated again once a slot
+// frees up.
+func TestConcurrencyStorm(t *testing.T) {
+	const (
+		limit    = 2
+		requests = 20
+		wait     = 10 * time.Millisecond
+	)
+	for _, failOpen := range []bool{true, false} {
+		t.Run(fmt.Sprintf("failOpen=%v", failOpen), func(t *testing.T) {
+			whsvr := newWebhookServer(Config{Mutator: mutator.DefaultConfig(), FailOpen: failOpen}, WithConcurrencyLimiter(NewConcurrencyLimiter(limit, wait)))
+			for range limit {
+				whsvr.concurrency.acquire(context.Background())
+			}
+			shedBefore := testutil.ToFloat64(metrics.LoadShed)
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var slowest time.Duration
+			for i := range requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					start := time.Now()
+					response := admit(t, whsvr, secretReview(t, fmt.Sprintf("tls-%d", i), "apps"))
+					elapsed := time.Since(start)
+
+					mu.Lock()
+					defer mu.Unlock()
+					slowest = max(slowest, elapsed)
+					switch {
+					case len(response.Patch) > 0:
+						t.Errorf("evaluated with every slot taken: %+v", response)
+					case failOpen && response.Allowed:
+					case !failOpen && !response.Allowed && response.Result != nil && response.Result.Code == http.StatusTooManyRequests:
+					default:
+						t.Errorf("unexpected answer %+v", response)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if got := testutil.ToFloat64(metrics.LoadShed) - shedBefore; got != requests {
+				t.Errorf("%v requests counted as shed, want %d", got, requests)
+			}
+			// the bound is loose for slow CI machines, an unbounded queue
+			// would never answer
+			if bound := wait + 500*time.Millisecond; slowest > bound {
+				t.Errorf("slowest request took %v, want under %v", slowest, bound)
+			}
+
+			whsvr.concurrency.release()
+			if response := admit(t, whsvr, secretReview(t, "tls", "apps")); len(response.Patch) == 0 {
+				t.Errorf("not evaluated with a free slot: %+v", response)
+			}
+		})
+	}
+}
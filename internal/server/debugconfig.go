@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// configResponse is the body of a /debug/config response.
+type configResponse struct {
+	ClusterProfile string       `json:"clusterProfile"`
+	ConfigHash     string       `json:"configHash"`
+	DecisionHash   string       `json:"decisionHash"` // recorded on the mutated secrets
+	Freeze         freezeStatus `json:"freeze"`
+	Config         Config       `json:"config"`
+}
+
+// ConfigHandler backs /debug/config, the settings of the active policy as
+// JSON, with the cluster profile they were picked by, their hashes and
+// whether a change freeze is active.
+func (whsvr *WebhookServer) ConfigHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p := whsvr.policy.Load()
+		if p == nil {
+			http.Error(w, "no policy loaded", http.StatusServiceUnavailable)
+			return
+		}
+		resp, err := json.MarshalIndent(configResponse{
+			ClusterProfile: p.config.ClusterProfile,
+			ConfigHash:     configHash(p.config),
+			DecisionHash:   mutator.ConfigHash(p.config.Mutator),
+			Freeze:         whsvr.freezeStatus(p),
+			Config:         p.config,
+		}, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(resp)
+	})
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// debugConfig returns the /debug/config response of whsvr.
+func debugConfig(t *testing.T, whsvr *WebhookServer) configResponse {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	whsvr.ConfigHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp configResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// The cluster profile of the active settings is shown, and follows a
+// reload with the hash.
+func TestConfigHandlerClusterProfile(t *testing.T) {
+	config := DefaultConfig()
+	config.ClusterProfile = "prod"
+	whsvr, err := NewWebhookServer(WithConfig(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer whsvr.Close()
+	prod := debugConfig(t, whsvr)
+	if prod.ClusterProfile != "prod" || prod.Config.ClusterProfile != "prod" || prod.ConfigHash == "" {
+		t.Errorf("profile %q in %+v", prod.ClusterProfile, prod)
+	}
+
+	config.ClusterProfile = "dev"
+	if err := whsvr.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	dev := debugConfig(t, whsvr)
+	if dev.ClusterProfile != "dev" || dev.ConfigHash == prod.ConfigHash {
+		t.Errorf("after the reload: profile %q, hash %s, was %s", dev.ClusterProfile, dev.ConfigHash, prod.ConfigHash)
+	}
+
+	rec := httptest.NewRecorder()
+	whsvr.ConfigHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/config", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status %d", rec.Code)
+	}
+}
+
+// The profile metric carries only the active profile.
+func TestClusterProfileMetric(t *testing.T) {
+	metrics.SetClusterProfile("prod")
+	metrics.SetClusterProfile("dev")
+	if got := testutil.CollectAndCount(metrics.ClusterProfile); got != 1 {
+		t.Errorf("%d profile series, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.ClusterProfile.WithLabelValues("dev")); got != 1 {
+		t.Errorf("dev profile %v, want 1", got)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// The API server may truncate warnings longer than maxWarningLength and
+// drops those past maxWarningsLength in all; the trace is cut to fit.
+const (
+	maxWarningLength  = 256
+	maxWarningsLength = 4096
+	traceWarningLabel = "debug: "
+)
+
+// traceDecision handles the trace of a secret annotated with
+// mutator.DebugAnnotationKey: the trace and the patch, its data values
+// elided, are logged at Info whatever the verbosity, and added to the
+// warnings of decision, as many steps as fit in the warnings the API server
+// returns. Nothing happens for other secrets.
+func traceDecision(log logr.Logger, decision *mutator.Decision, patch []mutator.PatchOperation) {
+	if decision.Trace == nil {
+		return
+	}
+	trace := decision.Trace
+	if len(patch) > 0 {
+		trace = append(trace[:len(trace):len(trace)], "patch: "+redactedPatch(patch).String())
+	}
+	log.Info("Decision trace", "annotation", mutator.DebugAnnotationKey, "trace", trace)
+
+	size := 0
+	for _, warning := range decision.Warnings {
+		size += len(warning)
+	}
+	// room for the note of a cut trace
+	const cutNote = traceWarningLabel + "trace cut, %d more steps in the webhook log"
+	for i, step := range trace {
+		warning := traceWarningLabel + step
+		if len(warning) > maxWarningLength {
+			warning = warning[:maxWarningLength-3] + "..."
+		}
+		if size+len(warning)+len(cutNote)+4 > maxWarningsLength {
+			decision.Warnings = append(decision.Warnings, fmt.Sprintf(cutNote, len(trace)-i))
+			return
+		}
+		size += len(warning)
+		decision.Warnings = append(decision.Warnings, warning)
+	}
+}
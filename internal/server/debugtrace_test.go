@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// debugWarnings returns the warnings holding the trace.
+func debugWarnings(warnings []string) []string {
+	var trace []string
+	for _, warning := range warnings {
+		if strings.HasPrefix(warning, traceWarningLabel) {
+			trace = append(trace, warning)
+		}
+	}
+	return trace
+}
+
+// A secret annotated for debugging has its trace logged at Info, however
+// quiet the logger, and returned in the warnings, with the patch; others
+// have neither.
+func TestDebugTraceAdmission(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	handler := newTestHandler(t, DefaultConfig(), WithLogger(zapr.NewLogger(zap.New(core))))
+
+	traced := FixtureSecret{Name: "api-tls", Namespace: "apps", DataSize: 16}.Build()
+	traced.Annotations[mutator.DebugAnnotationKey] = "true"
+	_, response := admitSecret(t, handler, traced)
+	warnings := debugWarnings(response.Warnings)
+	if len(warnings) == 0 || !strings.Contains(warnings[0], "evaluating CREATE of secret apps/api-tls") ||
+		!strings.HasPrefix(warnings[len(warnings)-1], traceWarningLabel+"patch: [") {
+		t.Errorf("warnings %q, want the trace ending with the patch", response.Warnings)
+	}
+	entries := logs.FilterMessage("Decision trace").All()
+	if len(entries) != 1 || entries[0].Level != zapcore.InfoLevel {
+		t.Fatalf("trace logged %d times, want once at Info", len(entries))
+	}
+	if trace, _ := entries[0].ContextMap()["trace"].([]interface{}); len(trace) != len(warnings) {
+		t.Errorf("%d steps logged, %d returned", len(trace), len(warnings))
+	}
+
+	// skipped secrets are traced too
+	skipped := FixtureSecret{Name: "api-tls", Namespace: "kube-system", DataSize: 16}.Build()
+	skipped.Annotations[mutator.DebugAnnotationKey] = "true"
+	if _, response := admitSecret(t, handler, skipped); !strings.Contains(strings.Join(response.Warnings, "\n"), "skipped: "+mutator.SkipIgnoredNamespace) {
+		t.Errorf("skipped secret warnings %q, want its trace", response.Warnings)
+	}
+
+	for _, value := range []string{"", "false"} {
+		secret := FixtureSecret{Name: "api-tls", Namespace: "apps", DataSize: 16}.Build()
+		if value != "" {
+			secret.Annotations[mutator.DebugAnnotationKey] = value
+		}
+		before := logs.FilterMessage("Decision trace").Len()
+		_, response := admitSecret(t, handler, secret)
+		if trace := debugWarnings(response.Warnings); len(trace) != 0 {
+			t.Errorf("debug annotation %q: trace %q returned", value, trace)
+		}
+		if logs.FilterMessage("Decision trace").Len() != before {
+			t.Errorf("debug annotation %q: trace logged", value)
+		}
+	}
+}
+
+// The steps are cut to the size of a warning, and the trace to the room
+// left in the warnings with a note; data values in the patch are elided.
+func TestTraceDecisionCap(t *testing.T) {
+	decision := mutator.Decision{Warnings: []string{"earlier warning"}}
+	for i := range 40 {
+		decision.Trace = append(decision.Trace, fmt.Sprintf("step %d %s", i, strings.Repeat("x", 300)))
+	}
+	patch := []mutator.PatchOperation{{Op: "add", Path: "/data/tls.key", Value: "private-key-material"}}
+	traceDecision(logr.Discard(), &decision, patch)
+
+	size := 0
+	for _, warning := range decision.Warnings {
+		size += len(warning)
+		if len(warning) > maxWarningLength {
+			t.Errorf("warning of %d bytes", len(warning))
+		}
+	}
+	if size > maxWarningsLength {
+		t.Errorf("warnings of %d bytes", size)
+	}
+	last := decision.Warnings[len(decision.Warnings)-1]
+	if decision.Warnings[0] != "earlier warning" || !strings.HasPrefix(last, traceWarningLabel+"trace cut, ") || !strings.HasSuffix(last, "more steps in the webhook log") {
+		t.Errorf("warnings start with %q and end with %q", decision.Warnings[0], last)
+	}
+	if !strings.HasSuffix(decision.Warnings[1], "...") {
+		t.Errorf("long step %q not cut", decision.Warnings[1])
+	}
+
+	// a short trace fits, the patch redacted
+	decision = mutator.Decision{Trace: []string{"rule default: matched"}}
+	traceDecision(logr.Discard(), &decision, patch)
+	if len(decision.Warnings) != 2 || !strings.Contains(decision.Warnings[1], "patch: ") || strings.Contains(decision.Warnings[1], "private-key-material") {
+		t.Errorf("warnings %q, want the step and the redacted patch", decision.Warnings)
+	}
+
+	// nothing without a trace
+	decision = mutator.Decision{}
+	traceDecision(logr.Discard(), &decision, patch)
+	if decision.Warnings != nil {
+		t.Errorf("untraced decision warned %q", decision.Warnings)
+	}
+}
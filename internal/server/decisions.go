@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/utils/clock"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// DecisionCache remembers the answers to recent admissions by request UID.
+// The API server sends a call that timed out again with the same UID; the
+// retry gets the answer of the first attempt instead of a second
+// evaluation, without its events and with its audit line marked as a
+// replay. A retry whose object has another resourceVersion is evaluated
+// afresh. Errored admissions aren't remembered, their retry may succeed.
+type DecisionCache struct {
+	ttl     time.Duration
+	entries *cache.LRUExpireCache
+}
+
+type cachedDecision struct {
+	resourceVersion string
+	response        *v1beta1.AdmissionResponse
+	result          string
+}
+
+// NewDecisionCache returns a cache of the last size decisions, each kept
+// for ttl.
+func NewDecisionCache(size int, ttl time.Duration) *DecisionCache {
+	return newDecisionCache(size, ttl, clock.RealClock{})
+}
+
+// newDecisionCache returns a cache whose entries expire by clk.
+func newDecisionCache(size int, ttl time.Duration, clk clock.PassiveClock) *DecisionCache {
+	return &DecisionCache{ttl: ttl, entries: cache.NewLRUExpireCacheWithClock(size, clk)}
+}
+
+// lookup returns a copy of the response remembered for req and its result.
+// A nil cache remembers nothing.
+func (c *DecisionCache) lookup(req *v1beta1.AdmissionRequest) (*v1beta1.AdmissionResponse, string, bool) {
+	if c == nil || req == nil {
+		return nil, "", false
+	}
+	value, ok := c.entries.Get(req.UID)
+	if !ok {
+		return nil, "", false
+	}
+	decision := value.(cachedDecision)
+	if decision.resourceVersion != objectResourceVersion(req) {
+		metrics.DecisionCacheBypasses.Inc()
+		return nil, "", false
+	}
+	metrics.DecisionCacheReplays.Inc()
+	return decision.response.DeepCopy(), decision.result, true
+}
+
+// store remembers the response to req, unless the admission errored.
+func (c *DecisionCache) store(req *v1beta1.AdmissionRequest, response *v1beta1.AdmissionResponse, result string) {
+	if c == nil || req == nil || response == nil || result == metrics.ResultErrored {
+		return
+	}
+	c.entries.Add(req.UID, cachedDecision{
+		resourceVersion: objectResourceVersion(req),
+		response:        response.DeepCopy(),
+		result:          result,
+	}, c.ttl)
+}
+
+// objectResourceVersion is the resourceVersion of the object of req, empty
+// on a create or when the object can't be read.
+func objectResourceVersion(req *v1beta1.AdmissionRequest) string {
+	var obj struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+	}
+	if len(req.Object.Raw) == 0 || json.Unmarshal(req.Object.Raw, &obj) != nil {
+		return ""
+	}
+	return obj.Metadata.ResourceVersion
+}
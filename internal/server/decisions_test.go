@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// A retried UID is answered from the cache, without an event and with its
+// audit line marked as a replay, until the entry expires, is evicted or
+// the object changed; errored admissions are evaluated again.
+func TestDecisionCache(t *testing.T) {
+	const ttl = 30 * time.Second
+	clock := clocktesting.NewFakeClock(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	events, fake := fakeEvents()
+	audit, path := newTestAuditLogger(t, 0, 0)
+	handler := newTestHandler(t, DefaultConfig(), WithDecisionCache(newDecisionCache(2, ttl, clock)),
+		WithEventRecorder(events), WithAuditLogger(audit))
+
+	review := func(uid, name, resourceVersion string) *v1beta1.AdmissionReview {
+		secret := FixtureSecret{Name: name, Namespace: "apps", DataSize: 16}.Build()
+		secret.ResourceVersion = resourceVersion
+		review, err := FixtureReview(secret, v1beta1.Update, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		review.Request.UID = types.UID(uid)
+		return review
+	}
+	var replayed []bool
+	send := func(review *v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, int) {
+		t.Helper()
+		response := admitWith(t, handler, review)
+		return response, len(recorded(fake))
+	}
+
+	first, events1 := send(review("a", "api-tls", "1"))
+	replayed = append(replayed, false)
+	replays, bypasses := testutil.ToFloat64(metrics.DecisionCacheReplays), testutil.ToFloat64(metrics.DecisionCacheBypasses)
+	if events1 != 1 || len(first.Patch) == 0 {
+		t.Fatalf("miss: %d events, patch %s", events1, first.Patch)
+	}
+
+	// hit
+	retry, events2 := send(review("a", "api-tls", "1"))
+	replayed = append(replayed, true)
+	if events2 != 0 || !bytes.Equal(retry.Patch, first.Patch) || retry.Allowed != first.Allowed {
+		t.Errorf("hit: %d events, patch %s, want %s replayed", events2, retry.Patch, first.Patch)
+	}
+	if got := testutil.ToFloat64(metrics.DecisionCacheReplays) - replays; got != 1 {
+		t.Errorf("hit: %v replays counted, want 1", got)
+	}
+
+	// another resourceVersion is a new object
+	if _, events := send(review("a", "api-tls", "2")); events != 1 {
+		t.Errorf("resourceVersion changed: %d events, want the admission evaluated", events)
+	}
+	replayed = append(replayed, false)
+	if got := testutil.ToFloat64(metrics.DecisionCacheBypasses) - bypasses; got != 1 {
+		t.Errorf("resourceVersion changed: %v bypasses counted, want 1", got)
+	}
+
+	// expired
+	send(review("b", "api-tls", "1"))
+	replayed = append(replayed, false)
+	clock.Step(ttl + time.Second)
+	if _, events := send(review("b", "api-tls", "1")); events != 1 {
+		t.Errorf("expired: %d events, want the admission evaluated", events)
+	}
+	replayed = append(replayed, false)
+
+	// evicted by newer UIDs
+	send(review("c", "api-tls", "1"))
+	send(review("d", "api-tls", "1"))
+	replayed = append(replayed, false, false)
+	if _, events := send(review("b", "api-tls", "1")); events != 1 {
+		t.Errorf("evicted: %d events, want the admission evaluated", events)
+	}
+	replayed = append(replayed, false)
+
+	// errored admissions aren't cached
+	broken := review("e", "api-tls", "1")
+	broken.Request.Object.Raw = []byte(`{"apiVersion":"v1","kind":"Secret","metadata":"broken"}`)
+	before := testutil.ToFloat64(metrics.DecisionCacheReplays)
+	send(broken)
+	send(broken)
+	replayed = append(replayed, false, false)
+	if testutil.ToFloat64(metrics.DecisionCacheReplays) != before {
+		t.Error("errored admission replayed")
+	}
+
+	audit.Close()
+	lines := auditLines(t, path)
+	if len(lines) != len(replayed) {
+		t.Fatalf("%d audit lines, want %d", len(lines), len(replayed))
+	}
+	for i, line := range lines {
+		if replay, _ := line["replay"].(bool); replay != replayed[i] {
+			t.Errorf("audit line %d marked replay %v, want %v: %v", i, replay, replayed[i], line)
+		}
+	}
+}
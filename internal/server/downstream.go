@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// ruleDownstream is the rule of admissions only the downstream webhook
+// patched.
+const ruleDownstream = "downstream"
+
+// largest downstream answer read
+const maxDownstreamResponseBytes = 3 << 20
+
+// DownstreamWebhook is another mutating webhook every admission is forwarded
+// to, so a legacy webhook can be retired behind this one. Its patch is
+// applied after ours.
+type DownstreamWebhook struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+}
+
+func NewDownstreamWebhook(rawURL string, tlsConfig *tls.Config, timeout time.Duration) (*DownstreamWebhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("downstream webhook URL %q must be http or https", rawURL)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("downstream webhook timeout must be positive, got %s", timeout)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &DownstreamWebhook{
+		url:     u.String(),
+		client:  &http.Client{Transport: transport},
+		timeout: timeout,
+	}, nil
+}
+
+// review sends the AdmissionReview to the downstream webhook and returns its
+// response with the decoded patch. It gives up after the downstream timeout
+// or when ctx ends, whichever comes first.
+func (d *DownstreamWebhook) review(ctx context.Context, ar *v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, []mutator.PatchOperation, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	body, err := json.Marshal(v1beta1.AdmissionReview{TypeMeta: ar.TypeMeta, Request: ar.Request})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("downstream webhook answered %s", resp.Status)
+	}
+	var answer v1beta1.AdmissionReview
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxDownstreamResponseBytes)).Decode(&answer); err != nil {
+		return nil, nil, fmt.Errorf("decoding downstream webhook answer: %w", err)
+	}
+	if answer.Response == nil {
+		return nil, nil, errors.New("downstream webhook answered without a response")
+	}
+	if answer.Response.UID != ar.Request.UID {
+		return nil, nil, fmt.Errorf("downstream webhook answered for UID %q", answer.Response.UID)
+	}
+	if !answer.Response.Allowed || len(answer.Response.Patch) == 0 {
+		return answer.Response, nil, nil
+	}
+	if answer.Response.PatchType == nil || *answer.Response.PatchType != v1beta1.PatchTypeJSONPatch {
+		return nil, nil, errors.New("downstream webhook answered with a patch that is not a JSON patch")
+	}
+	var patch []mutator.PatchOperation
+	if err := json.Unmarshal(answer.Response.Patch, &patch); err != nil {
+		return nil, nil, fmt.Errorf("decoding downstream webhook patch: %w", err)
+	}
+	return answer.Response, patch, nil
+}
+
+// chainDownstream forwards the admission to the downstream webhook and merges
+// its patch into ours. A non-nil response ends the admission with it: the
+// downstream webhook denied the object, or failed and the failure policy
+// rejects it. When the failure policy allows, a failed downstream webhook
+// only adds a warning.
+func (whsvr *WebhookServer) chainDownstream(ctx context.Context, log logr.Logger, ar *v1beta1.AdmissionReview, decision *mutator.Decision,
+	patch *[]mutator.PatchOperation, entry auditEntry) (*v1beta1.AdmissionResponse, string) {
+	span := startPhase(ctx, phaseDownstream)
+	response, theirs, err := whsvr.downstream.review(ctx, ar)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "downstream webhook failed")
+	}
+	span.SetAttributes(attribute.Int("admission.downstream_patch_operations", len(theirs)))
+	span.End()
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return whsvr.cancelled(log, entry, err)
+		}
+		result := "error"
+		if errors.Is(err, context.DeadlineExceeded) {
+			result = "timeout"
+		}
+		metrics.DownstreamRequests.WithLabelValues(result).Inc()
+		whsvr.observeError(err)
+		log.Error(err, "Downstream webhook failed", "failOpen", whsvr.failOpen)
+		if whsvr.failOpen {
+			decision.Warnings = append(decision.Warnings, "downstream webhook failed, its changes were not applied: "+err.Error())
+			return nil, ""
+		}
+		entry.Decision = decisionError
+		entry.Error = err.Error()
+		whsvr.recordDecision(entry)
+		return failureResponse(false, http.StatusInternalServerError, metav1.StatusReasonInternalError,
+			"downstream webhook failed: "+err.Error()), metrics.ResultDenied
+	}
+
+	decision.Warnings = append(decision.Warnings, response.Warnings...)
+	if !response.Allowed {
+		metrics.DownstreamRequests.WithLabelValues("denied").Inc()
+		message := ""
+		if response.Result != nil {
+			message = response.Result.Message
+		}
+		log.Info("Denied by the downstream webhook", "message", message)
+		entry.Decision = decisionDenied
+		entry.Error = message
+		whsvr.recordDecision(entry)
+		return &v1beta1.AdmissionResponse{
+			Result:   response.Result,
+			Warnings: decision.Warnings,
+		}, metrics.ResultDenied
+	}
+	metrics.DownstreamRequests.WithLabelValues("allowed").Inc()
+	if len(theirs) == 0 {
+		return nil, ""
+	}
+
+	if !decision.Mutate {
+		*decision = mutator.Decision{Mutate: true, Rule: ruleDownstream, Annotations: map[string]string{}, Warnings: decision.Warnings, Trace: decision.Trace}
+		*patch = theirs
+		return nil, ""
+	}
+	merged, conflicts := mergeDownstreamPatch(*patch, theirs)
+	for _, path := range conflicts {
+		log.Info("Downstream webhook patch conflicts with ours, keeping ours", "path", path)
+		decision.Warnings = append(decision.Warnings, fmt.Sprintf("downstream webhook's change to %s conflicts with cert-manager webhook's, which was kept", path))
+	}
+	metrics.DownstreamConflicts.Add(float64(len(conflicts)))
+	*patch = merged
+	return nil, ""
+}
+
+// mergeDownstreamPatch appends the downstream webhook's operations to ours,
+// in the order it sent them since they may depend on it; the result and the
+// conflicts don't depend on map order, so replicas merge alike.
+// Where both set the same thing ours wins; the paths of their values dropped
+// or overridden that way are returned as conflicts. Objects added at the same
+// path are combined key by key, and our values are carried into objects they
+// set above our paths so applying theirs after ours keeps ours.
+func mergeDownstreamPatch(ours, theirs []mutator.PatchOperation) ([]mutator.PatchOperation, []string) {
+	merged := append([]mutator.PatchOperation(nil), ours...)
+	var conflicts []string
+	for _, op := range theirs {
+		keep := true
+		for i := range ours {
+			mine := merged[i]
+			switch {
+			case op.Path == mine.Path:
+				keep = false
+				if op.Op == mine.Op && sameJSON(op.Value, mine.Value) {
+					break
+				}
+				mineObject, ok1 := objectValue(mine.Value)
+				theirObject, ok2 := objectValue(op.Value)
+				if op.Op != "add" || mine.Op != "add" || !ok1 || !ok2 {
+					conflicts = append(conflicts, op.Path)
+					break
+				}
+				keys := make([]string, 0, len(theirObject))
+				for key := range theirObject {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				for _, key := range keys {
+					value := theirObject[key]
+					if existing, set := mineObject[key]; set {
+						if !sameJSON(existing, value) {
+							conflicts = append(conflicts, op.Path+"/"+mutator.EscapePointer(key))
+						}
+						continue
+					}
+					mineObject[key] = value
+				}
+				merged[i].Value = mineObject
+			case strings.HasPrefix(mine.Path, op.Path+"/"):
+				// theirs sets a parent of what we set: carry ours into it
+				suffix := strings.TrimPrefix(mine.Path, op.Path+"/")
+				theirObject, ok := objectValue(op.Value)
+				if !ok || strings.Contains(suffix, "/") || mine.Op == "remove" {
+					conflicts = append(conflicts, op.Path)
+					keep = false
+					break
+				}
+				key := mutator.UnescapePointer(suffix)
+				if existing, set := theirObject[key]; set && !sameJSON(existing, mine.Value) {
+					conflicts = append(conflicts, mine.Path)
+				}
+				theirObject[key] = mine.Value
+				op.Value = theirObject
+			case strings.HasPrefix(op.Path, mine.Path+"/"):
+				// theirs sets something inside what we set
+				suffix := strings.TrimPrefix(op.Path, mine.Path+"/")
+				mineObject, ok := objectValue(mine.Value)
+				if !ok || strings.Contains(suffix, "/") {
+					conflicts = append(conflicts, op.Path)
+					keep = false
+					break
+				}
+				if existing, set := mineObject[mutator.UnescapePointer(suffix)]; set {
+					if op.Op == "remove" || !sameJSON(existing, op.Value) {
+						conflicts = append(conflicts, op.Path)
+					}
+					keep = false
+				}
+			}
+			if !keep {
+				break
+			}
+		}
+		if keep {
+			merged = append(merged, op)
+		}
+	}
+	return merged, conflicts
+}
+
+// objectValue returns a copy of a patch value that is a JSON object.
+func objectValue(value interface{}) (map[string]interface{}, bool) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, false
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(raw, &object); err != nil || object == nil {
+		return nil, false
+	}
+	return object, true
+}
+
+// sameJSON reports whether two patch values encode to the same JSON.
+func sameJSON(a, b interface{}) bool {
+	rawA, errA := json.Marshal(a)
+	rawB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(rawA, rawB)
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// stubDownstream serves a downstream webhook answering every review through
+// answer, which fills in the response for the review's UID.
+func stubDownstream(t *testing.T, answer func(w http.ResponseWriter, response *v1beta1.AdmissionResponse) bool) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var review v1beta1.AdmissionReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+			http.Error(w, "bad review", http.StatusBadRequest)
+			return
+		}
+		response := &v1beta1.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+		if !answer(w, response) {
+			return
+		}
+		json.NewEncoder(w).Encode(v1beta1.AdmissionReview{TypeMeta: review.TypeMeta, Response: response})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// patching answers with the patch ops.
+func patching(ops ...mutator.PatchOperation) func(http.ResponseWriter, *v1beta1.AdmissionResponse) bool {
+	return func(w http.ResponseWriter, response *v1beta1.AdmissionResponse) bool {
+		patch, _ := json.Marshal(ops)
+		patchType := v1beta1.PatchTypeJSONPatch
+		response.Patch, response.PatchType = patch, &patchType
+		return true
+	}
+}
+
+// downstreamHandler returns the handler of config chained to the stub with
+// the downstream timeout.
+func downstreamHandler(t *testing.T, config Config, stub *httptest.Server, timeout time.Duration) http.Handler {
+	t.Helper()
+	downstream, err := NewDownstreamWebhook(stub.URL, nil, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestHandler(t, config, WithDownstreamWebhook(downstream))
+}
+
+func TestDownstreamPatchMerged(t *testing.T) {
+	stub := stubDownstream(t, patching(
+		mutator.PatchOperation{Op: "add", Path: "/metadata/annotations/legacy.example.com~1owner", Value: "team-a"},
+		// conflicts with ours, which is kept
+		mutator.PatchOperation{Op: "add", Path: "/metadata/annotations/" + mutator.EscapePointer(syncAnnotationKey), Value: "env=legacy"},
+	))
+	handler := downstreamHandler(t, DefaultConfig(), stub, time.Second)
+	review := secretReview(t, "tls", "apps")
+	response := admitWith(t, handler, review)
+	if !response.Allowed {
+		t.Fatalf("secret not allowed: %v", response.Result)
+	}
+	annotations := patchedSecret(t, review, response).Annotations
+	if got := annotations["legacy.example.com/owner"]; got != "team-a" {
+		t.Errorf("downstream annotation %q, want it merged", got)
+	}
+	if got := annotations[syncAnnotationKey]; got != DefaultConfig().Mutator.NamespaceSelector {
+		t.Errorf("sync annotation %q, want ours to win the conflict", got)
+	}
+	if !containsWarning(response.Warnings, "conflicts") {
+		t.Errorf("no warning about the conflict in %q", response.Warnings)
+	}
+}
+
+// A secret only the downstream webhook mutates gets its patch alone.
+func TestDownstreamPatchOnly(t *testing.T) {
+	stub := stubDownstream(t, patching(
+		mutator.PatchOperation{Op: "add", Path: "/metadata/labels", Value: map[string]string{"legacy": "true"}},
+	))
+	handler := downstreamHandler(t, DefaultConfig(), stub, time.Second)
+	review := secretReview(t, "tls", metav1.NamespaceSystem)
+	patched := patchedSecret(t, review, admitWith(t, handler, review))
+	if patched.Labels["legacy"] != "true" {
+		t.Errorf("labels %v, want the downstream patch applied", patched.Labels)
+	}
+	if _, set := patched.Annotations[syncAnnotationKey]; set {
+		t.Error("secret in an ignored namespace annotated for sync")
+	}
+}
+
+func TestDownstreamFailures(t *testing.T) {
+	failing := func(w http.ResponseWriter, _ *v1beta1.AdmissionResponse) bool {
+		http.Error(w, "legacy webhook broken", http.StatusInternalServerError)
+		return false
+	}
+	hanging := func(w http.ResponseWriter, response *v1beta1.AdmissionResponse) bool {
+		time.Sleep(300 * time.Millisecond)
+		return true
+	}
+	denying := func(w http.ResponseWriter, response *v1beta1.AdmissionResponse) bool {
+		response.Allowed = false
+		response.Result = &metav1.Status{Message: "legacy says no"}
+		return true
+	}
+	tests := []struct {
+		name     string
+		answer   func(http.ResponseWriter, *v1beta1.AdmissionResponse) bool
+		failOpen bool
+		allowed  bool
+		message  string // in the warnings when allowed, in the result otherwise
+	}{
+		{name: "error fail open", answer: failing, failOpen: true, allowed: true, message: "500"},
+		{name: "error fail closed", answer: failing, message: "500"},
+		{name: "timeout fail open", answer: hanging, failOpen: true, allowed: true, message: "deadline exceeded"},
+		{name: "timeout fail closed", answer: hanging, message: "deadline exceeded"},
+		{name: "denied", answer: denying, failOpen: true, message: "legacy says no"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.FailOpen = tt.failOpen
+			handler := downstreamHandler(t, config, stubDownstream(t, tt.answer), 50*time.Millisecond)
+			review := secretReview(t, "tls", "apps")
+			response := admitWith(t, handler, review)
+			if response.Allowed != tt.allowed {
+				t.Fatalf("allowed = %v, want %v: %v", response.Allowed, tt.allowed, response.Result)
+			}
+			if !tt.allowed {
+				if response.Result == nil || !strings.Contains(response.Result.Message, tt.message) {
+					t.Errorf("result %v, want it to mention %q", response.Result, tt.message)
+				}
+				return
+			}
+			if !containsWarning(response.Warnings, tt.message) {
+				t.Errorf("warnings %q, want one mentioning %q", response.Warnings, tt.message)
+			}
+			// our own patch is still applied
+			if got := patchedSecret(t, review, response).Annotations[syncAnnotationKey]; got == "" {
+				t.Error("secret not annotated for sync")
+			}
+		})
+	}
+}
+
+// The downstream call stops at the admission's own deadline even when the
+// downstream timeout is longer.
+func TestDownstreamWithinDeadline(t *testing.T) {
+	stub := stubDownstream(t, func(http.ResponseWriter, *v1beta1.AdmissionResponse) bool {
+		time.Sleep(time.Second)
+		return true
+	})
+	handler := downstreamHandler(t, DefaultConfig(), stub, time.Minute)
+	body, err := json.Marshal(secretReview(t, "tls", "apps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("admission took %s past its 100ms deadline", elapsed)
+	}
+}
+
+func TestNewDownstreamWebhookInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		url     string
+		timeout time.Duration
+	}{
+		{"ftp://legacy", time.Second},
+		{"https://legacy", 0},
+	} {
+		if _, err := NewDownstreamWebhook(tt.url, nil, tt.timeout); err == nil {
+			t.Errorf("downstream %s with timeout %s accepted", tt.url, tt.timeout)
+		}
+	}
+}
+
+func containsWarning(warnings []string, part string) bool {
+	for _, warning := range warnings {
+		if strings.Contains(warning, part) {
+			return true
+		}
+	}
+	return false
+}
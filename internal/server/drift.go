@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// driftFieldManager owns the fields drift remediation patches.
+const driftFieldManager = "cert-manager-webhook-drift"
+
+// DriftScanConfig holds the settings of the drift scan.
+type DriftScanConfig struct {
+	// Interval is the time between the starts of two scans.
+	Interval time.Duration
+	// BatchSize is the number of secrets listed per request.
+	BatchSize int64
+	// Namespace limits the scan to one namespace, all when empty.
+	Namespace string
+	// Remediate patches the drifted secrets back to the policy.
+	Remediate bool
+}
+
+// DriftScanner finds the secrets the webhook manages whose annotations no
+// longer match what the current policy would set, e.g. after the namespace
+// selector changed: nothing writes them, so no admission corrects them. The
+// elected leader lists the secrets carrying the managed-by marker every
+// interval and exports their number; with remediation on, it patches them
+// back, except during a change freeze, when they are scanned again as the
+// window ends. Secrets without the marker hold values someone else set and
+// are never counted or touched.
+type DriftScanner struct {
+	log    logr.Logger
+	client kubernetes.Interface
+	whsvr  *WebhookServer
+	config DriftScanConfig
+}
+
+// NewDriftScanner returns a scanner comparing secrets with the policy of
+// whsvr.
+func (whsvr *WebhookServer) NewDriftScanner(log logr.Logger, client kubernetes.Interface, config DriftScanConfig) *DriftScanner {
+	return &DriftScanner{log: log, client: client, whsvr: whsvr, config: config}
+}
+
+// Stopped clears the drift gauge, which the new leader reports.
+func (s *DriftScanner) Stopped() {
+	metrics.DriftedSecrets.Set(0)
+}
+
+// Lead scans every interval until ctx is done.
+func (s *DriftScanner) Lead(ctx context.Context) {
+	s.log.Info("Scanning for drift", "interval", s.config.Interval.String(), "remediate", s.config.Remediate)
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		drifted, err := s.scan(ctx)
+		if err != nil && ctx.Err() == nil {
+			s.log.Error(err, "Drift scan failed, keeping the previous count")
+		} else if err == nil {
+			metrics.DriftedSecrets.Set(float64(drifted))
+			s.log.Info("Drift scan done", "drifted", drifted)
+		}
+		var rescan <-chan time.Time
+		if match, frozen := s.whsvr.frozen(s.whsvr.policy.Load()); frozen && s.config.Remediate && drifted > 0 {
+			// remediated as soon as the window ends, not at the next tick
+			rescan = time.After(match.End.Sub(s.whsvr.clock.Now()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-rescan:
+		}
+	}
+}
+
+// scan lists the secrets page by page and returns the number of drifted
+// managed secrets, remediated or not.
+func (s *DriftScanner) scan(ctx context.Context) (int, error) {
+	opts := metav1.ListOptions{Limit: s.config.BatchSize}
+	drifted := 0
+	for {
+		list, err := s.client.CoreV1().Secrets(s.config.Namespace).List(ctx, opts)
+		if err != nil {
+			return drifted, err
+		}
+		for i := range list.Items {
+			secret := &list.Items[i]
+			if secret.Annotations[mutator.ManagedByAnnotationKey] != mutator.ManagedByValue {
+				continue
+			}
+			ok, err := s.check(ctx, secret)
+			if err != nil {
+				if ctx.Err() != nil {
+					return drifted, err
+				}
+				s.log.Error(err, "Failed to check secret for drift", "namespace", secret.Namespace, "name", secret.Name)
+				continue
+			}
+			if ok {
+				drifted++
+			}
+		}
+		if list.Continue == "" {
+			return drifted, nil
+		}
+		opts.Continue = list.Continue
+	}
+}
+
+// check reports whether the managed secret drifted, remediating it when
+// configured.
+func (s *DriftScanner) check(ctx context.Context, secret *corev1.Secret) (bool, error) {
+	p := s.whsvr.policy.Load()
+	admission := mutator.AdmissionContext{Operation: string(v1beta1.Update), Secret: secret,
+		Namespaces: s.whsvr.informers.namespaceLister(), Certificates: s.whsvr.informers.certificateLister(),
+		Ingresses: s.whsvr.informers.ingressLister()}
+	decision, patch, err := p.mutator.Evaluate(ctx, admission)
+	if err != nil {
+		return false, fmt.Errorf("evaluating: %w", err)
+	}
+	conflicts := mutator.ConflictingAnnotations(secret.Annotations, decision.Annotations)
+	if !decision.Mutate || len(conflicts) == 0 {
+		return false, nil
+	}
+	log := s.log.WithValues("namespace", secret.Namespace, "name", secret.Name,
+		"decision", secret.Annotations[mutator.DecisionAnnotationKey], "wantDecision", decision.Annotations[mutator.DecisionAnnotationKey])
+	if !s.config.Remediate {
+		log.Info("Secret drifted from the policy", "keys", conflicts)
+		return true, nil
+	}
+	if match, frozen := s.whsvr.frozen(p); frozen {
+		metrics.DriftRemediations.WithLabelValues(skipFrozen).Inc()
+		log.Info("Not remediating drifted secret during change freeze", "keys", conflicts, "reason", skipFrozen,
+			"window", match.Window, "until", match.End.Format(time.RFC3339))
+		return true, nil
+	}
+	patchBytes, err := p.mutator.MarshalPatch(patch)
+	if err == nil {
+		err = withRetry(ctx, opDriftPatch, nil, func(ctx context.Context) error {
+			_, err := s.client.CoreV1().Secrets(secret.Namespace).Patch(ctx, secret.Name, types.JSONPatchType, patchBytes,
+				metav1.PatchOptions{FieldManager: driftFieldManager})
+			return err
+		})
+	}
+	switch {
+	case apierrors.IsNotFound(err):
+		return false, nil
+	case err != nil:
+		metrics.DriftRemediations.WithLabelValues("failed").Inc()
+		return true, fmt.Errorf("remediating: %w", err)
+	}
+	metrics.DriftRemediations.WithLabelValues("patched").Inc()
+	log.Info("Remediated drifted secret", "keys", conflicts, "rule", decision.Rule)
+	return true, nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// driftedSecrets returns secrets the webhook annotated under a sync
+// selector since changed: two it manages, in two namespaces, and one whose
+// value someone else set; and one secret annotated under the current
+// policy.
+func driftedSecrets(t *testing.T, current Config) []runtime.Object {
+	t.Helper()
+	old := DefaultConfig()
+	old.Mutator.NamespaceSelector = "env=old"
+	annotate := func(config Config, namespace, name string) *corev1.Secret {
+		secret, err := mutateSecret(newTestHandler(t, config), FixtureSecret{Name: name, Namespace: namespace, DataSize: 16}.Build())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret
+	}
+	unmanaged := FixtureSecret{Name: "hand-tls", Namespace: "apps", DataSize: 16}.Build()
+	unmanaged.Annotations[mutator.SyncAnnotationKey] = "env=old"
+	return []runtime.Object{
+		annotate(old, "apps", "api-tls"),
+		annotate(old, "web", "web-tls"),
+		unmanaged,
+		annotate(current, "apps", "new-tls"),
+	}
+}
+
+// syncValues returns the sync annotation of each secret, by namespace/name.
+func syncValues(t *testing.T, client *fake.Clientset) map[string]string {
+	t.Helper()
+	list, err := client.CoreV1().Secrets("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	for _, secret := range list.Items {
+		values[secret.Namespace+"/"+secret.Name] = secret.Annotations[mutator.SyncAnnotationKey]
+	}
+	return values
+}
+
+func newDriftScanner(t *testing.T, current Config, client *fake.Clientset, config DriftScanConfig) *DriftScanner {
+	t.Helper()
+	whsvr, err := NewWebhookServer(WithConfig(current))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(whsvr.Close)
+	return whsvr.NewDriftScanner(logr.Discard(), client, config)
+}
+
+// Detecting, the scan counts the managed secrets whose annotations the
+// policy would change, in its namespace scope, and patches nothing.
+func TestDriftDetect(t *testing.T) {
+	current := DefaultConfig()
+	current.Mutator.NamespaceSelector = "env=new"
+	client := fake.NewSimpleClientset(driftedSecrets(t, current)...)
+	before := syncValues(t, client)
+	var limits []int64
+	client.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		limits = append(limits, action.(k8stesting.ListActionImpl).ListOptions.Limit)
+		return false, nil, nil
+	})
+
+	for namespace, want := range map[string]int{"": 2, "apps": 1, "other": 0} {
+		drifted, err := newDriftScanner(t, current, client, DriftScanConfig{BatchSize: 50, Namespace: namespace}).scan(context.Background())
+		if err != nil || drifted != want {
+			t.Errorf("scan of %q: %d drifted, want %d: %v", namespace, drifted, want, err)
+		}
+	}
+	if len(limits) != 3 {
+		t.Errorf("%d lists for 3 scans", len(limits))
+	}
+	for _, limit := range limits {
+		if limit != 50 {
+			t.Errorf("listed %d secrets at once, want the batch size", limit)
+		}
+	}
+	if after := syncValues(t, client); !maps.Equal(after, before) {
+		t.Errorf("detecting changed the secrets from %v to %v", before, after)
+	}
+
+	// the leader exports the count, cleared once it steps down
+	ctx, cancel := context.WithCancel(context.Background())
+	scanner := newDriftScanner(t, current, client, DriftScanConfig{Interval: time.Hour, BatchSize: 50})
+	done := make(chan struct{})
+	go func() {
+		scanner.Lead(ctx)
+		close(done)
+	}()
+	waitFor(t, func() bool { return testutil.ToFloat64(metrics.DriftedSecrets) == 2 })
+	cancel()
+	<-done
+	scanner.Stopped()
+	if got := testutil.ToFloat64(metrics.DriftedSecrets); got != 0 {
+		t.Errorf("gauge %v after stepping down", got)
+	}
+}
+
+// Remediating, the scan patches the managed secrets back to the policy and
+// leaves the value someone else set; the next scan finds no drift.
+func TestDriftRemediate(t *testing.T) {
+	current := DefaultConfig()
+	current.Mutator.NamespaceSelector = "env=new"
+	client := fake.NewSimpleClientset(driftedSecrets(t, current)...)
+	patched := metrics.DriftRemediations.WithLabelValues("patched")
+	before := testutil.ToFloat64(patched)
+
+	scanner := newDriftScanner(t, current, client, DriftScanConfig{BatchSize: 50, Remediate: true})
+	if drifted, err := scanner.scan(context.Background()); err != nil || drifted != 2 {
+		t.Fatalf("%d drifted: %v", drifted, err)
+	}
+	if got := testutil.ToFloat64(patched) - before; got != 2 {
+		t.Errorf("%v remediations counted, want 2", got)
+	}
+	want := map[string]string{"apps/api-tls": "env=new", "web/web-tls": "env=new", "apps/hand-tls": "env=old", "apps/new-tls": "env=new"}
+	if got := syncValues(t, client); !maps.Equal(got, want) {
+		t.Errorf("sync annotations %v, want %v", got, want)
+	}
+	if drifted, err := scanner.scan(context.Background()); err != nil || drifted != 0 {
+		t.Errorf("%d drifted after remediation: %v", drifted, err)
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// otherNamespaces labels the gauges summing the namespaces beyond the top
+// ones.
+const otherNamespaces = "other"
+
+// eligibilityCounts are the cert-manager secrets of one namespace.
+type eligibilityCounts struct {
+	eligible, annotated, unannotated int
+}
+
+// reportEligibility sets the eligibility gauges from the secrets cache every
+// EligibilityInterval until ctx is done.
+func (c *BackfillController) reportEligibility(ctx context.Context, lister corelisters.SecretLister) {
+	ticker := time.NewTicker(c.config.EligibilityInterval)
+	defer ticker.Stop()
+	for {
+		counts, err := c.countEligible(ctx, lister)
+		if err == nil {
+			setEligibility(counts, c.config.EligibilityTopNamespaces)
+		} else if ctx.Err() == nil {
+			c.log.Error(err, "Failed to count eligible secrets")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// countEligible evaluates the cert-manager secrets of the cache with the
+// current policy, as admissions would. A secret is eligible when the policy
+// annotates it: annotated when it already holds the annotations, skipped
+// with no-changes, unannotated when it would be patched.
+func (c *BackfillController) countEligible(ctx context.Context, lister corelisters.SecretLister) (map[string]*eligibilityCounts, error) {
+	secrets, err := lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	p := c.whsvr.policy.Load()
+	namespaces := c.whsvr.informers.namespaceLister()
+	certificates := c.whsvr.informers.certificateLister()
+	ingresses := c.whsvr.informers.ingressLister()
+	counts := map[string]*eligibilityCounts{}
+	for _, secret := range secrets {
+		if _, ok := secret.Annotations[mutator.CertManagerAnnotationKey]; !ok {
+			continue
+		}
+		// the cached object is shared and the stages get their own copy
+		admission := mutator.AdmissionContext{Operation: string(v1beta1.Update), Secret: secret.DeepCopy(), Namespaces: namespaces, Certificates: certificates,
+			Ingresses: ingresses}
+		decision, _, err := p.mutator.Evaluate(ctx, admission)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			c.log.V(1).Info("Failed to evaluate secret for eligibility", "namespace", secret.Namespace, "name", secret.Name, "error", err.Error())
+			continue
+		}
+		if !decision.Mutate && decision.SkipReason != mutator.SkipNoChanges {
+			continue
+		}
+		count, ok := counts[secret.Namespace]
+		if !ok {
+			count = &eligibilityCounts{}
+			counts[secret.Namespace] = count
+		}
+		count.eligible++
+		if decision.Mutate {
+			count.unannotated++
+		} else {
+			count.annotated++
+		}
+	}
+	return counts, nil
+}
+
+// setEligibility replaces the gauges with counts, labelling the top
+// namespaces, those with the most unannotated then eligible secrets, and
+// summing the others under otherNamespaces.
+func setEligibility(counts map[string]*eligibilityCounts, top int) {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Or(
+			cmp.Compare(counts[b].unannotated, counts[a].unannotated),
+			cmp.Compare(counts[b].eligible, counts[a].eligible),
+			cmp.Compare(a, b))
+	})
+	resetEligibility()
+	var other eligibilityCounts
+	for i, name := range names {
+		count := counts[name]
+		if i >= top {
+			other.eligible += count.eligible
+			other.annotated += count.annotated
+			other.unannotated += count.unannotated
+			continue
+		}
+		setEligibilityGauges(name, *count)
+	}
+	if len(names) > top {
+		setEligibilityGauges(otherNamespaces, other)
+	}
+}
+
+// setEligibilityGauges adds count to the gauges of namespace, just reset:
+// the namespaces the cardinality guard counts as other share its series.
+func setEligibilityGauges(namespace string, count eligibilityCounts) {
+	metrics.EligibleSecrets.WithLabelValues(namespace).Add(float64(count.eligible))
+	metrics.AnnotatedSecrets.WithLabelValues(namespace).Add(float64(count.annotated))
+	metrics.UnannotatedEligibleSecrets.WithLabelValues(namespace).Add(float64(count.unannotated))
+}
+
+func resetEligibility() {
+	metrics.EligibleSecrets.Reset()
+	metrics.AnnotatedSecrets.Reset()
+	metrics.UnannotatedEligibleSecrets.Reset()
+}
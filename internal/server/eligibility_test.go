@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// The gauges count, per namespace, the cert-manager secrets the policy
+// annotates, split by whether they already are, from the cache: secrets
+// the policy skips or cert-manager didn't create are left out, and the
+// namespaces beyond the top ones are summed as other.
+func TestEligibilityGauges(t *testing.T) {
+	handler := newTestHandler(t, DefaultConfig())
+	annotated := func(namespace, name string) *corev1.Secret {
+		secret, err := mutateSecret(handler, FixtureSecret{Name: name, Namespace: namespace, DataSize: 16}.Build())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret
+	}
+	unannotated := func(namespace, name string) *corev1.Secret {
+		return FixtureSecret{Name: name, Namespace: namespace, DataSize: 16}.Build()
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, secret := range []*corev1.Secret{
+		unannotated("apps", "api-tls"), unannotated("apps", "web-tls"), annotated("apps", "db-tls"),
+		unannotated("db", "db-tls"),
+		annotated("web", "web-tls"), annotated("web", "www-tls"),
+		unannotated(metav1.NamespaceSystem, "api-tls"),
+		{ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "apps"}, Type: corev1.SecretTypeOpaque},
+	} {
+		if err := indexer.Add(secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	whsvr, err := NewWebhookServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer whsvr.Close()
+	controller := whsvr.NewBackfillController(logr.Discard(), nil, BackfillConfig{EligibilityTopNamespaces: 2})
+	counts, err := controller.countEligible(context.Background(), corelisters.NewSecretLister(indexer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setEligibility(counts, controller.config.EligibilityTopNamespaces)
+
+	want := map[string]eligibilityCounts{
+		"apps":          {eligible: 3, annotated: 1, unannotated: 2},
+		"db":            {eligible: 1, unannotated: 1},
+		otherNamespaces: {eligible: 2, annotated: 2},
+	}
+	for namespace, count := range want {
+		got := eligibilityCounts{
+			eligible:    int(testutil.ToFloat64(metrics.EligibleSecrets.WithLabelValues(namespace))),
+			annotated:   int(testutil.ToFloat64(metrics.AnnotatedSecrets.WithLabelValues(namespace))),
+			unannotated: int(testutil.ToFloat64(metrics.UnannotatedEligibleSecrets.WithLabelValues(namespace))),
+		}
+		if got != count {
+			t.Errorf("%s: %+v, want %+v", namespace, got, count)
+		}
+	}
+	if series := testutil.CollectAndCount(metrics.EligibleSecrets); series != len(want) {
+		t.Errorf("%d namespaces labelled, want %d", series, len(want))
+	}
+
+	// the leader stepping down clears them
+	controller.Stopped()
+	if series := testutil.CollectAndCount(metrics.EligibleSecrets); series != 0 {
+		t.Errorf("%d series left", series)
+	}
+}
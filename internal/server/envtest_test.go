@@ -0,0 +1,486 @@
+//go:build envtest
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// The integration suite boots a local API server with envtest, registers the
+// webhook against a server on a local listener and checks the secrets the
+// API server persists. It needs the envtest binaries, see `make
+// test-envtest`.
+
+// envtestWebhook returns the webhook configuration of the chart, sending the
+// secrets of every namespace but kube-system to the path.
+func envtestWebhook() *admissionregistrationv1.MutatingWebhookConfiguration {
+	// envtest replaces the service by the local server's URL, adding the
+	// leading slash of the path itself
+	path := "mutate"
+	failurePolicy := admissionregistrationv1.Fail
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "cert-manager-webhook"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name: "cert-webhook.alterus.io",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{Name: "cert-manager-webhook", Namespace: "default", Path: &path},
+			},
+			NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{
+				Key:      corev1.LabelMetadataName,
+				Operator: metav1.LabelSelectorOpNotIn,
+				Values:   []string{metav1.NamespaceSystem},
+			}}},
+			FailurePolicy:           &failurePolicy,
+			SideEffects:             &sideEffects,
+			AdmissionReviewVersions: []string{"v1beta1"},
+			Rules: []admissionregistrationv1.RuleWithOperations{{
+				Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{""},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"secrets"},
+				},
+			}},
+		}},
+	}
+}
+
+// startEnvtest boots the API server with the webhook registered and serves
+// a server of opts where it calls, returning a client of the API server
+// and the server.
+func startEnvtest(t *testing.T, opts ...Option) (kubernetes.Interface, *WebhookServer) {
+	t.Helper()
+	env, whsvr := bootEnvtest(t, opts...)
+	client, err := kubernetes.NewForConfig(env.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, whsvr
+}
+
+// bootEnvtest is startEnvtest returning the environment, whose Config
+// reaches the API server.
+func bootEnvtest(t *testing.T, opts ...Option) (*envtest.Environment, *WebhookServer) {
+	t.Helper()
+	env := &envtest.Environment{
+		WebhookInstallOptions: envtest.WebhookInstallOptions{
+			MutatingWebhooks: []*admissionregistrationv1.MutatingWebhookConfiguration{envtestWebhook()},
+		},
+	}
+	if _, err := env.Start(); err != nil {
+		t.Fatalf("starting the API server: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := env.Stop(); err != nil {
+			t.Errorf("stopping the API server: %v", err)
+		}
+	})
+
+	hook := env.WebhookInstallOptions
+	whsvr, err := NewWebhookServer(append([]Option{
+		WithTLSFromFiles(filepath.Join(hook.LocalServingCertDir, "tls.crt"), filepath.Join(hook.LocalServingCertDir, "tls.key")),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(hook.LocalServingHost, strconv.Itoa(hook.LocalServingPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := whsvr.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("serving the webhook: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		whsvr.server.Shutdown(ctx)
+		whsvr.Close()
+	})
+	return env, whsvr
+}
+
+// createSecret creates the secret, first its namespace when missing, and
+// returns it as the API server persisted it.
+func createSecret(t *testing.T, client kubernetes.Interface, secret *corev1.Secret) *corev1.Secret {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := client.CoreV1().Namespaces().Get(ctx, secret.Namespace, metav1.GetOptions{}); err != nil {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: secret.Namespace}}
+		if _, err := client.CoreV1().Namespaces().Create(ctx, namespace, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("creating secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+	persisted, err := client.CoreV1().Secrets(secret.Namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return persisted
+}
+
+// tlsSecret returns a cert-manager TLS secret name in namespace.
+func tlsSecret(name, namespace string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Annotations: map[string]string{mutator.CertManagerAnnotationKey: name}},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       []byte(strings.Repeat("c", 64)),
+			corev1.TLSPrivateKeyKey: []byte(strings.Repeat("k", 64)),
+		},
+	}
+}
+
+func TestEnvtest(t *testing.T) {
+	config := DefaultConfig()
+	config.Mutator.NamespaceSelector = "env=staging"
+	client, _ := startEnvtest(t, WithConfig(config))
+
+	t.Run("cert-manager secret annotated", func(t *testing.T) {
+		secret := createSecret(t, client, tlsSecret("api-tls", "apps"))
+		if got := secret.Annotations[syncAnnotationKey]; got != "env=staging" {
+			t.Errorf("sync annotation %q, want env=staging", got)
+		}
+	})
+
+	t.Run("update keeps the annotations", func(t *testing.T) {
+		secret := createSecret(t, client, tlsSecret("web-tls", "apps"))
+		secret.Data[corev1.TLSCertKey] = []byte(strings.Repeat("r", 64))
+		updated, err := client.CoreV1().Secrets(secret.Namespace).Update(context.Background(), secret, metav1.UpdateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := updated.Annotations[syncAnnotationKey]; got != "env=staging" {
+			t.Errorf("sync annotation %q after an update, want env=staging", got)
+		}
+		if got := updated.Annotations[mutator.CertManagerAnnotationKey]; got != "web-tls" {
+			t.Errorf("cert-manager annotation %q after an update, want web-tls", got)
+		}
+	})
+
+	t.Run("other secret left alone", func(t *testing.T) {
+		secret := createSecret(t, client, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "apps"},
+			StringData: map[string]string{"password": "hunter2"},
+		})
+		if _, set := secret.Annotations[syncAnnotationKey]; set {
+			t.Error("opaque secret annotated for sync")
+		}
+	})
+
+	t.Run("ignored namespace left alone", func(t *testing.T) {
+		secret := createSecret(t, client, tlsSecret("public-tls", metav1.NamespacePublic))
+		if _, set := secret.Annotations[syncAnnotationKey]; set {
+			t.Error("secret in kube-public annotated for sync")
+		}
+	})
+}
+
+// Secrets created while the policy ignored their namespace, as if before
+// the webhook was installed, are annotated by the backfill controller once
+// the policy covers them.
+func TestEnvtestBackfill(t *testing.T) {
+	config := DefaultConfig()
+	config.Mutator.IgnoredNamespaces = append(config.Mutator.IgnoredNamespaces, "legacy")
+	client, whsvr := startEnvtest(t, WithConfig(config))
+	names := []string{"api-tls", "web-tls", "db-tls"}
+	for _, name := range names {
+		secret := createSecret(t, client, FixtureSecret{Name: name, Namespace: "legacy", DataSize: 64}.Build())
+		if _, set := secret.Annotations[syncAnnotationKey]; set {
+			t.Fatalf("secret %s annotated while its namespace is ignored", name)
+		}
+	}
+
+	if err := whsvr.Reload(DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		whsvr.NewBackfillController(logr.Discard(), client, BackfillConfig{QPS: 10, Burst: 1}).Lead(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		annotated := 0
+		for _, name := range names {
+			secret, err := client.CoreV1().Secrets("legacy").Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if secret.Annotations[syncAnnotationKey] == "true" {
+				annotated++
+			}
+		}
+		if annotated == len(names) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d pre-existing secrets annotated", annotated, len(names))
+		}
+	}
+}
+
+// The copies of a deleted source and of a source not annotated for sync
+// are deleted by the replica collector; the copy of a synced source stays.
+func TestEnvtestReplicaGC(t *testing.T) {
+	client, _ := startEnvtest(t)
+	ctx := context.Background()
+	createSecret(t, client, FixtureSecret{Name: "synced-tls", Namespace: "apps", DataSize: 64}.Build())
+	createSecret(t, client, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "apps"},
+		StringData: map[string]string{"token": "x"},
+	})
+	createSecret(t, client, FixtureSecret{Name: "gone-tls", Namespace: "apps", DataSize: 64}.Build())
+	if err := client.CoreV1().Secrets("apps").Delete(ctx, "gone-tls", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range []string{"synced-tls", "plain", "gone-tls"} {
+		createSecret(t, client, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: source, Namespace: "team", Annotations: map[string]string{
+				mutator.OriginAnnotationKey: fmt.Sprintf(`{"namespace":"apps","name":%q}`, source),
+			}},
+			StringData: map[string]string{"copy": "x"},
+		})
+	}
+
+	gcCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		NewReplicaGC(logr.Discard(), client, ReplicaGCConfig{}).Lead(gcCtx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		list, err := client.CoreV1().Secrets("team").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, secret := range list.Items {
+			names = append(names, secret.Name)
+		}
+		if len(names) == 1 && names[0] == "synced-tls" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("copies %v left, want the copy of synced-tls only", names)
+		}
+	}
+}
+
+// runSelfcheck builds the webhook binary and runs its selfcheck subcommand
+// against the API server of env with args, returning the exit code and the
+// output.
+func runSelfcheck(t *testing.T, env *envtest.Environment, args ...string) (int, string) {
+	t.Helper()
+	dir := t.TempDir()
+	user, err := env.ControlPlane.AddUser(envtest.User{Name: "selfcheck", Groups: []string{"system:masters"}}, env.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubeconfig, err := user.KubeConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubeconfigPath := filepath.Join(dir, "kubeconfig")
+	if err := os.WriteFile(kubeconfigPath, kubeconfig, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// the subcommand runs as a binary: envtest and the command both define
+	// the kubeconfig flag
+	binary := filepath.Join(dir, "webhook")
+	if out, err := exec.Command("go", "build", "-o", binary, "github.com/bygui86/cert-manager-webhook/cmd/webhook").CombinedOutput(); err != nil {
+		t.Fatalf("building the webhook: %v\n%s", err, out)
+	}
+	cmd := exec.Command(binary, append([]string{"selfcheck", "-kubeconfig", kubeconfigPath}, args...)...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	switch {
+	case errors.As(err, &exit):
+		return exit.ExitCode(), string(out)
+	case err != nil:
+		t.Fatalf("running selfcheck: %v\n%s", err, stderr.String())
+	}
+	return 0, string(out)
+}
+
+// The selfcheck passes where the webhook mutates its test secret and fails
+// where it doesn't or kubed makes no copy, reporting each step, and deletes
+// the test secret either way.
+func TestEnvtestSelfcheck(t *testing.T) {
+	env, _ := bootEnvtest(t)
+	client, err := kubernetes.NewForConfig(env.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name      string
+		namespace string
+		args      []string
+		code      int
+		want      []string
+	}{
+		{
+			name:      "mutated",
+			namespace: metav1.NamespaceDefault,
+			want: []string{
+				"PASS  create test secret",
+				"PASS  sync annotations set",
+				"SKIP  kubed copy",
+				"PASS  delete test secrets",
+				"result: PASS",
+			},
+		},
+		{
+			// kube-system isn't sent to the webhook
+			name:      "not mutated",
+			namespace: metav1.NamespaceSystem,
+			args:      []string{"-target-namespace", metav1.NamespaceDefault, "-admission-timeout", "2s"},
+			code:      1,
+			want: []string{
+				"PASS  create test secret",
+				"FAIL  sync annotations set",
+				"the webhook didn't mutate the secret",
+				"SKIP  kubed copy",
+				"PASS  delete test secrets",
+				"result: FAIL",
+			},
+		},
+		{
+			// envtest runs no kubed
+			name:      "no copy",
+			namespace: metav1.NamespaceDefault,
+			args:      []string{"-target-namespace", metav1.NamespacePublic, "-replication-timeout", "2s"},
+			code:      1,
+			want: []string{
+				"PASS  sync annotations set",
+				"FAIL  kubed copy",
+				"PASS  delete test secrets",
+				"result: FAIL",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			code, out := runSelfcheck(t, env, append([]string{"-namespace", tt.namespace}, tt.args...)...)
+			if code != tt.code {
+				t.Errorf("exit %d, want %d:\n%s", code, tt.code, out)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output lacks %q:\n%s", want, out)
+				}
+			}
+			secrets, err := client.CoreV1().Secrets(tt.namespace).List(context.Background(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, secret := range secrets.Items {
+				if strings.HasPrefix(secret.Name, "cert-sync-selfcheck-") {
+					t.Errorf("test secret %s left in %s", secret.Name, tt.namespace)
+				}
+			}
+		})
+	}
+}
+
+// The drift watcher finds the webhook configuration as installed in step,
+// exports the fields edited away from the settings, and fails readiness
+// once it is deleted.
+func TestEnvtestWebhookConfigDrift(t *testing.T) {
+	client, _ := startEnvtest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	installed := envtestWebhook().Webhooks[0]
+	expected := WebhookSettings{
+		FailurePolicy:     *installed.FailurePolicy,
+		TimeoutSeconds:    DefaultWebhookTimeoutSeconds,
+		SideEffects:       *installed.SideEffects,
+		NamespaceSelector: installed.NamespaceSelector,
+	}
+	watcher := NewWebhookConfigWatcher(logr.Discard(), client, "cert-manager-webhook", expected, 100*time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		watcher.Lead(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		watcher.Stopped()
+	}()
+	await := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(30 * time.Second); !cond(); time.Sleep(100 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: gauges %v, readiness %v", what, driftGauges(), watcher.Present(time.Now()))
+			}
+		}
+	}
+
+	// matching, the API server's defaults and all
+	await("matching", func() bool {
+		gauges := driftGauges()
+		for _, field := range driftFields {
+			if value, ok := gauges[field]; !ok || value != 0 {
+				return false
+			}
+		}
+		return watcher.Present(time.Now()) == nil
+	})
+
+	// drifted
+	configs := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	config, err := configs.Get(ctx, "cert-manager-webhook", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := int32(30)
+	config.Webhooks[0].TimeoutSeconds = &timeout
+	config.Webhooks[0].ObjectSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "gone"}}
+	if _, err := configs.Update(ctx, config, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	await("drifted", func() bool {
+		gauges := driftGauges()
+		return gauges[driftFieldTimeoutSeconds] == 1 && gauges[driftFieldObjectSelector] == 1 &&
+			gauges[driftFieldFailurePolicy] == 0 && gauges[driftFieldRules] == 0 && gauges[driftFieldSideEffects] == 0
+	})
+
+	// missing
+	if err := configs.Delete(ctx, "cert-manager-webhook", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	await("missing", func() bool { return watcher.Present(time.Now()) != nil && len(driftGauges()) == 0 })
+}
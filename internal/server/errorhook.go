@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// HTTPErrorHook posts error reports as JSON to a URL: the ErrorReport
+// itself to a generic receiver, or a Sentry event to the store endpoint of
+// a Sentry DSN.
+type HTTPErrorHook struct {
+	url    string
+	header http.Header
+	client *http.Client
+	// body renders a report as the request body.
+	body func(ErrorReport) any
+}
+
+// NewHTTPErrorHook returns a hook posting the ErrorReport to endpoint, an
+// http or https URL.
+func NewHTTPErrorHook(endpoint string) (*HTTPErrorHook, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error report URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("error report URL %q is not an http or https URL", endpoint)
+	}
+	return &HTTPErrorHook{
+		url:    u.String(),
+		header: http.Header{},
+		client: &http.Client{},
+		body:   func(report ErrorReport) any { return report },
+	}, nil
+}
+
+// NewSentryErrorHook returns a hook posting Sentry events to the project of
+// dsn, written https://<key>@<host>/<project>.
+func NewSentryErrorHook(dsn string) (*HTTPErrorHook, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error report DSN: %w", err)
+	}
+	project := path.Base(u.Path)
+	if (u.Scheme != "http" && u.Scheme != "https") || u.User == nil || u.User.Username() == "" || project == "." || project == "/" {
+		return nil, fmt.Errorf("error report DSN is not a Sentry DSN, https://<key>@<host>/<project>")
+	}
+	auth := "Sentry sentry_version=7, sentry_client=cert-manager-webhook/" + buildVersion() + ", sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	store := url.URL{Scheme: u.Scheme, Host: u.Host, Path: path.Join(path.Dir(u.Path), "api", project, "store") + "/"}
+	header := http.Header{}
+	header.Set("X-Sentry-Auth", auth)
+	return &HTTPErrorHook{
+		url:    store.String(),
+		header: header,
+		client: &http.Client{},
+		body:   sentryEvent,
+	}, nil
+}
+
+// Send posts report.
+func (h *HTTPErrorHook) Send(ctx context.Context, report ErrorReport) error {
+	body, err := json.Marshal(h.body(report))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range h.header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("error tracker answered %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// sentryEvent renders report as an event of the Sentry store API.
+func sentryEvent(report ErrorReport) any {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	level := "error"
+	if report.Kind == ErrorReportPanic {
+		level = "fatal"
+	}
+	extra := map[string]any{
+		"count":     report.Count,
+		"window":    report.Window,
+		"firstSeen": report.FirstSeen.Format(time.RFC3339),
+	}
+	if report.Stack != "" {
+		extra["stack"] = report.Stack
+	}
+	for key, value := range report.Context {
+		extra[key] = value
+	}
+	return map[string]any{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   report.Time.Format(time.RFC3339),
+		"level":       level,
+		"platform":    "go",
+		"logger":      "cert-manager-webhook",
+		"server_name": report.Replica,
+		"release":     report.Version,
+		"message":     map[string]string{"formatted": report.Message},
+		"exception": map[string]any{"values": []map[string]string{{
+			"type":  strings.ToUpper(report.Kind[:1]) + report.Kind[1:],
+			"value": report.Message,
+		}}},
+		"tags": map[string]string{
+			"kind":       report.Kind,
+			"configHash": report.ConfigHash,
+		},
+		"extra": extra,
+	}
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/time/rate"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// Kinds of error reports.
+const (
+	ErrorReportPanic    = "panic"
+	ErrorReportRepeated = "repeated"
+)
+
+// errorReportMaxFingerprints bounds the errors counted at once; past it,
+// new errors aren't counted until the windows of others end.
+const errorReportMaxFingerprints = 1000
+
+// errorReportMaxMessage bounds the message of a report.
+const errorReportMaxMessage = 2048
+
+// ErrorReport is what an ErrorHook gets about a panic in an admission
+// handler or a burst of the same admission error. Its message, stack and
+// context are scrubbed, and never hold secret data.
+type ErrorReport struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// Count is the number of occurrences in the window so far.
+	Count      int               `json:"count"`
+	Window     string            `json:"window"`
+	FirstSeen  time.Time         `json:"firstSeen"`
+	Time       time.Time         `json:"time"`
+	Version    string            `json:"version"`
+	ConfigHash string            `json:"configHash"`
+	Replica    string            `json:"replica"`
+	Stack      string            `json:"stack,omitempty"`
+	Context    map[string]string `json:"context,omitempty"`
+}
+
+// ErrorHook sends error reports to an error tracker. It is called from the
+// ErrorReporter's goroutine, never from an admission.
+type ErrorHook interface {
+	Send(ctx context.Context, report ErrorReport) error
+}
+
+// ErrorReporterConfig holds the settings of the error reporter.
+type ErrorReporterConfig struct {
+	// Threshold is the number of times the same error must occur within
+	// Window to be reported.
+	Threshold int
+	// Window both counts the occurrences of an error and deduplicates its
+	// reports: an error, or a panic, is reported at most once per window.
+	Window time.Duration
+	// QueueSize bounds the reports waiting to be sent; further ones are
+	// dropped.
+	QueueSize int
+	// Timeout of sending one report.
+	Timeout time.Duration
+}
+
+// DefaultErrorReporter reports errors seen 10 times in 5 minutes.
+func DefaultErrorReporter() ErrorReporterConfig {
+	return ErrorReporterConfig{
+		Threshold: 10,
+		Window:    5 * time.Minute,
+		QueueSize: 64,
+		Timeout:   10 * time.Second,
+	}
+}
+
+// errorBurst counts the occurrences of one error in its window.
+type errorBurst struct {
+	start    time.Time
+	count    int
+	reported bool
+}
+
+// ErrorReporter hands the panics of the admission handlers, and the
+// admission errors seen Threshold times within Window, to an ErrorHook,
+// each at most once per window. Reports are queued and sent from Run, so a
+// slow or failing tracker never holds up an admission. A nil ErrorReporter
+// reports nothing.
+type ErrorReporter struct {
+	log     logr.Logger
+	hook    ErrorHook
+	config  ErrorReporterConfig
+	version string
+	replica string
+	queue   chan ErrorReport
+	errors  rate.Sometimes // logs failed sends
+
+	// configHash returns the hash of the active settings, set by
+	// WithErrorReporter.
+	configHash func() string
+
+	mu     sync.Mutex
+	bursts map[string]*errorBurst // by fingerprint
+}
+
+func NewErrorReporter(log logr.Logger, hook ErrorHook, config ErrorReporterConfig) *ErrorReporter {
+	replica, _ := os.Hostname()
+	return &ErrorReporter{
+		log:        log,
+		hook:       hook,
+		config:     config,
+		version:    buildVersion(),
+		replica:    replica,
+		queue:      make(chan ErrorReport, config.QueueSize),
+		errors:     rate.Sometimes{First: 1, Interval: time.Minute},
+		configHash: func() string { return "" },
+		bursts:     map[string]*errorBurst{},
+	}
+}
+
+// panicked reports a panic recovered from an admission handler, with its
+// scrubbed stack and the fields of its request.
+func (r *ErrorReporter) panicked(p any, stack []byte, fields map[string]string) {
+	if r == nil {
+		return
+	}
+	message := scrubReport(fmt.Sprint(p))
+	stackTrace := scrubStack(string(stack))
+	now := time.Now()
+	// the same panic at the same place is the same one
+	count, first, report := r.seen(ErrorReportPanic+"\x00"+errorFingerprint(message)+"\x00"+panicSite(stackTrace), 1, now)
+	if !report {
+		return
+	}
+	r.enqueue(r.newReport(ErrorReportPanic, message, count, first, now, stackTrace, fields))
+}
+
+// failed counts an admission error, and reports it once it occurred
+// Threshold times in the window.
+func (r *ErrorReporter) failed(err error) {
+	if r == nil {
+		return
+	}
+	message := scrubReport(err.Error())
+	now := time.Now()
+	count, first, report := r.seen(ErrorReportRepeated+"\x00"+errorFingerprint(message), r.config.Threshold, now)
+	if !report {
+		return
+	}
+	r.enqueue(r.newReport(ErrorReportRepeated, message, count, first, now, "", nil))
+}
+
+// seen counts an occurrence of the error fingerprinted fingerprint, and
+// tells whether it is to be reported: the first time it reaches threshold
+// in its window.
+func (r *ErrorReporter) seen(fingerprint string, threshold int, now time.Time) (int, time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	burst, ok := r.bursts[fingerprint]
+	if !ok || now.Sub(burst.start) >= r.config.Window {
+		if !ok && len(r.bursts) >= errorReportMaxFingerprints {
+			for key, other := range r.bursts {
+				if now.Sub(other.start) >= r.config.Window {
+					delete(r.bursts, key)
+				}
+			}
+			if len(r.bursts) >= errorReportMaxFingerprints {
+				return 0, time.Time{}, false
+			}
+		}
+		burst = &errorBurst{start: now}
+		r.bursts[fingerprint] = burst
+	}
+	burst.count++
+	if burst.reported || burst.count < threshold {
+		return burst.count, burst.start, false
+	}
+	burst.reported = true
+	return burst.count, burst.start, true
+}
+
+func (r *ErrorReporter) newReport(kind, message string, count int, first, now time.Time, stack string, fields map[string]string) ErrorReport {
+	return ErrorReport{
+		Kind:       kind,
+		Message:    message,
+		Count:      count,
+		Window:     r.config.Window.String(),
+		FirstSeen:  first.UTC(),
+		Time:       now.UTC(),
+		Version:    r.version,
+		ConfigHash: r.configHash(),
+		Replica:    r.replica,
+		Stack:      stack,
+		Context:    fields,
+	}
+}
+
+// enqueue queues report for Run, dropping it when the queue is full.
+func (r *ErrorReporter) enqueue(report ErrorReport) {
+	select {
+	case r.queue <- report:
+	default:
+		metrics.ErrorReports.WithLabelValues("dropped").Inc()
+	}
+}
+
+// observeError keeps err as the last admission error, and counts it
+// towards a report.
+func (whsvr *WebhookServer) observeError(err error) {
+	metrics.ObserveError(err)
+	whsvr.reports.failed(err)
+}
+
+// activeConfigHash returns the hash of the settings admissions are decided
+// by.
+func (whsvr *WebhookServer) activeConfigHash() string {
+	if p := whsvr.policy.Load(); p != nil {
+		return configHash(p.config)
+	}
+	return ""
+}
+
+// Run sends the queued reports until stop is closed.
+func (r *ErrorReporter) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case report := <-r.queue:
+			ctx, cancel := context.WithTimeout(context.Background(), r.config.Timeout)
+			err := r.hook.Send(ctx, report)
+			cancel()
+			if err != nil {
+				metrics.ErrorReports.WithLabelValues("failed").Inc()
+				r.errors.Do(func() {
+					r.log.Error(err, "Failed to send an error report, further failures are logged at most once a minute", "kind", report.Kind)
+				})
+				continue
+			}
+			metrics.ErrorReports.WithLabelValues("sent").Inc()
+		}
+	}
+}
+
+var (
+	// pemBlock and base64Run match what could be key material or secret
+	// data in a message.
+	pemBlock  = regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]+-----.*?(-----END [A-Z0-9 ]+-----|$)`)
+	base64Run = regexp.MustCompile(`[A-Za-z0-9+/_-]{40,}={0,2}`)
+	// volatile matches the parts of a message that differ between
+	// occurrences of the same error: quoted names and numbers.
+	volatile = regexp.MustCompile(`"[^"]*"|'[^']*'|[0-9a-fA-F]{8,}|[0-9]+`)
+)
+
+// scrubReport elides whatever looks like key material or encoded data from
+// s, and bounds its length.
+func scrubReport(s string) string {
+	s = pemBlock.ReplaceAllString(s, redacted)
+	s = base64Run.ReplaceAllString(s, redacted)
+	if len(s) > errorReportMaxMessage {
+		s = s[:errorReportMaxMessage] + "..."
+	}
+	return s
+}
+
+// scrubStack drops the argument values of the calls of a goroutine dump,
+// which may point at secret data, keeping the functions and their lines.
+func scrubStack(stack string) string {
+	lines := strings.Split(strings.TrimSpace(stack), "\n")
+	for i, line := range lines {
+		if i == 0 || strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "created by ") || !strings.HasSuffix(line, ")") {
+			continue
+		}
+		if open := strings.LastIndex(line, "("); open > 0 {
+			lines[i] = line[:open] + "(...)"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// panicSite is the innermost call of the stack outside the runtime, where
+// the panic happened.
+func panicSite(stack string) string {
+	for _, line := range strings.Split(stack, "\n") {
+		if line == "" || strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "goroutine ") ||
+			strings.HasPrefix(line, "runtime") || strings.HasPrefix(line, "panic(") ||
+			strings.HasPrefix(line, "github.com/bygui86/cert-manager-webhook/internal/server.recoverAdmission") {
+			continue
+		}
+		return line
+	}
+	return ""
+}
+
+// errorFingerprint identifies an error message regardless of the names
+// and numbers in it, so that the same failure on different secrets counts
+// as one error.
+func errorFingerprint(message string) string {
+	return volatile.ReplaceAllString(message, "_")
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Event reasons recorded on secrets.
+const (
+	eventAnnotated = "CertSyncAnnotated"
+	eventSkipped   = "CertSyncSkipped"
+	eventError     = "CertSyncError"
+	eventDenied    = "CertSyncDeleteDenied"
+	eventTargets   = "CertSyncTargetsDenied"
+	eventInvalid   = "CertSyncInvalidPatch"
+)
+
+// EventRecorder records Kubernetes Events on the objects the webhook
+// handles. The broadcaster queues events and writes them from its own
+// goroutine, dropping them rather than blocking when it falls behind, and
+// its correlator aggregates repeats and rate limits each secret so a hot
+// loop can't flood etcd.
+type EventRecorder struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+}
+
+func NewEventRecorder(log logr.Logger, client kubernetes.Interface) *EventRecorder {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		// a burst of 5 events per secret, then one every 5 minutes
+		BurstSize: 5,
+		QPS:       1. / 300,
+	})
+	broadcaster.StartRecordingToSink(retryingEventSink{sink: &typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")}})
+	broadcaster.StartEventWatcher(func(e *corev1.Event) {
+		log.V(1).Info("Event", "reason", e.Reason, "namespace", e.InvolvedObject.Namespace, "name", e.InvolvedObject.Name, "message", e.Message)
+	})
+	return &EventRecorder{
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "cert-manager-webhook"}),
+	}
+}
+
+// record queues an event on the object under review. It is a no-op on a nil
+// recorder and for dry-run requests, which must stay free of side effects.
+func (e *EventRecorder) record(req *v1beta1.AdmissionRequest, name, eventType, reason, messageFmt string, args ...interface{}) {
+	if e == nil || (req.DryRun != nil && *req.DryRun) {
+		return
+	}
+	ref := &corev1.ObjectReference{
+		Kind:       req.Kind.Kind,
+		APIVersion: schema.GroupVersion{Group: req.Kind.Group, Version: req.Kind.Version}.String(),
+		Namespace:  req.Namespace,
+		Name:       name,
+	}
+	e.recorder.Event(ref, eventType, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+// Shutdown flushes queued events and stops the broadcaster.
+func (e *EventRecorder) Shutdown() {
+	if e != nil {
+		e.broadcaster.Shutdown()
+	}
+}
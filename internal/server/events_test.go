@@ -0,0 +1,123 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakeEvents returns an event recorder writing to a fake recorder.
+func fakeEvents() (*EventRecorder, *record.FakeRecorder) {
+	fake := record.NewFakeRecorder(10)
+	return &EventRecorder{broadcaster: record.NewBroadcaster(), recorder: fake}, fake
+}
+
+// recorded returns the events the fake recorder got so far.
+func recorded(fake *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-fake.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		review func(t *testing.T) *v1beta1.AdmissionReview
+		event  string // prefix of the one event recorded, none if empty
+	}{
+		{
+			name:   "mutated",
+			review: reviewOf("tls", "apps"),
+			event:  corev1.EventTypeNormal + " " + eventAnnotated + " Annotated ",
+		},
+		{
+			name: "error",
+			review: func(t *testing.T) *v1beta1.AdmissionReview {
+				review := secretReview(t, "broken", "apps")
+				review.Request.Object.Raw = []byte(`{"apiVersion":"v1","kind":"Secret","metadata":"broken"}`)
+				return review
+			},
+			event: corev1.EventTypeWarning + " " + eventError + " Could not decode secret",
+		},
+		{
+			name:   "not worth an event",
+			review: reviewOf("skipped", metav1.NamespaceSystem),
+		},
+		{
+			name: "dry run",
+			review: func(t *testing.T) *v1beta1.AdmissionReview {
+				review := secretReview(t, "tls", "apps")
+				dryRun := true
+				review.Request.DryRun = &dryRun
+				return review
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, fake := fakeEvents()
+			admit(t, newDefaultServer(WithEventRecorder(events)), tt.review(t))
+			got := recorded(fake)
+			if tt.event == "" {
+				if len(got) != 0 {
+					t.Errorf("events recorded: %v", got)
+				}
+				return
+			}
+			if len(got) != 1 || !strings.HasPrefix(got[0], tt.event) {
+				t.Errorf("events %q, want one starting with %q", got, tt.event)
+			}
+		})
+	}
+}
+
+// A hot loop on one secret writes a burst of events to the API server,
+// then nothing more.
+func TestEventsRateLimited(t *testing.T) {
+	client := fake.NewClientset()
+	events := NewEventRecorder(logr.Discard(), client)
+	defer events.Shutdown()
+	review := secretReview(t, "tls", "apps")
+
+	for i := range 50 {
+		events.record(review.Request, "tls", corev1.EventTypeWarning, eventError, "Could not create patch: attempt %d", i)
+	}
+	// the burst of 5 is written, the spam filter drops the rest
+	writes := func() int {
+		n := 0
+		for _, action := range client.Actions() {
+			if action.GetResource().Resource == "events" && action.GetVerb() != "list" {
+				n++
+			}
+		}
+		return n
+	}
+	waitFor(t, func() bool { return writes() >= 5 })
+	events.Shutdown()
+	if n := writes(); n != 5 {
+		t.Errorf("%d event writes for 50 events, want the burst of 5", n)
+	}
+}
+
+// waitFor polls cond for up to five seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// Secrets as cert-manager v1.14 leaves them in a cluster issuing through
+// Let's Encrypt, trimmed of their data and server-set fields.
+const (
+	// the next private key of Certificate api-tls, kept between issuances
+	nextPrivateKeySecret = `{"apiVersion":"v1","kind":"Secret","type":"Opaque",
+		"metadata":{"name":"api-tls-x7k2p","namespace":"payments",
+			"labels":{"cert-manager.io/next-private-key":"true"},
+			"ownerReferences":[{"apiVersion":"cert-manager.io/v1","kind":"Certificate","name":"api-tls","uid":"3f0c9a52-6f1e-4b8e-9d6a-2c1b7e5a4d10","controller":true,"blockOwnerDeletion":true}]},
+		"data":{"tls.key":"a2V5"}}`
+	// the key of a pending issuance, owned by its CertificateRequest
+	requestOwnedSecret = `{"apiVersion":"v1","kind":"Secret","type":"kubernetes.io/tls",
+		"metadata":{"name":"api-tls-1-key","namespace":"payments",
+			"ownerReferences":[{"apiVersion":"cert-manager.io/v1","kind":"CertificateRequest","name":"api-tls-1","uid":"9b2d4e61-0a7c-4f3b-8e15-6d9c2a0f7b34","controller":true,"blockOwnerDeletion":true}]},
+		"data":{"tls.crt":"","tls.key":"a2V5"}}`
+	// the key of an ACME order's finalization, owned by the Order
+	orderOwnedSecret = `{"apiVersion":"v1","kind":"Secret","type":"kubernetes.io/tls",
+		"metadata":{"name":"api-tls-1-2938475610","namespace":"payments",
+			"ownerReferences":[{"apiVersion":"acme.cert-manager.io/v1","kind":"Order","name":"api-tls-1-2938475610","uid":"c47e1f08-5b3a-4d92-a6e0-81f3b9d2c5e7","controller":true,"blockOwnerDeletion":true}]},
+		"data":{"tls.crt":"","tls.key":"a2V5"}}`
+	// the CA the webhook's serving certificates are issued by
+	webhookCASecret = `{"apiVersion":"v1","kind":"Secret","type":"kubernetes.io/tls",
+		"metadata":{"name":"cert-manager-webhook-ca","namespace":"cert-manager",
+			"annotations":{"cert-manager.io/allow-direct-injection":"true"}},
+		"data":{"ca.crt":"Y2E=","tls.crt":"Y2E=","tls.key":"a2V5"}}`
+	// the ACME account key named in ClusterIssuer letsencrypt-prod
+	accountKeySecret = `{"apiVersion":"v1","kind":"Secret","type":"kubernetes.io/tls",
+		"metadata":{"name":"letsencrypt-prod-account-key","namespace":"cert-manager"},
+		"data":{"tls.crt":"","tls.key":"a2V5"}}`
+	// the certificate issued for Certificate api-tls, created with
+	// --enable-certificate-owner-ref
+	issuedSecret = `{"apiVersion":"v1","kind":"Secret","type":"kubernetes.io/tls",
+		"metadata":{"name":"api-tls","namespace":"payments",
+			"annotations":{"cert-manager.io/alt-names":"api.example.com","cert-manager.io/certificate-name":"api-tls",
+				"cert-manager.io/common-name":"api.example.com","cert-manager.io/issuer-group":"cert-manager.io",
+				"cert-manager.io/issuer-kind":"ClusterIssuer","cert-manager.io/issuer-name":"letsencrypt-prod"},
+			"ownerReferences":[{"apiVersion":"cert-manager.io/v1","kind":"Certificate","name":"api-tls","uid":"3f0c9a52-6f1e-4b8e-9d6a-2c1b7e5a4d10","controller":true,"blockOwnerDeletion":true}]},
+		"data":{"ca.crt":"","tls.crt":"Y2VydA==","tls.key":"a2V5"}}`
+)
+
+// capturedSecret decodes a secret captured from a cluster.
+func capturedSecret(t *testing.T, manifest string) *corev1.Secret {
+	t.Helper()
+	var secret corev1.Secret
+	if err := json.Unmarshal([]byte(manifest), &secret); err != nil {
+		t.Fatal(err)
+	}
+	return &secret
+}
+
+// cert-manager's temporary and internal secrets are passed through
+// unmodified, whatever their type, each counted under its own skip reason,
+// while the certificates it issues are still synced.
+func TestCertManagerExclusions(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		manifest string
+		settings string // of the policy stage, the defaults when empty
+		reason   string // "" when mutated
+	}{
+		{name: "next private key", manifest: nextPrivateKeySecret, reason: mutator.SkipNextPrivateKey},
+		{name: "owned by a certificate request", manifest: requestOwnedSecret, reason: mutator.SkipIssuanceOwned},
+		{name: "owned by an order", manifest: orderOwnedSecret, reason: mutator.SkipIssuanceOwned},
+		{name: "webhook ca", manifest: webhookCASecret, reason: mutator.SkipProtectedName},
+		{name: "account key by name", manifest: accountKeySecret, settings: `{"protectedNames":["letsencrypt-prod-account-key"]}`, reason: mutator.SkipProtectedName},
+		{name: "account key by namespace and name", manifest: accountKeySecret, settings: `{"protectedNames":["cert-manager/letsencrypt-prod-account-key"]}`, reason: mutator.SkipProtectedName},
+		{name: "account key unprotected", manifest: accountKeySecret},
+		{name: "account key in another namespace", manifest: accountKeySecret, settings: `{"protectedNames":["payments/letsencrypt-prod-account-key"]}`},
+		{name: "webhook ca no longer protected", manifest: webhookCASecret, settings: `{"protectedNames":[]}`},
+		{name: "issued certificate", manifest: issuedSecret},
+		{name: "issued certificate of the same name", manifest: issuedSecret, settings: `{"protectedNames":["cert-manager/api-tls"]}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			if tt.settings != "" {
+				config.Mutator.StageConfig = map[string]json.RawMessage{mutator.PolicyStage: json.RawMessage(tt.settings)}
+			}
+			handler := newTestHandler(t, config)
+			counted := metrics.Skips.WithLabelValues(tt.reason)
+			before := testutil.ToFloat64(counted)
+
+			_, response := admitSecret(t, handler, capturedSecret(t, tt.manifest))
+			if !response.Allowed {
+				t.Fatalf("denied with %+v", response.Result)
+			}
+			if mutated := len(response.Patch) != 0; mutated != (tt.reason == "") {
+				t.Errorf("patch %s, want skipped for %q", response.Patch, tt.reason)
+			}
+			if tt.reason == "" {
+				return
+			}
+			if got := testutil.ToFloat64(counted) - before; got != 1 {
+				t.Errorf("%v more skips counted %s, want 1", got, tt.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// FaultInjector delays or fails a random share of admission requests at
+// the handler boundary, to rehearse how the API server copes with a slow
+// or broken webhook. Every injected fault is logged and counted as such.
+type FaultInjector struct {
+	log            logr.Logger
+	latency        time.Duration
+	latencyPercent float64
+	errorPercent   float64
+}
+
+func NewFaultInjector(log logr.Logger, latency time.Duration, latencyPercent, errorPercent float64) (*FaultInjector, error) {
+	for _, p := range []float64{latencyPercent, errorPercent} {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid fault injection percentage %v, expect 0 to 100", p)
+		}
+	}
+	return &FaultInjector{
+		log:            log,
+		latency:        latency,
+		latencyPercent: latencyPercent,
+		errorPercent:   errorPercent,
+	}, nil
+}
+
+func (f *FaultInjector) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := requestIDFrom(r.Context())
+		if f.latency > 0 && rand.Float64()*100 < f.latencyPercent {
+			metrics.InjectedFaults.WithLabelValues("latency").Inc()
+			f.log.Info("Injected fault: latency", "injected", true, "latency", f.latency.String(), "requestID", requestID)
+			select {
+			case <-time.After(f.latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if rand.Float64()*100 < f.errorPercent {
+			metrics.InjectedFaults.WithLabelValues("error").Inc()
+			f.log.Info("Injected fault: error", "injected", true, "requestID", requestID)
+			http.Error(w, "injected fault", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
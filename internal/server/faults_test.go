@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"k8s.io/api/admission/v1beta1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// Over many requests, the share of faults injected is close to the
+// percentages asked for, and each is counted and logged as injected.
+func TestFaultSampling(t *testing.T) {
+	const requests = 20000
+	core, logs := observer.New(zapcore.InfoLevel)
+	faults, err := NewFaultInjector(zapr.NewLogger(zap.New(core)), time.Nanosecond, 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := 0
+	handler := faults.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served++ }))
+	latencies := metrics.InjectedFaults.WithLabelValues("latency")
+	errs := metrics.InjectedFaults.WithLabelValues("error")
+	latencyBefore, errorsBefore := testutil.ToFloat64(latencies), testutil.ToFloat64(errs)
+
+	failed := 0
+	for range requests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/mutate", nil))
+		if rec.Code == http.StatusInternalServerError {
+			failed++
+		}
+	}
+
+	delayed := int(testutil.ToFloat64(latencies) - latencyBefore)
+	// within about 5 standard deviations, a false failure is out of reach
+	for _, tt := range []struct {
+		fault       string
+		got, lo, hi int
+	}{
+		{fault: "latency", got: delayed, lo: 1800, hi: 2200},
+		{fault: "error", got: failed, lo: 850, hi: 1150},
+	} {
+		if tt.got < tt.lo || tt.got > tt.hi {
+			t.Errorf("%d of %d requests with injected %s, want %d to %d", tt.got, requests, tt.fault, tt.lo, tt.hi)
+		}
+	}
+	if got := int(testutil.ToFloat64(errs) - errorsBefore); got != failed {
+		t.Errorf("%d injected errors counted, %d answered", got, failed)
+	}
+	if served+failed != requests {
+		t.Errorf("%d requests served and %d failed of %d", served, failed, requests)
+	}
+	for _, line := range logs.All() {
+		if line.ContextMap()["injected"] != true {
+			t.Fatalf("fault logged without injected=true: %v", line.ContextMap())
+		}
+	}
+	if logs.Len() != delayed+failed {
+		t.Errorf("%d fault lines, want %d", logs.Len(), delayed+failed)
+	}
+}
+
+func TestFaultLatency(t *testing.T) {
+	const latency = 30 * time.Millisecond
+	faults, err := NewFaultInjector(logr.Discard(), latency, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := false
+	handler := faults.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true }))
+
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/mutate", nil))
+	if elapsed := time.Since(start); elapsed < latency || !served {
+		t.Errorf("served %v after %v, want after the injected %v", served, elapsed, latency)
+	}
+
+	// a client giving up ends the delay without an answer
+	served = false
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/mutate", nil).WithContext(ctx))
+	if served {
+		t.Error("request of a gone client served")
+	}
+}
+
+func TestFaultPercentages(t *testing.T) {
+	for _, percentages := range [][2]float64{{-1, 0}, {0, 101}} {
+		if _, err := NewFaultInjector(logr.Discard(), time.Second, percentages[0], percentages[1]); err == nil {
+			t.Errorf("percentages %v accepted", percentages)
+		}
+	}
+}
+
+// Faults are injected before the admission pipeline: an injected error
+// isn't counted as an admission result.
+func TestFaultAtHandlerBoundary(t *testing.T) {
+	faults, err := NewFaultInjector(logr.Discard(), 0, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	whsvr := newDefaultServer()
+	handler := faults.wrap(RequestID(http.HandlerFunc(whsvr.serve)))
+	admissions := func() float64 {
+		n := 0.
+		for _, operation := range []string{"", string(v1beta1.Create)} {
+			for _, result := range []string{metrics.ResultMutated, metrics.ResultErrored} {
+				n += testutil.ToFloat64(metrics.Requests.WithLabelValues("/mutate", operation, result))
+			}
+		}
+		return n
+	}
+	before := admissions()
+
+	body, err := json.Marshal(secretReview(t, "tls", "apps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("answered %d, want the injected 500", rec.Code)
+	}
+	if got := admissions() - before; got != 0 {
+		t.Errorf("injected error counted as %v admissions", got)
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+// certManagerUser is the identity cert-manager writes secrets with.
+const certManagerUser = "system:serviceaccount:cert-manager:cert-manager"
+
+// FixtureSecret describes a synthetic cert-manager TLS secret.
+type FixtureSecret struct {
+	Name      string
+	Namespace string
+	DataSize  int  // bytes in each of tls.crt and tls.key
+	Synced    bool // already carries the sync annotation
+	Bare      bool // has no annotations but the sync one, unlike cert-manager's
+}
+
+// Build returns the secret as cert-manager would create it.
+func (f FixtureSecret) Build() *corev1.Secret {
+	secret := &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      f.Name,
+			Namespace: f.Namespace,
+			Annotations: map[string]string{
+				certManagerAnnotationKey:      f.Name,
+				"cert-manager.io/issuer-name": "fixture-issuer",
+				"cert-manager.io/issuer-kind": "Issuer",
+			},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       bytes.Repeat([]byte("c"), f.DataSize),
+			corev1.TLSPrivateKeyKey: bytes.Repeat([]byte("k"), f.DataSize),
+		},
+	}
+	if f.Bare {
+		secret.Annotations = nil
+	}
+	if f.Synced {
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		secret.Annotations[syncAnnotationKey] = "true"
+	}
+	return secret
+}
+
+// FixtureReview wraps secret in an AdmissionReview as the API server sends
+// it for operation, with a fresh UID. A DELETE review carries the secret as
+// the old object only.
+func FixtureReview(secret *corev1.Secret, operation v1beta1.Operation, dryRun bool) (*v1beta1.AdmissionReview, error) {
+	raw, err := json.Marshal(secret)
+	if err != nil {
+		return nil, err
+	}
+	request := &v1beta1.AdmissionRequest{
+		UID:       uuid.NewUUID(),
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "secrets"},
+		Namespace: secret.Namespace,
+		Name:      secret.Name,
+		Operation: operation,
+		UserInfo:  authenticationv1.UserInfo{Username: certManagerUser},
+		Object:    runtime.RawExtension{Raw: raw},
+		DryRun:    &dryRun,
+	}
+	switch operation {
+	case v1beta1.Update:
+		request.OldObject = runtime.RawExtension{Raw: raw}
+	case v1beta1.Delete:
+		request.Object, request.OldObject = runtime.RawExtension{}, runtime.RawExtension{Raw: raw}
+	}
+	return &v1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+		Request:  request,
+	}, nil
+}
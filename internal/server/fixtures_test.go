@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestFixtureSecret(t *testing.T) {
+	secret := FixtureSecret{Name: "tls", Namespace: "apps", DataSize: 100}.Build()
+	if secret.Type != corev1.SecretTypeTLS || len(secret.Data[corev1.TLSCertKey]) != 100 || len(secret.Data[corev1.TLSPrivateKeyKey]) != 100 {
+		t.Errorf("secret of type %s with %d and %d bytes, want a TLS secret with 100 each",
+			secret.Type, len(secret.Data[corev1.TLSCertKey]), len(secret.Data[corev1.TLSPrivateKeyKey]))
+	}
+	if secret.Annotations[certManagerAnnotationKey] != "tls" {
+		t.Errorf("annotations %v, want cert-manager's", secret.Annotations)
+	}
+	if _, ok := secret.Annotations[syncAnnotationKey]; ok {
+		t.Error("secret synced without Synced")
+	}
+
+	synced := FixtureSecret{Name: "tls", Namespace: "apps", Synced: true, Bare: true}.Build()
+	if len(synced.Annotations) != 1 || synced.Annotations[syncAnnotationKey] != "true" {
+		t.Errorf("bare synced secret annotations %v, want the sync one only", synced.Annotations)
+	}
+}
+
+func TestFixtureReview(t *testing.T) {
+	secret := FixtureSecret{Name: "tls", Namespace: "apps", DataSize: 16}.Build()
+	create, err := FixtureReview(secret, v1beta1.Create, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, err := FixtureReview(secret, v1beta1.Update, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if create.Request.UID == update.Request.UID {
+		t.Error("reviews share a UID")
+	}
+	if len(create.Request.OldObject.Raw) != 0 || len(update.Request.OldObject.Raw) == 0 {
+		t.Error("the old object is only sent with an UPDATE")
+	}
+	if *create.Request.DryRun || !*update.Request.DryRun {
+		t.Error("dry run flag not set as asked")
+	}
+	var decoded corev1.Secret
+	if err := json.Unmarshal(update.Request.Object.Raw, &decoded); err != nil || decoded.Name != secret.Name {
+		t.Errorf("object %s doesn't decode to the secret: %v", update.Request.Object.Raw, err)
+	}
+}
+
+// Every fixture bench can send is admitted and patched, as cert-manager's
+// secrets are: bench measures the full mutation path.
+func TestFixturesAdmitted(t *testing.T) {
+	whsvr := newDefaultServer()
+	for _, fixture := range []FixtureSecret{
+		{Name: "fresh", Namespace: "apps", DataSize: 16},
+		{Name: "synced", Namespace: "apps", DataSize: 16, Synced: true},
+		{Name: "bare", Namespace: "apps", DataSize: 16, Bare: true},
+	} {
+		for _, operation := range []v1beta1.Operation{v1beta1.Create, v1beta1.Update} {
+			review, err := FixtureReview(fixture.Build(), operation, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := admit(t, whsvr, review)
+			if !response.Allowed || len(response.Patch) == 0 {
+				t.Errorf("%s %s: allowed %v with patch %s", operation, fixture.Name, response.Allowed, response.Patch)
+			}
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// skipFrozen is the skip reason of the admissions answered without their
+// patch during a change freeze.
+const skipFrozen = "change-freeze"
+
+// freezeMaxWindow bounds the duration of a cron window, and so how far
+// back its start is looked for.
+const freezeMaxWindow = 366 * 24 * time.Hour
+
+// freezeRefreshInterval is how often WatchFreeze looks for the start and
+// end of the windows between admissions.
+const freezeRefreshInterval = 10 * time.Second
+
+// FreezeConfig holds the change freeze windows, during which admissions are
+// evaluated, logged and recorded as usual but answered without their patch.
+type FreezeConfig struct {
+	// Timezone the cron windows are evaluated in, an IANA name; UTC when
+	// empty.
+	Timezone string
+	// Windows are each either an RFC3339 interval, "<start>/<end>", or a
+	// cron expression followed by a duration, "<minute> <hour> <day of
+	// month> <month> <day of week> <duration>", e.g. "0 18 * * FRI 60h" for
+	// the weekends from Friday 18:00.
+	Windows []string
+}
+
+// freezeMatch is the window a time falls in.
+type freezeMatch struct {
+	Window string
+	Start  time.Time
+	End    time.Time
+}
+
+// freezeWindow is a parsed window of a FreezeConfig.
+type freezeWindow interface {
+	// activeAt returns the occurrence of the window t falls in.
+	activeAt(t time.Time) (freezeMatch, bool)
+}
+
+// freezeSchedule is the parsed windows of a FreezeConfig. It is immutable,
+// part of the policy.
+type freezeSchedule struct {
+	windows []freezeWindow
+}
+
+// parseFreeze parses the windows of config, nil when it has none.
+func parseFreeze(config FreezeConfig) (*freezeSchedule, error) {
+	if len(config.Windows) == 0 {
+		return nil, nil
+	}
+	loc := time.UTC
+	if config.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(config.Timezone); err != nil {
+			return nil, fmt.Errorf("freeze timezone: %w", err)
+		}
+	}
+	schedule := &freezeSchedule{}
+	for _, spec := range config.Windows {
+		window, err := parseFreezeWindow(strings.TrimSpace(spec), loc)
+		if err != nil {
+			return nil, fmt.Errorf("freeze window %q: %w", spec, err)
+		}
+		schedule.windows = append(schedule.windows, window)
+	}
+	return schedule, nil
+}
+
+func parseFreezeWindow(spec string, loc *time.Location) (freezeWindow, error) {
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 1:
+		start, end, ok := strings.Cut(spec, "/")
+		if !ok {
+			return nil, fmt.Errorf("an interval is written <start>/<end>")
+		}
+		window := intervalWindow{spec: spec}
+		var err error
+		if window.start, err = time.Parse(time.RFC3339, start); err != nil {
+			return nil, err
+		}
+		if window.end, err = time.Parse(time.RFC3339, end); err != nil {
+			return nil, err
+		}
+		if !window.end.After(window.start) {
+			return nil, fmt.Errorf("the interval ends before it starts")
+		}
+		return window, nil
+	case 6:
+		return parseCronWindow(spec, fields, loc)
+	}
+	return nil, fmt.Errorf("neither an RFC3339 interval nor a cron expression with a duration")
+}
+
+// intervalWindow is a window between two fixed times.
+type intervalWindow struct {
+	spec       string
+	start, end time.Time
+}
+
+func (w intervalWindow) activeAt(t time.Time) (freezeMatch, bool) {
+	if t.Before(w.start) || !t.Before(w.end) {
+		return freezeMatch{}, false
+	}
+	return freezeMatch{Window: w.spec, Start: w.start, End: w.end}, true
+}
+
+// cronWindow is a window starting on every minute a cron expression
+// matches, in loc, and lasting duration.
+type cronWindow struct {
+	spec                                   string
+	minutes, hours, days, months, weekdays uint64 // bit per matching value
+	anyDay, anyWeekday                     bool   // the fields were "*"
+	duration                               time.Duration
+	loc                                    *time.Location
+}
+
+var (
+	cronMonths   = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+	cronWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+)
+
+func parseCronWindow(spec string, fields []string, loc *time.Location) (*cronWindow, error) {
+	window := &cronWindow{
+		spec:       spec,
+		anyDay:     strings.HasPrefix(fields[2], "*"),
+		anyWeekday: strings.HasPrefix(fields[4], "*"),
+		loc:        loc,
+	}
+	var err error
+	if window.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if window.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if window.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if window.months, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	// 7 is Sunday too
+	if window.weekdays, err = parseCronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	if window.weekdays&(1<<7) != 0 {
+		window.weekdays |= 1
+	}
+	if window.duration, err = time.ParseDuration(fields[5]); err != nil {
+		return nil, err
+	}
+	if window.duration < time.Minute || window.duration > freezeMaxWindow {
+		return nil, fmt.Errorf("duration %s out of range, from 1m to %s", window.duration, freezeMaxWindow)
+	}
+	return window, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and
+// steps between min and max, written as numbers or, from min, names.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		values, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+		lo, hi := min, max
+		if values != "*" {
+			first, last, isRange := strings.Cut(values, "-")
+			var err error
+			if lo, err = cronValue(first, min, max, names); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = cronValue(last, min, max, names); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("range %q ends before it starts", values)
+			}
+		}
+		for value := lo; value <= hi; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(text string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(text, name) {
+			return min + i, nil
+		}
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("invalid value %q, from %d to %d", text, min, max)
+	}
+	return value, nil
+}
+
+// activeAt looks for the last start of the window within its duration
+// before t, skipping the days and hours that don't match.
+func (w *cronWindow) activeAt(t time.Time) (freezeMatch, bool) {
+	t = t.In(w.loc)
+	earliest := t.Add(-w.duration)
+	for at := t.Truncate(time.Minute); at.After(earliest); {
+		year, month, day := at.Date()
+		switch {
+		case !w.dayMatches(at):
+			at = time.Date(year, month, day, 0, 0, 0, 0, w.loc).Add(-time.Minute)
+		case w.hours&(1<<at.Hour()) == 0:
+			at = time.Date(year, month, day, at.Hour(), 0, 0, 0, w.loc).Add(-time.Minute)
+		case w.minutes&(1<<at.Minute()) == 0:
+			at = at.Add(-time.Minute)
+		default:
+			return freezeMatch{Window: w.spec, Start: at, End: at.Add(w.duration)}, true
+		}
+	}
+	return freezeMatch{}, false
+}
+
+// dayMatches tells whether the cron expression matches the day of t: as in
+// cron, either of the day of month and day of week does when both are set.
+func (w *cronWindow) dayMatches(t time.Time) bool {
+	if w.months&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	day := w.days&(1<<t.Day()) != 0
+	weekday := w.weekdays&(1<<int(t.Weekday())) != 0
+	if w.anyDay || w.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// activeAt returns the window t falls in, the one ending last when it
+// falls in several. It is nil-safe.
+func (s *freezeSchedule) activeAt(t time.Time) (freezeMatch, bool) {
+	if s == nil {
+		return freezeMatch{}, false
+	}
+	var found freezeMatch
+	active := false
+	for _, window := range s.windows {
+		if match, ok := window.activeAt(t); ok && (!active || match.End.After(found.End)) {
+			found, active = match, true
+		}
+	}
+	return found, active
+}
+
+// frozen returns the freeze window the admissions of p fall in now, and
+// logs and exports its start and end.
+func (whsvr *WebhookServer) frozen(p *policy) (freezeMatch, bool) {
+	var match freezeMatch
+	active := false
+	if p != nil {
+		match, active = p.freeze.activeAt(whsvr.clock.Now())
+	}
+	window := ""
+	if active {
+		window = match.Window
+	}
+	last := whsvr.freezeWindow.Load()
+	if last != nil && *last == window {
+		return match, active
+	}
+	if !whsvr.freezeWindow.CompareAndSwap(last, &window) {
+		// another admission saw the change
+		return match, active
+	}
+	switch {
+	case active:
+		whsvr.log.Info("Change freeze started, admissions are evaluated but not patched", "window", window, "until", match.End.Format(time.RFC3339))
+		metrics.FreezeActive.Set(1)
+	case last != nil:
+		whsvr.log.Info("Change freeze ended, patching again", "window", *last)
+		metrics.FreezeActive.Set(0)
+	default:
+		metrics.FreezeActive.Set(0)
+	}
+	return match, active
+}
+
+// frozenError defers a write of a leader's controller to the end of the
+// change freeze window it fell in.
+type frozenError struct {
+	match freezeMatch
+}
+
+func (e *frozenError) Error() string {
+	return fmt.Sprintf("change freeze %q active until %s", e.match.Window, e.match.End.Format(time.RFC3339))
+}
+
+// frozenResponse answers an admission evaluated to patch during a change
+// freeze: the decision is logged and recorded as skipped, with the rule and
+// patch it would have applied, and the object is admitted unchanged. No
+// event is recorded, the object isn't changed.
+func (whsvr *WebhookServer) frozenResponse(log logr.Logger, entry auditEntry, rule string, patch []mutator.PatchOperation,
+	warnings []string, match freezeMatch) *v1beta1.AdmissionResponse {
+	if whsvr.sampler.sample(log, entry.Namespace, entry.Name, decisionSkipped+"/"+skipFrozen) {
+		log.Info("Not patching during change freeze", "window", match.Window, "rule", rule, "patchOperations", len(patch))
+	}
+	if debug := log.V(1); debug.Enabled() {
+		debug.Info("Patch", "patch", redactedPatch(patch))
+	}
+	entry.Decision = decisionSkipped
+	entry.SkipReason = skipFrozen
+	entry.MatchedRule = rule
+	entry.Patch = whsvr.patchSummary(patch)
+	metrics.ObserveSkip(skipFrozen)
+	whsvr.recordDecision(entry)
+	return &v1beta1.AdmissionResponse{
+		Allowed:  true,
+		Warnings: warnings,
+	}
+}
+
+// freezeStatus is the freeze state served on /debug/config.
+type freezeStatus struct {
+	Active bool       `json:"active"`
+	Window string     `json:"window,omitempty"`
+	Start  *time.Time `json:"start,omitempty"`
+	End    *time.Time `json:"end,omitempty"`
+}
+
+func (whsvr *WebhookServer) freezeStatus(p *policy) freezeStatus {
+	match, active := p.freeze.activeAt(whsvr.clock.Now())
+	if !active {
+		return freezeStatus{}
+	}
+	return freezeStatus{Active: true, Window: match.Window, Start: &match.Start, End: &match.End}
+}
+
+// FreezeNote tells, for the /readyz output, when a change freeze is
+// active; it doesn't fail readiness, admissions are still answered.
+func (whsvr *WebhookServer) FreezeNote() string {
+	match, active := whsvr.frozen(whsvr.policy.Load())
+	if !active {
+		return ""
+	}
+	return fmt.Sprintf("change freeze %q active until %s, admissions are evaluated but not patched",
+		match.Window, match.End.Format(time.RFC3339))
+}
+
+// WatchFreeze logs and exports the start and end of the freeze windows
+// between admissions, until stop is closed.
+func (whsvr *WebhookServer) WatchFreeze(stop <-chan struct{}) {
+	ticker := time.NewTicker(freezeRefreshInterval)
+	defer ticker.Stop()
+	for {
+		whsvr.frozen(whsvr.policy.Load())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
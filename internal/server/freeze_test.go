@@ -0,0 +1,384 @@
+package server
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+func TestParseFreeze(t *testing.T) {
+	if schedule, err := parseFreeze(FreezeConfig{Timezone: "Europe/Rome"}); schedule != nil || err != nil {
+		t.Errorf("no windows: %v, %v", schedule, err)
+	}
+	schedule, err := parseFreeze(FreezeConfig{Timezone: "Europe/Rome", Windows: []string{
+		"2026-12-24T00:00:00+01:00/2027-01-07T00:00:00+01:00",
+		" 0 18 * * FRI 60h ",
+		"*/15 9-17 1,15 jan-mar,DEC 1-5 10m",
+	}})
+	if err != nil || len(schedule.windows) != 3 {
+		t.Fatalf("%v, %v", schedule, err)
+	}
+
+	for _, tt := range []struct {
+		config FreezeConfig
+		want   string
+	}{
+		{config: FreezeConfig{Timezone: "Mars/Olympus", Windows: []string{"0 18 * * FRI 60h"}}, want: "freeze timezone"},
+		{config: FreezeConfig{Windows: []string{"2026-10-19T06:00:00Z/2026-10-16T18:00:00Z"}}, want: "the interval ends before it starts"},
+		{config: FreezeConfig{Windows: []string{"2026-10-16T18:00:00Z"}}, want: "an interval is written <start>/<end>"},
+		{config: FreezeConfig{Windows: []string{"2026-10-16/2026-10-19"}}, want: `parsing time "2026-10-16"`},
+		{config: FreezeConfig{Windows: []string{"0 18 * * FRI"}}, want: "neither an RFC3339 interval nor a cron expression with a duration"},
+		{config: FreezeConfig{Windows: []string{"60 18 * * FRI 1h"}}, want: `minute: invalid value "60", from 0 to 59`},
+		{config: FreezeConfig{Windows: []string{"0 24 * * FRI 1h"}}, want: "hour: invalid value"},
+		{config: FreezeConfig{Windows: []string{"0 18 0 * * 1h"}}, want: "day of month: invalid value"},
+		{config: FreezeConfig{Windows: []string{"0 18 * 13 * 1h"}}, want: "month: invalid value"},
+		{config: FreezeConfig{Windows: []string{"0 18 * * FRX 1h"}}, want: `day of week: invalid value "FRX"`},
+		{config: FreezeConfig{Windows: []string{"*/0 18 * * FRI 1h"}}, want: `minute: invalid step "0"`},
+		{config: FreezeConfig{Windows: []string{"0 18-9 * * * 1h"}}, want: `hour: range "18-9" ends before it starts`},
+		{config: FreezeConfig{Windows: []string{"0 18 * * FRI sixty"}}, want: `invalid duration "sixty"`},
+		{config: FreezeConfig{Windows: []string{"0 18 * * FRI 30s"}}, want: "duration 30s out of range"},
+		{config: FreezeConfig{Windows: []string{"0 18 * * FRI 9000h"}}, want: "duration 9000h0m0s out of range"},
+	} {
+		if _, err := parseFreeze(tt.config); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: error %v, want %q", tt.config.Windows, err, tt.want)
+		}
+	}
+}
+
+// freezeAt returns whether schedule is active at the time, written
+// RFC3339, and the occurrence it falls in.
+func freezeAt(t *testing.T, schedule *freezeSchedule, at string) (freezeMatch, bool) {
+	t.Helper()
+	now, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schedule.activeAt(now)
+}
+
+// The cron windows start on the minutes they match in their timezone and
+// last their duration, across days; the day of month and day of week
+// match either, as in cron, unless one is "*".
+func TestCronWindows(t *testing.T) {
+	rome, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		window string
+		at     string
+		start  string // of the occurrence, inactive when empty
+	}{
+		// the weekend from Friday 18:00, Rome time; 2026-10-16 is a Friday
+		{window: "0 18 * * FRI 60h", at: "2026-10-16T17:59:59+02:00"},
+		{window: "0 18 * * FRI 60h", at: "2026-10-16T18:00:00+02:00", start: "2026-10-16T18:00:00+02:00"},
+		{window: "0 18 * * FRI 60h", at: "2026-10-16T16:30:00Z", start: "2026-10-16T18:00:00+02:00"},
+		{window: "0 18 * * FRI 60h", at: "2026-10-18T12:00:00+02:00", start: "2026-10-16T18:00:00+02:00"},
+		{window: "0 18 * * FRI 60h", at: "2026-10-19T05:59:59+02:00", start: "2026-10-16T18:00:00+02:00"},
+		{window: "0 18 * * FRI 60h", at: "2026-10-19T06:00:00+02:00"},
+		{window: "0 18 * * FRI 60h", at: "2026-10-21T12:00:00+02:00"},
+		// 7 is Sunday too; 2026-11-01 is a Sunday
+		{window: "0 0 * * 7 1h", at: "2026-11-01T00:30:00+01:00", start: "2026-11-01T00:00:00+01:00"},
+		{window: "0 0 * * SUN 1h", at: "2026-11-01T00:30:00+01:00", start: "2026-11-01T00:00:00+01:00"},
+		// the 1st or a Monday
+		{window: "0 0 1 * MON 1h", at: "2026-11-01T00:30:00+01:00", start: "2026-11-01T00:00:00+01:00"},
+		{window: "0 0 1 * MON 1h", at: "2026-11-02T00:30:00+01:00", start: "2026-11-02T00:00:00+01:00"},
+		{window: "0 0 1 * MON 1h", at: "2026-11-03T00:30:00+01:00"},
+		// Mondays only
+		{window: "0 0 * * MON 1h", at: "2026-11-01T00:30:00+01:00"},
+		// steps and ranges, the last start counting
+		{window: "*/15 9-17 * * MON-FRI 10m", at: "2026-10-21T10:20:00+02:00", start: "2026-10-21T10:15:00+02:00"},
+		{window: "*/15 9-17 * * MON-FRI 10m", at: "2026-10-21T10:26:00+02:00"},
+		{window: "*/15 9-17 * * MON-FRI 10m", at: "2026-10-21T18:05:00+02:00"},
+		{window: "*/15 9-17 * * MON-FRI 10m", at: "2026-10-24T10:20:00+02:00"},
+		{window: "0 0 1 JAN * 24h", at: "2027-01-01T12:00:00+01:00", start: "2027-01-01T00:00:00+01:00"},
+		{window: "0 0 1 JAN * 24h", at: "2027-01-02T12:00:00+01:00"},
+	} {
+		schedule, err := parseFreeze(FreezeConfig{Timezone: "Europe/Rome", Windows: []string{tt.window}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		match, active := freezeAt(t, schedule, tt.at)
+		if active != (tt.start != "") {
+			t.Errorf("%q at %s: active %v", tt.window, tt.at, active)
+			continue
+		}
+		if !active {
+			continue
+		}
+		start, _ := time.Parse(time.RFC3339, tt.start)
+		duration, _ := time.ParseDuration(strings.Fields(tt.window)[5])
+		if !match.Start.Equal(start) || !match.End.Equal(start.Add(duration)) || match.Start.Location().String() != rome.String() || match.Window != tt.window {
+			t.Errorf("%q at %s: %+v, want from %s", tt.window, tt.at, match, tt.start)
+		}
+	}
+
+	// in UTC without a timezone
+	schedule, err := parseFreeze(FreezeConfig{Windows: []string{"0 18 * * FRI 60h"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, active := freezeAt(t, schedule, "2026-10-16T19:00:00+02:00"); active {
+		t.Error("active at 17:00 UTC")
+	}
+}
+
+// Of overlapping windows, the one ending last is reported.
+func TestFreezeScheduleOverlap(t *testing.T) {
+	schedule, err := parseFreeze(FreezeConfig{Windows: []string{
+		"2026-10-16T00:00:00Z/2026-10-17T00:00:00Z",
+		"2026-10-16T12:00:00Z/2026-10-20T00:00:00Z",
+		"0 12 * * * 1h",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match, active := freezeAt(t, schedule, "2026-10-16T12:30:00Z"); !active || match.Window != "2026-10-16T12:00:00Z/2026-10-20T00:00:00Z" {
+		t.Errorf("window %+v", match)
+	}
+	if match, active := freezeAt(t, schedule, "2026-10-21T12:30:00Z"); !active || match.Window != "0 12 * * * 1h" {
+		t.Errorf("window %+v", match)
+	}
+	var none *freezeSchedule
+	if _, active := none.activeAt(time.Now()); active {
+		t.Error("no schedule active")
+	}
+}
+
+// Entering, inside and leaving a window on the injected clock: the
+// admissions are evaluated, logged and recorded but not patched, and the
+// state follows on the metric, /debug/config and the /readyz note. The
+// windows follow a reload.
+func TestFreezeAdmission(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Date(2026, 10, 16, 17, 59, 0, 0, time.UTC))
+	core, logs := observer.New(zapcore.InfoLevel)
+	events, fake := fakeEvents()
+	audit, path := newTestAuditLogger(t, 0, 0)
+	config := DefaultConfig()
+	config.Paths = []string{PathMutateSecrets, PathMutateConfigMaps}
+	config.Freeze = FreezeConfig{Windows: []string{"2026-10-16T18:00:00Z/2026-10-19T06:00:00Z"}}
+	whsvr, err := NewWebhookServer(WithConfig(config), WithClock(clock), WithLogger(zapr.NewLogger(zap.New(core))),
+		WithEventRecorder(events), WithAuditLogger(audit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := whsvr.Handler()
+	secret := FixtureSecret{Name: "api-tls", Namespace: "apps", DataSize: 16}
+	skippedBefore := testutil.ToFloat64(metrics.Skips.WithLabelValues(skipFrozen))
+
+	step := func(name, at string, frozen bool) {
+		t.Helper()
+		now, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.SetTime(now)
+		if response := reviewAt(t, handler, PathMutateSecrets, secretReview(t, secret.Name, secret.Namespace)); !response.Allowed || (len(response.Patch) == 0) != frozen {
+			t.Errorf("%s: secret answered %+v, want frozen %v", name, response, frozen)
+		}
+		if response := reviewAt(t, handler, PathMutateConfigMaps, configMapReview(t)); !response.Allowed || (len(response.Patch) == 0) != frozen {
+			t.Errorf("%s: ConfigMap answered %+v, want frozen %v", name, response, frozen)
+		}
+		if events := recorded(fake); frozen && len(events) != 0 || !frozen && len(events) == 0 {
+			t.Errorf("%s: events %q, want frozen %v", name, events, frozen)
+		}
+		gauge := 0.0
+		if frozen {
+			gauge = 1
+		}
+		if got := testutil.ToFloat64(metrics.FreezeActive); got != gauge {
+			t.Errorf("%s: gauge %v", name, got)
+		}
+		status, note := debugConfig(t, whsvr).Freeze, whsvr.FreezeNote()
+		if status.Active != frozen || frozen && (status.Start == nil || status.End == nil || !strings.Contains(note, "admissions are evaluated but not patched")) ||
+			!frozen && note != "" {
+			t.Errorf("%s: /debug/config %+v, note %q", name, status, note)
+		}
+	}
+
+	step("before", "2026-10-16T17:59:59Z", false)
+	step("entering", "2026-10-16T18:00:00Z", true)
+	step("inside", "2026-10-18T12:00:00Z", true)
+	if status := debugConfig(t, whsvr).Freeze; status.Window != "2026-10-16T18:00:00Z/2026-10-19T06:00:00Z" ||
+		!status.Start.Equal(time.Date(2026, 10, 16, 18, 0, 0, 0, time.UTC)) || !status.End.Equal(time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("/debug/config freeze %+v", status)
+	}
+	if note := whsvr.FreezeNote(); note != `change freeze "2026-10-16T18:00:00Z/2026-10-19T06:00:00Z" active until 2026-10-19T06:00:00Z, admissions are evaluated but not patched` {
+		t.Errorf("note %q", note)
+	}
+	step("leaving", "2026-10-19T06:00:00Z", false)
+
+	// the start and end are logged once each
+	for message, want := range map[string]int{
+		"Change freeze started, admissions are evaluated but not patched": 1,
+		"Change freeze ended, patching again":                             1,
+		"Not patching during change freeze":                               4,
+	} {
+		if n := logs.FilterMessage(message).Len(); n != want {
+			t.Errorf("%q logged %d times, want %d", message, n, want)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.Skips.WithLabelValues(skipFrozen)) - skippedBefore; got != 4 {
+		t.Errorf("%v frozen admissions counted, want 4", got)
+	}
+
+	// the windows follow a reload: every day from 08:00 in Rome
+	config.Freeze = FreezeConfig{Timezone: "Europe/Rome", Windows: []string{"0 8 * * * 1h"}}
+	if err := whsvr.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	step("reloaded, inside", "2026-10-20T06:30:00Z", true)
+	step("reloaded, after", "2026-10-20T07:00:00Z", false)
+	config.Freeze = FreezeConfig{}
+	if err := whsvr.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	step("no windows", "2026-10-21T06:30:00Z", false)
+	config.Freeze = FreezeConfig{Windows: []string{"0 8 * * * 1s"}}
+	if err := whsvr.Reload(config); err == nil {
+		t.Error("invalid window reloaded")
+	}
+
+	whsvr.Close() // writes out the audit entries and events
+	var frozen []map[string]any
+	for _, line := range auditLines(t, path) {
+		if line["skipReason"] == skipFrozen {
+			frozen = append(frozen, line)
+		}
+	}
+	if len(frozen) != 6 || frozen[0]["decision"] != decisionSkipped || frozen[0]["matchedRule"] != "default" || frozen[0]["patch"] == nil {
+		t.Errorf("frozen audit lines %v, want 6 with the rule and patch", frozen)
+	}
+}
+
+// freezeFor returns a window started a minute ago and ending after d, on
+// the wall clock the leader's controllers requeue on.
+func freezeFor(d time.Duration) FreezeConfig {
+	now := time.Now().UTC()
+	start, end := now.Add(-time.Minute).Format(time.RFC3339), now.Add(d+time.Second).Format(time.RFC3339)
+	return FreezeConfig{Windows: []string{start + "/" + end}}
+}
+
+// A secret the backfill would patch during a freeze is counted as frozen,
+// left alone and patched once the window ends.
+func TestFreezeBackfill(t *testing.T) {
+	client := fake.NewSimpleClientset(preexisting()...)
+	config := DefaultConfig()
+	config.Freeze = freezeFor(time.Second)
+	whsvr, err := NewWebhookServer(WithConfig(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := backfillCounts()
+	frozen := testutil.ToFloat64(metrics.BackfillSecrets.WithLabelValues(backfillFrozen))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		whsvr.NewBackfillController(logr.Discard(), client, BackfillConfig{QPS: 100, Burst: 10}).Lead(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		whsvr.Close()
+	}()
+
+	waitFor(t, func() bool {
+		return testutil.ToFloat64(metrics.BackfillSecrets.WithLabelValues(backfillFrozen))-frozen == 1
+	})
+	if got := touches(client); len(got) != 0 {
+		t.Errorf("patched %v during the freeze", got)
+	}
+	waitFor(t, func() bool { return backfillCounts()[backfillPatched]-before[backfillPatched] == 1 })
+	if got, want := touches(client), map[string]int{"api-tls": 1}; !maps.Equal(got, want) {
+		t.Errorf("patched %v after the freeze, want %v", got, want)
+	}
+	if failed := backfillCounts()[backfillFailed] - before[backfillFailed]; failed != 0 {
+		t.Errorf("%v secrets failed", failed)
+	}
+}
+
+// The drifted secrets found during a freeze are counted and left alone,
+// then remediated as the window ends rather than at the next scan.
+func TestFreezeDriftRemediation(t *testing.T) {
+	current := DefaultConfig()
+	current.Mutator.NamespaceSelector = "env=new"
+	client := fake.NewSimpleClientset(driftedSecrets(t, current)...)
+	before := syncValues(t, client)
+	frozen := metrics.DriftRemediations.WithLabelValues(skipFrozen)
+	frozenBefore := testutil.ToFloat64(frozen)
+	current.Freeze = freezeFor(time.Second)
+	scanner := newDriftScanner(t, current, client, DriftScanConfig{Interval: time.Hour, BatchSize: 50, Remediate: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		scanner.Lead(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor(t, func() bool { return testutil.ToFloat64(frozen)-frozenBefore == 2 })
+	if after := syncValues(t, client); !maps.Equal(after, before) {
+		t.Errorf("remediated during the freeze from %v to %v", before, after)
+	}
+	waitFor(t, func() bool {
+		values := syncValues(t, client)
+		return values["apps/api-tls"] == "env=new" && values["web/web-tls"] == "env=new"
+	})
+}
+
+// The namespaces created during a freeze stay pending, their sources
+// touched once the window ends.
+func TestFreezeResync(t *testing.T) {
+	client := fake.NewSimpleClientset(resyncSources()...)
+	config := DefaultConfig()
+	config.Freeze = freezeFor(time.Second)
+	whsvr, err := NewWebhookServer(WithConfig(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(whsvr.Close)
+	controller := whsvr.NewResyncController(logr.Discard(), client, ResyncConfig{BatchWindow: 20 * time.Millisecond, QPS: 100, Burst: 10})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		controller.Lead(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the watch starts, then a few windows pass within the freeze
+	time.Sleep(100 * time.Millisecond)
+	if _, err := client.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments", Labels: map[string]string{"env": "prod"}}}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := touches(client); len(got) != 0 {
+		t.Fatalf("touched %v during the freeze", got)
+	}
+	waitFor(t, func() bool { return len(touches(client)) == 2 })
+	if got, want := touches(client), map[string]int{"all-tls": 1, "prod-tls": 1}; !maps.Equal(got, want) {
+		t.Errorf("touched %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,370 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/utils/clock"
+
+	"github.com/bygui86/cert-manager-webhook/internal/certs"
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// Config holds the settings of an admission handler.
+type Config struct {
+	Mutator               mutator.Config    // settings of the secrets mutation
+	ConfigMaps            ConfigMapConfig   // settings of the ConfigMap mutation
+	Certificates          CertificateConfig // settings of the Certificate mutation
+	Paths                 []string          // admission paths to serve, DefaultPaths when empty
+	FailOpen              bool              // allow admissions the handler can't evaluate
+	MaxBodyBytes          int64             // limit on the (decompressed) request body size, 0 for none
+	SlowThreshold         time.Duration     // warn about admissions taking longer, 0 disables
+	SkipPatchVerification bool              // return patches without applying them to the object first
+	// DeleteProtection holds who may delete the protected secrets.
+	DeleteProtection DeleteProtectionConfig
+	// ClusterProfile names the cluster profile the settings were picked by,
+	// empty when there is none.
+	ClusterProfile string
+	// Freeze holds the change freeze windows.
+	Freeze FreezeConfig
+}
+
+// DefaultConfig returns the admission settings used unless configured:
+// the secrets mutation only, fail open, a 3 MiB body limit and a 2s slow
+// request threshold.
+func DefaultConfig() Config {
+	mutatorConfig := mutator.DefaultConfig()
+	return Config{
+		Mutator: mutatorConfig,
+		ConfigMaps: ConfigMapConfig{
+			Selector:          DefaultConfigMapSelector,
+			IgnoredNamespaces: mutatorConfig.IgnoredNamespaces,
+			NamespaceSelector: mutatorConfig.NamespaceSelector,
+		},
+		Certificates: CertificateConfig{
+			IgnoredNamespaces: mutatorConfig.IgnoredNamespaces,
+			NamespaceSelector: mutatorConfig.NamespaceSelector,
+		},
+		FailOpen:         true,
+		MaxBodyBytes:     3 << 20,
+		SlowThreshold:    2 * time.Second,
+		DeleteProtection: DefaultDeleteProtection(),
+	}
+}
+
+func (c Config) validate() error {
+	if c.MaxBodyBytes < 0 {
+		return fmt.Errorf("negative request body limit %d", c.MaxBodyBytes)
+	}
+	if c.SlowThreshold < 0 {
+		return fmt.Errorf("negative slow request threshold %s", c.SlowThreshold)
+	}
+	if c.Mutator.NamespaceSelector == "" {
+		return errors.New("empty namespace selector")
+	}
+	enabled, err := EnabledRoutes(c.Paths)
+	if err != nil {
+		return err
+	}
+	for _, route := range enabled {
+		if (route.Path == PathMutateConfigMaps && c.ConfigMaps.NamespaceSelector == "") ||
+			(route.Path == PathMutateCertificates && c.Certificates.NamespaceSelector == "") {
+			return fmt.Errorf("%s: empty namespace selector", route.Path)
+		}
+	}
+	return nil
+}
+
+// Option sets up a WebhookServer or admission handler.
+type Option func(*WebhookServer)
+
+// WithConfig sets the admission settings.
+func WithConfig(config Config) Option {
+	return func(whsvr *WebhookServer) { whsvr.applyConfig(config) }
+}
+
+// WithPort sets the port the server listens on, 443 by default.
+func WithPort(port int) Option {
+	return func(whsvr *WebhookServer) {
+		host, _, _ := net.SplitHostPort(whsvr.server.Addr)
+		whsvr.server.Addr = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+}
+
+// tlsFilesReloadInterval is how often the key pair of WithTLSFromFiles is
+// checked for changes, the default of CERT_RELOAD_INTERVAL.
+var tlsFilesReloadInterval = time.Minute
+
+// WithTLSFromFiles serves the key pair loaded from certFile and keyFile. The
+// server reloads it when the files change, checking every minute from
+// NewWebhookServer until Close.
+func WithTLSFromFiles(certFile, keyFile string) Option {
+	return func(whsvr *WebhookServer) {
+		// loaded by NewWebhookServer, with the logger of all options
+		whsvr.certFile, whsvr.keyFile = certFile, keyFile
+	}
+}
+
+// WithSharedMetricsRegistry also registers the webhook's metrics on reg, e.g.
+// the registry of a program embedding the webhook. The metrics are package
+// globals, registered with the default registry as well: they count the
+// admissions of every webhook in the process, not of this server alone.
+func WithSharedMetricsRegistry(reg prometheus.Registerer) Option {
+	return func(whsvr *WebhookServer) {
+		if err := metrics.Register(reg); err != nil {
+			whsvr.optionErrors = append(whsvr.optionErrors, fmt.Errorf("registering metrics: %w", err))
+		}
+	}
+}
+
+// WithClock sets the clock admissions are timed and rate limited with.
+func WithClock(c clock.PassiveClock) Option {
+	return func(whsvr *WebhookServer) { whsvr.clock = c }
+}
+
+// WithLogger sets the logger, which discards by default.
+func WithLogger(log logr.Logger) Option {
+	return func(whsvr *WebhookServer) { whsvr.log = log }
+}
+
+// WithAccessLog logs one line per request, only one in every sample for
+// successful ones.
+func WithAccessLog(log logr.Logger, sample uint64) Option {
+	return func(whsvr *WebhookServer) {
+		whsvr.accessLog = &log
+		whsvr.accessLogSample = sample
+	}
+}
+
+// WithAuditLogger records every admission decision.
+func WithAuditLogger(audit *AuditLogger) Option {
+	return func(whsvr *WebhookServer) { whsvr.audit = audit }
+}
+
+// WithEventRecorder records Kubernetes Events on the handled secrets.
+func WithEventRecorder(events *EventRecorder) Option {
+	return func(whsvr *WebhookServer) { whsvr.events = events }
+}
+
+// WithRateLimiter limits the admission rate; strict rejects over-limit
+// requests instead of allowing them unpatched.
+func WithRateLimiter(limiter *RateLimiter, strict bool) Option {
+	return func(whsvr *WebhookServer) {
+		whsvr.limiter = limiter
+		whsvr.rateLimitStrict = strict
+	}
+}
+
+// WithConcurrencyLimiter caps the admissions evaluated at once.
+func WithConcurrencyLimiter(concurrency *ConcurrencyLimiter) Option {
+	return func(whsvr *WebhookServer) { whsvr.concurrency = concurrency }
+}
+
+// WithDecisionSampler samples the routine decision logs.
+func WithDecisionSampler(sampler *DecisionSampler) Option {
+	return func(whsvr *WebhookServer) { whsvr.sampler = sampler }
+}
+
+// WithDecisionCache answers retried admissions from cache.
+func WithDecisionCache(decisions *DecisionCache) Option {
+	return func(whsvr *WebhookServer) { whsvr.decisions = decisions }
+}
+
+// WithStatusReporter accounts the decisions in the status ConfigMap.
+func WithStatusReporter(status *StatusReporter) Option {
+	return func(whsvr *WebhookServer) {
+		if status != nil {
+			status.whsvr = whsvr
+		}
+		whsvr.status = status
+	}
+}
+
+// WithRecentDecisions keeps the last decisions for /decisions.
+func WithRecentDecisions(recent *RecentDecisions) Option {
+	return func(whsvr *WebhookServer) { whsvr.recent = recent }
+}
+
+// WithErrorReporter reports panics and repeated admission errors to an
+// error tracker.
+func WithErrorReporter(reports *ErrorReporter) Option {
+	return func(whsvr *WebhookServer) {
+		if reports != nil {
+			reports.configHash = whsvr.activeConfigHash
+		}
+		whsvr.reports = reports
+	}
+}
+
+// WithRequestRecorder writes fixtures of the incoming requests.
+func WithRequestRecorder(recorder *RequestRecorder) Option {
+	return func(whsvr *WebhookServer) { whsvr.recorder = recorder }
+}
+
+// WithFaultInjector delays or fails a share of the requests, for testing.
+func WithFaultInjector(faults *FaultInjector) Option {
+	return func(whsvr *WebhookServer) { whsvr.faults = faults }
+}
+
+// WithDownstreamWebhook forwards every admission to another mutating webhook
+// and merges its patch after ours.
+func WithDownstreamWebhook(downstream *DownstreamWebhook) Option {
+	return func(whsvr *WebhookServer) { whsvr.downstream = downstream }
+}
+
+// WithHTTPServer serves the admissions with server, keeping its address,
+// timeouts and TLS settings; its handler is replaced.
+func WithHTTPServer(server *http.Server) Option {
+	return func(whsvr *WebhookServer) { whsvr.server = server }
+}
+
+// Addr returns the address the server listens on.
+func (whsvr *WebhookServer) Addr() string {
+	return whsvr.server.Addr
+}
+
+// Shutdown stops the server gracefully, waiting for in-flight admissions
+// until ctx is done.
+func (whsvr *WebhookServer) Shutdown(ctx context.Context) error {
+	return whsvr.server.Shutdown(ctx)
+}
+
+// Close stops the key pair watch of WithTLSFromFiles and the optional
+// components once the server is shut down, writing out the events,
+// recordings and audit entries they have queued, and the informers.
+func (whsvr *WebhookServer) Close() {
+	whsvr.closeOnce.Do(func() {
+		close(whsvr.closed)
+		whsvr.informers.shutdown()
+		whsvr.events.Shutdown()
+		whsvr.recorder.Close()
+		if whsvr.audit != nil {
+			whsvr.audit.Close()
+		}
+	})
+}
+
+// Serve answers admissions on ln until the server is shut down. TLS is
+// terminated with the server's TLS config, except on Unix sockets where the
+// fronting proxy does it. Callers can pass any listener, e.g. one bound to a
+// random port for a local API server to call.
+func (whsvr *WebhookServer) Serve(ln net.Listener) error {
+	if whsvr.server.TLSConfig == nil || ln.Addr().Network() == "unix" {
+		return whsvr.server.Serve(ln)
+	}
+	return whsvr.server.ServeTLS(ln, "", "")
+}
+
+// NewHandler returns a handler serving the admission paths with request
+// IDs, panic recovery and the optional components applied. It keeps no
+// state outside the handler, so handlers with different configurations can
+// be served side by side; listeners and TLS are left to the caller.
+func NewHandler(config Config, opts ...Option) (http.Handler, error) {
+	whsvr := newWebhookServer(config, opts...)
+	if err := errors.Join(whsvr.optionErrors...); err != nil {
+		return nil, err
+	}
+	return whsvr.Handler(), nil
+}
+
+// NewWebhookServer returns a server for the admission handler, listening
+// on port 443 with the timeouts recommended for webhooks unless set by
+// opts. The server needs a key pair, e.g. from WithTLSFromFiles, unless it
+// is served over plain HTTP behind a proxy.
+func NewWebhookServer(opts ...Option) (*WebhookServer, error) {
+	whsvr := newWebhookServer(DefaultConfig(), opts...)
+	if err := errors.Join(whsvr.optionErrors...); err != nil {
+		return nil, err
+	}
+	if err := whsvr.config.validate(); err != nil {
+		return nil, err
+	}
+	_, port, err := net.SplitHostPort(whsvr.server.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	if whsvr.certFile != "" || whsvr.keyFile != "" {
+		keyPair, err := certs.NewReloader(whsvr.log.WithName("certs"), whsvr.certFile, whsvr.keyFile, nil)
+		if err != nil {
+			return nil, fmt.Errorf("loading key pair: %w", err)
+		}
+		whsvr.server.TLSConfig = &tls.Config{GetCertificate: keyPair.GetCertificate}
+		go keyPair.Watch(tlsFilesReloadInterval, whsvr.closed)
+	}
+	whsvr.server.Handler = whsvr.Handler()
+	return whsvr, nil
+}
+
+// NewWebhookServerFromParameters builds a server from the old parameter
+// struct; the sidecar configuration file is ignored.
+//
+// Deprecated: use NewWebhookServer. This shim goes away in the next release.
+func NewWebhookServerFromParameters(params WhSvrParameters) (*WebhookServer, error) {
+	return NewWebhookServer(WithPort(params.Port), WithTLSFromFiles(params.CertFile, params.KeyFile))
+}
+
+func newWebhookServer(config Config, opts ...Option) *WebhookServer {
+	// the server defaults are those of the command line flags
+	whsvr := &WebhookServer{
+		server: &http.Server{
+			Addr:              ":443",
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       90 * time.Second,
+		},
+		log:    logr.Discard(),
+		clock:  clock.RealClock{},
+		closed: make(chan struct{}),
+	}
+	whsvr.applyConfig(config)
+	for _, opt := range opts {
+		opt(whsvr)
+	}
+	return whsvr
+}
+
+func (whsvr *WebhookServer) applyConfig(config Config) {
+	whsvr.config = config
+	whsvr.maxBodyBytes = config.MaxBodyBytes
+	whsvr.failOpen = config.FailOpen
+	whsvr.slowThreshold = config.SlowThreshold
+	routes, err := EnabledRoutes(config.Paths)
+	if err != nil {
+		whsvr.optionErrors = append(whsvr.optionErrors, err)
+		return
+	}
+	whsvr.routes = routes
+	p, err := newPolicy(config)
+	if err != nil {
+		whsvr.optionErrors = append(whsvr.optionErrors, err)
+		return
+	}
+	whsvr.policy.Store(p)
+	metrics.ObserveConfigLoad()
+}
+
+// Handler returns the admission handler with all middleware applied.
+func (whsvr *WebhookServer) Handler() http.Handler {
+	var handler http.Handler = whsvr.admissionHandler()
+	if whsvr.faults != nil {
+		handler = whsvr.faults.wrap(handler)
+	}
+	handler = recoverAdmission(whsvr.log, whsvr.failOpen, whsvr.reports, handler)
+	if whsvr.accessLog != nil {
+		handler = AccessLog(*whsvr.accessLog, whsvr.accessLogSample, handler)
+	}
+	return RequestID(handler)
+}
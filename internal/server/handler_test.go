@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/clock"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// admitWith posts review to handler and returns its response.
+func admitWith(t *testing.T, handler http.Handler, review *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	t.Helper()
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var answer v1beta1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil || answer.Response == nil {
+		t.Fatalf("answered %d: %s", rec.Code, rec.Body)
+	}
+	return answer.Response
+}
+
+// admitSecret posts the CREATE review of secret to handler and returns the
+// review and its response.
+func admitSecret(t *testing.T, handler http.Handler, secret *corev1.Secret) (*v1beta1.AdmissionReview, *v1beta1.AdmissionResponse) {
+	t.Helper()
+	review, err := FixtureReview(secret, v1beta1.Create, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return review, admitWith(t, handler, review)
+}
+
+// newTestHandler returns the admission handler of config, failing t on
+// errors.
+func newTestHandler(t *testing.T, config Config, opts ...Option) http.Handler {
+	t.Helper()
+	handler, err := NewHandler(config, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+// patchedSecret returns the secret of review with the patch of response
+// applied.
+func patchedSecret(t *testing.T, review *v1beta1.AdmissionReview, response *v1beta1.AdmissionResponse) *corev1.Secret {
+	t.Helper()
+	patch, err := jsonpatch.DecodePatch(response.Patch)
+	if err != nil {
+		t.Fatalf("patch %s: %v", response.Patch, err)
+	}
+	patched, err := patch.Apply(review.Request.Object.Raw)
+	if err != nil {
+		t.Fatalf("patch %s doesn't apply: %v", response.Patch, err)
+	}
+	var secret corev1.Secret
+	if err := json.Unmarshal(patched, &secret); err != nil {
+		t.Fatal(err)
+	}
+	return &secret
+}
+
+func TestNewHandler(t *testing.T) {
+	config := Config{Mutator: mutator.DefaultConfig()}
+	review := secretReview(t, "tls", "apps")
+	response := admitWith(t, newTestHandler(t, config), review)
+	if !response.Allowed {
+		t.Fatalf("secret not allowed: %v", response.Result)
+	}
+	if got := patchedSecret(t, review, response).Annotations[syncAnnotationKey]; got != config.Mutator.NamespaceSelector {
+		t.Errorf("sync annotation %q, want the namespace selector %q", got, config.Mutator.NamespaceSelector)
+	}
+}
+
+// Handlers built with different configurations in one process don't share
+// settings.
+func TestNewHandlerSideBySide(t *testing.T) {
+	selectors := []string{"env=staging", "env=production"}
+	handlers := make([]http.Handler, len(selectors))
+	for i, selector := range selectors {
+		config := Config{Mutator: mutator.DefaultConfig()}
+		config.Mutator.NamespaceSelector = selector
+		handlers[i] = newTestHandler(t, config)
+	}
+	// the admissions of both handlers are interleaved
+	for round := 0; round < 3; round++ {
+		for i, handler := range handlers {
+			review := secretReview(t, fmt.Sprintf("tls-%d", round), "apps")
+			response := admitWith(t, handler, review)
+			if got := patchedSecret(t, review, response).Annotations[syncAnnotationKey]; got != selectors[i] {
+				t.Errorf("handler %d annotated %q, want %q", i, got, selectors[i])
+			}
+		}
+	}
+}
+
+func TestNewWebhookServerValidates(t *testing.T) {
+	unknownStage := DefaultConfig()
+	unknownStage.Mutator.Stages = []string{"no-such-stage"}
+	tests := map[string][]Option{
+		"unknown stage":            {WithConfig(unknownStage)},
+		"negative body limit":      {WithConfig(Config{Mutator: mutator.DefaultConfig(), MaxBodyBytes: -1})},
+		"negative slow threshold":  {WithConfig(Config{Mutator: mutator.DefaultConfig(), SlowThreshold: -time.Second})},
+		"empty namespace selector": {WithConfig(Config{})},
+		"port out of range":        {WithPort(70000)},
+	}
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewWebhookServer(opts...); err == nil {
+				t.Error("NewWebhookServer accepted invalid settings")
+			}
+		})
+	}
+}
+
+func TestNewWebhookServerDefaults(t *testing.T) {
+	whsvr, err := NewWebhookServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer whsvr.Close()
+	if whsvr.server.Addr != ":443" || whsvr.server.Handler == nil || whsvr.server.ReadTimeout != 10*time.Second {
+		t.Errorf("server %+v, want the admission handler on :443 with the recommended timeouts", whsvr.server)
+	}
+	if !reflect.DeepEqual(whsvr.config, DefaultConfig()) {
+		t.Errorf("config %+v, want the defaults", whsvr.config)
+	}
+}
+
+// The shared metrics count the server's admissions on the registry given
+// too.
+func TestWithSharedMetricsRegistry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	whsvr, err := NewWebhookServer(WithSharedMetricsRegistry(reg), WithSharedMetricsRegistry(reg))
+	if err != nil {
+		t.Fatalf("registering twice: %v", err)
+	}
+	defer whsvr.Close()
+	before := histogramSamples(t, reg, "webhook_admission_duration_seconds", map[string]string{"path": "/mutate"})
+	admitWith(t, whsvr.server.Handler, secretReview(t, "tls", "apps"))
+	if got := histogramSamples(t, reg, "webhook_admission_duration_seconds", map[string]string{"path": "/mutate"}) - before; got != 1 {
+		t.Errorf("%d admissions observed on the registry, want 1", got)
+	}
+}
+
+func TestNewHandlerUnknownStage(t *testing.T) {
+	config := DefaultConfig()
+	config.Mutator.Stages = []string{"no-such-stage"}
+	if _, err := NewHandler(config); err == nil {
+		t.Error("NewHandler accepted an unknown stage")
+	}
+}
+
+// minuteClock is a clock on which everything takes a minute.
+type minuteClock struct{ clock.RealClock }
+
+func (minuteClock) Since(time.Time) time.Duration { return time.Minute }
+
+// Admissions are timed on the server's clock.
+func TestWithClock(t *testing.T) {
+	log, logged := bufferLogger()
+	whsvr := newWebhookServer(Config{Mutator: mutator.DefaultConfig(), SlowThreshold: time.Second}, WithLogger(log), WithClock(minuteClock{}))
+	admitWith(t, whsvr.Handler(), secretReview(t, "tls", "apps"))
+	if !strings.Contains(logged.String(), "slow admission request") {
+		t.Errorf("an admission a minute long on the server's clock not reported as slow: %s", logged)
+	}
+}
+
+// mutateSecret admits secret through handler and returns it as patched. It
+// doesn't fail a test, so it can be called from other goroutines.
+func mutateSecret(handler http.Handler, secret *corev1.Secret) (*corev1.Secret, error) {
+	review, err := FixtureReview(secret, v1beta1.Create, false)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		return nil, err
+	}
+	rec := ServeLocal(context.Background(), handler, body)
+	var answer v1beta1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil {
+		return nil, fmt.Errorf("decoding answer %d: %w", rec.Code, err)
+	}
+	if answer.Response == nil || !answer.Response.Allowed {
+		return nil, fmt.Errorf("secret %s not allowed: %s", secret.Name, rec.Body)
+	}
+	return ApplyPatch(review.Request.Object.Raw, answer.Response.Patch)
+}
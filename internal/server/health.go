@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// Healthz reports that the process is up and serving.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// readinessCheck is one precondition of readiness; it returns nil while the
+// precondition holds.
+type readinessCheck struct {
+	name  string
+	check func(now time.Time) error
+}
+
+// Readiness backs /readyz. Each registered check is evaluated on every probe
+// and reported on its own line and in webhook_readiness_check, so it's
+// clear which precondition is failing; the endpoint is ready only when all
+// pass. Readiness is also dropped as soon as shutdown begins, so the
+// endpoint is removed from the Service before the server stops.
+type Readiness struct {
+	mu           sync.RWMutex
+	checks       []readinessCheck
+	Operator     *OperatorCheck // optional, informational only
+	ShuttingDown atomic.Bool
+	notes        []func() string
+}
+
+func (rd *Readiness) Add(name string, check func(now time.Time) error) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.checks = append(rd.checks, readinessCheck{name: name, check: check})
+}
+
+// AddNote adds a line of information to the answers, when note returns one,
+// for a problem that doesn't fail readiness.
+func (rd *Readiness) AddNote(note func() string) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.notes = append(rd.notes, note)
+}
+
+func (rd *Readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rd.ShuttingDown.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	rd.mu.RLock()
+	checks, notes := rd.checks, rd.notes
+	rd.mu.RUnlock()
+
+	now := time.Now()
+	ready := true
+	var body strings.Builder
+	for _, c := range checks {
+		if err := c.check(now); err != nil {
+			ready = false
+			metrics.ReadinessCheck.WithLabelValues(c.name).Set(0)
+			fmt.Fprintf(&body, "%s: failed: %v\n", c.name, err)
+			continue
+		}
+		metrics.ReadinessCheck.WithLabelValues(c.name).Set(1)
+		fmt.Fprintf(&body, "%s: ok\n", c.name)
+	}
+	if note := rd.Operator.Note(); note != "" {
+		fmt.Fprintf(&body, "note: %s\n", note)
+	}
+	for _, note := range notes {
+		if note := note(); note != "" {
+			fmt.Fprintf(&body, "note: %s\n", note)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write([]byte(body.String()))
+}
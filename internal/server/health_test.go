@@ -0,0 +1,145 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/bygui86/cert-manager-webhook/internal/certs"
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// toggle is a readiness check failing while set.
+type toggle struct{ failing atomic.Bool }
+
+func (c *toggle) check(time.Time) error {
+	if c.failing.Load() {
+		return errors.New("toggled off")
+	}
+	return nil
+}
+
+// probeReadiness calls rd and returns the status and body.
+func probeReadiness(rd *Readiness) (int, string) {
+	rec := httptest.NewRecorder()
+	rd.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return rec.Code, rec.Body.String()
+}
+
+// Each check flips its own line and gauge; the endpoint is ready only when
+// all pass.
+func TestReadinessChecks(t *testing.T) {
+	names := []string{"test-certificate", "test-config", "test-informers", "test-client-ca"}
+	checks := map[string]*toggle{}
+	rd := &Readiness{}
+	for _, name := range names {
+		checks[name] = &toggle{}
+		rd.Add(name, checks[name].check)
+	}
+
+	code, body := probeReadiness(rd)
+	if code != http.StatusOK {
+		t.Fatalf("answered %d with all checks passing: %s", code, body)
+	}
+	for _, name := range names {
+		if !strings.Contains(body, name+": ok\n") {
+			t.Errorf("no ok line for %s: %s", name, body)
+		}
+	}
+
+	for _, failing := range names {
+		t.Run(failing, func(t *testing.T) {
+			checks[failing].failing.Store(true)
+			defer checks[failing].failing.Store(false)
+
+			code, body := probeReadiness(rd)
+			if code != http.StatusServiceUnavailable {
+				t.Errorf("answered %d with %s failing", code, failing)
+			}
+			for _, name := range names {
+				line, gauge := name+": ok\n", 1.
+				if name == failing {
+					line, gauge = name+": failed: toggled off\n", 0
+				}
+				if !strings.Contains(body, line) {
+					t.Errorf("no line %q: %s", line, body)
+				}
+				if got := testutil.ToFloat64(metrics.ReadinessCheck.WithLabelValues(name)); got != gauge {
+					t.Errorf("%s gauge %v, want %v", name, got, gauge)
+				}
+			}
+		})
+	}
+	if code, body := probeReadiness(rd); code != http.StatusOK {
+		t.Errorf("answered %d once all checks pass again: %s", code, body)
+	}
+}
+
+func TestReadinessNoteAndShutdown(t *testing.T) {
+	rd := &Readiness{Operator: &OperatorCheck{note: "kubed/config-syncer not found"}}
+	code, body := probeReadiness(rd)
+	if code != http.StatusOK || body != "note: kubed/config-syncer not found\n" {
+		t.Errorf("answered %d %q, want ready with the note", code, body)
+	}
+
+	rd.ShuttingDown.Store(true)
+	if code, _ := probeReadiness(rd); code != http.StatusServiceUnavailable {
+		t.Errorf("answered %d while shutting down, want 503", code)
+	}
+}
+
+func TestWebhookConfigSynced(t *testing.T) {
+	c := &WebhookConfigReconciler{}
+	if err := c.Synced(time.Now()); err != nil {
+		t.Errorf("not ready without leading: %v", err)
+	}
+	c.leading.Store(true)
+	if err := c.Synced(time.Now()); err == nil {
+		t.Error("ready before the cache synced")
+	}
+	c.synced.Store(true)
+	if err := c.Synced(time.Now()); err != nil {
+		t.Errorf("not ready once synced: %v", err)
+	}
+	var none *WebhookConfigReconciler
+	if err := none.Synced(time.Now()); err != nil {
+		t.Errorf("nil reconciler not synced: %v", err)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	certFile, keyFile := keyPairFiles(t)
+	writeKeyPair(t, certFile, keyFile, "webhook", time.Hour, time.Now())
+	r, err := certs.NewReloader(logr.Discard(), certFile, keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := func(certs *certs.Reloader) *Readiness {
+		rd := &Readiness{}
+		rd.Add("certificate", certs.Ready)
+		return rd
+	}
+	shuttingDown := certificate(r)
+	shuttingDown.ShuttingDown.Store(true)
+	for name, tt := range map[string]struct {
+		ready *Readiness
+		code  int
+	}{
+		"valid":         {ready: certificate(r), code: http.StatusOK},
+		"not loaded":    {ready: certificate(&certs.Reloader{}), code: http.StatusServiceUnavailable},
+		"shutting down": {ready: shuttingDown, code: http.StatusServiceUnavailable},
+	} {
+		rec := httptest.NewRecorder()
+		tt.ready.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rec.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", name, rec.Code, tt.code)
+		}
+	}
+}
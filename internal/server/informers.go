@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// informerResync is how often the informers replay their cache to catch
+// missed events.
+const informerResync = 10 * time.Minute
+
+// CertificatesResource is the resource of cert-manager's Certificates.
+var CertificatesResource = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+
+// informerCache is the one shared informer factory of the server, holding
+// the informers of the features that read the cluster during admissions.
+// Admissions read the caches, never the API server, so a namespace created
+// moments before its first secret may not be in them yet; the stages get
+// mutator.ErrNamespaceNotCached for it and the admission is answered per
+// the failure policy.
+type informerCache struct {
+	log          logr.Logger
+	factory      informers.SharedInformerFactory
+	dynamic      dynamicinformer.DynamicSharedInformerFactory
+	namespaces   corelisters.NamespaceLister
+	certificates cache.GenericLister
+	ingresses    networkinglisters.IngressLister
+	hasSynced    []cache.InformerSynced
+	synced       atomic.Bool
+	stop         context.CancelFunc // stops the informers ahead of shutdown
+}
+
+// NeedsInformers reports whether a feature of the server reads the cluster
+// through the informer cache, which StartInformers must then start.
+func (whsvr *WebhookServer) NeedsInformers() bool {
+	p := whsvr.policy.Load()
+	return p != nil && (p.mutator.NeedsNamespaces() || p.mutator.NeedsCertificates() || p.mutator.NeedsIngresses())
+}
+
+// StartInformers starts the informers of the features that need them and
+// fills their caches in the background, until ctx is done; Close stops them.
+// It must be called before the server serves, and only once. dynamicClient
+// reads the cert-manager Certificates.
+func (whsvr *WebhookServer) StartInformers(ctx context.Context, client kubernetes.Interface, dynamicClient dynamic.Interface) {
+	ctx, stop := context.WithCancel(ctx)
+	c := &informerCache{
+		stop:    stop,
+		log:     whsvr.log.WithName("informers"),
+		factory: informers.NewSharedInformerFactory(client, informerResync),
+		dynamic: dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, informerResync),
+	}
+	p := whsvr.policy.Load()
+	if p != nil && p.mutator.NeedsNamespaces() {
+		namespaces := c.factory.Core().V1().Namespaces()
+		c.namespaces = namespaces.Lister()
+		c.hasSynced = append(c.hasSynced, namespaces.Informer().HasSynced)
+	}
+	if p != nil && p.mutator.NeedsIngresses() {
+		ingresses := c.factory.Networking().V1().Ingresses()
+		c.ingresses = ingresses.Lister()
+		c.hasSynced = append(c.hasSynced, ingresses.Informer().HasSynced)
+	}
+	if p != nil && p.mutator.NeedsCertificates() {
+		certificates := c.dynamic.ForResource(CertificatesResource)
+		c.certificates = certificates.Lister()
+		c.hasSynced = append(c.hasSynced, certificates.Informer().HasSynced)
+	}
+	c.factory.Start(ctx.Done())
+	c.dynamic.Start(ctx.Done())
+	go func() {
+		if cache.WaitForCacheSync(ctx.Done(), c.hasSynced...) {
+			c.synced.Store(true)
+			c.log.Info("Informer caches synced")
+		}
+	}()
+	whsvr.informers = c
+}
+
+// InformersSynced returns an error until the informer caches have synced,
+// nil when the server runs no informers.
+func (whsvr *WebhookServer) InformersSynced(time.Time) error {
+	if whsvr.informers == nil || whsvr.informers.synced.Load() {
+		return nil
+	}
+	return errors.New("informer caches not synced")
+}
+
+// namespaceLister returns the namespaces cache for the stages, nil when
+// none runs.
+func (c *informerCache) namespaceLister() mutator.NamespaceLister {
+	if c == nil || c.namespaces == nil {
+		return nil
+	}
+	return c.namespaces
+}
+
+// certificateLister returns the Certificates cache for the stages, nil when
+// none runs.
+func (c *informerCache) certificateLister() mutator.CertificateLister {
+	if c == nil || c.certificates == nil {
+		return nil
+	}
+	return cachedCertificates{c.certificates}
+}
+
+// ingressLister returns the Ingresses cache for the stages, nil when none
+// runs.
+func (c *informerCache) ingressLister() mutator.IngressLister {
+	if c == nil || c.ingresses == nil {
+		return nil
+	}
+	return c.ingresses
+}
+
+// cachedCertificates reads the dnsNames of the cached Certificates.
+type cachedCertificates struct {
+	lister cache.GenericLister
+}
+
+func (c cachedCertificates) DNSNames(namespace, name string) ([]string, error) {
+	obj, err := c.lister.ByNamespace(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	certificate, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, errors.New("unexpected object in the Certificates cache")
+	}
+	return CertificateDNSNames(certificate)
+}
+
+// CertificateDNSNames returns spec.dnsNames of a Certificate.
+func CertificateDNSNames(certificate *unstructured.Unstructured) ([]string, error) {
+	dnsNames, _, err := unstructured.NestedStringSlice(certificate.Object, "spec", "dnsNames")
+	return dnsNames, err
+}
+
+// shutdown stops the informers, waiting for them to return. It is nil-safe.
+func (c *informerCache) shutdown() {
+	if c != nil {
+		c.stop()
+		c.factory.Shutdown()
+		c.dynamic.Shutdown()
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// A namespace created after the cache synced isn't seen by admissions
+// until its informer observes it; meanwhile its secrets are answered per
+// the failure policy. Close stops the informers.
+func TestInformerStaleness(t *testing.T) {
+	settings, err := json.Marshal(mutator.PolicyConfig{Rules: []mutator.Rule{
+		{Name: "prod", MatchExpression: `namespaceLabels["env"] == "prod"`},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, failOpen := range []bool{true, false} {
+		config := DefaultConfig()
+		config.FailOpen = failOpen
+		config.Mutator.StageConfig = map[string]json.RawMessage{mutator.PolicyStage: settings}
+		whsvr, err := NewWebhookServer(WithConfig(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !whsvr.NeedsInformers() {
+			t.Fatal("informers not needed by a rule reading namespaceLabels")
+		}
+		client := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps", Labels: map[string]string{"env": "prod"}}})
+		ctx, cancel := context.WithCancel(context.Background())
+		whsvr.StartInformers(ctx, client, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+		waitFor(t, func() bool { return whsvr.InformersSynced(time.Now()) == nil })
+		handler := whsvr.Handler()
+
+		review, response := admitSecret(t, handler, FixtureSecret{Name: "api-tls", Namespace: "apps", DataSize: 16}.Build())
+		if patched := patchedSecret(t, review, response); patched.Annotations[mutator.SyncAnnotationKey] != "true" {
+			t.Errorf("fail open %v: cached namespace's secret patched to %v", failOpen, patched.Annotations)
+		}
+
+		// a namespace the cache hasn't seen yet
+		misses := testutil.ToFloat64(metrics.NamespaceCacheMisses)
+		if _, response := admitSecret(t, handler, FixtureSecret{Name: "api-tls", Namespace: "new", DataSize: 16}.Build()); response.Allowed != failOpen || len(response.Patch) != 0 {
+			t.Errorf("fail open %v: uncached namespace's secret allowed %v with patch %s", failOpen, response.Allowed, response.Patch)
+		}
+		if got := testutil.ToFloat64(metrics.NamespaceCacheMisses) - misses; got != 1 {
+			t.Errorf("fail open %v: %v cache misses counted, want 1", failOpen, got)
+		}
+
+		// and once the informer observes it
+		if _, err := client.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "new", Labels: map[string]string{"env": "prod"}}}, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool {
+			_, err := whsvr.informers.namespaces.Get("new")
+			return err == nil
+		})
+		review, response = admitSecret(t, handler, FixtureSecret{Name: "api-tls", Namespace: "new", DataSize: 16}.Build())
+		if patched := patchedSecret(t, review, response); patched.Annotations[mutator.SyncAnnotationKey] != "true" {
+			t.Errorf("fail open %v: observed namespace's secret patched to %v", failOpen, patched.Annotations)
+		}
+
+		closed := make(chan struct{})
+		go func() {
+			whsvr.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("informers not stopped by Close")
+		}
+		cancel()
+	}
+}
+
+// dns-targets reads the Certificates from their informer, which picks up
+// those created later.
+func TestInformerCertificates(t *testing.T) {
+	config := DefaultConfig()
+	config.Mutator.Stages = []string{mutator.PolicyStage, mutator.DNSTargetsStage}
+	whsvr, err := NewWebhookServer(WithConfig(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := func(name string, dnsNames ...interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "cert-manager.io/v1",
+			"kind":       "Certificate",
+			"metadata":   map[string]interface{}{"name": name, "namespace": "apps"},
+			"spec":       map[string]interface{}{"secretName": name, "dnsNames": dnsNames},
+		}}
+	}
+	client := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop"}},
+	)
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{CertificatesResource: "CertificateList"},
+		certificate("api-tls", "payments.internal.example.com", "*.internal.example.com"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	whsvr.StartInformers(ctx, client, dynamicClient)
+	defer whsvr.Close()
+	waitFor(t, func() bool { return whsvr.InformersSynced(time.Now()) == nil })
+	handler := whsvr.Handler()
+
+	review, response := admitSecret(t, handler, FixtureSecret{Name: "api-tls", Namespace: "apps", DataSize: 16}.Build())
+	if got := patchedSecret(t, review, response).Annotations[mutator.SyncAnnotationKey]; got != "kubernetes.io/metadata.name in (payments)" {
+		t.Errorf("synced to %q, want payments", got)
+	}
+
+	// not cached yet: the default, with a warning
+	review, response = admitSecret(t, handler, FixtureSecret{Name: "shop-tls", Namespace: "apps", DataSize: 16}.Build())
+	if got := patchedSecret(t, review, response).Annotations[mutator.SyncAnnotationKey]; got != "true" || len(response.Warnings) != 1 {
+		t.Errorf("synced to %q with warnings %q, want the default with one", got, response.Warnings)
+	}
+	if _, err := dynamicClient.Resource(CertificatesResource).Namespace("apps").Create(ctx, certificate("shop-tls", "shop.internal.example.com"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, err := whsvr.informers.certificateLister().DNSNames("apps", "shop-tls")
+		return err == nil
+	})
+	review, response = admitSecret(t, handler, FixtureSecret{Name: "shop-tls", Namespace: "apps", DataSize: 16}.Build())
+	if got := patchedSecret(t, review, response).Annotations[mutator.SyncAnnotationKey]; got != "kubernetes.io/metadata.name in (shop)" {
+		t.Errorf("synced to %q once cached, want shop", got)
+	}
+}
+
+// namespace-labels reads the namespaces from their informer: an UPDATE of a
+// secret picks up the namespace's labels as changed since the last copy,
+// and a namespace not cached yet is answered per the failure policy.
+func TestInformerNamespaceLabels(t *testing.T) {
+	for _, failOpen := range []bool{true, false} {
+		config := DefaultConfig()
+		config.FailOpen = failOpen
+		config.Mutator.Stages = []string{mutator.PolicyStage, mutator.SyncAnnotationStage, mutator.NamespaceLabelsStage}
+		config.Mutator.StageConfig = map[string]json.RawMessage{mutator.NamespaceLabelsStage: json.RawMessage(`{"keys":["team","cost-center"]}`)}
+		whsvr, err := NewWebhookServer(WithConfig(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments",
+			Labels: map[string]string{"team": "payments", "cost-center": "cc-42"}}})
+		ctx, cancel := context.WithCancel(context.Background())
+		whsvr.StartInformers(ctx, client, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+		waitFor(t, func() bool { return whsvr.InformersSynced(time.Now()) == nil })
+		handler := whsvr.Handler()
+
+		review, response := admitSecret(t, handler, FixtureSecret{Name: "api-tls", Namespace: "payments", DataSize: 16}.Build())
+		created := patchedSecret(t, review, response)
+		if created.Labels["team"] != "payments" || created.Labels["cost-center"] != "cc-42" {
+			t.Errorf("fail open %v: labels %v, want the namespace's", failOpen, created.Labels)
+		}
+
+		namespace, err := client.CoreV1().Namespaces().Get(ctx, "payments", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		namespace.Labels = map[string]string{"team": "billing"}
+		if _, err := client.CoreV1().Namespaces().Update(ctx, namespace, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool {
+			cached, err := whsvr.informers.namespaces.Get("payments")
+			return err == nil && cached.Labels["team"] == "billing"
+		})
+		update, err := FixtureReview(created, v1beta1.Update, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated := patchedSecret(t, update, admitWith(t, handler, update))
+		if _, ok := updated.Labels["cost-center"]; updated.Labels["team"] != "billing" || ok {
+			t.Errorf("fail open %v: labels %v after the namespace changed, want team billing only", failOpen, updated.Labels)
+		}
+
+		if _, response := admitSecret(t, handler, FixtureSecret{Name: "api-tls", Namespace: "new", DataSize: 16}.Build()); response.Allowed != failOpen || len(response.Patch) != 0 {
+			t.Errorf("fail open %v: uncached namespace's secret allowed %v with patch %s", failOpen, response.Allowed, response.Patch)
+		}
+		whsvr.Close()
+		cancel()
+	}
+}
+
+// Without a feature reading the cluster no informer runs, and the server
+// is ready at once.
+func TestInformersNotNeeded(t *testing.T) {
+	whsvr, err := NewWebhookServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if whsvr.NeedsInformers() {
+		t.Error("informers needed by the default config")
+	}
+	if err := whsvr.InformersSynced(time.Now()); err != nil {
+		t.Errorf("not ready without informers: %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// DefaultLeaseName is the name of the Lease the replicas elect the one
+// running the controllers on.
+const DefaultLeaseName = "cert-manager-webhook"
+
+// LeaderElectionConfig holds the settings of the leader election.
+type LeaderElectionConfig struct {
+	// Namespace and Name are those of the Lease.
+	Namespace, Name string
+	// Identity tells the replicas apart, e.g. the pod name.
+	Identity string
+	// LeaseDuration is how long the other replicas wait before taking over
+	// a lease that wasn't renewed, RenewDeadline how long the leader tries
+	// to renew it before giving up, RetryPeriod the time between attempts.
+	LeaseDuration, RenewDeadline, RetryPeriod time.Duration
+}
+
+// DefaultLeaderElection returns client-go's usual durations for the lease
+// DefaultLeaseName.
+func DefaultLeaderElection() LeaderElectionConfig {
+	return LeaderElectionConfig{
+		Name:          DefaultLeaseName,
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+	}
+}
+
+// Controller is a component that must run on one replica at a time,
+// because it writes to the cluster. The admission handlers serve on every
+// replica regardless.
+type Controller interface {
+	// Lead runs the controller until ctx is done, which happens when the
+	// replica loses the lease.
+	Lead(ctx context.Context)
+	// Stopped is called once Lead returned, to reset what the controller
+	// exports only while leading.
+	Stopped()
+}
+
+// LeaderElector runs the controllers on the replica holding the Lease. On
+// losing it, it cancels them and waits for them to return before releasing
+// the lease and running for it again, so no two replicas run them at once.
+type LeaderElector struct {
+	log         logr.Logger
+	client      kubernetes.Interface
+	config      LeaderElectionConfig
+	names       []string
+	controllers []Controller
+}
+
+// NewLeaderElector returns an elector with no controllers.
+func NewLeaderElector(log logr.Logger, client kubernetes.Interface, config LeaderElectionConfig) *LeaderElector {
+	return &LeaderElector{log: log, client: client, config: config}
+}
+
+// Add registers a controller under name, before Run.
+func (e *LeaderElector) Add(name string, controller Controller) {
+	e.names = append(e.names, name)
+	e.controllers = append(e.controllers, controller)
+}
+
+// Run takes part in leader election until ctx is cancelled, running the
+// controllers while leading.
+func (e *LeaderElector) Run(ctx context.Context) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: e.config.Namespace, Name: e.config.Name},
+		Client:     e.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: e.config.Identity},
+	}
+	e.log.Info("Running for the lease", "lease", e.config.Namespace+"/"+e.config.Name, "identity", e.config.Identity, "controllers", e.names)
+	for ctx.Err() == nil {
+		var (
+			started atomic.Bool
+			done    = make(chan struct{})
+		)
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:          lock,
+			LeaseDuration: e.config.LeaseDuration,
+			RenewDeadline: e.config.RenewDeadline,
+			RetryPeriod:   e.config.RetryPeriod,
+			Name:          e.config.Name,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					started.Store(true)
+					defer close(done)
+					e.lead(ctx)
+				},
+				OnStoppedLeading: func() {},
+				OnNewLeader: func(identity string) {
+					if identity != e.config.Identity {
+						e.log.Info("New leader elected", "leader", identity)
+					}
+				},
+			},
+		})
+		// the controllers of a lost term stop before the next election
+		if started.Load() {
+			<-done
+			// not ReleaseOnCancel, which releases before the term's
+			// context is even cancelled
+			e.release(lock)
+		}
+	}
+}
+
+// release hands the lease over when this replica still holds it, so the
+// next leader doesn't wait for it to expire.
+func (e *LeaderElector) release(lock *resourcelock.LeaseLock) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.config.RenewDeadline)
+	defer cancel()
+	record, _, err := lock.Get(ctx)
+	if err != nil || record.HolderIdentity != e.config.Identity {
+		return
+	}
+	now := metav1.NewTime(time.Now())
+	if err := lock.Update(ctx, resourcelock.LeaderElectionRecord{
+		LeaderTransitions:    record.LeaderTransitions,
+		LeaseDurationSeconds: 1,
+		AcquireTime:          now,
+		RenewTime:            now,
+	}); err != nil {
+		e.log.Error(err, "Failed to release the lease", "lease", e.config.Namespace+"/"+e.config.Name)
+		return
+	}
+	e.log.Info("Released the lease", "lease", e.config.Namespace+"/"+e.config.Name)
+}
+
+// lead runs the controllers until ctx is done and they all returned, then
+// resets them.
+func (e *LeaderElector) lead(ctx context.Context) {
+	metrics.IsLeader.Set(1)
+	e.log.Info("Started leading, starting controllers", "controllers", e.names)
+	var wg sync.WaitGroup
+	for i, controller := range e.controllers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			controller.Lead(ctx)
+			if ctx.Err() == nil {
+				e.log.Info("Controller returned while leading", "controller", e.names[i])
+			}
+		}()
+	}
+	wg.Wait()
+	for _, controller := range e.controllers {
+		controller.Stopped()
+	}
+	metrics.IsLeader.Set(0)
+	e.log.Info("Stopped leading, controllers stopped")
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/zapr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// reconciler is a controller whose reconcile is in progress until its
+// term ends, then takes a while to wind down. leading counts the
+// reconcilers running across replicas.
+type reconciler struct {
+	leading     *atomic.Int32
+	overlapped  *atomic.Bool
+	started     atomic.Int32
+	interrupted atomic.Int32
+	stopped     atomic.Int32
+}
+
+func (r *reconciler) Lead(ctx context.Context) {
+	r.started.Add(1)
+	if r.leading.Add(1) > 1 {
+		r.overlapped.Store(true)
+	}
+	<-ctx.Done()
+	time.Sleep(200 * time.Millisecond)
+	r.interrupted.Add(1)
+	r.leading.Add(-1)
+}
+
+func (r *reconciler) Stopped() { r.stopped.Add(1) }
+
+// A leader losing the lease mid-reconcile stops its controllers, and they
+// return before another replica's start, even though the lease is released
+// as soon as they did. The gauge and the logs follow the leadership.
+func TestLeaderLoss(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	// replica a is cut off from the API server once partitioned
+	var partitioned atomic.Bool
+	client.PrependReactor("*", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		write, ok := action.(interface{ GetObject() runtime.Object })
+		if !ok || !partitioned.Load() {
+			return false, nil, nil
+		}
+		if lease, ok := write.GetObject().(*coordinationv1.Lease); ok && lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == "a" {
+			return true, nil, errors.New("connection refused")
+		}
+		return false, nil, nil
+	})
+	var leading atomic.Int32
+	var overlapped atomic.Bool
+	elect := func(identity string) (*reconciler, *observer.ObservedLogs, context.CancelFunc, chan struct{}) {
+		config := DefaultLeaderElection()
+		// the lease records its duration in whole seconds
+		config.Namespace, config.Identity = "cert-manager", identity
+		config.LeaseDuration, config.RenewDeadline, config.RetryPeriod = time.Second, 500*time.Millisecond, 100*time.Millisecond
+		core, logs := observer.New(zapcore.InfoLevel)
+		elector := NewLeaderElector(zapr.NewLogger(zap.New(core)), client, config)
+		controller := &reconciler{leading: &leading, overlapped: &overlapped}
+		elector.Add("reconciler", controller)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			elector.Run(ctx)
+			close(done)
+		}()
+		return controller, logs, cancel, done
+	}
+
+	a, aLogs, cancelA, doneA := elect("a")
+	waitFor(t, func() bool { return a.started.Load() == 1 })
+	if got := testutil.ToFloat64(metrics.IsLeader); got != 1 {
+		t.Errorf("webhook_is_leader %v while leading, want 1", got)
+	}
+	b, _, cancelB, doneB := elect("b")
+
+	partitioned.Store(true)
+	waitFor(t, func() bool { return a.stopped.Load() == 1 })
+	if a.interrupted.Load() != 1 {
+		t.Error("controller reset before its reconcile returned")
+	}
+	waitFor(t, func() bool { return b.started.Load() == 1 })
+	if overlapped.Load() {
+		t.Error("controllers ran on both replicas at once")
+	}
+	if got := testutil.ToFloat64(metrics.IsLeader); got != 1 {
+		t.Errorf("webhook_is_leader %v once b leads, want 1", got)
+	}
+	// a runs for the lease again but doesn't get it while b holds it
+	partitioned.Store(false)
+	time.Sleep(300 * time.Millisecond)
+	if a.started.Load() != 1 {
+		t.Error("a started leading again while b held the lease")
+	}
+	for _, message := range []string{"Started leading, starting controllers", "Stopped leading, controllers stopped", "New leader elected"} {
+		if aLogs.FilterMessage(message).Len() == 0 {
+			t.Errorf("a didn't log %q", message)
+		}
+	}
+	if entries := aLogs.FilterMessage("New leader elected").All(); len(entries) > 0 && entries[len(entries)-1].ContextMap()["leader"] != "b" {
+		t.Errorf("new leader logged as %v, want b", entries[len(entries)-1].ContextMap())
+	}
+
+	cancelB()
+	<-doneB
+	if b.stopped.Load() != 1 || b.interrupted.Load() != 1 {
+		t.Errorf("b's controller interrupted %d and stopped %d times on shutdown, want once", b.interrupted.Load(), b.stopped.Load())
+	}
+	// b released the lease on shutdown, a takes it over
+	waitFor(t, func() bool { return a.started.Load() == 2 })
+	cancelA()
+	<-doneA
+	if got := testutil.ToFloat64(metrics.IsLeader); got != 0 {
+		t.Errorf("webhook_is_leader %v once stopped, want 0", got)
+	}
+	if overlapped.Load() {
+		t.Error("controllers ran on both replicas at once")
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const unixScheme = "unix://"
+
+// IsUnixListen reports whether a listen spec names a Unix domain socket.
+func IsUnixListen(spec string) bool {
+	return strings.HasPrefix(spec, unixScheme)
+}
+
+// IsLocalListen reports whether spec is only reachable from inside the pod:
+// a Unix socket or a loopback address.
+func IsLocalListen(spec string) bool {
+	if IsUnixListen(spec) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(spec)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Listen opens a listener for spec, which is either a TCP "host:port"
+// address or a "unix:///path/to/socket" URL. A stale socket file left
+// behind by a previous process is removed first.
+func Listen(spec string) (net.Listener, error) {
+	if !IsUnixListen(spec) {
+		return net.Listen("tcp", spec)
+	}
+
+	path := strings.TrimPrefix(spec, unixScheme)
+	if path == "" {
+		return nil, fmt.Errorf("missing socket path in %q", spec)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// removeStaleSocket deletes the socket file at path unless another process
+// is still accepting connections on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// CheckPortConflict rejects an ops address that would collide with the
+// webhook listener, which net.Listen only reports as a bare EADDRINUSE.
+func CheckPortConflict(webhookSpec, opsSpec string) error {
+	if IsUnixListen(webhookSpec) || IsUnixListen(opsSpec) {
+		if webhookSpec == opsSpec {
+			return fmt.Errorf("webhook and ops listeners share %s", webhookSpec)
+		}
+		return nil
+	}
+	webhookHost, webhookPort, err := net.SplitHostPort(webhookSpec)
+	if err != nil {
+		return err
+	}
+	opsHost, opsPort, err := net.SplitHostPort(opsSpec)
+	if err != nil {
+		return err
+	}
+	if webhookPort != opsPort {
+		return nil
+	}
+	if webhookHost == "" || opsHost == "" || webhookHost == opsHost {
+		return fmt.Errorf("ops port %s conflicts with the webhook port", opsPort)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+// socketPath returns a path for a Unix socket in a directory removed when
+// the test ends, short enough for the 108 byte limit of socket paths.
+func socketPath(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "webhook.sock")
+}
+
+// webhookHTTPServer returns a server answering admissions on /mutate.
+func webhookHTTPServer() *http.Server {
+	whsvr := newDefaultServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", whsvr.serve)
+	return &http.Server{Handler: mux}
+}
+
+// admitOver posts a review of a fixture secret to the webhook through
+// client and reports whether it was allowed.
+func admitOver(t *testing.T, client *http.Client, url string) bool {
+	t.Helper()
+	body, err := json.Marshal(secretReview(t, "tls", "apps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.Post(url+"/mutate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var answer v1beta1.AdmissionReview
+	if err := json.NewDecoder(res.Body).Decode(&answer); err != nil {
+		t.Fatalf("decoding answer %s: %v", res.Status, err)
+	}
+	return answer.Response != nil && answer.Response.Allowed
+}
+
+func TestListenTCP(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host, _, _ := net.SplitHostPort(ln.Addr().String()); host != "127.0.0.1" {
+		t.Errorf("listening on %s, want the loopback address only", ln.Addr())
+	}
+	serveHTTP(t, webhookHTTPServer(), ln)
+	if !admitOver(t, http.DefaultClient, "http://"+ln.Addr().String()) {
+		t.Error("secret not allowed")
+	}
+}
+
+// Admissions are served in plain HTTP on a Unix socket, the fronting proxy
+// terminating TLS.
+func TestListenUnix(t *testing.T) {
+	path := socketPath(t)
+	ln, err := Listen("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveHTTP(t, webhookHTTPServer(), ln)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	defer client.CloseIdleConnections()
+	if !admitOver(t, client, "http://webhook") {
+		t.Error("secret not allowed")
+	}
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	path := socketPath(t)
+	// a socket file left behind by a process that died
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("no stale socket file: %v", err)
+	}
+
+	ln, err := Listen("unix://" + path)
+	if err != nil {
+		t.Fatalf("stale socket not removed: %v", err)
+	}
+	defer ln.Close()
+
+	// a socket still accepting connections is left alone
+	if _, err := Listen("unix://" + path); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("listening on a socket in use: %v, want refused", err)
+	}
+}
+
+func TestListenUnixInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []string{"unix://", "unix://" + file} {
+		if ln, err := Listen(spec); err == nil {
+			ln.Close()
+			t.Errorf("listen(%q) succeeded", spec)
+		}
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+}
+
+func TestIsLocalListen(t *testing.T) {
+	for spec, want := range map[string]bool{
+		"unix:///var/run/webhook.sock": true,
+		"127.0.0.1:8080":               true,
+		"[::1]:8080":                   true,
+		"localhost:8080":               true,
+		":8080":                        false,
+		"0.0.0.0:8080":                 false,
+		"10.0.0.1:8080":                false,
+		"no-port":                      false,
+	} {
+		if got := IsLocalListen(spec); got != want {
+			t.Errorf("isLocalListen(%q) = %v, want %v", spec, got, want)
+		}
+	}
+}
+
+func TestCheckPortConflict(t *testing.T) {
+	tests := []struct {
+		webhook, ops string
+		conflict     bool
+	}{
+		{webhook: ":8443", ops: ":8080"},
+		{webhook: ":8443", ops: ":8443", conflict: true},
+		{webhook: ":8443", ops: "127.0.0.1:8443", conflict: true},
+		{webhook: "10.0.0.1:8443", ops: "127.0.0.1:8443"},
+		{webhook: "unix:///run/webhook.sock", ops: ":8443"},
+		{webhook: "unix:///run/webhook.sock", ops: "unix:///run/webhook.sock", conflict: true},
+	}
+	for _, tt := range tests {
+		if err := CheckPortConflict(tt.webhook, tt.ops); (err != nil) != tt.conflict {
+			t.Errorf("checkPortConflict(%q, %q) = %v, want conflict %v", tt.webhook, tt.ops, err, tt.conflict)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The server's logger gets the admission lines, with the fields that
+// identify the request.
+func TestInjectedLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	whsvr := newDefaultServer(WithLogger(zapr.NewLogger(zap.New(core))))
+	review := secretReview(t, "tls", "apps")
+	admit(t, whsvr, review)
+
+	mutating := logs.FilterMessage("Mutating object").All()
+	if len(mutating) != 1 {
+		t.Fatalf("%d mutation lines, want 1: %v", len(mutating), logs.All())
+	}
+	fields := mutating[0].ContextMap()
+	want := map[string]string{
+		"namespace": "apps",
+		"name":      "tls",
+		"uid":       string(review.Request.UID),
+		"operation": string(v1beta1.Create),
+	}
+	for key, value := range want {
+		if fmt.Sprint(fields[key]) != value {
+			t.Errorf("%s = %v, want %v", key, fields[key], value)
+		}
+	}
+	if _, ok := fields["requestID"]; !ok {
+		t.Errorf("no request ID: %v", fields)
+	}
+	// debug lines are only written at debug level
+	if debug := logs.FilterMessage("Decoded object").Len(); debug != 0 {
+		t.Errorf("%d debug lines at info level", debug)
+	}
+}
+
+// renderingSink is a logr sink at info level recording the lines it
+// writes and counting the values they would render.
+type renderingSink struct {
+	mu      sync.Mutex
+	lines   []string
+	renders int
+}
+
+func (s *renderingSink) Init(logr.RuntimeInfo)        {}
+func (s *renderingSink) Enabled(level int) bool       { return level == 0 }
+func (s *renderingSink) Error(error, string, ...any)  {}
+func (s *renderingSink) WithName(string) logr.LogSink { return s }
+
+func (s *renderingSink) WithValues(...any) logr.LogSink { return s }
+
+func (s *renderingSink) Info(_ int, msg string, keysAndValues ...any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(s.lines, msg)
+	s.renders += renderedValues(keysAndValues)
+}
+
+// renderedValues counts the values that render themselves, the costly
+// ones.
+func renderedValues(keysAndValues []any) int {
+	n := 0
+	for _, value := range keysAndValues {
+		switch value.(type) {
+		case logr.Marshaler, fmt.Stringer:
+			n++
+		}
+	}
+	return n
+}
+
+// At info level an admission logs its one summary line and renders
+// nothing: the object and the patch are only rendered at debug level.
+func TestInfoLevelRendersNothing(t *testing.T) {
+	sink := &renderingSink{}
+	handler := newTestHandler(t, DefaultConfig(), WithLogger(logr.New(sink)))
+	admitSecret(t, handler, FixtureSecret{Name: "tls", Namespace: "apps", DataSize: 4096}.Build())
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.lines) != 1 || sink.lines[0] != "Mutating object" {
+		t.Errorf("lines %q, want the summary only", sink.lines)
+	}
+	if sink.renders != 0 {
+		t.Errorf("%d values rendered at info level", sink.renders)
+	}
+}
+
+// At debug level the decoded object and the patch are logged, redacted.
+func TestDebugLevelDetail(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	handler := newTestHandler(t, DefaultConfig(), WithLogger(zapr.NewLogger(zap.New(core))))
+	secret := FixtureSecret{Name: "tls", Namespace: "apps", DataSize: 16}.Build()
+	secret.Data[corev1.TLSPrivateKeyKey] = []byte(sentinel)
+	admitSecret(t, handler, secret)
+
+	for _, message := range []string{"AdmissionReview", "Decoded object", "Patch", "Mutating object"} {
+		lines := logs.FilterMessage(message).All()
+		if len(lines) != 1 {
+			t.Errorf("%d %q lines at debug level, want 1", len(lines), message)
+			continue
+		}
+		if rendered := fmt.Sprint(lines[0].ContextMap()); strings.Contains(rendered, sentinel) {
+			t.Errorf("%q line holds the key: %s", message, rendered)
+		}
+	}
+	if object := fmt.Sprint(logs.FilterMessage("Decoded object").All()[0].ContextMap()["object"]); !strings.Contains(object, "fixture-issuer") {
+		t.Errorf("decoded object logged as %s, want its annotations", object)
+	}
+}
+
+// BenchmarkLogLevel compares the cost of an admission logged at info
+// level, its summary line only, and at debug level, the object and the
+// patch rendered too.
+func BenchmarkLogLevel(b *testing.B) {
+	review, err := FixtureReview(FixtureSecret{Name: "tls", Namespace: "apps", DataSize: 2048}.Build(), v1beta1.Create, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, level := range []zapcore.Level{zapcore.InfoLevel, zapcore.DebugLevel} {
+		b.Run(level.String(), func(b *testing.B) {
+			core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(io.Discard), level)
+			handler, err := NewHandler(DefaultConfig(), WithLogger(zapr.NewLogger(zap.New(core))))
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			for b.Loop() {
+				ServeLocal(context.Background(), handler, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type logLevelRequest struct {
+	Level string `json:"level"`
+	// Duration, if set, reverts to the startup level after it elapses.
+	Duration string `json:"duration,omitempty"`
+}
+
+type logLevelResponse struct {
+	Level    string     `json:"level"`
+	RevertAt *time.Time `json:"revertAt,omitempty"`
+}
+
+// logLevelHandler serves /debug/loglevel: GET returns the active level and
+// PUT changes it, like /debug/flags/v on Kubernetes components.
+type logLevelHandler struct {
+	log     logr.Logger
+	level   zap.AtomicLevel
+	initial zapcore.Level
+
+	mu         sync.Mutex
+	generation int // bumped on every change so a stale revert is ignored
+	revert     *time.Timer
+	revertAt   *time.Time
+}
+
+func NewLogLevelHandler(log logr.Logger, level zap.AtomicLevel) *logLevelHandler {
+	return &logLevelHandler{
+		log:     log,
+		level:   level,
+		initial: level.Level(),
+	}
+}
+
+func (h *logLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if status, err := h.set(r); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.mu.Lock()
+	resp := logLevelResponse{Level: h.level.Level().String(), RevertAt: h.revertAt}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (h *logLevelHandler) set(r *http.Request) (int, error) {
+	var req logLevelRequest
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1024)).Decode(&req); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid request: %v", err)
+	}
+	level, err := zapcore.ParseLevel(req.Level)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	var duration time.Duration
+	if req.Duration != "" {
+		if duration, err = time.ParseDuration(req.Duration); err != nil || duration <= 0 {
+			return http.StatusBadRequest, fmt.Errorf("invalid duration %q", req.Duration)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.revert != nil {
+		h.revert.Stop()
+		h.revert, h.revertAt = nil, nil
+	}
+	h.generation++
+	h.level.SetLevel(level)
+	h.log.Info("Log level changed", "level", level.String(), "duration", req.Duration)
+
+	if duration > 0 {
+		generation := h.generation
+		revertAt := time.Now().Add(duration)
+		h.revertAt = &revertAt
+		h.revert = time.AfterFunc(duration, func() { h.reset(generation) })
+	}
+	return http.StatusOK, nil
+}
+
+// reset restores the startup level once a temporary change expires.
+func (h *logLevelHandler) reset(generation int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if generation != h.generation {
+		return
+	}
+	h.level.SetLevel(h.initial)
+	h.revert, h.revertAt = nil, nil
+	h.log.Info("Log level reverted", "level", h.initial.String())
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// callLogLevel sends a request to the /debug/loglevel handler and returns
+// the answer.
+func callLogLevel(h http.Handler, method, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, "/debug/loglevel", strings.NewReader(body)))
+	return rec
+}
+
+// activeLevel returns the level GET reports.
+func activeLevel(t *testing.T, h http.Handler) logLevelResponse {
+	t.Helper()
+	rec := callLogLevel(h, http.MethodGet, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET answered %d: %s", rec.Code, rec.Body)
+	}
+	var resp logLevelResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestLogLevelChange(t *testing.T) {
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	h := NewLogLevelHandler(logr.Discard(), level)
+	if got := activeLevel(t, h).Level; got != "info" {
+		t.Fatalf("level %s, want info", got)
+	}
+	if rec := callLogLevel(h, http.MethodPut, `{"level":"debug"}`); rec.Code != http.StatusOK {
+		t.Fatalf("PUT answered %d: %s", rec.Code, rec.Body)
+	}
+	if level.Level() != zapcore.DebugLevel {
+		t.Errorf("logger level %v, want debug", level.Level())
+	}
+	if resp := activeLevel(t, h); resp.Level != "debug" || resp.RevertAt != nil {
+		t.Errorf("GET reports %+v, want debug for good", resp)
+	}
+}
+
+func TestLogLevelInvalid(t *testing.T) {
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	h := NewLogLevelHandler(logr.Discard(), level)
+	for name, body := range map[string]string{
+		"unknown level":     `{"level":"verbose"}`,
+		"negative duration": `{"level":"debug","duration":"-1m"}`,
+		"invalid duration":  `{"level":"debug","duration":"soon"}`,
+		"not JSON":          `level=debug`,
+	} {
+		if rec := callLogLevel(h, http.MethodPut, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: answered %d, want 400", name, rec.Code)
+		}
+	}
+	if level.Level() != zapcore.InfoLevel {
+		t.Errorf("level changed to %v by invalid requests", level.Level())
+	}
+	if rec := callLogLevel(h, http.MethodPost, `{"level":"debug"}`); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST answered %d, want 405", rec.Code)
+	}
+}
+
+// A temporary level reverts to the startup level once its duration is up;
+// a later change cancels the pending revert.
+func TestLogLevelRevert(t *testing.T) {
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	h := NewLogLevelHandler(logr.Discard(), level)
+
+	callLogLevel(h, http.MethodPut, `{"level":"debug","duration":"50ms"}`)
+	if resp := activeLevel(t, h); resp.Level != "debug" || resp.RevertAt == nil {
+		t.Errorf("GET reports %+v, want debug until a revert", resp)
+	}
+	waitFor(t, func() bool { return level.Level() == zapcore.InfoLevel })
+	if resp := activeLevel(t, h); resp.RevertAt != nil {
+		t.Errorf("revert still pending after it ran: %+v", resp)
+	}
+
+	// the error level set for good outlives the revert of the debug one
+	callLogLevel(h, http.MethodPut, `{"level":"debug","duration":"50ms"}`)
+	callLogLevel(h, http.MethodPut, `{"level":"error"}`)
+	time.Sleep(150 * time.Millisecond)
+	if level.Level() != zapcore.ErrorLevel {
+		t.Errorf("level %v after a stale revert, want error", level.Level())
+	}
+}
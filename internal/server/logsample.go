@@ -0,0 +1,104 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// maxSampledObjects bounds the objects remembered between summaries.
+const maxSampledObjects = 10000
+
+// DecisionSampler thins out the routine per-admission decision logs on busy
+// clusters. The first decision seen for an object, and any change of
+// decision, is always logged; after that only every Nth identical decision
+// per namespace is. Errors are logged outside the sampler, and raising the
+// log level to debug turns sampling off so one object can be followed.
+type DecisionSampler struct {
+	every uint64
+
+	mu         sync.Mutex
+	seen       map[string]string // namespace/name -> last decision
+	repeats    map[string]uint64 // namespace + decision -> repeats since summary
+	decisions  map[string]uint64 // decision -> count since summary
+	suppressed uint64
+}
+
+func NewDecisionSampler(every uint64) *DecisionSampler {
+	s := &DecisionSampler{every: every}
+	s.reset()
+	return s
+}
+
+func (s *DecisionSampler) reset() {
+	s.seen = map[string]string{}
+	s.repeats = map[string]uint64{}
+	s.decisions = map[string]uint64{}
+	s.suppressed = 0
+}
+
+// sample counts a decision and reports whether it should be logged. A nil
+// sampler logs everything.
+func (s *DecisionSampler) sample(log logr.Logger, namespace, name, decision string) bool {
+	if s == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.decisions[decision]++
+	if log.V(1).Enabled() || s.every <= 1 {
+		return true
+	}
+
+	object := namespace + "/" + name
+	if last, ok := s.seen[object]; !ok || last != decision {
+		if len(s.seen) >= maxSampledObjects {
+			s.seen = map[string]string{}
+		}
+		s.seen[object] = decision
+		return true
+	}
+
+	key := namespace + "\x00" + decision
+	s.repeats[key]++
+	if s.repeats[key]%s.every == 0 {
+		return true
+	}
+	s.suppressed++
+	return false
+}
+
+// Summarize logs the decisions counted since the previous summary every
+// interval, until stop is closed.
+func (s *DecisionSampler) Summarize(log logr.Logger, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		decisions, suppressed := s.decisions, s.suppressed
+		s.reset()
+		s.mu.Unlock()
+
+		keys := make([]string, 0, len(decisions))
+		for decision := range decisions {
+			keys = append(keys, decision)
+		}
+		sort.Strings(keys)
+		keysAndValues := []interface{}{"interval", interval.String(), "suppressed", suppressed}
+		for _, decision := range keys {
+			keysAndValues = append(keysAndValues, decision, decisions[decision])
+		}
+		log.Info("Admission summary", keysAndValues...)
+	}
+}
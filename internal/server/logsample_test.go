@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// A burst of identical decisions on one object logs the first and every
+// Nth repeat.
+func TestDecisionSamplerBurst(t *testing.T) {
+	sampler := NewDecisionSampler(5)
+	logged := 0
+	for range 21 {
+		if sampler.sample(logr.Discard(), "apps", "tls", decisionMutated) {
+			logged++
+		}
+	}
+	// the first, then repeats 5, 10, 15 and 20
+	if logged != 5 {
+		t.Errorf("%d of 21 identical decisions logged, want 5", logged)
+	}
+	if sampler.suppressed != 16 {
+		t.Errorf("%d suppressed, want 16", sampler.suppressed)
+	}
+}
+
+func TestDecisionSamplerAlwaysLogged(t *testing.T) {
+	sampler := NewDecisionSampler(100)
+	sampler.sample(logr.Discard(), "apps", "tls", decisionMutated)
+	sampler.sample(logr.Discard(), "apps", "tls", decisionMutated)
+
+	if !sampler.sample(logr.Discard(), "apps", "other", decisionMutated) {
+		t.Error("first decision of another object suppressed")
+	}
+	if !sampler.sample(logr.Discard(), "apps", "tls", decisionSkipped+"/"+skipReplica) {
+		t.Error("changed decision suppressed")
+	}
+	// following one object at debug level logs all its decisions
+	core, _ := observer.New(zapcore.DebugLevel)
+	debug := zapr.NewLogger(zap.New(core))
+	for range 3 {
+		if !sampler.sample(debug, "apps", "tls", decisionSkipped+"/"+skipReplica) {
+			t.Error("decision suppressed at debug level")
+		}
+	}
+
+	var none *DecisionSampler
+	if !none.sample(logr.Discard(), "apps", "tls", decisionMutated) {
+		t.Error("nil sampler suppressed a decision")
+	}
+}
+
+// The summary counts the decisions since the previous one.
+func TestDecisionSamplerSummary(t *testing.T) {
+	sampler := NewDecisionSampler(10)
+	for i := range 12 {
+		sampler.sample(logr.Discard(), "apps", "tls", decisionMutated)
+		sampler.sample(logr.Discard(), "apps", fmt.Sprintf("opaque-%d", i), decisionSkipped)
+	}
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sampler.Summarize(zapr.NewLogger(zap.New(core)), 10*time.Millisecond, stop)
+	}()
+	waitFor(t, func() bool { return logs.FilterMessage("Admission summary").Len() >= 2 })
+	close(stop)
+	<-done
+
+	summaries := logs.FilterMessage("Admission summary").All()
+	first := summaries[0].ContextMap()
+	// 12 mutations of tls log the first and the 10th repeat
+	for key, want := range map[string]any{decisionMutated: uint64(12), decisionSkipped: uint64(12), "suppressed": uint64(10)} {
+		if first[key] != want {
+			t.Errorf("first summary %s = %v, want %v", key, first[key], want)
+		}
+	}
+	second := summaries[1].ContextMap()
+	if _, ok := second[decisionMutated]; ok || second["suppressed"] != uint64(0) {
+		t.Errorf("second summary %v, want nothing counted", second)
+	}
+}
+
+// Through the handler, the routine lines of a hot object are thinned out.
+func TestDecisionSamplerHandler(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	whsvr := newDefaultServer(WithLogger(zapr.NewLogger(zap.New(core))), WithDecisionSampler(NewDecisionSampler(4)))
+	for range 8 {
+		admit(t, whsvr, secretReview(t, "tls", "apps"))
+	}
+	if got := logs.FilterMessage("Mutating object").Len(); got != 2 {
+		t.Errorf("%d of 8 mutations logged, want the first and the 4th repeat", got)
+	}
+}
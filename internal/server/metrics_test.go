@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/zapr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// histogramSamples returns the number of observations of the histogram
+// name gathered from reg, in the series labelled by labels.
+func histogramSamples(t *testing.T, reg prometheus.Gatherer, name string, labels map[string]string) uint64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	series:
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if value, ok := labels[pair.GetName()]; ok && value != pair.GetValue() {
+					continue series
+				}
+			}
+			return metric.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+// scrape returns the text exposition of reg.
+func scrape(t *testing.T, reg prometheus.Gatherer) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape answered %d: %s", rec.Code, rec.Body)
+	}
+	return rec.Body.String()
+}
+
+// Each admission is counted once under its path, operation and result, and
+// timed.
+func TestAdmissionMetrics(t *testing.T) {
+	whsvr := newDefaultServer()
+	tests := []struct {
+		result string
+		review func(t *testing.T) *v1beta1.AdmissionReview
+	}{
+		{metrics.ResultMutated, reviewOf("mutated", "apps")},
+		{metrics.ResultSkipped, reviewOf("skipped", metav1.NamespaceSystem)},
+		{metrics.ResultErrored, func(t *testing.T) *v1beta1.AdmissionReview {
+			review := secretReview(t, "broken", "apps")
+			review.Request.Object.Raw = []byte(`{"apiVersion":"v1","kind":"Secret","metadata":"broken"}`)
+			return review
+		}},
+	}
+	pathLabel := map[string]string{"path": "/mutate"}
+	for _, tt := range tests {
+		t.Run(tt.result, func(t *testing.T) {
+			counter := metrics.Requests.WithLabelValues("/mutate", string(v1beta1.Create), tt.result)
+			before := testutil.ToFloat64(counter)
+			timed := histogramSamples(t, prometheus.DefaultGatherer, "webhook_admission_duration_seconds", pathLabel)
+			admit(t, whsvr, tt.review(t))
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("%s requests counted %v times, want once", tt.result, got)
+			}
+			if got := histogramSamples(t, prometheus.DefaultGatherer, "webhook_admission_duration_seconds", pathLabel) - timed; got != 1 {
+				t.Errorf("%d latency observations, want 1", got)
+			}
+		})
+	}
+
+	out := scrape(t, prometheus.DefaultGatherer)
+	for _, result := range []string{metrics.ResultMutated, metrics.ResultSkipped, metrics.ResultErrored} {
+		series := `webhook_requests_total{operation="CREATE",path="/mutate",result="` + result + `"}`
+		if !strings.Contains(out, series) {
+			t.Errorf("scrape has no %s", series)
+		}
+	}
+	if !strings.Contains(out, "webhook_patch_errors_total") {
+		t.Error("scrape has no patch error counter")
+	}
+}
+
+// The default registry, served on /metrics, carries the Go and process
+// collectors next to the webhook's.
+func TestDefaultRegistryCollectors(t *testing.T) {
+	out := scrape(t, prometheus.DefaultGatherer)
+	for _, name := range []string{"go_goroutines", "process_cpu_seconds_total", "webhook_requests_total"} {
+		if !strings.Contains(out, name) {
+			t.Errorf("default registry has no %s", name)
+		}
+	}
+}
+
+// With several rules, each mutation counts under the rule it matched, and
+// the annotations it adds under their key when configured, or "other".
+// Admissions run concurrently; run with -race.
+func TestRuleMetrics(t *testing.T) {
+	settings, err := json.Marshal(mutator.PolicyConfig{Rules: []mutator.Rule{
+		{Name: "production", MatchExpression: `object.metadata.namespace.startsWith("prod-")`},
+		{Name: "wildcards", MatchExpression: `object.metadata.name.startsWith("wildcard-")`},
+		{Name: "default"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.Mutator.StageConfig = map[string]json.RawMessage{mutator.PolicyStage: settings}
+	handler := newTestHandler(t, config)
+	metrics.SetAnnotationKeys(mutator.SyncAnnotationKey)
+	t.Cleanup(func() { metrics.SetAnnotationKeys() })
+
+	secrets := map[string]FixtureSecret{
+		"production": {Name: "tls", Namespace: "prod-shop", DataSize: 16},
+		"wildcards":  {Name: "wildcard-apps", Namespace: "apps", DataSize: 16},
+		"default":    {Name: "tls", Namespace: "apps", DataSize: 16},
+	}
+	const perRule = 20
+	before := map[string]float64{}
+	for rule := range secrets {
+		before[rule] = testutil.ToFloat64(metrics.RuleMatches.WithLabelValues(rule))
+	}
+	syncBefore := testutil.ToFloat64(metrics.AnnotationsAdded.WithLabelValues(mutator.SyncAnnotationKey))
+	otherBefore := testutil.ToFloat64(metrics.AnnotationsAdded.WithLabelValues("other"))
+	patchesBefore := histogramSamples(t, prometheus.DefaultGatherer, "webhook_patch_bytes", nil)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	otherPerMutation := -1
+	for rule, fixture := range secrets {
+		for range perRule {
+			wg.Go(func() {
+				patched, err := mutateSecret(handler, fixture.Build())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if got := patched.Annotations[mutator.DecisionAnnotationKey]; !strings.Contains(got, rule) {
+					t.Errorf("secret of rule %s has decision %q", rule, got)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				// the annotations other than the sync one
+				otherPerMutation = len(patched.Annotations) - len(fixture.Build().Annotations) - 1
+			})
+		}
+	}
+	wg.Wait()
+
+	for rule := range secrets {
+		if got := testutil.ToFloat64(metrics.RuleMatches.WithLabelValues(rule)) - before[rule]; got != perRule {
+			t.Errorf("rule %s matched %v times, want %d", rule, got, perRule)
+		}
+	}
+	mutations := float64(perRule * len(secrets))
+	if got := testutil.ToFloat64(metrics.AnnotationsAdded.WithLabelValues(mutator.SyncAnnotationKey)) - syncBefore; got != mutations {
+		t.Errorf("sync annotation counted %v times, want %v", got, mutations)
+	}
+	if got := testutil.ToFloat64(metrics.AnnotationsAdded.WithLabelValues("other")) - otherBefore; got != mutations*float64(otherPerMutation) {
+		t.Errorf("other annotations counted %v times, want %v", got, mutations*float64(otherPerMutation))
+	}
+	if got := histogramSamples(t, prometheus.DefaultGatherer, "webhook_patch_bytes", nil) - patchesBefore; got != uint64(mutations) {
+		t.Errorf("%d patch sizes observed, want %v", got, mutations)
+	}
+}
+
+// With ownership signatures, each mutation is counted and logged under the
+// signature the secret matched.
+func TestSignatureMetrics(t *testing.T) {
+	settings, err := json.Marshal(mutator.PolicyConfig{
+		SignaturePresets: []string{mutator.PresetCertManager, mutator.PresetCSIDriver},
+		Signatures:       []mutator.Signature{{Name: "tls-operator", LabelSelector: "app.kubernetes.io/managed-by=tls-operator"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.Mutator.StageConfig = map[string]json.RawMessage{mutator.PolicyStage: settings}
+	core, logs := observer.New(zapcore.InfoLevel)
+	handler := newTestHandler(t, config, WithLogger(zapr.NewLogger(zap.New(core))))
+
+	csi := FixtureSecret{Name: "csi-tls", Namespace: "apps", DataSize: 16, Bare: true}.Build()
+	csi.Annotations = map[string]string{"csi.cert-manager.io/issuer-name": "ca"}
+	operator := FixtureSecret{Name: "operator-tls", Namespace: "apps", DataSize: 16, Bare: true}.Build()
+	operator.Labels = map[string]string{"app.kubernetes.io/managed-by": "tls-operator"}
+	secrets := map[string]*corev1.Secret{
+		mutator.PresetCertManager: FixtureSecret{Name: "api-tls", Namespace: "apps", DataSize: 16}.Build(),
+		mutator.PresetCSIDriver:   csi,
+		"tls-operator":            operator,
+	}
+	for signature, secret := range secrets {
+		counted := metrics.SignatureMatches.WithLabelValues(signature)
+		before := testutil.ToFloat64(counted)
+		if _, err := mutateSecret(handler, secret); err != nil {
+			t.Fatal(err)
+		}
+		if got := testutil.ToFloat64(counted) - before; got != 1 {
+			t.Errorf("signature %s matched %v times, want 1", signature, got)
+		}
+		mutating := logs.FilterMessage("Mutating object").FilterField(zap.String("name", secret.Name)).All()
+		if len(mutating) != 1 || mutating[0].ContextMap()["signature"] != signature {
+			t.Errorf("%s logged as %v, want signature %s", secret.Name, mutating, signature)
+		}
+	}
+
+	unsigned := FixtureSecret{Name: "manual-tls", Namespace: "apps", DataSize: 16, Bare: true}.Build()
+	if _, response := admitSecret(t, handler, unsigned); len(response.Patch) != 0 {
+		t.Errorf("secret matching no signature patched with %s", response.Patch)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// syncOperatorSelector matches the Deployments of kubed and its successor
+// config-syncer as installed by their Helm charts.
+const syncOperatorSelector = "app.kubernetes.io/name in (kubed,config-syncer)"
+
+// OperatorCheck looks for the operator that acts on the sync annotation.
+// Without it the annotations are set but nothing is ever copied, so a
+// missing operator is logged and noted on /readyz, without failing it.
+type OperatorCheck struct {
+	log    logr.Logger
+	client kubernetes.Interface
+
+	mu   sync.RWMutex
+	note string
+}
+
+func NewOperatorCheck(log logr.Logger, client kubernetes.Interface) *OperatorCheck {
+	return &OperatorCheck{log: log, client: client}
+}
+
+func (c *OperatorCheck) check(ctx context.Context) {
+	deployments, err := c.client.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: syncOperatorSelector,
+		Limit:         1,
+	})
+	if apierrors.IsForbidden(err) {
+		c.log.Info("Not allowed to list deployments, can't tell whether kubed/config-syncer is installed")
+		c.setNote("")
+		return
+	}
+	if err != nil {
+		c.log.Error(err, "Failed to look for kubed/config-syncer")
+		return
+	}
+
+	if len(deployments.Items) == 0 {
+		metrics.SyncOperatorPresent.Set(0)
+		c.log.Info("WARNING: kubed/config-syncer not found, annotated secrets will not be synced to other namespaces")
+		c.setNote("kubed/config-syncer not found, secrets will not be synced")
+		return
+	}
+	metrics.SyncOperatorPresent.Set(1)
+	c.setNote("")
+}
+
+func (c *OperatorCheck) setNote(note string) {
+	c.mu.Lock()
+	c.note = note
+	c.mu.Unlock()
+}
+
+// Note returns an informational message for /readyz, empty when there is
+// nothing to report. It is nil-safe.
+func (c *OperatorCheck) Note() string {
+	if c == nil {
+		return ""
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.note
+}
+
+// Watch repeats the check every interval until stop is closed.
+func (c *OperatorCheck) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		c.check(ctx)
+		cancel()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
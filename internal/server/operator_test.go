@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+func deployment(namespace, name string) *appsv1.Deployment {
+	return &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+		Namespace: namespace,
+		Name:      name,
+		Labels:    map[string]string{"app.kubernetes.io/name": name},
+	}}
+}
+
+// The note and metric follow the operator as it is installed, replaced and
+// removed.
+func TestOperatorCheck(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewClientset(deployment("apps", "unrelated"))
+	c := NewOperatorCheck(logr.Discard(), client)
+	deployments := client.AppsV1().Deployments
+	steps := []struct {
+		name    string
+		change  func() error
+		present bool
+	}{
+		{name: "missing", change: func() error { return nil }},
+		{name: "kubed installed", present: true, change: func() error {
+			_, err := deployments("kube-system").Create(ctx, deployment("kube-system", "kubed"), metav1.CreateOptions{})
+			return err
+		}},
+		{name: "replaced by config-syncer", present: true, change: func() error {
+			if err := deployments("kube-system").Delete(ctx, "kubed", metav1.DeleteOptions{}); err != nil {
+				return err
+			}
+			_, err := deployments("config-syncer").Create(ctx, deployment("config-syncer", "config-syncer"), metav1.CreateOptions{})
+			return err
+		}},
+		{name: "removed", change: func() error {
+			return deployments("config-syncer").Delete(ctx, "config-syncer", metav1.DeleteOptions{})
+		}},
+	}
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatal(err)
+		}
+		c.check(ctx)
+		note := c.Note()
+		if step.present != (note == "") {
+			t.Errorf("%s: note %q", step.name, note)
+		}
+		want := 0.0
+		if step.present {
+			want = 1
+		}
+		if got := testutil.ToFloat64(metrics.SyncOperatorPresent); got != want {
+			t.Errorf("%s: operator present metric %v, want %v", step.name, got, want)
+		}
+	}
+}
+
+func TestOperatorCheckErrors(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewClientset()
+	c := NewOperatorCheck(logr.Discard(), client)
+	c.check(ctx)
+	if c.Note() == "" {
+		t.Fatal("no note without an operator")
+	}
+
+	// a transient error keeps the last note
+	fail := func(err error) {
+		client.PrependReactor("list", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, err
+		})
+	}
+	fail(apierrors.NewServiceUnavailable("overloaded"))
+	c.check(ctx)
+	if !strings.Contains(c.Note(), "not found") {
+		t.Errorf("note %q after a transient error, want the last one", c.Note())
+	}
+
+	// without RBAC to list deployments nothing can be told
+	fail(apierrors.NewForbidden(schema.GroupResource{Group: "apps", Resource: "deployments"}, "", nil))
+	c.check(ctx)
+	if note := c.Note(); note != "" {
+		t.Errorf("note %q when forbidden", note)
+	}
+
+	var none *OperatorCheck
+	if note := none.Note(); note != "" {
+		t.Errorf("nil check noted %q", note)
+	}
+}
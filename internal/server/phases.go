@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Phases of an admission, timed for slow request warnings.
+const (
+	phaseRead   = "read"
+	phaseDecode = "decode"
+	phasePolicy = "policy"
+	phasePatch  = "patch"
+
+	phaseDownstream = "downstream"
+)
+
+var phases = [...]string{phaseRead, phaseDecode, phasePolicy, phasePatch, phaseDownstream}
+
+// phaseTimings collects how long each phase of one admission took, indexed
+// like phases.
+type phaseTimings struct {
+	mu        sync.Mutex
+	durations [len(phases)]time.Duration
+	ran       [len(phases)]bool
+}
+
+type phaseTimingsKey struct{}
+
+func withPhaseTimings(ctx context.Context) (context.Context, *phaseTimings) {
+	timings := &phaseTimings{}
+	return context.WithValue(ctx, phaseTimingsKey{}, timings), timings
+}
+
+func (t *phaseTimings) add(name string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	for i, phase := range phases {
+		if phase == name {
+			t.mu.Lock()
+			t.durations[i] += d
+			t.ran[i] = true
+			t.mu.Unlock()
+			return
+		}
+	}
+}
+
+// slowest returns the phase that took longest, with all durations as
+// strings for logging.
+func (t *phaseTimings) slowest() (string, map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	slowest, max := "", time.Duration(-1)
+	all := make(map[string]string, len(phases))
+	for i, name := range phases {
+		if !t.ran[i] {
+			continue
+		}
+		d := t.durations[i]
+		all[name] = d.String()
+		if d > max {
+			slowest, max = name, d
+		}
+	}
+	return slowest, all
+}
+
+// phase is a tracing span that also records its duration in the
+// admission's phase timings when it ends.
+type phase struct {
+	trace.Span
+	name    string
+	start   time.Time
+	timings *phaseTimings
+}
+
+func startPhase(ctx context.Context, name string) phase {
+	// an admission that isn't traced gets no spans for its phases
+	span := trace.SpanFromContext(ctx)
+	if span.IsRecording() {
+		_, span = tracer.Start(ctx, name)
+	}
+	timings, _ := ctx.Value(phaseTimingsKey{}).(*phaseTimings)
+	return phase{Span: span, name: name, start: time.Now(), timings: timings}
+}
+
+func (p phase) End(options ...trace.SpanEndOption) {
+	p.timings.add(p.name, time.Since(p.start))
+	p.Span.End(options...)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/zapr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// slowReader delays the first read of its body, standing in for a client
+// sending the review slowly.
+type slowReader struct {
+	io.Reader
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.delay > 0 {
+		time.Sleep(r.delay)
+		r.delay = 0
+	}
+	return r.Reader.Read(p)
+}
+
+// An admission over the threshold is warned about with the phase that
+// took longest, here the read of a slowly sent body.
+func TestSlowRequestWarning(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	core, logs := observer.New(zapcore.InfoLevel)
+	whsvr := newWebhookServer(Config{Mutator: mutator.DefaultConfig(), SlowThreshold: delay / 2}, WithLogger(zapr.NewLogger(zap.New(core))))
+	slow := metrics.SlowRequests.WithLabelValues(phaseRead)
+	before := testutil.ToFloat64(slow)
+
+	admit(t, whsvr, secretReview(t, "fast", "apps"))
+	if warnings := logs.FilterMessage("WARNING: slow admission request").Len(); warnings != 0 {
+		t.Fatalf("%d warnings for a fast admission", warnings)
+	}
+
+	body, err := json.Marshal(secretReview(t, "tls", "apps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/mutate", &slowReader{Reader: bytes.NewReader(body), delay: delay})
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	RequestID(http.HandlerFunc(whsvr.serve)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("answered %d: %s", rec.Code, rec.Body)
+	}
+
+	warnings := logs.FilterMessage("WARNING: slow admission request").All()
+	if len(warnings) != 1 {
+		t.Fatalf("%d warnings for a slow admission, want 1", len(warnings))
+	}
+	fields := warnings[0].ContextMap()
+	if fields["slowestPhase"] != phaseRead || fields["result"] != metrics.ResultMutated ||
+		fields["threshold"] != whsvr.slowThreshold.String() {
+		t.Errorf("warning fields %v, want the read phase of a mutation", fields)
+	}
+	if duration, err := time.ParseDuration(fmt.Sprint(fields["duration"])); err != nil || duration < delay {
+		t.Errorf("duration %v, want at least %v", fields["duration"], delay)
+	}
+	phases, _ := fields["phases"].(map[string]string)
+	for _, phase := range []string{phaseRead, phaseDecode, phasePolicy, phasePatch} {
+		if _, ok := phases[phase]; !ok {
+			t.Errorf("no %s timing in %v", phase, fields["phases"])
+		}
+	}
+	if got := testutil.ToFloat64(slow) - before; got != 1 {
+		t.Errorf("%v slow requests counted for the read phase, want 1", got)
+	}
+}
+
+func TestPhaseTimingsSlowest(t *testing.T) {
+	_, timings := withPhaseTimings(context.Background())
+	timings.add(phaseRead, time.Millisecond)
+	timings.add(phasePatch, 3*time.Millisecond)
+	timings.add(phasePatch, 3*time.Millisecond)
+	timings.add(phasePolicy, 5*time.Millisecond)
+	slowest, all := timings.slowest()
+	if slowest != phasePatch {
+		t.Errorf("slowest %s, want the patch phase adding up its two runs", slowest)
+	}
+	if len(all) != 3 || all[phasePatch] != "6ms" {
+		t.Errorf("timings %v", all)
+	}
+
+	// timings outside an admission are dropped
+	var none *phaseTimings
+	none.add(phaseRead, time.Second)
+}
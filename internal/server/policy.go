@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// policy is an immutable snapshot of the settings admissions are decided
+// by. Each admission loads the current one when it starts and decides by it
+// throughout, so a reload never leaves it half on the old settings and half
+// on the new ones. Nothing in it is modified once it is built.
+type policy struct {
+	config            Config
+	mutator           *mutator.Mutator // decides on and patches secrets
+	configMapSelector labels.Selector  // ConfigMaps the ConfigMap mutation annotates
+	freeze            *freezeSchedule  // change freeze windows, nil when none
+}
+
+// newPolicy builds the snapshot of config.
+func newPolicy(config Config) (*policy, error) {
+	selector, err := labels.Parse(config.ConfigMaps.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("ConfigMap selector: %w", err)
+	}
+	freeze, err := parseFreeze(config.Freeze)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mutator.New(config.Mutator)
+	if err != nil {
+		return nil, err
+	}
+	return &policy{config: config, mutator: m, configMapSelector: selector, freeze: freeze}, nil
+}
+
+// Reload swaps in the policy of config for the admissions starting from now
+// on; those in flight finish on the settings they started with. The
+// settings of the server itself, the paths, the body size limit, the
+// failure policy and the slow request threshold, stay as the server was
+// built, and config must keep them. A config needing the informer cache when
+// none runs is rejected too, its rules would find no namespace. The current
+// policy is kept on any error.
+func (whsvr *WebhookServer) Reload(config Config) error {
+	built := whsvr.config
+	if !slices.Equal(config.Paths, built.Paths) || config.MaxBodyBytes != built.MaxBodyBytes ||
+		config.FailOpen != built.FailOpen || config.SlowThreshold != built.SlowThreshold {
+		return errors.New("the paths, body size limit, failure policy and slow request threshold only change on a restart")
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+	p, err := newPolicy(config)
+	if err != nil {
+		return err
+	}
+	if p.mutator.NeedsNamespaces() && whsvr.informers.namespaceLister() == nil {
+		return errors.New("rules reading namespaceLabels need the namespace cache, which only starts on a restart")
+	}
+	if p.mutator.NeedsCertificates() && whsvr.informers.certificateLister() == nil {
+		return errors.New("the dns-targets stage needs the Certificates cache, which only starts on a restart")
+	}
+	if p.mutator.NeedsIngresses() && whsvr.informers.ingressLister() == nil {
+		return errors.New("the ingress-targets stage needs the Ingresses cache, which only starts on a restart")
+	}
+	whsvr.policy.Store(p)
+	metrics.ObserveConfigLoad()
+	whsvr.log.Info("Policy reloaded", "stages", config.Mutator.Stages, "clusterProfile", config.ClusterProfile)
+	return nil
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// clusterConfig returns the default config annotating secrets for cluster
+// name, selecting the namespaces labelled env=name.
+func clusterConfig(name string) Config {
+	config := DefaultConfig()
+	config.Mutator.NamespaceSelector = "env=" + name
+	config.Mutator.ClusterName = name
+	return config
+}
+
+// Admissions running while the policy is reloaded are each decided by one
+// snapshot: the sync and cluster annotations of a patch never come from two.
+// Run with -race.
+func TestReloadConcurrentAdmissions(t *testing.T) {
+	whsvr, err := NewWebhookServer(WithConfig(clusterConfig("blue")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer whsvr.Close()
+	handler := whsvr.Handler()
+
+	stop := make(chan struct{})
+	reloaded := make(chan error, 1)
+	go func() {
+		defer close(reloaded)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			name := "blue"
+			if i%2 == 0 {
+				name = "green"
+			}
+			if err := whsvr.Reload(clusterConfig(name)); err != nil {
+				reloaded <- err
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				secret := FixtureSecret{Name: fmt.Sprintf("tls-%d-%d", worker, i), Namespace: "apps", DataSize: 16}.Build()
+				mutated, err := mutateSecret(handler, secret)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				annotations := mutated.Annotations
+				cluster := annotations[mutator.ClusterAnnotationKey]
+				if selector := annotations[syncAnnotationKey]; selector != "env="+cluster {
+					t.Errorf("secret %s annotated for cluster %q with selector %q", secret.Name, cluster, selector)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	if err := <-reloaded; err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+}
+
+func TestReloadKeepsServerSettings(t *testing.T) {
+	whsvr, err := NewWebhookServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer whsvr.Close()
+	config := DefaultConfig()
+	config.MaxBodyBytes *= 2
+	if err := whsvr.Reload(config); err == nil {
+		t.Error("Reload changed the body size limit")
+	}
+
+	broken := DefaultConfig()
+	broken.Mutator.Stages = []string{"no-such-stage"}
+	if err := whsvr.Reload(broken); err == nil {
+		t.Fatal("Reload accepted an unknown stage")
+	}
+	// the current policy is kept
+	review, response := admitSecret(t, whsvr.Handler(), FixtureSecret{Name: "tls", Namespace: "apps", DataSize: 16}.Build())
+	if got := patchedSecret(t, review, response).Annotations[syncAnnotationKey]; got != DefaultConfig().Mutator.NamespaceSelector {
+		t.Errorf("sync annotation %q after a failed reload, want the default", got)
+	}
+}
+
+// Sync profiles are reloaded with the policy: a changed profile applies to
+// the next admission, and a removed one falls back to the default with a
+// warning.
+func TestReloadProfiles(t *testing.T) {
+	withProfile := func(namespaces ...string) Config {
+		config := DefaultConfig()
+		settings, err := json.Marshal(mutator.SyncAnnotationConfig{Profiles: map[string]mutator.SyncProfile{"infra": {TargetNamespaces: namespaces}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Mutator.StageConfig = map[string]json.RawMessage{mutator.SyncAnnotationStage: settings}
+		return config
+	}
+	whsvr, err := NewWebhookServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer whsvr.Close()
+	secret := FixtureSecret{Name: "wildcard-tls", Namespace: "platform", DataSize: 16}.Build()
+	secret.Annotations[mutator.ProfileAnnotationKey] = "infra"
+
+	for _, tt := range []struct {
+		config  Config
+		want    string
+		warning bool
+	}{
+		{config: withProfile("ingress-nginx"), want: "kubernetes.io/metadata.name in (ingress-nginx)"},
+		{config: withProfile("monitoring", "ingress-nginx"), want: "kubernetes.io/metadata.name in (ingress-nginx,monitoring)"},
+		{config: DefaultConfig(), want: DefaultConfig().Mutator.NamespaceSelector, warning: true},
+	} {
+		if err := whsvr.Reload(tt.config); err != nil {
+			t.Fatal(err)
+		}
+		review, response := admitSecret(t, whsvr.Handler(), secret)
+		if got := patchedSecret(t, review, response).Annotations[syncAnnotationKey]; got != tt.want {
+			t.Errorf("synced to %q, want %q", got, tt.want)
+		}
+		if tt.warning != (len(response.Warnings) == 1) || tt.warning && !strings.Contains(response.Warnings[0], `unknown sync profile "infra"`) {
+			t.Errorf("warnings %q, want one %v", response.Warnings, tt.warning)
+		}
+	}
+}
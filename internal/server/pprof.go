@@ -0,0 +1,21 @@
+package server
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/go-logr/logr"
+)
+
+// RegisterPprof mounts the net/http/pprof handlers on mux behind auth.
+func RegisterPprof(mux *http.ServeMux, log logr.Logger, auth Authenticator, blockProfileRate, mutexProfileFraction int) {
+	runtime.SetBlockProfileRate(blockProfileRate)
+	runtime.SetMutexProfileFraction(mutexProfileFraction)
+
+	mux.Handle("/debug/pprof/", RequireBearerToken(log, auth, http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", RequireBearerToken(log, auth, http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", RequireBearerToken(log, auth, http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", RequireBearerToken(log, auth, http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", RequireBearerToken(log, auth, http.HandlerFunc(pprof.Trace)))
+}
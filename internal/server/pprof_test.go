@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+)
+
+// getOps serves GET path through mux with the Authorization header set to
+// authorization, none when empty.
+func getOps(mux http.Handler, path, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPprofDisabled(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/Healthz", okHandler)
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/profile"} {
+		if rec := getOps(mux, path, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("%s answered %d without pprof, want 404", path, rec.Code)
+		}
+	}
+}
+
+func TestPprofEnabled(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte(validToken), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewStaticTokenAuthenticator(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutexFraction := runtime.SetMutexProfileFraction(-1)
+	t.Cleanup(func() {
+		runtime.SetBlockProfileRate(0)
+		runtime.SetMutexProfileFraction(mutexFraction)
+	})
+	mux := http.NewServeMux()
+	RegisterPprof(mux, logr.Discard(), auth, 1, 5)
+	if got := runtime.SetMutexProfileFraction(-1); got != 5 {
+		t.Errorf("mutex profile fraction %d, want 5", got)
+	}
+
+	profiles := map[string]string{
+		"/debug/pprof/":                  "goroutine",
+		"/debug/pprof/heap?debug=1":      "heap profile",
+		"/debug/pprof/goroutine?debug=1": "goroutine profile",
+		"/debug/pprof/block?debug=1":     "--- contention",
+		"/debug/pprof/cmdline":           os.Args[0],
+	}
+	for path, want := range profiles {
+		rec := getOps(mux, path, "Bearer "+validToken)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("%s answered %d without %q: %.200s", path, rec.Code, want, rec.Body)
+		}
+		if rec := getOps(mux, path, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s answered %d without a token, want 401", path, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// DeleteProtectionConfig holds the settings of the secret deletion
+// protection.
+type DeleteProtectionConfig struct {
+	// AllowedUsers may delete protected secrets, e.g. cert-manager's
+	// service account.
+	AllowedUsers []string
+	// AllowedGroups may delete protected secrets, e.g. the cluster admins.
+	AllowedGroups []string
+}
+
+// DefaultDeleteProtection lets cert-manager and the cluster admins delete
+// protected secrets.
+func DefaultDeleteProtection() DeleteProtectionConfig {
+	return DeleteProtectionConfig{
+		AllowedUsers:  []string{"system:serviceaccount:cert-manager:cert-manager"},
+		AllowedGroups: []string{"system:masters"},
+	}
+}
+
+// protectSecretDelete answers the deletions of secrets, denying those of
+// the secrets kubed copies, the ones carrying the managed-by marker or the
+// sync annotation: deleting the source takes the certificate away from
+// every namespace using it. Allowlisted users and groups may delete them,
+// and so may anyone once the secret is annotated with
+// mutator.AllowDeleteAnnotationKey "true". Dry-run deletions are answered
+// the same, so they predict the real ones.
+func (whsvr *WebhookServer) protectSecretDelete(ctx context.Context, p *policy, ar *v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, string) {
+	req := ar.Request
+	if req.Operation != v1beta1.Delete {
+		return &v1beta1.AdmissionResponse{Allowed: true}, metrics.ResultAllowed
+	}
+	if len(req.OldObject.Raw) == 0 {
+		return whsvr.decodeFailed(ctx, req, errors.New("DELETE review without the old object"))
+	}
+	var secret mutator.SecretMetadata
+	if err := json.Unmarshal(req.OldObject.Raw, &secret); err != nil {
+		return whsvr.decodeFailed(ctx, req, err)
+	}
+	log := logr.FromContextOrDiscard(ctx).WithValues("namespace", req.Namespace, "name", req.Name, "operation", req.Operation,
+		"user", req.UserInfo.Username)
+	entry := newAuditEntry(requestIDFrom(ctx), req, req.Name)
+	allow := func(reason string) (*v1beta1.AdmissionResponse, string) {
+		if reason != "" {
+			log.Info("Allowing deletion of protected secret", "reason", reason)
+		}
+		entry.Decision = decisionAllowed
+		whsvr.recordDecision(entry)
+		return &v1beta1.AdmissionResponse{Allowed: true}, metrics.ResultAllowed
+	}
+
+	_, synced := secret.Annotations[mutator.SyncAnnotationKey]
+	if !synced && secret.Annotations[mutator.ManagedByAnnotationKey] != mutator.ManagedByValue {
+		return allow("")
+	}
+	if secret.Annotations[mutator.AllowDeleteAnnotationKey] == "true" {
+		return allow("allow-delete-annotation")
+	}
+	allowed := p.config.DeleteProtection
+	if slices.Contains(allowed.AllowedUsers, req.UserInfo.Username) {
+		return allow("allowed-user")
+	}
+	for _, group := range req.UserInfo.Groups {
+		if slices.Contains(allowed.AllowedGroups, group) {
+			return allow("allowed-group")
+		}
+	}
+
+	message := fmt.Sprintf("secret %s/%s is copied to other namespaces by kubed and protected from deletion by the cert-manager webhook; "+
+		"to delete it, first run: kubectl annotate secret -n %s %s %s=true",
+		req.Namespace, req.Name, req.Namespace, req.Name, mutator.AllowDeleteAnnotationKey)
+	log.Info("Denying deletion of protected secret")
+	entry.Decision = decisionDenied
+	entry.Error = message
+	whsvr.recordDecision(entry)
+	whsvr.events.record(req, req.Name, corev1.EventTypeWarning, eventDenied, "Deletion by %s denied, annotate with %s=true to allow it",
+		req.UserInfo.Username, mutator.AllowDeleteAnnotationKey)
+	return &v1beta1.AdmissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: message,
+			Reason:  metav1.StatusReasonForbidden,
+			Code:    http.StatusForbidden,
+		},
+	}, metrics.ResultDenied
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// deleteReview returns the DELETE review of secret by user, a member of
+// groups.
+func deleteReview(t *testing.T, secret *corev1.Secret, user string, groups []string, dryRun bool) *v1beta1.AdmissionReview {
+	t.Helper()
+	review, err := FixtureReview(secret, v1beta1.Delete, dryRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	review.Request.UserInfo = authenticationv1.UserInfo{Username: user, Groups: groups}
+	return review
+}
+
+// Synced secrets and those carrying the managed-by marker are only deleted
+// by the allowlisted identities, or by anyone once annotated to allow it.
+// Dry runs get the same answers, without the events.
+func TestDeleteProtection(t *testing.T) {
+	config := DefaultConfig()
+	config.Paths = []string{PathMutateSecrets, PathProtectSecrets}
+	synced := FixtureSecret{Name: "wildcard-tls", Namespace: "payments", DataSize: 16, Synced: true}.Build()
+	managed := FixtureSecret{Name: "api-tls", Namespace: "payments", DataSize: 16}.Build()
+	managed.Annotations[mutator.ManagedByAnnotationKey] = mutator.ManagedByValue
+	unlocked := FixtureSecret{Name: "old-tls", Namespace: "payments", DataSize: 16, Synced: true}.Build()
+	unlocked.Annotations[mutator.AllowDeleteAnnotationKey] = "true"
+	const developer = "jane@example.com"
+
+	for _, tt := range []struct {
+		name   string
+		secret *corev1.Secret
+		user   string
+		groups []string
+		denied bool
+	}{
+		{name: "synced", secret: synced, user: developer, groups: []string{"system:authenticated"}, denied: true},
+		{name: "managed", secret: managed, user: developer, denied: true},
+		{name: "unprotected", secret: FixtureSecret{Name: "other-tls", Namespace: "payments", DataSize: 16}.Build(), user: developer},
+		{name: "allowed user", secret: synced, user: certManagerUser},
+		{name: "allowed group", secret: synced, user: developer, groups: []string{"system:authenticated", "system:masters"}},
+		{name: "override", secret: unlocked, user: developer},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, dryRun := range []bool{false, true} {
+				events, fake := fakeEvents()
+				handler := newTestHandler(t, config, WithEventRecorder(events))
+				result := metrics.ResultAllowed
+				if tt.denied {
+					result = metrics.ResultDenied
+				}
+				counted := metrics.Requests.WithLabelValues(PathProtectSecrets, string(v1beta1.Delete), result)
+				before := testutil.ToFloat64(counted)
+
+				response := reviewAt(t, handler, PathProtectSecrets, deleteReview(t, tt.secret, tt.user, tt.groups, dryRun))
+				if response.Allowed == tt.denied || len(response.Patch) != 0 {
+					t.Fatalf("dry run %v: allowed %v with patch %s, want denied %v", dryRun, response.Allowed, response.Patch, tt.denied)
+				}
+				if got := testutil.ToFloat64(counted) - before; got != 1 {
+					t.Errorf("dry run %v: %v requests counted %s, want 1", dryRun, got, result)
+				}
+				got := recorded(fake)
+				if !tt.denied {
+					if len(got) != 0 {
+						t.Errorf("dry run %v: events %q for an allowed deletion", dryRun, got)
+					}
+					continue
+				}
+				override := "kubectl annotate secret -n payments " + tt.secret.Name + " " + mutator.AllowDeleteAnnotationKey + "=true"
+				if response.Result == nil || response.Result.Code != http.StatusForbidden || !strings.Contains(response.Result.Message, override) {
+					t.Errorf("dry run %v: denied with %+v, want a 403 saying %q", dryRun, response.Result, override)
+				}
+				wantEvents := 1
+				if dryRun {
+					wantEvents = 0
+				}
+				if len(got) != wantEvents || (wantEvents == 1 && !strings.HasPrefix(got[0], corev1.EventTypeWarning+" "+eventDenied)) {
+					t.Errorf("dry run %v: events %q, want %d %s", dryRun, got, wantEvents, eventDenied)
+				}
+			}
+		})
+	}
+}
+
+// The allowlists are configured, and the path leaves other operations
+// alone.
+func TestDeleteProtectionConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Paths = []string{PathProtectSecrets}
+	config.DeleteProtection = DeleteProtectionConfig{AllowedUsers: []string{"ops"}, AllowedGroups: []string{"sre"}}
+	handler := newTestHandler(t, config)
+	secret := FixtureSecret{Name: "wildcard-tls", Namespace: "payments", DataSize: 16, Synced: true}.Build()
+
+	for _, tt := range []struct {
+		user    string
+		groups  []string
+		allowed bool
+	}{
+		{user: "ops", allowed: true},
+		{user: "jane", groups: []string{"sre"}, allowed: true},
+		{user: certManagerUser},
+		{user: "jane", groups: []string{"system:masters"}},
+	} {
+		if response := reviewAt(t, handler, PathProtectSecrets, deleteReview(t, secret, tt.user, tt.groups, false)); response.Allowed != tt.allowed {
+			t.Errorf("%s of %q: allowed %v, want %v", tt.user, tt.groups, response.Allowed, tt.allowed)
+		}
+	}
+
+	update, err := FixtureReview(secret, v1beta1.Update, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update.Request.UserInfo.Username = "jane"
+	if response := reviewAt(t, handler, PathProtectSecrets, update); !response.Allowed {
+		t.Errorf("update denied with %+v", response.Result)
+	}
+}
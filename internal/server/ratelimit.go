@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// idle per-client limiters are dropped after this long
+	clientLimiterTTL = 5 * time.Minute
+	// sweep idle per-client limiters once this many are tracked
+	clientLimiterSweepSize = 1024
+)
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter is a token bucket limiter applied globally and per source IP.
+// A zero rate disables the corresponding bucket. It is safe for concurrent use.
+type RateLimiter struct {
+	global      *rate.Limiter
+	clientRate  rate.Limit
+	clientBurst int
+
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+}
+
+func NewRateLimiter(globalRate float64, globalBurst int, clientRate float64, clientBurst int) *RateLimiter {
+	l := &RateLimiter{
+		clientRate:  rate.Limit(clientRate),
+		clientBurst: clientBurst,
+		clients:     map[string]*clientLimiter{},
+	}
+	if globalRate > 0 {
+		l.global = rate.NewLimiter(rate.Limit(globalRate), globalBurst)
+	}
+	return l
+}
+
+// allow reports whether a request from the given client may proceed, and if
+// not, which bucket ("global" or "client") rejected it.
+func (l *RateLimiter) allow(client string, now time.Time) (bool, string) {
+	if l == nil {
+		return true, ""
+	}
+	if l.clientRate > 0 && !l.clientLimiter(client, now).AllowN(now, 1) {
+		return false, "client"
+	}
+	if l.global != nil && !l.global.AllowN(now, 1) {
+		return false, "global"
+	}
+	return true, ""
+}
+
+func (l *RateLimiter) clientLimiter(client string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.clients) >= clientLimiterSweepSize {
+		for key, c := range l.clients {
+			if now.Sub(c.lastSeen) > clientLimiterTTL {
+				delete(l.clients, key)
+			}
+		}
+	}
+
+	c, ok := l.clients[client]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(l.clientRate, l.clientBurst)}
+		l.clients[client] = c
+	}
+	c.lastSeen = now
+	return c.limiter
+}
+
+// clientIP returns the source IP of the request without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/admission/v1beta1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+func TestRateLimiterBuckets(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(1, 5, 1, 3)
+	for i := 0; i < 3; i++ {
+		if ok, bucket := l.allow("10.0.0.1", now); !ok {
+			t.Fatalf("request %d of the client's burst rejected by the %s bucket", i, bucket)
+		}
+	}
+	if ok, bucket := l.allow("10.0.0.1", now); ok || bucket != "client" {
+		t.Errorf("request past the client's burst: %v, %q, want rejected by the client bucket", ok, bucket)
+	}
+	// the global bucket has 2 tokens left
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("10.0.0.2", now); !ok {
+			t.Fatalf("request %d of another client rejected", i)
+		}
+	}
+	if ok, bucket := l.allow("10.0.0.3", now); ok || bucket != "global" {
+		t.Errorf("request past the global burst: %v, %q, want rejected by the global bucket", ok, bucket)
+	}
+	if ok, bucket := l.allow("10.0.0.1", now.Add(time.Second)); !ok {
+		t.Errorf("request a second later rejected by the %s bucket", bucket)
+	}
+
+	var nilLimiter *RateLimiter
+	if ok, _ := nilLimiter.allow("10.0.0.1", now); !ok {
+		t.Error("a nil limiter rejected a request")
+	}
+}
+
+// Idle clients are swept once enough of them are tracked.
+func TestRateLimiterSweep(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(0, 0, 1, 1)
+	for i := 0; i < clientLimiterSweepSize; i++ {
+		l.allow(string(rune(i)), now)
+	}
+	l.allow("10.0.0.1", now.Add(clientLimiterTTL+time.Second))
+	if len(l.clients) != 1 {
+		t.Errorf("%d clients tracked after the sweep, want 1", len(l.clients))
+	}
+}
+
+// A burst of concurrent requests lets exactly the burst through. Run with
+// -race.
+func TestRateLimiterConcurrentBurst(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(0, 0, 1, 20)
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := l.allow("10.0.0.1", now); ok {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := allowed.Load(); got != 20 {
+		t.Errorf("%d of the burst allowed, want 20", got)
+	}
+}
+
+func TestRateLimitedAdmissions(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		mode := "fail_open"
+		if strict {
+			mode = "strict"
+		}
+		t.Run(mode, func(t *testing.T) {
+			// a bucket refilling once an hour, so the test never sees a token back
+			whsvr := newDefaultServer(WithRateLimiter(NewRateLimiter(0, 0, 1.0/3600, 2), strict))
+			limited := testutil.ToFloat64(metrics.RateLimited.WithLabelValues("client", mode))
+
+			var patched, unpatched, rejected int
+			for i := 0; i < 5; i++ {
+				rec := postReview(t, whsvr, secretReview(t, "tls", "apps"))
+				if rec.Code == http.StatusTooManyRequests {
+					rejected++
+					continue
+				}
+				var answer v1beta1.AdmissionReview
+				if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil || answer.Response == nil || !answer.Response.Allowed {
+					t.Fatalf("answered %d: %s", rec.Code, rec.Body)
+				}
+				if len(answer.Response.Patch) > 0 {
+					patched++
+				} else {
+					unpatched++
+				}
+			}
+			if patched != 2 {
+				t.Errorf("%d admissions patched, want the burst of 2", patched)
+			}
+			if strict && (rejected != 3 || unpatched != 0) {
+				t.Errorf("%d rejected and %d allowed unpatched, want 3 rejected", rejected, unpatched)
+			}
+			if !strict && (unpatched != 3 || rejected != 0) {
+				t.Errorf("%d allowed unpatched and %d rejected, want 3 allowed unpatched", unpatched, rejected)
+			}
+			if got := testutil.ToFloat64(metrics.RateLimited.WithLabelValues("client", mode)) - limited; got != 3 {
+				t.Errorf("%v rate limited requests counted, want 3", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// DefaultRecentDecisions is the number of decisions /decisions keeps.
+const DefaultRecentDecisions = 200
+
+// recentDecisionsResponse is the body of a /decisions response.
+type recentDecisionsResponse struct {
+	Capacity  int          `json:"capacity"`
+	Decisions []auditEntry `json:"decisions"` // newest first
+}
+
+// RecentDecisions keeps the last admission decisions in memory, the same
+// entries as the audit log, for GET /decisions to answer "what did the
+// webhook just do to this secret" without the logs. Dry runs and the
+// answers replayed to retries aren't kept, so they don't push out the
+// decisions they repeat. A nil RecentDecisions keeps nothing.
+type RecentDecisions struct {
+	mu      sync.Mutex
+	entries []auditEntry // ring of cap(entries)
+	next    int          // index of the next entry in entries
+}
+
+// NewRecentDecisions returns a buffer of the last size decisions, nil when
+// size isn't positive.
+func NewRecentDecisions(size int) *RecentDecisions {
+	if size <= 0 {
+		return nil
+	}
+	return &RecentDecisions{entries: make([]auditEntry, 0, size)}
+}
+
+// record keeps entry, dropping the oldest one when full.
+func (d *RecentDecisions) record(entry auditEntry) {
+	if d == nil || entry.DryRun || entry.Replay {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.entries) < cap(d.entries) {
+		d.entries = append(d.entries, entry)
+	} else {
+		d.entries[d.next] = entry
+	}
+	d.next = (d.next + 1) % cap(d.entries)
+}
+
+// list returns the entries kept for namespace and name, newest first; an
+// empty filter matches any.
+func (d *RecentDecisions) list(namespace, name string) []auditEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries := []auditEntry{}
+	size := cap(d.entries)
+	for i := 1; i <= len(d.entries); i++ {
+		entry := d.entries[(d.next-i+size)%size]
+		if (namespace == "" || entry.Namespace == namespace) && (name == "" || entry.Name == name) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// ServeHTTP backs GET /decisions, the decisions kept as JSON, newest first,
+// filtered with the namespace and name query parameters.
+func (d *RecentDecisions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	resp, err := json.Marshal(recentDecisionsResponse{
+		Capacity:  cap(d.entries),
+		Decisions: d.list(query.Get("namespace"), query.Get("name")),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(resp)
+}
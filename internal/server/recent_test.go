@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+// getDecisions queries d like GET /decisions with query.
+func getDecisions(t *testing.T, d *RecentDecisions, query string) recentDecisionsResponse {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/decisions"+query, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/decisions answered %d: %s", rec.Code, rec.Body)
+	}
+	var resp recentDecisionsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestRecentDecisionsPastCapacity(t *testing.T) {
+	d := NewRecentDecisions(5)
+	for i := 0; i < 12; i++ {
+		d.record(auditEntry{UID: fmt.Sprint(i), Namespace: fmt.Sprintf("ns-%d", i%2), Name: fmt.Sprintf("tls-%d", i%3)})
+	}
+	resp := getDecisions(t, d, "")
+	if resp.Capacity != 5 {
+		t.Errorf("capacity %d, want 5", resp.Capacity)
+	}
+	var uids []string
+	for _, entry := range resp.Decisions {
+		uids = append(uids, entry.UID)
+	}
+	if got := strings.Join(uids, ","); got != "11,10,9,8,7" {
+		t.Errorf("kept %s, want the last 5 newest first", got)
+	}
+
+	tests := map[string]string{
+		"?namespace=ns-1":            "11,9,7",
+		"?name=tls-1":                "10,7",
+		"?namespace=ns-1&name=tls-1": "7",
+		"?namespace=other":           "",
+	}
+	for query, want := range tests {
+		uids = nil
+		for _, entry := range getDecisions(t, d, query).Decisions {
+			uids = append(uids, entry.UID)
+		}
+		if got := strings.Join(uids, ","); got != want {
+			t.Errorf("%s returned %s, want %s", query, got, want)
+		}
+	}
+}
+
+func TestRecentDecisionsSkipsDuplicates(t *testing.T) {
+	d := NewRecentDecisions(5)
+	d.record(auditEntry{UID: "dry", DryRun: true})
+	d.record(auditEntry{UID: "replay", Replay: true})
+	d.record(auditEntry{UID: "kept"})
+	if decisions := getDecisions(t, d, "").Decisions; len(decisions) != 1 || decisions[0].UID != "kept" {
+		t.Errorf("kept %+v, want the one decision that isn't a dry run or replay", decisions)
+	}
+}
+
+func TestRecentDecisionsDisabled(t *testing.T) {
+	if d := NewRecentDecisions(0); d != nil {
+		t.Fatal("a buffer of 0 decisions is kept")
+	}
+	var d *RecentDecisions
+	d.record(auditEntry{UID: "ignored"})
+}
+
+// Run with -race.
+func TestRecentDecisionsConcurrent(t *testing.T) {
+	d := NewRecentDecisions(16)
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				d.record(auditEntry{UID: fmt.Sprintf("%d-%d", worker, i), Namespace: "apps"})
+				d.list("apps", "")
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(d.list("", "")); n != 16 {
+		t.Errorf("%d decisions kept, want 16", n)
+	}
+}
+
+// Admissions are recorded with their outcome, dry runs aren't.
+func TestRecentDecisionsAdmissions(t *testing.T) {
+	d := NewRecentDecisions(10)
+	handler := newTestHandler(t, DefaultConfig(), WithRecentDecisions(d))
+	admitSecret(t, handler, FixtureSecret{Name: "tls", Namespace: "apps", DataSize: 16}.Build())
+	dryRun, err := FixtureReview(FixtureSecret{Name: "dry", Namespace: "apps", DataSize: 16}.Build(), v1beta1.Create, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admitWith(t, handler, dryRun)
+
+	decisions := getDecisions(t, d, "?namespace=apps").Decisions
+	if len(decisions) != 1 {
+		t.Fatalf("kept %+v, want the one admission that isn't a dry run", decisions)
+	}
+	entry := decisions[0]
+	if entry.Name != "tls" || entry.Operation != string(v1beta1.Create) || entry.Decision != decisionMutated || len(entry.Patch) == 0 {
+		t.Errorf("recorded %+v", entry)
+	}
+}
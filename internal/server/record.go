@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// recordings queued before new ones are dropped
+const recordQueueSize = 256
+
+type recording struct {
+	received time.Time
+	uid      types.UID
+	body     []byte
+}
+
+// RequestRecorder writes sanitised copies of incoming AdmissionReviews to a
+// directory, one JSON file per request, as fixtures to reproduce reports
+// with. Secret data values are blanked; everything else is kept. Files are
+// written in the background and the oldest are pruned to stay within the
+// file and byte caps. Recording never blocks or fails an admission.
+type RequestRecorder struct {
+	log      logr.Logger
+	dir      string
+	maxFiles int
+	maxBytes int64
+
+	queue chan recording
+	done  chan struct{}
+}
+
+func NewRequestRecorder(log logr.Logger, dir string, maxFiles int, maxBytes int64) (*RequestRecorder, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	r := &RequestRecorder{
+		log:      log,
+		dir:      dir,
+		maxFiles: maxFiles,
+		maxBytes: maxBytes,
+		queue:    make(chan recording, recordQueueSize),
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// record queues a copy of a request body for writing, the body being a
+// pooled buffer. It is a no-op on a nil recorder.
+func (r *RequestRecorder) record(uid types.UID, body []byte) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.queue <- recording{received: time.Now().UTC(), uid: uid, body: bytes.Clone(body)}:
+	default:
+		r.log.V(1).Info("Recording queue full, dropping request", "uid", uid)
+	}
+}
+
+// Close writes the queued recordings and stops the writer.
+func (r *RequestRecorder) Close() {
+	if r == nil {
+		return
+	}
+	close(r.queue)
+	<-r.done
+}
+
+func (r *RequestRecorder) run() {
+	defer close(r.done)
+	for rec := range r.queue {
+		if err := r.write(rec); err != nil {
+			r.log.Error(err, "Failed to record request", "uid", rec.uid)
+			continue
+		}
+		if err := r.prune(); err != nil {
+			r.log.Error(err, "Failed to prune recorded requests")
+		}
+	}
+}
+
+func (r *RequestRecorder) write(rec recording) error {
+	var review v1beta1.AdmissionReview
+	if err := json.Unmarshal(rec.body, &review); err != nil {
+		return err
+	}
+	if review.Request != nil {
+		review.Request.Object = sanitizeSecret(review.Request.Object)
+		review.Request.OldObject = sanitizeSecret(review.Request.OldObject)
+	}
+	out, err := json.MarshalIndent(review, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	name := rec.received.Format("20060102T150405.000000000Z") + "_" + safeFileName(string(rec.uid)) + ".json"
+	return os.WriteFile(filepath.Join(r.dir, name), out, 0o600)
+}
+
+// sanitizeSecret blanks the values under data and stringData, keeping the
+// keys so the shape of the secret is preserved.
+func sanitizeSecret(raw runtime.RawExtension) runtime.RawExtension {
+	if len(raw.Raw) == 0 {
+		return raw
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(raw.Raw, &object); err != nil {
+		return runtime.RawExtension{}
+	}
+	for _, field := range []string{"data", "stringData"} {
+		values, ok := object[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key := range values {
+			values[key] = ""
+		}
+	}
+	sanitized, err := json.Marshal(object)
+	if err != nil {
+		return runtime.RawExtension{}
+	}
+	return runtime.RawExtension{Raw: sanitized}
+}
+
+// safeFileName keeps only characters that are safe in a file name.
+func safeFileName(s string) string {
+	return strings.Map(func(c rune) rune {
+		if c == '-' || c == '.' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			return c
+		}
+		return '_'
+	}, s)
+}
+
+// prune removes the oldest recordings until both caps are met. File names
+// start with the timestamp, so name order is age order.
+func (r *RequestRecorder) prune() error {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return err
+	}
+	type file struct {
+		name string
+		size int64
+	}
+	var files []file
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{name: entry.Name(), size: info.Size()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	for len(files) > 0 && ((r.maxFiles > 0 && len(files) > r.maxFiles) || (r.maxBytes > 0 && total > r.maxBytes)) {
+		if err := os.Remove(filepath.Join(r.dir, files[0].name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= files[0].size
+		files = files[1:]
+	}
+	return nil
+}
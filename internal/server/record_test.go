@@ -0,0 +1,159 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// recordedFiles returns the names of the recordings in dir.
+func recordedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// A recording keeps the review but the secret's data values, and replays
+// through the handler to the same answer.
+func TestRecordedFixture(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRequestRecorder(logr.Discard(), dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	review := secretReview(t, "tls", "apps")
+	var secret corev1.Secret
+	if err := json.Unmarshal(review.Request.Object.Raw, &secret); err != nil {
+		t.Fatal(err)
+	}
+	secret.Data[corev1.TLSPrivateKeyKey] = []byte(sentinel)
+	if review.Request.Object.Raw, err = json.Marshal(secret); err != nil {
+		t.Fatal(err)
+	}
+	response := admit(t, newDefaultServer(WithRequestRecorder(recorder)), review)
+	recorder.Close()
+
+	names := recordedFiles(t, dir)
+	if len(names) != 1 {
+		t.Fatalf("recordings %v, want 1", names)
+	}
+	if pattern := `^\d{8}T\d{6}\.\d{9}Z_` + regexp.QuoteMeta(string(review.Request.UID)) + `\.json$`; !regexp.MustCompile(pattern).MatchString(names[0]) {
+		t.Errorf("recording named %s, want timestamp_uid.json", names[0])
+	}
+	body, err := os.ReadFile(filepath.Join(dir, names[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), sentinel) {
+		t.Fatalf("secret data recorded: %s", body)
+	}
+
+	var fixture v1beta1.AdmissionReview
+	if err := json.Unmarshal(body, &fixture); err != nil {
+		t.Fatal(err)
+	}
+	var recorded corev1.Secret
+	if err := json.Unmarshal(fixture.Request.Object.Raw, &recorded); err != nil {
+		t.Fatal(err)
+	}
+	for key := range secret.Data {
+		if value, ok := recorded.Data[key]; !ok || len(value) != 0 {
+			t.Errorf("data key %s recorded as %q, want the key with no value", key, value)
+		}
+	}
+	if recorded.Name != secret.Name || recorded.Annotations[certManagerAnnotationKey] != secret.Annotations[certManagerAnnotationKey] {
+		t.Errorf("metadata not kept: %+v", recorded.ObjectMeta)
+	}
+
+	// the recorder is closed, the replay goes through a server of its own
+	replayed := admit(t, newDefaultServer(), &fixture)
+	if string(replayed.Patch) != string(response.Patch) {
+		t.Errorf("replay patched %s, the original %s", replayed.Patch, response.Patch)
+	}
+}
+
+// The oldest recordings are pruned past the caps.
+func TestRecorderPrune(t *testing.T) {
+	for name, caps := range map[string]struct {
+		files int
+		bytes int64
+	}{
+		"files": {files: 3},
+		"bytes": {bytes: 3 * 1024},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			recorder, err := NewRequestRecorder(logr.Discard(), dir, caps.files, caps.bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			whsvr := newDefaultServer(WithRequestRecorder(recorder))
+			var uids []string
+			for _, secret := range []string{"a", "b", "c", "d", "e", "f"} {
+				review := secretReview(t, secret, "apps")
+				review.Request.UID = types.UID("uid-" + secret)
+				admit(t, whsvr, review)
+				uids = append(uids, string(review.Request.UID))
+			}
+			recorder.Close()
+
+			names := recordedFiles(t, dir)
+			var total int64
+			for _, name := range names {
+				info, err := os.Stat(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				total += info.Size()
+			}
+			if len(names) == 0 || (caps.files > 0 && len(names) > caps.files) || (caps.bytes > 0 && total > caps.bytes) {
+				t.Fatalf("%d recordings of %d bytes left", len(names), total)
+			}
+			// the newest are kept
+			if last := names[len(names)-1]; !strings.HasSuffix(last, uids[len(uids)-1]+".json") {
+				t.Errorf("newest recording %s, want the one of %s", last, uids[len(uids)-1])
+			}
+		})
+	}
+}
+
+// Recording never holds up or fails an admission: a full queue drops the
+// recording and a failed write is only logged.
+func TestRecorderNeverBlocks(t *testing.T) {
+	stalled := &RequestRecorder{log: logr.Discard(), queue: make(chan recording, 1)}
+	for _, name := range []string{"a", "b", "c"} {
+		admit(t, newDefaultServer(WithRequestRecorder(stalled)), secretReview(t, name, "apps"))
+	}
+	if len(stalled.queue) != 1 {
+		t.Errorf("%d recordings queued, want the queue's 1", len(stalled.queue))
+	}
+
+	dir := filepath.Join(t.TempDir(), "recordings")
+	recorder, err := NewRequestRecorder(logr.Discard(), dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	response := admit(t, newDefaultServer(WithRequestRecorder(recorder)), secretReview(t, "tls", "apps"))
+	recorder.Close()
+	if !response.Allowed || len(response.Patch) == 0 {
+		t.Errorf("admission answered %+v with an unwritable recording directory", response)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// Failure policies, named after the MutatingWebhookConfiguration field.
+const (
+	FailurePolicyIgnore = "Ignore"
+	FailurePolicyFail   = "Fail"
+)
+
+func ParseFailurePolicy(value string) (bool, error) {
+	switch value {
+	case FailurePolicyIgnore:
+		return true, nil
+	case FailurePolicyFail:
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid failure policy %q, expect %s or %s", value, FailurePolicyIgnore, FailurePolicyFail)
+}
+
+// panicReview is the version of the review answered after a panic before
+// the review was decoded, the one the API server prefers.
+var panicReview = metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"}
+
+// failureResponse answers an admission the webhook could not evaluate:
+// allowed without a patch when failing open, rejected with the given status
+// otherwise.
+func failureResponse(failOpen bool, code int32, reason metav1.StatusReason, message string) *v1beta1.AdmissionResponse {
+	if failOpen {
+		return &v1beta1.AdmissionResponse{Allowed: true}
+	}
+	return &v1beta1.AdmissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: message,
+			Reason:  reason,
+			Code:    code,
+		},
+	}
+}
+
+// recoverAdmission turns a panic in an admission handler into a well-formed
+// AdmissionReview that allows the object when failOpen is set and rejects it
+// otherwise, instead of dropping the connection. The answer carries the UID
+// and API version of the review, which the handler records in the request
+// info. The panic goes to reports as well.
+func recoverAdmission(log logr.Logger, failOpen bool, reports *ErrorReporter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo)
+		if !ok {
+			info = &requestInfo{}
+			r = r.WithContext(withRequestInfo(r.Context(), info))
+		}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			metrics.Panics.Inc()
+
+			uid := info.uid
+			stack := debug.Stack()
+			log.Error(fmt.Errorf("%v", p), "Recovered from panic in admission handler",
+				"requestID", requestIDFrom(r.Context()), "uid", uid, "path", r.URL.Path, "stack", string(stack))
+			reports.panicked(p, stack, map[string]string{
+				"requestID": requestIDFrom(r.Context()),
+				"uid":       string(uid),
+				"path":      r.URL.Path,
+			})
+
+			response := failureResponse(failOpen, http.StatusInternalServerError, metav1.StatusReasonInternalError,
+				"internal error in cert-manager webhook")
+			response.UID = uid
+			review := info.review
+			if review.APIVersion == "" {
+				review = panicReview
+			}
+			resp, err := json.Marshal(v1beta1.AdmissionReview{TypeMeta: review, Response: response})
+			if err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write(resp); err != nil {
+				log.Error(err, "Can't write response")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
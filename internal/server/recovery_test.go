@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRecoverAdmission(t *testing.T) {
+	v1 := metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"}
+	v1beta1Review := metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"}
+	tests := []struct {
+		name     string
+		failOpen bool
+		review   metav1.TypeMeta // recorded by the handler before it panics, none when empty
+		want     metav1.TypeMeta
+		allowed  bool
+	}{
+		{name: "fail open v1", failOpen: true, review: v1, want: v1, allowed: true},
+		{name: "fail closed v1beta1", review: v1beta1Review, want: v1beta1Review},
+		{name: "panic before decoding", failOpen: true, want: panicReview, allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.review.APIVersion != "" {
+					info := requestInfoFrom(r.Context())
+					info.uid = "4a5f4c0e"
+					info.review = tt.review
+				}
+				panic("boom")
+			})
+			// no access log: the recovery attaches the request info itself
+			handler := recoverAdmission(logr.Discard(), tt.failOpen, nil, panicking)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader("{}")))
+
+			var review v1beta1.AdmissionReview
+			if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+				t.Fatalf("answer isn't a review: %v: %s", err, rec.Body)
+			}
+			if review.TypeMeta != tt.want {
+				t.Errorf("answered in %v, want %v", review.TypeMeta, tt.want)
+			}
+			if review.Response == nil {
+				t.Fatal("no response")
+			}
+			if review.Response.Allowed != tt.allowed {
+				t.Errorf("allowed = %v, want %v", review.Response.Allowed, tt.allowed)
+			}
+			if tt.review.APIVersion != "" && review.Response.UID != "4a5f4c0e" {
+				t.Errorf("UID = %q, want the request's", review.Response.UID)
+			}
+		})
+	}
+}
+
+func TestRecoverAdmissionAbortHandler(t *testing.T) {
+	handler := recoverAdmission(logr.Discard(), true, nil, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler passed on", p)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/mutate", nil))
+}
+
+func TestParseFailurePolicy(t *testing.T) {
+	for value, want := range map[string]bool{FailurePolicyIgnore: true, FailurePolicyFail: false} {
+		got, err := ParseFailurePolicy(value)
+		if err != nil || got != want {
+			t.Errorf("parseFailurePolicy(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	if _, err := ParseFailurePolicy("ignore"); err == nil {
+		t.Error("parseFailurePolicy accepted a lower case policy")
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+const redacted = "<redacted>"
+
+// redactedSecret wraps a Secret for logging. It prints the metadata and the
+// names and sizes of the data keys, never their values. Every Secret that is
+// logged must go through it. Nothing is rendered until a line is written.
+type redactedSecret struct {
+	secret *corev1.Secret
+}
+
+// MarshalLog renders the secret as an object for structured logs.
+func (s redactedSecret) MarshalLog() any {
+	if s.secret == nil {
+		return nil
+	}
+	return struct {
+		Namespace   string            `json:"namespace"`
+		Name        string            `json:"name"`
+		Type        corev1.SecretType `json:"type"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+		Labels      map[string]string `json:"labels,omitempty"`
+		Data        map[string]int    `json:"dataBytes,omitempty"`
+		StringData  map[string]int    `json:"stringDataBytes,omitempty"`
+	}{s.secret.Namespace, s.secret.Name, s.secret.Type, s.secret.Annotations, s.secret.Labels,
+		byteSizes(s.secret.Data), stringSizes(s.secret.StringData)}
+}
+
+func (s redactedSecret) String() string {
+	if s.secret == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("Secret{namespace=%q name=%q type=%q annotations=%v labels=%v data=%s stringData=%s}",
+		s.secret.Namespace, s.secret.Name, s.secret.Type, s.secret.Annotations, s.secret.Labels,
+		dataSummary(byteSizes(s.secret.Data)), dataSummary(stringSizes(s.secret.StringData)))
+}
+
+func byteSizes(data map[string][]byte) map[string]int {
+	sizes := make(map[string]int, len(data))
+	for key, value := range data {
+		sizes[key] = len(value)
+	}
+	return sizes
+}
+
+func stringSizes(data map[string]string) map[string]int {
+	sizes := make(map[string]int, len(data))
+	for key, value := range data {
+		sizes[key] = len(value)
+	}
+	return sizes
+}
+
+// dataSummary renders data keys with their sizes, e.g. "[ca.crt:1200B tls.key:1679B]".
+func dataSummary(sizes map[string]int) string {
+	keys := make([]string, 0, len(sizes))
+	for key := range sizes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s:%dB", key, sizes[key]))
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// redactedPatch wraps patch operations for logging, eliding the values of
+// any operation touching secret data. Nothing is rendered until a line is
+// written.
+type redactedPatch []mutator.PatchOperation
+
+// MarshalLog renders the operations as an array for structured logs.
+func (p redactedPatch) MarshalLog() any {
+	return p.elided()
+}
+
+func (p redactedPatch) String() string {
+	out, err := json.Marshal(p.elided())
+	if err != nil {
+		return fmt.Sprintf("<unprintable patch: %v>", err)
+	}
+	return string(out)
+}
+
+func (p redactedPatch) elided() []mutator.PatchOperation {
+	ops := make([]mutator.PatchOperation, len(p))
+	for i, op := range p {
+		ops[i] = op
+		if !isDataPath(op.Path) {
+			continue
+		}
+		if values, ok := op.Value.(map[string]string); ok {
+			elided := make(map[string]string, len(values))
+			for key := range values {
+				elided[key] = redacted
+			}
+			ops[i].Value = elided
+		} else {
+			ops[i].Value = redacted
+		}
+	}
+	return ops
+}
+
+// RedactPatch returns patch for printing, the values of data keys elided.
+func RedactPatch(patch []mutator.PatchOperation) fmt.Stringer {
+	return redactedPatch(patch)
+}
+
+func isDataPath(path string) bool {
+	return path == "/data" || path == "/stringData" ||
+		strings.HasPrefix(path, "/data/") || strings.HasPrefix(path, "/stringData/")
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// sentinel stands for private key material that must never be logged.
+const sentinel = "SENTINEL-PRIVATE-KEY-7f3a9c"
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of loggers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// bufferLogger returns a logger writing every line, whatever its
+// verbosity, to a buffer.
+func bufferLogger() (logr.Logger, *syncBuffer) {
+	out := &syncBuffer{}
+	log := funcr.New(func(prefix, args string) {
+		fmt.Fprintln(out, prefix, args)
+	}, funcr.Options{Verbosity: 10})
+	return log, out
+}
+
+func TestRedactedSecret(t *testing.T) {
+	secret := &corev1.Secret{Data: map[string][]byte{corev1.TLSPrivateKeyKey: []byte(sentinel)}}
+	secret.Name, secret.Namespace = "tls", "apps"
+	secret.StringData = map[string]string{"password": sentinel}
+
+	text := redactedSecret{secret}.String()
+	if strings.Contains(text, sentinel) {
+		t.Errorf("secret value logged: %s", text)
+	}
+	if want := fmt.Sprintf("%s:%dB", corev1.TLSPrivateKeyKey, len(sentinel)); !strings.Contains(text, want) {
+		t.Errorf("%s: want the key size %s", text, want)
+	}
+	if !strings.Contains(text, "password:") {
+		t.Errorf("%s: want the stringData key", text)
+	}
+	if got := (redactedSecret{}).String(); got != "<nil>" {
+		t.Errorf("nil secret rendered %q", got)
+	}
+}
+
+func TestRedactedPatch(t *testing.T) {
+	patch := redactedPatch{
+		{Op: "add", Path: "/data/key.pk8", Value: sentinel},
+		{Op: "add", Path: "/stringData", Value: map[string]string{"password": sentinel}},
+		{Op: "replace", Path: "/data", Value: map[string][]byte{"tls.key": []byte(sentinel)}},
+		{Op: "add", Path: "/metadata/annotations", Value: map[string]string{syncAnnotationKey: "true"}},
+	}
+	out := patch.String()
+	if strings.Contains(out, sentinel) {
+		t.Errorf("patch value logged: %s", out)
+	}
+	for _, kept := range []string{"/data/key.pk8", `"password"`, `"true"`} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("%s: want %s kept", out, kept)
+		}
+	}
+}
+
+// A secret carrying a private key goes through the webhook logging
+// verbosely; none of the key material may come out.
+func TestSentinelNeverLogged(t *testing.T) {
+	log, logged := bufferLogger()
+
+	review := secretReview(t, "tls", "apps")
+	var secret corev1.Secret
+	if err := json.Unmarshal(review.Request.Object.Raw, &secret); err != nil {
+		t.Fatal(err)
+	}
+	secret.Data[corev1.TLSPrivateKeyKey] = []byte(sentinel)
+	secret.StringData = map[string]string{"keystore.p12": sentinel}
+	raw, err := json.Marshal(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	review.Request.Object = runtime.RawExtension{Raw: raw}
+	if response := admit(t, newDefaultServer(WithLogger(log)), review); !response.Allowed || len(response.Patch) == 0 {
+		t.Fatalf("secret not patched: %+v", response)
+	}
+
+	out := logged.String()
+	if !strings.Contains(out, "Decoded object") || !strings.Contains(out, `"patch"=`) {
+		t.Fatalf("the object and patch weren't logged, the test misses that path:\n%s", out)
+	}
+	for _, value := range []string{sentinel, base64.StdEncoding.EncodeToString([]byte(sentinel))} {
+		if strings.Contains(out, value) {
+			t.Errorf("log contains key material %q:\n%s", value, out)
+		}
+	}
+}
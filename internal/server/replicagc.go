@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+const (
+	// originIndex indexes the copies by the namespace/name of their source.
+	originIndex = "origin"
+	// replicaGCMaxRetries is how often a failed deletion is retried before
+	// waiting for the copy's next change or resync.
+	replicaGCMaxRetries = 5
+)
+
+// Results of the orphaned copies the replica collector handles.
+const (
+	replicaGCDeleted = "deleted"
+	replicaGCDryRun  = "dry-run"
+	replicaGCFailed  = "failed"
+)
+
+// ReplicaGCConfig holds the settings of the replica collector.
+type ReplicaGCConfig struct {
+	// GracePeriod is how long a copy must stay orphaned before it is
+	// deleted, so that a source being recreated keeps its copies.
+	GracePeriod time.Duration
+	// DryRun logs the deletions instead of making them.
+	DryRun bool
+}
+
+// ReplicaGC deletes the copies kubed made of sources that no longer exist or
+// are no longer annotated for sync, which kubed leaves behind. The elected
+// leader watches every secret; a copy, one carrying kubed's origin
+// annotation, is orphaned when its source is missing from the cache or lacks
+// the sync annotation, and is deleted once it stayed so for the grace
+// period. Copies annotated with mutator.KeepReplicaAnnotationKey "true", and
+// copies whose origin can't be parsed, are never deleted.
+type ReplicaGC struct {
+	log    logr.Logger
+	client kubernetes.Interface
+	config ReplicaGCConfig
+
+	mu            sync.Mutex
+	orphanedSince map[string]time.Time // by copy key
+}
+
+// NewReplicaGC returns a collector of orphaned copies.
+func NewReplicaGC(log logr.Logger, client kubernetes.Interface, config ReplicaGCConfig) *ReplicaGC {
+	return &ReplicaGC{log: log, client: client, config: config}
+}
+
+// Lead collects until ctx is done.
+func (gc *ReplicaGC) Lead(ctx context.Context) {
+	gc.log.Info("Collecting orphaned copies", "gracePeriod", gc.config.GracePeriod.String(), "dryRun", gc.config.DryRun)
+	gc.collect(ctx)
+}
+
+// Stopped does nothing, the collector exports nothing while leading.
+func (gc *ReplicaGC) Stopped() {}
+
+// replicaOrigin is the value of kubed's origin annotation, the reference of
+// the source a copy was made from.
+type replicaOrigin struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// parseOrigin decodes the origin annotation, a JSON object naming the
+// source's namespace and name among other fields.
+func parseOrigin(value string) (replicaOrigin, error) {
+	var origin replicaOrigin
+	if err := json.Unmarshal([]byte(value), &origin); err != nil {
+		return origin, fmt.Errorf("decoding origin %q: %w", value, err)
+	}
+	if origin.Namespace == "" || origin.Name == "" {
+		return origin, fmt.Errorf("origin %q names no source", value)
+	}
+	return origin, nil
+}
+
+func (o replicaOrigin) key() string { return o.Namespace + "/" + o.Name }
+
+// indexByOrigin indexes the copies by the key of their source.
+func indexByOrigin(obj interface{}) ([]string, error) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return nil, nil
+	}
+	value, ok := secret.Annotations[mutator.OriginAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	origin, err := parseOrigin(value)
+	if err != nil {
+		return nil, nil
+	}
+	return []string{origin.key()}, nil
+}
+
+func (gc *ReplicaGC) collect(ctx context.Context) {
+	gc.mu.Lock()
+	gc.orphanedSince = map[string]time.Time{}
+	gc.mu.Unlock()
+
+	factory := informers.NewSharedInformerFactory(gc.client, informerResync)
+	secrets := factory.Core().V1().Secrets()
+	informer := secrets.Informer()
+	_ = informer.SetTransform(func(obj interface{}) (interface{}, error) {
+		if secret, ok := obj.(*corev1.Secret); ok {
+			secret.ManagedFields = nil
+			secret.Data, secret.StringData = nil, nil
+		}
+		return obj, nil
+	})
+	_ = informer.AddIndexers(cache.Indexers{originIndex: indexByOrigin})
+
+	queue := workqueue.NewTypedRateLimitingQueueWithConfig(workqueue.DefaultTypedControllerRateLimiter[string](),
+		workqueue.TypedRateLimitingQueueConfig[string]{Name: "replica-gc"})
+	// a change to a secret re-examines it when it is a copy, and its copies
+	// when it is a source
+	enqueue := func(obj interface{}) {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return
+		}
+		if secret, ok := obj.(*corev1.Secret); ok {
+			if _, ok := secret.Annotations[mutator.OriginAnnotationKey]; ok {
+				queue.Add(key)
+			}
+		}
+		copies, _ := informer.GetIndexer().IndexKeys(originIndex, key)
+		for _, copyKey := range copies {
+			queue.Add(copyKey)
+		}
+	}
+	_, _ = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+		DeleteFunc: enqueue,
+	})
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	go func() {
+		<-ctx.Done()
+		queue.ShutDown()
+	}()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return
+	}
+	gc.log.Info("Secrets cache synced")
+
+	for gc.processNext(ctx, queue, secrets.Lister()) {
+	}
+}
+
+func (gc *ReplicaGC) processNext(ctx context.Context, queue workqueue.TypedRateLimitingInterface[string], lister corelisters.SecretLister) bool {
+	key, shutdown := queue.Get()
+	if shutdown {
+		return false
+	}
+	defer queue.Done(key)
+
+	recheck, err := gc.sync(ctx, lister, key)
+	switch {
+	case err == nil || ctx.Err() != nil:
+		queue.Forget(key)
+		if recheck > 0 {
+			queue.AddAfter(key, recheck)
+		}
+	case queue.NumRequeues(key) < replicaGCMaxRetries:
+		gc.log.Error(err, "Failed to delete orphaned copy, retrying", "secret", key)
+		queue.AddRateLimited(key)
+	default:
+		gc.log.Error(err, "Failed to delete orphaned copy, giving up until it changes", "secret", key)
+		queue.Forget(key)
+	}
+	return true
+}
+
+// sync examines the copy of key and deletes it when it stayed orphaned for
+// the grace period. It returns when to examine it again, zero for never.
+func (gc *ReplicaGC) sync(ctx context.Context, lister corelisters.SecretLister, key string) (time.Duration, error) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return 0, err
+	}
+	replica, err := lister.Secrets(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		gc.forget(key)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	log := gc.log.WithValues("namespace", namespace, "name", name)
+	value, ok := replica.Annotations[mutator.OriginAnnotationKey]
+	if !ok || replica.Annotations[mutator.KeepReplicaAnnotationKey] == "true" {
+		gc.forget(key)
+		return 0, nil
+	}
+	origin, err := parseOrigin(value)
+	if err != nil {
+		// never guess which source an unreadable origin meant
+		log.V(1).Info("Ignoring copy with an unreadable origin", "error", err.Error())
+		gc.forget(key)
+		return 0, nil
+	}
+	orphaned, reason, err := sourceGone(lister, origin)
+	if err != nil {
+		return 0, err
+	}
+	if !orphaned {
+		gc.forget(key)
+		return 0, nil
+	}
+
+	gc.mu.Lock()
+	since, ok := gc.orphanedSince[key]
+	if !ok {
+		since = time.Now()
+		gc.orphanedSince[key] = since
+	}
+	gc.mu.Unlock()
+	if wait := gc.config.GracePeriod - time.Since(since); wait > 0 {
+		if !ok {
+			log.Info("Copy orphaned, deleting it after the grace period", "source", origin.key(), "reason", reason, "in", wait.Round(time.Second).String())
+		}
+		return wait, nil
+	}
+
+	if gc.config.DryRun {
+		metrics.ReplicaGC.WithLabelValues(replicaGCDryRun).Inc()
+		log.Info("Would delete orphaned copy", "source", origin.key(), "reason", reason)
+		gc.forget(key)
+		return 0, nil
+	}
+	// a copy recreated under the same name since is not the one examined
+	uid := replica.UID
+	// a conflict is the precondition failing, final
+	err = withRetry(ctx, opReplicaGCDelete, transientError, func(ctx context.Context) error {
+		return gc.client.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &uid},
+		})
+	})
+	if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+		metrics.ReplicaGC.WithLabelValues(replicaGCFailed).Inc()
+		return 0, fmt.Errorf("deleting: %w", err)
+	}
+	gc.forget(key)
+	if err == nil {
+		metrics.ReplicaGC.WithLabelValues(replicaGCDeleted).Inc()
+		log.Info("Deleted orphaned copy", "source", origin.key(), "reason", reason)
+	}
+	return 0, nil
+}
+
+// sourceGone reports whether the source of origin is missing from the cache
+// or no longer annotated for sync, with the reason.
+func sourceGone(lister corelisters.SecretLister, origin replicaOrigin) (bool, string, error) {
+	source, err := lister.Secrets(origin.Namespace).Get(origin.Name)
+	if apierrors.IsNotFound(err) {
+		return true, "source-deleted", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	if _, ok := source.Annotations[mutator.SyncAnnotationKey]; !ok {
+		return true, "source-unannotated", nil
+	}
+	return false, "", nil
+}
+
+func (gc *ReplicaGC) forget(key string) {
+	gc.mu.Lock()
+	delete(gc.orphanedSince, key)
+	gc.mu.Unlock()
+}
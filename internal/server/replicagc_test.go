@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+func TestParseOrigin(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  replicaOrigin
+		err   bool
+	}{
+		{value: `{"namespace":"apps","name":"api-tls"}`, want: replicaOrigin{Namespace: "apps", Name: "api-tls"}},
+		// kubed records the whole reference of the source
+		{value: `{"kind":"Secret","apiVersion":"v1","namespace":"apps","name":"api-tls","uid":"4c1b","resourceVersion":"42"}`, want: replicaOrigin{Namespace: "apps", Name: "api-tls"}},
+		{value: `{"namespace":"apps"}`, err: true},
+		{value: `{"name":"api-tls"}`, err: true},
+		{value: `apps/api-tls`, err: true},
+		{value: ``, err: true},
+	} {
+		origin, err := parseOrigin(tt.value)
+		if (err != nil) != tt.err || (!tt.err && origin != tt.want) {
+			t.Errorf("parseOrigin(%q) = %+v, %v", tt.value, origin, err)
+		}
+	}
+}
+
+// replicaSecret returns a secret of namespace team, a copy of origin.
+func replicaSecret(name, origin string, annotations map[string]string) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team", Annotations: map[string]string{mutator.OriginAnnotationKey: origin}},
+		Type:       corev1.SecretTypeTLS,
+	}
+	for key, value := range annotations {
+		secret.Annotations[key] = value
+	}
+	return secret
+}
+
+// replicaFixtures returns sources, the first annotated for sync and the
+// second not, and copies of them and of a deleted source, one exempted,
+// and a copy of unreadable origin.
+func replicaFixtures() []runtime.Object {
+	origin := func(name string) string { return fmt.Sprintf(`{"namespace":"apps","name":%q}`, name) }
+	return []runtime.Object{
+		FixtureSecret{Name: "synced-tls", Namespace: "apps", DataSize: 16, Synced: true}.Build(),
+		FixtureSecret{Name: "plain-tls", Namespace: "apps", DataSize: 16}.Build(),
+		replicaSecret("synced-tls", origin("synced-tls"), nil),
+		replicaSecret("plain-tls", origin("plain-tls"), nil),
+		replicaSecret("gone-tls", origin("gone-tls"), nil),
+		replicaSecret("kept-tls", origin("gone-tls"), map[string]string{mutator.KeepReplicaAnnotationKey: "true"}),
+		replicaSecret("unreadable-tls", "apps/gone-tls", nil),
+	}
+}
+
+// teamSecrets returns the names of the secrets left in namespace team.
+func teamSecrets(t *testing.T, client *fake.Clientset) []string {
+	t.Helper()
+	list, err := client.CoreV1().Secrets("team").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, secret := range list.Items {
+		names = append(names, secret.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func runReplicaGC(t *testing.T, client *fake.Clientset, config ReplicaGCConfig) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewReplicaGC(logr.Discard(), client, config).Lead(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// The copies of a deleted source and of one no longer annotated are
+// deleted once the grace period passed; the others are kept.
+func TestReplicaGC(t *testing.T) {
+	const grace = 200 * time.Millisecond
+	client := fake.NewSimpleClientset(replicaFixtures()...)
+	deleted := metrics.ReplicaGC.WithLabelValues(replicaGCDeleted)
+	before := testutil.ToFloat64(deleted)
+	start := time.Now()
+	runReplicaGC(t, client, ReplicaGCConfig{GracePeriod: grace})
+
+	all := []string{"gone-tls", "kept-tls", "plain-tls", "synced-tls", "unreadable-tls"}
+	time.Sleep(grace / 2)
+	if got := teamSecrets(t, client); !slices.Equal(got, all) {
+		t.Errorf("copies %v within the grace period, want %v", got, all)
+	}
+	want := []string{"kept-tls", "synced-tls", "unreadable-tls"}
+	waitFor(t, func() bool { return slices.Equal(teamSecrets(t, client), want) })
+	if elapsed := time.Since(start); elapsed < grace {
+		t.Errorf("copies deleted after %v, within the grace period", elapsed)
+	}
+	if got := testutil.ToFloat64(deleted) - before; got != 2 {
+		t.Errorf("%v deletions counted, want 2", got)
+	}
+}
+
+// A source recreated within the grace period keeps its copy.
+func TestReplicaGCSourceRecreated(t *testing.T) {
+	const grace = 300 * time.Millisecond
+	client := fake.NewSimpleClientset(replicaSecret("back-tls", `{"namespace":"apps","name":"back-tls"}`, nil))
+	runReplicaGC(t, client, ReplicaGCConfig{GracePeriod: grace})
+	time.Sleep(grace / 3)
+	source := FixtureSecret{Name: "back-tls", Namespace: "apps", DataSize: 16, Synced: true}.Build()
+	if _, err := client.CoreV1().Secrets("apps").Create(context.Background(), source, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(grace)
+	if got := teamSecrets(t, client); !slices.Equal(got, []string{"back-tls"}) {
+		t.Errorf("copies %v, want the copy of the recreated source kept", got)
+	}
+}
+
+// A dry run counts the copies it would delete and deletes none.
+func TestReplicaGCDryRun(t *testing.T) {
+	client := fake.NewSimpleClientset(replicaFixtures()...)
+	dryRun := metrics.ReplicaGC.WithLabelValues(replicaGCDryRun)
+	before := testutil.ToFloat64(dryRun)
+	runReplicaGC(t, client, ReplicaGCConfig{DryRun: true})
+
+	waitFor(t, func() bool { return testutil.ToFloat64(dryRun)-before == 2 })
+	if got := teamSecrets(t, client); len(got) != 5 {
+		t.Errorf("copies %v left by a dry run, want all 5", got)
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A well-formed incoming X-Request-Id is kept and echoed; any other is
+// replaced by a generated one.
+func TestWithRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		kept     bool
+	}{
+		{name: "valid", incoming: "req-0123456789abcdef", kept: true},
+		{name: "printable punctuation", incoming: "trace/1:span=2", kept: true},
+		{name: "maximum length", incoming: strings.Repeat("a", maxRequestIDLength), kept: true},
+		{name: "missing"},
+		{name: "too long", incoming: strings.Repeat("a", maxRequestIDLength+1)},
+		{name: "space", incoming: "req 1"},
+		{name: "control character", incoming: "req\x1b[31m"},
+		{name: "non-ASCII", incoming: "réq-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = requestIDFrom(r.Context())
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/mutate", nil)
+			if tt.incoming != "" {
+				req.Header.Set(requestIDHeader, tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			echoed := rec.Header().Get(requestIDHeader)
+			if echoed != seen {
+				t.Errorf("echoed %q, handler saw %q", echoed, seen)
+			}
+			if tt.kept {
+				if seen != tt.incoming {
+					t.Errorf("request ID %q, want the incoming %q kept", seen, tt.incoming)
+				}
+				return
+			}
+			if seen == tt.incoming || !validRequestID(seen) {
+				t.Errorf("request ID %q, want a generated one", seen)
+			}
+		})
+	}
+}
+
+// Requests get distinct IDs when none comes in.
+func TestGeneratedRequestIDsDiffer(t *testing.T) {
+	handler := RequestID(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/mutate", nil))
+		id := rec.Header().Get(requestIDHeader)
+		if seen[id] {
+			t.Fatalf("request ID %q generated twice", id)
+		}
+		seen[id] = true
+	}
+}
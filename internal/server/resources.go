@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// DefaultConfigMapSelector matches the CA bundle ConfigMaps written by
+// trust-manager.
+const DefaultConfigMapSelector = "trust.cert-manager.io/bundle"
+
+// Reasons objects other than secrets are admitted without being mutated.
+const (
+	skipNotSelected    = "not-selected"    // a ConfigMap outside the selector
+	skipUnexpectedKind = "unexpected-kind" // a kind no enabled path handles
+)
+
+// ConfigMapConfig holds the settings of the ConfigMap mutation.
+type ConfigMapConfig struct {
+	// Selector is the label selector of the ConfigMaps to annotate.
+	Selector string
+	// IgnoredNamespaces are never mutated.
+	IgnoredNamespaces []string
+	// NamespaceSelector is the value given to the sync annotation.
+	NamespaceSelector string
+}
+
+// CertificateConfig holds the settings of the Certificate mutation, which
+// has cert-manager set the sync annotation on the secrets it issues.
+type CertificateConfig struct {
+	// IgnoredNamespaces are never mutated.
+	IgnoredNamespaces []string
+	// NamespaceSelector is the value given to the sync annotation.
+	NamespaceSelector string
+}
+
+// secretTemplateAnnotationsPath points at the annotations cert-manager
+// copies from a Certificate to its secret.
+const secretTemplateAnnotationsPath = "/spec/secretTemplate/annotations"
+
+// certificate is the part of a cert-manager Certificate the webhook reads.
+type certificate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              struct {
+		SecretTemplate *struct {
+			Annotations map[string]string `json:"annotations,omitempty"`
+		} `json:"secretTemplate,omitempty"`
+	} `json:"spec"`
+}
+
+// mutateConfigMap annotates the selected ConfigMaps for kubed.
+func (whsvr *WebhookServer) mutateConfigMap(ctx context.Context, p *policy, ar *v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, string) {
+	req := ar.Request
+	var configMap corev1.ConfigMap
+	if err := decodeObject(req, &configMap); err != nil {
+		return whsvr.decodeFailed(ctx, req, err)
+	}
+	config := p.config.ConfigMaps
+	reason := ""
+	switch {
+	case slices.Contains(config.IgnoredNamespaces, configMap.Namespace):
+		reason = skipIgnoredNamespace
+	case !p.configMapSelector.Matches(labels.Set(configMap.Labels)):
+		reason = skipNotSelected
+	case configMap.Annotations[mutator.OriginAnnotationKey] != "":
+		reason = skipReplica
+	}
+	patch := mutator.NewPatchBuilder(&configMap)
+	patch.AddAnnotation(syncAnnotationKey, config.NamespaceSelector)
+	check := expectAnnotations(map[string]string{syncAnnotationKey: config.NamespaceSelector},
+		func(c *corev1.ConfigMap) map[string]string { return c.Annotations })
+	return whsvr.admitPatch(ctx, p, req, configMap.Name, reason, patch, check)
+}
+
+// mutateCertificate adds the sync annotation to the secret template of
+// cert-manager Certificates, so the secrets are issued with it.
+func (whsvr *WebhookServer) mutateCertificate(ctx context.Context, p *policy, ar *v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, string) {
+	req := ar.Request
+	var cert certificate
+	if err := decodeObject(req, &cert); err != nil {
+		return whsvr.decodeFailed(ctx, req, err)
+	}
+	config := p.config.Certificates
+	reason := ""
+	if slices.Contains(config.IgnoredNamespaces, cert.Namespace) {
+		reason = skipIgnoredNamespace
+	}
+	patch := mutator.NewPatchBuilder(&cert)
+	if template := cert.Spec.SecretTemplate; template != nil {
+		patch.DeclareMap(secretTemplateAnnotationsPath, template.Annotations)
+	} else {
+		patch.DeclareMap(secretTemplateAnnotationsPath, nil, "/spec/secretTemplate")
+	}
+	patch.AddMapKey(secretTemplateAnnotationsPath, syncAnnotationKey, config.NamespaceSelector)
+	check := expectAnnotations(map[string]string{syncAnnotationKey: config.NamespaceSelector},
+		func(c *certificate) map[string]string {
+			if c.Spec.SecretTemplate == nil {
+				return nil
+			}
+			return c.Spec.SecretTemplate.Annotations
+		})
+	return whsvr.admitPatch(ctx, p, req, cert.Name, reason, patch, check)
+}
+
+// validateSecret rejects secrets whose sync annotation kubed can't parse,
+// which it would otherwise ignore without a word.
+func (whsvr *WebhookServer) validateSecret(ctx context.Context, p *policy, ar *v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, string) {
+	req := ar.Request
+	var secret mutator.SecretMetadata
+	if err := decodeObject(req, &secret); err != nil {
+		return whsvr.decodeFailed(ctx, req, err)
+	}
+	log := logr.FromContextOrDiscard(ctx).WithValues("namespace", req.Namespace, "name", secret.Name, "operation", req.Operation, "kind", req.Kind.Kind)
+	entry := newAuditEntry(requestIDFrom(ctx), req, secret.Name)
+
+	value := secret.Annotations[syncAnnotationKey]
+	if _, err := labels.Parse(value); err != nil && !slices.Contains(p.config.Mutator.IgnoredNamespaces, secret.Namespace) {
+		log.Info("Denying secret with an invalid sync annotation", "value", value, "error", err.Error())
+		entry.Decision = decisionDenied
+		entry.Error = err.Error()
+		whsvr.recordDecision(entry)
+		whsvr.events.record(req, secret.Name, corev1.EventTypeWarning, eventError, "Invalid %s annotation: %v", syncAnnotationKey, err)
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Message: "invalid " + syncAnnotationKey + " annotation: " + err.Error(),
+				Reason:  metav1.StatusReasonInvalid,
+				Code:    http.StatusUnprocessableEntity,
+			},
+		}, metrics.ResultDenied
+	}
+	entry.Decision = decisionAllowed
+	whsvr.recordDecision(entry)
+	return &v1beta1.AdmissionResponse{Allowed: true}, metrics.ResultAllowed
+}
+
+// admitPatch answers the mutations of objects other than secrets, which
+// have no stages or downstream webhook: it skips the object when reason is
+// set or the object needs no changes and applies the patch otherwise,
+// recording the decision as mutate does. check verifies the patched
+// object.
+func (whsvr *WebhookServer) admitPatch(ctx context.Context, p *policy, req *v1beta1.AdmissionRequest, name, reason string, builder *mutator.PatchBuilder,
+	check func(patched []byte) error) (*v1beta1.AdmissionResponse, string) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("namespace", req.Namespace, "name", name, "operation", req.Operation, "kind", req.Kind.Kind)
+	entry := newAuditEntry(requestIDFrom(ctx), req, name)
+	patch, err := builder.Operations()
+	if err == nil && reason == "" && len(patch) == 0 {
+		reason = mutator.SkipNoChanges
+	}
+	if reason != "" {
+		if whsvr.sampler.sample(log, req.Namespace, name, decisionSkipped+"/"+reason) {
+			log.Info("Skipping mutation", "reason", reason)
+		}
+		entry.Decision = decisionSkipped
+		entry.SkipReason = reason
+		metrics.ObserveSkip(reason)
+		whsvr.recordDecision(entry)
+		return &v1beta1.AdmissionResponse{Allowed: true}, metrics.ResultSkipped
+	}
+
+	var patchBytes []byte
+	if err == nil {
+		patchBytes, err = mutator.MarshalPatch(patch)
+	}
+	if err != nil {
+		log.Error(err, "Could not create patch")
+		whsvr.observeError(err)
+		metrics.PatchErrors.Inc()
+		entry.Decision = decisionError
+		entry.Error = err.Error()
+		whsvr.recordDecision(entry)
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}, metrics.ResultErrored
+	}
+	if err := whsvr.verifyPatch(p, req, patchBytes, check); err != nil {
+		return whsvr.verificationFailed(log, req, name, entry, err)
+	}
+	if match, frozen := whsvr.frozen(p); frozen {
+		return whsvr.frozenResponse(log, entry, mutator.DefaultRule, patch, nil, match), metrics.ResultSkipped
+	}
+	if whsvr.sampler.sample(log, req.Namespace, name, decisionMutated) {
+		log.Info("Mutating object", "rule", mutator.DefaultRule, "patchOperations", len(patch))
+	}
+	metrics.ObservePatch(mutator.DefaultRule, patchBytes)
+	metrics.ObserveMutation(req.Namespace)
+	metrics.ObserveAnnotationAdded(syncAnnotationKey)
+	entry.Decision = decisionMutated
+	entry.MatchedRule = mutator.DefaultRule
+	entry.Patch = whsvr.patchSummary(patch)
+	whsvr.recordDecision(entry)
+	whsvr.events.record(req, name, corev1.EventTypeNormal, eventAnnotated, "Annotated %s for sync", syncAnnotationKey)
+
+	patchType := v1beta1.PatchTypeJSONPatch
+	return &v1beta1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patchBytes,
+		PatchType: &patchType,
+	}, metrics.ResultMutated
+}
+
+// decodeFailed answers a review whose object could not be decoded.
+func (whsvr *WebhookServer) decodeFailed(ctx context.Context, req *v1beta1.AdmissionRequest, err error) (*v1beta1.AdmissionResponse, string) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("namespace", req.Namespace, "name", req.Name, "operation", req.Operation)
+	log.Error(err, "Could not unmarshal raw object")
+	whsvr.observeError(err)
+	entry := newAuditEntry(requestIDFrom(ctx), req, req.Name)
+	entry.Decision = decisionError
+	entry.Error = err.Error()
+	whsvr.recordDecision(entry)
+	whsvr.events.record(req, req.Name, corev1.EventTypeWarning, eventError, "Could not decode %s: %v", strings.ToLower(req.Kind.Kind), err)
+	return &v1beta1.AdmissionResponse{
+		Result: &metav1.Status{
+			Message: err.Error(),
+		},
+	}, metrics.ResultErrored
+}
+
+// unexpectedKind answers a review of a kind no enabled path handles, which
+// a webhook rule broader than the handlers sent: allowed with a warning, or
+// rejected when failing closed.
+func (whsvr *WebhookServer) unexpectedKind(ctx context.Context, path string, req *v1beta1.AdmissionRequest) (*v1beta1.AdmissionResponse, string) {
+	kind := schema.GroupKind{Group: req.Kind.Group, Kind: req.Kind.Kind}
+	message := "cert-manager webhook has no handler for " + kind.String() + " objects on " + path
+	log := logr.FromContextOrDiscard(ctx)
+	log.Info("No handler for the kind", "path", path, "kind", kind.String(), "resource", req.Resource.Resource, "failOpen", whsvr.failOpen)
+	metrics.UnexpectedKinds.WithLabelValues(path, kind.String(), "false").Inc()
+	entry := newAuditEntry(requestIDFrom(ctx), req, req.Name)
+	response := failureResponse(whsvr.failOpen, http.StatusBadRequest, metav1.StatusReasonBadRequest, message)
+	if !whsvr.failOpen {
+		entry.Decision = decisionDenied
+		entry.Error = message
+		whsvr.recordDecision(entry)
+		return response, metrics.ResultDenied
+	}
+	entry.Decision = decisionSkipped
+	entry.SkipReason = skipUnexpectedKind
+	whsvr.recordDecision(entry)
+	metrics.ObserveSkip(skipUnexpectedKind)
+	response.Warnings = []string{message}
+	return response, metrics.ResultSkipped
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+const (
+	// resyncFieldManager owns the annotation the resync controller sets.
+	resyncFieldManager = "cert-manager-webhook-resync"
+	// resyncPageSize is the number of secrets listed per request.
+	resyncPageSize = 500
+)
+
+// ResyncConfig holds the settings of the resync controller.
+type ResyncConfig struct {
+	// BatchWindow is how long namespace creations are collected before the
+	// sources are touched, once for all of them.
+	BatchWindow time.Duration
+	// QPS and Burst limit the touches sent per second and at once.
+	QPS   float64
+	Burst int
+}
+
+// ResyncController makes kubed copy the managed secrets into a namespace as
+// soon as it is created, rather than at kubed's next full resync. The
+// elected leader watches namespaces; the ones created within a batch window
+// are collected, and each managed source secret whose sync annotation
+// selects one of them is touched once by setting mutator.ResyncAnnotationKey
+// to the time, which kubed sees as a change. During a change freeze nothing
+// is touched, the created namespaces stay pending until the window ends.
+type ResyncController struct {
+	log     logr.Logger
+	client  kubernetes.Interface
+	whsvr   *WebhookServer
+	limiter *rate.Limiter // touches sent per second
+	config  ResyncConfig
+
+	mu      sync.Mutex
+	pending map[string]labels.Set // created namespaces by name, with their labels
+}
+
+// NewResyncController returns a controller touching the managed secrets
+// when namespaces are created, outside the change freezes of whsvr.
+func (whsvr *WebhookServer) NewResyncController(log logr.Logger, client kubernetes.Interface, config ResyncConfig) *ResyncController {
+	return &ResyncController{
+		log:     log,
+		client:  client,
+		whsvr:   whsvr,
+		limiter: rate.NewLimiter(rate.Limit(config.QPS), config.Burst),
+		config:  config,
+	}
+}
+
+// Stopped does nothing, the controller exports nothing while leading.
+func (c *ResyncController) Stopped() {}
+
+// Lead watches namespace creations until ctx is done.
+func (c *ResyncController) Lead(ctx context.Context) {
+	c.log.Info("Watching namespace creations", "batchWindow", c.config.BatchWindow.String())
+	c.mu.Lock()
+	c.pending = map[string]labels.Set{}
+	c.mu.Unlock()
+
+	factory := informers.NewSharedInformerFactory(c.client, informerResync)
+	informer := factory.Core().V1().Namespaces().Informer()
+	_, _ = informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			// the namespaces existing when the watch starts are not new
+			namespace, ok := obj.(*corev1.Namespace)
+			if !ok || isInInitialList {
+				return
+			}
+			c.mu.Lock()
+			c.pending[namespace.Name] = labels.Set(namespace.Labels)
+			c.mu.Unlock()
+		},
+	})
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return
+	}
+
+	ticker := time.NewTicker(c.config.BatchWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if match, frozen := c.whsvr.frozen(c.whsvr.policy.Load()); frozen {
+			c.mu.Lock()
+			pending := len(c.pending)
+			c.mu.Unlock()
+			if pending > 0 {
+				c.log.V(1).Info("Not touching the sources of new namespaces during change freeze", "reason", skipFrozen,
+					"window", match.Window, "until", match.End.Format(time.RFC3339), "namespaces", pending)
+			}
+			continue
+		}
+		c.mu.Lock()
+		created := c.pending
+		c.pending = map[string]labels.Set{}
+		c.mu.Unlock()
+		if len(created) == 0 {
+			continue
+		}
+		if err := c.touchSources(ctx, created); err != nil && ctx.Err() == nil {
+			c.log.Error(err, "Failed to touch the sources of new namespaces", "namespaces", len(created))
+		}
+	}
+}
+
+// touchSources touches each managed source secret selecting one of the
+// created namespaces, once.
+func (c *ResyncController) touchSources(ctx context.Context, created map[string]labels.Set) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{mutator.ResyncAnnotationKey: now},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	opts := metav1.ListOptions{Limit: resyncPageSize}
+	touched := 0
+	for {
+		list, err := c.client.CoreV1().Secrets("").List(ctx, opts)
+		if err != nil {
+			return fmt.Errorf("listing secrets: %w", err)
+		}
+		for i := range list.Items {
+			secret := &list.Items[i]
+			if secret.Annotations[mutator.ManagedByAnnotationKey] != mutator.ManagedByValue {
+				continue
+			}
+			value, ok := secret.Annotations[mutator.SyncAnnotationKey]
+			if !ok || !selectsAny(value, created) {
+				continue
+			}
+			if err := c.limiter.Wait(ctx); err != nil {
+				return err
+			}
+			err := withRetry(ctx, opResyncTouch, nil, func(ctx context.Context) error {
+				_, err := c.client.CoreV1().Secrets(secret.Namespace).Patch(ctx, secret.Name, types.MergePatchType, patch,
+					metav1.PatchOptions{FieldManager: resyncFieldManager})
+				return err
+			})
+			switch {
+			case apierrors.IsNotFound(err):
+			case err != nil:
+				metrics.ResyncTouches.WithLabelValues("failed").Inc()
+				c.log.Error(err, "Failed to touch secret", "namespace", secret.Namespace, "name", secret.Name)
+			default:
+				metrics.ResyncTouches.WithLabelValues("touched").Inc()
+				touched++
+			}
+		}
+		if list.Continue == "" {
+			break
+		}
+		opts.Continue = list.Continue
+	}
+	c.log.Info("Touched the sources of new namespaces", "namespaces", len(created), "secrets", touched)
+	return nil
+}
+
+// selectsAny reports whether the sync annotation value, "true" or empty for
+// every namespace or else a label selector, selects one of namespaces. An
+// invalid selector selects none, kubed ignores it too.
+func selectsAny(value string, namespaces map[string]labels.Set) bool {
+	if value == "" || value == "true" {
+		return true
+	}
+	selector, err := labels.Parse(value)
+	if err != nil {
+		return false
+	}
+	for _, set := range namespaces {
+		if selector.Matches(set) {
+			return true
+		}
+	}
+	return false
+}
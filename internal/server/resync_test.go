@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// resyncSources returns the namespace apps and its managed source secrets,
+// syncing everywhere, to prod and to dev, and one the webhook doesn't
+// manage.
+func resyncSources() []runtime.Object {
+	source := func(name, sync string, managed bool) *corev1.Secret {
+		secret := FixtureSecret{Name: name, Namespace: "apps", DataSize: 16}.Build()
+		secret.Annotations[mutator.SyncAnnotationKey] = sync
+		if managed {
+			secret.Annotations[mutator.ManagedByAnnotationKey] = mutator.ManagedByValue
+		}
+		return secret
+	}
+	return []runtime.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps"}},
+		source("all-tls", "true", true),
+		source("prod-tls", "env=prod", true),
+		source("dev-tls", "env=dev", true),
+		source("hand-tls", "true", false),
+	}
+}
+
+// touches returns the number of patches each secret got.
+func touches(client *fake.Clientset) map[string]int {
+	counts := map[string]int{}
+	for _, action := range client.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok && action.GetResource().Resource == "secrets" {
+			counts[patch.GetName()]++
+		}
+	}
+	return counts
+}
+
+// newResync returns a resync controller of a server of the default
+// settings, closed when the test ends.
+func newResync(t *testing.T, client *fake.Clientset, config ResyncConfig) *ResyncController {
+	t.Helper()
+	whsvr, err := NewWebhookServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(whsvr.Close)
+	return whsvr.NewResyncController(logr.Discard(), client, config)
+}
+
+// A namespace created while leading gets the sources selecting it touched
+// once; the namespaces there before don't.
+func TestResyncNamespaceCreated(t *testing.T) {
+	client := fake.NewSimpleClientset(resyncSources()...)
+	controller := newResync(t, client, ResyncConfig{BatchWindow: 20 * time.Millisecond, QPS: 100, Burst: 10})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		controller.Lead(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// a few windows pass with apps, there before
+	time.Sleep(100 * time.Millisecond)
+	if got := touches(client); len(got) != 0 {
+		t.Fatalf("touched %v for the existing namespace", got)
+	}
+
+	if _, err := client.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments", Labels: map[string]string{"env": "prod"}}}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(touches(client)) == 2 })
+	time.Sleep(100 * time.Millisecond)
+	if got, want := touches(client), map[string]int{"all-tls": 1, "prod-tls": 1}; !maps.Equal(got, want) {
+		t.Errorf("touched %v, want %v", got, want)
+	}
+	secret, err := client.CoreV1().Secrets("apps").Get(ctx, "prod-tls", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.Parse(time.RFC3339, secret.Annotations[mutator.ResyncAnnotationKey]); err != nil {
+		t.Errorf("resync annotation %q: %v", secret.Annotations[mutator.ResyncAnnotationKey], err)
+	}
+}
+
+// The namespaces of a storm, batched together, touch each source selecting
+// any of them once.
+func TestResyncStorm(t *testing.T) {
+	client := fake.NewSimpleClientset(resyncSources()...)
+	controller := newResync(t, client, ResyncConfig{QPS: 100, Burst: 10})
+	created := map[string]labels.Set{}
+	for _, name := range []string{"prod-1", "prod-2", "prod-3", "prod-4"} {
+		created[name] = labels.Set{"env": "prod"}
+	}
+	created["dev-1"] = labels.Set{"env": "dev"}
+	created["test-1"] = labels.Set{"env": "test"}
+	if err := controller.touchSources(context.Background(), created); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := touches(client), map[string]int{"all-tls": 1, "prod-tls": 1, "dev-tls": 1}; !maps.Equal(got, want) {
+		t.Errorf("touched %v, want %v", got, want)
+	}
+}
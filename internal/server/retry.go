@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// Side effects retried by withRetry, the operation label of
+// webhook_sideeffect_retries_total.
+const (
+	opEvent           = "event"
+	opStatus          = "status-configmap"
+	opWebhookConfig   = "webhook-config"
+	opBackfillPatch   = "backfill-patch"
+	opDriftPatch      = "drift-patch"
+	opResyncTouch     = "resync-touch"
+	opReplicaGCDelete = "replica-gc-delete"
+)
+
+// sideEffectAttempts is the number of attempts at a side effect.
+const sideEffectAttempts = 5
+
+// sideEffectBackoff spaces the attempts of a side effect: 200ms doubling up
+// to 5s, each jittered by up to 50% so replicas don't retry in step.
+var sideEffectBackoff = wait.Backoff{
+	Duration: 200 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.5,
+	Steps:    sideEffectAttempts,
+	Cap:      5 * time.Second,
+}
+
+// retryableError reports whether an API call failing with err may succeed
+// when made again: on conflicts, when the caller reads the object afresh on
+// each attempt, and on transientError.
+func retryableError(err error) bool {
+	return apierrors.IsConflict(err) || transientError(err)
+}
+
+// transientError reports whether err is one of the server's or network's
+// passing failures: 5xx, timeouts, throttling, dropped connections. Errors
+// about the request itself, invalid, forbidden, not found, are not, and
+// retrying them only delays the failure.
+func transientError(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case apierrors.IsInternalError(err), apierrors.IsServerTimeout(err), apierrors.IsTimeout(err),
+		apierrors.IsTooManyRequests(err), apierrors.IsServiceUnavailable(err), apierrors.IsUnexpectedServerError(err):
+		return true
+	}
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		return status.Status().Code >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || utilnet.IsConnectionReset(err) || utilnet.IsProbableEOF(err) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// withRetry calls fn until it succeeds or fails with an error retry doesn't
+// accept, for at most sideEffectAttempts attempts spaced by
+// sideEffectBackoff; retry is retryableError when nil. It never waits past
+// ctx's deadline, returning the last error rather than starting an attempt
+// bound to fail, and returns once ctx is done. Each retry is counted under
+// operation.
+func withRetry(ctx context.Context, operation string, retry func(error) bool, fn func(ctx context.Context) error) error {
+	if retry == nil {
+		retry = retryableError
+	}
+	backoff := sideEffectBackoff
+	for {
+		err := fn(ctx)
+		if err == nil || !retry(err) || backoff.Steps <= 1 {
+			return err
+		}
+		delay := backoff.Step()
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		metrics.SideEffectRetries.WithLabelValues(operation).Inc()
+	}
+}
+
+// eventWriteTimeout bounds the writes of an event, retries included.
+const eventWriteTimeout = 30 * time.Second
+
+// retryingEventSink writes events through withRetry. The broadcaster calls
+// it from its own goroutine, so retries never delay an admission.
+type retryingEventSink struct {
+	sink record.EventSink
+}
+
+func (s retryingEventSink) Create(event *corev1.Event) (*corev1.Event, error) {
+	return retryEvent(func() (*corev1.Event, error) { return s.sink.Create(event) })
+}
+
+func (s retryingEventSink) Update(event *corev1.Event) (*corev1.Event, error) {
+	return retryEvent(func() (*corev1.Event, error) { return s.sink.Update(event) })
+}
+
+func (s retryingEventSink) Patch(event *corev1.Event, data []byte) (*corev1.Event, error) {
+	return retryEvent(func() (*corev1.Event, error) { return s.sink.Patch(event, data) })
+}
+
+// retryEvent retries transient failures of write only: an event write in
+// conflict must be turned by the broadcaster into a create or an update.
+func retryEvent(write func() (*corev1.Event, error)) (*corev1.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), eventWriteTimeout)
+	defer cancel()
+	var written *corev1.Event
+	err := withRetry(ctx, opEvent, transientError, func(context.Context) error {
+		var err error
+		written, err = write()
+		return err
+	})
+	return written, err
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+var configMaps = corev1.Resource("configmaps")
+
+func TestRetryClassification(t *testing.T) {
+	for _, tt := range []struct {
+		name                 string
+		err                  error
+		retryable, transient bool
+	}{
+		{name: "conflict", err: apierrors.NewConflict(configMaps, "status", errors.New("changed")), retryable: true},
+		{name: "internal", err: apierrors.NewInternalError(errors.New("etcd")), retryable: true, transient: true},
+		{name: "server timeout", err: apierrors.NewServerTimeout(configMaps, "update", 1), retryable: true, transient: true},
+		{name: "timeout", err: apierrors.NewTimeoutError("slow", 1), retryable: true, transient: true},
+		{name: "throttled", err: apierrors.NewTooManyRequests("slow down", 1), retryable: true, transient: true},
+		{name: "unavailable", err: apierrors.NewServiceUnavailable("restarting"), retryable: true, transient: true},
+		{name: "bad gateway", err: apierrors.NewGenericServerResponse(502, "update", configMaps, "status", "", 0, true), retryable: true, transient: true},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, retryable: true, transient: true},
+		{name: "connection reset", err: fmt.Errorf("update: %w", syscall.ECONNRESET), retryable: true, transient: true},
+		{name: "eof", err: io.EOF, retryable: true, transient: true},
+		{name: "wrapped eof", err: fmt.Errorf("update: %w", io.ErrUnexpectedEOF), retryable: true, transient: true},
+		{name: "invalid", err: apierrors.NewInvalid(corev1.SchemeGroupVersion.WithKind("ConfigMap").GroupKind(), "status",
+			field.ErrorList{field.Invalid(field.NewPath("data"), "x", "too long")})},
+		{name: "bad request", err: apierrors.NewBadRequest("malformed")},
+		{name: "forbidden", err: apierrors.NewForbidden(configMaps, "status", errors.New("RBAC"))},
+		{name: "not found", err: apierrors.NewNotFound(configMaps, "status")},
+		{name: "already exists", err: apierrors.NewAlreadyExists(configMaps, "status")},
+		{name: "cancelled", err: context.Canceled},
+		{name: "other", err: errors.New("broken")},
+		{name: "none"},
+	} {
+		if got := retryableError(tt.err); got != tt.retryable {
+			t.Errorf("%s: retryable %v, want %v", tt.name, got, tt.retryable)
+		}
+		if got := transientError(tt.err); got != tt.transient {
+			t.Errorf("%s: transient %v, want %v", tt.name, got, tt.transient)
+		}
+	}
+}
+
+// scriptedClient returns a clientset whose ConfigMap updates fail with the
+// errors of script in turn, then succeed, and the count of updates.
+func scriptedClient(script ...error) (*fake.Clientset, func() int) {
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "status", Namespace: "cert-manager"}})
+	var mu sync.Mutex
+	updates := 0
+	client.PrependReactor("update", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		updates++
+		if updates <= len(script) {
+			return true, nil, script[updates-1]
+		}
+		return false, nil, nil
+	})
+	return client, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return updates
+	}
+}
+
+// fastBackoff spaces the attempts by milliseconds for the test. The cap,
+// which ends the steps once reached, is out of reach as it is in
+// sideEffectBackoff.
+func fastBackoff(t *testing.T) {
+	saved := sideEffectBackoff
+	sideEffectBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 2, Jitter: 0.5, Steps: sideEffectAttempts, Cap: 25 * time.Millisecond}
+	t.Cleanup(func() { sideEffectBackoff = saved })
+}
+
+// Writes failing with scripted errors are retried while retryable, at
+// most sideEffectAttempts times, each retry counted under the operation.
+func TestWithRetry(t *testing.T) {
+	fastBackoff(t)
+	unavailable := apierrors.NewServiceUnavailable("restarting")
+	invalid := apierrors.NewBadRequest("malformed")
+	for _, tt := range []struct {
+		name     string
+		script   []error
+		retry    func(error) bool
+		attempts int
+		want     error // the error returned, nil for success
+	}{
+		{name: "conflict then 5xx", script: []error{apierrors.NewConflict(configMaps, "status", errors.New("changed")), unavailable}, attempts: 3},
+		{name: "not retryable", script: []error{invalid, unavailable}, attempts: 1, want: invalid},
+		{name: "persistent", script: []error{unavailable, unavailable, unavailable, unavailable, unavailable, unavailable}, attempts: sideEffectAttempts, want: unavailable},
+		{name: "conflict as an event", script: []error{apierrors.NewConflict(configMaps, "status", errors.New("changed"))}, retry: transientError, attempts: 1,
+			want: apierrors.NewConflict(configMaps, "status", errors.New("changed"))},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, updates := scriptedClient(tt.script...)
+			retries := metrics.SideEffectRetries.WithLabelValues(opStatus)
+			before := testutil.ToFloat64(retries)
+			err := withRetry(context.Background(), opStatus, tt.retry, func(ctx context.Context) error {
+				_, err := client.CoreV1().ConfigMaps("cert-manager").Update(ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "status", Namespace: "cert-manager"}}, metav1.UpdateOptions{})
+				return err
+			})
+			if (tt.want == nil) != (err == nil) || (err != nil && err.Error() != tt.want.Error()) {
+				t.Errorf("error %v, want %v", err, tt.want)
+			}
+			if updates() != tt.attempts {
+				t.Errorf("%d attempts, want %d", updates(), tt.attempts)
+			}
+			if got := testutil.ToFloat64(retries) - before; got != float64(tt.attempts-1) {
+				t.Errorf("%v retries counted, want %d", got, tt.attempts-1)
+			}
+		})
+	}
+}
+
+// No retry starts when the delay outlasts the context's deadline, and
+// none once the context is done.
+func TestWithRetryContext(t *testing.T) {
+	unavailable := apierrors.NewServiceUnavailable("restarting")
+	update := func(client *fake.Clientset) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			_, err := client.CoreV1().ConfigMaps("cert-manager").Update(ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "status", Namespace: "cert-manager"}}, metav1.UpdateOptions{})
+			return err
+		}
+	}
+
+	// the first delay, at least 200ms, is past the deadline
+	client, updates := scriptedClient(unavailable, unavailable)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := withRetry(ctx, opStatus, nil, update(client)); !apierrors.IsServiceUnavailable(err) || updates() != 1 {
+		t.Errorf("error %v after %d attempts, want the first one's", err, updates())
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("returned after %v, waiting for the deadline", elapsed)
+	}
+
+	// cancelled while waiting to retry
+	client, updates = scriptedClient(unavailable, unavailable)
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start = time.Now()
+	if err := withRetry(ctx, opStatus, nil, update(client)); !apierrors.IsServiceUnavailable(err) || updates() != 1 {
+		t.Errorf("error %v after %d attempts, want the first one's", err, updates())
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("returned %v after being cancelled", elapsed)
+	}
+}
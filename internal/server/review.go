@@ -0,0 +1,35 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+// decodeReview decodes an AdmissionReview from a stream with encoding/json
+// rather than a runtime scheme. admission.k8s.io/v1 and v1beta1 reviews
+// share the same shape, so either is decoded into the v1beta1 types the
+// handlers use, its TypeMeta kept to answer in the same version. As with
+// the universal deserializer this replaces, unknown fields are ignored and
+// other apiVersions are decoded the same way rather than rejected. Anything
+// but whitespace after the review is an error, and so is a truncated one;
+// an empty stream returns io.EOF. The object stays raw in Object.Raw, as
+// its type is only known once the route is.
+func decodeReview(r io.Reader) (v1beta1.AdmissionReview, error) {
+	decoder := json.NewDecoder(r)
+	var ar v1beta1.AdmissionReview
+	if err := decoder.Decode(&ar); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) || err == io.ErrUnexpectedEOF {
+			return v1beta1.AdmissionReview{}, fmt.Errorf("couldn't get version/kind; json parse error: %w", err)
+		}
+		return v1beta1.AdmissionReview{}, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return v1beta1.AdmissionReview{}, errors.New("unexpected data after the AdmissionReview")
+	}
+	return ar, nil
+}
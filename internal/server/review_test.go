@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	goruntime "runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+)
+
+func TestDecodeReview(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		apiVersion string // decoded, when no error
+		uid        string
+		err        string // in the error, none when empty
+	}{
+		{name: "v1", body: `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"a1"}}`, apiVersion: "admission.k8s.io/v1", uid: "a1"},
+		{name: "v1beta1", body: `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"uid":"b1"}}`, apiVersion: "admission.k8s.io/v1beta1", uid: "b1"},
+		{name: "unknown fields ignored", body: `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","extra":1,"request":{"uid":"c1","future":{}}}`, apiVersion: "admission.k8s.io/v1", uid: "c1"},
+		{name: "other apiVersion decoded alike", body: `{"apiVersion":"admission.k8s.io/v2","kind":"AdmissionReview","request":{"uid":"d1"}}`, apiVersion: "admission.k8s.io/v2", uid: "d1"},
+		{name: "trailing whitespace", body: "{\"request\":{\"uid\":\"e1\"}}\n\t ", uid: "e1"},
+		{name: "not JSON", body: `apiVersion: v1`, err: "couldn't get version/kind"},
+		{name: "truncated", body: `{"apiVersion":"admission.k8s.io/v1","request":{`, err: "couldn't get version/kind"},
+		{name: "trailing data", body: `{"request":{"uid":"f1"}}{}`, err: "unexpected data"},
+		{name: "wrong type", body: `{"request":"f1"}`, err: "cannot unmarshal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ar, err := decodeReview(strings.NewReader(tt.body))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ar.APIVersion != tt.apiVersion || ar.Request == nil || string(ar.Request.UID) != tt.uid {
+				t.Errorf("decoded %+v", ar)
+			}
+		})
+	}
+	if _, err := decodeReview(strings.NewReader("")); !errors.Is(err, io.EOF) {
+		t.Errorf("empty body: %v, want io.EOF", err)
+	}
+}
+
+// failingReader returns its error once the bytes before it are read, as
+// the body of a client gone mid-request does.
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+	return n, err
+}
+
+// Bodies cut short are told apart: a stream ending inside the document is
+// a review that doesn't decode, answered with its error, while a stream
+// failing is a body that couldn't be read, answered 400.
+func TestServeTruncatedBody(t *testing.T) {
+	handler := newTestHandler(t, DefaultConfig())
+	review, err := FixtureReview(FixtureSecret{Name: "tls", Namespace: "apps", DataSize: 4096}.Build(), v1beta1.Create, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := body[:len(body)/2]
+	for _, tt := range []struct {
+		name    string
+		body    io.Reader
+		gzip    bool
+		code    int
+		message string // of the review's answer, when code is 200
+	}{
+		{name: "document cut", body: bytes.NewReader(half), code: http.StatusOK, message: "unexpected EOF"},
+		{name: "trailing garbage", body: io.MultiReader(bytes.NewReader(body), strings.NewReader("{}")), code: http.StatusOK, message: "unexpected data"},
+		{name: "client gone", body: &failingReader{r: bytes.NewReader(half), err: io.ErrUnexpectedEOF}, code: http.StatusBadRequest},
+		{name: "gzip stream cut", body: bytes.NewReader(func() []byte { gz := gzipped(t, body); return gz[:len(gz)/2] }()), gzip: true, code: http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, PathMutateSecrets, tt.body)
+			req.Header.Set("Content-Type", "application/json")
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.code {
+				t.Fatalf("answered %d: %s, want %d", rec.Code, rec.Body, tt.code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var answer v1beta1.AdmissionReview
+			if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil {
+				t.Fatal(err)
+			}
+			if answer.Response == nil || answer.Response.Allowed || answer.Response.Result == nil ||
+				!strings.Contains(answer.Response.Result.Message, tt.message) {
+				t.Errorf("answered %s, want a denial containing %q", rec.Body, tt.message)
+			}
+		})
+	}
+}
+
+// A client streaming its body slowly is served as long as the whole body
+// arrives within the read timeout.
+func TestSlowClientServed(t *testing.T) {
+	whsvr, err := NewWebhookServer(WithHTTPServer(&http.Server{Addr: ":8443", ReadHeaderTimeout: time.Minute, ReadTimeout: 5 * time.Second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := listenLocal(t)
+	serveWebhook(t, whsvr, ln)
+	review, err := FixtureReview(FixtureSecret{Name: "tls", Namespace: "apps", DataSize: 4096}.Build(), v1beta1.Create, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: webhook\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n", PathMutateSecrets, len(body))
+	for chunk := range slices.Chunk(body, len(body)/10+1) {
+		if _, err := conn.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var answer v1beta1.AdmissionReview
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || answer.Response == nil || !answer.Response.Allowed || len(answer.Response.Patch) == 0 {
+		t.Errorf("slow client answered %d with %+v", resp.StatusCode, answer.Response)
+	}
+}
+
+// heldBytes returns the heap decode leaves in use with what it returns
+// kept alive.
+func heldBytes(decode func() any) float64 {
+	var before, after goruntime.MemStats
+	goruntime.GC()
+	goruntime.ReadMemStats(&before)
+	kept := decode()
+	goruntime.GC()
+	goruntime.ReadMemStats(&after)
+	goruntime.KeepAlive(kept)
+	return float64(after.HeapAlloc) - float64(before.HeapAlloc)
+}
+
+// BenchmarkDecodeReview compares decodeReview with the universal
+// deserializer it replaced, on a small review and a 1MiB one. Both
+// allocate about as much, but the body the deserializer needed read first
+// was held for the whole admission, while the decoder's buffer goes once
+// the review is decoded: held-B is the heap in use during the admission.
+func BenchmarkDecodeReview(b *testing.B) {
+	for _, fixture := range []FixtureSecret{
+		{Name: "small", Namespace: "apps", DataSize: 16},
+		{Name: "1MiB", Namespace: "apps", DataSize: 1 << 20},
+	} {
+		review, err := FixtureReview(fixture.Build(), v1beta1.Create, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		body, err := json.Marshal(review)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fixture.Name+"/universal deserializer", func(b *testing.B) {
+			deserializer := serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for b.Loop() {
+				// the deserializer needs the whole body read first
+				buffered, err := io.ReadAll(bytes.NewReader(body))
+				if err != nil {
+					b.Fatal(err)
+				}
+				var ar v1beta1.AdmissionReview
+				if _, _, err := deserializer.Decode(buffered, nil, &ar); err != nil || ar.Request == nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(heldBytes(func() any {
+				buffered, _ := io.ReadAll(bytes.NewReader(body))
+				var ar v1beta1.AdmissionReview
+				_, _, _ = deserializer.Decode(buffered, nil, &ar)
+				return []any{buffered, ar}
+			}), "held-B")
+		})
+		b.Run(fixture.Name+"/encoding/json", func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for b.Loop() {
+				if ar, err := decodeReview(bytes.NewReader(body)); err != nil || ar.Request == nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(heldBytes(func() any {
+				ar, _ := decodeReview(bytes.NewReader(body))
+				return ar
+			}), "held-B")
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// Admission paths the webhook can serve, one per resource and kind of
+// webhook.
+const (
+	PathMutateSecrets      = "/mutate/secrets"
+	PathMutateConfigMaps   = "/mutate/configmaps"
+	PathMutateCertificates = "/mutate/certificates"
+	PathValidateSecrets    = "/validate/secrets"
+	PathProtectSecrets     = "/validate/secrets/delete"
+
+	// PathLegacyMutate is the path of the secrets handler from before there
+	// were others, still served for existing webhook configurations.
+	PathLegacyMutate = "/mutate"
+)
+
+// DefaultPaths are the admission paths served unless configured.
+var DefaultPaths = []string{PathMutateSecrets}
+
+// certificateKind is cert-manager's Certificate; its API types aren't a
+// dependency, the handler decodes the fields it needs itself.
+var certificateKind = schema.GroupVersionKind{Group: "cert-manager.io", Version: "v1", Kind: "Certificate"}
+
+// Route binds an admission path to the handler of one kind of object.
+type Route struct {
+	// Path is the URL path the API server posts reviews to.
+	Path string
+	// Kind is the kind of object the handler accepts.
+	Kind schema.GroupVersionKind
+	// Resource is the resource the route's webhook rules match.
+	Resource string
+	// Validating routes never patch and are registered in a
+	// ValidatingWebhookConfiguration.
+	Validating bool
+
+	operations []admissionregistrationv1.OperationType // CREATE and UPDATE when empty
+	name       string                                  // prefix of the webhook name, Resource when empty
+	admit      func(whsvr *WebhookServer, ctx context.Context, p *policy, ar *v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, string)
+}
+
+var routes = []Route{
+	{Path: PathMutateSecrets, Kind: corev1.SchemeGroupVersion.WithKind("Secret"), Resource: "secrets", admit: (*WebhookServer).mutate},
+	{Path: PathMutateConfigMaps, Kind: corev1.SchemeGroupVersion.WithKind("ConfigMap"), Resource: "configmaps", admit: (*WebhookServer).mutateConfigMap},
+	{Path: PathMutateCertificates, Kind: certificateKind, Resource: "certificates", admit: (*WebhookServer).mutateCertificate},
+	{Path: PathValidateSecrets, Kind: corev1.SchemeGroupVersion.WithKind("Secret"), Resource: "secrets", Validating: true, admit: (*WebhookServer).validateSecret},
+	{Path: PathProtectSecrets, Kind: corev1.SchemeGroupVersion.WithKind("Secret"), Resource: "secrets", Validating: true,
+		operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Delete}, name: "secret-deletes", admit: (*WebhookServer).protectSecretDelete},
+}
+
+// Routes returns every admission path the webhook can serve.
+func Routes() []Route {
+	return append([]Route(nil), routes...)
+}
+
+// LookupRoute returns the route served on path; the legacy path is the
+// secrets mutation.
+func LookupRoute(path string) (Route, bool) {
+	if path == PathLegacyMutate {
+		path = PathMutateSecrets
+	}
+	for _, route := range routes {
+		if route.Path == path {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+// EnabledRoutes returns the routes of paths, DefaultPaths when empty.
+func EnabledRoutes(paths []string) ([]Route, error) {
+	if len(paths) == 0 {
+		paths = DefaultPaths
+	}
+	enabled := make([]Route, 0, len(paths))
+	for _, path := range paths {
+		route, ok := LookupRoute(path)
+		if !ok || path == PathLegacyMutate {
+			known := make([]string, 0, len(routes))
+			for _, route := range routes {
+				known = append(known, route.Path)
+			}
+			return nil, fmt.Errorf("unknown admission path %q, known paths: %s", path, strings.Join(known, ", "))
+		}
+		enabled = append(enabled, route)
+	}
+	return enabled, nil
+}
+
+// Rules returns the webhook rules sending the route's objects to it.
+func (r Route) Rules() []admissionregistrationv1.RuleWithOperations {
+	scope := admissionregistrationv1.AllScopes
+	operations := r.operations
+	if len(operations) == 0 {
+		operations = []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update}
+	}
+	return []admissionregistrationv1.RuleWithOperations{{
+		Operations: operations,
+		Rule: admissionregistrationv1.Rule{
+			APIGroups:   []string{r.Kind.Group},
+			APIVersions: []string{r.Kind.Version},
+			Resources:   []string{r.Resource},
+			Scope:       &scope,
+		},
+	}}
+}
+
+// WebhookName returns the name of the route's entry in a webhook
+// configuration, prefixing base with the resource. The secrets mutation
+// keeps base, the name it had when it was the only entry.
+func (r Route) WebhookName(base string) string {
+	if r.Path == PathMutateSecrets {
+		return base
+	}
+	if r.name != "" {
+		return r.name + "." + base
+	}
+	return r.Resource + "." + base
+}
+
+// accepts reports whether the route handles the object of req. Versions
+// are not compared, the handlers read fields common to all of them.
+func (r Route) accepts(req *v1beta1.AdmissionRequest) bool {
+	if req.Kind.Group != r.Kind.Group || req.Kind.Kind != r.Kind.Kind {
+		return false
+	}
+	return req.Resource.Resource == "" || req.Resource.Resource == r.Resource
+}
+
+// routeFor returns the enabled route handling the kind of req, the one of
+// path unless it's for another kind. Mutating and validating routes don't
+// stand in for each other. It returns false when no route handles req.
+func (whsvr *WebhookServer) routeFor(path string, req *v1beta1.AdmissionRequest) (Route, bool) {
+	route, _ := LookupRoute(path)
+	if req == nil || route.accepts(req) {
+		return route, true
+	}
+	for _, other := range whsvr.routes {
+		if other.Validating == route.Validating && other.accepts(req) {
+			return other, true
+		}
+	}
+	return route, false
+}
+
+// decodeSecret decodes the secret of req, without its data unless a
+// mutation stage of p needs it.
+func (whsvr *WebhookServer) decodeSecret(p *policy, req *v1beta1.AdmissionRequest) (*corev1.Secret, error) {
+	if p.mutator.NeedsData() {
+		var secret corev1.Secret
+		if err := decodeObject(req, &secret); err != nil {
+			return nil, err
+		}
+		return &secret, nil
+	}
+	var metadata mutator.SecretMetadata
+	if err := decodeObject(req, &metadata); err != nil {
+		return nil, err
+	}
+	return metadata.Secret(), nil
+}
+
+// decodeObject decodes the object of req into obj. The object must be of
+// the request's kind when it declares one, which only a broken client gets
+// wrong; the mismatch is reported rather than the decoding errors it causes.
+func decodeObject(req *v1beta1.AdmissionRequest, obj interface{ GetObjectKind() schema.ObjectKind }) error {
+	err := json.Unmarshal(req.Object.Raw, obj)
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	if err != nil {
+		var typeMeta metav1.TypeMeta
+		if json.Unmarshal(req.Object.Raw, &typeMeta) != nil {
+			return err
+		}
+		gvk = typeMeta.GroupVersionKind()
+	}
+	if gvk.Kind != "" && (gvk.Group != req.Kind.Group || gvk.Kind != req.Kind.Kind) {
+		return fmt.Errorf("object of kind %s in a request for %s", gvk.GroupKind(), schema.GroupKind{Group: req.Kind.Group, Kind: req.Kind.Kind})
+	}
+	return err
+}
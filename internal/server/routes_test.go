@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// objectReview returns the CREATE review of obj, requested as kind and
+// resource.
+func objectReview(t *testing.T, kind schema.GroupVersionKind, resource string, obj metav1.Object) *v1beta1.AdmissionReview {
+	t.Helper()
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &v1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+		Request: &v1beta1.AdmissionRequest{
+			UID:       types.UID(uuid.NewUUID()),
+			Kind:      metav1.GroupVersionKind{Group: kind.Group, Version: kind.Version, Kind: kind.Kind},
+			Resource:  metav1.GroupVersionResource{Group: kind.Group, Version: kind.Version, Resource: resource},
+			Namespace: obj.GetNamespace(),
+			Name:      obj.GetName(),
+			Operation: v1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+// reviewAt posts review to path and returns the answer.
+func reviewAt(t *testing.T, handler http.Handler, path string, review *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	t.Helper()
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s answered %d: %s", path, rec.Code, rec.Body)
+	}
+	var answer v1beta1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil || answer.Response == nil {
+		t.Fatalf("%s answered %s: %v", path, rec.Body, err)
+	}
+	return answer.Response
+}
+
+// configMapReview returns the review of a ConfigMap trust-manager selects.
+func configMapReview(t *testing.T) *v1beta1.AdmissionReview {
+	t.Helper()
+	return objectReview(t, corev1.SchemeGroupVersion.WithKind("ConfigMap"), "configmaps", &corev1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle", Namespace: "apps", Labels: map[string]string{DefaultConfigMapSelector: "true"}},
+		Data:       map[string]string{"ca.crt": "-"},
+	})
+}
+
+// Each enabled path serves its own kind of object, and /mutate stays the
+// secrets mutation.
+func TestRoutes(t *testing.T) {
+	config := DefaultConfig()
+	config.Paths = []string{PathMutateSecrets, PathMutateConfigMaps, PathMutateCertificates, PathValidateSecrets}
+	handler := newTestHandler(t, config)
+	cert := objectReview(t, certificateKind, "certificates", &certificate{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "cert-manager.io/v1", Kind: "Certificate"},
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "apps"},
+	})
+
+	for _, tt := range []struct {
+		path   string
+		review *v1beta1.AdmissionReview
+		want   string // JSON pointer the patch sets, none when validating
+	}{
+		{path: PathMutateSecrets, review: secretReview(t, "tls", "apps"), want: "/metadata/annotations"},
+		{path: PathLegacyMutate, review: secretReview(t, "tls", "apps"), want: "/metadata/annotations"},
+		{path: PathMutateConfigMaps, review: configMapReview(t), want: "/metadata/annotations"},
+		{path: PathMutateCertificates, review: cert, want: "/spec/secretTemplate"},
+		{path: PathValidateSecrets, review: secretReview(t, "tls", "apps")},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			response := reviewAt(t, handler, tt.path, tt.review)
+			if !response.Allowed || response.UID != tt.review.Request.UID {
+				t.Fatalf("answered %+v", response)
+			}
+			var patch []mutator.PatchOperation
+			if len(response.Patch) > 0 {
+				if err := json.Unmarshal(response.Patch, &patch); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.want == "" {
+				if len(patch) != 0 {
+					t.Errorf("validating path patched %s", response.Patch)
+				}
+				return
+			}
+			if !slices.ContainsFunc(patch, func(op mutator.PatchOperation) bool { return strings.HasPrefix(op.Path, tt.want) }) {
+				t.Errorf("patch %s, want one on %s", response.Patch, tt.want)
+			}
+		})
+	}
+
+	// paths not enabled aren't served
+	rec := httptest.NewRecorder()
+	newTestHandler(t, DefaultConfig()).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, PathMutateConfigMaps, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("disabled path answered %d, want 404", rec.Code)
+	}
+	if _, err := EnabledRoutes([]string{"/mutate/pods"}); err == nil || !strings.Contains(err.Error(), PathMutateConfigMaps) {
+		t.Errorf("unknown path error %v, want the known paths", err)
+	}
+}
+
+// A ConfigMap sent to the secrets path, with no ConfigMap handler enabled,
+// is neither decoded as a secret nor patched: it is allowed with a warning
+// when failing open, denied otherwise, and counted either way.
+func TestConfigMapOnSecretsPath(t *testing.T) {
+	for _, failOpen := range []bool{true, false} {
+		config := DefaultConfig()
+		config.FailOpen = failOpen
+		handler := newTestHandler(t, config)
+		unexpected := metrics.UnexpectedKinds.WithLabelValues(PathMutateSecrets, "ConfigMap", "false")
+		before := testutil.ToFloat64(unexpected)
+
+		response := reviewAt(t, handler, PathMutateSecrets, configMapReview(t))
+		message := "no handler for ConfigMap objects on " + PathMutateSecrets
+		if response.Allowed != failOpen || len(response.Patch) != 0 {
+			t.Errorf("fail open %v: allowed %v with patch %s", failOpen, response.Allowed, response.Patch)
+		}
+		if failOpen && (len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], message)) {
+			t.Errorf("warnings %q, want %q", response.Warnings, message)
+		}
+		if !failOpen && (response.Result == nil || response.Result.Code != http.StatusBadRequest || !strings.Contains(response.Result.Message, message)) {
+			t.Errorf("denied with %+v, want a 400 saying %q", response.Result, message)
+		}
+		if got := testutil.ToFloat64(unexpected) - before; got != 1 {
+			t.Errorf("%v unexpected kinds counted, want 1", got)
+		}
+	}
+}
+
+// Secrets are decoded with their data for the stages needing it, here the
+// bundle stage concatenating tls.crt and tls.key.
+func TestDecodeSecretWithData(t *testing.T) {
+	config := DefaultConfig()
+	config.Mutator.Stages = append(append([]string(nil), mutator.DefaultStages...), mutator.BundleStage)
+	handler := newTestHandler(t, config)
+
+	secret := FixtureSecret{Name: "tls", Namespace: "apps", DataSize: 16}.Build()
+	secret.Data[corev1.TLSCertKey] = []byte("-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n")
+	secret.Annotations[mutator.BundleAnnotationKey] = "true"
+	review, response := admitSecret(t, handler, secret)
+	patched := patchedSecret(t, review, response)
+	if len(patched.Data[mutator.BundleDataKey]) == 0 {
+		t.Fatalf("no %s written: data was not decoded", mutator.BundleDataKey)
+	}
+	if string(patched.Data[corev1.TLSPrivateKeyKey]) != string(secret.Data[corev1.TLSPrivateKeyKey]) {
+		t.Error("tls.key changed")
+	}
+}
+
+// Reviews are dispatched on the request's kind, and an object that isn't of
+// that kind is reported rather than decoded as garbage.
+func TestKindMismatch(t *testing.T) {
+	config := DefaultConfig()
+	config.Paths = []string{PathMutateSecrets, PathMutateConfigMaps, PathValidateSecrets}
+	handler := newTestHandler(t, config)
+	secret := FixtureSecret{Name: "tls", Namespace: "apps", DataSize: 16}
+
+	// a Secret request carrying a ConfigMap, and the other way round
+	configMapAsSecret := configMapReview(t)
+	configMapAsSecret.Request.Kind = metav1.GroupVersionKind{Version: "v1", Kind: "Secret"}
+	configMapAsSecret.Request.Resource.Resource = "secrets"
+	secretAsConfigMap := secretReview(t, "tls", "apps")
+	secretAsConfigMap.Request.Kind = metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	secretAsConfigMap.Request.Resource.Resource = "configmaps"
+	// a Secret of the configmaps resource
+	wrongResource := secretReview(t, "tls", "apps")
+	wrongResource.Request.Resource.Resource = "configmaps"
+	// an object not declaring its kind is taken as the request's
+	bare := secret.Build()
+	bare.TypeMeta = metav1.TypeMeta{}
+	untyped := objectReview(t, corev1.SchemeGroupVersion.WithKind("Secret"), "secrets", bare)
+
+	for _, tt := range []struct {
+		name    string
+		path    string
+		review  *v1beta1.AdmissionReview
+		allowed bool
+		patched bool
+		message string // in the warnings when allowed, the result otherwise
+		// counted as an unexpected kind, "true" when dispatched to the
+		// handler of the kind, "false" when none handles it
+		dispatched string
+	}{
+		{name: "ConfigMap on the secrets path", path: PathMutateSecrets, review: configMapReview(t), allowed: true, patched: true,
+			dispatched: "true"},
+		{name: "ConfigMap on the validating path", path: PathValidateSecrets, review: configMapReview(t), allowed: true,
+			message: "no handler for ConfigMap objects on " + PathValidateSecrets, dispatched: "false"},
+		{name: "Secret of the configmaps resource", path: PathMutateSecrets, review: wrongResource, allowed: true,
+			message: "no handler for Secret objects on " + PathMutateSecrets, dispatched: "false"},
+		{name: "ConfigMap object in a Secret request", path: PathMutateSecrets, review: configMapAsSecret,
+			message: "object of kind ConfigMap in a request for Secret"},
+		{name: "Secret object in a ConfigMap request", path: PathMutateConfigMaps, review: secretAsConfigMap,
+			message: "object of kind Secret in a request for ConfigMap"},
+		{name: "untyped object", path: PathMutateSecrets, review: untyped, allowed: true, patched: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			unexpected := metrics.UnexpectedKinds.WithLabelValues(tt.path, tt.review.Request.Kind.Kind, tt.dispatched)
+			before := testutil.ToFloat64(unexpected)
+			response := reviewAt(t, handler, tt.path, tt.review)
+			if response.Allowed != tt.allowed || (len(response.Patch) > 0) != tt.patched {
+				t.Errorf("allowed %v with patch %s, want allowed %v, patched %v", response.Allowed, response.Patch, tt.allowed, tt.patched)
+			}
+			got := strings.Join(response.Warnings, "\n")
+			if !tt.allowed && response.Result != nil {
+				got = response.Result.Message
+			}
+			if !strings.Contains(got, tt.message) {
+				t.Errorf("answered %q, want %q", got, tt.message)
+			}
+			if got := testutil.ToFloat64(unexpected) - before; tt.dispatched != "" && got != 1 {
+				t.Errorf("%v unexpected kinds counted, want 1", got)
+			}
+		})
+	}
+}
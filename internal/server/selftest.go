@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/go-logr/logr"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// selfTestResult is the body of a /selftest response.
+type selfTestResult struct {
+	Pass        bool              `json:"pass"`
+	Allowed     bool              `json:"allowed"`
+	Patched     bool              `json:"patched"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// SelfTestHandler backs /selftest. It sends a synthetic dry-run admission of
+// a cert-manager TLS secret through the admission handler, applies the patch
+// it gets back and checks that the sync annotation was set. Nothing is sent
+// to the cluster.
+type SelfTestHandler struct {
+	Log       logr.Logger
+	Admission http.Handler
+}
+
+func (h *SelfTestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result := h.run(r)
+	if !result.Pass {
+		h.Log.Info("Self-test failed", "error", result.Error, "annotations", result.Annotations)
+	}
+
+	resp, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Pass {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	_, _ = w.Write(resp)
+}
+
+func (h *SelfTestHandler) run(r *http.Request) selfTestResult {
+	secret := FixtureSecret{Name: "selftest-tls", Namespace: "selftest", DataSize: 8}.Build()
+	review, err := FixtureReview(secret, v1beta1.Create, true)
+	if err != nil {
+		return selfTestResult{Error: err.Error()}
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		return selfTestResult{Error: err.Error()}
+	}
+
+	rec := ServeLocal(r.Context(), h.Admission, body)
+	if rec.Code != http.StatusOK {
+		return selfTestResult{Error: fmt.Sprintf("admission handler answered %d: %s", rec.Code, rec.Body.String())}
+	}
+
+	var answer v1beta1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil {
+		return selfTestResult{Error: fmt.Sprintf("decoding response: %v", err)}
+	}
+	response := answer.Response
+	if response == nil {
+		return selfTestResult{Error: "response has no AdmissionResponse"}
+	}
+	result := selfTestResult{
+		Allowed:     response.Allowed,
+		Patched:     len(response.Patch) > 0,
+		Annotations: secret.Annotations,
+	}
+	if !response.Allowed {
+		if response.Result != nil {
+			result.Error = response.Result.Message
+		} else {
+			result.Error = "secret was not allowed"
+		}
+		return result
+	}
+	if !result.Patched {
+		result.Error = "no patch returned"
+		return result
+	}
+
+	mutated, err := ApplyPatch(review.Request.Object.Raw, response.Patch)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Annotations = mutated.Annotations
+	if _, ok := mutated.Annotations[syncAnnotationKey]; !ok {
+		result.Error = fmt.Sprintf("patched secret has no %s annotation", syncAnnotationKey)
+		return result
+	}
+	result.Pass = true
+	return result
+}
+
+// ServeLocal sends an AdmissionReview body through the admission handler
+// in-process, as the API server would over the network.
+func ServeLocal(ctx context.Context, admission http.Handler, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, PathMutateSecrets, bytes.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	rec := httptest.NewRecorder()
+	admission.ServeHTTP(rec, req)
+	return rec
+}
+
+// ApplyPatch applies a JSON patch from an AdmissionResponse to the raw
+// secret it was computed for.
+func ApplyPatch(raw, patchBytes []byte) (*corev1.Secret, error) {
+	patch, err := jsonpatch.DecodePatch(patchBytes)
+	if err != nil {
+		return nil, fmt.Errorf("decoding patch: %v", err)
+	}
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		return nil, fmt.Errorf("applying patch: %v", err)
+	}
+	var mutated corev1.Secret
+	if err := json.Unmarshal(patched, &mutated); err != nil {
+		return nil, fmt.Errorf("decoding patched secret: %v", err)
+	}
+	return &mutated, nil
+}
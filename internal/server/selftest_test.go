@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"k8s.io/api/admission/v1beta1"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// selfTest calls handler and returns the status and result.
+func selfTest(t *testing.T, handler http.Handler) (int, selfTestResult) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/selftest", nil))
+	var result selfTestResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("decoding %d %s: %v", rec.Code, rec.Body, err)
+	}
+	return rec.Code, result
+}
+
+// The self-test runs the live policy, and follows it through reloads
+// without a side effect on the cluster.
+func TestSelfTest(t *testing.T) {
+	events, fake := fakeEvents()
+	whsvr, err := NewWebhookServer(WithConfig(clusterConfig("blue")), WithEventRecorder(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &SelfTestHandler{Log: logr.Discard(), Admission: whsvr.Handler()}
+
+	code, result := selfTest(t, handler)
+	if code != http.StatusOK || !result.Pass || !result.Allowed || !result.Patched {
+		t.Fatalf("self-test answered %d %+v, want a pass", code, result)
+	}
+	if got := result.Annotations[syncAnnotationKey]; got != "env=blue" {
+		t.Errorf("%s = %q, want the live selector env=blue", syncAnnotationKey, got)
+	}
+
+	if err := whsvr.Reload(clusterConfig("green")); err != nil {
+		t.Fatal(err)
+	}
+	code, result = selfTest(t, handler)
+	if code != http.StatusOK || result.Annotations[syncAnnotationKey] != "env=green" {
+		t.Errorf("self-test answered %d %+v after the reload, want env=green", code, result)
+	}
+
+	// a policy that no longer annotates fails the self-test
+	config := clusterConfig("blue")
+	config.Mutator.Stages = []string{mutator.PolicyStage}
+	if err := whsvr.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	code, result = selfTest(t, handler)
+	if code != http.StatusInternalServerError || result.Pass || result.Error == "" {
+		t.Errorf("self-test answered %d %+v with no annotating stage, want a failure", code, result)
+	}
+
+	// the synthetic admission is a dry run
+	if got := recorded(fake); len(got) != 0 {
+		t.Errorf("self-test recorded events %v", got)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/selftest", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST answered %d, want 405", rec.Code)
+	}
+}
+
+func TestSelfTestFailures(t *testing.T) {
+	answer := func(code int, response *v1beta1.AdmissionResponse) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+			_ = json.NewEncoder(w).Encode(v1beta1.AdmissionReview{Response: response})
+		})
+	}
+	for name, admission := range map[string]http.Handler{
+		"handler error": answer(http.StatusInternalServerError, nil),
+		"no response":   answer(http.StatusOK, nil),
+		"denied":        answer(http.StatusOK, &v1beta1.AdmissionResponse{}),
+		"no patch":      answer(http.StatusOK, &v1beta1.AdmissionResponse{Allowed: true}),
+		"no annotation": answer(http.StatusOK, &v1beta1.AdmissionResponse{Allowed: true, Patch: []byte(`[]`)}),
+	} {
+		code, result := selfTest(t, &SelfTestHandler{Log: logr.Discard(), Admission: admission})
+		if code != http.StatusInternalServerError || result.Pass || result.Error == "" {
+			t.Errorf("%s: self-test answered %d %+v, want a failure", name, code, result)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveHTTP serves server on ln until the test ends.
+func serveHTTP(t *testing.T, server *http.Server, ln net.Listener) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(ln) }()
+	t.Cleanup(func() {
+		server.Close()
+		if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+}
+
+// serveWebhook serves whsvr on ln until the test ends.
+func serveWebhook(t *testing.T, whsvr *WebhookServer, ln net.Listener) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- whsvr.Serve(ln) }()
+	t.Cleanup(func() {
+		whsvr.server.Close()
+		if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Serve: %v", err)
+		}
+		whsvr.Close()
+	})
+}
+
+// listenLocal returns a listener on a random loopback port.
+func listenLocal(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+// A client sending its request too slowly is disconnected once the
+// configured deadline passes, not left holding a goroutine.
+func TestSlowClientTimeouts(t *testing.T) {
+	const deadline = 200 * time.Millisecond
+	tests := map[string]struct {
+		server *http.Server
+		send   string // written at once, the rest of the request never comes
+	}{
+		"header": {
+			server: &http.Server{ReadHeaderTimeout: deadline, ReadTimeout: time.Minute},
+			send:   "POST /mutate HTTP/1.1\r\nHost: webhook\r\n",
+		},
+		"body": {
+			server: &http.Server{ReadHeaderTimeout: time.Minute, ReadTimeout: deadline},
+			send: "POST /mutate HTTP/1.1\r\nHost: webhook\r\n" +
+				"Content-Type: application/json\r\nContent-Length: 1024\r\n\r\n{\"kind\":",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			whsvr := newDefaultServer()
+			mux := http.NewServeMux()
+			mux.HandleFunc("/mutate", whsvr.serve)
+			tt.server.Handler = mux
+			ln := listenLocal(t)
+			serveHTTP(t, tt.server, ln)
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			start := time.Now()
+			if _, err := io.WriteString(conn, tt.send); err != nil {
+				t.Fatal(err)
+			}
+			// the server may answer 408 or 400 before closing; what
+			// matters is that it closes
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.Copy(io.Discard, conn); err != nil {
+				t.Fatalf("connection not closed by the server: %v", err)
+			}
+			elapsed := time.Since(start)
+			// the deadline runs from the accept, a little before start
+			if elapsed < deadline/2 || elapsed > deadline+2*time.Second {
+				t.Errorf("connection closed after %v, want about %v", elapsed, deadline)
+			}
+		})
+	}
+}
+
+// The admission listener serves the admission paths only: the operational
+// endpoints are on the ops listener.
+func TestAdmissionHandlerOnlyAdmissions(t *testing.T) {
+	handler := newTestHandler(t, DefaultConfig())
+	for _, path := range []string{"/metrics", "/Healthz", "/readyz", "/debug/pprof/", "/debug/loglevel", "/debug/config", "/decisions", "/stats"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("admission handler answered %d on %s, want 404", rec.Code, path)
+		}
+	}
+}
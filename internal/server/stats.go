@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// defaultStatsTopN is how many namespaces /stats lists by default.
+const defaultStatsTopN = 10
+
+// statsResponse is the body of a /stats response.
+type statsResponse struct {
+	metrics.Summary
+	Backend string `json:"backend"`
+}
+
+// StatsHandler backs /stats, a JSON summary of the activity since start
+// for quick inspection. ?top=N sets how many namespaces are listed.
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	topN := defaultStatsTopN
+	if value := r.URL.Query().Get("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid top", http.StatusBadRequest)
+			return
+		}
+		topN = n
+	}
+
+	resp, err := json.MarshalIndent(statsResponse{
+		Summary: metrics.Summarize(topN),
+		Backend: "kubed",
+	}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(resp)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// fetchStats calls StatsHandler with query and decodes the answer.
+func fetchStats(t *testing.T, query string) statsResponse {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	StatsHandler(rec, httptest.NewRequest(http.MethodGet, "/stats"+query, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/stats answered %d: %s", rec.Code, rec.Body)
+	}
+	var stats statsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+// mutations returns the count of namespace in stats, 0 when not listed.
+func mutations(stats statsResponse, namespace string) uint64 {
+	for _, count := range stats.TopMutated {
+		if count.Namespace == namespace {
+			return count.Mutations
+		}
+	}
+	return 0
+}
+
+// The summary adds up the admissions as the metrics count them. The
+// accounting is process wide, so only the changes are compared.
+func TestStatsAggregation(t *testing.T) {
+	whsvr := newDefaultServer()
+	mutatedMetric := metrics.Requests.WithLabelValues("/mutate", string(v1beta1.Create), metrics.ResultMutated)
+	before, metricBefore := fetchStats(t, "?top=1000"), testutil.ToFloat64(mutatedMetric)
+
+	for _, secret := range []struct{ name, namespace string }{
+		{"a", "stats-busy"},
+		{"b", "stats-busy"},
+		{"c", "stats-busy"},
+		{"d", "stats-quiet"},
+		{"e", metav1.NamespaceSystem},
+	} {
+		admit(t, whsvr, secretReview(t, secret.name, secret.namespace))
+	}
+	broken := secretReview(t, "broken", "stats-busy")
+	broken.Request.Object.Raw = []byte(`{"apiVersion":"v1","kind":"Secret","metadata":"broken"}`)
+	admit(t, whsvr, broken)
+	if err := whsvr.Reload(whsvr.config); err != nil {
+		t.Fatal(err)
+	}
+
+	after := fetchStats(t, "?top=1000")
+	delta := func(counts map[string]uint64, key string) uint64 {
+		return counts[key] - before.Requests[key]
+	}
+	if got := delta(after.Requests, metrics.ResultMutated); got != 4 {
+		t.Errorf("%d more mutated requests, want 4", got)
+	}
+	if got := delta(after.Requests, metrics.ResultSkipped); got != 1 {
+		t.Errorf("%d more skipped requests, want 1", got)
+	}
+	if got := delta(after.Requests, metrics.ResultErrored); got != 1 {
+		t.Errorf("%d more errored requests, want 1", got)
+	}
+	if got, metric := delta(after.Requests, metrics.ResultMutated), testutil.ToFloat64(mutatedMetric)-metricBefore; float64(got) != metric {
+		t.Errorf("/stats counted %d mutations, the metrics %v", got, metric)
+	}
+	if got := mutations(after, "stats-busy") - mutations(before, "stats-busy"); got != 3 {
+		t.Errorf("%d more mutations in stats-busy, want 3", got)
+	}
+	if got := mutations(after, "stats-quiet") - mutations(before, "stats-quiet"); got != 1 {
+		t.Errorf("%d more mutations in stats-quiet, want 1", got)
+	}
+	if after.SkipReasons[skipIgnoredNamespace]-before.SkipReasons[skipIgnoredNamespace] != 1 {
+		t.Errorf("skip reasons %v, want one more %s", after.SkipReasons, skipIgnoredNamespace)
+	}
+	if after.LastError == nil || !strings.Contains(after.LastError.Message, "cannot unmarshal") ||
+		time.Since(after.LastError.Time) > time.Minute {
+		t.Errorf("last error %+v, want the broken secret's", after.LastError)
+	}
+	if got := after.Generation - before.Generation; got != 1 {
+		t.Errorf("config generation went up by %d on a reload, want 1", got)
+	}
+	if float64(after.Generation) != testutil.ToFloat64(metrics.ConfigGeneration) {
+		t.Errorf("config generation %d, metric %v", after.Generation, testutil.ToFloat64(metrics.ConfigGeneration))
+	}
+	if after.Backend == "" || after.Uptime == "" {
+		t.Errorf("no backend or uptime: %+v", after)
+	}
+
+	// the busiest namespaces come first
+	top := fetchStats(t, "?top=1")
+	if len(top.TopMutated) != 1 || top.TopMutated[0].Mutations < mutations(after, "stats-busy") {
+		t.Errorf("top namespace %v, want one at least as busy as stats-busy", top.TopMutated)
+	}
+	rec := httptest.NewRecorder()
+	StatsHandler(rec, httptest.NewRequest(http.MethodGet, "/stats?top=-1", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid top answered %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// statusKey is the ConfigMap key holding the status document.
+	statusKey = "status.json"
+	// statusRecentDecisions is the number of recent decisions kept.
+	statusRecentDecisions = 50
+)
+
+// statusDecision is one recent decision of the status document, without
+// anything of the secret but its name.
+type statusDecision struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Decision  string    `json:"decision"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// statusDocument is the content of the status ConfigMap.
+type statusDocument struct {
+	Replica    string           `json:"replica"`
+	Version    string           `json:"version"`
+	ConfigHash string           `json:"configHash"`
+	Updated    time.Time        `json:"updated"`
+	Counts     map[string]int64 `json:"counts"` // decisions by outcome
+	Recent     []statusDecision `json:"recent"` // newest first
+}
+
+// StatusReporter keeps a ConfigMap describing the webhook's recent work for
+// dashboards that can't scrape Prometheus: the decisions by outcome, the
+// last ones, the hash of the active policy and the binary's version. Every
+// replica accounts the decisions it makes; the leader writes its own every
+// interval, when they changed, so the ConfigMap shows the replica holding
+// the Lease. A nil reporter accounts nothing.
+type StatusReporter struct {
+	log       logr.Logger
+	client    kubernetes.Interface
+	whsvr     *WebhookServer
+	name      string // of the ConfigMap
+	namespace string // of the ConfigMap
+	identity  string // of the replica
+	interval  time.Duration
+
+	mu      sync.Mutex
+	counts  map[string]int64
+	recent  []statusDecision // ring of statusRecentDecisions
+	next    int              // index of the next decision in recent
+	changed bool             // since the last write
+}
+
+// NewStatusReporter returns a reporter of the replica identity writing the
+// ConfigMap name in namespace every interval. whsvr must be given it with
+// WithStatusReporter.
+func NewStatusReporter(log logr.Logger, client kubernetes.Interface, namespace, name, identity string, interval time.Duration) *StatusReporter {
+	return &StatusReporter{
+		log:       log,
+		client:    client,
+		name:      name,
+		namespace: namespace,
+		identity:  identity,
+		interval:  interval,
+		counts:    map[string]int64{},
+		recent:    make([]statusDecision, 0, statusRecentDecisions),
+		changed:   true,
+	}
+}
+
+// observe accounts a decision.
+func (s *StatusReporter) observe(entry auditEntry) {
+	if s == nil {
+		return
+	}
+	decision := statusDecision{Namespace: entry.Namespace, Name: entry.Name, Decision: entry.Decision, Timestamp: entry.Timestamp}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[entry.Decision]++
+	if len(s.recent) < statusRecentDecisions {
+		s.recent = append(s.recent, decision)
+	} else {
+		s.recent[s.next] = decision
+	}
+	s.next = (s.next + 1) % statusRecentDecisions
+	s.changed = true
+}
+
+// document returns the status to write and whether it changed since the
+// last write.
+func (s *StatusReporter) document() (statusDocument, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc := statusDocument{
+		Replica: s.identity,
+		Version: buildVersion(),
+		Updated: time.Now().UTC(),
+		Counts:  make(map[string]int64, len(s.counts)),
+		Recent:  make([]statusDecision, 0, len(s.recent)),
+	}
+	for outcome, count := range s.counts {
+		doc.Counts[outcome] = count
+	}
+	for i := 1; i <= len(s.recent); i++ {
+		doc.Recent = append(doc.Recent, s.recent[(s.next-i+statusRecentDecisions)%statusRecentDecisions])
+	}
+	if p := s.whsvr.policy.Load(); p != nil {
+		doc.ConfigHash = configHash(p.config)
+	}
+	changed := s.changed
+	s.changed = false
+	return doc, changed
+}
+
+// Stopped makes the next term start with a write.
+func (s *StatusReporter) Stopped() {
+	s.mu.Lock()
+	s.changed = true
+	s.mu.Unlock()
+}
+
+// Lead writes the ConfigMap every interval until ctx is done.
+func (s *StatusReporter) Lead(ctx context.Context) {
+	s.log.Info("Writing the status", "configMap", s.name, "interval", s.interval.String())
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if doc, changed := s.document(); changed {
+			if err := s.store(ctx, doc); err != nil && ctx.Err() == nil {
+				s.log.Error(err, "Failed to write the status", "configMap", s.name)
+				s.mu.Lock()
+				s.changed = true
+				s.mu.Unlock()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// store writes doc to the ConfigMap, creating it when missing and reading
+// it again when it was changed since it was read.
+func (s *StatusReporter) store(ctx context.Context, doc statusDocument) error {
+	content, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	configMaps := s.client.CoreV1().ConfigMaps(s.namespace)
+	return withRetry(ctx, opStatus, nil, func(ctx context.Context) error {
+		cm, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace,
+					Labels: map[string]string{"app.kubernetes.io/managed-by": "cert-manager-webhook"}},
+				Data: map[string]string{statusKey: string(content)},
+			}
+			_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// created meanwhile, update it on the retry
+				return apierrors.NewConflict(corev1.Resource("configmaps"), s.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[statusKey] = string(content)
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// configHash identifies config, so that replicas deciding by different
+// settings can be told apart.
+func configHash(config Config) string {
+	content, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:8])
+}
+
+// buildVersion returns the version the binary was built from, its module
+// version or else its VCS revision.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return info.Main.Version
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// readStatus returns the status document of the ConfigMap, with its
+// decisions decoded as generic objects so the test sees the fields
+// written, or false when it isn't there yet.
+func readStatus(t *testing.T, client *fake.Clientset) (statusDocument, []map[string]any, bool) {
+	t.Helper()
+	cm, err := client.CoreV1().ConfigMaps("cert-manager").Get(context.Background(), "webhook-status", metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return statusDocument{}, nil, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc statusDocument
+	var generic struct {
+		Recent []map[string]any `json:"recent"`
+	}
+	if err := json.Unmarshal([]byte(cm.Data[statusKey]), &doc); err != nil {
+		t.Fatalf("status %q: %v", cm.Data[statusKey], err)
+	}
+	if err := json.Unmarshal([]byte(cm.Data[statusKey]), &generic); err != nil {
+		t.Fatal(err)
+	}
+	return doc, generic.Recent, true
+}
+
+// The leader writes the decisions accounted through the handler to the
+// ConfigMap: the counts by outcome, the last 50 decisions newest first with
+// nothing of the secrets but their names, the config hash and the version.
+// It writes only when they changed, and retries on conflicts.
+func TestStatusReporter(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	var updates, conflicts atomic.Int32
+	client.PrependReactor("update", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if updates.Add(1) == 1 {
+			conflicts.Add(1)
+			return true, nil, apierrors.NewConflict(corev1.Resource("configmaps"), "webhook-status", fmt.Errorf("changed meanwhile"))
+		}
+		return false, nil, nil
+	})
+	reporter := NewStatusReporter(logr.Discard(), client, "cert-manager", "webhook-status", "webhook-0", 20*time.Millisecond)
+	config := DefaultConfig()
+	handler := newTestHandler(t, config, WithStatusReporter(reporter))
+
+	for i := range 55 {
+		admitSecret(t, handler, FixtureSecret{Name: fmt.Sprintf("tls-%02d", i), Namespace: "apps", DataSize: 16}.Build())
+	}
+	for i := range 5 {
+		admitSecret(t, handler, FixtureSecret{Name: fmt.Sprintf("system-%d", i), Namespace: metav1.NamespaceSystem, DataSize: 16}.Build())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		reporter.Lead(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var doc statusDocument
+	var recent []map[string]any
+	waitFor(t, func() bool {
+		var ok bool
+		doc, recent, ok = readStatus(t, client)
+		return ok
+	})
+	if doc.Counts[decisionMutated] != 55 || doc.Counts[decisionSkipped] != 5 || len(doc.Counts) != 2 {
+		t.Errorf("counts %v, want 55 mutated and 5 skipped", doc.Counts)
+	}
+	if len(doc.Recent) != statusRecentDecisions {
+		t.Fatalf("%d recent decisions, want %d", len(doc.Recent), statusRecentDecisions)
+	}
+	if first, last := doc.Recent[0], doc.Recent[len(doc.Recent)-1]; first.Name != "system-4" || first.Decision != decisionSkipped ||
+		first.Namespace != metav1.NamespaceSystem || last.Name != "tls-10" || first.Timestamp.Before(last.Timestamp) {
+		t.Errorf("recent decisions from %+v to %+v, want system-4 to tls-10", first, last)
+	}
+	for _, decision := range recent {
+		if len(decision) != 4 {
+			t.Errorf("recent decision written with fields %v, want namespace, name, decision and timestamp", decision)
+			break
+		}
+	}
+	if doc.Replica != "webhook-0" || doc.Version == "" || doc.ConfigHash != configHash(config) {
+		t.Errorf("status of replica %q, version %q, config hash %q", doc.Replica, doc.Version, doc.ConfigHash)
+	}
+
+	// no write while nothing changes
+	written := len(client.Actions())
+	time.Sleep(100 * time.Millisecond)
+	if got := len(client.Actions()) - written; got != 0 {
+		t.Errorf("%d writes without a decision", got)
+	}
+
+	// a decision is written on the next tick, through a conflict
+	admitSecret(t, handler, FixtureSecret{Name: "new-tls", Namespace: "apps", DataSize: 16}.Build())
+	waitFor(t, func() bool {
+		doc, _, _ = readStatus(t, client)
+		return doc.Counts[decisionMutated] == 56
+	})
+	if doc.Recent[0].Name != "new-tls" || conflicts.Load() != 1 {
+		t.Errorf("newest decision %+v after %d conflicts", doc.Recent[0], conflicts.Load())
+	}
+
+	cm, err := client.CoreV1().ConfigMaps("cert-manager").Get(context.Background(), "webhook-status", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := cm.Data[statusKey]; strings.Contains(content, strings.Repeat("c", 16)) || strings.Contains(content, "fixture-issuer") {
+		t.Errorf("status holds secret content: %s", content)
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed key pair for commonName, valid for
+// validity, to certFile and keyFile, stamping both with modTime.
+func writeKeyPair(t *testing.T, certFile, keyFile, commonName string, validity time.Duration, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(validity),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key goes first, so a reload between the writes sees a mismatched
+	// pair rather than a stale one
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})},
+		{certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})},
+	}
+	for _, file := range files {
+		if err := os.WriteFile(file.name, file.data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file.name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func keyPairFiles(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	return filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+}
+
+// servedCommonName returns the common name of the certificate whsvr serves.
+func servedCommonName(t *testing.T, whsvr *WebhookServer) string {
+	t.Helper()
+	cert, err := whsvr.server.TLSConfig.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestNewWebhookServerFromParametersReloadsKeyPair(t *testing.T) {
+	interval := tlsFilesReloadInterval
+	tlsFilesReloadInterval = 10 * time.Millisecond
+	t.Cleanup(func() { tlsFilesReloadInterval = interval })
+
+	certFile, keyFile := keyPairFiles(t)
+	issued := time.Now().Add(-time.Hour)
+	writeKeyPair(t, certFile, keyFile, "before-rotation", time.Hour, issued)
+
+	whsvr, err := NewWebhookServerFromParameters(WhSvrParameters{Port: 8443, CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer whsvr.Close()
+	if whsvr.server.Addr != ":8443" {
+		t.Errorf("listening on %q, want :8443", whsvr.server.Addr)
+	}
+	if got := servedCommonName(t, whsvr); got != "before-rotation" {
+		t.Fatalf("serving %q, want the initial certificate", got)
+	}
+
+	writeKeyPair(t, certFile, keyFile, "after-rotation", time.Hour, issued.Add(time.Minute))
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCommonName(t, whsvr) != "after-rotation" {
+		if time.Now().After(deadline) {
+			t.Fatal("rotated certificate not picked up")
+		}
+		time.Sleep(tlsFilesReloadInterval)
+	}
+}
+
+func TestNewWebhookServerFromParametersMissingFiles(t *testing.T) {
+	certFile, keyFile := keyPairFiles(t)
+	params := WhSvrParameters{Port: 8443, CertFile: certFile, KeyFile: keyFile}
+	if _, err := NewWebhookServerFromParameters(params); err == nil {
+		t.Error("NewWebhookServerFromParameters accepted missing key pair files")
+	}
+}
+
+// The key pair logs with the server's logger, whatever the order of the
+// options.
+func TestWithTLSFromFilesLogger(t *testing.T) {
+	certFile, keyFile := keyPairFiles(t)
+	writeKeyPair(t, certFile, keyFile, "webhook", time.Hour, time.Now())
+	log, logged := bufferLogger()
+	whsvr, err := NewWebhookServer(WithTLSFromFiles(certFile, keyFile), WithLogger(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer whsvr.Close()
+	if !strings.Contains(logged.String(), "Loaded serving certificate") {
+		t.Errorf("key pair not logged with the server's logger: %s", logged)
+	}
+}
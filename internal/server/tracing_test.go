@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/api/admission/v1beta1"
+)
+
+var (
+	spansOnce sync.Once
+	spans     *tracetest.SpanRecorder
+)
+
+// recordSpans installs a tracer provider recording in memory. The global
+// provider is only delegated to once, so all tests share the recorder and
+// tell their spans apart by trace ID.
+func recordSpans() *tracetest.SpanRecorder {
+	spansOnce.Do(func() {
+		spans = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+			sdktrace.WithSpanProcessor(spans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return spans
+}
+
+// tracedAdmission sends a review of a secret to handler under the
+// traceparent given, and returns the spans of that trace.
+func tracedAdmission(t *testing.T, handler http.Handler, traceparent string) []sdktrace.ReadOnlySpan {
+	t.Helper()
+	recorder := recordSpans()
+	body, err := json.Marshal(secretReview(t, "tls", "apps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", traceparent)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("handler answered %d: %s", rec.Code, rec.Body)
+	}
+
+	parent := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(),
+		propagation.HeaderCarrier(req.Header)))
+	var traced []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == parent.TraceID() {
+			traced = append(traced, span)
+		}
+	}
+	return traced
+}
+
+// An admission continues the API server's trace in a span with a child
+// per phase, tagged with what was decided.
+func TestTracingSpans(t *testing.T) {
+	handler := http.HandlerFunc(newDefaultServer().serve)
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	traced := tracedAdmission(t, handler, "00-"+traceID+"-"+parentID+"-01")
+
+	var root sdktrace.ReadOnlySpan
+	for _, span := range traced {
+		if span.Name() == "admission" {
+			root = span
+		}
+	}
+	if root == nil {
+		t.Fatalf("no admission span in %d spans of the trace", len(traced))
+	}
+	if got := root.Parent().SpanID().String(); got != parentID {
+		t.Errorf("admission span parent %s, want the API server's %s", got, parentID)
+	}
+	if root.SpanKind() != trace.SpanKindServer {
+		t.Errorf("admission span kind %v, want server", root.SpanKind())
+	}
+	attributes := map[string]string{}
+	for _, kv := range root.Attributes() {
+		attributes[string(kv.Key)] = kv.Value.Emit()
+	}
+	for key, want := range map[string]string{
+		"admission.namespace": "apps",
+		"admission.name":      "tls",
+		"admission.operation": string(v1beta1.Create),
+		"admission.decision":  "mutated",
+		"http.route":          "/mutate",
+	} {
+		if attributes[key] != want {
+			t.Errorf("%s = %q, want %q", key, attributes[key], want)
+		}
+	}
+	if _, ok := attributes["admission.rule"]; !ok {
+		t.Errorf("no matched rule: %v", attributes)
+	}
+
+	children := map[string]bool{}
+	for _, span := range traced {
+		if span.Parent().SpanID() == root.SpanContext().SpanID() {
+			children[span.Name()] = true
+		}
+	}
+	for _, phase := range []string{"decode", "policy", "patch"} {
+		if !children[phase] {
+			t.Errorf("no %s child span, got %v", phase, children)
+		}
+	}
+}
+
+// An admission the API server didn't sample gets no spans, for its phases
+// neither.
+func TestTracingUnsampled(t *testing.T) {
+	handler := http.HandlerFunc(newDefaultServer().serve)
+	traced := tracedAdmission(t, handler, "00-5bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if len(traced) != 0 {
+		names := make([]string, 0, len(traced))
+		for _, span := range traced {
+			names = append(names, span.Name())
+		}
+		t.Errorf("spans recorded for an unsampled admission: %v", names)
+	}
+}
+
+func TestInitTracing(t *testing.T) {
+	shutdown, err := InitTracing(context.Background(), "", 2)
+	if err != nil {
+		t.Fatalf("disabled tracing: %v", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown of disabled tracing: %v", err)
+	}
+	for _, rate := range []float64{-0.1, 1.5} {
+		if _, err := InitTracing(context.Background(), "http://127.0.0.1:4318", rate); err == nil {
+			t.Errorf("sample rate %v accepted", rate)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/go-logr/logr"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// verifyResultOp labels verification failures of patches that apply but
+// leave the object without the expected annotations, or unreadable.
+const verifyResultOp = "result"
+
+// PatchVerificationError is a generated patch the API server would not
+// apply, or whose result isn't the object intended.
+type PatchVerificationError struct {
+	// Op is the operation of the first patch operation that doesn't apply,
+	// or "result" when the patch applies but the result is wrong.
+	Op string
+	// Path is the path of that operation, empty for the result.
+	Path string
+	Err  error
+}
+
+func (e *PatchVerificationError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("patch verification: %v", e.Err)
+	}
+	return fmt.Sprintf("patch verification: %s %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *PatchVerificationError) Unwrap() error {
+	return e.Err
+}
+
+// verifyPatch applies patchBytes to the object of req the way the API
+// server will, and has check inspect the patched object. It is a no-op when
+// verification is turned off. Failures are counted by the operation at
+// fault.
+func (whsvr *WebhookServer) verifyPatch(p *policy, req *v1beta1.AdmissionRequest, patchBytes []byte, check func(patched []byte) error) error {
+	if p.config.SkipPatchVerification {
+		return nil
+	}
+	err := applyAndCheck(req.Object.Raw, patchBytes, check)
+	var verifyErr *PatchVerificationError
+	if errors.As(err, &verifyErr) {
+		metrics.PatchVerificationFailures.WithLabelValues(verifyErr.Op).Inc()
+	}
+	return err
+}
+
+func applyAndCheck(raw, patchBytes []byte, check func(patched []byte) error) error {
+	patch, err := jsonpatch.DecodePatch(patchBytes)
+	if err != nil {
+		return &PatchVerificationError{Op: verifyResultOp, Err: fmt.Errorf("decoding patch: %w", err)}
+	}
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		return offendingOperation(raw, patch, err)
+	}
+	if err := check(patched); err != nil {
+		return &PatchVerificationError{Op: verifyResultOp, Err: err}
+	}
+	return nil
+}
+
+// offendingOperation finds the first operation of patch that fails on raw,
+// applying them one by one; patches only take that long when broken.
+func offendingOperation(raw []byte, patch jsonpatch.Patch, err error) error {
+	doc := raw
+	for _, op := range patch {
+		next, opErr := jsonpatch.Patch{op}.Apply(doc)
+		if opErr != nil {
+			path, _ := op.Path()
+			return &PatchVerificationError{Op: op.Kind(), Path: path, Err: opErr}
+		}
+		doc = next
+	}
+	return &PatchVerificationError{Op: verifyResultOp, Err: err}
+}
+
+// expectAnnotations returns a check that the patched object decodes into
+// obj and that annotations(obj) holds the expected values.
+func expectAnnotations[T any](expected map[string]string, annotations func(*T) map[string]string) func([]byte) error {
+	return func(patched []byte) error {
+		var obj T
+		if err := json.Unmarshal(patched, &obj); err != nil {
+			return fmt.Errorf("decoding the patched object: %w", err)
+		}
+		actual := annotations(&obj)
+		for _, key := range slices.Sorted(maps.Keys(expected)) {
+			if value, ok := actual[key]; !ok || value != expected[key] {
+				return fmt.Errorf("patched object has %s=%q, want %q", key, value, expected[key])
+			}
+		}
+		return nil
+	}
+}
+
+// secretAnnotations are the annotations of a patched secret.
+func secretAnnotations(secret *mutator.SecretMetadata) map[string]string {
+	return secret.Annotations
+}
+
+// verificationFailed answers an admission whose patch failed verification
+// per the failure policy: admitted unpatched, or rejected.
+func (whsvr *WebhookServer) verificationFailed(log logr.Logger, req *v1beta1.AdmissionRequest, name string, entry auditEntry, err error) (*v1beta1.AdmissionResponse, string) {
+	log.Error(err, "Generated patch failed verification", "failOpen", whsvr.failOpen)
+	whsvr.observeError(err)
+	entry.Decision = decisionError
+	entry.Error = err.Error()
+	whsvr.recordDecision(entry)
+	whsvr.events.record(req, name, corev1.EventTypeWarning, eventError, "Generated patch failed verification: %v", err)
+	return failureResponse(whsvr.failOpen, http.StatusInternalServerError, metav1.StatusReasonInternalError,
+		"generated patch failed verification: "+err.Error()), metrics.ResultErrored
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// brokenStage is a test stage returning the broken patch its secret is
+// named after.
+const brokenStage = "test-broken"
+
+func init() {
+	mutator.Register(brokenStage, func(mutator.Config, json.RawMessage) (mutator.Stage, error) {
+		return mutator.StageFunc(func(_ context.Context, obj mutator.AdmissionContext, decision *mutator.Decision) ([]mutator.PatchOperation, error) {
+			switch obj.Secret.Name {
+			case "remove-missing":
+				return []mutator.PatchOperation{{Op: "remove", Path: "/metadata/finalizers/0"}}, nil
+			case "test-failing":
+				return []mutator.PatchOperation{{Op: "test", Path: "/metadata/name", Value: "other"}}, nil
+			case "unescaped":
+				return []mutator.PatchOperation{{Op: "add", Path: "/metadata/ownerReferences/example.com/owner", Value: "x"}}, nil
+			case "unreadable":
+				return []mutator.PatchOperation{{Op: "add", Path: "/immutable", Value: "yes"}}, nil
+			case "annotation-missing":
+				decision.Annotations["example.com/verified"] = "true"
+			}
+			return nil, nil
+		}), nil
+	})
+}
+
+// A patch that doesn't apply, or leaves the secret without the annotations
+// decided, is answered per the failure policy and counted by the operation
+// at fault; without verification it goes out as it is.
+func TestPatchVerification(t *testing.T) {
+	for _, tt := range []struct {
+		secret string
+		op     string
+		err    string
+	}{
+		{secret: "remove-missing", op: "remove", err: "/metadata/finalizers/0"},
+		{secret: "test-failing", op: "test", err: "/metadata/name"},
+		{secret: "unescaped", op: "add", err: "/metadata/ownerReferences/example.com/owner"},
+		{secret: "unreadable", op: verifyResultOp, err: "decoding the patched object"},
+		{secret: "annotation-missing", op: verifyResultOp, err: "example.com/verified"},
+	} {
+		t.Run(tt.secret, func(t *testing.T) {
+			failures := metrics.PatchVerificationFailures.WithLabelValues(tt.op)
+			for _, failOpen := range []bool{true, false} {
+				config := DefaultConfig()
+				config.FailOpen = failOpen
+				config.Mutator.Stages = []string{mutator.PolicyStage, brokenStage, mutator.SyncAnnotationStage}
+				before := testutil.ToFloat64(failures)
+				_, response := admitSecret(t, newTestHandler(t, config), FixtureSecret{Name: tt.secret, Namespace: "apps", DataSize: 16}.Build())
+				if response.Allowed != failOpen || len(response.Patch) != 0 {
+					t.Errorf("fail open %v: allowed %v with patch %s", failOpen, response.Allowed, response.Patch)
+				}
+				if !failOpen && (response.Result == nil || !strings.Contains(response.Result.Message, tt.err)) {
+					t.Errorf("denied with %+v, want the error on %s", response.Result, tt.err)
+				}
+				if got := testutil.ToFloat64(failures) - before; got != 1 {
+					t.Errorf("fail open %v: %v failures counted for %s, want 1", failOpen, got, tt.op)
+				}
+			}
+
+			config := DefaultConfig()
+			config.SkipPatchVerification = true
+			config.Mutator.Stages = []string{mutator.PolicyStage, brokenStage, mutator.SyncAnnotationStage}
+			before := testutil.ToFloat64(failures)
+			if _, response := admitSecret(t, newTestHandler(t, config), FixtureSecret{Name: tt.secret, Namespace: "apps", DataSize: 16}.Build()); !response.Allowed || len(response.Patch) == 0 {
+				t.Errorf("unverified: allowed %v with patch %s, want the patch", response.Allowed, response.Patch)
+			}
+			if testutil.ToFloat64(failures) != before {
+				t.Error("failure counted without verification")
+			}
+		})
+	}
+
+	// and a sound patch passes
+	config := DefaultConfig()
+	config.FailOpen = false
+	config.Mutator.Stages = []string{mutator.PolicyStage, brokenStage, mutator.SyncAnnotationStage}
+	review, response := admitSecret(t, newTestHandler(t, config), FixtureSecret{Name: "sound", Namespace: "apps", DataSize: 16}.Build())
+	if patched := patchedSecret(t, review, response); patched.Annotations[mutator.SyncAnnotationKey] != "true" {
+		t.Errorf("sound patch gave annotations %v", patched.Annotations)
+	}
+}
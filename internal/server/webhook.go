@@ -0,0 +1,585 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/clock"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+const (
+	syncAnnotationKey        = mutator.SyncAnnotationKey
+	certManagerAnnotationKey = mutator.CertManagerAnnotationKey
+)
+
+type WebhookServer struct {
+	server          *http.Server
+	log             logr.Logger
+	maxBodyBytes    int64                  // limit on the (decompressed) request body size
+	limiter         *RateLimiter           // optional admission rate limiter
+	rateLimitStrict bool                   // reject over-limit requests with 429 instead of allowing them unpatched
+	audit           *AuditLogger           // optional audit trail of admission decisions
+	events          *EventRecorder         // optional Kubernetes Events on handled secrets
+	status          *StatusReporter        // optional status ConfigMap of recent decisions
+	recent          *RecentDecisions       // optional buffer of the last decisions for /decisions
+	concurrency     *ConcurrencyLimiter    // optional cap on concurrent evaluations
+	failOpen        bool                   // allow admissions the webhook can't evaluate
+	sampler         *DecisionSampler       // optional sampling of routine decision logs
+	decisions       *DecisionCache         // optional answers to recent admissions, for retries
+	slowThreshold   time.Duration          // warn about admissions taking longer, 0 disables
+	recorder        *RequestRecorder       // optional fixtures of incoming requests
+	faults          *FaultInjector         // optional injected latency and errors
+	downstream      *DownstreamWebhook     // optional webhook whose patch is merged after ours
+	reports         *ErrorReporter         // optional reports of panics and repeated errors
+	informers       *informerCache         // caches of the cluster objects stages read, nil when none do
+	accessLog       *logr.Logger           // optional log line per request
+	accessLogSample uint64                 // log one in every N successful requests
+	routes          []Route                // enabled admission paths
+	config          Config                 // settings the server was built with
+	policy          atomic.Pointer[policy] // settings admissions are decided by, swapped by Reload
+	clock           clock.PassiveClock     // times and rate limits admissions
+	optionErrors    []error                // failures of options, reported by NewWebhookServer
+	certFile        string                 // key pair of WithTLSFromFiles, loaded by NewWebhookServer
+	keyFile         string
+	closed          chan struct{}          // closed by Close, stops the key pair watch
+	closeOnce       sync.Once
+	inFlight        atomic.Int64           // admission requests currently being served
+	freezeWindow    atomic.Pointer[string] // freeze window admissions were last found in, empty outside
+}
+
+// InFlight returns the number of admission requests currently being served.
+func (whsvr *WebhookServer) InFlight() int64 {
+	return whsvr.inFlight.Load()
+}
+
+// WhSvrParameters are the parameters of NewWebhookServerFromParameters.
+type WhSvrParameters struct {
+	Port           int    // webhook server port
+	CertFile       string // path to the x509 certificate for https
+	KeyFile        string // path to the x509 private key matching CertFile
+	SidecarCfgFile string // path to sidecar injector configuration file, ignored
+}
+
+// Reasons a secret is admitted without being mutated.
+const (
+	skipIgnoredNamespace = mutator.SkipIgnoredNamespace
+	skipNotTLS           = mutator.SkipNotTLS
+	skipReplica          = mutator.SkipReplica
+	skipRateLimited      = "rate-limited"
+	skipLoadShed         = "load-shed"
+)
+
+// main mutation process, returning the response and its metrics result
+func (whsvr *WebhookServer) mutate(ctx context.Context, p *policy, ar *v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, string) {
+	req := ar.Request
+	requestID := requestIDFrom(ctx)
+
+	span := trace.SpanFromContext(ctx)
+
+	decodeSpan := startPhase(ctx, phaseDecode)
+	secret, err := whsvr.decodeSecret(p, req)
+	decodeSpan.End()
+	if err != nil {
+		return whsvr.decodeFailed(ctx, req, err)
+	}
+
+	// the name is only set on the object for generated names
+	if req.Name == "" {
+		span.SetAttributes(attribute.String("admission.name", secret.Name))
+	}
+	// the logger encodes its values when they are added, whether a line is
+	// written or not, so they are added in one go
+	log := logr.FromContextOrDiscard(ctx).WithValues("namespace", req.Namespace, "name", secret.Name, "operation", req.Operation,
+		"kind", req.Kind.Kind, "user", req.UserInfo.Username)
+	if debug := log.V(1); debug.Enabled() {
+		debug.Info("AdmissionReview")
+		debug.Info("Decoded object", "object", redactedSecret{secret})
+	}
+
+	entry := newAuditEntry(requestID, req, secret.Name)
+	entry.Cluster = p.config.Mutator.ClusterName
+
+	admission := mutator.AdmissionContext{Operation: string(req.Operation), Secret: secret, UserInfo: req.UserInfo,
+		Namespaces: whsvr.informers.namespaceLister(), Certificates: whsvr.informers.certificateLister(),
+		Ingresses: whsvr.informers.ingressLister()}
+
+	// the policy phase runs the mutation stages, the patch phase encodes
+	// the operations they returned
+	policySpan := startPhase(ctx, phasePolicy)
+	decision, patch, err := p.mutator.Evaluate(ctx, admission)
+	reason := decision.SkipReason
+	policySpan.SetAttributes(attribute.String("admission.skip_reason", reason))
+	policySpan.End()
+	if err != nil && ctx.Err() != nil {
+		return whsvr.cancelled(log, entry, err)
+	}
+	var deniedErr mutator.DeniedError
+	if errors.As(err, &deniedErr) {
+		// a strict tenancy policy, target limit or patch validation
+		// denies the secret whatever the failure policy
+		log.Info("Denying secret", "error", err.Error())
+		entry.Decision = decisionDenied
+		entry.Error = err.Error()
+		whsvr.recordDecision(entry)
+		eventReason := eventTargets
+		if _, ok := deniedErr.(*mutator.PatchViolationError); ok {
+			eventReason = eventInvalid
+		}
+		whsvr.events.record(req, secret.Name, corev1.EventTypeWarning, eventReason, "Denied: %v", err)
+		traceDecision(log, &decision, nil)
+		return &v1beta1.AdmissionResponse{
+			Warnings: decision.Warnings,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Message: err.Error(),
+				Reason:  metav1.StatusReasonForbidden,
+				Code:    http.StatusForbidden,
+			},
+		}, metrics.ResultDenied
+	}
+	if err != nil {
+		// the secret couldn't be evaluated, e.g. a rule's expression
+		// failed on it: answer per the failure policy
+		var ruleErr *mutator.RuleError
+		if errors.As(err, &ruleErr) {
+			metrics.RuleErrors.WithLabelValues(ruleErr.Rule).Inc()
+		}
+		if errors.Is(err, mutator.ErrNamespaceNotCached) {
+			metrics.NamespaceCacheMisses.Inc()
+		}
+		log.Error(err, "Could not evaluate secret", "failOpen", whsvr.failOpen)
+		traceDecision(log, &decision, nil)
+		whsvr.observeError(err)
+		entry.Decision = decisionError
+		entry.Error = err.Error()
+		whsvr.recordDecision(entry)
+		whsvr.events.record(req, secret.Name, corev1.EventTypeWarning, eventError, "Could not evaluate secret: %v", err)
+		return failureResponse(whsvr.failOpen, http.StatusInternalServerError, metav1.StatusReasonInternalError,
+			"could not evaluate secret: "+err.Error()), metrics.ResultErrored
+	}
+	if whsvr.downstream != nil {
+		if response, result := whsvr.chainDownstream(ctx, log, ar, &decision, &patch, entry); response != nil {
+			return response, result
+		}
+		reason = decision.SkipReason
+	}
+	if !decision.Mutate {
+		if whsvr.sampler.sample(log, req.Namespace, secret.Name, decisionSkipped+"/"+reason) {
+			log.Info("Skipping mutation", "reason", reason)
+		}
+		entry.Decision = decisionSkipped
+		entry.SkipReason = reason
+		metrics.ObserveSkip(reason)
+		whsvr.recordDecision(entry)
+		// other skips happen to every non-TLS or system secret and aren't worth an event
+		if reason == skipReplica {
+			whsvr.events.record(req, secret.Name, corev1.EventTypeNormal, eventSkipped, "Not annotated for sync: %s", reason)
+		}
+		traceDecision(log, &decision, nil)
+		return &v1beta1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: decision.Warnings,
+		}, metrics.ResultSkipped
+	}
+
+	patchSpan := startPhase(ctx, phasePatch)
+	patchBytes, err := p.mutator.MarshalPatch(patch)
+	patchSpan.SetAttributes(attribute.Int("admission.patch_bytes", len(patchBytes)))
+	if err != nil {
+		patchSpan.RecordError(err)
+		patchSpan.SetStatus(codes.Error, "could not create patch")
+	}
+	patchSpan.End()
+	if err != nil {
+		log.Error(err, "Could not create patch")
+		whsvr.observeError(err)
+		metrics.PatchErrors.Inc()
+		entry.Decision = decisionError
+		entry.Error = err.Error()
+		whsvr.recordDecision(entry)
+		whsvr.events.record(req, secret.Name, corev1.EventTypeWarning, eventError, "Could not create patch: %v", err)
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}, metrics.ResultErrored
+	}
+	verifySpan := startPhase(ctx, phasePatch)
+	err = whsvr.verifyPatch(p, req, patchBytes, expectAnnotations(decision.Annotations, secretAnnotations))
+	verifySpan.End()
+	if err != nil {
+		return whsvr.verificationFailed(log, req, secret.Name, entry, err)
+	}
+	if match, frozen := whsvr.frozen(p); frozen {
+		traceDecision(log, &decision, patch)
+		return whsvr.frozenResponse(log, entry, decision.Rule, patch, decision.Warnings, match), metrics.ResultSkipped
+	}
+
+	span.SetAttributes(attribute.String("admission.rule", decision.Rule))
+	if decision.TargetCount > 0 {
+		metrics.SyncTargets.Observe(float64(decision.TargetCount))
+	}
+	if decision.Signature != "" {
+		span.SetAttributes(attribute.String("admission.signature", decision.Signature))
+		log = log.WithValues("signature", decision.Signature)
+		metrics.SignatureMatches.WithLabelValues(decision.Signature).Inc()
+	}
+	if whsvr.sampler.sample(log, req.Namespace, secret.Name, decisionMutated) {
+		log.Info("Mutating object", "rule", decision.Rule, "patchOperations", len(patch))
+	}
+	if debug := log.V(1); debug.Enabled() {
+		debug.Info("Patch", "patch", redactedPatch(patch))
+	}
+	traceDecision(log, &decision, patch)
+	metrics.ObservePatch(decision.Rule, patchBytes)
+	metrics.ObserveMutation(req.Namespace)
+	for key := range decision.Annotations {
+		metrics.ObserveAnnotationAdded(key)
+	}
+
+	entry.Decision = decisionMutated
+	entry.MatchedRule = decision.Rule
+	entry.Patch = whsvr.patchSummary(patch)
+	whsvr.recordDecision(entry)
+	if decision.Rule == ruleDownstream {
+		whsvr.events.record(req, secret.Name, corev1.EventTypeNormal, eventAnnotated, "Patched by the downstream webhook")
+	} else {
+		whsvr.events.record(req, secret.Name, corev1.EventTypeNormal, eventAnnotated, "Annotated %s=%s by rule %s",
+			syncAnnotationKey, decision.Annotations[syncAnnotationKey], decision.Rule)
+	}
+
+	return &v1beta1.AdmissionResponse{
+		Allowed:  true,
+		Patch:    patchBytes,
+		Warnings: decision.Warnings,
+		PatchType: func() *v1beta1.PatchType {
+			pt := v1beta1.PatchTypeJSONPatch
+			return &pt
+		}(),
+	}, metrics.ResultMutated
+}
+
+// cancelled answers an admission whose context ended mid-evaluation. The API
+// server has given up on it, so the answer is only for the record.
+func (whsvr *WebhookServer) cancelled(log logr.Logger, entry auditEntry, err error) (*v1beta1.AdmissionResponse, string) {
+	log.Info("Admission cancelled", "error", err.Error())
+	whsvr.observeError(err)
+	entry.Decision = decisionError
+	entry.Error = err.Error()
+	whsvr.recordDecision(entry)
+	return &v1beta1.AdmissionResponse{
+		Result: &metav1.Status{
+			Message: err.Error(),
+		},
+	}, metrics.ResultErrored
+}
+
+// bodyReader returns the request body as a stream, transparently
+// decompressing gzip content, with the size limit enforced on the
+// decompressed bytes. The caller closes it.
+func (whsvr *WebhookServer) bodyReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
+	if r.Body == nil {
+		return http.NoBody, nil
+	}
+	var reader io.ReadCloser = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		reader = gz
+	}
+	if whsvr.maxBodyBytes > 0 {
+		reader = http.MaxBytesReader(w, reader, whsvr.maxBodyBytes)
+	}
+	return reader, nil
+}
+
+// bodyStream remembers the error reading the body failed with, which the
+// decoder passes on as it is, to tell it from a malformed body.
+type bodyStream struct {
+	r   io.Reader
+	err error
+}
+
+func (s *bodyStream) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+// writeStatusError replies with a metav1.Status describing the failure.
+func writeStatusError(w http.ResponseWriter, code int32, reason metav1.StatusReason, message string) {
+	status := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Reason:   reason,
+		Code:     code,
+	}
+	resp, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(code))
+	_, _ = w.Write(resp)
+}
+
+// admissionHandler routes the enabled admission paths to the webhook; the
+// legacy path is served along with the secrets mutation.
+func (whsvr *WebhookServer) admissionHandler() *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, route := range whsvr.routes {
+		mux.HandleFunc(route.Path, whsvr.serve)
+		if route.Path == PathMutateSecrets {
+			mux.HandleFunc(PathLegacyMutate, whsvr.serve)
+		}
+	}
+	return mux
+}
+
+// Serve method for webhook server
+func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
+	whsvr.inFlight.Add(1)
+	metrics.AdmissionsInFlight.Inc()
+	defer func() {
+		whsvr.inFlight.Add(-1)
+		metrics.AdmissionsInFlight.Dec()
+	}()
+
+	log := whsvr.log
+	if id := requestIDFrom(r.Context()); id != "" {
+		log = log.WithValues("requestID", id)
+	}
+
+	// continue the API server's trace when it sent one
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "admission", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.route", r.URL.Path)))
+	defer span.End()
+	ctx, timings := withPhaseTimings(ctx)
+	// the API server passes how long it waits for the answer; work on the
+	// admission, downstream calls included, stops there
+	if r.URL.RawQuery != "" {
+		if timeout, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil && timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+	}
+	r = r.WithContext(ctx)
+	// the admission is decided by the policy current when it arrived
+	p := whsvr.policy.Load()
+
+	start := whsvr.clock.Now()
+	operation, result := "", metrics.ResultErrored
+	defer func() {
+		span.SetAttributes(attribute.String("admission.decision", result))
+		if result == metrics.ResultErrored {
+			span.SetStatus(codes.Error, result)
+		}
+		elapsed := whsvr.clock.Since(start)
+		metrics.ObserveAdmission(r.URL.Path, operation, result, elapsed)
+		if whsvr.slowThreshold > 0 && elapsed > whsvr.slowThreshold {
+			slowest, phases := timings.slowest()
+			metrics.SlowRequests.WithLabelValues(slowest).Inc()
+			log.Info("WARNING: slow admission request", "duration", elapsed.String(), "threshold", whsvr.slowThreshold.String(),
+				"slowestPhase", slowest, "phases", phases, "result", result)
+		}
+	}()
+
+	// verify the content type is accurate
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		log.Info("Unexpected Content-Type, expect application/json", "contentType", contentType, "remoteAddr", r.RemoteAddr)
+		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// the review is decoded as the body streams in; the decoder's buffer
+	// goes with it, rather than the body being held for the whole
+	// admission. Only the recorder gets the bytes, in the buffer the
+	// response is encoded in afterwards
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var ar v1beta1.AdmissionReview
+	readSpan := startPhase(ctx, phaseRead)
+	body := &bodyStream{}
+	reader, err := whsvr.bodyReader(w, r)
+	if err != nil {
+		body.err = err
+	} else {
+		defer reader.Close()
+		body.r = reader
+		if whsvr.recorder != nil {
+			body.r = io.TeeReader(reader, buf)
+		}
+		ar, err = decodeReview(body)
+	}
+	readSpan.End()
+	if body.err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(body.err, &tooLarge) {
+			log.Info("Request body too large", "limit", tooLarge.Limit, "remoteAddr", r.RemoteAddr)
+			metrics.RequestBodyTooLarge.Inc()
+			writeStatusError(w, http.StatusRequestEntityTooLarge, metav1.StatusReasonRequestEntityTooLarge,
+				fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+			return
+		}
+		log.Error(body.err, "Can't read body", "remoteAddr", r.RemoteAddr)
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+	if err == io.EOF {
+		log.Info("Empty body", "remoteAddr", r.RemoteAddr)
+		http.Error(w, "empty body", http.StatusBadRequest)
+		return
+	}
+
+	var admissionResponse *v1beta1.AdmissionResponse
+	if err != nil {
+		log.Error(err, "Can't decode body", "remoteAddr", r.RemoteAddr)
+		whsvr.observeError(err)
+		admissionResponse = &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	} else if ar.Request != nil {
+		whsvr.recorder.record(ar.Request.UID, buf.Bytes())
+
+		// attach the admission UID to everything logged from here on
+		requestInfoFrom(r.Context()).uid = ar.Request.UID
+		log = log.WithValues("uid", ar.Request.UID)
+		operation = string(ar.Request.Operation)
+		span.SetAttributes(
+			attribute.String("admission.uid", string(ar.Request.UID)),
+			attribute.String("admission.namespace", ar.Request.Namespace),
+			attribute.String("admission.name", ar.Request.Name),
+			attribute.String("admission.operation", operation))
+	}
+
+	if admissionResponse == nil {
+		// a panic from here on is answered in the version of the review
+		requestInfoFrom(r.Context()).review = ar.TypeMeta
+	}
+
+	if admissionResponse != nil {
+		// decoding failed
+	} else if cached, cachedResult, ok := whsvr.decisions.lookup(ar.Request); ok {
+		log.V(1).Info("Replaying the decision of an earlier attempt", "result", cachedResult)
+		entry := newAuditEntry(requestIDFrom(r.Context()), ar.Request, ar.Request.Name)
+		entry.Decision = cachedResult
+		entry.Replay = true
+		whsvr.recordDecision(entry)
+		admissionResponse, result = cached, cachedResult
+	} else if ok, bucket := whsvr.limiter.allow(clientIP(r), whsvr.clock.Now()); !ok {
+		mode := "fail_open"
+		if whsvr.rateLimitStrict {
+			mode = "strict"
+		}
+		metrics.RateLimited.WithLabelValues(bucket, mode).Inc()
+		if whsvr.rateLimitStrict {
+			log.Info("Rate limited request", "client", clientIP(r), "bucket", bucket)
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if ar.Request != nil {
+			entry := newAuditEntry(requestIDFrom(r.Context()), ar.Request, ar.Request.Name)
+			entry.Decision = decisionSkipped
+			entry.SkipReason = skipRateLimited
+			whsvr.recordDecision(entry)
+		}
+		metrics.ObserveSkip(skipRateLimited)
+		result = metrics.ResultSkipped
+		admissionResponse = &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	} else if !whsvr.concurrency.acquire(ctx) {
+		log.Info("Shedding load, no admission slot free", "limit", whsvr.concurrency.limit(), "failOpen", whsvr.failOpen)
+		admissionResponse = failureResponse(whsvr.failOpen, http.StatusTooManyRequests, metav1.StatusReasonTooManyRequests,
+			"cert-manager webhook overloaded")
+		result = metrics.ResultDenied
+		if whsvr.failOpen {
+			result = metrics.ResultSkipped
+			metrics.ObserveSkip(skipLoadShed)
+			if ar.Request != nil {
+				entry := newAuditEntry(requestIDFrom(r.Context()), ar.Request, ar.Request.Name)
+				entry.Decision = decisionSkipped
+				entry.SkipReason = skipLoadShed
+				whsvr.recordDecision(entry)
+			}
+		}
+	} else {
+		func() {
+			defer whsvr.concurrency.release()
+			// the mux only routes enabled paths here, but the webhook
+			// rules may send them any kind
+			ctx := logr.NewContext(r.Context(), log)
+			route, ok := whsvr.routeFor(r.URL.Path, ar.Request)
+			if !ok {
+				admissionResponse, result = whsvr.unexpectedKind(ctx, r.URL.Path, ar.Request)
+				return
+			}
+			if ar.Request != nil && route.Path != r.URL.Path && r.URL.Path != PathLegacyMutate {
+				kind := schema.GroupKind{Group: ar.Request.Kind.Group, Kind: ar.Request.Kind.Kind}
+				log.Info("Dispatching object to the handler of its kind", "path", r.URL.Path, "kind", kind.String(), "handler", route.Path)
+				metrics.UnexpectedKinds.WithLabelValues(r.URL.Path, kind.String(), "true").Inc()
+			}
+			admissionResponse, result = route.admit(whsvr, ctx, p, &ar)
+			whsvr.decisions.store(ar.Request, admissionResponse, result)
+		}()
+	}
+
+	// answer in the API version the review was sent in; v1 and v1beta1
+	// reviews share the same shape
+	admissionReview := v1beta1.AdmissionReview{TypeMeta: ar.TypeMeta}
+	if admissionResponse != nil {
+		admissionReview.Response = admissionResponse
+		if ar.Request != nil {
+			admissionReview.Response.UID = ar.Request.UID
+		}
+		if id := requestIDFrom(r.Context()); id != "" {
+			if admissionReview.Response.AuditAnnotations == nil {
+				admissionReview.Response.AuditAnnotations = map[string]string{}
+			}
+			admissionReview.Response.AuditAnnotations["request-id"] = id
+		}
+	}
+
+	// the recorder copied the body, its bytes are done with
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(admissionReview); err != nil {
+		log.Error(err, "Can't encode response")
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Encode ends the JSON with a newline Marshal didn't add
+	if _, err := w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))); err != nil {
+		log.Error(err, "Can't write response")
+		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// newDefaultServer returns a server with the default policy and opts, failing
+// closed without limits as the zero settings do.
+func newDefaultServer(opts ...Option) *WebhookServer {
+	return newWebhookServer(Config{Mutator: mutator.DefaultConfig()}, opts...)
+}
+
+// secretReview returns the review of the creation of a cert-manager TLS
+// secret name in namespace.
+func secretReview(t *testing.T, name, namespace string) *v1beta1.AdmissionReview {
+	t.Helper()
+	secret := corev1.Secret{
+		TypeMeta: metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Annotations: map[string]string{certManagerAnnotationKey: name},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{corev1.TLSCertKey: bytes.Repeat([]byte("c"), 16), corev1.TLSPrivateKeyKey: bytes.Repeat([]byte("k"), 16)},
+	}
+	raw, err := json.Marshal(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &v1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1beta1"},
+		Request: &v1beta1.AdmissionRequest{
+			UID:       "review",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "secrets"},
+			Name:      name,
+			Namespace: namespace,
+			Operation: v1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+// postReview posts review to the server's /mutate handler, which gets a
+// request ID as in the server.
+func postReview(t *testing.T, whsvr *WebhookServer, review *v1beta1.AdmissionReview) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	RequestID(http.HandlerFunc(whsvr.serve)).ServeHTTP(rec, req)
+	return rec
+}
+
+// admit posts review to the server and returns its response.
+func admit(t *testing.T, whsvr *WebhookServer, review *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	t.Helper()
+	rec := postReview(t, whsvr, review)
+	var answer v1beta1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil || answer.Response == nil {
+		t.Fatalf("answered %d: %s", rec.Code, rec.Body)
+	}
+	return answer.Response
+}
+
+// reviewOfSize returns the JSON of a review padded with trailing whitespace
+// to size bytes.
+func reviewOfSize(t *testing.T, size int) []byte {
+	t.Helper()
+	body, err := json.Marshal(secretReview(t, "tls", "apps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) > size {
+		t.Fatalf("review of %d bytes is over %d", len(body), size)
+	}
+	return append(body, bytes.Repeat([]byte(" "), size-len(body))...)
+}
+
+func gzipped(t *testing.T, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	const limit = 4096
+	whsvr := newWebhookServer(Config{Mutator: mutator.DefaultConfig(), MaxBodyBytes: limit})
+	tests := []struct {
+		name string
+		size int
+		gzip bool
+		code int
+	}{
+		{name: "below the limit", size: limit - 1, code: http.StatusOK},
+		{name: "at the limit", size: limit, code: http.StatusOK},
+		{name: "above the limit", size: limit + 1, code: http.StatusRequestEntityTooLarge},
+		{name: "gzip at the limit", size: limit, gzip: true, code: http.StatusOK},
+		// the compressed body is far smaller than the limit, the limit
+		// applies to the decompressed one
+		{name: "gzip above the limit", size: limit + 1, gzip: true, code: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := reviewOfSize(t, tt.size)
+			if tt.gzip {
+				body = gzipped(t, body)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			rejected := testutil.ToFloat64(metrics.RequestBodyTooLarge)
+			rec := httptest.NewRecorder()
+			whsvr.serve(rec, req)
+			if rec.Code != tt.code {
+				t.Fatalf("answered %d, want %d: %s", rec.Code, tt.code, rec.Body)
+			}
+			counted := testutil.ToFloat64(metrics.RequestBodyTooLarge) - rejected
+			if tt.code != http.StatusRequestEntityTooLarge {
+				if counted != 0 {
+					t.Errorf("%v rejections counted", counted)
+				}
+				return
+			}
+			if counted != 1 {
+				t.Errorf("%v rejections counted, want 1", counted)
+			}
+			var status metav1.Status
+			if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+				t.Fatalf("answer isn't a Status: %v: %s", err, rec.Body)
+			}
+			if status.Reason != metav1.StatusReasonRequestEntityTooLarge || status.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("answered %+v", status)
+			}
+		})
+	}
+}
+
+// A request whose context is done is answered without being evaluated,
+// counted as an error and not reported as an event.
+func TestCancelledAdmission(t *testing.T) {
+	events, fake := fakeEvents()
+	whsvr := newDefaultServer(WithEventRecorder(events))
+	errored := metrics.Requests.WithLabelValues("/mutate", string(v1beta1.Create), metrics.ResultErrored)
+	before := testutil.ToFloat64(errored)
+	body, err := json.Marshal(secretReview(t, "tls", "apps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	RequestID(http.HandlerFunc(whsvr.serve)).ServeHTTP(rec, req)
+	var review v1beta1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	if response := review.Response; response == nil || response.Allowed || len(response.Patch) != 0 ||
+		response.Result == nil || response.Result.Message != context.Canceled.Error() {
+		t.Errorf("cancelled admission answered %s", rec.Body)
+	}
+	if got := testutil.ToFloat64(errored) - before; got != 1 {
+		t.Errorf("%v more errored admissions, want 1", got)
+	}
+	if events := recorded(fake); len(events) != 0 {
+		t.Errorf("events %q recorded for a cancelled admission", events)
+	}
+}
+
+// A rule failing on a secret is counted and answered per the failure
+// policy.
+func TestRuleErrorFailurePolicy(t *testing.T) {
+	settings, err := json.Marshal(mutator.PolicyConfig{Rules: []mutator.Rule{
+		{Name: "test-teams", MatchExpression: `object.metadata.labels["team"] == "payments"`},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := metrics.RuleErrors.WithLabelValues("test-teams")
+	for _, failOpen := range []bool{true, false} {
+		config := DefaultConfig()
+		config.FailOpen = failOpen
+		config.Mutator.StageConfig = map[string]json.RawMessage{mutator.PolicyStage: settings}
+		handler := newTestHandler(t, config)
+		before := testutil.ToFloat64(errs)
+
+		response := admitWith(t, handler, secretReview(t, "tls", "apps"))
+		// failing closed, the rule is named in the denial
+		if response.Allowed != failOpen || len(response.Patch) != 0 ||
+			(!failOpen && (response.Result == nil || !strings.Contains(response.Result.Message, `rule "test-teams"`))) {
+			t.Errorf("fail open %v: allowed %v with patch %s and result %+v", failOpen, response.Allowed, response.Patch, response.Result)
+		}
+		if got := testutil.ToFloat64(errs) - before; got != 1 {
+			t.Errorf("fail open %v: %v rule errors counted, want 1", failOpen, got)
+		}
+	}
+}
+
+// A strict tenancy policy denies a secret with disallowed targets, even
+// failing open, with an event; otherwise the targets are stripped, and a
+// secret left without any is skipped under its own reason.
+func TestTenancyAdmission(t *testing.T) {
+	tenancy := func(strict bool) Config {
+		policy, err := json.Marshal(mutator.PolicyConfig{Tenancy: mutator.TenancyConfig{Strict: strict, Tenants: []mutator.Tenant{
+			{Name: "team-a", SourceNamespaces: []string{"team-a-*"}, AllowedTargets: []string{"team-a-*"}},
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sync, err := json.Marshal(mutator.SyncAnnotationConfig{Profiles: map[string]mutator.SyncProfile{
+			"mixed":  {TargetNamespaces: []string{"team-a-api", "team-b-api"}},
+			"team-b": {TargetNamespaces: []string{"team-b-api"}},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := DefaultConfig()
+		config.FailOpen = true
+		config.Mutator.StageConfig = map[string]json.RawMessage{mutator.PolicyStage: policy, mutator.SyncAnnotationStage: sync}
+		return config
+	}
+	secret := func(profile string) *corev1.Secret {
+		secret := FixtureSecret{Name: "api-tls", Namespace: "team-a-web", DataSize: 16}.Build()
+		secret.Annotations[mutator.ProfileAnnotationKey] = profile
+		return secret
+	}
+
+	events, fake := fakeEvents()
+	handler := newTestHandler(t, tenancy(true), WithEventRecorder(events))
+	denied := metrics.Requests.WithLabelValues("/mutate", string(v1beta1.Create), metrics.ResultDenied)
+	before := testutil.ToFloat64(denied)
+	_, response := admitSecret(t, handler, secret("mixed"))
+	if response.Allowed || response.Result == nil || response.Result.Code != http.StatusForbidden ||
+		!strings.Contains(response.Result.Message, "may not be synced to team-b-api") {
+		t.Errorf("strict: allowed %v with %+v, want a 403 naming team-b-api", response.Allowed, response.Result)
+	}
+	if got := testutil.ToFloat64(denied) - before; got != 1 {
+		t.Errorf("strict: %v denials counted, want 1", got)
+	}
+	if got := recorded(fake); len(got) != 1 || !strings.HasPrefix(got[0], corev1.EventTypeWarning+" "+eventTargets) {
+		t.Errorf("strict: events %q, want one %s", got, eventTargets)
+	}
+
+	handler = newTestHandler(t, tenancy(false))
+	review, response := admitSecret(t, handler, secret("mixed"))
+	if got := patchedSecret(t, review, response).Annotations[syncAnnotationKey]; got != "kubernetes.io/metadata.name in (team-a-api)" ||
+		len(response.Warnings) != 1 {
+		t.Errorf("partially allowed: synced to %q with warnings %q", got, response.Warnings)
+	}
+	skipped := metrics.Skips.WithLabelValues(mutator.SkipTargetsDenied)
+	before = testutil.ToFloat64(skipped)
+	if _, response = admitSecret(t, handler, secret("team-b")); !response.Allowed || len(response.Patch) != 0 || len(response.Warnings) != 1 {
+		t.Errorf("fully denied: allowed %v with patch %s and warnings %q, want skipped with a warning", response.Allowed, response.Patch, response.Warnings)
+	}
+	if got := testutil.ToFloat64(skipped) - before; got != 1 {
+		t.Errorf("fully denied: %v skips counted %s, want 1", got, mutator.SkipTargetsDenied)
+	}
+}
+
+// The namespaces each mutated secret selects are observed once capped; in
+// strict mode a secret over the cap is denied, even failing open.
+func TestTargetLimitAdmission(t *testing.T) {
+	sync, err := json.Marshal(mutator.SyncAnnotationConfig{Profiles: map[string]mutator.SyncProfile{
+		"two":  {TargetNamespaces: []string{"prod-a", "prod-b"}},
+		"five": {TargetNamespaces: []string{"prod-a", "prod-b", "prod-c", "prod-d", "prod-e"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.FailOpen = true
+	config.Mutator.MaxTargets, config.Mutator.StrictTargetLimit = 3, true
+	config.Mutator.StageConfig = map[string]json.RawMessage{mutator.SyncAnnotationStage: sync}
+	events, fake := fakeEvents()
+	handler := newTestHandler(t, config, WithEventRecorder(events))
+	secret := func(profile string) *corev1.Secret {
+		secret := FixtureSecret{Name: "wildcard-tls", Namespace: "platform", DataSize: 16}.Build()
+		secret.Annotations[mutator.ProfileAnnotationKey] = profile
+		return secret
+	}
+
+	observed := func() uint64 {
+		return histogramSamples(t, prometheus.DefaultGatherer, "webhook_sync_target_namespaces", nil)
+	}
+	before := observed()
+	if _, response := admitSecret(t, handler, secret("two")); len(response.Patch) == 0 {
+		t.Errorf("secret under the cap not mutated: %+v", response.Result)
+	}
+	if got := observed() - before; got != 1 {
+		t.Errorf("%d target counts observed, want 1", got)
+	}
+	recorded(fake)
+
+	before = observed()
+	_, response := admitSecret(t, handler, secret("five"))
+	if response.Allowed || response.Result == nil || response.Result.Code != http.StatusForbidden ||
+		!strings.Contains(response.Result.Message, "selects 5 namespaces, more than the 3 allowed") {
+		t.Errorf("over the cap: allowed %v with %+v, want a 403", response.Allowed, response.Result)
+	}
+	if got := observed() - before; got != 0 {
+		t.Errorf("%d target counts observed for a denied secret", got)
+	}
+	if got := recorded(fake); len(got) != 1 || !strings.HasPrefix(got[0], corev1.EventTypeWarning+" "+eventTargets) {
+		t.Errorf("events %q, want one %s", got, eventTargets)
+	}
+}
+
+// A secret whose annotations would go over the metadata budget once
+// patched is admitted without the annotations that don't fit, with a
+// warning, or denied in strict mode.
+func TestPatchValidationAdmission(t *testing.T) {
+	secret := FixtureSecret{Name: "api-tls", Namespace: "apps", DataSize: 16}.Build()
+	size := 0
+	for key, value := range secret.Annotations {
+		size += len(key) + len(value)
+	}
+	secret.Annotations["example.com/notes"] = strings.Repeat("n", apivalidation.TotalAnnotationSizeLimitB-size-len("example.com/notes"))
+
+	config := DefaultConfig()
+	_, response := admitSecret(t, newTestHandler(t, config), secret)
+	if !response.Allowed || len(response.Patch) != 0 || len(response.Warnings) == 0 ||
+		!strings.Contains(strings.Join(response.Warnings, "\n"), "the annotations would exceed 262144 bytes") {
+		t.Errorf("allowed %v with %s, warnings %q, want admitted unpatched with a warning", response.Allowed, response.Patch, response.Warnings)
+	}
+
+	config.Mutator.StrictPatchValidation = true
+	events, fake := fakeEvents()
+	_, response = admitSecret(t, newTestHandler(t, config, WithEventRecorder(events)), secret)
+	if response.Allowed || response.Result == nil || response.Result.Code != http.StatusForbidden ||
+		!strings.Contains(response.Result.Message, "invalid patch: annotation") {
+		t.Errorf("strict: allowed %v with %+v, want a 403", response.Allowed, response.Result)
+	}
+	if got := recorded(fake); len(got) != 1 || !strings.HasPrefix(got[0], corev1.EventTypeWarning+" "+eventInvalid) {
+		t.Errorf("events %q, want one %s", got, eventInvalid)
+	}
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	admissionregistrationinformers "k8s.io/client-go/informers/admissionregistration/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/bygui86/cert-manager-webhook/internal/certs"
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// driftGracePeriod is how long the webhook configuration may stay out of
+// step before /readyz reports it.
+const driftGracePeriod = 2 * time.Minute
+
+// WebhookConfigReconciler keeps the caBundle and rules of the webhook's
+// MutatingWebhookConfiguration in step with the serving CA and the rules the
+// webhook expects, with an entry per enabled mutating path. Only the elected
+// leader writes; it reacts to edits of the configuration through an
+// informer and polls the CA source for rotations.
+type WebhookConfigReconciler struct {
+	log      logr.Logger
+	client   kubernetes.Interface
+	name     string       // MutatingWebhookConfiguration name
+	ca       certs.Source // PEM bundle of the CA that signed the serving certificate
+	routes   []Route      // enabled admission paths
+	interval time.Duration
+
+	leading atomic.Bool // leading and thus running the informer
+	synced  atomic.Bool // informer cache synced
+
+	mu         sync.Mutex
+	driftSince time.Time // when the current drift was first seen, zero in sync
+	lastErr    error
+}
+
+func NewWebhookConfigReconciler(log logr.Logger, client kubernetes.Interface, name string, ca certs.Source, routes []Route, interval time.Duration) *WebhookConfigReconciler {
+	return &WebhookConfigReconciler{
+		log:      log,
+		client:   client,
+		name:     name,
+		ca:       ca,
+		routes:   routes,
+		interval: interval,
+	}
+}
+
+// Lead reconciles until ctx is done.
+func (c *WebhookConfigReconciler) Lead(ctx context.Context) {
+	c.log.Info("Reconciling webhook configuration", "name", c.name)
+	c.leading.Store(true)
+	c.reconcileLoop(ctx)
+}
+
+// Stopped clears the state of the last term.
+func (c *WebhookConfigReconciler) Stopped() {
+	c.leading.Store(false)
+	c.synced.Store(false)
+	c.setDrift(nil, false)
+}
+
+// webhookConfigInformer returns an informer of the MutatingWebhookConfiguration
+// name alone, its factory to start, and a channel signalled on its changes.
+func webhookConfigInformer(client kubernetes.Interface, name string) (informers.SharedInformerFactory, admissionregistrationinformers.MutatingWebhookConfigurationInformer, <-chan struct{}) {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 10*time.Minute,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	informer := factory.Admissionregistration().V1().MutatingWebhookConfigurations()
+
+	trigger := make(chan struct{}, 1)
+	enqueue := func(interface{}) {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+	_, _ = informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+		DeleteFunc: enqueue,
+	})
+	return factory, informer, trigger
+}
+
+func (c *WebhookConfigReconciler) reconcileLoop(ctx context.Context) {
+	factory, informer, trigger := webhookConfigInformer(c.client, c.name)
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced) {
+		return
+	}
+	c.synced.Store(true)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		err := c.reconcile(ctx, informer.Lister().Get)
+		if err != nil {
+			c.log.Error(err, "Failed to reconcile webhook configuration", "name", c.name)
+		}
+		c.setDrift(err, true)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcile brings every webhook of the configuration back to the current
+// CA bundle and the rules of its path, and adds the entries of enabled paths
+// it lacks, updating it only when something drifted.
+func (c *WebhookConfigReconciler) reconcile(ctx context.Context, get func(string) (*admissionregistrationv1.MutatingWebhookConfiguration, error)) error {
+	ca, err := c.ca(ctx)
+	if err != nil {
+		return fmt.Errorf("reading CA bundle: %w", err)
+	}
+	current, err := get(c.name)
+	if err != nil {
+		return err
+	}
+
+	desired := current.DeepCopy()
+	var caDrift, rulesDrift bool
+	for i := range desired.Webhooks {
+		webhook := &desired.Webhooks[i]
+		if !bytes.Equal(webhook.ClientConfig.CABundle, ca) {
+			webhook.ClientConfig.CABundle = ca
+			caDrift = true
+		}
+		// entries on unknown paths predate the per-resource paths
+		route, ok := LookupRoute(clientConfigPath(webhook.ClientConfig))
+		if !ok {
+			route, _ = LookupRoute(PathMutateSecrets)
+		}
+		if rules := route.Rules(); !equality.Semantic.DeepEqual(webhook.Rules, rules) {
+			webhook.Rules = rules
+			rulesDrift = true
+		}
+	}
+	added := 0
+	for _, route := range c.routes {
+		if route.Validating || len(desired.Webhooks) == 0 || hasRoute(desired.Webhooks, route) {
+			continue
+		}
+		// a new entry calls the webhook like the first one does
+		webhook := *desired.Webhooks[0].DeepCopy()
+		webhook.Name = route.WebhookName(desired.Webhooks[0].Name)
+		webhook.ClientConfig = withClientConfigPath(webhook.ClientConfig, route.Path)
+		webhook.Rules = route.Rules()
+		desired.Webhooks = append(desired.Webhooks, webhook)
+		added++
+	}
+	if !caDrift && !rulesDrift && added == 0 {
+		return nil
+	}
+
+	// a conflict means the watch has a newer version to reconcile from
+	err = withRetry(ctx, opWebhookConfig, transientError, func(ctx context.Context) error {
+		_, err := c.client.AdmissionregistrationV1().MutatingWebhookConfigurations().Update(ctx, desired, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		metrics.WebhookConfigReconciles.WithLabelValues("failed").Inc()
+		return err
+	}
+	metrics.WebhookConfigReconciles.WithLabelValues("updated").Inc()
+	c.log.Info("Reconciled webhook configuration drift", "name", c.name, "caBundle", caDrift, "rules", rulesDrift, "addedWebhooks", added)
+	return nil
+}
+
+func (c *WebhookConfigReconciler) setDrift(err error, leading bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastErr = err
+	switch {
+	case err == nil || !leading:
+		c.driftSince = time.Time{}
+	case c.driftSince.IsZero():
+		c.driftSince = time.Now()
+	}
+}
+
+// Synced returns an error while the leader's informer cache hasn't synced
+// yet. Replicas that aren't leading run no informer. It is nil-safe.
+func (c *WebhookConfigReconciler) Synced(time.Time) error {
+	if c == nil || !c.leading.Load() || c.synced.Load() {
+		return nil
+	}
+	return fmt.Errorf("webhook configuration informer not synced")
+}
+
+// Drifted returns the last reconcile error when the configuration has been
+// out of step for longer than driftGracePeriod. It is nil-safe.
+func (c *WebhookConfigReconciler) Drifted(now time.Time) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.driftSince.IsZero() || now.Sub(c.driftSince) < driftGracePeriod {
+		return nil
+	}
+	return fmt.Errorf("webhook configuration %s out of sync since %s: %v", c.name, c.driftSince.Format(time.RFC3339), c.lastErr)
+}
+
+// clientConfigPath returns the path the API server calls the webhook on.
+func clientConfigPath(config admissionregistrationv1.WebhookClientConfig) string {
+	switch {
+	case config.Service != nil && config.Service.Path != nil:
+		return *config.Service.Path
+	case config.URL != nil:
+		if u, err := url.Parse(*config.URL); err == nil {
+			return u.Path
+		}
+	}
+	return ""
+}
+
+// withClientConfigPath returns config calling the webhook on path.
+func withClientConfigPath(config admissionregistrationv1.WebhookClientConfig, path string) admissionregistrationv1.WebhookClientConfig {
+	if config.Service != nil {
+		config.Service.Path = &path
+	} else if config.URL != nil {
+		if u, err := url.Parse(*config.URL); err == nil {
+			u.Path = path
+			s := u.String()
+			config.URL = &s
+		}
+	}
+	return config
+}
+
+// hasRoute reports whether one of webhooks calls route's path, the legacy
+// path counting as the secrets one.
+func hasRoute(webhooks []admissionregistrationv1.MutatingWebhook, route Route) bool {
+	for _, webhook := range webhooks {
+		if existing, ok := LookupRoute(clientConfigPath(webhook.ClientConfig)); ok && existing.Path == route.Path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testCABundle = "-----BEGIN CERTIFICATE-----\nca\n-----END CERTIFICATE-----\n"
+
+// webhookConfig returns a configuration named webhook with one entry
+// trusting caBundle and matching rules.
+func webhookConfig(caBundle string, rules []admissionregistrationv1.RuleWithOperations) *admissionregistrationv1.MutatingWebhookConfiguration {
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "webhook"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name:         "secrets.webhook.example.com",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: []byte(caBundle)},
+			Rules:        rules,
+		}},
+	}
+}
+
+// secretRules are the rules of the secrets mutation.
+func secretRules() []admissionregistrationv1.RuleWithOperations {
+	route, _ := LookupRoute(PathMutateSecrets)
+	return route.Rules()
+}
+
+func TestReconcileWebhookConfig(t *testing.T) {
+	createOnly := secretRules()
+	createOnly[0].Operations = createOnly[0].Operations[:1]
+	tests := []struct {
+		name     string
+		existing *admissionregistrationv1.MutatingWebhookConfiguration
+		updated  bool
+		err      bool
+	}{
+		{name: "in step", existing: webhookConfig(testCABundle, secretRules())},
+		{name: "rotated caBundle", existing: webhookConfig("stale", secretRules()), updated: true},
+		{name: "edited rules", existing: webhookConfig(testCABundle, createOnly), updated: true},
+		{name: "no caBundle", existing: webhookConfig("", nil), updated: true},
+		// the chart installs the configuration, a missing one is drift to
+		// report rather than something to create
+		{name: "missing", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset()
+			if tt.existing != nil {
+				client = fake.NewClientset(tt.existing)
+			}
+			ca := func(context.Context) ([]byte, error) { return []byte(testCABundle), nil }
+			c := NewWebhookConfigReconciler(logr.Discard(), client, "webhook", ca, nil, time.Minute)
+			get := func(name string) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+				return client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), name, metav1.GetOptions{})
+			}
+			client.ClearActions()
+
+			err := c.reconcile(context.Background(), get)
+			if (err != nil) != tt.err {
+				t.Fatalf("reconciled with %v", err)
+			}
+			var updates int
+			for _, action := range client.Actions() {
+				switch action.GetVerb() {
+				case "update":
+					updates++
+				case "create":
+					t.Errorf("created %s", action.GetResource().Resource)
+				}
+			}
+			if tt.updated != (updates == 1) || updates > 1 {
+				t.Fatalf("%d updates", updates)
+			}
+			if tt.err {
+				return
+			}
+			got, err := get("webhook")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got.Webhooks[0].ClientConfig.CABundle) != testCABundle {
+				t.Errorf("caBundle %q", got.Webhooks[0].ClientConfig.CABundle)
+			}
+			if !equality.Semantic.DeepEqual(got.Webhooks[0].Rules, secretRules()) {
+				t.Errorf("rules %+v", got.Webhooks[0].Rules)
+			}
+		})
+	}
+}
+
+// An enabled mutating path without an entry gets one calling the webhook
+// like the first entry, on its own path and rules; entries on the legacy
+// path count as the secrets one.
+func TestReconcileWebhookConfigAddsPaths(t *testing.T) {
+	existing := webhookConfig(testCABundle, secretRules())
+	legacy := PathLegacyMutate
+	existing.Webhooks[0].ClientConfig.Service = &admissionregistrationv1.ServiceReference{Namespace: "infra", Name: "webhook", Path: &legacy}
+	client := fake.NewClientset(existing)
+	routes, err := EnabledRoutes([]string{PathMutateSecrets, PathMutateConfigMaps, PathValidateSecrets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := func(context.Context) ([]byte, error) { return []byte(testCABundle), nil }
+	c := NewWebhookConfigReconciler(logr.Discard(), client, "webhook", ca, routes, time.Minute)
+	get := func(name string) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+		return client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), name, metav1.GetOptions{})
+	}
+	if err := c.reconcile(context.Background(), get); err != nil {
+		t.Fatal(err)
+	}
+	got, err := get("webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Webhooks) != 2 {
+		t.Fatalf("%d webhooks, want the secrets one and the ConfigMaps one added", len(got.Webhooks))
+	}
+	added := got.Webhooks[1]
+	configMaps, _ := LookupRoute(PathMutateConfigMaps)
+	if added.Name != "configmaps.secrets.webhook.example.com" || clientConfigPath(added.ClientConfig) != PathMutateConfigMaps ||
+		added.ClientConfig.Service.Name != "webhook" || string(added.ClientConfig.CABundle) != testCABundle ||
+		!equality.Semantic.DeepEqual(added.Rules, configMaps.Rules()) {
+		t.Errorf("added webhook %+v", added)
+	}
+	if path := clientConfigPath(got.Webhooks[0].ClientConfig); path != PathLegacyMutate {
+		t.Errorf("legacy entry moved to %s", path)
+	}
+
+	// once added, nothing drifts
+	client.ClearActions()
+	if err := c.reconcile(context.Background(), get); err != nil || len(client.Actions()) != 1 {
+		t.Errorf("second reconcile %v with actions %v, want only the get", err, client.Actions())
+	}
+}
+
+func TestWebhookConfigDrifted(t *testing.T) {
+	c := NewWebhookConfigReconciler(logr.Discard(), fake.NewClientset(), "webhook", nil, nil, time.Minute)
+	now := time.Now()
+	if err := c.Drifted(now); err != nil {
+		t.Errorf("drifted before reconciling: %v", err)
+	}
+	c.setDrift(context.DeadlineExceeded, true)
+	if err := c.Drifted(now.Add(driftGracePeriod / 2)); err != nil {
+		t.Errorf("drifted within the grace period: %v", err)
+	}
+	if err := c.Drifted(now.Add(driftGracePeriod + time.Second)); err == nil {
+		t.Error("not drifted past the grace period")
+	}
+	c.setDrift(context.DeadlineExceeded, false)
+	if err := c.Drifted(now.Add(driftGracePeriod + time.Second)); err != nil {
+		t.Errorf("drifted after losing the lease: %v", err)
+	}
+	var none *WebhookConfigReconciler
+	if err := none.Drifted(now); err != nil {
+		t.Errorf("nil reconciler drifted: %v", err)
+	}
+}
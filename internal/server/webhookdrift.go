@@ -0,0 +1,284 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// DefaultWebhookTimeoutSeconds is the timeout of the webhook entries.
+const DefaultWebhookTimeoutSeconds = 10
+
+// Fields of the webhook entries the drift watcher compares.
+const (
+	driftFieldFailurePolicy     = "failurePolicy"
+	driftFieldTimeoutSeconds    = "timeoutSeconds"
+	driftFieldRules             = "rules"
+	driftFieldNamespaceSelector = "namespaceSelector"
+	driftFieldObjectSelector    = "objectSelector"
+	driftFieldSideEffects       = "sideEffects"
+)
+
+var driftFields = []string{
+	driftFieldFailurePolicy,
+	driftFieldTimeoutSeconds,
+	driftFieldRules,
+	driftFieldNamespaceSelector,
+	driftFieldObjectSelector,
+	driftFieldSideEffects,
+}
+
+// WebhookSettings are the settings every webhook entry of the
+// configuration is expected to have, besides the rules of its path: those
+// the manifests subcommand renders.
+type WebhookSettings struct {
+	FailurePolicy     admissionregistrationv1.FailurePolicyType
+	TimeoutSeconds    int32
+	SideEffects       admissionregistrationv1.SideEffectClass
+	NamespaceSelector *metav1.LabelSelector
+	ObjectSelector    *metav1.LabelSelector
+}
+
+// ExpectedWebhookSettings returns the settings of the webhook entries of a
+// webhook answering failures with failurePolicy and recording Events when
+// emitEvents is set.
+func ExpectedWebhookSettings(failurePolicy string, emitEvents bool) WebhookSettings {
+	// events are the only side effect, and they aren't recorded for dry runs
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	if emitEvents {
+		sideEffects = admissionregistrationv1.SideEffectClassNoneOnDryRun
+	}
+	return WebhookSettings{
+		FailurePolicy:  admissionregistrationv1.FailurePolicyType(failurePolicy),
+		TimeoutSeconds: DefaultWebhookTimeoutSeconds,
+		SideEffects:    sideEffects,
+		// the namespaces the webhook always skips aren't sent at all; an
+		// objectSelector can't be used as TLS secrets carry no common label
+		NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{
+			Key:      corev1.LabelMetadataName,
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   mutator.DefaultConfig().IgnoredNamespaces,
+		}}},
+	}
+}
+
+// fieldDrift is a field of a webhook entry that differs from the settings.
+type fieldDrift struct {
+	Webhook  string `json:"webhook"`
+	Field    string `json:"field"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// WebhookConfigWatcher watches the webhook's MutatingWebhookConfiguration
+// and reports the fields of its entries that differ from the settings the
+// webhook runs with: the failure policy, timeout, rules of their path,
+// selectors and side effects. It only detects: each field's drift is
+// exported and a diff logged when it appears, while remediation is left to
+// the WebhookConfigReconciler. It runs on the elected leader.
+type WebhookConfigWatcher struct {
+	log      logr.Logger
+	client   kubernetes.Interface
+	name     string // MutatingWebhookConfiguration name
+	expected WebhookSettings
+	interval time.Duration
+
+	leading atomic.Bool
+
+	mu       sync.Mutex
+	missing  bool
+	lastDiff string // rendering of the drift last logged
+}
+
+func NewWebhookConfigWatcher(log logr.Logger, client kubernetes.Interface, name string, expected WebhookSettings, interval time.Duration) *WebhookConfigWatcher {
+	return &WebhookConfigWatcher{log: log, client: client, name: name, expected: expected, interval: interval}
+}
+
+// Lead watches the configuration until ctx is done.
+func (w *WebhookConfigWatcher) Lead(ctx context.Context) {
+	w.log.Info("Watching webhook configuration for drift", "name", w.name)
+	w.leading.Store(true)
+	factory, informer, trigger := webhookConfigInformer(w.client, w.name)
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced) {
+		return
+	}
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		w.check(informer.Lister().Get)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stopped clears what the watcher exports while leading.
+func (w *WebhookConfigWatcher) Stopped() {
+	w.leading.Store(false)
+	metrics.WebhookConfigDrift.Reset()
+	w.mu.Lock()
+	w.missing = false
+	w.lastDiff = ""
+	w.mu.Unlock()
+}
+
+// check compares the configuration with the settings.
+func (w *WebhookConfigWatcher) check(get func(string) (*admissionregistrationv1.MutatingWebhookConfiguration, error)) {
+	current, err := get(w.name)
+	missing := apierrors.IsNotFound(err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if missing != w.missing {
+		if missing {
+			w.log.Info("WARNING: webhook configuration not found, the API server doesn't call the webhook", "name", w.name)
+		} else {
+			w.log.Info("Webhook configuration found again", "name", w.name)
+		}
+		w.missing = missing
+	}
+	if err != nil {
+		if !missing {
+			w.log.Error(err, "Failed to get webhook configuration", "name", w.name)
+		}
+		metrics.WebhookConfigDrift.Reset()
+		w.lastDiff = ""
+		return
+	}
+
+	drift := webhookConfigDrift(current, w.expected)
+	drifted := map[string]bool{}
+	for _, d := range drift {
+		drifted[d.Field] = true
+	}
+	for _, field := range driftFields {
+		value := 0.0
+		if drifted[field] {
+			value = 1
+		}
+		metrics.WebhookConfigDrift.WithLabelValues(field).Set(value)
+	}
+
+	rendered, _ := json.Marshal(drift)
+	diff := string(rendered)
+	if len(drift) == 0 {
+		diff = ""
+	}
+	if diff == w.lastDiff {
+		return
+	}
+	if diff == "" {
+		w.log.Info("Webhook configuration back in step with the settings", "name", w.name)
+	} else {
+		w.log.Info("WARNING: webhook configuration drifted from the settings", "name", w.name, "drift", drift)
+	}
+	w.lastDiff = diff
+}
+
+// Present fails while the leader finds the configuration missing, which
+// leaves the webhook uncalled. It is nil-safe.
+func (w *WebhookConfigWatcher) Present(time.Time) error {
+	if w == nil || !w.leading.Load() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.missing {
+		return fmt.Errorf("webhook configuration %s not found", w.name)
+	}
+	return nil
+}
+
+// webhookConfigDrift returns the fields of the entries of config that
+// differ from expected and the rules of their path, sorted by entry and
+// field.
+func webhookConfigDrift(config *admissionregistrationv1.MutatingWebhookConfiguration, expected WebhookSettings) []fieldDrift {
+	var drift []fieldDrift
+	for _, webhook := range config.Webhooks {
+		add := func(field string, want, got interface{}) {
+			drift = append(drift, fieldDrift{Webhook: webhook.Name, Field: field, Expected: driftValue(want), Actual: driftValue(got)})
+		}
+		// the API server defaults an unset failure policy to Fail and
+		// timeout to 10s
+		failurePolicy := admissionregistrationv1.Fail
+		if webhook.FailurePolicy != nil {
+			failurePolicy = *webhook.FailurePolicy
+		}
+		if failurePolicy != expected.FailurePolicy {
+			add(driftFieldFailurePolicy, expected.FailurePolicy, failurePolicy)
+		}
+		timeout := int32(DefaultWebhookTimeoutSeconds)
+		if webhook.TimeoutSeconds != nil {
+			timeout = *webhook.TimeoutSeconds
+		}
+		if timeout != expected.TimeoutSeconds {
+			add(driftFieldTimeoutSeconds, expected.TimeoutSeconds, timeout)
+		}
+		// entries on unknown paths predate the per-resource paths
+		route, ok := LookupRoute(clientConfigPath(webhook.ClientConfig))
+		if !ok {
+			route, _ = LookupRoute(PathMutateSecrets)
+		}
+		if rules := route.Rules(); !equality.Semantic.DeepEqual(webhook.Rules, rules) {
+			add(driftFieldRules, rules, webhook.Rules)
+		}
+		if !sameSelector(webhook.NamespaceSelector, expected.NamespaceSelector) {
+			add(driftFieldNamespaceSelector, expected.NamespaceSelector, webhook.NamespaceSelector)
+		}
+		if !sameSelector(webhook.ObjectSelector, expected.ObjectSelector) {
+			add(driftFieldObjectSelector, expected.ObjectSelector, webhook.ObjectSelector)
+		}
+		var sideEffects admissionregistrationv1.SideEffectClass
+		if webhook.SideEffects != nil {
+			sideEffects = *webhook.SideEffects
+		}
+		if sideEffects != expected.SideEffects {
+			add(driftFieldSideEffects, expected.SideEffects, sideEffects)
+		}
+	}
+	sort.SliceStable(drift, func(i, j int) bool { return drift[i].Webhook < drift[j].Webhook })
+	return drift
+}
+
+// sameSelector compares selectors, an unset one selecting everything like
+// an empty one.
+func sameSelector(a, b *metav1.LabelSelector) bool {
+	if a == nil {
+		a = &metav1.LabelSelector{}
+	}
+	if b == nil {
+		b = &metav1.LabelSelector{}
+	}
+	return equality.Semantic.DeepEqual(a, b)
+}
+
+// driftValue renders a field value in the drift log.
+func driftValue(value interface{}) string {
+	rendered, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(rendered)
+}
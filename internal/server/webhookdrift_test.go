@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/zapr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/bygui86/cert-manager-webhook/internal/metrics"
+)
+
+// generatedWebhookConfig returns the webhook configuration the manifests
+// subcommand renders for settings, with the entry of the secrets path.
+func generatedWebhookConfig(settings WebhookSettings) *admissionregistrationv1.MutatingWebhookConfiguration {
+	route, _ := LookupRoute(PathMutateSecrets)
+	path := PathMutateSecrets
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "cert-manager-webhook"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name: "cert-sync.bygui86.io",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{Namespace: "cert-manager", Name: "cert-manager-webhook", Path: &path},
+			},
+			Rules:                   route.Rules(),
+			FailurePolicy:           &settings.FailurePolicy,
+			TimeoutSeconds:          &settings.TimeoutSeconds,
+			SideEffects:             &settings.SideEffects,
+			NamespaceSelector:       settings.NamespaceSelector,
+			ObjectSelector:          settings.ObjectSelector,
+			AdmissionReviewVersions: []string{"v1", "v1beta1"},
+		}},
+	}
+}
+
+// driftedFields returns the fields of drift.
+func driftedFields(drift []fieldDrift) []string {
+	var fields []string
+	for _, d := range drift {
+		fields = append(fields, d.Webhook+" "+d.Field)
+	}
+	return fields
+}
+
+func TestWebhookConfigDrift(t *testing.T) {
+	expected := ExpectedWebhookSettings(FailurePolicyIgnore, false)
+	const name = "cert-sync.bygui86.io"
+	for _, tt := range []struct {
+		name   string
+		edit   func(*admissionregistrationv1.MutatingWebhook)
+		fields []string
+	}{
+		{name: "generated", edit: func(*admissionregistrationv1.MutatingWebhook) {}},
+		{name: "fail with a 30s timeout", edit: func(w *admissionregistrationv1.MutatingWebhook) {
+			fail, timeout := admissionregistrationv1.Fail, int32(30)
+			w.FailurePolicy, w.TimeoutSeconds = &fail, &timeout
+		}, fields: []string{driftFieldFailurePolicy, driftFieldTimeoutSeconds}},
+		{name: "unset failure policy defaults to Fail", edit: func(w *admissionregistrationv1.MutatingWebhook) {
+			w.FailurePolicy = nil
+		}, fields: []string{driftFieldFailurePolicy}},
+		{name: "unset timeout defaults to 10s", edit: func(w *admissionregistrationv1.MutatingWebhook) {
+			w.TimeoutSeconds = nil
+		}},
+		{name: "stale object selector", edit: func(w *admissionregistrationv1.MutatingWebhook) {
+			w.ObjectSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "gone"}}
+		}, fields: []string{driftFieldObjectSelector}},
+		{name: "empty object selector", edit: func(w *admissionregistrationv1.MutatingWebhook) {
+			w.ObjectSelector = &metav1.LabelSelector{}
+		}},
+		{name: "namespace selector dropped", edit: func(w *admissionregistrationv1.MutatingWebhook) {
+			w.NamespaceSelector = nil
+		}, fields: []string{driftFieldNamespaceSelector}},
+		{name: "deletes sent", edit: func(w *admissionregistrationv1.MutatingWebhook) {
+			w.Rules[0].Operations = append(w.Rules[0].Operations, admissionregistrationv1.Delete)
+		}, fields: []string{driftFieldRules}},
+		{name: "side effects", edit: func(w *admissionregistrationv1.MutatingWebhook) {
+			some := admissionregistrationv1.SideEffectClassNoneOnDryRun
+			w.SideEffects = &some
+		}, fields: []string{driftFieldSideEffects}},
+		{name: "unknown path compared with the secrets rules", edit: func(w *admissionregistrationv1.MutatingWebhook) {
+			path := "/mutate"
+			w.ClientConfig.Service.Path = &path
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config := generatedWebhookConfig(ExpectedWebhookSettings(FailurePolicyIgnore, false))
+			tt.edit(&config.Webhooks[0])
+			var want []string
+			for _, field := range tt.fields {
+				want = append(want, name+" "+field)
+			}
+			if got := driftedFields(webhookConfigDrift(config, expected)); !slices.Equal(got, want) {
+				t.Errorf("drift %v, want %v", got, want)
+			}
+		})
+	}
+
+	// the values are rendered for the log, by entry
+	config := generatedWebhookConfig(expected)
+	second := config.Webhooks[0]
+	second.Name = "a-first.bygui86.io"
+	timeout := int32(30)
+	second.TimeoutSeconds = &timeout
+	config.Webhooks = append(config.Webhooks, second)
+	drift := webhookConfigDrift(config, expected)
+	if len(drift) != 1 || drift[0] != (fieldDrift{Webhook: "a-first.bygui86.io", Field: driftFieldTimeoutSeconds, Expected: "10", Actual: "30"}) {
+		t.Errorf("drift %+v", drift)
+	}
+}
+
+// driftGauges returns the drift gauges exported, by field.
+func driftGauges() map[string]float64 {
+	gauges := map[string]float64{}
+	if testutil.CollectAndCount(metrics.WebhookConfigDrift) == 0 {
+		return gauges
+	}
+	for _, field := range driftFields {
+		gauges[field] = testutil.ToFloat64(metrics.WebhookConfigDrift.WithLabelValues(field))
+	}
+	return gauges
+}
+
+// The watcher exports the drift of the configuration as it changes, logs
+// each new diff once, and fails readiness while the configuration is
+// missing; it never writes.
+func TestWebhookConfigWatcher(t *testing.T) {
+	expected := ExpectedWebhookSettings(FailurePolicyIgnore, false)
+	client := fake.NewSimpleClientset(generatedWebhookConfig(expected))
+	core, logs := observer.New(zapcore.InfoLevel)
+	w := NewWebhookConfigWatcher(zapr.NewLogger(zap.New(core)), client, "cert-manager-webhook", expected, 10*time.Millisecond)
+	t.Cleanup(metrics.WebhookConfigDrift.Reset)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Lead(ctx)
+	}()
+	configs := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+
+	// matching
+	waitFor(t, func() bool { return len(driftGauges()) == len(driftFields) })
+	for field, value := range driftGauges() {
+		if value != 0 {
+			t.Errorf("matching: %s drifted", field)
+		}
+	}
+	if err := w.Present(time.Now()); err != nil {
+		t.Errorf("matching: %v", err)
+	}
+
+	// drifted
+	drifted := generatedWebhookConfig(expected)
+	fail, timeout := admissionregistrationv1.Fail, int32(30)
+	drifted.Webhooks[0].FailurePolicy, drifted.Webhooks[0].TimeoutSeconds = &fail, &timeout
+	if _, err := configs.Update(ctx, drifted, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return driftGauges()[driftFieldTimeoutSeconds] == 1 })
+	if gauges := driftGauges(); gauges[driftFieldFailurePolicy] != 1 || gauges[driftFieldRules] != 0 || gauges[driftFieldObjectSelector] != 0 {
+		t.Errorf("drifted: gauges %v", gauges)
+	}
+	time.Sleep(50 * time.Millisecond) // checked again on the interval
+	warnings := logs.FilterMessage("WARNING: webhook configuration drifted from the settings").All()
+	if len(warnings) != 1 {
+		t.Fatalf("drift logged %d times, want once", len(warnings))
+	}
+	if drift, _ := warnings[0].ContextMap()["drift"].([]fieldDrift); len(drift) != 2 ||
+		drift[0].Field != driftFieldFailurePolicy || drift[0].Expected != `"Ignore"` || drift[0].Actual != `"Fail"` {
+		t.Errorf("diff %+v, want the two fields", warnings[0].ContextMap()["drift"])
+	}
+
+	// edited back
+	if _, err := configs.Update(ctx, generatedWebhookConfig(expected), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return driftGauges()[driftFieldTimeoutSeconds] == 0 })
+	if n := logs.FilterMessage("Webhook configuration back in step with the settings").Len(); n != 1 {
+		t.Errorf("back in step logged %d times", n)
+	}
+
+	// missing
+	if err := configs.Delete(ctx, "cert-manager-webhook", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return w.Present(time.Now()) != nil })
+	if err := w.Present(time.Now()); !strings.Contains(err.Error(), "webhook configuration cert-manager-webhook not found") {
+		t.Errorf("missing: %v", err)
+	}
+	if gauges := driftGauges(); len(gauges) != 0 {
+		t.Errorf("missing: gauges %v left", gauges)
+	}
+
+	// back, in step
+	if _, err := configs.Create(ctx, generatedWebhookConfig(expected), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return w.Present(time.Now()) == nil && len(driftGauges()) == len(driftFields) })
+	if n := logs.FilterMessage("Webhook configuration found again").Len(); n != 1 {
+		t.Errorf("found again logged %d times", n)
+	}
+
+	cancel()
+	<-done
+	w.Stopped()
+	if gauges := driftGauges(); len(gauges) != 0 {
+		t.Errorf("stopped: gauges %v left", gauges)
+	}
+	// the test's own updates, delete and create are the only writes
+	writes := 0
+	for _, action := range client.Actions() {
+		if !slices.Contains([]string{"get", "list", "watch"}, action.GetVerb()) {
+			writes++
+		}
+	}
+	if writes != 4 {
+		t.Errorf("%d writes, want the test's 4", writes)
+	}
+
+	// a follower is ready whatever the configuration
+	w.missing = true
+	if err := w.Present(time.Now()); err != nil {
+		t.Errorf("not leading: %v", err)
+	}
+	var none *WebhookConfigWatcher
+	if err := none.Present(time.Now()); err != nil {
+		t.Errorf("nil watcher: %v", err)
+	}
+}
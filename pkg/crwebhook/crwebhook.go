@@ -0,0 +1,62 @@
+// Package crwebhook serves the mutator from a controller-runtime webhook
+// server, so operators built on controller-runtime can mount it in their
+// manager instead of running the webhook binary.
+package crwebhook
+
+import (
+	"context"
+	"net/http"
+
+	"gomodules.xyz/jsonpatch/v2"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// Audit annotations set on the responses, prefixed by the API server with
+// the webhook's name.
+const (
+	AuditDecision   = "decision"
+	AuditRule       = "rule"
+	AuditSkipReason = "skip-reason"
+)
+
+// Handler implements admission.Handler on top of a Mutator.
+type Handler struct {
+	mutator *mutator.Mutator
+}
+
+var _ admission.Handler = &Handler{}
+
+// New returns a Handler evaluating secrets with m.
+func New(m *mutator.Mutator) *Handler {
+	return &Handler{mutator: m}
+}
+
+// Handle decodes the secret of req, evaluates it and translates the
+// decision, patch and warnings into a controller-runtime response.
+func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.Response {
+	secret, err := h.mutator.DecodeSecret(req.Object.Raw)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	decision, patch, err := h.mutator.Evaluate(ctx, mutator.AdmissionContext{Operation: string(req.Operation), Secret: secret, UserInfo: req.UserInfo})
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	var resp admission.Response
+	if !decision.Mutate {
+		resp = admission.Allowed(decision.SkipReason)
+		resp.AuditAnnotations = map[string]string{AuditDecision: "skipped", AuditSkipReason: decision.SkipReason}
+	} else {
+		ops := make([]jsonpatch.JsonPatchOperation, len(patch))
+		for i, op := range patch {
+			ops[i] = jsonpatch.JsonPatchOperation{Operation: op.Op, Path: op.Path, Value: op.Value}
+		}
+		resp = admission.Patched("", ops...)
+		resp.AuditAnnotations = map[string]string{AuditDecision: "mutated", AuditRule: decision.Rule}
+	}
+	return resp.WithWarnings(decision.Warnings...)
+}
@@ -0,0 +1,136 @@
+package crwebhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/bygui86/cert-manager-webhook/pkg/mutator"
+)
+
+// newHandler returns a Handler running stages, the default ones when none.
+func newHandler(t *testing.T, stages ...string) *Handler {
+	t.Helper()
+	config := mutator.DefaultConfig()
+	if len(stages) > 0 {
+		config.Stages = stages
+	}
+	m, err := mutator.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(m)
+}
+
+// request returns the CREATE request of a cert-manager TLS secret.
+func request(t *testing.T, namespace, name string) admission.Request {
+	t.Helper()
+	raw, err := json.Marshal(&corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Annotations: map[string]string{mutator.CertManagerAnnotationKey: name}},
+		Type:       corev1.SecretTypeTLS,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		UID:       types.UID("uid-" + name),
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "secrets"},
+		Namespace: namespace,
+		Name:      name,
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+func TestHandle(t *testing.T) {
+	h := newHandler(t)
+
+	resp := h.Handle(context.Background(), request(t, "apps", "api-tls"))
+	if !resp.Allowed || resp.AuditAnnotations[AuditDecision] != "mutated" || resp.AuditAnnotations[AuditRule] != mutator.DefaultRule {
+		t.Errorf("mutated secret answered allowed %v with audit annotations %v", resp.Allowed, resp.AuditAnnotations)
+	}
+	patched := map[string]any{}
+	for _, op := range resp.Patches {
+		patched[op.Path] = op.Value
+	}
+	if path := "/metadata/annotations/" + mutator.EscapePointer(mutator.SyncAnnotationKey); patched[path] != "true" {
+		t.Errorf("patches %+v, want the sync annotation", resp.Patches)
+	}
+
+	resp = h.Handle(context.Background(), request(t, metav1.NamespaceSystem, "api-tls"))
+	if !resp.Allowed || len(resp.Patches) != 0 || resp.AuditAnnotations[AuditDecision] != "skipped" ||
+		resp.AuditAnnotations[AuditSkipReason] != mutator.SkipIgnoredNamespace {
+		t.Errorf("skipped secret answered allowed %v with %d patches and audit annotations %v", resp.Allowed, len(resp.Patches), resp.AuditAnnotations)
+	}
+}
+
+// The warnings of the decision go to the API client.
+func TestHandleWarnings(t *testing.T) {
+	h := newHandler(t, mutator.PolicyStage, mutator.ChainStage, mutator.SyncAnnotationStage)
+	resp := h.Handle(context.Background(), request(t, "apps", "api-tls"))
+	if !resp.Allowed || len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "chain verification failed") {
+		t.Errorf("allowed %v with warnings %q, want the chain's", resp.Allowed, resp.Warnings)
+	}
+}
+
+func TestHandleErrors(t *testing.T) {
+	h := newHandler(t)
+	broken := request(t, "apps", "api-tls")
+	broken.Object.Raw = []byte(`{"metadata":"broken"}`)
+	if resp := h.Handle(context.Background(), broken); resp.Allowed || resp.Result.Code != http.StatusBadRequest {
+		t.Errorf("undecodable secret answered allowed %v with %+v, want a 400", resp.Allowed, resp.Result)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if resp := h.Handle(ctx, request(t, "apps", "api-tls")); resp.Allowed || resp.Result.Code != http.StatusInternalServerError {
+		t.Errorf("failed evaluation answered allowed %v with %+v, want a 500", resp.Allowed, resp.Result)
+	}
+}
+
+// Mounted as controller-runtime's admission webhook, the handler answers
+// AdmissionReviews with a JSON patch.
+func TestWebhook(t *testing.T) {
+	webhook := &admission.Webhook{Handler: newHandler(t)}
+	req := request(t, "apps", "api-tls")
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  &req.AdmissionRequest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/mutate-secrets", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	webhook.ServeHTTP(rec, r)
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	resp := review.Response
+	if resp == nil || resp.UID != req.UID || !resp.Allowed || resp.PatchType == nil || *resp.PatchType != admissionv1.PatchTypeJSONPatch {
+		t.Fatalf("answered %s", rec.Body)
+	}
+	var patch []mutator.PatchOperation
+	if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) == 0 || resp.AuditAnnotations[AuditDecision] != "mutated" {
+		t.Errorf("patch %s with audit annotations %v", resp.Patch, resp.AuditAnnotations)
+	}
+}
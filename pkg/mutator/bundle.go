@@ -0,0 +1,120 @@
+package mutator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// BundleStage names the stage generating the combined PEM bundle.
+const BundleStage = "bundle"
+
+// Annotations of the bundle stage.
+const (
+	// BundleAnnotationKey set to "true" asks for the BundleDataKey of the
+	// secret.
+	BundleAnnotationKey = "cert-sync.bygui86.io/bundle"
+	// BundleKeyAnnotationKey set to "true" adds the private key to the
+	// bundle, which is then as sensitive as tls.key.
+	BundleKeyAnnotationKey = "cert-sync.bygui86.io/bundle-include-key"
+	// BundleGeneratedAnnotationKey marks the secrets whose BundleDataKey
+	// the stage wrote, the only ones it removes the key from.
+	BundleGeneratedAnnotationKey = "cert-sync.bygui86.io/bundle-generated"
+)
+
+const (
+	// BundleDataKey is the data key holding the bundle.
+	BundleDataKey = "bundle.pem"
+	// CADataKey holds the issuing CA in the secrets cert-manager writes.
+	CADataKey = "ca.crt"
+	// DefaultBundleMaxBytes caps the size of the bundle; the whole secret
+	// is limited to 1MiB.
+	DefaultBundleMaxBytes = 256 << 10
+)
+
+// BundleConfig holds the settings of the bundle stage.
+type BundleConfig struct {
+	// MaxBytes caps the size of the bundle, DefaultBundleMaxBytes when
+	// zero. A larger one is not written, with a warning.
+	MaxBytes int `json:"maxBytes,omitempty"`
+}
+
+func init() {
+	Register(BundleStage, func(_ Config, raw json.RawMessage) (Stage, error) {
+		var settings BundleConfig
+		if len(raw) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&settings); err != nil {
+				return nil, err
+			}
+		}
+		if settings.MaxBytes < 0 {
+			return nil, fmt.Errorf("maxBytes %d is negative", settings.MaxBytes)
+		}
+		if settings.MaxBytes == 0 {
+			settings.MaxBytes = DefaultBundleMaxBytes
+		}
+		return bundleStage{maxBytes: settings.MaxBytes}, nil
+	})
+}
+
+// bundleStage writes BundleDataKey for the workloads wanting a single PEM
+// file, HAProxy-style: tls.crt, then ca.crt and, when asked for separately,
+// tls.key. It runs on every admission, so the bundle follows its inputs on
+// UPDATE, and removes it once BundleAnnotationKey is gone. Patches already
+// satisfied are dropped by the PatchBuilder, so an unchanged secret gets
+// none.
+type bundleStage struct {
+	maxBytes int
+}
+
+// NeedsData makes the stage a DataStage.
+func (s bundleStage) NeedsData() bool { return true }
+
+func (s bundleStage) Apply(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+	annotations := obj.Secret.Annotations
+	patch := NewPatchBuilder(obj.Secret)
+	if annotations[BundleAnnotationKey] != "true" {
+		if annotations[BundleGeneratedAnnotationKey] != "true" {
+			return nil, nil
+		}
+		patch.RemoveDataKey(BundleDataKey)
+		patch.RemoveAnnotation(BundleGeneratedAnnotationKey)
+		return patch.Operations()
+	}
+	bundle := pemBundle(obj.Secret.Data, annotations[BundleKeyAnnotationKey] == "true")
+	switch {
+	case len(obj.Secret.Data[corev1.TLSCertKey]) == 0:
+		decision.Warnings = append(decision.Warnings, fmt.Sprintf("%s: the secret has no %s yet", BundleDataKey, corev1.TLSCertKey))
+		return nil, nil
+	case len(bundle) > s.maxBytes:
+		decision.Warnings = append(decision.Warnings, fmt.Sprintf("%s: %d bytes, more than the %d allowed, not written", BundleDataKey, len(bundle), s.maxBytes))
+		return nil, nil
+	}
+	patch.AddDataKey(BundleDataKey, bundle)
+	patch.AddAnnotation(BundleGeneratedAnnotationKey, "true")
+	return patch.Operations()
+}
+
+// pemBundle concatenates tls.crt, ca.crt and, with key, tls.key, each
+// ending with a newline. Missing inputs are left out.
+func pemBundle(data map[string][]byte, key bool) []byte {
+	inputs := []string{corev1.TLSCertKey, CADataKey}
+	if key {
+		inputs = append(inputs, corev1.TLSPrivateKeyKey)
+	}
+	var bundle bytes.Buffer
+	for _, input := range inputs {
+		content := bytes.TrimSpace(data[input])
+		if len(content) == 0 {
+			continue
+		}
+		bundle.Write(content)
+		bundle.WriteByte('\n')
+	}
+	return bundle.Bytes()
+}
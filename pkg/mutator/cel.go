@@ -0,0 +1,210 @@
+package mutator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// Rule is a named condition of the policy stage. Secrets the policy lets
+// through are matched against the rules in order and take the name of the
+// first that matches as their Decision.Rule.
+type Rule struct {
+	Name string `json:"name"`
+	// MatchExpression is a CEL expression returning a bool, evaluated over
+	// object.metadata, object.type, request.operation, request.userInfo and
+	// namespaceLabels. A rule without one matches every secret.
+	MatchExpression string `json:"matchExpression,omitempty"`
+	// Profile names the sync profile of the secrets matching the rule.
+	Profile string `json:"profile,omitempty"`
+}
+
+// RuleError is a failure to evaluate the match expression of a rule.
+type RuleError struct {
+	Rule string
+	Err  error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("rule %q: %v", e.Rule, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// The CEL view of an admission. Secret data is deliberately left out.
+type celObject struct {
+	Metadata celMetadata `json:"metadata"`
+	Type     string      `json:"type"`
+}
+
+type celMetadata struct {
+	Name         string            `json:"name"`
+	GenerateName string            `json:"generateName"`
+	Namespace    string            `json:"namespace"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+}
+
+type celRequest struct {
+	Operation string      `json:"operation"`
+	UserInfo  celUserInfo `json:"userInfo"`
+}
+
+type celUserInfo struct {
+	Username string              `json:"username"`
+	UID      string              `json:"uid"`
+	Groups   []string            `json:"groups"`
+	Extra    map[string][]string `json:"extra"`
+}
+
+// how often a running expression checks whether its context is done, in
+// comprehension iterations
+const celInterruptCheckFrequency = 100
+
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		ext.NativeTypes(reflect.TypeOf(celObject{}), reflect.TypeOf(celRequest{}), ext.ParseStructTag("json")),
+		ext.Strings(),
+		cel.Variable("object", cel.ObjectType("mutator.celObject")),
+		cel.Variable("request", cel.ObjectType("mutator.celRequest")),
+		cel.Variable("namespaceLabels", cel.MapType(cel.StringType, cel.StringType)),
+	)
+})
+
+// programs caches compiled expressions, which are immutable, so mutators
+// built again from the same settings don't compile them again.
+var programs sync.Map
+
+// compiledExpression is a match expression ready to evaluate.
+type compiledExpression struct {
+	program         cel.Program
+	readsNamespaces bool // refers to namespaceLabels
+}
+
+// compileExpression parses and type-checks a match expression.
+func compileExpression(expression string) (compiledExpression, error) {
+	if cached, ok := programs.Load(expression); ok {
+		return cached.(compiledExpression), nil
+	}
+	env, err := celEnv()
+	if err != nil {
+		return compiledExpression{}, err
+	}
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return compiledExpression{}, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return compiledExpression{}, fmt.Errorf("expression must return a bool, not %s", ast.OutputType())
+	}
+	program, err := env.Program(ast, cel.InterruptCheckFrequency(celInterruptCheckFrequency))
+	if err != nil {
+		return compiledExpression{}, err
+	}
+	compiled := compiledExpression{program: program}
+	for _, ref := range ast.NativeRep().ReferenceMap() {
+		if ref.Name == "namespaceLabels" {
+			compiled.readsNamespaces = true
+		}
+	}
+	programs.Store(expression, compiled)
+	return compiled, nil
+}
+
+// compiledRule is a Rule with its expression compiled, nil for a rule
+// matching every secret.
+type compiledRule struct {
+	name            string
+	profile         string
+	program         cel.Program
+	readsNamespaces bool
+}
+
+func compileRules(rules []Rule) ([]compiledRule, error) {
+	var compiled []compiledRule
+	names := map[string]bool{}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %q defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+		c := compiledRule{name: rule.Name, profile: rule.Profile}
+		if rule.MatchExpression != "" {
+			expression, err := compileExpression(rule.MatchExpression)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: matchExpression: %w", rule.Name, err)
+			}
+			c.program = expression.program
+			c.readsNamespaces = expression.readsNamespaces
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// celActivation returns the variables the expressions of obj are evaluated
+// against.
+func celActivation(obj AdmissionContext) map[string]interface{} {
+	metadata := obj.Secret.ObjectMeta
+	namespaceLabels := obj.NamespaceLabels
+	if namespaceLabels == nil {
+		namespaceLabels = map[string]string{}
+	}
+	return map[string]interface{}{
+		"object": celObject{
+			Metadata: celMetadata{
+				Name:         metadata.Name,
+				GenerateName: metadata.GenerateName,
+				Namespace:    metadata.Namespace,
+				Labels:       metadata.Labels,
+				Annotations:  metadata.Annotations,
+			},
+			Type: string(obj.Secret.Type),
+		},
+		"request": celRequest{
+			Operation: obj.Operation,
+			UserInfo: celUserInfo{
+				Username: obj.UserInfo.Username,
+				UID:      obj.UserInfo.UID,
+				Groups:   obj.UserInfo.Groups,
+				Extra:    extraValues(obj.UserInfo.Extra),
+			},
+		},
+		"namespaceLabels": namespaceLabels,
+	}
+}
+
+func extraValues(extra map[string]authenticationv1.ExtraValue) map[string][]string {
+	values := make(map[string][]string, len(extra))
+	for key, value := range extra {
+		values[key] = value
+	}
+	return values
+}
+
+// matches evaluates the rule's expression, stopping when ctx is done.
+func (r compiledRule) matches(ctx context.Context, vars map[string]interface{}) (bool, error) {
+	if r.program == nil {
+		return true, nil
+	}
+	out, _, err := r.program.ContextEval(ctx, vars)
+	if err != nil {
+		return false, err
+	}
+	matched, ok := out.Value().(bool)
+	if !ok {
+		return false, errors.New("expression did not return a bool")
+	}
+	return matched, nil
+}
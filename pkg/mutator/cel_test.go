@@ -0,0 +1,186 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// rulesMutator returns a mutator whose policy has the rules.
+func rulesMutator(rules []Rule) (*Mutator, error) {
+	settings, err := json.Marshal(PolicyConfig{Rules: rules})
+	if err != nil {
+		return nil, err
+	}
+	config := DefaultConfig()
+	config.StageConfig = map[string]json.RawMessage{PolicyStage: settings}
+	return New(config)
+}
+
+func TestRuleCompileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		rules []Rule
+		want  string
+	}{
+		{name: "syntax", rules: []Rule{{Name: "broken", MatchExpression: `object.metadata.name ==`}}, want: `rule "broken": matchExpression`},
+		{name: "unknown variable", rules: []Rule{{Name: "secret", MatchExpression: `secret.name == "x"`}}, want: "undeclared reference to 'secret'"},
+		{name: "unknown field", rules: []Rule{{Name: "owner", MatchExpression: `object.metadata.owner == "x"`}}, want: "undefined field 'owner'"},
+		{name: "not a bool", rules: []Rule{{Name: "name", MatchExpression: `object.metadata.name`}}, want: "must return a bool, not string"},
+		{name: "mistyped", rules: []Rule{{Name: "count", MatchExpression: `object.metadata.name > 3`}}, want: `rule "count": matchExpression`},
+		{name: "no name", rules: []Rule{{MatchExpression: "true"}}, want: "rule 0 has no name"},
+		{name: "twice", rules: []Rule{{Name: "a"}, {Name: "a"}}, want: `rule "a" defined twice`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := rulesMutator(tt.rules)
+			if err == nil || !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), PolicyStage) {
+				t.Errorf("error %v, want one of the policy stage containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Compiled expressions are cached by their text and shared by mutators.
+func TestRuleCompileCached(t *testing.T) {
+	const expression = `object.metadata.name.startsWith("cached-")`
+	first, err := compileExpression(expression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := compileExpression(expression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("expression compiled twice")
+	}
+}
+
+// An expression failing on a secret fails its evaluation with a RuleError
+// naming the rule, for the server to answer per the failure policy.
+func TestRuleRuntimeError(t *testing.T) {
+	m, err := rulesMutator([]Rule{
+		{Name: "teams", MatchExpression: `object.metadata.labels["team"] == "payments"`},
+		{Name: "default"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: tlsSecret("apps", "api-tls", nil)})
+	var ruleErr *RuleError
+	if !errors.As(err, &ruleErr) || ruleErr.Rule != "teams" || !strings.Contains(err.Error(), "no such key") || patch != nil {
+		t.Errorf("error %v with patch %v, want a RuleError of teams", err, patch)
+	}
+
+	secret := tlsSecret("apps", "api-tls", nil)
+	secret.Labels = map[string]string{"team": "payments"}
+	if decision, _, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret}); err != nil || decision.Rule != "teams" {
+		t.Errorf("labelled secret matched %q: %v", decision.Rule, err)
+	}
+}
+
+// Expressions see each variable of the environment.
+func TestRuleVariables(t *testing.T) {
+	secret := tlsSecret("apps", "api-tls", map[string]string{"team": "payments"})
+	secret.GenerateName = "api-"
+	secret.Labels = map[string]string{"tier": "web"}
+	admission := AdmissionContext{
+		Operation: "UPDATE",
+		Secret:    secret,
+		UserInfo: authenticationv1.UserInfo{
+			Username: "system:serviceaccount:cert-manager:cert-manager",
+			UID:      "42",
+			Groups:   []string{"system:serviceaccounts"},
+			Extra:    map[string]authenticationv1.ExtraValue{"scopes": {"deploy"}},
+		},
+		NamespaceLabels: map[string]string{"env": "prod"},
+	}
+	for _, expression := range []string{
+		`object.metadata.name == "api-tls"`,
+		`object.metadata.generateName == "api-"`,
+		`object.metadata.namespace == "apps"`,
+		`object.metadata.labels["tier"] == "web"`,
+		`object.metadata.annotations["team"] == "payments"`,
+		`object.type == "kubernetes.io/tls"`,
+		`request.operation == "UPDATE"`,
+		`request.userInfo.username.endsWith(":cert-manager")`,
+		`request.userInfo.uid == "42"`,
+		`"system:serviceaccounts" in request.userInfo.groups`,
+		`request.userInfo.extra["scopes"][0] == "deploy"`,
+		`namespaceLabels["env"] == "prod"`,
+	} {
+		t.Run(expression, func(t *testing.T) {
+			m, err := rulesMutator([]Rule{{Name: "match", MatchExpression: expression}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			decision, _, err := m.Evaluate(context.Background(), admission)
+			if err != nil || decision.Rule != "match" {
+				t.Errorf("matched %q, skipped for %q: %v", decision.Rule, decision.SkipReason, err)
+			}
+			// and the negation doesn't match
+			m, err = rulesMutator([]Rule{{Name: "match", MatchExpression: "!(" + expression + ")"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decision, _, err := m.Evaluate(context.Background(), admission); err != nil || decision.SkipReason != SkipNoRuleMatched {
+				t.Errorf("negation decided %+v: %v", decision, err)
+			}
+		})
+	}
+}
+
+// Rules reading namespaceLabels make the mutator look the namespace up
+// when the labels aren't given.
+func TestRuleNamespaceLabels(t *testing.T) {
+	m, err := rulesMutator([]Rule{{Name: "prod", MatchExpression: `namespaceLabels["env"] == "prod"`}, {Name: "default"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.NeedsNamespaces() {
+		t.Fatal("the namespace labels aren't asked for")
+	}
+	namespaces := fixedNamespaces{"apps": {"env": "prod"}, "dev": {"env": "dev"}}
+	for namespace, rule := range map[string]string{"apps": "prod", "dev": "default"} {
+		decision, _, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: tlsSecret(namespace, "api-tls", nil), Namespaces: namespaces})
+		if err != nil || decision.Rule != rule {
+			t.Errorf("secret of %s matched %q, want %q: %v", namespace, decision.Rule, rule, err)
+		}
+	}
+
+	if plain, err := rulesMutator([]Rule{{Name: "apps", MatchExpression: `object.metadata.namespace == "apps"`}}); err != nil || plain.NeedsNamespaces() {
+		t.Errorf("namespaces asked for by a rule not reading them: %v", err)
+	}
+}
+
+// fixedNamespaces is a NamespaceLister of namespaces by their labels; the
+// others don't exist.
+type fixedNamespaces map[string]map[string]string
+
+func (n fixedNamespaces) Get(name string) (*corev1.Namespace, error) {
+	labels, ok := n[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(corev1.Resource("namespaces"), name)
+	}
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}, nil
+}
+
+// List returns the namespaces selector selects, as client-go's lister,
+// each also labelled with its name as by the API server.
+func (n fixedNamespaces) List(selector labels.Selector) ([]*corev1.Namespace, error) {
+	var namespaces []*corev1.Namespace
+	for name, set := range n {
+		if selector.Matches(labels.Merge(set, labels.Set{namespaceNameLabel: name})) {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: set}})
+		}
+	}
+	return namespaces, nil
+}
@@ -0,0 +1,158 @@
+package mutator
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ChainStage names the stage verifying tls.crt against ca.crt.
+const ChainStage = "verify-chain"
+
+// ChainVerifiedAnnotationKey records whether tls.crt chains to ca.crt,
+// "true" or "false". Secrets without ca.crt don't get it.
+const ChainVerifiedAnnotationKey = "cert-sync.bygui86.io/chain-verified"
+
+// SkipChainUnverified is the reason a strict verify-chain stage skips a
+// secret whose chain doesn't verify.
+const SkipChainUnverified = "chain-unverified"
+
+// ChainConfig holds the settings of the verify-chain stage.
+type ChainConfig struct {
+	// Strict skips the secrets whose chain doesn't verify, so they don't
+	// get the sync annotation, rather than only recording the failure.
+	Strict bool `json:"strict,omitempty"`
+	// RequireCA makes a strict stage skip the secrets without ca.crt too.
+	RequireCA bool `json:"requireCA,omitempty"`
+}
+
+func init() {
+	Register(ChainStage, func(_ Config, raw json.RawMessage) (Stage, error) {
+		var settings ChainConfig
+		if len(raw) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&settings); err != nil {
+				return nil, err
+			}
+		}
+		return chainStage{config: settings}, nil
+	})
+}
+
+// errNoCA is returned by verifyChain for a secret without ca.crt.
+var errNoCA = fmt.Errorf("no %s to verify against", CADataKey)
+
+// chainStage verifies that the leaf of tls.crt chains to ca.crt through
+// the intermediates following it in tls.crt, so that an issuer
+// misconfiguration shows at issuance rather than at the consumers' TLS
+// handshakes. The chain is verified at a time the leaf is valid, so an
+// expired certificate that chains is recorded as verified, with a warning
+// about its expiry. A failure is recorded as "false" with a warning; a
+// secret without ca.crt is only warned about. Placed before
+// sync-annotation, a strict stage skips the failures instead.
+type chainStage struct {
+	config ChainConfig
+}
+
+// NeedsData makes the stage a DataStage.
+func (s chainStage) NeedsData() bool { return true }
+
+func (s chainStage) Apply(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+	leaf, err := verifyChain(obj.Secret.Data, time.Now())
+	if leaf != nil && time.Now().After(leaf.NotAfter) {
+		decision.Warnings = append(decision.Warnings, fmt.Sprintf("%s expired at %s", corev1.TLSCertKey, leaf.NotAfter.UTC().Format(time.RFC3339)))
+	}
+	patch := NewPatchBuilder(obj.Secret)
+	switch {
+	case errors.Is(err, errNoCA):
+		decision.Warnings = append(decision.Warnings, fmt.Sprintf("chain not verified: %s", err))
+		if s.config.Strict && s.config.RequireCA {
+			return skip(decision, SkipChainUnverified)
+		}
+		patch.RemoveAnnotation(ChainVerifiedAnnotationKey)
+	case err != nil:
+		decision.Warnings = append(decision.Warnings, fmt.Sprintf("chain verification failed: %s", err))
+		if s.config.Strict {
+			return skip(decision, SkipChainUnverified)
+		}
+		decision.Annotations[ChainVerifiedAnnotationKey] = "false"
+		patch.AddAnnotation(ChainVerifiedAnnotationKey, "false")
+	default:
+		decision.Annotations[ChainVerifiedAnnotationKey] = "true"
+		patch.AddAnnotation(ChainVerifiedAnnotationKey, "true")
+	}
+	return patch.Operations()
+}
+
+// verifyChain verifies the leaf of tls.crt against the certificates of
+// ca.crt, with the other certificates of tls.crt as intermediates, at now
+// or, when the leaf isn't valid at now, at the nearest end of its validity.
+// It returns the leaf once it parsed, and errNoCA when there is no ca.crt.
+func verifyChain(data map[string][]byte, now time.Time) (*x509.Certificate, error) {
+	chain, err := parseCertificates(data[corev1.TLSCertKey])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", corev1.TLSCertKey, err)
+	}
+	leaf := chain[0]
+	if len(bytes.TrimSpace(data[CADataKey])) == 0 {
+		return leaf, errNoCA
+	}
+	cas, err := parseCertificates(data[CADataKey])
+	if err != nil {
+		return leaf, fmt.Errorf("%s: %w", CADataKey, err)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, ca := range cas {
+		opts.Roots.AddCert(ca)
+	}
+	for _, intermediate := range chain[1:] {
+		opts.Intermediates.AddCert(intermediate)
+	}
+	switch {
+	case now.After(leaf.NotAfter):
+		opts.CurrentTime = leaf.NotAfter
+	case now.Before(leaf.NotBefore):
+		opts.CurrentTime = leaf.NotBefore
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return leaf, err
+	}
+	return leaf, nil
+}
+
+// parseCertificates parses the PEM certificates of content, at least one.
+func parseCertificates(content []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New("no PEM certificate")
+	}
+	return certificates, nil
+}
@@ -0,0 +1,142 @@
+package mutator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// chainSecret returns a secret holding tlsCrt and caCrt, ca.crt left out
+// when empty.
+func chainSecret(tlsCrt, caCrt []byte) *corev1.Secret {
+	secret := tlsSecret("apps", "api-tls", nil)
+	secret.Data = map[string][]byte{corev1.TLSCertKey: tlsCrt, corev1.TLSPrivateKeyKey: []byte("key")}
+	if len(caCrt) > 0 {
+		secret.Data[CADataKey] = caCrt
+	}
+	return secret
+}
+
+// The outcome of the verification of tls.crt against ca.crt is recorded
+// in the annotation, with a warning unless it verified; expiry and a
+// missing ca.crt are told apart from a broken chain.
+func TestChainVerification(t *testing.T) {
+	root := newTestCA(t, "root", nil)
+	intermediate := newTestCA(t, "intermediate", root)
+	other := newTestCA(t, "other root", nil)
+	valid := intermediate.leaf(t, ecKey(t), time.Now().Add(time.Hour), "api.example.com")
+	expired := intermediate.leaf(t, ecKey(t), time.Now().Add(-24*time.Hour), "api.example.com")
+	chained := func(leaf []byte) []byte { return append(append([]byte(nil), leaf...), intermediate.pem...) }
+
+	stage := buildStage(t, ChainStage, DefaultConfig(), nil)
+	for _, tt := range []struct {
+		name     string
+		secret   *corev1.Secret
+		verified string // the annotation, none when empty
+		warnings []string
+	}{
+		{name: "full chain", secret: chainSecret(chained(valid), root.pem), verified: "true"},
+		{name: "intermediate as CA", secret: chainSecret(valid, intermediate.pem), verified: "true"},
+		{name: "one of several CAs", secret: chainSecret(chained(valid), append(append([]byte(nil), other.pem...), root.pem...)), verified: "true"},
+		{name: "missing intermediate", secret: chainSecret(valid, root.pem), verified: "false",
+			warnings: []string{"chain verification failed: x509: certificate signed by unknown authority"}},
+		{name: "wrong CA", secret: chainSecret(chained(valid), other.pem), verified: "false",
+			warnings: []string{"chain verification failed: x509: certificate signed by unknown authority"}},
+		{name: "expired but chaining", secret: chainSecret(chained(expired), root.pem), verified: "true", warnings: []string{"tls.crt expired at "}},
+		{name: "expired and wrong CA", secret: chainSecret(chained(expired), other.pem), verified: "false",
+			warnings: []string{"tls.crt expired at ", "chain verification failed"}},
+		{name: "no ca.crt", secret: chainSecret(chained(valid), nil), warnings: []string{"chain not verified: no ca.crt to verify against"}},
+		{name: "garbage tls.crt", secret: chainSecret([]byte("garbage"), root.pem), verified: "false",
+			warnings: []string{"chain verification failed: tls.crt: no PEM certificate"}},
+		{name: "garbage ca.crt", secret: chainSecret(chained(valid), []byte("garbage")), verified: "false",
+			warnings: []string{"chain verification failed: ca.crt: no PEM certificate"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, patched, decision := applyStage(t, stage, tt.secret)
+			got, ok := patched.Annotations[ChainVerifiedAnnotationKey]
+			if got != tt.verified || ok != (tt.verified != "") {
+				t.Errorf("annotated %q (%v), want %q", got, ok, tt.verified)
+			}
+			if decision.Annotations[ChainVerifiedAnnotationKey] != tt.verified {
+				t.Errorf("decided %q, want %q", decision.Annotations[ChainVerifiedAnnotationKey], tt.verified)
+			}
+			if len(decision.Warnings) != len(tt.warnings) {
+				t.Fatalf("warnings %q, want %q", decision.Warnings, tt.warnings)
+			}
+			for i, want := range tt.warnings {
+				if !strings.Contains(decision.Warnings[i], want) {
+					t.Errorf("warning %q, want %q", decision.Warnings[i], want)
+				}
+			}
+		})
+	}
+
+	// a recorded outcome goes once ca.crt does, and the same outcome
+	// again doesn't patch
+	_, verified, _ := applyStage(t, stage, chainSecret(chained(valid), root.pem))
+	if patch, _, _ := applyStage(t, stage, verified); patch != nil {
+		t.Errorf("verified secret patched again with %+v", patch)
+	}
+	delete(verified.Data, CADataKey)
+	if _, patched, _ := applyStage(t, stage, verified); patched.Annotations[ChainVerifiedAnnotationKey] != "" {
+		t.Errorf("outcome %q left without ca.crt", patched.Annotations[ChainVerifiedAnnotationKey])
+	}
+}
+
+// Placed before sync-annotation, a strict stage keeps the secrets whose
+// chain doesn't verify from being synced, and with requireCA those without
+// ca.crt; otherwise they are synced with the failure recorded.
+func TestChainStrict(t *testing.T) {
+	root := newTestCA(t, "root", nil)
+	other := newTestCA(t, "other root", nil)
+	leaf := root.leaf(t, ecKey(t), time.Now().Add(time.Hour), "api.example.com")
+	chain := func(settings string) *Mutator {
+		t.Helper()
+		config := DefaultConfig()
+		config.Stages = []string{PolicyStage, ChainStage, SyncAnnotationStage}
+		config.StageConfig = map[string]json.RawMessage{ChainStage: json.RawMessage(settings)}
+		m, err := New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	for _, tt := range []struct {
+		settings string
+		secret   *corev1.Secret
+		synced   bool
+	}{
+		{settings: `{}`, secret: chainSecret(leaf, other.pem), synced: true},
+		{settings: `{"strict":true}`, secret: chainSecret(leaf, other.pem)},
+		{settings: `{"strict":true}`, secret: chainSecret(leaf, root.pem), synced: true},
+		{settings: `{"strict":true}`, secret: chainSecret(leaf, nil), synced: true},
+		{settings: `{"strict":true,"requireCA":true}`, secret: chainSecret(leaf, nil)},
+		{settings: `{"requireCA":true}`, secret: chainSecret(leaf, nil), synced: true},
+	} {
+		decision, patch, err := chain(tt.settings).Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: tt.secret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tt.synced {
+			if patch != nil || decision.Mutate || decision.SkipReason != SkipChainUnverified || len(decision.Warnings) != 1 {
+				t.Errorf("%s, ca.crt %v: decided %+v with patch %v, want skipped", tt.settings, bytes.Contains(tt.secret.Data[CADataKey], []byte("BEGIN")), decision, patch)
+			}
+			continue
+		}
+		if patched := applyPatch(t, tt.secret, patch); patched.Annotations[SyncAnnotationKey] != "true" {
+			t.Errorf("%s: not synced, annotations %v", tt.settings, patched.Annotations)
+		}
+	}
+
+	config := DefaultConfig()
+	config.Stages = []string{PolicyStage, ChainStage}
+	config.StageConfig = map[string]json.RawMessage{ChainStage: json.RawMessage(`{"stric":true}`)}
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), ChainStage) {
+		t.Errorf("unknown setting: error %v, want one of %s", err, ChainStage)
+	}
+}
@@ -0,0 +1,56 @@
+package mutator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DecisionAnnotationKey records which rule decided the sync annotation of a
+// secret and by which settings, "<rule>@<config hash>", so that unexpected
+// targets can be traced back without the logs. It is written with the sync
+// annotation.
+const DecisionAnnotationKey = "cert-sync.bygui86.io/decision"
+
+// ConfigHash returns the short hash identifying the settings of config that
+// decide the patches, the one recorded in DecisionAnnotationKey.
+func ConfigHash(config Config) string {
+	config.RewriteDecisionOnConfigChange = false
+	content, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:4])
+}
+
+// ParseDecision splits a value of DecisionAnnotationKey into the rule and the
+// config hash, false when it isn't one.
+func ParseDecision(value string) (rule, hash string, ok bool) {
+	i := strings.LastIndex(value, "@")
+	if i <= 0 {
+		return "", "", false
+	}
+	return value[:i], value[i+1:], true
+}
+
+// decisionValue returns the value of DecisionAnnotationKey for secret
+// mutated by rule, and whether it is the one of the current settings rather
+// than the value recorded on the secret. A secret recorded with the same rule
+// under other settings keeps its value, so a change of settings that leaves
+// the decision as it was doesn't patch every secret, unless the Mutator
+// rewrites decisions on config changes.
+func (m *Mutator) decisionValue(secret *corev1.Secret, rule string) (string, bool) {
+	value := rule + "@" + m.configHash
+	if m.rewriteDecision {
+		return value, true
+	}
+	recorded := secret.Annotations[DecisionAnnotationKey]
+	if recordedRule, _, ok := ParseDecision(recorded); ok && recordedRule == rule {
+		return recorded, recorded == value
+	}
+	return value, true
+}
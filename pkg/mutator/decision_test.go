@@ -0,0 +1,120 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ruleConfig returns the default config with the rules production, for
+// namespaces prod-*, wildcards, for names wildcard-*, and a catch-all
+// default.
+func ruleConfig(t *testing.T) Config {
+	t.Helper()
+	settings, err := json.Marshal(PolicyConfig{Rules: []Rule{
+		{Name: "production", MatchExpression: `object.metadata.namespace.startsWith("prod-")`},
+		{Name: "wildcards", MatchExpression: `object.metadata.name.startsWith("wildcard-")`},
+		{Name: "default"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.StageConfig = map[string]json.RawMessage{PolicyStage: settings}
+	return config
+}
+
+// evaluate returns the decision annotation m sets on secret.
+func evaluate(t *testing.T, m *Mutator, secret *corev1.Secret) string {
+	t.Helper()
+	decision, _, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decision.Mutate {
+		t.Fatalf("secret %s/%s skipped: %s", secret.Namespace, secret.Name, decision.SkipReason)
+	}
+	return decision.Annotations[DecisionAnnotationKey]
+}
+
+func TestDecisionAnnotation(t *testing.T) {
+	config := ruleConfig(t)
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := ConfigHash(config)
+	tests := []struct {
+		namespace, name, rule string
+	}{
+		{"prod-payments", "api-tls", "production"},
+		{"prod-payments", "wildcard-tls", "production"},
+		{"apps", "wildcard-tls", "wildcards"},
+		{"apps", "api-tls", "default"},
+	}
+	for _, tt := range tests {
+		value := evaluate(t, m, tlsSecret(tt.namespace, tt.name, nil))
+		if want := tt.rule + "@" + hash; value != want {
+			t.Errorf("%s/%s recorded as %q, want %q", tt.namespace, tt.name, value, want)
+		}
+		rule, recordedHash, ok := ParseDecision(value)
+		if !ok || rule != tt.rule || recordedHash != hash {
+			t.Errorf("ParseDecision(%q) = %q, %q, %v", value, rule, recordedHash, ok)
+		}
+	}
+}
+
+func TestDecisionConfigChange(t *testing.T) {
+	config := ruleConfig(t)
+	recorded := map[string]string{DecisionAnnotationKey: "default@0badc0de"}
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := evaluate(t, m, tlsSecret("apps", "api-tls", recorded)); value != "default@0badc0de" {
+		t.Errorf("decision rewritten to %q on a config change alone", value)
+	}
+	if value, want := evaluate(t, m, tlsSecret("prod-payments", "api-tls", recorded)), "production@"+ConfigHash(config); value != want {
+		t.Errorf("decision %q after a change of rule, want %q", value, want)
+	}
+
+	config.RewriteDecisionOnConfigChange = true
+	m, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, want := evaluate(t, m, tlsSecret("apps", "api-tls", recorded)), "default@"+ConfigHash(config); value != want {
+		t.Errorf("decision %q with rewrites on config changes, want %q", value, want)
+	}
+}
+
+// Decisions recorded on secrets, whatever their writers put in them, don't
+// grow the cache of precomputed patches beyond one per rule.
+func TestDecisionCacheBounded(t *testing.T) {
+	m, err := New(ruleConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.static == nil {
+		t.Fatal("the default stages are not precomputed")
+	}
+	for i := 0; i < 1000; i++ {
+		recorded := map[string]string{DecisionAnnotationKey: fmt.Sprintf("default@%08x", i)}
+		if value, want := evaluate(t, m, tlsSecret("apps", "api-tls", recorded)), recorded[DecisionAnnotationKey]; value != want {
+			t.Fatalf("decision %q, want the recorded %q kept", value, want)
+		}
+	}
+	evaluate(t, m, tlsSecret("prod-payments", "api-tls", nil))
+	evaluate(t, m, tlsSecret("apps", "api-tls", nil))
+	cached := 0
+	m.static.decisions.Range(func(any, any) bool {
+		cached++
+		return true
+	})
+	if cached > 3 {
+		t.Errorf("%d decisions cached, want at most one per rule", cached)
+	}
+}
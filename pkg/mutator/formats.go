@@ -0,0 +1,167 @@
+package mutator
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// FormatsStage names the stage writing the data in other encodings.
+const FormatsStage = "formats"
+
+// Annotations of the formats stage.
+const (
+	// FormatsAnnotationKey lists the encodings to add to the secret,
+	// comma-separated, e.g. "der,pkcs8".
+	FormatsAnnotationKey = "cert-sync.bygui86.io/formats"
+	// FormatsGeneratedAnnotationKey lists the encodings the stage wrote,
+	// the only ones it removes once they are no longer asked for.
+	FormatsGeneratedAnnotationKey = "cert-sync.bygui86.io/formats-generated"
+)
+
+// The encodings of the formats stage.
+const (
+	// FormatDER is the leaf certificate of tls.crt in DER, under
+	// DERDataKey.
+	FormatDER = "der"
+	// FormatPKCS8 is tls.key as a DER PKCS#8 key, under PKCS8DataKey.
+	FormatPKCS8 = "pkcs8"
+)
+
+// Data keys written by the formats stage.
+const (
+	DERDataKey   = "tls.der"
+	PKCS8DataKey = "key.pk8"
+)
+
+// formatConverters convert the secret's data to each format, under its key.
+var formatConverters = map[string]struct {
+	key     string
+	convert func(data map[string][]byte) ([]byte, error)
+}{
+	FormatDER:   {DERDataKey, certificateDER},
+	FormatPKCS8: {PKCS8DataKey, privateKeyPKCS8},
+}
+
+func init() {
+	Register(FormatsStage, func(Config, json.RawMessage) (Stage, error) {
+		return formatsStage{}, nil
+	})
+}
+
+// formatsStage adds the certificate and key in the encodings listed by
+// FormatsAnnotationKey, for appliances that don't read PEM, leaving tls.crt
+// and tls.key as they are. Input that doesn't parse is refused with a
+// warning, and the key of that format left as it is. The conversions are
+// deterministic, so a secret whose inputs didn't change gets no patch.
+type formatsStage struct{}
+
+// NeedsData makes the stage a DataStage.
+func (s formatsStage) NeedsData() bool { return true }
+
+func (s formatsStage) Apply(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+	annotations := obj.Secret.Annotations
+	wanted := formatList(annotations[FormatsAnnotationKey])
+	generated := formatList(annotations[FormatsGeneratedAnnotationKey])
+	if len(wanted) == 0 && len(generated) == 0 {
+		return nil, nil
+	}
+	patch := NewPatchBuilder(obj.Secret)
+	written := map[string]bool{}
+	for _, format := range generated {
+		if converter, ok := formatConverters[format]; ok && !slices.Contains(wanted, format) {
+			patch.RemoveDataKey(converter.key)
+		}
+	}
+	for _, format := range wanted {
+		converter, ok := formatConverters[format]
+		if !ok {
+			decision.Warnings = append(decision.Warnings, fmt.Sprintf("%s: unknown format %q, known: %s, %s", FormatsAnnotationKey, format, FormatDER, FormatPKCS8))
+			continue
+		}
+		converted, err := converter.convert(obj.Secret.Data)
+		if err != nil {
+			decision.Warnings = append(decision.Warnings, fmt.Sprintf("%s: not written: %s", converter.key, err))
+			if slices.Contains(generated, format) {
+				written[format] = true // left as it is
+			}
+			continue
+		}
+		patch.AddDataKey(converter.key, converted)
+		written[format] = true
+	}
+	if len(written) == 0 {
+		patch.RemoveAnnotation(FormatsGeneratedAnnotationKey)
+	} else {
+		formats := make([]string, 0, len(written))
+		for format := range written {
+			formats = append(formats, format)
+		}
+		sort.Strings(formats)
+		patch.AddAnnotation(FormatsGeneratedAnnotationKey, strings.Join(formats, ","))
+	}
+	return patch.Operations()
+}
+
+// formatList splits a comma-separated list of formats.
+func formatList(value string) []string {
+	var formats []string
+	for _, format := range strings.Split(value, ",") {
+		if format = strings.ToLower(strings.TrimSpace(format)); format != "" && !slices.Contains(formats, format) {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+// certificateDER returns the leaf certificate of tls.crt in DER, checked to
+// parse.
+func certificateDER(data map[string][]byte) ([]byte, error) {
+	block, _ := pem.Decode(data[corev1.TLSCertKey])
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate in %s", corev1.TLSCertKey)
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", corev1.TLSCertKey, err)
+	}
+	return block.Bytes, nil
+}
+
+// privateKeyPKCS8 returns tls.key, PKCS#1, SEC 1 or PKCS#8 PEM, as a DER
+// PKCS#8 key.
+func privateKeyPKCS8(data map[string][]byte) ([]byte, error) {
+	block, _ := pem.Decode(data[corev1.TLSPrivateKeyKey])
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key in %s", corev1.TLSPrivateKeyKey)
+	}
+	var (
+		key any
+		err error
+	)
+	switch block.Type {
+	case "PRIVATE KEY":
+		// already PKCS#8, checked to parse
+		if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", corev1.TLSPrivateKeyKey, err)
+		}
+		return block.Bytes, nil
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		err = errors.New("unsupported PEM type " + block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", corev1.TLSPrivateKeyKey, err)
+	}
+	return x509.MarshalPKCS8PrivateKey(key)
+}
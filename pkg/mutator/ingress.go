@@ -0,0 +1,226 @@
+package mutator
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// IngressTargetsStage names the stage syncing secrets to the namespaces of
+// the Ingresses serving their hosts.
+const IngressTargetsStage = "ingress-targets"
+
+// DefaultIngressMaxTargets caps the namespaces the ingress-targets stage
+// syncs a secret to.
+const DefaultIngressMaxTargets = 50
+
+// What the ingress-targets stage does when no Ingress serves the hosts of a
+// secret.
+const (
+	// NoIngressFallback syncs the secret to the cluster default, with a
+	// warning.
+	NoIngressFallback = "fallback"
+	// NoIngressSkip leaves the secret alone, with reason SkipNoIngressMatched.
+	NoIngressSkip = "skip"
+)
+
+// IngressLister lists Ingresses from a cache, which may lag behind the API
+// server; client-go's IngressLister is one.
+type IngressLister interface {
+	List(selector labels.Selector) ([]*networkingv1.Ingress, error)
+}
+
+// IngressStage is implemented by stages that read Ingresses through
+// AdmissionContext.Ingresses. The server only runs its Ingress cache when a
+// stage of the Mutator needs it.
+type IngressStage interface {
+	Stage
+	// NeedsIngresses reports whether the stage reads Ingresses.
+	NeedsIngresses() bool
+}
+
+// IngressTargetsConfig holds the settings of the ingress-targets stage.
+type IngressTargetsConfig struct {
+	// FromCertificate takes the hosts from the dnsNames of the owning
+	// Certificate rather than from the SANs of tls.crt, so that the stage
+	// doesn't need the secret's data.
+	FromCertificate bool `json:"fromCertificate,omitempty"`
+	// MaxTargets caps the namespaces; DefaultIngressMaxTargets when zero.
+	// More is treated like a failure to resolve them.
+	MaxTargets int `json:"maxTargets,omitempty"`
+	// OnNoMatch is NoIngressFallback, the default, or NoIngressSkip.
+	OnNoMatch string `json:"onNoMatch,omitempty"`
+}
+
+func init() {
+	Register(IngressTargetsStage, func(c Config, raw json.RawMessage) (Stage, error) {
+		var settings IngressTargetsConfig
+		if len(raw) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&settings); err != nil {
+				return nil, err
+			}
+		}
+		switch settings.OnNoMatch {
+		case "":
+			settings.OnNoMatch = NoIngressFallback
+		case NoIngressFallback, NoIngressSkip:
+		default:
+			return nil, fmt.Errorf("onNoMatch %q is neither %q nor %q", settings.OnNoMatch, NoIngressFallback, NoIngressSkip)
+		}
+		if settings.MaxTargets < 0 {
+			return nil, fmt.Errorf("maxTargets %d is negative", settings.MaxTargets)
+		}
+		if settings.MaxTargets == 0 {
+			settings.MaxTargets = DefaultIngressMaxTargets
+		}
+		return ingressTargetsStage{config: settings, cluster: c}, nil
+	})
+}
+
+// errNoIngress is returned by ingressTargetsStage.targets when no Ingress
+// serves the hosts.
+var errNoIngress = errors.New("no Ingress serves its hosts")
+
+// ingressTargetsStage sets the sync annotation to the namespaces holding an
+// Ingress whose spec.tls hosts are among the secret's hosts, in place of the
+// sync-annotation stage. It runs on every admission, so an UPDATE, e.g. a
+// renewal, refreshes the targets. When they can't be resolved the secret is
+// synced to the cluster default, with a warning; when no Ingress matches it
+// is too, or skipped, per OnNoMatch.
+type ingressTargetsStage struct {
+	config  IngressTargetsConfig
+	cluster Config // the default sync value and the cap
+}
+
+// NeedsIngresses makes the stage an IngressStage.
+func (s ingressTargetsStage) NeedsIngresses() bool { return true }
+
+// NeedsData makes the stage a DataStage unless the hosts are taken from the
+// Certificate.
+func (s ingressTargetsStage) NeedsData() bool { return !s.config.FromCertificate }
+
+// NeedsCertificates makes the stage a CertificateStage when the hosts are
+// taken from the Certificate.
+func (s ingressTargetsStage) NeedsCertificates() bool { return s.config.FromCertificate }
+
+func (s ingressTargetsStage) Apply(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+	value, err := s.targets(obj)
+	switch {
+	case errors.Is(err, errNoIngress) && s.config.OnNoMatch == NoIngressSkip:
+		return skip(decision, SkipNoIngressMatched)
+	case err != nil:
+		value = s.cluster.NamespaceSelector
+		decision.Warnings = append(decision.Warnings, fmt.Sprintf("%s; syncing to the default %q", err, value))
+	}
+	return setSyncAnnotation(obj, s.cluster, decision, value)
+}
+
+// targets returns the sync value selecting the namespaces of the Ingresses
+// serving the secret's hosts.
+func (s ingressTargetsStage) targets(obj AdmissionContext) (string, error) {
+	if obj.Ingresses == nil {
+		return "", errors.New("no Ingress cache")
+	}
+	hosts, err := s.hosts(obj)
+	if err != nil {
+		return "", err
+	}
+	ingresses, err := obj.Ingresses.List(labels.Everything())
+	if err != nil {
+		return "", fmt.Errorf("listing Ingresses: %w", err)
+	}
+	seen := map[string]bool{}
+	for _, ingress := range ingresses {
+		if seen[ingress.Namespace] || !servesAny(ingress, hosts) {
+			continue
+		}
+		if len(validation.IsDNS1123Label(ingress.Namespace)) > 0 {
+			continue
+		}
+		seen[ingress.Namespace] = true
+	}
+	switch {
+	case len(seen) == 0:
+		return "", errNoIngress
+	case len(seen) > s.config.MaxTargets:
+		return "", fmt.Errorf("%d namespaces have Ingresses serving its hosts, more than the %d allowed", len(seen), s.config.MaxTargets)
+	}
+	targets := make([]string, 0, len(seen))
+	for target := range seen {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return NamespaceNameSelector(targets), nil
+}
+
+// hosts returns the DNS names the secret's certificate is valid for, from
+// the Certificate or the leaf of tls.crt.
+func (s ingressTargetsStage) hosts(obj AdmissionContext) ([]string, error) {
+	if s.config.FromCertificate {
+		name := obj.Secret.Annotations[CertManagerAnnotationKey]
+		if name == "" {
+			return nil, fmt.Errorf("secret has no %s annotation to find its Certificate by", CertManagerAnnotationKey)
+		}
+		if obj.Certificates == nil {
+			return nil, fmt.Errorf("certificate %s: no Certificate cache", name)
+		}
+		hosts, err := obj.Certificates.DNSNames(obj.Secret.Namespace, name)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %s: %w", name, err)
+		}
+		return hosts, nil
+	}
+	block, _ := pem.Decode(obj.Secret.Data[corev1.TLSCertKey])
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate in %s", corev1.TLSCertKey)
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", corev1.TLSCertKey, err)
+	}
+	return certificate.DNSNames, nil
+}
+
+// servesAny reports whether one of the TLS hosts of ingress is covered by
+// one of names, which may be wildcards.
+func servesAny(ingress *networkingv1.Ingress, names []string) bool {
+	for _, tls := range ingress.Spec.TLS {
+		for _, host := range tls.Hosts {
+			for _, name := range names {
+				if hostMatches(name, host) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// hostMatches reports whether the certificate name covers host: they are
+// equal, or name is a wildcard *.suffix and host is one label under suffix.
+// A wildcard host is only covered by the same wildcard.
+func hostMatches(name, host string) bool {
+	name, host = strings.ToLower(name), strings.ToLower(host)
+	if name == host {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(name, "*.")
+	if !ok || strings.HasPrefix(host, "*.") {
+		return false
+	}
+	label, rest, ok := strings.Cut(host, ".")
+	return ok && label != "" && rest == suffix
+}
@@ -0,0 +1,215 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// fixedIngresses is an IngressLister of the Ingresses.
+type fixedIngresses []*networkingv1.Ingress
+
+func (i fixedIngresses) List(labels.Selector) ([]*networkingv1.Ingress, error) {
+	return i, nil
+}
+
+// ingress returns the Ingress namespace/name serving hosts over TLS.
+func ingress(namespace, name string, hosts ...string) *networkingv1.Ingress {
+	return &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       networkingv1.IngressSpec{TLS: []networkingv1.IngressTLS{{Hosts: hosts, SecretName: name + "-tls"}}},
+	}
+}
+
+// ingressTargetsMutator returns a mutator syncing to the namespaces of the
+// Ingresses with the ingress-targets settings.
+func ingressTargetsMutator(t *testing.T, settings IngressTargetsConfig) *Mutator {
+	t.Helper()
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.Stages = []string{PolicyStage, IngressTargetsStage}
+	config.StageConfig = map[string]json.RawMessage{IngressTargetsStage: raw}
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestHostMatches(t *testing.T) {
+	for _, tt := range []struct {
+		name, host string
+		want       bool
+	}{
+		{name: "shop.example.com", host: "shop.example.com", want: true},
+		{name: "Shop.Example.com", host: "shop.example.COM", want: true},
+		{name: "*.example.com", host: "shop.example.com", want: true},
+		{name: "*.example.com", host: "*.example.com", want: true},
+		{name: "*.example.com", host: "a.shop.example.com"},
+		{name: "*.example.com", host: "example.com"},
+		{name: "*.example.com", host: ".example.com"},
+		{name: "shop.example.com", host: "*.example.com"},
+		{name: "*.shop.example.com", host: "*.example.com"},
+		{name: "shop.example.com", host: "shop.example.org"},
+	} {
+		if got := hostMatches(tt.name, tt.host); got != tt.want {
+			t.Errorf("hostMatches(%q, %q) = %v, want %v", tt.name, tt.host, got, tt.want)
+		}
+	}
+}
+
+// The sync annotation selects exactly the namespaces of the Ingresses
+// serving the hosts of tls.crt, wildcards covering the hosts one label
+// under them, within the cap.
+func TestIngressTargets(t *testing.T) {
+	ca := newTestCA(t, "root", nil)
+	ingresses := fixedIngresses{
+		ingress("shop", "web", "shop.example.com"),
+		ingress("shop", "admin", "admin.shop.example.com"),
+		ingress("payments", "api", "api.payments.example.com", "shop.example.com"),
+		ingress("edge", "catch-all", "*.example.com"),
+		ingress("blog", "blog", "blog.example.org"),
+		{ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "plain"}, Spec: networkingv1.IngressSpec{}},
+	}
+	secretFor := func(dnsNames ...string) *corev1.Secret {
+		secret := tlsSecret("apps", "api-tls", nil)
+		secret.Data = map[string][]byte{corev1.TLSCertKey: ca.leaf(t, ecKey(t), time.Now().Add(time.Hour), dnsNames...), corev1.TLSPrivateKeyKey: []byte("key")}
+		return secret
+	}
+	evaluate := func(m *Mutator, secret *corev1.Secret, operation string) (Decision, string) {
+		t.Helper()
+		decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: operation, Secret: secret, Ingresses: ingresses})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if patch == nil {
+			return decision, ""
+		}
+		return decision, applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]
+	}
+	m := ingressTargetsMutator(t, IngressTargetsConfig{})
+	if !m.NeedsIngresses() || !m.NeedsData() || m.NeedsCertificates() {
+		t.Fatal("ingress-targets doesn't ask for the Ingresses and the data only")
+	}
+
+	for _, tt := range []struct {
+		name     string
+		dnsNames []string
+		want     string
+	}{
+		{name: "one host", dnsNames: []string{"shop.example.com"}, want: "kubernetes.io/metadata.name in (payments,shop)"},
+		{name: "multi-SAN", dnsNames: []string{"admin.shop.example.com", "blog.example.org"}, want: "kubernetes.io/metadata.name in (blog,shop)"},
+		{name: "wildcard", dnsNames: []string{"*.example.com"}, want: "kubernetes.io/metadata.name in (edge,payments,shop)"},
+		{name: "wildcard one label down", dnsNames: []string{"*.shop.example.com"}, want: "kubernetes.io/metadata.name in (shop)"},
+	} {
+		decision, got := evaluate(m, secretFor(tt.dnsNames...), "CREATE")
+		if got != tt.want || len(decision.Warnings) != 0 {
+			t.Errorf("%s: synced to %q with warnings %q, want %q", tt.name, got, decision.Warnings, tt.want)
+		}
+	}
+
+	// refreshed on UPDATE, e.g. a renewal for other hosts
+	renewed := secretFor("blog.example.org")
+	renewed.Annotations[SyncAnnotationKey] = "kubernetes.io/metadata.name in (payments,shop)"
+	if _, got := evaluate(m, renewed, "UPDATE"); got != "kubernetes.io/metadata.name in (blog)" {
+		t.Errorf("renewed secret synced to %q, want blog", got)
+	}
+
+	// over the cap, or unresolved: the default, with a warning
+	capped := ingressTargetsMutator(t, IngressTargetsConfig{MaxTargets: 2})
+	for name, tt := range map[string]struct {
+		m       *Mutator
+		secret  *corev1.Secret
+		warning string
+	}{
+		"over the cap": {m: capped, secret: secretFor("*.example.com"), warning: "3 namespaces have Ingresses serving its hosts, more than the 2 allowed"},
+		"not a certificate": {m: m, secret: func() *corev1.Secret {
+			secret := secretFor("shop.example.com")
+			secret.Data[corev1.TLSCertKey] = []byte("garbage")
+			return secret
+		}(), warning: "no certificate in tls.crt"},
+	} {
+		decision, got := evaluate(tt.m, tt.secret, "CREATE")
+		if got != "true" || len(decision.Warnings) != 1 || !strings.Contains(decision.Warnings[0], tt.warning) {
+			t.Errorf("%s: synced to %q with warnings %q, want the default saying %q", name, got, decision.Warnings, tt.warning)
+		}
+	}
+}
+
+// When no Ingress serves the hosts, the secret is synced to the default
+// with a warning, or skipped, as configured.
+func TestIngressTargetsNoMatch(t *testing.T) {
+	ca := newTestCA(t, "root", nil)
+	secret := tlsSecret("apps", "api-tls", nil)
+	secret.Data = map[string][]byte{corev1.TLSCertKey: ca.leaf(t, ecKey(t), time.Now().Add(time.Hour), "internal.example.net")}
+	ingresses := fixedIngresses{ingress("shop", "web", "shop.example.com")}
+
+	m := ingressTargetsMutator(t, IngressTargetsConfig{OnNoMatch: NoIngressFallback})
+	decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret, Ingresses: ingresses})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]; got != "true" || len(decision.Warnings) != 1 ||
+		!strings.Contains(decision.Warnings[0], "no Ingress serves its hosts") {
+		t.Errorf("fallback synced to %q with warnings %q", got, decision.Warnings)
+	}
+
+	m = ingressTargetsMutator(t, IngressTargetsConfig{OnNoMatch: NoIngressSkip})
+	decision, patch, err = m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret, Ingresses: ingresses})
+	if err != nil || patch != nil || decision.Mutate || decision.SkipReason != SkipNoIngressMatched {
+		t.Errorf("skip decided %+v with patch %v: %v", decision, patch, err)
+	}
+
+	for name, raw := range map[string]string{
+		"unknown onNoMatch": `{"onNoMatch":"ignore"}`,
+		"negative cap":      `{"maxTargets":-1}`,
+		"unknown field":     `{"fromCert":true}`,
+	} {
+		config := DefaultConfig()
+		config.Stages = []string{PolicyStage, IngressTargetsStage}
+		config.StageConfig = map[string]json.RawMessage{IngressTargetsStage: json.RawMessage(raw)}
+		if _, err := New(config); err == nil || !strings.Contains(err.Error(), IngressTargetsStage) {
+			t.Errorf("%s: error %v, want one of %s", name, err, IngressTargetsStage)
+		}
+	}
+}
+
+// With fromCertificate the hosts are the Certificate's dnsNames, and the
+// secret's data isn't needed.
+func TestIngressTargetsFromCertificate(t *testing.T) {
+	m := ingressTargetsMutator(t, IngressTargetsConfig{FromCertificate: true})
+	if m.NeedsData() || !m.NeedsCertificates() {
+		t.Fatal("fromCertificate reads the data, or not the Certificates")
+	}
+	secret := tlsSecret("apps", "api-tls", nil)
+	obj := AdmissionContext{Operation: "CREATE", Secret: secret,
+		Ingresses:    fixedIngresses{ingress("shop", "web", "shop.example.com"), ingress("blog", "blog", "blog.example.org")},
+		Certificates: fixedCertificates{"apps/api-tls": {"shop.example.com"}},
+	}
+	decision, patch, err := m.Evaluate(context.Background(), obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]; got != "kubernetes.io/metadata.name in (shop)" || len(decision.Warnings) != 0 {
+		t.Errorf("synced to %q with warnings %q", got, decision.Warnings)
+	}
+
+	obj.Certificates = fixedCertificates{}
+	decision, patch, err = m.Evaluate(context.Background(), obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]; got != "true" || len(decision.Warnings) != 1 {
+		t.Errorf("unknown Certificate synced to %q with warnings %q, want the default with one", got, decision.Warnings)
+	}
+}
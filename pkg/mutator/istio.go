@@ -0,0 +1,102 @@
+package mutator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// IstioGatewayStage names the stage adding the Istio namespace to the sync
+// targets of gateway certificates.
+const IstioGatewayStage = "istio-gateway"
+
+// IstioGatewayAnnotationKey set to "true" marks a secret an Istio Gateway
+// refers to by credentialName, which must be copied to the Istio namespace.
+const IstioGatewayAnnotationKey = "cert-sync.bygui86.io/istio-gateway"
+
+// DefaultIstioNamespace is where Istio's gateways read their credentials.
+const DefaultIstioNamespace = "istio-system"
+
+// namespaceNameLabel is the label the API server sets on every namespace,
+// to its name.
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+// IstioGatewayConfig holds the settings of the istio-gateway stage.
+type IstioGatewayConfig struct {
+	// Namespace is the namespace of the gateways, e.g. istio-ingress;
+	// DefaultIstioNamespace when empty.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+func init() {
+	Register(IstioGatewayStage, func(_ Config, raw json.RawMessage) (Stage, error) {
+		var settings IstioGatewayConfig
+		if len(raw) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&settings); err != nil {
+				return nil, err
+			}
+		}
+		if settings.Namespace == "" {
+			settings.Namespace = DefaultIstioNamespace
+		}
+		if errs := validation.IsDNS1123Label(settings.Namespace); len(errs) > 0 {
+			return nil, fmt.Errorf("namespace %q: %v", settings.Namespace, errs)
+		}
+		return istioGatewayStage{namespace: settings.Namespace}, nil
+	})
+}
+
+// istioGatewayStage adds the Istio namespace to Decision.SyncNamespaces for
+// the secrets annotated IstioGatewayAnnotationKey, which the targeting
+// stage after it adds to its own targets. It patches nothing itself.
+type istioGatewayStage struct {
+	namespace string
+}
+
+func (s istioGatewayStage) Apply(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+	if obj.Secret.Annotations[IstioGatewayAnnotationKey] == "true" && !slices.Contains(decision.SyncNamespaces, s.namespace) {
+		decision.SyncNamespaces = append(decision.SyncNamespaces, s.namespace)
+	}
+	return nil, nil
+}
+
+// composeSyncValue returns the sync value selecting the namespaces value
+// does and namespaces too. "true" and empty select every namespace already;
+// a selection by namespace name is extended. Any other selector can't
+// select more without selecting other namespaces, so it is returned as it
+// is, with an error.
+func composeSyncValue(value string, namespaces []string) (string, error) {
+	if len(namespaces) == 0 || value == "" || value == "true" {
+		return value, nil
+	}
+	selector, err := labels.Parse(value)
+	if err != nil {
+		return value, fmt.Errorf("sync value %q: %w", value, err)
+	}
+	requirements, _ := selector.Requirements()
+	if len(requirements) != 1 || requirements[0].Key() != namespaceNameLabel {
+		return value, fmt.Errorf("sync value %q can't also select %v; label the namespaces so that it selects them", value, namespaces)
+	}
+	switch requirements[0].Operator() {
+	case selection.In, selection.Equals, selection.DoubleEquals:
+	default:
+		return value, fmt.Errorf("sync value %q can't also select %v; label the namespaces so that it selects them", value, namespaces)
+	}
+	names := requirements[0].Values().UnsortedList()
+	for _, namespace := range namespaces {
+		if !slices.Contains(names, namespace) {
+			names = append(names, namespace)
+		}
+	}
+	sort.Strings(names)
+	return NamespaceNameSelector(names), nil
+}
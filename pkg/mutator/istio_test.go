@@ -0,0 +1,125 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// istioMutator returns a mutator adding the Istio namespace of settings to
+// the targets of stage, which sets the sync annotation.
+func istioMutator(t *testing.T, config Config, stage string, settings json.RawMessage) *Mutator {
+	t.Helper()
+	config.Stages = []string{PolicyStage, IstioGatewayStage, stage}
+	config.StageConfig = map[string]json.RawMessage{IstioGatewayStage: settings}
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// A secret annotated as a gateway's is synced to the Istio namespace on
+// top of the cluster default: a selection by name gets it added, a
+// selector of every namespace is kept, and any other selector is kept with
+// a warning. Once patched, the secret is left as it is.
+func TestIstioGateway(t *testing.T) {
+	gateway := map[string]string{IstioGatewayAnnotationKey: "true"}
+	for _, tt := range []struct {
+		name        string
+		selector    string
+		annotations map[string]string
+		want        string
+		warning     bool
+	}{
+		{name: "every namespace", selector: "true", annotations: gateway, want: "true"},
+		{name: "names", selector: "kubernetes.io/metadata.name in (shop,apps)", annotations: gateway,
+			want: "kubernetes.io/metadata.name in (apps,istio-system,shop)"},
+		{name: "one name", selector: "kubernetes.io/metadata.name=shop", annotations: gateway,
+			want: "kubernetes.io/metadata.name in (istio-system,shop)"},
+		{name: "istio already", selector: "kubernetes.io/metadata.name in (istio-system)", annotations: gateway,
+			want: "kubernetes.io/metadata.name in (istio-system)"},
+		{name: "label selector", selector: "team=web", annotations: gateway, want: "team=web", warning: true},
+		{name: "names excluded", selector: "kubernetes.io/metadata.name notin (shop)", annotations: gateway,
+			want: "kubernetes.io/metadata.name notin (shop)", warning: true},
+		{name: "not a gateway's", selector: "kubernetes.io/metadata.name=shop", want: "kubernetes.io/metadata.name=shop"},
+		{name: "annotated false", selector: "kubernetes.io/metadata.name=shop", annotations: map[string]string{IstioGatewayAnnotationKey: "false"},
+			want: "kubernetes.io/metadata.name=shop"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.NamespaceSelector = tt.selector
+			m := istioMutator(t, config, SyncAnnotationStage, nil)
+			secret := tlsSecret("apps", "gateway-tls", tt.annotations)
+			decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret})
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched := applyPatch(t, secret, patch)
+			if got := patched.Annotations[SyncAnnotationKey]; got != tt.want {
+				t.Errorf("synced to %q, want %q", got, tt.want)
+			}
+			if tt.warning != (len(decision.Warnings) == 1) || (tt.warning && !strings.Contains(decision.Warnings[0], "label the namespaces")) {
+				t.Errorf("warnings %q, want one %v", decision.Warnings, tt.warning)
+			}
+
+			decision, patch, err = m.Evaluate(context.Background(), AdmissionContext{Operation: "UPDATE", Secret: patched})
+			if err != nil || decision.SkipReason != SkipNoChanges || patch != nil {
+				t.Errorf("patched secret evaluated to %+v with %v: %v", decision, patch, err)
+			}
+		})
+	}
+}
+
+// The Istio namespace composes with the targets of dns-targets, and is
+// configured.
+func TestIstioGatewayTargets(t *testing.T) {
+	namespaces := fixedNamespaces{"payments": nil, "shop": nil, "istio-ingress": nil}
+	certificates := fixedCertificates{"apps/gateway-tls": {"payments.internal.example.com", "shop.internal.example.com"}}
+	gateway := map[string]string{IstioGatewayAnnotationKey: "true"}
+	for _, tt := range []struct {
+		name        string
+		settings    json.RawMessage
+		annotations map[string]string
+		want        string
+	}{
+		{name: "default namespace", annotations: gateway, want: "kubernetes.io/metadata.name in (istio-system,payments,shop)"},
+		{name: "configured namespace", settings: json.RawMessage(`{"namespace":"istio-ingress"}`), annotations: gateway,
+			want: "kubernetes.io/metadata.name in (istio-ingress,payments,shop)"},
+		{name: "not a gateway's", settings: json.RawMessage(`{"namespace":"istio-ingress"}`), want: "kubernetes.io/metadata.name in (payments,shop)"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := istioMutator(t, DefaultConfig(), DNSTargetsStage, tt.settings)
+			secret := tlsSecret("apps", "gateway-tls", tt.annotations)
+			decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret,
+				Namespaces: namespaces, Certificates: certificates})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]; got != tt.want {
+				t.Errorf("synced to %q, want %q", got, tt.want)
+			}
+			if len(decision.Warnings) != 0 {
+				t.Errorf("warnings %q", decision.Warnings)
+			}
+		})
+	}
+}
+
+func TestIstioGatewayConfig(t *testing.T) {
+	for _, tt := range []struct {
+		settings string
+		want     string
+	}{
+		{settings: `{"namespace":"Istio_System"}`, want: `namespace "Istio_System"`},
+		{settings: `{"namespaces":["istio-system"]}`, want: `unknown field "namespaces"`},
+	} {
+		config := DefaultConfig()
+		config.Stages = []string{PolicyStage, IstioGatewayStage, SyncAnnotationStage}
+		config.StageConfig = map[string]json.RawMessage{IstioGatewayStage: json.RawMessage(tt.settings)}
+		if _, err := New(config); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.settings, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package mutator
+
+import (
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// DeniedError is implemented by the errors of Evaluate that deny the
+// admission, whatever the failure policy, rather than fail it.
+type DeniedError interface {
+	error
+	// DeniesAdmission marks the error.
+	DeniesAdmission()
+}
+
+// DeniesAdmission makes TargetsDeniedError a DeniedError.
+func (e *TargetsDeniedError) DeniesAdmission() {}
+
+// TargetLimitError is returned by Evaluate when a secret would be synced
+// to more namespaces than Config.MaxTargets allows in strict mode. The
+// admission is denied.
+type TargetLimitError struct {
+	Value string
+	Count int
+	Max   int
+}
+
+func (e *TargetLimitError) Error() string {
+	return fmt.Sprintf("sync value %q selects %d namespaces, more than the %d allowed", e.Value, e.Count, e.Max)
+}
+
+// DeniesAdmission makes TargetLimitError a DeniedError.
+func (e *TargetLimitError) DeniesAdmission() {}
+
+// namespaceListLister is implemented by the NamespaceListers that can list,
+// e.g. client-go's, which resolveTargets needs for a label selector.
+type namespaceListLister interface {
+	List(selector labels.Selector) ([]*corev1.Namespace, error)
+}
+
+// resolveTargets returns the names of the namespaces the sync value
+// selects, sorted: the names of a selection by name, or else those of the
+// cached namespaces the selector selects, "true" and empty selecting all.
+// It returns false when they can't be known, e.g. without a namespace
+// cache.
+func resolveTargets(obj AdmissionContext, value string) ([]string, bool) {
+	selector := labels.Everything()
+	if value != "" && value != "true" {
+		parsed, err := labels.Parse(value)
+		if err != nil {
+			return nil, false
+		}
+		requirements, _ := parsed.Requirements()
+		if len(requirements) == 1 && requirements[0].Key() == namespaceNameLabel {
+			switch requirements[0].Operator() {
+			case selection.In, selection.Equals, selection.DoubleEquals:
+				return requirements[0].Values().List(), true
+			}
+		}
+		selector = parsed
+	}
+	lister, ok := obj.Namespaces.(namespaceListLister)
+	if !ok {
+		return nil, false
+	}
+	namespaces, err := lister.List(selector)
+	if err != nil {
+		return nil, false
+	}
+	names := make([]string, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		names = append(names, namespace.Name)
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// limitTargets caps the namespaces value selects at config's MaxTargets,
+// recording their number in decision.TargetCount. Over the cap the value is
+// truncated to the first of them by name, with a warning, or in strict mode
+// the admission is denied. A value whose namespaces can't be resolved is
+// kept, with a warning.
+func limitTargets(obj AdmissionContext, config Config, decision *Decision, value string) (string, error) {
+	if config.MaxTargets <= 0 {
+		return value, nil
+	}
+	names, ok := resolveTargets(obj, value)
+	if !ok {
+		decision.Warnings = append(decision.Warnings, fmt.Sprintf("sync value %q: namespaces not resolved, the limit of %d not enforced", value, config.MaxTargets))
+		return value, nil
+	}
+	decision.TargetCount = len(names)
+	if len(names) <= config.MaxTargets {
+		return value, nil
+	}
+	if config.StrictTargetLimit {
+		return value, &TargetLimitError{Value: value, Count: len(names), Max: config.MaxTargets}
+	}
+	decision.Warnings = append(decision.Warnings, fmt.Sprintf("sync value %q selects %d namespaces, more than the %d allowed; truncated to the first %d",
+		value, len(names), config.MaxTargets, config.MaxTargets))
+	decision.TargetCount = config.MaxTargets
+	return NamespaceNameSelector(names[:config.MaxTargets]), nil
+}
@@ -0,0 +1,122 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// limitNamespaces are five namespaces labelled env=prod, two env=dev.
+var limitNamespaces = fixedNamespaces{
+	"prod-a": {"env": "prod"}, "prod-b": {"env": "prod"}, "prod-c": {"env": "prod"}, "prod-d": {"env": "prod"}, "prod-e": {"env": "prod"},
+	"dev-a": {"env": "dev"}, "dev-b": {"env": "dev"},
+}
+
+// limitMutator returns a mutator capping the targets at 3, in strict mode
+// or not, with the cluster default selector and a profile of each size.
+func limitMutator(t *testing.T, selector string, strict bool) *Mutator {
+	t.Helper()
+	sync, err := json.Marshal(SyncAnnotationConfig{Profiles: map[string]SyncProfile{
+		"two":   {TargetNamespaces: []string{"prod-b", "prod-a"}},
+		"three": {TargetNamespaces: []string{"prod-c", "prod-b", "prod-a"}},
+		"five":  {TargetNamespaces: []string{"prod-e", "prod-d", "prod-c", "prod-b", "prod-a"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.NamespaceSelector = selector
+	config.MaxTargets, config.StrictTargetLimit = 3, strict
+	config.StageConfig = map[string]json.RawMessage{SyncAnnotationStage: sync}
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// Lists and selectors under and at the cap are kept, counted; over it they
+// are truncated to the first namespaces by name with a warning, or denied
+// in strict mode.
+func TestTargetLimit(t *testing.T) {
+	const firstThree = "kubernetes.io/metadata.name in (prod-a,prod-b,prod-c)"
+	for _, tt := range []struct {
+		name     string
+		selector string // the cluster default
+		profile  string
+		want     string // sync value, when not strict
+		count    int
+	}{
+		{name: "list under", selector: "true", profile: "two", want: "kubernetes.io/metadata.name in (prod-a,prod-b)", count: 2},
+		{name: "list at", selector: "true", profile: "three", want: firstThree, count: 3},
+		{name: "list over", selector: "true", profile: "five", want: firstThree, count: 5},
+		{name: "selector under", selector: "env=dev", want: "env=dev", count: 2},
+		{name: "selector at", selector: "env=prod,kubernetes.io/metadata.name notin (prod-d,prod-e)",
+			want: "env=prod,kubernetes.io/metadata.name notin (prod-d,prod-e)", count: 3},
+		{name: "selector over", selector: "env=prod", want: firstThree, count: 5},
+		{name: "every namespace", selector: "true", want: "kubernetes.io/metadata.name in (dev-a,dev-b,prod-a)", count: 7},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			over := tt.count > 3
+			secret := tlsSecret("apps", "wildcard-tls", nil)
+			if tt.profile != "" {
+				secret.Annotations[ProfileAnnotationKey] = tt.profile
+			}
+			req := AdmissionContext{Operation: "CREATE", Secret: secret, Namespaces: limitNamespaces}
+
+			decision, patch, err := limitMutator(t, tt.selector, false).Evaluate(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantCount := min(tt.count, 3)
+			if got := applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]; got != tt.want || decision.TargetCount != wantCount {
+				t.Errorf("synced to %q, %d namespaces, want %q, %d", got, decision.TargetCount, tt.want, wantCount)
+			}
+			if over != (len(decision.Warnings) == 1) || over && !strings.Contains(decision.Warnings[0], "truncated to the first 3") {
+				t.Errorf("warnings %q, want one %v", decision.Warnings, over)
+			}
+
+			decision, patch, err = limitMutator(t, tt.selector, true).Evaluate(context.Background(), req)
+			var limitErr *TargetLimitError
+			if !over {
+				if err != nil || patch == nil || decision.TargetCount != tt.count {
+					t.Errorf("strict: %d namespaces with %v: %v", decision.TargetCount, patch, err)
+				}
+				return
+			}
+			if !errors.As(err, &limitErr) || limitErr.Count != tt.count || limitErr.Max != 3 {
+				t.Errorf("strict: error %v, want %d namespaces denied", err, tt.count)
+			}
+			var denied DeniedError
+			if !errors.As(err, &denied) {
+				t.Errorf("strict: %T doesn't deny the admission", err)
+			}
+		})
+	}
+}
+
+// A selector that can't be resolved without a namespace cache is kept with
+// a warning; a selection by name doesn't need one.
+func TestTargetLimitUnresolved(t *testing.T) {
+	m := limitMutator(t, "env=prod", true)
+	if !m.NeedsNamespaces() {
+		t.Error("the cap doesn't ask for the namespaces")
+	}
+	secret := tlsSecret("apps", "wildcard-tls", nil)
+	decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]; got != "env=prod" || decision.TargetCount != 0 ||
+		len(decision.Warnings) != 1 || !strings.Contains(decision.Warnings[0], "not resolved") {
+		t.Errorf("synced to %q, %d namespaces, warnings %q, want kept with a warning", got, decision.TargetCount, decision.Warnings)
+	}
+
+	secret.Annotations[ProfileAnnotationKey] = "five"
+	var limitErr *TargetLimitError
+	if _, _, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret}); !errors.As(err, &limitErr) {
+		t.Errorf("list over the cap without a cache: error %v", err)
+	}
+}
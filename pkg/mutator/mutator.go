@@ -0,0 +1,463 @@
+// Package mutator decides whether a secret gets the kubed sync annotation
+// and builds the JSON patch setting it. It holds no global state and knows
+// nothing about HTTP, so it can be embedded in other admission servers.
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Annotations read and written by the mutator.
+const (
+	// SyncAnnotationKey tells kubed which namespaces to copy a secret to.
+	SyncAnnotationKey = "kubed.appscode.com/sync"
+	// OriginAnnotationKey is set by kubed on the copies it makes.
+	OriginAnnotationKey = "kubed.appscode.com/origin"
+	// CertManagerAnnotationKey is set by cert-manager on the secrets it issues.
+	CertManagerAnnotationKey = "cert-manager.io/certificate-name"
+	// ManagedByAnnotationKey marks the secrets whose sync annotation the
+	// webhook set, which its controllers may correct later. Values on
+	// secrets without it were set by someone else and are left alone.
+	ManagedByAnnotationKey = "cert-sync.bygui86.io/managed-by"
+	// ManagedByValue is the value of ManagedByAnnotationKey.
+	ManagedByValue = "cert-manager-webhook"
+	// ResyncAnnotationKey is set to the time on the managed secrets to make
+	// kubed copy them again, e.g. into a namespace just created.
+	ResyncAnnotationKey = "cert-sync.bygui86.io/resync"
+	// KeepReplicaAnnotationKey set to "true" on a kubed copy keeps it when
+	// its source is gone.
+	KeepReplicaAnnotationKey = "cert-sync.bygui86.io/keep"
+	// AllowDeleteAnnotationKey set to "true" lifts the deletion protection
+	// of a synced secret.
+	AllowDeleteAnnotationKey = "cert-sync.bygui86.io/allow-delete"
+	// ClusterAnnotationKey names the cluster whose webhook set the sync
+	// annotation, for inventories aggregating the copies of many clusters.
+	ClusterAnnotationKey = "cert-sync.bygui86.io/cluster"
+)
+
+// Reasons a secret is admitted without being mutated.
+const (
+	SkipIgnoredNamespace = "ignored-namespace"
+	SkipNotTLS           = "not-tls-secret"
+	SkipReplica          = "kubed-replica"
+	SkipNoChanges        = "no-changes"
+	SkipNoRuleMatched    = "no-rule-matched"
+	SkipNoIngressMatched = "no-ingress-matched"
+	SkipNextPrivateKey   = "next-private-key"
+	SkipIssuanceOwned    = "issuance-owned"
+	SkipProtectedName    = "protected-name"
+)
+
+// DefaultRule is the name of the rule applied when no other rule matches.
+const DefaultRule = "default"
+
+// Config holds the settings of a Mutator.
+type Config struct {
+	// IgnoredNamespaces are never mutated.
+	IgnoredNamespaces []string
+	// NamespaceSelector is the value given to the sync annotation, "true"
+	// for all namespaces or a label selector.
+	NamespaceSelector string
+	// Stages are the names of the stages to run, in order; DefaultStages
+	// when empty.
+	Stages []string
+	// StageConfig holds the settings of the stages by name, decoded by
+	// each stage's Factory.
+	StageConfig map[string]json.RawMessage
+	// MaxTargets caps the namespaces the sync annotation of a secret may
+	// select, 0 for no cap. Selectors are resolved against the namespace
+	// cache.
+	MaxTargets int
+	// StrictTargetLimit denies the secrets over MaxTargets rather than
+	// truncating their targets.
+	StrictTargetLimit bool
+	// ClusterName is written in ClusterAnnotationKey with the sync
+	// annotation, not at all when empty.
+	ClusterName string
+	// StrictPatchValidation denies the secrets whose patch would set
+	// annotations or labels the API server rejects, rather than dropping
+	// those with a warning.
+	StrictPatchValidation bool
+	// RewriteDecisionOnConfigChange updates DecisionAnnotationKey on the
+	// secrets recorded under other settings even when their rule didn't
+	// change.
+	RewriteDecisionOnConfigChange bool
+}
+
+// DefaultStages skip the secrets that must not be synced and annotate the
+// others for kubed.
+var DefaultStages = []string{PolicyStage, SyncAnnotationStage}
+
+// DefaultConfig skips the Kubernetes system namespaces and syncs to all
+// namespaces.
+func DefaultConfig() Config {
+	return Config{
+		IgnoredNamespaces: []string{metav1.NamespaceSystem, metav1.NamespacePublic},
+		NamespaceSelector: "true",
+		Stages:            DefaultStages,
+	}
+}
+
+// AdmissionContext is the object under admission.
+type AdmissionContext struct {
+	// Operation is the admission operation, e.g. CREATE or UPDATE.
+	Operation string
+	// Secret is the decoded object of the request. Its Data and StringData
+	// are only set when a stage needs them, see Mutator.NeedsData.
+	Secret *corev1.Secret
+	// UserInfo is the user making the request.
+	UserInfo authenticationv1.UserInfo
+	// NamespaceLabels are the labels of the secret's namespace, nil when
+	// they are not known.
+	NamespaceLabels map[string]string
+	// Namespaces looks up namespaces, nil when there is no cache of them.
+	Namespaces NamespaceLister
+	// Certificates looks up cert-manager Certificates, nil when there is no
+	// cache of them.
+	Certificates CertificateLister
+	// Ingresses lists Ingresses, nil when there is no cache of them.
+	Ingresses IngressLister
+}
+
+// NamespaceLister gets namespaces from a cache, which may lag behind the
+// API server; client-go's NamespaceLister is one.
+type NamespaceLister interface {
+	Get(name string) (*corev1.Namespace, error)
+}
+
+// ErrNamespaceNotCached is returned for a namespace the cache hasn't seen,
+// typically one created moments before the secret. The admission is then
+// answered per the failure policy, like any other evaluation error.
+var ErrNamespaceNotCached = errors.New("namespace not in the cache yet")
+
+// Namespace returns the secret's namespace from Namespaces. It fails with
+// ErrNamespaceNotCached when the cache doesn't have it, and when there is
+// no cache.
+func (c AdmissionContext) Namespace() (*corev1.Namespace, error) {
+	if c.Namespaces == nil {
+		return nil, fmt.Errorf("namespace %s: %w", c.Secret.Namespace, ErrNamespaceNotCached)
+	}
+	namespace, err := c.Namespaces.Get(c.Secret.Namespace)
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("namespace %s: %w", c.Secret.Namespace, ErrNamespaceNotCached)
+	}
+	return namespace, err
+}
+
+// Decision is the outcome of evaluating a secret.
+type Decision struct {
+	// Mutate is true when the secret gets patched.
+	Mutate bool
+	// SkipReason says why the secret is left alone when Mutate is false.
+	SkipReason string
+	// Rule names the rule that matched when Mutate is true.
+	Rule string
+	// Signature names the ownership signature the secret matched, empty
+	// when the policy has none.
+	Signature string
+	// Profile names the sync profile picked for the secret, if any.
+	Profile string
+	// Targets restricts the namespaces the secret may be synced to, nil
+	// when it may be synced anywhere.
+	Targets *TargetRestriction
+	// TargetCount is the number of namespaces the sync annotation selects,
+	// once capped; 0 when not resolved, without Config.MaxTargets.
+	TargetCount int
+	// Annotations are the annotations the patch sets.
+	Annotations map[string]string
+	// SyncNamespaces are namespaces the sync annotation must select besides
+	// the targets of the stage setting it, e.g. the Istio namespace.
+	SyncNamespaces []string
+	// Warnings are returned to the API client with the admission.
+	Warnings []string
+	// Trace holds the steps of the evaluation of a secret annotated with
+	// DebugAnnotationKey, nil for others: the matchers evaluated with their
+	// outcome, the stages run and the annotations set. Secret data never
+	// appears in it.
+	Trace []string
+
+	traced bool
+}
+
+// PatchOperation is one RFC 6902 JSON patch operation.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// Mutator evaluates secrets by running its stages in order. It is safe for
+// concurrent use.
+type Mutator struct {
+	stages          []Stage
+	names           []string // of the stages, for traces
+	needsData       bool
+	needsNamespaces bool
+	needsCerts      bool
+	needsIngresses  bool
+	static          *staticPatch // precomputed patches, nil unless all stages are static
+	configHash      string       // recorded in DecisionAnnotationKey
+	rewriteDecision bool
+	strictPatches   bool
+}
+
+// New returns a Mutator running the stages named in config.
+func New(config Config) (*Mutator, error) {
+	names := config.Stages
+	if len(names) == 0 {
+		names = DefaultStages
+	}
+	for name := range config.StageConfig {
+		if _, ok := lookupStage(name); !ok {
+			return nil, fmt.Errorf("settings for unknown mutation stage %q, registered stages: %s", name, strings.Join(Registered(), ", "))
+		}
+	}
+	// the cap resolves selectors against the namespace cache
+	m := &Mutator{needsNamespaces: config.MaxTargets > 0, configHash: ConfigHash(config),
+		rewriteDecision: config.RewriteDecisionOnConfigChange, strictPatches: config.StrictPatchValidation}
+	for _, name := range names {
+		factory, ok := lookupStage(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown mutation stage %q, registered stages: %s", name, strings.Join(Registered(), ", "))
+		}
+		stage, err := factory(config, config.StageConfig[name])
+		if err != nil {
+			return nil, fmt.Errorf("mutation stage %q: %w", name, err)
+		}
+		m.stages = append(m.stages, stage)
+		m.names = append(m.names, name)
+		if stage, ok := stage.(DataStage); ok && stage.NeedsData() {
+			m.needsData = true
+		}
+		if stage, ok := stage.(NamespaceStage); ok && stage.NeedsNamespaces() {
+			m.needsNamespaces = true
+		}
+		if stage, ok := stage.(CertificateStage); ok && stage.NeedsCertificates() {
+			m.needsCerts = true
+		}
+		if stage, ok := stage.(IngressStage); ok && stage.NeedsIngresses() {
+			m.needsIngresses = true
+		}
+	}
+	static, err := newStaticPatch(m.stages, m.names)
+	if err != nil {
+		return nil, fmt.Errorf("precomputing the patches: %w", err)
+	}
+	m.static = static
+	return m, nil
+}
+
+// NeedsData reports whether a stage reads or patches the data of secrets.
+// Otherwise they can be decoded as SecretMetadata.
+func (m *Mutator) NeedsData() bool {
+	return m.needsData
+}
+
+// NeedsNamespaces reports whether a stage reads the namespace of secrets,
+// which then need a NamespaceLister in their AdmissionContext.
+func (m *Mutator) NeedsNamespaces() bool {
+	return m.needsNamespaces
+}
+
+// NeedsCertificates reports whether a stage reads the Certificate of
+// secrets, which then need a CertificateLister in their AdmissionContext.
+func (m *Mutator) NeedsCertificates() bool {
+	return m.needsCerts
+}
+
+// NeedsIngresses reports whether a stage lists Ingresses, which then need
+// an IngressLister in the AdmissionContext.
+func (m *Mutator) NeedsIngresses() bool {
+	return m.needsIngresses
+}
+
+// SecretMetadata is the part of a Secret the stages read unless one needs
+// the data. Decoding a secret into it skips the data, allocating nothing for
+// it however large it is.
+type SecretMetadata struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Immutable         *bool             `json:"immutable,omitempty"`
+	Type              corev1.SecretType `json:"type,omitempty"`
+}
+
+// Secret returns the secret without its data.
+func (s *SecretMetadata) Secret() *corev1.Secret {
+	return &corev1.Secret{TypeMeta: s.TypeMeta, ObjectMeta: s.ObjectMeta, Immutable: s.Immutable, Type: s.Type}
+}
+
+// DecodeSecret decodes the raw JSON of a secret for Evaluate, without its
+// data unless a stage needs it.
+func (m *Mutator) DecodeSecret(raw []byte) (*corev1.Secret, error) {
+	if m.needsData {
+		var secret corev1.Secret
+		if err := json.Unmarshal(raw, &secret); err != nil {
+			return nil, err
+		}
+		return &secret, nil
+	}
+	var metadata SecretMetadata
+	if err := json.Unmarshal(raw, &metadata); err != nil {
+		return nil, err
+	}
+	return metadata.Secret(), nil
+}
+
+// Evaluate runs the stages on req and returns the decision and the patch
+// to apply, which is empty when a stage skipped the secret. The patches of
+// the stages are merged with a PatchBuilder, so the last stage wins on
+// conflicts and each conflict adds a warning. A patch setting the sync
+// annotation records the decision in DecisionAnnotationKey. Annotations and
+// labels the API server would reject are dropped from the patch with a
+// warning, or in strict mode fail it with a PatchViolationError. Secrets
+// annotated with DebugAnnotationKey get the steps in Decision.Trace. It
+// returns the context's error once ctx is done. The patch may be shared
+// with other calls and must not be modified.
+func (m *Mutator) Evaluate(ctx context.Context, req AdmissionContext) (Decision, []PatchOperation, error) {
+	decision := Decision{Mutate: true, Rule: DefaultRule, Annotations: map[string]string{}, traced: Traced(req.Secret)}
+	decision.tracef("evaluating %s of secret %s/%s, type %s, by %s", req.Operation, req.Secret.Namespace, req.Secret.Name,
+		req.Secret.Type, req.UserInfo.Username)
+	stages, names := m.stages, m.names
+	if m.static != nil {
+		stages, names = m.static.stages, m.static.names
+		decision.tracef("annotations precomputed: %s", traceAnnotations(m.static.annotations))
+	}
+	var builder *PatchBuilder
+	for i, stage := range stages {
+		if err := ctx.Err(); err != nil {
+			return Decision{}, nil, err
+		}
+		patch, err := stage.Apply(ctx, req, &decision)
+		if err != nil {
+			decision.tracef("stage %s failed: %v", names[i], err)
+			return decision, nil, err
+		}
+		if !decision.Mutate {
+			decision.tracef("stage %s skipped the secret: %s", names[i], decision.SkipReason)
+			return Decision{SkipReason: decision.SkipReason, Warnings: decision.Warnings, Trace: decision.Trace}, nil, nil
+		}
+		decision.tracef("stage %s: %d patch operations", names[i], len(patch))
+		if len(patch) > 0 {
+			if builder == nil {
+				builder = NewPatchBuilder(req.Secret)
+			}
+			builder.Merge(patch...)
+		}
+	}
+	if static := m.static; static != nil {
+		if _, ok := static.annotations[SyncAnnotationKey]; ok {
+			var err error
+			if static, err = static.withDecision(m.decisionValue(req.Secret, decision.Rule)); err != nil {
+				return decision, nil, err
+			}
+			decision.tracef("decision recorded as %s", static.annotations[DecisionAnnotationKey])
+		}
+		for key, value := range static.annotations {
+			decision.Annotations[key] = value
+		}
+		if patch, ok := static.patch(req.Secret); ok && builder == nil {
+			return m.checkPatch(req.Secret, decision, patch)
+		}
+		if builder == nil {
+			builder = NewPatchBuilder(req.Secret)
+		}
+		for _, key := range sortedKeys(static.annotations) {
+			builder.AddAnnotation(key, static.annotations[key])
+		}
+	} else if _, ok := decision.Annotations[SyncAnnotationKey]; ok {
+		value, _ := m.decisionValue(req.Secret, decision.Rule)
+		decision.tracef("decision recorded as %s", value)
+		decision.Annotations[DecisionAnnotationKey] = value
+		if builder == nil {
+			builder = NewPatchBuilder(req.Secret)
+		}
+		builder.AddAnnotation(DecisionAnnotationKey, value)
+	}
+	if builder == nil {
+		decision.tracef("nothing to patch")
+		return Decision{SkipReason: SkipNoChanges, Warnings: decision.Warnings, Trace: decision.Trace}, nil, nil
+	}
+	merged, err := builder.Operations()
+	if err != nil {
+		return decision, nil, err
+	}
+	decision.Warnings = append(decision.Warnings, builder.Warnings()...)
+	return m.checkPatch(req.Secret, decision, merged)
+}
+
+// checkPatch returns decision with patch, without the entries the API
+// server would reject, see validatePatch.
+func (m *Mutator) checkPatch(secret *corev1.Secret, decision Decision, patch []PatchOperation) (Decision, []PatchOperation, error) {
+	patch, violations := validatePatch(secret.Annotations, patch)
+	if len(violations) > 0 {
+		messages := make([]string, 0, len(violations))
+		for _, violation := range violations {
+			decision.tracef("patch validation: %s", violation)
+			messages = append(messages, violation.String())
+			if violation.path == annotationsPath {
+				delete(decision.Annotations, violation.key)
+			}
+		}
+		if m.strictPatches {
+			return decision, nil, &PatchViolationError{Violations: messages}
+		}
+		decision.Warnings = append(decision.Warnings, messages...)
+	}
+	if len(patch) == 0 {
+		decision.tracef("nothing to patch, the secret is up to date")
+		return Decision{SkipReason: SkipNoChanges, Warnings: decision.Warnings, Trace: decision.Trace}, nil, nil
+	}
+	decision.tracef("rule %s, annotations %s", decision.Rule, traceAnnotations(decision.Annotations))
+	return decision, patch, nil
+}
+
+// MarshalPatch encodes a patch returned by Evaluate for an AdmissionResponse,
+// reusing the encoding of a precomputed one. The bytes must not be
+// modified.
+func (m *Mutator) MarshalPatch(patch []PatchOperation) ([]byte, error) {
+	if m.static != nil {
+		if raw, ok := m.static.encoded(patch); ok {
+			return raw, nil
+		}
+	}
+	return MarshalPatch(patch)
+}
+
+// MarshalPatch encodes a patch for an AdmissionResponse.
+func MarshalPatch(patch []PatchOperation) ([]byte, error) {
+	return json.Marshal(patch)
+}
+
+// ConflictingAnnotations returns the sorted keys of want that are already
+// set in have to another, non-empty value.
+func ConflictingAnnotations(have, want map[string]string) []string {
+	var conflicts []string
+	for _, key := range sortedKeys(want) {
+		if value, ok := have[key]; ok && value != "" && value != want[key] {
+			conflicts = append(conflicts, key)
+		}
+	}
+	return conflicts
+}
+
+// AnnotationPatch returns the operations setting the added annotations on an
+// object that has existing ones.
+func AnnotationPatch(existing, added map[string]string) []PatchOperation {
+	b := newPatchBuilder()
+	b.DeclareMap(annotationsPath, existing)
+	for _, key := range sortedKeys(added) {
+		b.AddAnnotation(key, added[key])
+	}
+	// adding valid keys can't fail
+	patch, _ := b.Operations()
+	return patch
+}
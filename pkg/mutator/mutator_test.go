@@ -0,0 +1,326 @@
+package mutator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// tlsSecret returns a TLS secret issued by cert-manager with annotations
+// added to cert-manager's.
+func tlsSecret(namespace, name string, annotations map[string]string) *corev1.Secret {
+	all := map[string]string{CertManagerAnnotationKey: name}
+	for key, value := range annotations {
+		all[key] = value
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Annotations: all},
+		Type:       corev1.SecretTypeTLS,
+	}
+}
+
+// applyPatch returns secret with patch applied as the API server would.
+func applyPatch(t *testing.T, secret *corev1.Secret, patch []PatchOperation) *corev1.Secret {
+	t.Helper()
+	doc, err := json.Marshal(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := MarshalPatch(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jsonpatch.DecodePatch(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := decoded.Apply(doc)
+	if err != nil {
+		t.Fatalf("patch %s doesn't apply: %v", raw, err)
+	}
+	var result corev1.Secret
+	if err := json.Unmarshal(patched, &result); err != nil {
+		t.Fatal(err)
+	}
+	return &result
+}
+
+// The default mutator annotates cert-manager's TLS secrets for kubed.
+func TestEvaluate(t *testing.T) {
+	config := DefaultConfig()
+	config.NamespaceSelector = "env=prod"
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, secret := range map[string]*corev1.Secret{
+		"cert-manager's":     tlsSecret("apps", "api-tls", nil),
+		"not cert-manager's": {ObjectMeta: metav1.ObjectMeta{Name: "manual", Namespace: "apps"}, Type: corev1.SecretTypeTLS},
+	} {
+		t.Run(name, func(t *testing.T) {
+			decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !decision.Mutate || decision.Rule != DefaultRule || decision.SkipReason != "" {
+				t.Fatalf("decision %+v, want a mutation by the default rule", decision)
+			}
+			if got := decision.Annotations[SyncAnnotationKey]; got != "env=prod" {
+				t.Errorf("decided sync annotation %q, want env=prod", got)
+			}
+			if got := applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]; got != "env=prod" {
+				t.Errorf("sync annotation patched to %q, want env=prod", got)
+			}
+		})
+	}
+}
+
+// The policy skips the secrets that must not be synced, each for its own
+// reason and without a patch.
+func TestEvaluateSkips(t *testing.T) {
+	m, err := New(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opaque := tlsSecret("apps", "opaque", nil)
+	opaque.Type = corev1.SecretTypeOpaque
+	for _, tt := range []struct {
+		secret *corev1.Secret
+		reason string
+	}{
+		{tlsSecret(metav1.NamespaceSystem, "api-tls", nil), SkipIgnoredNamespace},
+		{tlsSecret(metav1.NamespacePublic, "api-tls", nil), SkipIgnoredNamespace},
+		{opaque, SkipNotTLS},
+		{tlsSecret("apps", "api-tls", map[string]string{OriginAnnotationKey: `{"namespace":"certs"}`}), SkipReplica},
+	} {
+		decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: tt.secret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.Mutate || decision.SkipReason != tt.reason || patch != nil {
+			t.Errorf("%s/%s: mutate %v, skipped for %q with %v, want skipped for %q",
+				tt.secret.Namespace, tt.secret.Name, decision.Mutate, decision.SkipReason, patch, tt.reason)
+		}
+	}
+
+	// the origin annotation alone doesn't make a replica
+	manual := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "manual", Namespace: "apps", Annotations: map[string]string{OriginAnnotationKey: "{}"}},
+		Type:       corev1.SecretTypeTLS,
+	}
+	if decision, _, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: manual}); err != nil || !decision.Mutate {
+		t.Errorf("secret with only the origin annotation skipped for %q: %v", decision.SkipReason, err)
+	}
+}
+
+func TestEvaluateClusterName(t *testing.T) {
+	config := DefaultConfig()
+	config.ClusterName = "eu-west-1"
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := tlsSecret("apps", "api-tls", nil)
+	_, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamped := applyPatch(t, secret, patch)
+	if got := stamped.Annotations[ClusterAnnotationKey]; got != "eu-west-1" {
+		t.Errorf("cluster annotation %q, want eu-west-1", got)
+	}
+
+	// stamped already, nothing to patch
+	decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "UPDATE", Secret: stamped})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Mutate || decision.SkipReason != SkipNoChanges || patch != nil {
+		t.Errorf("stamped secret: mutate %v, skipped for %q with %+v, want skipped for %s", decision.Mutate, decision.SkipReason, patch, SkipNoChanges)
+	}
+
+	// stamped by another cluster, the name alone is patched
+	stamped.Annotations[ClusterAnnotationKey] = "us-east-1"
+	_, patch, err = m.Evaluate(context.Background(), AdmissionContext{Operation: "UPDATE", Secret: stamped})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 1 || patch[0].Path != "/metadata/annotations/cert-sync.bygui86.io~1cluster" || patch[0].Value != "eu-west-1" {
+		t.Errorf("secret of another cluster patched with %+v, want the cluster name replaced", patch)
+	}
+}
+
+// A done context ends the evaluation before the next stage, so none runs
+// for a request nobody waits for anymore.
+func TestEvaluateDoneContext(t *testing.T) {
+	m, err := New(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := AdmissionContext{Operation: "CREATE", Secret: tlsSecret("apps", "api-tls", nil)}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	for _, tt := range []struct {
+		name string
+		ctx  context.Context
+		want error
+	}{
+		{name: "cancelled", ctx: cancelled, want: context.Canceled},
+		{name: "past deadline", ctx: expired, want: context.DeadlineExceeded},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, patch, err := m.Evaluate(tt.ctx, req)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("error %v, want %v", err, tt.want)
+			}
+			if decision.Mutate || patch != nil {
+				t.Errorf("decision %+v with patch %v", decision, patch)
+			}
+		})
+	}
+}
+
+// AnnotationPatch adds a missing annotations map, and otherwise adds each
+// key under its escaped path, keeping the annotations already there and
+// leaving a key already set alone.
+func TestAnnotationPatch(t *testing.T) {
+	added := map[string]string{SyncAnnotationKey: "true"}
+
+	patch := AnnotationPatch(nil, added)
+	if len(patch) != 1 || patch[0].Op != "add" || patch[0].Path != "/metadata/annotations" {
+		t.Fatalf("patch for no annotations %+v, want one add of /metadata/annotations", patch)
+	}
+
+	existing := tlsSecret("apps", "api-tls", map[string]string{"team": "payments"})
+	patched := applyPatch(t, existing, AnnotationPatch(existing.Annotations, added))
+	if patched.Annotations["team"] != "payments" || patched.Annotations[SyncAnnotationKey] != "true" {
+		t.Errorf("annotations %v patched to %v, want the sync annotation added", existing.Annotations, patched.Annotations)
+	}
+
+	synced := tlsSecret("apps", "api-tls", map[string]string{SyncAnnotationKey: "env=dev"})
+	patch = AnnotationPatch(synced.Annotations, added)
+	if len(patch) != 1 || patch[0].Op != "add" || patch[0].Path != "/metadata/annotations/"+EscapePointer(SyncAnnotationKey) {
+		t.Fatalf("patch for a present key %+v, want one add of the escaped key", patch)
+	}
+	if patched := applyPatch(t, synced, patch); patched.Annotations[SyncAnnotationKey] != "true" {
+		t.Errorf("sync annotation patched to %q, want true", patched.Annotations[SyncAnnotationKey])
+	}
+
+	if patch := AnnotationPatch(added, added); len(patch) != 0 {
+		t.Errorf("patch for a key already set %+v, want none", patch)
+	}
+}
+
+func TestConflictingAnnotations(t *testing.T) {
+	have := map[string]string{"a": "1", "b": "2", "c": "", "d": "4"}
+	want := map[string]string{"d": "x", "a": "1", "b": "x", "c": "x", "e": "x"}
+	if got := ConflictingAnnotations(have, want); !slices.Equal(got, []string{"b", "d"}) {
+		t.Errorf("conflicts %v, want [b d]: equal, empty and missing values don't conflict", got)
+	}
+}
+
+// secretJSON returns the JSON of a cert-manager TLS secret with size bytes
+// in each of tls.crt and tls.key.
+func secretJSON(tb testing.TB, size int, annotations map[string]string) []byte {
+	tb.Helper()
+	secret := tlsSecret("apps", "api-tls", annotations)
+	secret.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"}
+	secret.Data = map[string][]byte{
+		corev1.TLSCertKey:       bytes.Repeat([]byte("c"), size),
+		corev1.TLSPrivateKeyKey: bytes.Repeat([]byte("k"), size),
+	}
+	raw, err := json.Marshal(secret)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return raw
+}
+
+// withStages returns a mutator running the default stages and extra.
+func withStages(tb testing.TB, extra ...string) *Mutator {
+	tb.Helper()
+	config := DefaultConfig()
+	config.Stages = append(append([]string(nil), DefaultStages...), extra...)
+	m, err := New(config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return m
+}
+
+func TestDecodeSecret(t *testing.T) {
+	raw := secretJSON(t, 64, map[string]string{"team": "payments"})
+	immutable := true
+	tests := []struct {
+		name     string
+		m        *Mutator
+		wantData bool
+	}{
+		{name: "metadata only", m: withStages(t)},
+		{name: "data for a stage needing it", m: withStages(t, dataStage), wantData: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.m.NeedsData() != tt.wantData {
+				t.Fatalf("NeedsData() = %v", tt.m.NeedsData())
+			}
+			secret, err := tt.m.DecodeSecret(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if secret.Name != "api-tls" || secret.Namespace != "apps" || secret.Type != corev1.SecretTypeTLS || secret.Annotations["team"] != "payments" {
+				t.Errorf("metadata not decoded: %+v", secret.ObjectMeta)
+			}
+			if got := len(secret.Data[corev1.TLSCertKey]); (got == 64) != tt.wantData {
+				t.Errorf("%d bytes of tls.crt decoded", got)
+			}
+		})
+	}
+
+	secret := tlsSecret("apps", "api-tls", nil)
+	secret.Immutable = &immutable
+	raw, err := json.Marshal(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := withStages(t).DecodeSecret(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Immutable == nil || !*decoded.Immutable {
+		t.Error("immutable not decoded with the metadata")
+	}
+}
+
+// BenchmarkDecodeSecret compares decoding a secret with 1MiB of data whole,
+// as for a stage needing the data, with decoding its metadata only.
+func BenchmarkDecodeSecret(b *testing.B) {
+	raw := secretJSON(b, 1<<20, nil)
+	for _, bm := range []struct {
+		name string
+		m    *Mutator
+	}{
+		{"full", withStages(b, dataStage)},
+		{"metadata", withStages(b)},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(len(raw)))
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := bm.m.DecodeSecret(raw); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package mutator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// NamespaceAnnotationsStage names the stage copying annotations of the
+// namespace onto secrets.
+const NamespaceAnnotationsStage = "namespace-annotations"
+
+// NamespaceAnnotationsAnnotationKey lists the annotations the
+// namespace-annotations stage copied, comma-separated, the only ones it
+// updates and removes later.
+const NamespaceAnnotationsAnnotationKey = "cert-sync.bygui86.io/namespace-annotations"
+
+// DefaultNamespaceAnnotationMaxBytes caps the values copied by the
+// namespace-annotations stage; all the annotations of an object are limited
+// to 256KiB.
+const DefaultNamespaceAnnotationMaxBytes = 4 << 10
+
+// NamespaceAnnotationsConfig holds the settings of the namespace-annotations
+// stage.
+type NamespaceAnnotationsConfig struct {
+	// Keys are the annotations to copy; a trailing * matches any key with
+	// that prefix, e.g. "backup.example.com/*".
+	Keys []string `json:"keys"`
+	// Force lists the keys, matched the same way, copied even over another
+	// value the secret has.
+	Force []string `json:"force,omitempty"`
+	// Remove lists the annotations, matched the same way, removed from the
+	// secret. A key both copied and removed is removed.
+	Remove []string `json:"remove,omitempty"`
+	// MaxValueBytes caps the values copied, DefaultNamespaceAnnotationMaxBytes
+	// when zero. A longer one is not copied, with a warning.
+	MaxValueBytes int `json:"maxValueBytes,omitempty"`
+}
+
+// reservedAnnotations are the annotations of the webhook, which the remove
+// list must leave alone.
+var reservedAnnotations = []string{SyncAnnotationKey, ManagedByAnnotationKey, DecisionAnnotationKey,
+	NamespaceLabelsAnnotationKey, NamespaceAnnotationsAnnotationKey}
+
+func init() {
+	Register(NamespaceAnnotationsStage, func(_ Config, raw json.RawMessage) (Stage, error) {
+		var settings NamespaceAnnotationsConfig
+		if len(raw) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&settings); err != nil {
+				return nil, err
+			}
+		}
+		if len(settings.Keys) == 0 {
+			return nil, errors.New("no keys")
+		}
+		if err := checkKeyPatterns(slices.Concat(settings.Keys, settings.Force, settings.Remove)); err != nil {
+			return nil, err
+		}
+		for _, key := range reservedAnnotations {
+			if matchesKey(settings.Remove, key) {
+				return nil, fmt.Errorf("remove: %s is the webhook's own annotation", key)
+			}
+		}
+		if settings.MaxValueBytes < 0 {
+			return nil, fmt.Errorf("maxValueBytes %d is negative", settings.MaxValueBytes)
+		}
+		if settings.MaxValueBytes == 0 {
+			settings.MaxValueBytes = DefaultNamespaceAnnotationMaxBytes
+		}
+		return namespaceAnnotationsStage{config: settings}, nil
+	})
+}
+
+// namespaceAnnotationsStage copies the annotations of the secret's namespace
+// matching its keys onto the secret, e.g. a backup policy or a data
+// classification the consumers of the kubed copies need to see, like the
+// namespace-labels stage does labels: an annotation the secret already has
+// is not overwritten unless forced, and those the stage copied follow the
+// namespace. The annotations of the remove list are removed from the secret
+// and never copied. Values over MaxValueBytes are not copied, with a warning.
+type namespaceAnnotationsStage struct {
+	config NamespaceAnnotationsConfig
+}
+
+// NeedsNamespaces makes the stage a NamespaceStage.
+func (s namespaceAnnotationsStage) NeedsNamespaces() bool { return true }
+
+func (s namespaceAnnotationsStage) Apply(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+	namespace, err := obj.Namespace()
+	if err != nil {
+		return nil, err
+	}
+	copyable := make(map[string]string, len(namespace.Annotations))
+	for key, value := range namespace.Annotations {
+		switch {
+		case matchesKey(s.config.Remove, key) || !matchesKey(s.config.Keys, key):
+		case len(value) > s.config.MaxValueBytes:
+			decision.Warnings = append(decision.Warnings, fmt.Sprintf("annotation %s of namespace %s not copied, %d bytes, more than the %d allowed",
+				key, namespace.Name, len(value), s.config.MaxValueBytes))
+		default:
+			copyable[key] = value
+		}
+	}
+	patch := NewPatchBuilder(obj.Secret)
+	copied := copyNamespaceMetadata(copyable, obj.Secret.Annotations, obj.Secret.Annotations[NamespaceAnnotationsAnnotationKey], s.config.Keys, s.config.Force,
+		func(key, value string) { patch.AddAnnotation(key, value) },
+		func(key string) { patch.RemoveAnnotation(key) },
+		func(key string) {
+			decision.Warnings = append(decision.Warnings, fmt.Sprintf("annotation %s of namespace %s not copied, the secret has another value", key, namespace.Name))
+		})
+	for _, key := range sortedKeys(obj.Secret.Annotations) {
+		if matchesKey(s.config.Remove, key) {
+			patch.RemoveAnnotation(key)
+		}
+	}
+	recordCopied(patch, NamespaceAnnotationsAnnotationKey, copied)
+	return patch.Operations()
+}
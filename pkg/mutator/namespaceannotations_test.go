@@ -0,0 +1,147 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// annotatedNamespaces is a NamespaceLister of namespaces with labels and
+// annotations; the others don't exist.
+type annotatedNamespaces map[string]*corev1.Namespace
+
+func (n annotatedNamespaces) Get(name string) (*corev1.Namespace, error) {
+	if namespace, ok := n[name]; ok {
+		return namespace, nil
+	}
+	return nil, apierrors.NewNotFound(corev1.Resource("namespaces"), name)
+}
+
+// namespaceWithAnnotations returns the namespaces of labels, the one named
+// also having annotations.
+func namespaceWithAnnotations(labels fixedNamespaces, name string, annotations map[string]string) annotatedNamespaces {
+	namespaces := annotatedNamespaces{name: {ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations}}}
+	for namespace, set := range labels {
+		if namespaces[namespace] == nil {
+			namespaces[namespace] = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+		}
+		namespaces[namespace].Labels = set
+	}
+	return namespaces
+}
+
+// The annotations of the namespace matching the keys are copied, not over
+// the secret's own unless forced, and values over the cap aren't.
+func TestNamespaceAnnotations(t *testing.T) {
+	stage := buildStage(t, NamespaceAnnotationsStage, DefaultConfig(),
+		json.RawMessage(`{"keys":["backup.example.com/*","classification","owner"],"force":["owner"],"maxValueBytes":8}`))
+	secret := tlsSecret("payments", "api-tls", map[string]string{"classification": "public", "owner": "someone"})
+	namespace := map[string]string{
+		"backup.example.com/policy": "daily",
+		"backup.example.com/notes":  "123456789",
+		"classification":            "internal",
+		"owner":                     "payments",
+		"description":               "payments team",
+	}
+	stageNamespace := namespaceWithAnnotations(nil, "payments", namespace)
+
+	_, patched, decision := applyWithNamespaces(t, stage, secret, stageNamespace)
+	for key, want := range map[string]string{"backup.example.com/policy": "daily", "classification": "public", "owner": "payments"} {
+		if patched.Annotations[key] != want {
+			t.Errorf("annotation %s = %q, want %q", key, patched.Annotations[key], want)
+		}
+	}
+	for _, key := range []string{"backup.example.com/notes", "description"} {
+		if _, ok := patched.Annotations[key]; ok {
+			t.Errorf("annotation %s copied", key)
+		}
+	}
+	if got := patched.Annotations[NamespaceAnnotationsAnnotationKey]; got != "backup.example.com/policy,owner" {
+		t.Errorf("copied annotations listed as %q", got)
+	}
+	if len(decision.Warnings) != 2 || !strings.Contains(decision.Warnings[0], "backup.example.com/notes of namespace payments not copied, 9 bytes, more than the 8 allowed") ||
+		!strings.Contains(decision.Warnings[1], "classification of namespace payments not copied, the secret has another value") {
+		t.Errorf("warnings %q, want the long value and the conflict", decision.Warnings)
+	}
+	if patch, _, _ := applyWithNamespaces(t, stage, patched, stageNamespace); patch != nil {
+		t.Errorf("copied annotations patched again with %+v", patch)
+	}
+}
+
+// A key both copied and removed is removed: never copied, and taken off the
+// secret whether the secret or an earlier copy set it.
+func TestNamespaceAnnotationsRemoveWins(t *testing.T) {
+	namespaces := namespaceWithAnnotations(fixedNamespaces{}, "payments", map[string]string{"backup.example.com/policy": "daily", "classification": "internal"})
+	copying := buildStage(t, NamespaceAnnotationsStage, DefaultConfig(), json.RawMessage(`{"keys":["backup.example.com/*","classification"]}`))
+	_, copied, _ := applyWithNamespaces(t, copying, tlsSecret("payments", "api-tls", map[string]string{"legacy.example.com/ticket": "T-1"}), namespaces)
+	if copied.Annotations[NamespaceAnnotationsAnnotationKey] != "backup.example.com/policy,classification" {
+		t.Fatalf("copied %q", copied.Annotations[NamespaceAnnotationsAnnotationKey])
+	}
+
+	removing := buildStage(t, NamespaceAnnotationsStage, DefaultConfig(),
+		json.RawMessage(`{"keys":["backup.example.com/*","classification"],"force":["classification"],"remove":["classification","legacy.example.com/*"]}`))
+	_, patched, decision := applyWithNamespaces(t, removing, copied, namespaces)
+	for _, key := range []string{"classification", "legacy.example.com/ticket"} {
+		if _, ok := patched.Annotations[key]; ok {
+			t.Errorf("annotation %s left", key)
+		}
+	}
+	if patched.Annotations["backup.example.com/policy"] != "daily" || patched.Annotations[NamespaceAnnotationsAnnotationKey] != "backup.example.com/policy" {
+		t.Errorf("annotations %v, want the backup policy still copied", patched.Annotations)
+	}
+	if len(decision.Warnings) != 0 {
+		t.Errorf("warnings %q", decision.Warnings)
+	}
+	if patch, _, _ := applyWithNamespaces(t, removing, patched, namespaces); patch != nil {
+		t.Errorf("patched again with %+v", patch)
+	}
+}
+
+// Both copying stages read the one namespace cache.
+func TestNamespaceMetadataStages(t *testing.T) {
+	config := DefaultConfig()
+	config.Stages = []string{PolicyStage, SyncAnnotationStage, NamespaceLabelsStage, NamespaceAnnotationsStage}
+	config.StageConfig = map[string]json.RawMessage{
+		NamespaceLabelsStage:      json.RawMessage(`{"keys":["team"]}`),
+		NamespaceAnnotationsStage: json.RawMessage(`{"keys":["classification"]}`),
+	}
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	namespaces := namespaceWithAnnotations(fixedNamespaces{"payments": {"team": "payments"}}, "payments", map[string]string{"classification": "internal"})
+	secret := tlsSecret("payments", "api-tls", nil)
+	_, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret, Namespaces: namespaces})
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched := applyPatch(t, secret, patch)
+	if patched.Labels["team"] != "payments" || patched.Annotations["classification"] != "internal" || patched.Annotations[SyncAnnotationKey] != "true" {
+		t.Errorf("labels %v and annotations %v, want the namespace's copied and the secret synced", patched.Labels, patched.Annotations)
+	}
+}
+
+func TestNamespaceAnnotationsConfig(t *testing.T) {
+	for _, tt := range []struct {
+		settings string
+		want     string
+	}{
+		{settings: `{"remove":["a"]}`, want: "no keys"},
+		{settings: `{"keys":["a"],"remove":["cert-sync.bygui86.io/*"]}`, want: "remove: " + ManagedByAnnotationKey + " is the webhook's own annotation"},
+		{settings: `{"keys":["a"],"remove":["` + SyncAnnotationKey + `"]}`, want: "remove: " + SyncAnnotationKey + " is the webhook's own annotation"},
+		{settings: `{"keys":["a"],"maxValueBytes":-1}`, want: "maxValueBytes -1 is negative"},
+		{settings: `{"keys":["a b"]}`, want: `key "a b"`},
+	} {
+		config := DefaultConfig()
+		config.Stages = []string{PolicyStage, SyncAnnotationStage, NamespaceAnnotationsStage}
+		config.StageConfig = map[string]json.RawMessage{NamespaceAnnotationsStage: json.RawMessage(tt.settings)}
+		if _, err := New(config); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.settings, err, tt.want)
+		}
+	}
+}
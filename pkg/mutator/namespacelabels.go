@@ -0,0 +1,153 @@
+package mutator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// NamespaceLabelsStage names the stage copying labels of the namespace onto
+// secrets.
+const NamespaceLabelsStage = "namespace-labels"
+
+// NamespaceLabelsAnnotationKey lists the labels the namespace-labels stage
+// copied, comma-separated, the only ones it updates and removes later.
+const NamespaceLabelsAnnotationKey = "cert-sync.bygui86.io/namespace-labels"
+
+// NamespaceLabelsConfig holds the settings of the namespace-labels stage.
+type NamespaceLabelsConfig struct {
+	// Keys are the labels to copy; a trailing * matches any key with that
+	// prefix, e.g. "cost.example.com/*".
+	Keys []string `json:"keys"`
+	// Force lists the keys, matched the same way, copied even over another
+	// value the secret has.
+	Force []string `json:"force,omitempty"`
+}
+
+func init() {
+	Register(NamespaceLabelsStage, func(_ Config, raw json.RawMessage) (Stage, error) {
+		var settings NamespaceLabelsConfig
+		if len(raw) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&settings); err != nil {
+				return nil, err
+			}
+		}
+		if len(settings.Keys) == 0 {
+			return nil, errors.New("no keys")
+		}
+		if err := checkKeyPatterns(slices.Concat(settings.Keys, settings.Force)); err != nil {
+			return nil, err
+		}
+		return namespaceLabelsStage{keys: settings.Keys, force: settings.Force}, nil
+	})
+}
+
+// namespaceLabelsStage copies the labels of the secret's namespace matching
+// its keys onto the secret, e.g. team or cost-center for cost attribution,
+// and so onto its kubed copies. A label the secret already has is not
+// overwritten unless forced, with a warning when its value differs; those
+// the stage copied
+// follow the namespace on every admission, and are removed once the
+// namespace no longer has them. A namespace missing from the cache fails
+// the admission, which is answered per the failure policy.
+type namespaceLabelsStage struct {
+	keys  []string
+	force []string
+}
+
+// NeedsNamespaces makes the stage a NamespaceStage.
+func (s namespaceLabelsStage) NeedsNamespaces() bool { return true }
+
+func (s namespaceLabelsStage) Apply(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+	namespace, err := obj.Namespace()
+	if err != nil {
+		return nil, err
+	}
+	patch := NewPatchBuilder(obj.Secret)
+	copied := copyNamespaceMetadata(namespace.Labels, obj.Secret.Labels, obj.Secret.Annotations[NamespaceLabelsAnnotationKey], s.keys, s.force,
+		func(key, value string) { patch.AddLabel(key, value) },
+		func(key string) { patch.RemoveLabel(key) },
+		func(key string) {
+			decision.Warnings = append(decision.Warnings, fmt.Sprintf("label %s of namespace %s not copied, the secret has another value", key, namespace.Name))
+		})
+	recordCopied(patch, NamespaceLabelsAnnotationKey, copied)
+	return patch.Operations()
+}
+
+// checkKeyPatterns checks label or annotation keys, each a qualified name
+// or a prefix of one followed by *.
+func checkKeyPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		key := strings.TrimSuffix(pattern, "*")
+		if key == "" {
+			return fmt.Errorf("key %q: matches every key", pattern)
+		}
+		if key != pattern {
+			continue
+		}
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("key %q: %s", pattern, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+// matchesKey reports whether key is one of patterns or has the prefix of
+// one ending with *.
+func matchesKey(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); (ok && strings.HasPrefix(key, prefix)) || pattern == key {
+			return true
+		}
+	}
+	return false
+}
+
+// copyNamespaceMetadata copies the entries of from, the namespace's labels
+// or annotations, whose keys match patterns onto existing, the secret's,
+// calling set and remove for the edits, and returns the keys copied, sorted.
+// recorded lists those copied before: they are updated, and removed once
+// from no longer has them, while the other keys existing has are kept
+// unless they match force, calling conflict when their value differs.
+func copyNamespaceMetadata(from, existing map[string]string, recorded string, patterns, force []string,
+	set func(key, value string), remove func(key string), conflict func(key string)) []string {
+	owned := strings.Split(recorded, ",")
+	var copied []string
+	for _, key := range sortedKeys(from) {
+		if !matchesKey(patterns, key) {
+			continue
+		}
+		if value, ok := existing[key]; ok && !slices.Contains(owned, key) && !matchesKey(force, key) {
+			if value != from[key] {
+				conflict(key)
+			}
+			continue
+		}
+		set(key, from[key])
+		copied = append(copied, key)
+	}
+	for _, key := range owned {
+		if key != "" && !slices.Contains(copied, key) {
+			remove(key)
+		}
+	}
+	return copied
+}
+
+// recordCopied sets the annotation key to the keys copied, or removes it
+// when there are none.
+func recordCopied(patch *PatchBuilder, key string, copied []string) {
+	if len(copied) == 0 {
+		patch.RemoveAnnotation(key)
+		return
+	}
+	patch.AddAnnotation(key, strings.Join(copied, ","))
+}
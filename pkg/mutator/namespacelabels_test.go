@@ -0,0 +1,140 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// applyWithNamespaces runs stage on an UPDATE of secret in the namespaces
+// and returns the patch, the secret patched and the decision.
+func applyWithNamespaces(t *testing.T, stage Stage, secret *corev1.Secret, namespaces NamespaceLister) ([]PatchOperation, *corev1.Secret, Decision) {
+	t.Helper()
+	decision := Decision{Mutate: true, Annotations: map[string]string{}}
+	patch, err := stage.Apply(context.Background(), AdmissionContext{Operation: "UPDATE", Secret: secret, Namespaces: namespaces}, &decision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) == 0 {
+		return nil, secret, decision
+	}
+	return patch, applyPatch(t, secret, patch), decision
+}
+
+// The labels of the namespace matching the keys are copied and listed;
+// others and those the namespace doesn't have aren't. A second run patches
+// nothing.
+func TestNamespaceLabels(t *testing.T) {
+	stage := buildStage(t, NamespaceLabelsStage, DefaultConfig(), json.RawMessage(`{"keys":["team","cost-center","cost.example.com/*"]}`))
+	namespaces := fixedNamespaces{
+		"payments": {"team": "payments", "cost-center": "cc-42", "cost.example.com/owner": "finance", "cost.example.com/budget": "b1", "env": "prod"},
+		"bare":     {"env": "dev"},
+	}
+
+	_, patched, decision := applyWithNamespaces(t, stage, tlsSecret("payments", "api-tls", nil), namespaces)
+	want := map[string]string{"team": "payments", "cost-center": "cc-42", "cost.example.com/owner": "finance", "cost.example.com/budget": "b1"}
+	if len(patched.Labels) != len(want) {
+		t.Errorf("labels %v, want %v", patched.Labels, want)
+	}
+	for key, value := range want {
+		if patched.Labels[key] != value {
+			t.Errorf("label %s = %q, want %q", key, patched.Labels[key], value)
+		}
+	}
+	if got := patched.Annotations[NamespaceLabelsAnnotationKey]; got != "cost-center,cost.example.com/budget,cost.example.com/owner,team" {
+		t.Errorf("copied labels listed as %q", got)
+	}
+	if len(decision.Warnings) != 0 {
+		t.Errorf("warnings %q", decision.Warnings)
+	}
+	if patch, _, _ := applyWithNamespaces(t, stage, patched, namespaces); patch != nil {
+		t.Errorf("copied labels patched again with %+v", patch)
+	}
+
+	// nothing to copy
+	if patch, _, _ := applyWithNamespaces(t, stage, tlsSecret("bare", "api-tls", nil), namespaces); patch != nil {
+		t.Errorf("namespace without the labels patched with %+v", patch)
+	}
+}
+
+// A label the secret has is kept, with a warning when its value differs,
+// unless forced.
+func TestNamespaceLabelsConflicts(t *testing.T) {
+	namespaces := fixedNamespaces{"payments": {"team": "payments", "cost-center": "cc-42"}}
+	secret := tlsSecret("payments", "api-tls", nil)
+	secret.Labels = map[string]string{"team": "platform", "cost-center": "cc-42"}
+
+	stage := buildStage(t, NamespaceLabelsStage, DefaultConfig(), json.RawMessage(`{"keys":["team","cost-center"]}`))
+	patch, patched, decision := applyWithNamespaces(t, stage, secret, namespaces)
+	if patch != nil || patched.Labels["team"] != "platform" {
+		t.Errorf("labels of the secret overwritten with %+v", patch)
+	}
+	if len(decision.Warnings) != 1 || !strings.Contains(decision.Warnings[0], "label team of namespace payments not copied") {
+		t.Errorf("warnings %q, want team's conflict only", decision.Warnings)
+	}
+
+	stage = buildStage(t, NamespaceLabelsStage, DefaultConfig(), json.RawMessage(`{"keys":["team","cost-center"],"force":["team"]}`))
+	_, patched, decision = applyWithNamespaces(t, stage, secret, namespaces)
+	if patched.Labels["team"] != "payments" || patched.Annotations[NamespaceLabelsAnnotationKey] != "team" || len(decision.Warnings) != 0 {
+		t.Errorf("forced: labels %v, copied %q, warnings %q", patched.Labels, patched.Annotations[NamespaceLabelsAnnotationKey], decision.Warnings)
+	}
+}
+
+// The labels copied follow the namespace on UPDATE, those it no longer has
+// are removed with the list, and the secret's own labels are left alone.
+func TestNamespaceLabelsRefresh(t *testing.T) {
+	stage := buildStage(t, NamespaceLabelsStage, DefaultConfig(), json.RawMessage(`{"keys":["team","cost-center"]}`))
+	secret := tlsSecret("payments", "api-tls", nil)
+	secret.Labels = map[string]string{"app": "api"}
+	_, copied, _ := applyWithNamespaces(t, stage, secret, fixedNamespaces{"payments": {"team": "payments", "cost-center": "cc-42"}})
+
+	_, patched, _ := applyWithNamespaces(t, stage, copied, fixedNamespaces{"payments": {"team": "billing"}})
+	if patched.Labels["team"] != "billing" || patched.Labels["app"] != "api" || patched.Annotations[NamespaceLabelsAnnotationKey] != "team" {
+		t.Errorf("labels %v, copied %q after the namespace changed", patched.Labels, patched.Annotations[NamespaceLabelsAnnotationKey])
+	}
+	if _, ok := patched.Labels["cost-center"]; ok {
+		t.Error("label the namespace dropped left on the secret")
+	}
+
+	_, patched, _ = applyWithNamespaces(t, stage, patched, fixedNamespaces{"payments": nil})
+	if len(patched.Labels) != 1 || patched.Labels["app"] != "api" {
+		t.Errorf("labels %v once the namespace has none", patched.Labels)
+	}
+	if _, ok := patched.Annotations[NamespaceLabelsAnnotationKey]; ok {
+		t.Error("list of copied labels left once none is")
+	}
+}
+
+// A namespace missing from the cache fails the stage, for the failure
+// policy to answer.
+func TestNamespaceLabelsMissingNamespace(t *testing.T) {
+	stage := buildStage(t, NamespaceLabelsStage, DefaultConfig(), json.RawMessage(`{"keys":["team"]}`))
+	decision := Decision{Mutate: true, Annotations: map[string]string{}}
+	_, err := stage.Apply(context.Background(), AdmissionContext{Operation: "CREATE", Secret: tlsSecret("new", "api-tls", nil), Namespaces: fixedNamespaces{}}, &decision)
+	if !errors.Is(err, ErrNamespaceNotCached) {
+		t.Errorf("error %v, want %v", err, ErrNamespaceNotCached)
+	}
+}
+
+func TestNamespaceLabelsConfig(t *testing.T) {
+	for _, tt := range []struct {
+		settings string
+		want     string
+	}{
+		{settings: `{}`, want: "no keys"},
+		{settings: `{"keys":["*"]}`, want: `key "*": matches every key`},
+		{settings: `{"keys":["team"],"force":["bad key"]}`, want: `key "bad key"`},
+		{settings: `{"keys":["team"],"labels":["x"]}`, want: `unknown field "labels"`},
+	} {
+		config := DefaultConfig()
+		config.Stages = []string{PolicyStage, SyncAnnotationStage, NamespaceLabelsStage}
+		config.StageConfig = map[string]json.RawMessage{NamespaceLabelsStage: json.RawMessage(tt.settings)}
+		if _, err := New(config); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.settings, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package mutator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// JSON pointers of the object maps PatchBuilder has methods for.
+const (
+	annotationsPath = "/metadata/annotations"
+	labelsPath      = "/metadata/labels"
+	dataPath        = "/data"
+)
+
+var (
+	pointerEscaper   = strings.NewReplacer("~", "~0", "/", "~1")
+	pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+)
+
+// EscapePointer escapes key for use as a JSON Pointer reference token (RFC
+// 6901), e.g. an annotation key in a patch path.
+func EscapePointer(key string) string { return pointerEscaper.Replace(key) }
+
+// UnescapePointer returns the key a JSON Pointer reference token escapes.
+func UnescapePointer(token string) string { return pointerUnescaper.Replace(token) }
+
+// PatchBuilder assembles the JSON patch of one object. It escapes keys per
+// RFC 6901, knows which of the object's maps exist and creates the missing
+// ones, drops operations the object already satisfies and collapses
+// operations on the same key, the last one winning with a warning. The
+// operations are validated when built and always come out in the same
+// order, sorted by path with test operations ahead of the others on their
+// path, whatever the order of the maps they were built from; replicas
+// given the same object and edits produce byte-identical patches.
+type PatchBuilder struct {
+	maps     map[string]*patchMap      // maps of the object, by pointer
+	ops      map[string]PatchOperation // operations outside the maps, by path
+	tests    []PatchOperation          // test operations guarding the patch
+	warnings []string
+	errs     []error
+}
+
+// patchMap is a map of the object and the edits to its keys.
+type patchMap struct {
+	existing  map[string]interface{} // nil when the object lacks the map
+	ancestors []string               // missing parents to create with it, outermost first
+	edits     map[string]PatchOperation
+}
+
+// NewPatchBuilder returns a builder for obj, which knows its annotations and
+// labels and, for a secret, its data.
+func NewPatchBuilder(obj metav1.Object) *PatchBuilder {
+	b := newPatchBuilder()
+	b.DeclareMap(annotationsPath, obj.GetAnnotations())
+	b.DeclareMap(labelsPath, obj.GetLabels())
+	if secret, ok := obj.(*corev1.Secret); ok {
+		var data map[string]interface{}
+		if secret.Data != nil {
+			data = make(map[string]interface{}, len(secret.Data))
+			for key, value := range secret.Data {
+				data[key] = value
+			}
+		}
+		b.declare(dataPath, data)
+	}
+	return b
+}
+
+func newPatchBuilder() *PatchBuilder {
+	return &PatchBuilder{maps: map[string]*patchMap{}, ops: map[string]PatchOperation{}}
+}
+
+// DeclareMap tells the builder about another string map of the object, at
+// the JSON pointer path. existing is nil when the object lacks it; the
+// pointers of its missing parents, outermost first, are then created too.
+// An empty map is created anew as well, since encoding drops it.
+func (b *PatchBuilder) DeclareMap(path string, existing map[string]string, missingAncestors ...string) {
+	var values map[string]interface{}
+	if existing != nil {
+		values = make(map[string]interface{}, len(existing))
+		for key, value := range existing {
+			values[key] = value
+		}
+	}
+	b.declare(path, values, missingAncestors...)
+}
+
+func (b *PatchBuilder) declare(path string, existing map[string]interface{}, missingAncestors ...string) {
+	if len(existing) == 0 {
+		existing = nil
+	}
+	b.maps[path] = &patchMap{existing: existing, ancestors: missingAncestors, edits: map[string]PatchOperation{}}
+}
+
+// AddAnnotation sets an annotation.
+func (b *PatchBuilder) AddAnnotation(key, value string) { b.set(annotationsPath, "add", key, value) }
+
+// ReplaceAnnotation changes an annotation the object must already have.
+func (b *PatchBuilder) ReplaceAnnotation(key, value string) {
+	b.set(annotationsPath, "replace", key, value)
+}
+
+// RemoveAnnotation removes an annotation if the object has it.
+func (b *PatchBuilder) RemoveAnnotation(key string) { b.set(annotationsPath, "remove", key, nil) }
+
+// AddLabel sets a label.
+func (b *PatchBuilder) AddLabel(key, value string) { b.set(labelsPath, "add", key, value) }
+
+// RemoveLabel removes a label if the object has it.
+func (b *PatchBuilder) RemoveLabel(key string) { b.set(labelsPath, "remove", key, nil) }
+
+// AddDataKey sets a key of a secret's data. The secret must have been
+// decoded with its data, by a Mutator whose stage is a DataStage.
+func (b *PatchBuilder) AddDataKey(key string, value []byte) { b.set(dataPath, "add", key, value) }
+
+// RemoveDataKey removes a key of a secret's data if it has it.
+func (b *PatchBuilder) RemoveDataKey(key string) { b.set(dataPath, "remove", key, nil) }
+
+// AddMapKey sets a key of the map declared at path.
+func (b *PatchBuilder) AddMapKey(path, key, value string) { b.set(path, "add", key, value) }
+
+func (b *PatchBuilder) set(path, op, key string, value interface{}) {
+	m, ok := b.maps[path]
+	switch {
+	case !ok:
+		b.errs = append(b.errs, fmt.Errorf("%s %s: map not declared", op, path))
+		return
+	case key == "":
+		b.errs = append(b.errs, fmt.Errorf("%s %s: empty key", op, path))
+		return
+	}
+	edit := PatchOperation{Op: op, Path: path + "/" + EscapePointer(key), Value: value}
+	if prev, ok := m.edits[key]; ok && !reflect.DeepEqual(prev, edit) {
+		b.warnings = append(b.warnings, fmt.Sprintf("conflicting patch operations on %s, the last one wins", edit.Path))
+	}
+	m.edits[key] = edit
+}
+
+// Merge adds operations built elsewhere, e.g. returned by a stage. Those on
+// the keys of a known map, or adding a whole one, are taken apart into key
+// edits; test operations are all kept; others are kept as they are, the
+// last one on a path winning.
+func (b *PatchBuilder) Merge(ops ...PatchOperation) {
+	for _, op := range ops {
+		if op.Op == "test" {
+			b.tests = append(b.tests, op)
+			continue
+		}
+		if _, ok := b.maps[op.Path]; ok && op.Op == "add" {
+			if values, ok := stringMap(op.Value); ok {
+				for _, key := range sortedKeys(values) {
+					b.set(op.Path, "add", key, values[key])
+				}
+				continue
+			}
+		}
+		if path, key, ok := b.mapKey(op.Path); ok {
+			b.set(path, op.Op, key, op.Value)
+			continue
+		}
+		if prev, ok := b.ops[op.Path]; ok && !reflect.DeepEqual(prev, op) {
+			b.warnings = append(b.warnings, fmt.Sprintf("conflicting patch operations on %s, the last one wins", op.Path))
+		}
+		b.ops[op.Path] = op
+	}
+}
+
+// mapKey splits a pointer to a key of a known map.
+func (b *PatchBuilder) mapKey(pointer string) (path, key string, ok bool) {
+	i := strings.LastIndex(pointer, "/")
+	if i < 0 {
+		return "", "", false
+	}
+	if _, known := b.maps[pointer[:i]]; !known {
+		return "", "", false
+	}
+	return pointer[:i], UnescapePointer(pointer[i+1:]), true
+}
+
+// stringMap returns the entries of an annotation or label map value.
+func stringMap(value interface{}) (map[string]string, bool) {
+	switch v := value.(type) {
+	case map[string]string:
+		return v, true
+	case map[string]interface{}:
+		values := make(map[string]string, len(v))
+		for key, value := range v {
+			s, ok := value.(string)
+			if !ok {
+				return nil, false
+			}
+			values[key] = s
+		}
+		return values, true
+	}
+	return nil, false
+}
+
+// Warnings returns the conflicts between operations, resolved in favour of
+// the last one.
+func (b *PatchBuilder) Warnings() []string {
+	return b.warnings
+}
+
+// Operations returns the patch in the builder's order. A missing map is
+// created with all its added keys in one operation, after its missing
+// parents. It fails when an operation can't apply to the object, e.g.
+// replacing a key it doesn't have.
+func (b *PatchBuilder) Operations() ([]PatchOperation, error) {
+	errs := b.errs
+	patch := append([]PatchOperation(nil), b.tests...)
+	parents := map[string]bool{} // missing parents already created
+	for _, path := range sortedKeys(b.maps) {
+		m := b.maps[path]
+		keys := sortedKeys(m.edits)
+
+		if m.existing == nil {
+			created := map[string]interface{}{}
+			for _, key := range keys {
+				switch edit := m.edits[key]; edit.Op {
+				case "add":
+					created[key] = edit.Value
+				case "replace":
+					errs = append(errs, fmt.Errorf("replace %s: no such key", edit.Path))
+				}
+			}
+			if len(created) == 0 {
+				continue
+			}
+			for _, ancestor := range m.ancestors {
+				if !parents[ancestor] {
+					parents[ancestor] = true
+					patch = append(patch, PatchOperation{Op: "add", Path: ancestor, Value: map[string]interface{}{}})
+				}
+			}
+			patch = append(patch, PatchOperation{Op: "add", Path: path, Value: created})
+			continue
+		}
+
+		for _, key := range keys {
+			edit := m.edits[key]
+			current, has := m.existing[key]
+			switch {
+			case edit.Op == "replace" && !has:
+				errs = append(errs, fmt.Errorf("replace %s: no such key", edit.Path))
+			case edit.Op == "remove" && !has,
+				edit.Op != "remove" && has && reflect.DeepEqual(current, edit.Value):
+				// already the case
+			case edit.Op == "add" || edit.Op == "replace" || edit.Op == "remove":
+				patch = append(patch, edit)
+			default:
+				errs = append(errs, fmt.Errorf("%s %s: unsupported operation", edit.Op, edit.Path))
+			}
+		}
+	}
+	for _, path := range sortedKeys(b.ops) {
+		patch = append(patch, b.ops[path])
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	SortPatch(patch)
+	return patch, nil
+}
+
+// SortPatch puts operations in the order PatchBuilder guarantees: by path,
+// a parent ahead of its children, and test operations first on their path.
+// Operations on the same path otherwise keep their order.
+func SortPatch(patch []PatchOperation) {
+	sort.SliceStable(patch, func(i, j int) bool {
+		if patch[i].Path != patch[j].Path {
+			return patch[i].Path < patch[j].Path
+		}
+		return patch[i].Op == "test" && patch[j].Op != "test"
+	})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MarshalJSON encodes the operation, with a value unless it is a remove;
+// empty strings are values too.
+func (op PatchOperation) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{op.Op, op.Path})
+	}
+	return json.Marshal(struct {
+		Op    string      `json:"op"`
+		Path  string      `json:"path"`
+		Value interface{} `json:"value"`
+	}{op.Op, op.Path, op.Value})
+}
+
+// Build returns the patch encoded for an AdmissionResponse.
+func (b *PatchBuilder) Build() ([]byte, error) {
+	patch, err := b.Operations()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(patch)
+}
@@ -0,0 +1,267 @@
+package mutator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEscapePointer(t *testing.T) {
+	tests := map[string]string{
+		"kubed.appscode.com/sync": "kubed.appscode.com~1sync",
+		"a~b":                     "a~0b",
+		"~1":                      "~01",
+		"plain":                   "plain",
+	}
+	for key, want := range tests {
+		if got := EscapePointer(key); got != want {
+			t.Errorf("EscapePointer(%q) = %q, want %q", key, got, want)
+		}
+		if got := UnescapePointer(want); got != key {
+			t.Errorf("UnescapePointer(%q) = %q, want %q", want, got, key)
+		}
+	}
+}
+
+// applyBuilt applies the patch b builds to doc.
+func applyBuilt(t *testing.T, doc []byte, b *PatchBuilder) []byte {
+	t.Helper()
+	raw, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := jsonpatch.DecodePatch(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := patch.Apply(doc)
+	if err != nil {
+		t.Fatalf("patch %s doesn't apply: %v", raw, err)
+	}
+	return patched
+}
+
+// Every operation of the builder applies to the object it was built for
+// and has the effect asked for, whether the object has the map or not.
+func TestPatchBuilderRoundTrip(t *testing.T) {
+	full := &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "api-tls",
+			Namespace:   "apps",
+			Annotations: map[string]string{"a/b~c": "old", "gone": "x", "kept": "k"},
+			Labels:      map[string]string{"tier": "web", "gone": "x"},
+		},
+		Data: map[string][]byte{corev1.TLSCertKey: []byte("cert"), "gone": []byte("x")},
+	}
+	empty := &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: "api-tls", Namespace: "apps"},
+	}
+	for name, secret := range map[string]*corev1.Secret{"maps present": full, "maps absent": empty} {
+		t.Run(name, func(t *testing.T) {
+			b := NewPatchBuilder(secret)
+			b.AddAnnotation("new/key~1", "added")
+			if secret == full {
+				b.ReplaceAnnotation("a/b~c", "replaced")
+			}
+			b.RemoveAnnotation("gone")
+			b.AddLabel("team", "payments")
+			b.RemoveLabel("gone")
+			b.AddDataKey("ca.crt", []byte("ca"))
+			b.RemoveDataKey("gone")
+
+			doc, err := json.Marshal(secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var patched corev1.Secret
+			if err := json.Unmarshal(applyBuilt(t, doc, b), &patched); err != nil {
+				t.Fatal(err)
+			}
+			if patched.Annotations["new/key~1"] != "added" || patched.Labels["team"] != "payments" || string(patched.Data["ca.crt"]) != "ca" {
+				t.Errorf("added keys missing: annotations %v, labels %v, data %v", patched.Annotations, patched.Labels, patched.Data)
+			}
+			for _, has := range []bool{hasKey(patched.Annotations, "gone"), hasKey(patched.Labels, "gone"), hasKey(patched.Data, "gone")} {
+				if has {
+					t.Error("removed key left")
+				}
+			}
+			if secret == full {
+				if patched.Annotations["a/b~c"] != "replaced" || patched.Annotations["kept"] != "k" ||
+					patched.Labels["tier"] != "web" || string(patched.Data[corev1.TLSCertKey]) != "cert" {
+					t.Errorf("existing keys wrong: annotations %v, labels %v, data %v", patched.Annotations, patched.Labels, patched.Data)
+				}
+			}
+		})
+	}
+}
+
+func hasKey[V any](m map[string]V, key string) bool {
+	_, ok := m[key]
+	return ok
+}
+
+// A map under missing parents is created with them.
+func TestPatchBuilderAncestors(t *testing.T) {
+	b := newPatchBuilder()
+	b.DeclareMap("/spec/secretTemplate/annotations", nil, "/spec/secretTemplate")
+	b.AddMapKey("/spec/secretTemplate/annotations", SyncAnnotationKey, "true")
+	var cert struct {
+		Spec struct {
+			SecretName     string `json:"secretName"`
+			SecretTemplate struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"secretTemplate"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(applyBuilt(t, []byte(`{"spec":{"secretName":"api-tls"}}`), b), &cert); err != nil {
+		t.Fatal(err)
+	}
+	if cert.Spec.SecretName != "api-tls" || cert.Spec.SecretTemplate.Annotations[SyncAnnotationKey] != "true" {
+		t.Errorf("patched to %+v", cert.Spec)
+	}
+}
+
+// Operations on the same key collapse, the last one winning with a warning;
+// those the object already satisfies are dropped.
+func TestPatchBuilderDedup(t *testing.T) {
+	secret := tlsSecret("apps", "api-tls", map[string]string{"same": "v"})
+	b := NewPatchBuilder(secret)
+	b.AddAnnotation("key", "first")
+	b.AddAnnotation("key", "first")
+	if len(b.Warnings()) != 0 {
+		t.Errorf("warnings %q for the same operation twice", b.Warnings())
+	}
+	b.AddAnnotation("key", "second")
+	b.AddAnnotation("same", "v")
+	b.RemoveAnnotation("absent")
+	b.RemoveLabel("absent")
+	patch, err := b.Operations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 1 || patch[0].Value != "second" {
+		t.Errorf("patch %+v, want the last add of key only", patch)
+	}
+	if len(b.Warnings()) != 1 || !strings.Contains(b.Warnings()[0], "/metadata/annotations/key") {
+		t.Errorf("warnings %q, want the conflict on key", b.Warnings())
+	}
+
+	// merged operations collapse the same way, and test operations are kept
+	b = NewPatchBuilder(secret)
+	b.Merge(
+		PatchOperation{Op: "add", Path: "/metadata/annotations/key", Value: "merged"},
+		PatchOperation{Op: "add", Path: "/metadata/labels", Value: map[string]interface{}{"team": "payments"}},
+		PatchOperation{Op: "test", Path: "/metadata/annotations/same", Value: "v"},
+	)
+	b.AddAnnotation("key", "last")
+	doc, err := json.Marshal(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patched corev1.Secret
+	if err := json.Unmarshal(applyBuilt(t, doc, b), &patched); err != nil {
+		t.Fatal(err)
+	}
+	if patched.Annotations["key"] != "last" || patched.Labels["team"] != "payments" {
+		t.Errorf("merged patch gave annotations %v, labels %v", patched.Annotations, patched.Labels)
+	}
+	if patch, _ := b.Operations(); !slices.ContainsFunc(patch, func(op PatchOperation) bool { return op.Op == "test" }) {
+		t.Errorf("patch %+v, want the test operation kept", patch)
+	}
+}
+
+// Operations that can't apply fail the build rather than the patch.
+func TestPatchBuilderErrors(t *testing.T) {
+	secret := tlsSecret("apps", "api-tls", nil)
+	for name, edit := range map[string]func(b *PatchBuilder){
+		"replace missing key": func(b *PatchBuilder) { b.ReplaceAnnotation("absent", "x") },
+		"replace missing map": func(b *PatchBuilder) {
+			b.Merge(PatchOperation{Op: "replace", Path: "/metadata/labels/c", Value: "d"})
+		},
+		"undeclared map": func(b *PatchBuilder) { b.AddMapKey("/spec/template", "a", "b") },
+		"empty key":      func(b *PatchBuilder) { b.AddAnnotation("", "x") },
+	} {
+		b := NewPatchBuilder(secret)
+		edit(b)
+		if _, err := b.Build(); err == nil {
+			t.Errorf("%s: built", name)
+		}
+	}
+}
+
+// The same edits, made in whatever order Go iterates their maps, build the
+// same bytes, as do full evaluations of the same secret.
+func TestPatchDeterministic(t *testing.T) {
+	annotations, labels, data := map[string]string{}, map[string]string{}, map[string][]byte{}
+	existing := map[string]string{CertManagerAnnotationKey: "api-tls"}
+	for i := range 50 {
+		key := fmt.Sprintf("example.com/key-%02d", i)
+		annotations[key] = fmt.Sprint(i)
+		labels[fmt.Sprintf("label-%02d", i)] = fmt.Sprint(i)
+		data[fmt.Sprintf("file-%02d", i)] = []byte{byte(i)}
+		if i%2 == 0 {
+			existing[key] = "old"
+			existing[fmt.Sprintf("example.com/gone-%02d", i)] = "x"
+		}
+	}
+	secret := tlsSecret("apps", "api-tls", existing)
+	config := DefaultConfig()
+	config.Stages = []string{PolicyStage, teamStage, renameStage, SyncAnnotationStage}
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var built, evaluated []byte
+	for i := range 1000 {
+		b := NewPatchBuilder(secret)
+		for key, value := range annotations {
+			b.AddAnnotation(key, value)
+		}
+		for key := range existing {
+			if strings.Contains(key, "/gone-") {
+				b.RemoveAnnotation(key)
+			}
+		}
+		for key, value := range labels {
+			b.AddLabel(key, value)
+		}
+		for key, value := range data {
+			b.AddDataKey(key, value)
+		}
+		raw, err := b.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		marshalled, err := m.MarshalPatch(patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 0 {
+			built, evaluated = raw, marshalled
+			continue
+		}
+		if !bytes.Equal(raw, built) {
+			t.Fatalf("build %d:\n%s\nwant\n%s", i, raw, built)
+		}
+		if !bytes.Equal(marshalled, evaluated) {
+			t.Fatalf("evaluation %d:\n%s\nwant\n%s", i, marshalled, evaluated)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package mutator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// ProfileAnnotationKey names the sync profile of a secret, taking
+// precedence over the profile of the rule it matched.
+const ProfileAnnotationKey = "cert-sync.bygui86.io/profile"
+
+// SyncAnnotationConfig holds the settings of the sync-annotation stage.
+type SyncAnnotationConfig struct {
+	// Profiles are named sets of targets, picked by the rule a secret
+	// matched or by its ProfileAnnotationKey instead of the cluster default.
+	Profiles map[string]SyncProfile `json:"profiles,omitempty"`
+}
+
+// SyncProfile is a named set of target namespaces, e.g. the infrastructure
+// namespaces receiving every platform certificate.
+type SyncProfile struct {
+	TargetNamespaces []string `json:"targetNamespaces"`
+}
+
+// syncProfiles decodes and checks the settings of the sync-annotation
+// stage in config, which the policy reads too, and returns the sync value
+// of each profile.
+func syncProfiles(config Config) (map[string]string, error) {
+	var settings SyncAnnotationConfig
+	if raw := config.StageConfig[SyncAnnotationStage]; len(raw) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&settings); err != nil {
+			return nil, err
+		}
+	}
+	values := make(map[string]string, len(settings.Profiles))
+	for name, profile := range settings.Profiles {
+		if len(profile.TargetNamespaces) == 0 {
+			return nil, fmt.Errorf("profile %q has no targetNamespaces", name)
+		}
+		for _, namespace := range profile.TargetNamespaces {
+			if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+				return nil, fmt.Errorf("profile %q: namespace %q: %v", name, namespace, errs)
+			}
+		}
+		namespaces := append([]string(nil), profile.TargetNamespaces...)
+		sort.Strings(namespaces)
+		values[name] = NamespaceNameSelector(namespaces)
+	}
+	return values, nil
+}
+
+// profileSyncStage is the sync-annotation stage when there are profiles or
+// a cap on the targets:
+// the sync value is that of the secret's profile, named by its
+// ProfileAnnotationKey or else by the rule it matched, and the cluster
+// default without one. An unknown profile falls back to the default, with a
+// warning.
+type profileSyncStage struct {
+	config   Config
+	profiles map[string]string // sync values by profile name
+}
+
+func (s profileSyncStage) Apply(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+	name := obj.Secret.Annotations[ProfileAnnotationKey]
+	if name == "" {
+		name = decision.Profile
+	}
+	value := s.config.NamespaceSelector
+	if name != "" {
+		if profile, ok := s.profiles[name]; ok {
+			value = profile
+			decision.Profile = name
+		} else {
+			decision.Profile = ""
+			decision.Warnings = append(decision.Warnings, fmt.Sprintf("unknown sync profile %q; syncing to the default %q", name, value))
+		}
+	}
+	decision.tracef("sync profile %q", decision.Profile)
+	return setSyncAnnotation(obj, s.config, decision, value)
+}
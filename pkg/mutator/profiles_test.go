@@ -0,0 +1,101 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// profilesConfig returns the default config with the rules and the sync
+// profiles.
+func profilesConfig(t *testing.T, rules []Rule, profiles map[string]SyncProfile) Config {
+	t.Helper()
+	policy, err := json.Marshal(PolicyConfig{Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync, err := json.Marshal(SyncAnnotationConfig{Profiles: profiles})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.StageConfig = map[string]json.RawMessage{PolicyStage: policy, SyncAnnotationStage: sync}
+	return config
+}
+
+// The profile of the rule a secret matched picks its targets, unless the
+// secret names another; an unknown name falls back to the default with a
+// warning.
+func TestSyncProfiles(t *testing.T) {
+	m, err := New(profilesConfig(t, []Rule{
+		{Name: "platform", MatchExpression: `object.metadata.name.startsWith("wildcard-")`, Profile: "infra"},
+		{Name: "default"},
+	}, map[string]SyncProfile{
+		"infra": {TargetNamespaces: []string{"monitoring", "ingress-nginx", "istio-system"}},
+		"edge":  {TargetNamespaces: []string{"ingress-nginx"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const infra = "kubernetes.io/metadata.name in (ingress-nginx,istio-system,monitoring)"
+	for _, tt := range []struct {
+		name        string
+		annotations map[string]string
+		want        string
+		profile     string
+		warning     string
+	}{
+		{name: "wildcard-tls", want: infra, profile: "infra"},
+		{name: "api-tls", want: "true"},
+		{name: "api-tls", annotations: map[string]string{ProfileAnnotationKey: "infra"}, want: infra, profile: "infra"},
+		{name: "wildcard-tls", annotations: map[string]string{ProfileAnnotationKey: "edge"}, want: "kubernetes.io/metadata.name in (ingress-nginx)", profile: "edge"},
+		{name: "wildcard-tls", annotations: map[string]string{ProfileAnnotationKey: "infar"}, want: "true", warning: `unknown sync profile "infar"`},
+		{name: "api-tls", annotations: map[string]string{ProfileAnnotationKey: "infar"}, want: "true", warning: `unknown sync profile "infar"`},
+	} {
+		secret := tlsSecret("apps", tt.name, tt.annotations)
+		decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]; got != tt.want || decision.Profile != tt.profile {
+			t.Errorf("%s %v: synced to %q by profile %q, want %q by %q", tt.name, tt.annotations, got, decision.Profile, tt.want, tt.profile)
+		}
+		if tt.warning == "" && len(decision.Warnings) != 0 || tt.warning != "" && (len(decision.Warnings) != 1 || !strings.Contains(decision.Warnings[0], tt.warning)) {
+			t.Errorf("%s %v: warnings %q, want %q", tt.name, tt.annotations, decision.Warnings, tt.warning)
+		}
+	}
+
+	// without profiles, any is unknown
+	m, err = New(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := tlsSecret("apps", "api-tls", map[string]string{ProfileAnnotationKey: "infra"})
+	decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]; got != "true" || len(decision.Warnings) != 1 ||
+		!strings.Contains(decision.Warnings[0], `unknown sync profile "infra"`) {
+		t.Errorf("without profiles: synced to %q with warnings %q, want the default with one", got, decision.Warnings)
+	}
+}
+
+func TestSyncProfilesConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		rules    []Rule
+		profiles map[string]SyncProfile
+		want     string
+	}{
+		{name: "no targets", profiles: map[string]SyncProfile{"infra": {}}, want: `profile "infra" has no targetNamespaces`},
+		{name: "bad namespace", profiles: map[string]SyncProfile{"infra": {TargetNamespaces: []string{"Monitoring"}}}, want: `profile "infra": namespace "Monitoring"`},
+		{name: "unknown profile of a rule", rules: []Rule{{Name: "platform", Profile: "infar"}},
+			profiles: map[string]SyncProfile{"infra": {TargetNamespaces: []string{"monitoring"}}}, want: `rule "platform": unknown profile "infar"`},
+	} {
+		if _, err := New(profilesConfig(t, tt.rules, tt.profiles)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package mutator
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// SkipNoSignatureMatched is the reason a secret matching none of the
+// configured ownership signatures is skipped.
+const SkipNoSignatureMatched = "no-signature-matched"
+
+// Built-in signature presets.
+const (
+	// PresetCertManager matches the secrets cert-manager issues for
+	// Certificates.
+	PresetCertManager = "cert-manager"
+	// PresetCSIDriver matches the secrets carrying the annotations of the
+	// cert-manager csi-driver.
+	PresetCSIDriver = "csi-driver"
+)
+
+// signaturePresets are the built-in signatures, by name.
+var signaturePresets = map[string]Signature{
+	PresetCertManager: {Name: PresetCertManager, AnnotationKey: CertManagerAnnotationKey},
+	PresetCSIDriver:   {Name: PresetCSIDriver, AnnotationKey: "csi.cert-manager.io/*"},
+}
+
+// Signature tells the secrets of one producer of TLS material, e.g.
+// cert-manager or an operator, by their metadata. All the set fields must
+// match.
+type Signature struct {
+	// Name identifies the signature in logs and metrics.
+	Name string `json:"name"`
+	// AnnotationKey must be present; a trailing * matches any key with
+	// that prefix, e.g. "csi.cert-manager.io/*".
+	AnnotationKey string `json:"annotationKey,omitempty"`
+	// AnnotationValue, with AnnotationKey, is the value the annotation
+	// must have.
+	AnnotationValue string `json:"annotationValue,omitempty"`
+	// LabelSelector must select the secret's labels.
+	LabelSelector string `json:"labelSelector,omitempty"`
+}
+
+// compiledSignature is a Signature with its selector parsed.
+type compiledSignature struct {
+	Signature
+	selector labels.Selector // nil when not set
+}
+
+// compileSignatures returns the presets named followed by the custom
+// signatures, checked.
+func compileSignatures(presets []string, custom []Signature) ([]compiledSignature, error) {
+	signatures := make([]Signature, 0, len(presets)+len(custom))
+	for _, name := range presets {
+		preset, ok := signaturePresets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown signature preset %q, presets: %s, %s", name, PresetCertManager, PresetCSIDriver)
+		}
+		signatures = append(signatures, preset)
+	}
+	signatures = append(signatures, custom...)
+	compiled := make([]compiledSignature, 0, len(signatures))
+	names := map[string]bool{}
+	for i, signature := range signatures {
+		switch {
+		case signature.Name == "":
+			return nil, fmt.Errorf("signature %d: no name", i)
+		case names[signature.Name]:
+			return nil, fmt.Errorf("signature %q: name taken", signature.Name)
+		case signature.AnnotationKey == "" && signature.LabelSelector == "":
+			return nil, fmt.Errorf("signature %q: neither annotationKey nor labelSelector", signature.Name)
+		case signature.AnnotationValue != "" && (signature.AnnotationKey == "" || strings.HasSuffix(signature.AnnotationKey, "*")):
+			return nil, fmt.Errorf("signature %q: annotationValue needs an exact annotationKey", signature.Name)
+		}
+		names[signature.Name] = true
+		c := compiledSignature{Signature: signature}
+		if signature.LabelSelector != "" {
+			selector, err := labels.Parse(signature.LabelSelector)
+			if err != nil {
+				return nil, fmt.Errorf("signature %q: labelSelector: %w", signature.Name, err)
+			}
+			c.selector = selector
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// matches reports whether the secret with metadata has the signature.
+func (s compiledSignature) matches(metadata metav1.ObjectMeta) bool {
+	if s.selector != nil && !s.selector.Matches(labels.Set(metadata.Labels)) {
+		return false
+	}
+	switch key := s.AnnotationKey; {
+	case key == "":
+		return true
+	case strings.HasSuffix(key, "*"):
+		for annotation := range metadata.Annotations {
+			if strings.HasPrefix(annotation, strings.TrimSuffix(key, "*")) {
+				return true
+			}
+		}
+		return false
+	default:
+		value, ok := metadata.Annotations[key]
+		return ok && (s.AnnotationValue == "" || value == s.AnnotationValue)
+	}
+}
+
+// matchSignature returns the name of the first of signatures the secret
+// has, false when it has none.
+func matchSignature(signatures []compiledSignature, metadata metav1.ObjectMeta) (string, bool) {
+	for _, signature := range signatures {
+		if signature.matches(metadata) {
+			return signature.Name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,136 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// signaturesMutator returns a mutator whose policy has the signatures.
+func signaturesMutator(t *testing.T, presets []string, custom []Signature) *Mutator {
+	t.Helper()
+	settings, err := json.Marshal(PolicyConfig{SignaturePresets: presets, Signatures: custom})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.StageConfig = map[string]json.RawMessage{PolicyStage: settings}
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// producedSecret returns a TLS secret with only the annotations and labels
+// given, unlike tlsSecret's, which cert-manager issued.
+func producedSecret(name string, annotations, labels map[string]string) *corev1.Secret {
+	secret := tlsSecret("apps", name, annotations)
+	delete(secret.Annotations, CertManagerAnnotationKey)
+	secret.Labels = labels
+	return secret
+}
+
+// checkSignature fails the test unless m mutates secret as matching the
+// signature named want, or skips it for reason when want is "".
+func checkSignature(t *testing.T, m *Mutator, secret *corev1.Secret, want, reason string) {
+	t.Helper()
+	decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want == "" {
+		if decision.Mutate || decision.SkipReason != reason || patch != nil {
+			t.Errorf("%s: mutate %v as %q, skipped for %q, want skipped for %q", secret.Name, decision.Mutate, decision.Signature, decision.SkipReason, reason)
+		}
+		return
+	}
+	if !decision.Mutate || decision.Signature != want {
+		t.Errorf("%s: mutate %v as %q, skipped for %q, want mutated as %q", secret.Name, decision.Mutate, decision.Signature, decision.SkipReason, want)
+	}
+}
+
+// Each preset matches the secrets of its producer alone; together, the
+// first listed names the match.
+func TestSignaturePresets(t *testing.T) {
+	issued := tlsSecret("apps", "issued", nil)
+	csi := producedSecret("csi", map[string]string{"csi.cert-manager.io/issuer-name": "ca", "csi.cert-manager.io/dns-names": "api.example.com"}, nil)
+	both := tlsSecret("apps", "both", map[string]string{"csi.cert-manager.io/issuer-name": "ca"})
+	other := producedSecret("other", map[string]string{"cert-manager.io/issuer-name": "ca"}, nil)
+	replica := producedSecret("replica", map[string]string{"csi.cert-manager.io/issuer-name": "ca", OriginAnnotationKey: `{"namespace":"certs"}`}, nil)
+
+	m := signaturesMutator(t, []string{PresetCertManager}, nil)
+	checkSignature(t, m, issued, PresetCertManager, "")
+	checkSignature(t, m, csi, "", SkipNoSignatureMatched)
+	checkSignature(t, m, other, "", SkipNoSignatureMatched)
+
+	m = signaturesMutator(t, []string{PresetCSIDriver}, nil)
+	checkSignature(t, m, csi, PresetCSIDriver, "")
+	checkSignature(t, m, issued, "", SkipNoSignatureMatched)
+	checkSignature(t, m, replica, "", SkipReplica)
+
+	m = signaturesMutator(t, []string{PresetCSIDriver, PresetCertManager}, nil)
+	checkSignature(t, m, both, PresetCSIDriver, "")
+	checkSignature(t, m, issued, PresetCertManager, "")
+
+	// without signatures every TLS secret is mutated, unnamed
+	decision, _, err := signaturesMutator(t, nil, nil).Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: other})
+	if err != nil || !decision.Mutate || decision.Signature != "" {
+		t.Errorf("without signatures: mutate %v as %q: %v", decision.Mutate, decision.Signature, err)
+	}
+}
+
+// Custom signatures match on an annotation's presence or value and on
+// labels, all their fields together, after the presets.
+func TestCustomSignatures(t *testing.T) {
+	m := signaturesMutator(t, []string{PresetCertManager}, []Signature{
+		{Name: "vault", AnnotationKey: "vault.example.com/issued-by", AnnotationValue: "pki"},
+		{Name: "operator", LabelSelector: "app.kubernetes.io/managed-by=tls-operator"},
+		{Name: "team-operator", AnnotationKey: "tls.example.com/*", LabelSelector: "team in (web, api)"},
+	})
+	for _, tt := range []struct {
+		secret *corev1.Secret
+		want   string
+	}{
+		{secret: producedSecret("vault", map[string]string{"vault.example.com/issued-by": "pki"}, nil), want: "vault"},
+		{secret: producedSecret("vault-transit", map[string]string{"vault.example.com/issued-by": "transit"}, nil)},
+		{secret: producedSecret("operator", nil, map[string]string{"app.kubernetes.io/managed-by": "tls-operator"}), want: "operator"},
+		{secret: producedSecret("helm", nil, map[string]string{"app.kubernetes.io/managed-by": "helm"})},
+		{secret: producedSecret("team", map[string]string{"tls.example.com/owner": "web"}, map[string]string{"team": "web"}), want: "team-operator"},
+		{secret: producedSecret("team-unlabelled", map[string]string{"tls.example.com/owner": "web"}, nil)},
+		{secret: producedSecret("team-other", map[string]string{"tls.example.com/owner": "db"}, map[string]string{"team": "db"})},
+		{secret: tlsSecret("apps", "issued-by-vault", map[string]string{"vault.example.com/issued-by": "pki"}), want: PresetCertManager},
+	} {
+		checkSignature(t, m, tt.secret, tt.want, SkipNoSignatureMatched)
+	}
+}
+
+func TestSignatureCompileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		presets []string
+		custom  []Signature
+		want    string
+	}{
+		{name: "unknown preset", presets: []string{"venafi"}, want: `unknown signature preset "venafi"`},
+		{name: "no name", custom: []Signature{{AnnotationKey: "a"}}, want: "signature 0: no name"},
+		{name: "name of a preset", presets: []string{PresetCertManager}, custom: []Signature{{Name: PresetCertManager, AnnotationKey: "a"}}, want: `signature "cert-manager": name taken`},
+		{name: "nothing to match", custom: []Signature{{Name: "empty"}}, want: "neither annotationKey nor labelSelector"},
+		{name: "value without key", custom: []Signature{{Name: "value", AnnotationValue: "v", LabelSelector: "a=b"}}, want: "annotationValue needs an exact annotationKey"},
+		{name: "value of a prefix", custom: []Signature{{Name: "value", AnnotationKey: "a/*", AnnotationValue: "v"}}, want: "annotationValue needs an exact annotationKey"},
+		{name: "bad selector", custom: []Signature{{Name: "selector", LabelSelector: "a in b"}}, want: `signature "selector": labelSelector`},
+	} {
+		settings, err := json.Marshal(PolicyConfig{SignaturePresets: tt.presets, Signatures: tt.custom})
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := DefaultConfig()
+		config.StageConfig = map[string]json.RawMessage{PolicyStage: settings}
+		if _, err := New(config); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
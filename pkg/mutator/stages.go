@@ -0,0 +1,394 @@
+package mutator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Names of the built-in stages.
+const (
+	PolicyStage         = "policy"
+	SyncAnnotationStage = "sync-annotation"
+)
+
+// Stage is one step of a Mutator. Apply returns the patch operations the
+// stage contributes for obj. A stage may set the annotations, rule and
+// warnings of decision, or skip the secret by clearing decision.Mutate and
+// setting decision.SkipReason, which ends the chain.
+type Stage interface {
+	Apply(ctx context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error)
+}
+
+// DataStage is implemented by stages that read the data of the secret, or
+// patch it. Secrets are decoded without their data, which can be large and
+// is key material, unless a stage of the Mutator needs it.
+type DataStage interface {
+	Stage
+	// NeedsData reports whether the stage reads or patches the data.
+	NeedsData() bool
+}
+
+// NamespaceStage is implemented by stages that read the namespace of the
+// secret through AdmissionContext.Namespace. The server only runs its
+// namespace cache when a stage of the Mutator needs it.
+type NamespaceStage interface {
+	Stage
+	// NeedsNamespaces reports whether the stage reads namespaces.
+	NeedsNamespaces() bool
+}
+
+// StageFunc adapts a function to a Stage.
+type StageFunc func(ctx context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error)
+
+// Apply calls f.
+func (f StageFunc) Apply(ctx context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+	return f(ctx, obj, decision)
+}
+
+// Factory builds a stage from the mutator's Config and the stage's own
+// settings, the raw JSON under its name in Config.StageConfig, which is
+// nil when there are none.
+type Factory func(config Config, raw json.RawMessage) (Stage, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a stage available under name, to be enabled in
+// Config.Stages. It is meant to be called from init functions, so that
+// builds can compile in their own stages; it panics when name is taken.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, taken := registry[name]; taken {
+		panic(fmt.Sprintf("mutator: stage %q registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// Registered returns the names of the registered stages, sorted.
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupStage(name string) (Factory, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	factory, ok := registry[name]
+	return factory, ok
+}
+
+func init() {
+	Register(PolicyStage, func(c Config, raw json.RawMessage) (Stage, error) {
+		var settings PolicyConfig
+		if len(raw) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&settings); err != nil {
+				return nil, err
+			}
+		}
+		rules, err := compileRules(settings.Rules)
+		if err != nil {
+			return nil, err
+		}
+		profiles, err := syncProfiles(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s settings: %w", SyncAnnotationStage, err)
+		}
+		for _, rule := range rules {
+			if _, ok := profiles[rule.profile]; rule.profile != "" && !ok {
+				return nil, fmt.Errorf("rule %q: unknown profile %q", rule.name, rule.profile)
+			}
+		}
+		signatures, err := compileSignatures(settings.SignaturePresets, settings.Signatures)
+		if err != nil {
+			return nil, err
+		}
+		tenants, err := compileTenants(settings.Tenancy.Tenants)
+		if err != nil {
+			return nil, fmt.Errorf("tenancy: %w", err)
+		}
+		protected := settings.ProtectedNames
+		if protected == nil {
+			protected = DefaultProtectedNames
+		}
+		return policyStage{ignoredNamespaces: c.IgnoredNamespaces, protectedNames: protected, signatures: signatures,
+			tenants: tenants, strictTenancy: settings.Tenancy.Strict, rules: rules, noProfiles: len(profiles) == 0}, nil
+	})
+	Register(SyncAnnotationStage, func(c Config, _ json.RawMessage) (Stage, error) {
+		profiles, err := syncProfiles(c)
+		if err != nil {
+			return nil, err
+		}
+		if len(profiles) > 0 || c.MaxTargets > 0 {
+			// the value depends on the secret, the stage is not static
+			return profileSyncStage{config: c, profiles: profiles}, nil
+		}
+		return syncAnnotationStage{config: c}, nil
+	})
+}
+
+// PolicyConfig holds the settings of the policy stage.
+type PolicyConfig struct {
+	// Rules, when set, are matched in order against the secrets the policy
+	// lets through; secrets matching none are skipped.
+	Rules []Rule `json:"rules,omitempty"`
+	// ProtectedNames are secrets never mutated, each "namespace/name" or
+	// a name in any namespace; DefaultProtectedNames when unset.
+	ProtectedNames []string `json:"protectedNames,omitempty"`
+	// SignaturePresets and Signatures, when set, are the ownership
+	// signatures, the presets first, of which a secret must have one to be
+	// mutated; otherwise every TLS secret is.
+	SignaturePresets []string    `json:"signaturePresets,omitempty"`
+	Signatures       []Signature `json:"signatures,omitempty"`
+	// Tenancy restricts the namespaces the secrets of each namespace may be
+	// synced to.
+	Tenancy TenancyConfig `json:"tenancy,omitempty"`
+}
+
+// DefaultProtectedNames are cert-manager's own secrets: the CA of its
+// webhook's serving certificate.
+var DefaultProtectedNames = []string{"cert-manager/cert-manager-webhook-ca"}
+
+// NextPrivateKeyKey labels the secrets cert-manager keeps the next private
+// key of a Certificate in, until the issuance completes.
+const NextPrivateKeyKey = "cert-manager.io/next-private-key"
+
+// issuanceOwnerKinds are the kinds of the cert-manager resources that own
+// the short-lived secrets of an issuance, by API group.
+var issuanceOwnerKinds = map[string]string{
+	"cert-manager.io":      "CertificateRequest",
+	"acme.cert-manager.io": "Order",
+}
+
+// policyStage skips system namespaces, cert-manager's temporary and
+// internal secrets, secrets other than TLS ones, the copies kubed makes
+// and, when there are signatures or rules, secrets none matches.
+type policyStage struct {
+	ignoredNamespaces []string
+	protectedNames    []string
+	signatures        []compiledSignature
+	tenants           []compiledTenant
+	strictTenancy     bool
+	rules             []compiledRule
+	noProfiles        bool // the sync-annotation stage has no profiles
+}
+
+func (s policyStage) Apply(ctx context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+	metadata := obj.Secret.ObjectMeta
+	// skip special kubernetes system namespaces
+	for _, namespace := range s.ignoredNamespaces {
+		if metadata.Namespace == namespace {
+			return skip(decision, SkipIgnoredNamespace)
+		}
+	}
+
+	// cert-manager's own secrets, whatever their type, each counted apart
+	if reason := certManagerInternal(metadata, s.protectedNames); reason != "" {
+		return skip(decision, reason)
+	}
+
+	if obj.Secret.Type != corev1.SecretTypeTLS {
+		return skip(decision, SkipNotTLS)
+	}
+	decision.tracef("policy: namespace not ignored, not a cert-manager internal secret, TLS type")
+	// without profiles, the sync-annotation stage is static and never reads
+	// the profile annotation
+	if name := metadata.Annotations[ProfileAnnotationKey]; name != "" && s.noProfiles {
+		decision.Warnings = append(decision.Warnings, fmt.Sprintf("unknown sync profile %q, no profile is configured", name))
+	}
+
+	// copies made by kubed carry the origin annotation next to the
+	// producer's
+	annotations := metadata.GetAnnotations()
+	if len(s.signatures) > 0 {
+		if decision.traced {
+			for _, signature := range s.signatures {
+				decision.tracef("signature %s: %s", signature.Name, outcome(signature.matches(metadata)))
+			}
+		}
+		signature, ok := matchSignature(s.signatures, metadata)
+		if !ok {
+			return skip(decision, SkipNoSignatureMatched)
+		}
+		if _, origin := annotations[OriginAnnotationKey]; origin {
+			return skip(decision, SkipReplica)
+		}
+		decision.Signature = signature
+	} else if _, cm := annotations[CertManagerAnnotationKey]; cm {
+		if _, origin := annotations[OriginAnnotationKey]; origin {
+			return skip(decision, SkipReplica)
+		}
+	}
+
+	if len(s.rules) == 0 && len(s.tenants) == 0 {
+		return nil, nil
+	}
+	if s.NeedsNamespaces() && obj.NamespaceLabels == nil && obj.Namespaces != nil {
+		namespace, err := obj.Namespace()
+		if err != nil {
+			return nil, err
+		}
+		obj.NamespaceLabels = namespace.Labels
+		if obj.NamespaceLabels == nil {
+			obj.NamespaceLabels = map[string]string{}
+		}
+	}
+	if allowed, ok := allowedTargets(s.tenants, metadata.Namespace, obj.NamespaceLabels); ok {
+		decision.Targets = &TargetRestriction{Allowed: allowed, Strict: s.strictTenancy}
+		decision.tracef("tenancy: may be synced to %s, strict %t", strings.Join(allowed, ", "), s.strictTenancy)
+	}
+	if len(s.rules) == 0 {
+		return nil, nil
+	}
+	vars := celActivation(obj)
+	for _, rule := range s.rules {
+		matched, err := rule.matches(ctx, vars)
+		if err != nil {
+			return nil, &RuleError{Rule: rule.name, Err: err}
+		}
+		decision.tracef("rule %s: %s", rule.name, outcome(matched))
+		if matched {
+			decision.Rule = rule.name
+			decision.Profile = rule.profile
+			return nil, nil
+		}
+	}
+	return skip(decision, SkipNoRuleMatched)
+}
+
+// certManagerInternal returns the skip reason of the secrets cert-manager
+// creates for itself, which must never be synced: the next private key of
+// an issuance, the secrets owned by a CertificateRequest or an ACME Order,
+// e.g. temporary keys, and the protected names, e.g. ACME account keys. It
+// returns "" for others.
+func certManagerInternal(metadata metav1.ObjectMeta, protectedNames []string) string {
+	if _, ok := metadata.Labels[NextPrivateKeyKey]; ok {
+		return SkipNextPrivateKey
+	}
+	if _, ok := metadata.Annotations[NextPrivateKeyKey]; ok {
+		return SkipNextPrivateKey
+	}
+	for _, owner := range metadata.OwnerReferences {
+		group, _, _ := strings.Cut(owner.APIVersion, "/")
+		if kind, ok := issuanceOwnerKinds[group]; ok && owner.Kind == kind {
+			return SkipIssuanceOwned
+		}
+	}
+	for _, name := range protectedNames {
+		if name == metadata.Name || name == metadata.Namespace+"/"+metadata.Name {
+			return SkipProtectedName
+		}
+	}
+	return ""
+}
+
+// NeedsNamespaces makes the policy a NamespaceStage when one of its rules
+// refers to namespaceLabels or a tenant selects namespaces by label.
+func (s policyStage) NeedsNamespaces() bool {
+	for _, rule := range s.rules {
+		if rule.readsNamespaces {
+			return true
+		}
+	}
+	for _, tenant := range s.tenants {
+		if tenant.selector != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// StaticAnnotations makes the policy a StaticStage: it patches nothing.
+func (s policyStage) StaticAnnotations() map[string]string { return nil }
+
+func skip(decision *Decision, reason string) ([]PatchOperation, error) {
+	decision.Mutate = false
+	decision.SkipReason = reason
+	decision.tracef("skipped: %s", reason)
+	return nil, nil
+}
+
+// syncAnnotationStage sets the kubed sync annotation, and the marker of the
+// secrets the webhook manages.
+type syncAnnotationStage struct {
+	config Config
+}
+
+// StaticAnnotations makes the stage a StaticStage.
+func (s syncAnnotationStage) StaticAnnotations() map[string]string {
+	return syncAnnotations(s.config, s.config.NamespaceSelector)
+}
+
+func (s syncAnnotationStage) Apply(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+	return setSyncAnnotation(obj, s.config, decision, s.config.NamespaceSelector)
+}
+
+// setSyncAnnotation returns the patch of the stages setting the sync
+// annotation: value, extended to select decision.SyncNamespaces and
+// restricted to decision.Targets and config's MaxTargets, with the
+// annotations going with it. A value that can't be extended is kept, with a
+// warning.
+func setSyncAnnotation(obj AdmissionContext, config Config, decision *Decision, value string) ([]PatchOperation, error) {
+	decision.tracef("sync annotation: %q, with namespaces %v", value, decision.SyncNamespaces)
+	value, err := composeSyncValue(value, decision.SyncNamespaces)
+	if err != nil {
+		decision.Warnings = append(decision.Warnings, err.Error())
+	}
+	if restriction := decision.Targets; restriction != nil {
+		restricted, denied := restrictTargets(value, restriction.Allowed)
+		if len(denied) > 0 {
+			if restriction.Strict {
+				return nil, &TargetsDeniedError{Namespace: obj.Secret.Namespace, Denied: denied}
+			}
+			decision.Warnings = append(decision.Warnings, fmt.Sprintf("secrets of namespace %s may not be synced to %s, removed from the targets",
+				obj.Secret.Namespace, strings.Join(denied, ", ")))
+			if restricted == "" {
+				return skip(decision, SkipTargetsDenied)
+			}
+			value = restricted
+		}
+		decision.tracef("tenancy: %q once restricted, denied %v", value, denied)
+	}
+	value, err = limitTargets(obj, config, decision, value)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxTargets > 0 {
+		decision.tracef("target limit %d: %q, %d namespaces", config.MaxTargets, value, decision.TargetCount)
+	}
+	patch := NewPatchBuilder(obj.Secret)
+	annotations := syncAnnotations(config, value)
+	for _, key := range sortedKeys(annotations) {
+		decision.Annotations[key] = annotations[key]
+		patch.AddAnnotation(key, annotations[key])
+	}
+	return patch.Operations()
+}
+
+// syncAnnotations returns the annotations set with the sync annotation
+// value: the managed-by marker and the cluster name when configured.
+func syncAnnotations(config Config, value string) map[string]string {
+	annotations := map[string]string{SyncAnnotationKey: value, ManagedByAnnotationKey: ManagedByValue}
+	if config.ClusterName != "" {
+		annotations[ClusterAnnotationKey] = config.ClusterName
+	}
+	return annotations
+}
@@ -0,0 +1,283 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Test stages of the chain: test-team labels the secret and annotates it
+// with its name, test-rename annotates it with its own, test-skip skips the
+// secrets named skip-*, test-settings fails on the settings "invalid",
+// test-cancel cancels the context it carries and test-data needs the data.
+const (
+	teamStage     = "test-team"
+	renameStage   = "test-rename"
+	skipStage     = "test-skip"
+	cancelStage   = "test-cancel"
+	settingsStage = "test-settings"
+	dataStage     = "test-data"
+	stageNameKey  = "example.com/stage"
+	teamLabelKey  = "example.com/team"
+	skipReasonKey = "test-skipped"
+)
+
+type cancelKey struct{}
+
+// dataStageFunc is a StageFunc needing the data of secrets.
+type dataStageFunc StageFunc
+
+func (f dataStageFunc) Apply(ctx context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+	return f(ctx, obj, decision)
+}
+
+func (dataStageFunc) NeedsData() bool { return true }
+
+// renames counts the runs of test-rename.
+var renames atomic.Int32
+
+// settingsSeen holds the settings test-settings was last built with.
+var settingsSeen atomic.Pointer[json.RawMessage]
+
+func init() {
+	Register(teamStage, func(Config, json.RawMessage) (Stage, error) {
+		return StageFunc(func(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+			decision.Annotations[stageNameKey] = teamStage
+			return []PatchOperation{
+				{Op: "add", Path: "/metadata/labels", Value: map[string]string{teamLabelKey: "payments"}},
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]string{stageNameKey: teamStage}},
+			}, nil
+		}), nil
+	})
+	Register(renameStage, func(Config, json.RawMessage) (Stage, error) {
+		return StageFunc(func(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+			renames.Add(1)
+			decision.Annotations[stageNameKey] = renameStage
+			return []PatchOperation{{Op: "add", Path: "/metadata/annotations", Value: map[string]string{stageNameKey: renameStage}}}, nil
+		}), nil
+	})
+	Register(skipStage, func(Config, json.RawMessage) (Stage, error) {
+		return StageFunc(func(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+			if strings.HasPrefix(obj.Secret.Name, "skip-") {
+				return skip(decision, skipReasonKey)
+			}
+			return nil, nil
+		}), nil
+	})
+	Register(settingsStage, func(_ Config, raw json.RawMessage) (Stage, error) {
+		settingsSeen.Store(&raw)
+		if string(raw) == `"invalid"` {
+			return nil, errors.New("invalid settings")
+		}
+		return StageFunc(func(context.Context, AdmissionContext, *Decision) ([]PatchOperation, error) { return nil, nil }), nil
+	})
+	Register(cancelStage, func(Config, json.RawMessage) (Stage, error) {
+		return StageFunc(func(ctx context.Context, _ AdmissionContext, _ *Decision) ([]PatchOperation, error) {
+			ctx.Value(cancelKey{}).(context.CancelFunc)()
+			return nil, nil
+		}), nil
+	})
+	Register(dataStage, func(Config, json.RawMessage) (Stage, error) {
+		return dataStageFunc(func(context.Context, AdmissionContext, *Decision) ([]PatchOperation, error) { return nil, nil }), nil
+	})
+}
+
+// buildStage returns the stage registered as name, built from config and
+// raw.
+func buildStage(t *testing.T, name string, config Config, raw json.RawMessage) Stage {
+	t.Helper()
+	factory, ok := lookupStage(name)
+	if !ok {
+		t.Fatalf("stage %s not registered", name)
+	}
+	stage, err := factory(config, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stage
+}
+
+// chain returns a mutator running stages.
+func chain(t *testing.T, stages ...string) *Mutator {
+	t.Helper()
+	config := DefaultConfig()
+	config.Stages = stages
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// The policy stage only decides: it never patches, and skipping clears
+// Mutate with the reason.
+func TestPolicyStage(t *testing.T) {
+	stage := buildStage(t, PolicyStage, DefaultConfig(), nil)
+	for _, tt := range []struct {
+		secret *corev1.Secret
+		reason string
+	}{
+		{secret: tlsSecret("apps", "api-tls", nil)},
+		{secret: tlsSecret(metav1.NamespaceSystem, "api-tls", nil), reason: SkipIgnoredNamespace},
+		{secret: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "apps"}, Type: corev1.SecretTypeOpaque}, reason: SkipNotTLS},
+	} {
+		decision := Decision{Mutate: true, Rule: DefaultRule, Annotations: map[string]string{}}
+		patch, err := stage.Apply(context.Background(), AdmissionContext{Operation: "CREATE", Secret: tt.secret}, &decision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(patch) != 0 || len(decision.Annotations) != 0 {
+			t.Errorf("%s/%s: policy patched %v, annotated %v", tt.secret.Namespace, tt.secret.Name, patch, decision.Annotations)
+		}
+		if decision.Mutate != (tt.reason == "") || decision.SkipReason != tt.reason {
+			t.Errorf("%s/%s: mutate %v, skipped for %q, want skipped for %q",
+				tt.secret.Namespace, tt.secret.Name, decision.Mutate, decision.SkipReason, tt.reason)
+		}
+	}
+}
+
+func TestSyncAnnotationStage(t *testing.T) {
+	config := DefaultConfig()
+	config.NamespaceSelector = "env=prod"
+	config.ClusterName = "eu-west-1"
+	stage := buildStage(t, SyncAnnotationStage, config, nil)
+	want := map[string]string{SyncAnnotationKey: "env=prod", ManagedByAnnotationKey: ManagedByValue, ClusterAnnotationKey: "eu-west-1"}
+	if static, ok := stage.(StaticStage); !ok || !maps.Equal(static.StaticAnnotations(), want) {
+		t.Errorf("stage %T isn't static with %v", stage, want)
+	}
+
+	secret := tlsSecret("apps", "api-tls", map[string]string{SyncAnnotationKey: "true"})
+	decision := Decision{Mutate: true, Annotations: map[string]string{}}
+	patch, err := stage.Apply(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret}, &decision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(decision.Annotations, want) {
+		t.Errorf("decided annotations %v, want %v", decision.Annotations, want)
+	}
+	patched := applyPatch(t, secret, patch)
+	for key, value := range want {
+		if patched.Annotations[key] != value {
+			t.Errorf("%s patched to %q, want %q", key, patched.Annotations[key], value)
+		}
+	}
+}
+
+// Stages and settings naming no registered stage fail with the names that
+// are.
+func TestNewUnknownStage(t *testing.T) {
+	for name, config := range map[string]Config{
+		"stage":    {Stages: []string{PolicyStage, "no-such-stage"}},
+		"settings": {StageConfig: map[string]json.RawMessage{"no-such-stage": json.RawMessage(`{}`)}},
+	} {
+		_, err := New(config)
+		if err == nil || !strings.Contains(err.Error(), `"no-such-stage"`) || !strings.Contains(err.Error(), strings.Join(Registered(), ", ")) {
+			t.Errorf("%s: error %v, want the unknown stage and the registered ones", name, err)
+		}
+	}
+	if m, err := New(Config{NamespaceSelector: "true"}); err != nil || len(m.stages) != len(DefaultStages) {
+		t.Errorf("no stages configured: %v, want the default ones", err)
+	}
+}
+
+// A stage gets its own settings, and an error building it names the stage.
+func TestStageSettings(t *testing.T) {
+	config := DefaultConfig()
+	config.Stages = []string{PolicyStage, settingsStage}
+	config.StageConfig = map[string]json.RawMessage{settingsStage: json.RawMessage(`{"a":1}`)}
+	if _, err := New(config); err != nil || string(*settingsSeen.Load()) != `{"a":1}` {
+		t.Errorf("stage built with settings %s: %v", *settingsSeen.Load(), err)
+	}
+	config.StageConfig[settingsStage] = json.RawMessage(`"invalid"`)
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), `"`+settingsStage+`"`) {
+		t.Errorf("error %v, want the stage's", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("a stage name registered twice")
+		}
+	}()
+	Register(PolicyStage, nil)
+}
+
+// A full chain runs its stages in the configured order, merges their
+// patches into one, the last stage winning each conflict with a warning,
+// and ends at the first stage skipping the secret.
+func TestChain(t *testing.T) {
+	evaluate := func(m *Mutator, secret *corev1.Secret) (Decision, *corev1.Secret) {
+		t.Helper()
+		decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if patch == nil {
+			return decision, nil
+		}
+		return decision, applyPatch(t, secret, patch)
+	}
+	m := chain(t, PolicyStage, teamStage, skipStage, renameStage, SyncAnnotationStage)
+
+	secret := tlsSecret("apps", "api-tls", nil)
+	decision, patched := evaluate(m, secret)
+	if patched == nil {
+		t.Fatalf("secret skipped: %s", decision.SkipReason)
+	}
+	if patched.Labels[teamLabelKey] != "payments" || patched.Annotations[stageNameKey] != renameStage ||
+		patched.Annotations[SyncAnnotationKey] != "true" {
+		t.Errorf("secret patched to labels %v, annotations %v", patched.Labels, patched.Annotations)
+	}
+	if len(decision.Warnings) != 1 || !strings.Contains(decision.Warnings[0], EscapePointer(stageNameKey)) {
+		t.Errorf("warnings %q, want the conflict on %s", decision.Warnings, stageNameKey)
+	}
+
+	// the order is the configured one
+	_, patched = evaluate(chain(t, PolicyStage, renameStage, teamStage, SyncAnnotationStage), secret)
+	if patched.Annotations[stageNameKey] != teamStage {
+		t.Errorf("annotation %q with test-team last, want its value", patched.Annotations[stageNameKey])
+	}
+
+	// a skip ends the chain with no patch
+	before := renames.Load()
+	decision, patched = evaluate(m, tlsSecret("apps", "skip-tls", nil))
+	if decision.Mutate || decision.SkipReason != skipReasonKey || patched != nil {
+		t.Errorf("skipped secret decided %+v, patched %v", decision, patched)
+	}
+	if renames.Load() != before {
+		t.Error("a stage after the skip ran")
+	}
+
+	// without sync-annotation, the stages left patch on their own
+	_, patched = evaluate(chain(t, PolicyStage, teamStage), secret)
+	if _, ok := patched.Annotations[SyncAnnotationKey]; ok || patched.Labels[teamLabelKey] != "payments" {
+		t.Errorf("secret patched to labels %v, annotations %v without sync-annotation", patched.Labels, patched.Annotations)
+	}
+
+	// stages patching nothing leave the secret alone
+	decision, patched = evaluate(chain(t, PolicyStage), secret)
+	if decision.Mutate || decision.SkipReason != SkipNoChanges || patched != nil {
+		t.Errorf("chain without patches decided %+v, patched %v", decision, patched)
+	}
+}
+
+// A stage cancelling the context stops the chain before the next stage.
+func TestChainCancelledByStage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	before := renames.Load()
+	m := chain(t, PolicyStage, cancelStage, renameStage, SyncAnnotationStage)
+	decision, patch, err := m.Evaluate(context.WithValue(ctx, cancelKey{}, cancel), AdmissionContext{Operation: "CREATE", Secret: tlsSecret("apps", "api-tls", nil)})
+	if !errors.Is(err, context.Canceled) || decision.Mutate || patch != nil {
+		t.Errorf("decision %+v with patch %v: %v, want cancelled", decision, patch, err)
+	}
+	if renames.Load() != before {
+		t.Error("a stage ran after the context was cancelled")
+	}
+}
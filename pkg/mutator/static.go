@@ -0,0 +1,146 @@
+package mutator
+
+import (
+	"maps"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// StaticStage is implemented by stages whose patch doesn't depend on the
+// secret: they either patch nothing, or set the same annotations on every
+// secret and do nothing else. When all its stages are static, a Mutator
+// encodes its patches once, at New, and Evaluate only picks one; the stages
+// setting annotations aren't called.
+type StaticStage interface {
+	Stage
+	// StaticAnnotations returns the annotations the stage sets, nil when it
+	// patches nothing.
+	StaticAnnotations() map[string]string
+}
+
+// staticPatch holds the precomputed patches of a Mutator whose stages are
+// all static: the one creating the annotations of a secret that has none,
+// and the one adding them to a secret that has others. A secret that
+// already has some of them goes through a PatchBuilder.
+type staticPatch struct {
+	stages      []Stage  // the stages to run, those patching nothing
+	names       []string // of the stages
+	annotations map[string]string
+	created     encodedPatch
+	added       encodedPatch
+	decisions   sync.Map // *staticPatch recording each decision of the settings, by value
+}
+
+// encodedPatch is a patch with its encoding.
+type encodedPatch struct {
+	ops []PatchOperation
+	raw []byte
+}
+
+// newStaticPatch precomputes the patches of stages, or returns nil when one
+// of them isn't static, none sets annotations or two set the same one,
+// which only a PatchBuilder warns about.
+func newStaticPatch(stages []Stage, names []string) (*staticPatch, error) {
+	s := &staticPatch{annotations: map[string]string{}}
+	for i, stage := range stages {
+		static, ok := stage.(StaticStage)
+		if !ok {
+			return nil, nil
+		}
+		annotations := static.StaticAnnotations()
+		if annotations == nil {
+			s.stages = append(s.stages, stage)
+			s.names = append(s.names, names[i])
+			continue
+		}
+		for key, value := range annotations {
+			if _, taken := s.annotations[key]; taken {
+				return nil, nil
+			}
+			s.annotations[key] = value
+		}
+	}
+	if len(s.annotations) == 0 {
+		return nil, nil
+	}
+	if err := s.encode(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// encode precomputes the patches setting s.annotations.
+func (s *staticPatch) encode() error {
+	created := map[string]interface{}{}
+	var added []PatchOperation
+	for _, key := range sortedKeys(s.annotations) {
+		created[key] = s.annotations[key]
+		added = append(added, PatchOperation{Op: "add", Path: annotationsPath + "/" + pointerEscaper.Replace(key), Value: s.annotations[key]})
+	}
+	var err error
+	if s.created, err = encodePatch([]PatchOperation{{Op: "add", Path: annotationsPath, Value: created}}); err != nil {
+		return err
+	}
+	s.added, err = encodePatch(added)
+	return err
+}
+
+// withDecision returns the patches of s also setting DecisionAnnotationKey
+// to value. Those of the current settings, one per rule, are encoded on first
+// use and kept; a value kept from a secret, which may be anything whoever
+// writes the secret put there, is encoded for that admission only.
+func (s *staticPatch) withDecision(value string, current bool) (*staticPatch, error) {
+	if p, ok := s.decisions.Load(value); ok {
+		return p.(*staticPatch), nil
+	}
+	p := &staticPatch{stages: s.stages, names: s.names, annotations: maps.Clone(s.annotations)}
+	p.annotations[DecisionAnnotationKey] = value
+	if err := p.encode(); err != nil {
+		return nil, err
+	}
+	if !current {
+		return p, nil
+	}
+	actual, _ := s.decisions.LoadOrStore(value, p)
+	return actual.(*staticPatch), nil
+}
+
+func encodePatch(ops []PatchOperation) (encodedPatch, error) {
+	raw, err := MarshalPatch(ops)
+	// callers appending to the operations must not write into ours
+	return encodedPatch{ops: ops[:len(ops):len(ops)], raw: raw}, err
+}
+
+// patch returns the precomputed patch for secret, false when it has some of
+// the annotations already.
+func (s *staticPatch) patch(secret *corev1.Secret) ([]PatchOperation, bool) {
+	if len(secret.Annotations) == 0 {
+		return s.created.ops, true
+	}
+	for key := range s.annotations {
+		if _, ok := secret.Annotations[key]; ok {
+			return nil, false
+		}
+	}
+	return s.added.ops, true
+}
+
+// encoded returns the encoding of patch when it is one of the precomputed
+// ones, those recording decisions included.
+func (s *staticPatch) encoded(patch []PatchOperation) ([]byte, bool) {
+	for _, p := range []*encodedPatch{&s.created, &s.added} {
+		if len(patch) == len(p.ops) && len(patch) > 0 && &patch[0] == &p.ops[0] {
+			return p.raw, true
+		}
+	}
+	var (
+		raw []byte
+		ok  bool
+	)
+	s.decisions.Range(func(_, p any) bool {
+		raw, ok = p.(*staticPatch).encoded(patch)
+		return !ok
+	})
+	return raw, ok
+}
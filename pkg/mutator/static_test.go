@@ -0,0 +1,107 @@
+package mutator
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// withoutStatic returns a copy of m building every patch with a
+// PatchBuilder, as mutators with a stage that isn't static do.
+func withoutStatic(m *Mutator) *Mutator {
+	plain := *m
+	plain.static = nil
+	return &plain
+}
+
+// staticSecrets are secrets taking each of the precomputed patches, and
+// one already carrying the sync annotation.
+func staticSecrets() map[string]*corev1.Secret {
+	bare := tlsSecret("apps", "bare-tls", nil)
+	bare.Annotations = nil
+	return map[string]*corev1.Secret{
+		"annotations absent":  bare,
+		"annotations present": tlsSecret("apps", "api-tls", nil),
+		"already synced":      tlsSecret("apps", "synced-tls", map[string]string{SyncAnnotationKey: "env=staging"}),
+	}
+}
+
+// The precomputed patches are those a PatchBuilder builds.
+func TestStaticPatch(t *testing.T) {
+	m, err := New(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.static == nil {
+		t.Fatal("the default stages are not precomputed")
+	}
+	plain := withoutStatic(m)
+	for name, secret := range staticSecrets() {
+		t.Run(name, func(t *testing.T) {
+			req := AdmissionContext{Operation: "CREATE", Secret: secret}
+			_, patch, err := m.Evaluate(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, want, err := plain.Evaluate(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := m.MarshalPatch(patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantRaw, err := MarshalPatch(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(raw) != string(wantRaw) {
+				t.Errorf("precomputed patch\n%s\nwant\n%s", raw, wantRaw)
+			}
+		})
+	}
+}
+
+// Stages whose patch may depend on the secret aren't precomputed.
+func TestStaticPatchOff(t *testing.T) {
+	if m := withStages(t, teamStage); m.static != nil {
+		t.Errorf("patches precomputed with the %s stage", teamStage)
+	}
+}
+
+// BenchmarkEvaluate measures Evaluate and MarshalPatch with the default
+// stages, with the precomputed patches and building them with a
+// PatchBuilder.
+func BenchmarkEvaluate(b *testing.B) {
+	m, err := New(DefaultConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, mutator := range []struct {
+		name string
+		m    *Mutator
+	}{
+		{"precomputed", m},
+		{"builder", withoutStatic(m)},
+	} {
+		for name, secret := range staticSecrets() {
+			if name == "already synced" {
+				continue
+			}
+			b.Run(mutator.name+"/"+name, func(b *testing.B) {
+				req := AdmissionContext{Operation: "CREATE", Secret: secret}
+				b.ReportAllocs()
+				for b.Loop() {
+					_, patch, err := mutator.m.Evaluate(context.Background(), req)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := mutator.m.MarshalPatch(patch); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
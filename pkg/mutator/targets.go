@@ -0,0 +1,152 @@
+package mutator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DNSTargetsStage names the stage deriving the sync targets from the
+// owning Certificate's dnsNames.
+const DNSTargetsStage = "dns-targets"
+
+// DefaultDNSTargetPattern maps a DNS name to its first label, e.g.
+// payments.internal.example.com to payments.
+const DefaultDNSTargetPattern = `^([a-z0-9]([-a-z0-9]*[a-z0-9])?)\.`
+
+// CertificateLister gets cert-manager Certificates from a cache, which may
+// lag behind the API server.
+type CertificateLister interface {
+	// DNSNames returns spec.dnsNames of the Certificate namespace/name.
+	DNSNames(namespace, name string) ([]string, error)
+}
+
+// CertificateStage is implemented by stages that read the Certificate
+// owning the secret through AdmissionContext.Certificates. The server only
+// runs its Certificate cache when a stage of the Mutator needs it.
+type CertificateStage interface {
+	Stage
+	// NeedsCertificates reports whether the stage reads Certificates.
+	NeedsCertificates() bool
+}
+
+// DNSTargetsConfig holds the settings of the dns-targets stage.
+type DNSTargetsConfig struct {
+	// Pattern is matched against each DNS name of the Certificate;
+	// DefaultDNSTargetPattern when empty. Names it doesn't match are left
+	// out.
+	Pattern string `json:"pattern,omitempty"`
+	// Replacement makes the namespace name from a match, with $1 or
+	// ${name} standing for the captures as in regexp.Expand; "$1" when
+	// empty.
+	Replacement string `json:"replacement,omitempty"`
+}
+
+func init() {
+	Register(DNSTargetsStage, func(c Config, raw json.RawMessage) (Stage, error) {
+		var settings DNSTargetsConfig
+		if len(raw) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&settings); err != nil {
+				return nil, err
+			}
+		}
+		if settings.Pattern == "" {
+			settings.Pattern = DefaultDNSTargetPattern
+		}
+		if settings.Replacement == "" {
+			settings.Replacement = "$1"
+		}
+		pattern, err := regexp.Compile(settings.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("pattern: %w", err)
+		}
+		return dnsTargetsStage{pattern: pattern, replacement: settings.Replacement, cluster: c}, nil
+	})
+}
+
+// dnsTargetsStage sets the sync annotation to the namespaces named by the
+// DNS names of the secret's Certificate, in place of the sync-annotation
+// stage. Wildcard names are left out, and so are the results that are not
+// the names of existing namespaces. When the Certificate can't be read or
+// none of its names maps to a namespace, the secret is synced to the
+// cluster default, with a warning.
+type dnsTargetsStage struct {
+	pattern     *regexp.Regexp
+	replacement string
+	cluster     Config // the default sync value and the cap
+}
+
+// NeedsCertificates makes the stage a CertificateStage.
+func (s dnsTargetsStage) NeedsCertificates() bool { return true }
+
+// NeedsNamespaces makes the stage a NamespaceStage, it checks the targets
+// exist.
+func (s dnsTargetsStage) NeedsNamespaces() bool { return true }
+
+func (s dnsTargetsStage) Apply(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+	value, err := s.targets(obj)
+	if err != nil {
+		value = s.cluster.NamespaceSelector
+		decision.Warnings = append(decision.Warnings, fmt.Sprintf("%s; syncing to the default %q", err, value))
+	}
+	return setSyncAnnotation(obj, s.cluster, decision, value)
+}
+
+// targets returns the sync value selecting the namespaces the Certificate's
+// DNS names map to.
+func (s dnsTargetsStage) targets(obj AdmissionContext) (string, error) {
+	name := obj.Secret.Annotations[CertManagerAnnotationKey]
+	if name == "" {
+		return "", fmt.Errorf("secret has no %s annotation to find its Certificate by", CertManagerAnnotationKey)
+	}
+	if obj.Certificates == nil {
+		return "", fmt.Errorf("certificate %s: no Certificate cache", name)
+	}
+	dnsNames, err := obj.Certificates.DNSNames(obj.Secret.Namespace, name)
+	if err != nil {
+		return "", fmt.Errorf("certificate %s: %w", name, err)
+	}
+	seen := map[string]bool{}
+	for _, dnsName := range dnsNames {
+		if strings.HasPrefix(dnsName, "*.") {
+			continue
+		}
+		match := s.pattern.FindStringSubmatchIndex(dnsName)
+		if match == nil {
+			continue
+		}
+		target := string(s.pattern.ExpandString(nil, s.replacement, dnsName, match))
+		if len(validation.IsDNS1123Label(target)) > 0 || seen[target] {
+			continue
+		}
+		if obj.Namespaces != nil {
+			if _, err := obj.Namespaces.Get(target); err != nil {
+				continue
+			}
+		}
+		seen[target] = true
+	}
+	if len(seen) == 0 {
+		return "", fmt.Errorf("certificate %s: no DNS name maps to an existing namespace", name)
+	}
+	targets := make([]string, 0, len(seen))
+	for target := range seen {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return NamespaceNameSelector(targets), nil
+}
+
+// NamespaceNameSelector returns the sync value selecting the namespaces
+// named, by the label the API server sets on every namespace.
+func NamespaceNameSelector(names []string) string {
+	return namespaceNameLabel + " in (" + strings.Join(names, ",") + ")"
+}
@@ -0,0 +1,133 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fixedCertificates is a CertificateLister of the dnsNames of Certificates
+// by namespace/name; the others fail to be read.
+type fixedCertificates map[string][]string
+
+func (c fixedCertificates) DNSNames(namespace, name string) ([]string, error) {
+	dnsNames, ok := c[namespace+"/"+name]
+	if !ok {
+		return nil, fmt.Errorf("certificate %s/%s not in the cache", namespace, name)
+	}
+	return dnsNames, nil
+}
+
+// dnsTargetsMutator returns a mutator deriving the sync targets with the
+// dns-targets settings.
+func dnsTargetsMutator(t *testing.T, settings DNSTargetsConfig) *Mutator {
+	t.Helper()
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.Stages = []string{PolicyStage, DNSTargetsStage}
+	config.StageConfig = map[string]json.RawMessage{DNSTargetsStage: raw}
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// The sync annotation selects the namespaces the Certificate's DNS names map
+// to, leaving out wildcards, names the pattern doesn't match and namespaces
+// that don't exist. A Certificate that can't be read, or whose names map to
+// no namespace, gets the cluster default with a warning.
+func TestDNSTargets(t *testing.T) {
+	m := dnsTargetsMutator(t, DNSTargetsConfig{})
+	if !m.NeedsCertificates() || !m.NeedsNamespaces() {
+		t.Fatal("dns-targets doesn't ask for the Certificates and namespaces")
+	}
+	namespaces := fixedNamespaces{"payments": nil, "shop": nil, "apps": nil}
+	certificates := fixedCertificates{
+		"apps/multi-tls": {"payments.internal.example.com", "shop.internal.example.com", "www.payments.example.com",
+			"payments.example.com", "ghost.internal.example.com"},
+		"apps/wildcard-tls":       {"*.internal.example.com", "shop.internal.example.com"},
+		"apps/only-wildcards-tls": {"*.internal.example.com", "*.example.com"},
+		"apps/invalid-tls":        {"Payments_1.example.com", "localhost"},
+	}
+	for _, tt := range []struct {
+		name    string
+		want    string
+		warning string // in the one warning returned, none if empty
+	}{
+		{name: "multi-tls", want: "kubernetes.io/metadata.name in (payments,shop)"},
+		{name: "wildcard-tls", want: "kubernetes.io/metadata.name in (shop)"},
+		{name: "only-wildcards-tls", want: "true", warning: "no DNS name maps to an existing namespace"},
+		{name: "invalid-tls", want: "true", warning: "no DNS name maps to an existing namespace"},
+		{name: "missing-tls", want: "true", warning: "certificate missing-tls: certificate apps/missing-tls not in the cache"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := tlsSecret("apps", tt.name, nil)
+			decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret,
+				Namespaces: namespaces, Certificates: certificates})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]; got != tt.want {
+				t.Errorf("synced to %q, want %q", got, tt.want)
+			}
+			if tt.warning == "" && len(decision.Warnings) != 0 {
+				t.Errorf("warnings %q", decision.Warnings)
+			}
+			if tt.warning != "" && (len(decision.Warnings) != 1 || !strings.Contains(decision.Warnings[0], tt.warning) ||
+				!strings.Contains(decision.Warnings[0], `syncing to the default "true"`)) {
+				t.Errorf("warnings %q, want one saying %q", decision.Warnings, tt.warning)
+			}
+		})
+	}
+
+	// without the Certificate cache or the cert-manager annotation
+	secret := tlsSecret("apps", "multi-tls", nil)
+	for name, obj := range map[string]AdmissionContext{
+		"no cache":      {Operation: "CREATE", Secret: secret, Namespaces: namespaces},
+		"no annotation": {Operation: "CREATE", Secret: tlsSecret("apps", "multi-tls", map[string]string{CertManagerAnnotationKey: ""}), Namespaces: namespaces, Certificates: certificates},
+	} {
+		decision, patch, err := m.Evaluate(context.Background(), obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := applyPatch(t, obj.Secret, patch).Annotations[SyncAnnotationKey]; got != "true" || len(decision.Warnings) != 1 {
+			t.Errorf("%s: synced to %q with warnings %q, want the default with one", name, got, decision.Warnings)
+		}
+	}
+}
+
+// The pattern and replacement map the names by another convention, here
+// the team after a "team-" prefix of the second label.
+func TestDNSTargetsPattern(t *testing.T) {
+	m := dnsTargetsMutator(t, DNSTargetsConfig{Pattern: `^[a-z]+\.team-(?P<team>[a-z]+)\.example\.com$`, Replacement: "${team}-prod"})
+	secret := tlsSecret("apps", "api-tls", nil)
+	decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret,
+		Namespaces:   fixedNamespaces{"payments-prod": nil, "shop-prod": nil},
+		Certificates: fixedCertificates{"apps/api-tls": {"api.team-payments.example.com", "web.team-shop.example.com", "api.payments.example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]; got != "kubernetes.io/metadata.name in (payments-prod,shop-prod)" || len(decision.Warnings) != 0 {
+		t.Errorf("synced to %q with warnings %q", got, decision.Warnings)
+	}
+
+	for name, raw := range map[string]string{"bad pattern": `{"pattern":"("}`, "unknown field": `{"patern":"x"}`} {
+		config := DefaultConfig()
+		config.Stages = []string{PolicyStage, DNSTargetsStage}
+		config.StageConfig = map[string]json.RawMessage{DNSTargetsStage: json.RawMessage(raw)}
+		if _, err := New(config); err == nil || !strings.Contains(err.Error(), DNSTargetsStage) {
+			t.Errorf("%s: error %v, want one of %s", name, err, DNSTargetsStage)
+		}
+	}
+	if !slices.Contains(Registered(), DNSTargetsStage) {
+		t.Errorf("%s not registered", DNSTargetsStage)
+	}
+}
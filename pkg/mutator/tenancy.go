@@ -0,0 +1,156 @@
+package mutator
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// SkipTargetsDenied is the reason a secret none of whose targets its
+// namespace may sync to is skipped.
+const SkipTargetsDenied = "targets-denied"
+
+// TenancyConfig maps source namespaces to the namespaces their secrets may
+// be synced to.
+type TenancyConfig struct {
+	// Strict denies the admission of a secret with a disallowed target,
+	// rather than stripping the target with a warning.
+	Strict bool `json:"strict,omitempty"`
+	// Tenants are the mappings. A namespace matching several may sync to
+	// the targets of all of them; one matching none is not restricted.
+	Tenants []Tenant `json:"tenants,omitempty"`
+}
+
+// Tenant is the mapping of a set of source namespaces.
+type Tenant struct {
+	Name string `json:"name"`
+	// SourceNamespaces are glob patterns, e.g. "team-a-*", matched against
+	// the secret's namespace.
+	SourceNamespaces []string `json:"sourceNamespaces,omitempty"`
+	// NamespaceSelector selects source namespaces by their labels, which
+	// makes the policy read the namespace cache.
+	NamespaceSelector string `json:"namespaceSelector,omitempty"`
+	// AllowedTargets are glob patterns of the namespaces the sources may
+	// sync to.
+	AllowedTargets []string `json:"allowedTargets"`
+}
+
+// compiledTenant is a Tenant with its selector parsed.
+type compiledTenant struct {
+	Tenant
+	selector labels.Selector // nil when not set
+}
+
+func compileTenants(tenants []Tenant) ([]compiledTenant, error) {
+	compiled := make([]compiledTenant, 0, len(tenants))
+	for i, tenant := range tenants {
+		switch {
+		case tenant.Name == "":
+			return nil, fmt.Errorf("tenant %d has no name", i)
+		case len(tenant.SourceNamespaces) == 0 && tenant.NamespaceSelector == "":
+			return nil, fmt.Errorf("tenant %q: neither sourceNamespaces nor namespaceSelector", tenant.Name)
+		}
+		for _, pattern := range append(slices.Clone(tenant.SourceNamespaces), tenant.AllowedTargets...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("tenant %q: pattern %q: %w", tenant.Name, pattern, err)
+			}
+		}
+		c := compiledTenant{Tenant: tenant}
+		if tenant.NamespaceSelector != "" {
+			selector, err := labels.Parse(tenant.NamespaceSelector)
+			if err != nil {
+				return nil, fmt.Errorf("tenant %q: namespaceSelector: %w", tenant.Name, err)
+			}
+			c.selector = selector
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// allowedTargets returns the target patterns of the tenants namespace, with
+// namespaceLabels, belongs to, and false when it belongs to none.
+func allowedTargets(tenants []compiledTenant, namespace string, namespaceLabels map[string]string) ([]string, bool) {
+	var allowed []string
+	found := false
+	for _, tenant := range tenants {
+		if !matchesAny(tenant.SourceNamespaces, namespace) &&
+			(tenant.selector == nil || namespaceLabels == nil || !tenant.selector.Matches(labels.Set(namespaceLabels))) {
+			continue
+		}
+		found = true
+		allowed = append(allowed, tenant.AllowedTargets...)
+	}
+	return allowed, found
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetRestriction holds the namespaces a secret may be synced to.
+type TargetRestriction struct {
+	// Allowed are glob patterns of the namespaces.
+	Allowed []string
+	// Strict denies the secret rather than stripping disallowed targets.
+	Strict bool
+}
+
+// TargetsDeniedError is returned by Evaluate when a strict tenancy policy
+// denies the targets of a secret. The admission is denied.
+type TargetsDeniedError struct {
+	Namespace string
+	Denied    []string
+}
+
+func (e *TargetsDeniedError) Error() string {
+	return fmt.Sprintf("secrets of namespace %s may not be synced to %s", e.Namespace, strings.Join(e.Denied, ", "))
+}
+
+// restrictTargets returns value without the namespaces outside allowed,
+// and the ones it removed. Only selections by namespace name, which the
+// per-secret inputs produce, are restricted: the cluster default and other
+// label selectors are the operator's and are returned as they are. The
+// value is empty when no target is left.
+func restrictTargets(value string, allowed []string) (string, []string) {
+	if value == "" || value == "true" {
+		return value, nil
+	}
+	selector, err := labels.Parse(value)
+	if err != nil {
+		return value, nil
+	}
+	requirements, _ := selector.Requirements()
+	if len(requirements) != 1 || requirements[0].Key() != namespaceNameLabel {
+		return value, nil
+	}
+	switch requirements[0].Operator() {
+	case selection.In, selection.Equals, selection.DoubleEquals:
+	default:
+		return value, nil
+	}
+	var kept, denied []string
+	for _, namespace := range requirements[0].Values().List() {
+		if matchesAny(allowed, namespace) {
+			kept = append(kept, namespace)
+		} else {
+			denied = append(denied, namespace)
+		}
+	}
+	if len(denied) == 0 {
+		return value, nil
+	}
+	if len(kept) == 0 {
+		return "", denied
+	}
+	return NamespaceNameSelector(kept), denied
+}
@@ -0,0 +1,169 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// tenancyMutator returns a mutator whose policy has the tenants, in strict
+// mode or not, picking the targets of secrets by profile.
+func tenancyMutator(t *testing.T, strict bool, stages ...string) *Mutator {
+	t.Helper()
+	policy, err := json.Marshal(PolicyConfig{Tenancy: TenancyConfig{Strict: strict, Tenants: []Tenant{
+		{Name: "team-a", SourceNamespaces: []string{"team-a-*"}, AllowedTargets: []string{"team-a-*", "ingress-nginx"}},
+		{Name: "platform", NamespaceSelector: "tenant=platform", AllowedTargets: []string{"*"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync, err := json.Marshal(SyncAnnotationConfig{Profiles: map[string]SyncProfile{
+		"edge":   {TargetNamespaces: []string{"ingress-nginx", "team-a-web"}},
+		"team-b": {TargetNamespaces: []string{"team-b-api", "team-b-web"}},
+		"mixed":  {TargetNamespaces: []string{"team-a-api", "team-b-api", "monitoring"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	if len(stages) > 0 {
+		config.Stages = stages
+	}
+	config.StageConfig = map[string]json.RawMessage{PolicyStage: policy, SyncAnnotationStage: sync}
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// tenancyNamespaces are the namespaces of the tenancy tests, by labels.
+var tenancyNamespaces = fixedNamespaces{
+	"team-a-web": nil, "team-a-api": nil, "team-b-api": nil, "team-b-web": nil,
+	"ingress-nginx": nil, "monitoring": nil, "platform": {"tenant": "platform"},
+}
+
+// The targets a secret's namespace may not sync to are removed with a
+// warning, and a secret left without any is skipped. Namespaces of no
+// tenant and the cluster default are not restricted.
+func TestTenancy(t *testing.T) {
+	m := tenancyMutator(t, false)
+	if !m.NeedsNamespaces() {
+		t.Fatal("tenant selecting namespaces by label doesn't ask for the namespaces")
+	}
+	for _, tt := range []struct {
+		name      string
+		namespace string
+		profile   string
+		want      string   // sync value, empty when skipped
+		denied    []string // in the warning, none when empty
+	}{
+		{name: "allowed", namespace: "team-a-web", profile: "edge", want: "kubernetes.io/metadata.name in (ingress-nginx,team-a-web)"},
+		{name: "partially allowed", namespace: "team-a-web", profile: "mixed", want: "kubernetes.io/metadata.name in (team-a-api)",
+			denied: []string{"monitoring", "team-b-api"}},
+		{name: "fully denied", namespace: "team-a-web", profile: "team-b", denied: []string{"team-b-api", "team-b-web"}},
+		{name: "cluster default", namespace: "team-a-web", want: "true"},
+		{name: "no tenant", namespace: "team-b-api", profile: "mixed", want: "kubernetes.io/metadata.name in (monitoring,team-a-api,team-b-api)"},
+		{name: "tenant by label", namespace: "platform", profile: "mixed", want: "kubernetes.io/metadata.name in (monitoring,team-a-api,team-b-api)"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := tlsSecret(tt.namespace, "api-tls", nil)
+			if tt.profile != "" {
+				secret.Annotations[ProfileAnnotationKey] = tt.profile
+			}
+			decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret, Namespaces: tenancyNamespaces})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if decision.Mutate || decision.SkipReason != SkipTargetsDenied || patch != nil {
+					t.Errorf("mutate %v, skipped for %q with %v, want skipped for %s", decision.Mutate, decision.SkipReason, patch, SkipTargetsDenied)
+				}
+			} else if got := applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]; got != tt.want {
+				t.Errorf("synced to %q, want %q", got, tt.want)
+			}
+			if len(tt.denied) == 0 {
+				if len(decision.Warnings) != 0 {
+					t.Errorf("warnings %q", decision.Warnings)
+				}
+				return
+			}
+			if len(decision.Warnings) != 1 || !strings.Contains(decision.Warnings[0], "may not be synced to "+strings.Join(tt.denied, ", ")) {
+				t.Errorf("warnings %q, want %v removed", decision.Warnings, tt.denied)
+			}
+		})
+	}
+}
+
+// In strict mode a disallowed target fails the evaluation with the
+// namespaces denied, however many targets are allowed.
+func TestTenancyStrict(t *testing.T) {
+	m := tenancyMutator(t, true)
+	for _, tt := range []struct {
+		profile string
+		denied  []string
+	}{
+		{profile: "edge"},
+		{profile: "mixed", denied: []string{"monitoring", "team-b-api"}},
+		{profile: "team-b", denied: []string{"team-b-api", "team-b-web"}},
+	} {
+		secret := tlsSecret("team-a-web", "api-tls", map[string]string{ProfileAnnotationKey: tt.profile})
+		decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret, Namespaces: tenancyNamespaces})
+		var deniedErr *TargetsDeniedError
+		if len(tt.denied) == 0 {
+			if err != nil || !decision.Mutate || patch == nil {
+				t.Errorf("%s: mutate %v with %v: %v", tt.profile, decision.Mutate, patch, err)
+			}
+			continue
+		}
+		if !errors.As(err, &deniedErr) || deniedErr.Namespace != "team-a-web" || !slices.Equal(deniedErr.Denied, tt.denied) {
+			t.Errorf("%s: error %v, want %v denied", tt.profile, err, tt.denied)
+		}
+	}
+}
+
+// The targets of the other stages deriving them from the secret are
+// restricted too.
+func TestTenancyTargetStages(t *testing.T) {
+	m := tenancyMutator(t, false, PolicyStage, IstioGatewayStage, DNSTargetsStage)
+	certificates := fixedCertificates{"team-a-web/api-tls": {"team-a-api.internal.example.com", "team-b-api.internal.example.com"}}
+	secret := tlsSecret("team-a-web", "api-tls", map[string]string{IstioGatewayAnnotationKey: "true"})
+	namespaces := fixedNamespaces{"team-a-web": nil, "team-a-api": nil, "team-b-api": nil}
+	decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret,
+		Namespaces: namespaces, Certificates: certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := applyPatch(t, secret, patch).Annotations[SyncAnnotationKey]; got != "kubernetes.io/metadata.name in (team-a-api)" {
+		t.Errorf("synced to %q, want team-a-api only", got)
+	}
+	if len(decision.Warnings) != 1 || !strings.Contains(decision.Warnings[0], "may not be synced to istio-system, team-b-api") {
+		t.Errorf("warnings %q, want istio-system and team-b-api removed", decision.Warnings)
+	}
+}
+
+func TestTenancyConfig(t *testing.T) {
+	for _, tt := range []struct {
+		tenant Tenant
+		want   string
+	}{
+		{tenant: Tenant{SourceNamespaces: []string{"a"}}, want: "tenant 0 has no name"},
+		{tenant: Tenant{Name: "a", AllowedTargets: []string{"a"}}, want: `tenant "a": neither sourceNamespaces nor namespaceSelector`},
+		{tenant: Tenant{Name: "a", SourceNamespaces: []string{"team-[a"}}, want: `tenant "a": pattern "team-[a"`},
+		{tenant: Tenant{Name: "a", SourceNamespaces: []string{"a"}, AllowedTargets: []string{"[b"}}, want: `tenant "a": pattern "[b"`},
+		{tenant: Tenant{Name: "a", NamespaceSelector: "tenant in a"}, want: `tenant "a": namespaceSelector`},
+	} {
+		settings, err := json.Marshal(PolicyConfig{Tenancy: TenancyConfig{Tenants: []Tenant{tt.tenant}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := DefaultConfig()
+		config.StageConfig = map[string]json.RawMessage{PolicyStage: settings}
+		if _, err := New(config); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: error %v, want %q", tt.tenant, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package mutator
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DebugAnnotationKey set to "true" on a secret, e.g. through the
+// secretTemplate of its Certificate, has the evaluation of that secret
+// traced in Decision.Trace, without raising the verbosity of every other.
+const DebugAnnotationKey = "cert-sync.bygui86.io/debug"
+
+// Traced reports whether the evaluation of secret is traced.
+func Traced(secret *corev1.Secret) bool {
+	return secret != nil && secret.Annotations[DebugAnnotationKey] == "true"
+}
+
+// tracef adds a step to the trace of decision, when it is traced.
+func (d *Decision) tracef(format string, args ...interface{}) {
+	if d.traced {
+		d.Trace = append(d.Trace, fmt.Sprintf(format, args...))
+	}
+}
+
+// outcome renders the result of a matcher in the trace.
+func outcome(matched bool) string {
+	if matched {
+		return "matched"
+	}
+	return "not matched"
+}
+
+// traceAnnotations renders annotations in the trace, sorted by key.
+func traceAnnotations(annotations map[string]string) string {
+	entries := make([]string, 0, len(annotations))
+	for _, key := range sortedKeys(annotations) {
+		entries = append(entries, fmt.Sprintf("%s=%q", key, annotations[key]))
+	}
+	return "{" + strings.Join(entries, ", ") + "}"
+}
@@ -0,0 +1,105 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// traceMutator returns a mutator with signatures and rules for the trace to
+// show.
+func traceMutator(t *testing.T) *Mutator {
+	t.Helper()
+	policy, err := json.Marshal(PolicyConfig{
+		SignaturePresets: []string{PresetCertManager},
+		Rules: []Rule{
+			{Name: "platform", MatchExpression: `object.metadata.name.startsWith("wildcard-")`},
+			{Name: "default"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.StageConfig = map[string]json.RawMessage{PolicyStage: policy}
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// A secret annotated for debugging gets the matchers evaluated with their
+// outcome, the stages and the annotations set in its trace; the others
+// get none.
+func TestTrace(t *testing.T) {
+	m := traceMutator(t)
+	secret := tlsSecret("apps", "api-tls", map[string]string{DebugAnnotationKey: "true"})
+	secret.Data = map[string][]byte{"tls.key": []byte("private-key-material")}
+	decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret})
+	if err != nil || patch == nil {
+		t.Fatalf("patch %v: %v", patch, err)
+	}
+	trace := strings.Join(decision.Trace, "\n")
+	for _, step := range []string{
+		"evaluating CREATE of secret apps/api-tls, type kubernetes.io/tls",
+		"annotations precomputed: {" + ManagedByAnnotationKey,
+		"signature " + PresetCertManager + ": matched",
+		"rule platform: not matched",
+		"rule default: matched",
+		"stage " + PolicyStage + ": 0 patch operations",
+		"decision recorded as default@",
+		"rule default, annotations {" + DecisionAnnotationKey,
+		SyncAnnotationKey + `="true"`,
+	} {
+		if !strings.Contains(trace, step) {
+			t.Errorf("no %q in the trace:\n%s", step, trace)
+		}
+	}
+	if strings.Contains(trace, "private-key-material") {
+		t.Errorf("secret data in the trace:\n%s", trace)
+	}
+
+	for _, value := range []string{"", "false", "yes"} {
+		annotations := map[string]string{}
+		if value != "" {
+			annotations[DebugAnnotationKey] = value
+		}
+		decision, _, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: tlsSecret("apps", "api-tls", annotations)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.Trace != nil {
+			t.Errorf("debug annotation %q: traced %q", value, decision.Trace)
+		}
+	}
+}
+
+// Secrets skipped, or already up to date, are traced up to why.
+func TestTraceSkipped(t *testing.T) {
+	m := traceMutator(t)
+	opaque := tlsSecret("apps", "api-tls", map[string]string{DebugAnnotationKey: "true"})
+	opaque.Type = "Opaque"
+	decision, _, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: opaque})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(decision.Trace); n < 2 || decision.Trace[n-2] != "skipped: "+SkipNotTLS || !strings.HasPrefix(decision.Trace[n-1], "stage "+PolicyStage+" skipped") {
+		t.Errorf("trace %q, want the skip last", decision.Trace)
+	}
+
+	secret := tlsSecret("apps", "api-tls", map[string]string{DebugAnnotationKey: "true"})
+	_, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision, _, err = m.Evaluate(context.Background(), AdmissionContext{Operation: "UPDATE", Secret: applyPatch(t, secret, patch)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.SkipReason != SkipNoChanges || !slices.ContainsFunc(decision.Trace, func(step string) bool { return strings.HasPrefix(step, "nothing to patch") }) {
+		t.Errorf("up to date: skipped for %q, trace %q", decision.SkipReason, decision.Trace)
+	}
+}
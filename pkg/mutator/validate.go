@@ -0,0 +1,170 @@
+package mutator
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// PatchViolationError is returned by Evaluate when a patch would set
+// annotations or labels the API server rejects, in strict mode. The
+// admission is denied.
+type PatchViolationError struct {
+	Violations []string
+}
+
+func (e *PatchViolationError) Error() string {
+	return "invalid patch: " + strings.Join(e.Violations, "; ")
+}
+
+// DeniesAdmission makes PatchViolationError a DeniedError.
+func (e *PatchViolationError) DeniesAdmission() {}
+
+// patchViolation is an entry of a patch the API server would reject.
+type patchViolation struct {
+	path   string // of the map, annotationsPath or labelsPath
+	key    string
+	reason string
+}
+
+func (v patchViolation) String() string {
+	kind := "annotation"
+	if v.path == labelsPath {
+		kind = "label"
+	}
+	return fmt.Sprintf("%s %s dropped: %s", kind, v.key, v.reason)
+}
+
+// checkMetadataEntry returns why the API server would reject the
+// annotation or label key set to value, empty when it wouldn't: keys are
+// qualified names, a prefix of at most 253 characters and a name of at most
+// 63, annotation keys in any case; label values are at most 63 characters of
+// a restricted set, and annotation values valid UTF-8.
+func checkMetadataEntry(path, key, value string) string {
+	var errs []string
+	if path == annotationsPath {
+		errs = validation.IsQualifiedName(strings.ToLower(key))
+		if !utf8.ValidString(value) {
+			errs = append(errs, "value is not valid UTF-8")
+		}
+	} else {
+		errs = append(validation.IsQualifiedName(key), validation.IsValidLabelValue(value)...)
+	}
+	return strings.Join(errs, "; ")
+}
+
+// validatePatch drops from patch the annotations and labels it sets that the
+// API server would reject, which would fail the whole write of the secret,
+// and returns the violations. Once the others are applied to existing, the
+// secret's annotations, the largest added annotations are dropped until
+// they fit in TotalAnnotationSizeLimitB. patch is returned as it is when
+// nothing is dropped.
+func validatePatch(existing map[string]string, patch []PatchOperation) ([]PatchOperation, []patchViolation) {
+	var violations []patchViolation
+	check := func(path, key string, value interface{}) bool {
+		s, _ := value.(string)
+		if reason := checkMetadataEntry(path, key, s); reason != "" {
+			violations = append(violations, patchViolation{path: path, key: key, reason: reason})
+			return false
+		}
+		return true
+	}
+	out := filterMetadataEdits(patch, check)
+
+	// the annotations once patched, and those the patch adds
+	annotations := maps.Clone(existing)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	var added []string
+	_ = filterMetadataEdits(out, func(path, key string, value interface{}) bool {
+		if path == annotationsPath {
+			annotations[key], _ = value.(string)
+			added = append(added, key)
+		}
+		return true
+	})
+	for _, op := range out {
+		if path, key, ok := metadataKey(op.Path); ok && path == annotationsPath && op.Op == "remove" {
+			delete(annotations, key)
+		}
+	}
+	if apivalidation.ValidateAnnotationsSize(annotations) == nil {
+		if len(violations) == 0 {
+			return patch, nil
+		}
+		return out, violations
+	}
+	sort.SliceStable(added, func(i, j int) bool {
+		return len(added[i])+len(annotations[added[i]]) > len(added[j])+len(annotations[added[j]])
+	})
+	dropped := map[string]bool{}
+	for _, key := range added {
+		if apivalidation.ValidateAnnotationsSize(annotations) == nil {
+			break
+		}
+		if value, ok := existing[key]; ok {
+			annotations[key] = value
+		} else {
+			delete(annotations, key)
+		}
+		dropped[key] = true
+		violations = append(violations, patchViolation{path: annotationsPath, key: key,
+			reason: fmt.Sprintf("the annotations would exceed %d bytes", apivalidation.TotalAnnotationSizeLimitB)})
+	}
+	out = filterMetadataEdits(out, func(path, key string, _ interface{}) bool {
+		return path != annotationsPath || !dropped[key]
+	})
+	return out, violations
+}
+
+// filterMetadataEdits returns the operations of patch keeping only the
+// annotations and labels set for which keep is true. Operations adding a
+// whole map are copied before being filtered, and dropped once empty.
+func filterMetadataEdits(patch []PatchOperation, keep func(path, key string, value interface{}) bool) []PatchOperation {
+	out := make([]PatchOperation, 0, len(patch))
+	for _, op := range patch {
+		if op.Op != "add" && op.Op != "replace" {
+			out = append(out, op)
+			continue
+		}
+		if op.Path == annotationsPath || op.Path == labelsPath {
+			values, ok := stringMap(op.Value)
+			if !ok {
+				out = append(out, op)
+				continue
+			}
+			kept := make(map[string]interface{}, len(values))
+			for _, key := range sortedKeys(values) {
+				if keep(op.Path, key, values[key]) {
+					kept[key] = values[key]
+				}
+			}
+			if len(kept) > 0 {
+				op.Value = kept
+				out = append(out, op)
+			}
+			continue
+		}
+		if path, key, ok := metadataKey(op.Path); ok && !keep(path, key, op.Value) {
+			continue
+		}
+		out = append(out, op)
+	}
+	return out
+}
+
+// metadataKey splits a pointer to an annotation or a label.
+func metadataKey(pointer string) (path, key string, ok bool) {
+	for _, path := range []string{annotationsPath, labelsPath} {
+		if key, ok := strings.CutPrefix(pointer, path+"/"); ok {
+			return path, pointerUnescaper.Replace(key), true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,248 @@
+package mutator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+)
+
+// annotateStage is a stage setting the annotations and labels of its
+// settings, whatever they are.
+const annotateStage = "test-annotate"
+
+func init() {
+	Register(annotateStage, func(_ Config, raw json.RawMessage) (Stage, error) {
+		var settings struct {
+			Annotations map[string]string `json:"annotations"`
+			Labels      map[string]string `json:"labels"`
+		}
+		if err := json.Unmarshal(raw, &settings); err != nil {
+			return nil, err
+		}
+		return StageFunc(func(_ context.Context, obj AdmissionContext, decision *Decision) ([]PatchOperation, error) {
+			patch := NewPatchBuilder(obj.Secret)
+			for _, key := range sortedKeys(settings.Annotations) {
+				decision.Annotations[key] = settings.Annotations[key]
+				patch.AddAnnotation(key, settings.Annotations[key])
+			}
+			for _, key := range sortedKeys(settings.Labels) {
+				patch.AddLabel(key, settings.Labels[key])
+			}
+			return patch.Operations()
+		}), nil
+	})
+}
+
+// dnsName returns a DNS subdomain of n characters.
+func dnsName(n int) string {
+	var labels []string
+	for n > 0 {
+		size := min(n, 63)
+		labels = append(labels, strings.Repeat("a", size))
+		n -= size + 1
+	}
+	name := strings.Join(labels, ".")
+	if len(name) > 0 && name[len(name)-1] == '.' {
+		name = name[:len(name)-1] + "a"
+	}
+	return name
+}
+
+func TestCheckMetadataEntry(t *testing.T) {
+	name63, name64 := strings.Repeat("n", 63), strings.Repeat("n", 64)
+	if len(dnsName(253)) != 253 || len(dnsName(254)) != 254 {
+		t.Fatalf("prefixes of %d and %d characters", len(dnsName(253)), len(dnsName(254)))
+	}
+	for _, tt := range []struct {
+		path  string
+		key   string
+		value string
+		want  string // in the reason, valid when empty
+	}{
+		// keys, either map
+		{path: annotationsPath, key: "a", value: "v"},
+		{path: annotationsPath, key: name63},
+		{path: annotationsPath, key: name64, want: "must be no more than 63 bytes"},
+		{path: annotationsPath, key: dnsName(253) + "/" + name63},
+		{path: annotationsPath, key: dnsName(254) + "/a", want: "prefix part must be no more than 253 bytes"},
+		{path: annotationsPath, key: "example.com/" + name64, want: "must be no more than 63 bytes"},
+		{path: annotationsPath, key: "", want: "name part must be non-empty"},
+		{path: annotationsPath, key: "example.com/", want: "name part must be non-empty"},
+		{path: annotationsPath, key: "a/b/c", want: "with an optional DNS subdomain prefix"},
+		{path: annotationsPath, key: "-a", want: "must consist of alphanumeric characters"},
+		{path: annotationsPath, key: "a-", want: "must consist of alphanumeric characters"},
+		{path: annotationsPath, key: "a_b.c-d"},
+		{path: annotationsPath, key: "a b", want: "must consist of alphanumeric characters"},
+		{path: labelsPath, key: name64, want: "must be no more than 63 bytes"},
+		{path: labelsPath, key: "example_com/a", want: "prefix part a lowercase RFC 1123 subdomain"},
+		// case: annotation keys are checked lowercased, labels aren't
+		{path: annotationsPath, key: "Example.COM/Name"},
+		{path: labelsPath, key: "example.com/Name"},
+		{path: labelsPath, key: "Example.com/name", want: "prefix part a lowercase RFC 1123 subdomain"},
+		// annotation values: any length, valid UTF-8
+		{path: annotationsPath, key: "a", value: ""},
+		{path: annotationsPath, key: "a", value: strings.Repeat("v", 64) + " with spaces, ü and 🔒"},
+		{path: annotationsPath, key: "a", value: "\xff", want: "value is not valid UTF-8"},
+		{path: annotationsPath, key: "a", value: "ok\xc3", want: "value is not valid UTF-8"},
+		// label values
+		{path: labelsPath, key: "a", value: ""},
+		{path: labelsPath, key: "a", value: strings.Repeat("v", 63)},
+		{path: labelsPath, key: "a", value: strings.Repeat("v", 64), want: "must be no more than 63 bytes"},
+		{path: labelsPath, key: "a", value: "a_b.c-D"},
+		{path: labelsPath, key: "a", value: "-a", want: "a valid label must be"},
+		{path: labelsPath, key: "a", value: "a b", want: "a valid label must be"},
+		{path: labelsPath, key: "a", value: "ü", want: "a valid label must be"},
+		// both wrong
+		{path: labelsPath, key: "a b", value: "c d", want: "must consist of alphanumeric characters"},
+	} {
+		got := checkMetadataEntry(tt.path, tt.key, tt.value)
+		if tt.want == "" && got != "" || tt.want != "" && !strings.Contains(got, tt.want) {
+			t.Errorf("%s %q=%q: %q, want %q", tt.path, tt.key, tt.value, got, tt.want)
+		}
+	}
+}
+
+// The invalid entries are dropped from the operations setting them one by
+// one and from those adding a whole map, which are dropped once empty.
+func TestValidatePatchEntries(t *testing.T) {
+	valid := []PatchOperation{
+		{Op: "add", Path: annotationsPath + "/a", Value: "v"},
+		{Op: "add", Path: labelsPath, Value: map[string]interface{}{"team": "payments"}},
+	}
+	if got, violations := validatePatch(nil, valid); len(violations) != 0 || &got[0] != &valid[0] {
+		t.Errorf("valid patch changed to %+v with %v", got, violations)
+	}
+
+	patch := []PatchOperation{
+		{Op: "add", Path: annotationsPath, Value: map[string]interface{}{"good": "v", "bad key": "v", "bad-value": "\xff"}},
+		{Op: "replace", Path: annotationsPath + "/example.com~1" + strings.Repeat("n", 64), Value: "v"},
+		{Op: "add", Path: labelsPath, Value: map[string]interface{}{"team": "a b"}},
+		{Op: "add", Path: labelsPath + "/env", Value: "prod"},
+		{Op: "remove", Path: annotationsPath + "/bad key"},
+	}
+	got, violations := validatePatch(nil, patch)
+	want := []PatchOperation{
+		{Op: "add", Path: annotationsPath, Value: map[string]interface{}{"good": "v"}},
+		{Op: "add", Path: labelsPath + "/env", Value: "prod"},
+		{Op: "remove", Path: annotationsPath + "/bad key"},
+	}
+	if !patchesEqual(got, want) {
+		t.Errorf("patch %+v, want %+v", got, want)
+	}
+	var keys []string
+	for _, violation := range violations {
+		keys = append(keys, violation.key)
+	}
+	if !slices.Equal(keys, []string{"bad key", "bad-value", "example.com/" + strings.Repeat("n", 64), "team"}) {
+		t.Errorf("violations %v", violations)
+	}
+	if msg := violations[3].String(); !strings.HasPrefix(msg, "label team dropped: ") {
+		t.Errorf("violation %q", msg)
+	}
+	if _, ok := patch[0].Value.(map[string]interface{})["bad key"]; !ok {
+		t.Error("the operations of the patch given modified")
+	}
+}
+
+// patchesEqual compares patches through their JSON.
+func patchesEqual(a, b []PatchOperation) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
+
+// Added annotations that would take the secret's over the metadata budget
+// are dropped, largest first, until the rest fits; those removed make room.
+func TestValidatePatchSize(t *testing.T) {
+	const limit = apivalidation.TotalAnnotationSizeLimitB
+	// existing takes all the budget but 100 bytes
+	existing := map[string]string{"big": strings.Repeat("x", limit-100-len("big"))}
+	add := func(key string, size int) PatchOperation {
+		return PatchOperation{Op: "add", Path: annotationsPath + "/" + key, Value: strings.Repeat("v", size-len(key))}
+	}
+
+	// exactly at the budget
+	patch := []PatchOperation{add("a", 60), add("b", 40)}
+	if got, violations := validatePatch(existing, patch); len(violations) != 0 || len(got) != 2 {
+		t.Errorf("at the budget: %d operations kept, violations %v", len(got), violations)
+	}
+
+	// a byte over: the largest goes
+	patch = []PatchOperation{add("a", 60), add("b", 41)}
+	got, violations := validatePatch(existing, patch)
+	if len(got) != 1 || got[0].Path != annotationsPath+"/b" || len(violations) != 1 || violations[0].key != "a" ||
+		!strings.Contains(violations[0].String(), "the annotations would exceed 262144 bytes") {
+		t.Errorf("a byte over: %+v, violations %v", got, violations)
+	}
+
+	// an annotation replaced counts at its new size, and is only restored
+	// when dropped
+	patch = []PatchOperation{{Op: "replace", Path: annotationsPath + "/big", Value: strings.Repeat("x", limit)}, add("c", 10)}
+	got, violations = validatePatch(existing, patch)
+	if len(got) != 1 || got[0].Path != annotationsPath+"/c" || len(violations) != 1 || violations[0].key != "big" {
+		t.Errorf("replaced over: %+v, violations %v", got, violations)
+	}
+
+	// removed annotations make room
+	patch = []PatchOperation{{Op: "remove", Path: annotationsPath + "/big"}, add("d", 1000)}
+	if got, violations := validatePatch(existing, patch); len(violations) != 0 || len(got) != 2 {
+		t.Errorf("with room made: %+v, violations %v", got, violations)
+	}
+}
+
+// The entries dropped are warned about and left out of the decision, or
+// deny the admission in strict mode; a patch left empty skips the secret.
+func TestEvaluatePatchValidation(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		config := DefaultConfig()
+		config.Stages = []string{PolicyStage, SyncAnnotationStage, annotateStage}
+		config.StageConfig = map[string]json.RawMessage{annotateStage: json.RawMessage(`{"annotations":{"bad key":"v","owner":"payments"},"labels":{"team":"a b"}}`)}
+		config.StrictPatchValidation = strict
+		m, err := New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret := tlsSecret("apps", "api-tls", nil)
+		decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: secret})
+		if strict {
+			var violation *PatchViolationError
+			var denied DeniedError
+			if !errors.As(err, &violation) || len(violation.Violations) != 2 || !errors.As(err, &denied) || patch != nil {
+				t.Errorf("strict: error %v with %+v, want the two entries denied", err, patch)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched := applyPatch(t, secret, patch)
+		if _, ok := patched.Annotations["bad key"]; ok || patched.Annotations["owner"] != "payments" || len(patched.Labels) != 0 {
+			t.Errorf("annotations %v, labels %v", patched.Annotations, patched.Labels)
+		}
+		if _, ok := decision.Annotations["bad key"]; ok || decision.Annotations["owner"] != "payments" {
+			t.Errorf("decided annotations %v", decision.Annotations)
+		}
+		if len(decision.Warnings) != 2 || !strings.HasPrefix(decision.Warnings[0], "annotation bad key dropped") ||
+			!strings.HasPrefix(decision.Warnings[1], "label team dropped") {
+			t.Errorf("warnings %q", decision.Warnings)
+		}
+	}
+
+	// nothing left to patch
+	config := DefaultConfig()
+	config.Stages = []string{annotateStage}
+	config.StageConfig = map[string]json.RawMessage{annotateStage: json.RawMessage(`{"annotations":{"bad key":"v"}}`)}
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision, patch, err := m.Evaluate(context.Background(), AdmissionContext{Operation: "CREATE", Secret: tlsSecret("apps", "api-tls", nil)})
+	if err != nil || patch != nil || decision.SkipReason != SkipNoChanges || len(decision.Warnings) != 1 {
+		t.Errorf("skipped for %q with %+v, warnings %q: %v", decision.SkipReason, patch, decision.Warnings, err)
+	}
+}
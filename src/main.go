@@ -1,63 +0,0 @@
-package main
-
-import (
-	"context"
-	"crypto/tls"
-	"fmt"
-	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
-	"flag"
-	"log"
-)
-
-func GetEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
-	}
-	return fallback
-}
-
-func main() {
-	flag.Parse()
-
-	// get command line parameters
-	webhookPort := GetEnv("WEBHOOK_PORT", "443")
-	certFile := GetEnv("WEBHOOK_CERT", "/etc/webhook/certs/tls.crt")
-	keyFile := GetEnv("WEBHOOK_KEY", "/etc/webhook/certs/tls.key")
-
-	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		log.Printf("Failed to load key pair: %v", err)
-	}
-
-	whsvr := &WebhookServer{
-		server: &http.Server{
-			Addr:      fmt.Sprintf(":%v", webhookPort),
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
-		},
-	}
-
-	// define http server and server handler
-	mux := http.NewServeMux()
-	mux.HandleFunc("/mutate", whsvr.serve)
-	whsvr.server.Handler = mux
-
-	// start webhook server in new routine
-	go func() {
-		if err := whsvr.server.ListenAndServeTLS("", ""); err != nil {
-			log.Printf("Failed to listen and serve webhook server: %v", err)
-		}
-	}()
-
-	log.Print("Server started")
-
-	// listening OS shutdown singal
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChan
-
-	log.Print("Got OS shutdown signal, shutting down webhook server gracefully...")
-	whsvr.server.Shutdown(context.Background())
-}